@@ -18,61 +18,333 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"os/user"
 	"path/filepath"
 	"regexp"
 	goruntime "runtime"
+	"strings"
+	"time"
 
 	log "github.com/golang/glog"
 	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/rs/xid"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/transport"
+
+	corev1 "k8s.io/api/core/v1"
 
 	"github.com/cruise-automation/isopod/pkg/cloud"
+	"github.com/cruise-automation/isopod/pkg/cloud/onprem"
+	"github.com/cruise-automation/isopod/pkg/flags"
+	"github.com/cruise-automation/isopod/pkg/helm"
+	"github.com/cruise-automation/isopod/pkg/image"
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/loader"
+	"github.com/cruise-automation/isopod/pkg/policy"
 	"github.com/cruise-automation/isopod/pkg/runtime"
+	"github.com/cruise-automation/isopod/pkg/signature"
+	isopodstore "github.com/cruise-automation/isopod/pkg/store"
 	store "github.com/cruise-automation/isopod/pkg/store/kube"
+	"github.com/cruise-automation/isopod/pkg/store/mirror"
 	"github.com/cruise-automation/isopod/pkg/util"
+	"github.com/cruise-automation/isopod/pkg/vault"
 )
 
 var version = "<unknown>"
 
+// watchInterval is how often test files are polled for changes in --watch mode.
+const watchInterval = 500 * time.Millisecond
+
+// helmCache is shared by addons runtimes of all clusters so that identical
+// charts are rendered once per run.
+var helmCache = helm.NewRenderCache()
+
+// imageCache is shared by addons runtimes of all clusters so that each image
+// tag is pinned to the same digest on all clusters.
+var imageCache = image.NewDigestCache()
+
+// tlsPolicy constrains TLS of the Kubernetes and GKE API clients of all
+// clusters (see --tls_min_version and --tls_cipher_suites).
+var tlsPolicy *util.TLSPolicy
+
+// provenance is the git revision of the entry file (nil if not in a git repo
+// or --git_provenance is disabled).
+var provenance *loader.Provenance
+
+// policyChecker checks objects against --policy_dir (nil if disabled).
+var policyChecker *policy.Checker
+
+// circuitBreaker records objects failing to apply on all clusters for
+// --circuit_threshold.
+var circuitBreaker *kube.CircuitBreaker
+
+// applyProfile records apply latencies of objects on all clusters for
+// --profile_applies.
+var applyProfile = kube.NewApplyProfile()
+
+// discoveryCache is shared by addons runtimes of all clusters so that API
+// resources of clusters with identical API surfaces are discovered once per
+// run (nil if --no_discovery_cache).
+var discoveryCache *kube.DiscoveryCache
+
+// snapshotRun is the ID of the run whose snapshots are written under
+// --snapshot_dir (empty if disabled) and restoreRun that of the run the
+// `restore' command undoes.
+var snapshotRun, restoreRun string
+
 var (
 	// required
 	vaultToken = flag.String("vault_token", os.Getenv("VAULT_TOKEN"), "Vault token obtained during authentication.")
-	namespace  = flag.String("namespace", "default", "Kubernetes namespace to store metadata in.")
+	namespace  = flag.String("namespace", "default", "Kubernetes namespace to store metadata in. May contain ${foo} placeholders replaced by --context parameters (e.g isopod-${team}).")
 
 	// optional
 	kubeconfig     = flag.String("kubeconfig", "", "Kubernetes client config path.")
 	addonRegex     = flag.String("match_addons", "", "Filters configured addons based on provided regex.")
-	isopodCtx      = flag.String("context", "", "Comma-separated list of `foo=bar' context parameters passed to the clusters Starlark function.")
-	dryRun         = flag.Bool("dry_run", false, "Print intended actions but don't mutate anything.")
+	isopodCtx      = flag.String("context", "", "Comma-separated list of `foo=bar' context parameters passed to the clusters Starlark function. Values in the form of @path are read from the file at path.")
+	profile        = flag.String("profile", "", "Environment profile (e.g dev or prod) exposed to Starlark as ctx.profile.")
+	preludes       = stringsVar("prelude", "Starlark file whose globals are predeclared in the entry file, addons and tests without load(). May be repeated; files are executed in order and may not shadow built-ins or each other.")
+	dryRunMode     = dryRunVar("dry_run", "One of none (apply), client (print intended actions and diffs but don't mutate anything), server (client, and also send objects to the API server with server-side dry run) or diff (apply and print diffs against live objects). A bare --dry_run means client. The mode must be given with `=', e.g --dry_run=server.")
+	dryRun         = new(bool) // Set from --dry_run by resolveDryRun.
 	svcAcctKeyFile = flag.String("sa_key", "", "Path to the service account json file.")
+	svcAcctKeyJSON = flag.String("sa_key_json", "", "Content of the service account json (used if --sa_key is not set). Defaults to $GOOGLE_CREDENTIALS.")
+	tokenCache     = flag.String("token_cache_file", "", "File to cache GCP OAuth2 tokens in (keyed by credentials identity) so that valid tokens are reused across runs. Defaults to isopod/gcp_tokens.json in the user cache directory.")
+	noTokenCache   = flag.Bool("no_token_cache", false, "Don't cache GCP OAuth2 tokens across runs (see --token_cache_file).")
 	noSpin         = flag.Bool("nospin", false, "Disables command line status spinner.")
-	kubeDiff       = flag.Bool("kube_diff", false, "Print diff against live Kubernetes objects.")
+	kubeDiff       = flag.Bool("kube_diff", false, "Deprecated: use --dry_run=diff.")
+	applyBatch     = flag.Int("apply_batch_size", 1, "Max number of objects passed to a single kube.put/put_yaml call applied concurrently.")
+	applyOrder     = flag.String("apply_order", kube.DefaultApplyOrder, "Comma-separated categories (namespaces, crds, rbac, config, webhooks), kinds (Kind or Kind.group) and * (everything else) in the order objects of a single kube.put_yaml call are applied in (pruned in reverse). Objects are applied in the order given if empty.")
+	conflictRetry  = flag.Int("conflict_retries", 3, "Max number of times an update rejected because the live object was modified concurrently is retried against its latest version (0 disables retries).")
+	deleteCRDs     = flag.Bool("delete_crds", false, "Allow removal of CustomResourceDefinitions (and all their custom resources). CRDs are kept by default.")
+	verboseDiff    = flag.Bool("verbose", false, "Also confirm objects that match their live state in the diff output.")
+	diffOnlyAddons = flag.Bool("diff_only_addons", false, "Omit objects that match their live state from the diff output and print diffs under headers of the addons (and clusters) that change.")
+	diffRulesFile  = flag.String("diff_rules", "", "Path to a YAML file of rules normalizing fields away from both sides of the diff output (in addition to the built-in rules), see README.")
+	diffSecurity   = flag.Bool("diff_security_only", false, "Limit the diff output (and diffs recorded with --diff_store or --diff_markdown) to security-relevant changes: RBAC, network policies, secrets and webhooks in full, and fields such as images, securityContext, capabilities, privileged and hostPath of other objects, see README. Objects without such changes are omitted.")
+	diffSecRules   = flag.String("diff_security_rules", "", "With --diff_security_only, path to a YAML file of the kinds and fields selected instead of the built-in ones, see README.")
+	diffStore      = flag.String("diff_store", "", "In --dry_run mode, also record the diff of each cluster for review in a `configmap' or `secret' in --namespace of the cluster (keyed by cluster and run). Disabled if empty.")
+	diffMaxLines   = flag.Int("diff_max_lines", 0, "Max number of diff lines printed per object (0 means no limit).")
+	singleCluster  = flag.Bool("single_cluster", false, "Skip the clusters Starlark function and run addons once against the current context of --kubeconfig (or of $KUBECONFIG or ~/.kube/config, like kubectl). --context parameters are passed to addons in ctx.")
+	serverDryRun   = flag.Bool("server_dry_run", false, "Deprecated: use --dry_run=server.")
 	showVersion    = flag.Bool("version", false, "Print binary version/system information and exit(0).")
 	relativePath   = flag.String("rel_path", "", "The base path used to interpret double slash prefix.")
+	writeLastApply = flag.Bool("write_last_applied", false, "Stamp the kubectl.kubernetes.io/last-applied-configuration annotation on applied objects (like kubectl apply does) so that kubectl apply on the same objects merges correctly.")
+	instanceID     = flag.String("instance_id", "", "Identifies this Isopod instance; set as the isopod.getcruise.com/managed-by label value on all applied objects.")
+	applySet       = flag.Bool("applyset", false, "Manage objects applied by each addon as an ApplySet with a parent Secret in --namespace (understood by kubectl apply --prune --applyset); --prune lists live objects through it.")
+	watchTests     = flag.Bool("watch", false, "Re-run affected tests whenever Starlark files change (test command only).")
+	allowedWindow  = flag.String("allowed_window", "", "Time window outside of which install and remove refuse to mutate anything, in \"[DAYS] HH:MM-HH:MM [TIMEZONE]\" format (e.g \"Mon-Fri 09:00-17:00 America/Los_Angeles\"). Dry runs are always allowed.")
+	overrideWindow = flag.String("override_window", "", "Reason for mutating outside of --allowed_window (logged). Use for emergencies only.")
+	maxReqDelta    = flag.String("max_request_delta", "", "Comma-separated list of `cpu=10,memory=64Gi' limits on the total change in requested resources of applied Deployments, StatefulSets, DaemonSets and Jobs. Install fails before applying anything if the delta estimated in a dry run exceeds them.")
+	maxObjects     = flag.Int("max_objects_per_addon", 0, "Fail an addon (before applying more) once it passes more than this many objects to kube.put, kube.put_yaml and helm.apply in a single run, unless the addon sets max_objects (0 means no limit).")
+	maxAddons      = flag.Int("max_addons", 0, "Fail if the addons Starlark function returns more than this many addons (0 means no limit).")
+	addonTimeout   = flag.Duration("addon_timeout", 0, "Max time to load and install (or remove) a single addon, e.g 10m (0 means no limit).")
+	prune          = flag.Bool("prune", false, "Delete objects applied by an addon in the live rollout that the addon no longer applies (install command only).")
+	resume         = flag.Bool("resume", false, "Skip objects applied (and not changed since) by the previous install that failed on the cluster (install command only).")
+	reportStatus   = flag.Bool("report_status", false, "Print status of applied objects (e.g ready replicas of Deployments and endpoints of Services) once the rollout is live (install command only).")
+	listFormat     = flag.String("list_format", "text", "Format list command prints addons of each cluster in: text or json (a line of JSON per cluster).")
+	withObjects    = flag.Bool("with_objects", false, "With list command and --list_format=json, render each addon (in a silent dry run) and include kinds of objects it applies. Addons failing to render are listed with the error.")
+	watchResources = flag.Bool("watch_resources", false, "Once the rollout is live, tail status changes and events of applied objects until all of them are healthy or interrupted (install command only, skipped if stdout is not a terminal or $CI is set).")
+	allowDeprec    = flag.Bool("allow_deprecated", false, "Install addons past the sunset date they are deprecated with (see README) rather than fail.")
+	verifyIdent    = flag.Bool("verify_cluster_identity", false, "Before mutating a cluster, verify that the connected cluster is the one targeted: the UID of kube-system must match the cluster's cluster_uid field and/or keys of ConfigMap kube-system/isopod-cluster-identity must match its fields (see README). Recommended for production.")
+	noDiscCache    = flag.Bool("no_discovery_cache", false, "Discover API resources of the cluster for every object mapped rather than once per cluster, reusing those of clusters with the same server version and group versions within the run (see README).")
+	metricsFile    = flag.String("metrics_textfile", "", "Directory to write OpenMetrics .prom files of each addon installed on each cluster to (e.g last run status and duration, applied objects, last success timestamp) for the node_exporter textfile collector. Disabled if empty.")
+	statusTimeout  = flag.Duration("status_timeout", 10*time.Second, "Max time to read back status of applied objects with --report_status, each poll of --watch_resources or the status command (0 means no limit).")
+	keepLeases     = flag.Bool("keep_leases", false, "Keep leases of dynamic Vault secrets read during the run (revoked on exit by default).")
+	vaultPreflight = flag.Bool("vault_preflight", false, "Before installing, evaluate all selected addons in a silent dry run and fail if the Vault token lacks capabilities on any path they read or write (install command only).")
+	vaultConc      = flag.Int("vault_concurrency", 8, "Max number of secrets a single vault.read_all call reads from Vault at once.")
+	stages         = flag.String("stages", "", "Comma-separated list of cluster stages (the `stage' attribute of clusters, e.g canary,prod) to roll out to in order. Clusters of other stages are skipped.")
+	continueStages = flag.Bool("continue_on_stage_failure", false, "With --stages, roll out to the next stage even if the previous one had failures (halts by default).")
+	bakeTime       = flag.Duration("bake_time", 0, "With --stages, time to wait in between stages, e.g 30m (skipped in --dry_run mode).")
+	explainSel     = flag.Bool("explain_selection", false, "Print whether each addon is selected on each cluster (and why) instead of running the command.")
+	interactive    = flag.Bool("interactive", false, "Preview changes of each addon on each cluster and ask whether to apply them (install command only).")
+	assumeYes      = flag.Bool("yes", false, "Apply all changes without asking in --interactive mode (required if stdin is not a terminal).")
+	dumpGlobals    = flag.String("dump_starlark_globals", "", "Print all predeclared Starlark globals (built-in packages and functions) available to addons in `text' or `json' format and exit.")
+	noNetwork      = flag.Bool("no_network", false, "Don't access image registries, git remotes or module servers: image.resolve returns image references with their tags unresolved, git:: entry files are loaded from --git_cache_dir and modules loaded by URL from --module_cache_dir.")
+	gitCacheDir    = flag.String("git_cache_dir", "", "Directory that git:: entry files are cloned to (defaults to isopod/git under the user cache dir).")
+	moduleCacheDir = flag.String("module_cache_dir", "", "Directory that modules loaded by URL (pinned to their sha256 digest) are cached in (defaults to isopod/modules under the user cache dir). With --no_network, only cached modules can be loaded.")
+	coexistAnnos   = flag.String("coexist_annotations", "", "Comma-separated list of `foo=bar' annotations stamped on all applied objects so that other controllers (e.g ArgoCD) ignore them.")
+	mirrorStoreCfg = flag.String("mirror_store_kubeconfig", "", "Kubernetes client config path of a cluster to mirror rollout metadata to (read if missing in the target cluster). Failing to write to the mirror is logged but doesn't fail the run.")
+	mirrorStoreNS  = flag.String("mirror_store_namespace", "", "Kubernetes namespace to mirror metadata to (defaults to --namespace).")
+	verifySig      = flag.String("verify_signature", "", "Path to a cosign signature (as written by cosign sign-blob) of the tree of files under the entry file directory (or --rel_path) that must verify against --signature_key before running, see README. Disabled if empty.")
+	signatureKey   = flag.String("signature_key", "", "Path to the PEM-encoded cosign public key that --verify_signature is checked against.")
+	profileApplies = flag.Int("profile_applies", 0, "Print a table of the N slowest object applies (across all clusters) at the end of the run (0 disables it).")
+	createStoreNS  = flag.Bool("create_store_namespace", false, "Create --namespace in each cluster if it does not exist (fails otherwise).")
+	storeSA        = flag.String("store_service_account", store.DefaultServiceAccount, "ServiceAccount in --namespace that store init grants access to the rollout store.")
+	snapshotDir    = flag.String("snapshot_dir", "", "Directory to write the live state of each object to (under the ID of the run) before it is updated or deleted, e.g to undo the run with the restore command. Disabled if empty.")
+	snapshotMax    = flag.Int64("snapshot_max_bytes", 100<<20, "With --snapshot_dir, max total size of snapshots of each cluster. Objects that would exceed it are not snapshotted (with a warning). Unbounded if not positive.")
+	snapshotSecret = flag.Bool("snapshot_secrets", false, "With --snapshot_dir, keep Secret data in snapshots (redacted by default).")
+	removeTimeout  = flag.Duration("remove_timeout", 0, "Max time to wait for each object deleted by kube.delete (e.g in remove) to be gone, e.g 5m. Fails the addon if exceeded unless --force_delete_finalizers is set (0 means don't wait).")
+	forceFinalizer = flag.Bool("force_delete_finalizers", false, "With --remove_timeout, remove finalizers of objects still not deleted once it expires (logged). Whatever the finalizers clean up may be left behind.")
+	helmReleases   = flag.Bool("helm_release_tracking", false, "Record releases applied by helm.apply as Helm 3 release Secrets (sh.helm.release.v1.<name>.v<revision>) so that helm list, helm history and helm rollback work with them.")
+	diffMarkdown   = flag.String("diff_markdown", "", "In --dry_run mode, also write a Markdown summary of the diffs (total change count and a collapsible fenced diff per addon and cluster) to this file at the end of the run, e.g to post it as a review comment. Disabled if empty.")
+	regRewrite     = flag.String("registry_rewrite", "", "Comma separated <from>=<to> registries rewritten in image references of applied objects, e.g docker.io=registry.internal/docker,gcr.io=registry.internal/gcr (tags and digests are kept). Disabled if empty.")
+	rewritePaths   = flag.String("registry_rewrite_paths", "", "With --registry_rewrite, path to a YAML file of image fields (e.g of CRDs) rewritten in addition to containers of Pod specs, see README.")
+	circuitThresh  = flag.Int("circuit_threshold", 0, "Stop applying an object on remaining clusters once it failed with the same error on more than this many clusters (e.g a webhook down fleet-wide), reported once at the end of the run (0 disables it).")
+	sopsBinary     = flag.String("sops_binary", "sops", "Path to the sops binary used by sops.decrypt.")
+	sopsAgeKey     = flag.String("sops_age_key_file", "", "File with age private keys sops.decrypt passes to sops (as SOPS_AGE_KEY_FILE). Uses sops' own defaults if empty.")
+	flagsFile      = flag.String("flags_file", "", "YAML file of feature flags evaluated by flags.enabled (see README). Disabled if empty.")
+	consistGroup   = flag.String("group", "", "With consistency command, cluster ctx attribute (e.g env) to group clusters by, objects are compared between clusters of the same group. All clusters are compared if empty.")
+	tlsMinVersion  = flag.String("tls_min_version", util.DefaultTLSMinVersion, "Minimum TLS version (1.0, 1.1, 1.2 or 1.3) of the Kubernetes and GKE API clients.")
+	tlsCiphers     = flag.String("tls_cipher_suites", "", "Comma separated TLS 1.0-1.2 cipher suites (Go names, e.g TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) allowed for the Kubernetes and GKE API clients. Go's secure defaults if empty.")
+	histCluster    = flag.String("cluster", "", "With history command, only print history of the cluster with this name (as printed in logs) or API server address.")
+	gitProvenance  = flag.Bool("git_provenance", true, "Detect the git commit, branch and dirty state of the repo containing the entry file, annotate applied objects with it and record it with addon runs in the rollout store.")
+	appliedByName  = flag.String("applied_by", "", "Recorded with addon runs in the rollout store as who applied them (defaults to <user>@<host>).")
+	chartDir       = flag.String("chart_dir", "", "With export-chart command, directory to write the Helm chart to (defaults to the addon name).")
+	objectFilter   = flag.String("object_filter", "", "Starlark expression deciding which objects of all addons are applied, deleted and pruned, e.g 'obj.kind == \"NetworkPolicy\"' (see README). Objects it returns False for are skipped.")
+	flagsURL       = flag.String("flags_url", "", "URL to fetch feature flags evaluated by flags.enabled from at the start of the run, in the same format as --flags_file (as JSON). Overrides values of --flags_file. All flags have their default values if fetching fails.")
+	policyDir      = flag.String("policy_dir", "", "Directory of Rego policies (conftest-style deny and warn rules) every object is checked against right before it is applied, also in dry run (see README). Disabled if empty.")
+	policyMode     = flag.String("policy_mode", "deny", "What to do with objects violating deny rules of --policy_dir: deny fails them, warn only logs a warning.")
+	opaBinary      = flag.String("opa_binary", "opa", "Path to the opa binary evaluating --policy_dir.")
 )
 
 func init() {
 	flag.Parse()
-	if *vaultToken == "" {
+	if *vaultToken == "" && *dumpGlobals == "" {
 		log.Fatalf("--vault_token or $VAULT_TOKEN must be set")
 	}
 }
 
+// Modes of --dry_run.
+const (
+	dryRunNone   = "none"
+	dryRunClient = "client"
+	dryRunServer = "server"
+	dryRunDiff   = "diff"
+)
+
+// dryRunFlag is the value of --dry_run. It is a boolean flag so that a bare
+// --dry_run (or --dry_run=true/false) still works as before it took a mode,
+// which is why the mode must be given with `=' (see resolveDryRun).
+type dryRunFlag struct {
+	mode string
+}
+
+func (f *dryRunFlag) String() string {
+	if f == nil || f.mode == "" {
+		return dryRunNone
+	}
+	return f.mode
+}
+
+func (f *dryRunFlag) Set(s string) error {
+	switch s {
+	case "true":
+		f.mode = dryRunClient
+	case "false":
+		f.mode = dryRunNone
+	case dryRunNone, dryRunClient, dryRunServer, dryRunDiff:
+		f.mode = s
+	default:
+		return fmt.Errorf("unknown mode `%s' (must be none, client, server or diff)", s)
+	}
+	return nil
+}
+
+func (f *dryRunFlag) IsBoolFlag() bool { return true }
+
+// dryRunVar defines a dryRunFlag with name and usage (none by default).
+func dryRunVar(name, usage string) *dryRunFlag {
+	f := &dryRunFlag{mode: dryRunNone}
+	flag.Var(f, name, usage)
+	return f
+}
+
+// stringsFlag is the value of a flag that may be repeated, collecting
+// values in the order given.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// stringsVar defines a stringsFlag with name and usage (empty by default).
+func stringsVar(name, usage string) *stringsFlag {
+	f := &stringsFlag{}
+	flag.Var(f, name, usage)
+	return f
+}
+
+// resolveDryRun sets dryRun, serverDryRun and kubeDiff from --dry_run.
+// The deprecated --server_dry_run and --kube_diff booleans map onto it
+// (--dry_run --server_dry_run is server, --kube_diff without --dry_run is
+// diff) with a warning. Exits if a mode follows a bare --dry_run as a
+// separate arg (e.g `--dry_run server install'), which would otherwise be
+// taken as the command.
+func resolveDryRun() {
+	mode := dryRunMode.String()
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dry_run":
+			switch arg := flag.Arg(0); arg {
+			case dryRunNone, dryRunClient, dryRunServer, dryRunDiff, "true", "false":
+				log.Exitf("--dry_run takes its mode with `=', e.g --dry_run=%s (got `%s' as the command)", arg, arg)
+			}
+		case "server_dry_run":
+			log.Warningf("--server_dry_run is deprecated, use --dry_run=server instead")
+			if *serverDryRun && mode == dryRunClient {
+				mode = dryRunServer
+			}
+		case "kube_diff":
+			log.Warningf("--kube_diff is deprecated, use --dry_run=diff instead")
+			if *kubeDiff && mode == dryRunNone {
+				mode = dryRunDiff
+			}
+		}
+	})
+	dryRunMode.mode = mode
+
+	*dryRun = mode == dryRunClient || mode == dryRunServer
+	*serverDryRun = mode == dryRunServer
+	*kubeDiff = mode == dryRunDiff
+}
+
 func usageAndDie() {
 	fmt.Fprintf(os.Stderr, `Isopod, an addons installer framework.
 
 By default, isopod targets all addons on all clusters. One may confine the
 selection with "--match_addons" and "--clusters_selector".
 
-Usage: %s [options] <command> <ENTRYFILE_PATH | TEST_PATH>
+Usage: %s [options] <command> [ADDON] <ENTRYFILE_PATH | TEST_PATH>
 
 The following commands are supported:
 	install        install addons
 	remove         uninstall addons
 	list           list addons in the ENTRYFILE_PATH
+	status         print status of objects applied by addons in the live rollout
+	store gc       delete stale rollout store entries (e.g of addons or
+	               clusters no longer defined in the ENTRYFILE_PATH)
+	store init     create --namespace of each cluster along with the
+	               ServiceAccount and RBAC the rollout store needs
 	test           run unit tests in TEST_PATH
+	export-chart ADDON
+	               write objects rendered by ADDON as a Helm chart of static
+	               templates to --chart_dir
+	history ADDON  print past runs of ADDON recorded in the rollout store
+	               (only on --cluster if set)
+	restore --run ID
+	               undo run ID snapshotted under --snapshot_dir: re-apply
+	               objects as they were before it and delete those it created
+	consistency    render addons (in dry run) and report objects rendered
+	               differently across clusters of the same --group
+
+Exit codes:
+	0              success
+	1              fatal error (e.g invalid flags or ENTRYFILE_PATH)
+	2              some of the selected clusters failed
+	3              all of the selected clusters failed
+	4              objects differ across clusters (consistency only)
 
 The following options are supported:
 `, os.Args[0])
@@ -87,6 +359,34 @@ func getCmdAndPath(argv []string) (cmd runtime.Command, path string) {
 	}
 
 	cmd = runtime.Command(argv[0])
+	if argv[0] == "store" {
+		if len(argv) < 3 {
+			usageAndDie()
+		}
+		switch argv[1] {
+		case "gc":
+			return runtime.StoreGCCommand, argv[2]
+		case "init":
+			return runtime.StoreInitCommand, argv[2]
+		}
+		usageAndDie()
+	}
+	if cmd == runtime.RestoreCommand {
+		fs := flag.NewFlagSet(string(cmd), flag.ExitOnError)
+		run := fs.String("run", "", "ID of the run to undo (printed by the run).")
+		fs.Parse(argv[1:])
+		if *run == "" || fs.NArg() < 1 {
+			usageAndDie()
+		}
+		restoreRun = *run
+		return cmd, fs.Arg(0)
+	}
+	if cmd == runtime.ExportChartCommand || cmd == runtime.HistoryCommand {
+		if len(argv) < 3 {
+			usageAndDie()
+		}
+		return cmd, argv[2]
+	}
 	if len(argv) < 2 {
 		if cmd == runtime.TestCommand {
 			return
@@ -97,21 +397,104 @@ func getCmdAndPath(argv []string) (cmd runtime.Command, path string) {
 	return
 }
 
-func buildClustersRuntime(mainFile string) runtime.Runtime {
+// svcAcctKeyContent returns --sa_key_json or $GOOGLE_CREDENTIALS if not set.
+// The variable is not read as the flag default so that the key is never
+// printed in usage.
+func svcAcctKeyContent() string {
+	if *svcAcctKeyJSON != "" {
+		return *svcAcctKeyJSON
+	}
+	return os.Getenv("GOOGLE_CREDENTIALS")
+}
+
+// tokenCacheFile returns path of the GCP token cache file (empty if disabled).
+func tokenCacheFile() string {
+	if *noTokenCache {
+		return ""
+	}
+	if *tokenCache != "" {
+		return *tokenCache
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		log.Warningf("GCP tokens are not cached: %v", err)
+		return ""
+	}
+	return filepath.Join(dir, "isopod", "gcp_tokens.json")
+}
+
+// whoApplies returns who is recorded as having applied addon runs:
+// --applied_by or <user>@<host> (empty if neither can be told).
+func whoApplies() string {
+	if *appliedByName != "" {
+		return *appliedByName
+	}
+	u, err := user.Current()
+	if err != nil {
+		log.Warningf("Failed to tell who applies addons: %v", err)
+		return ""
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return u.Username
+	}
+	return u.Username + "@" + host
+}
+
+// gitCloneDir returns the directory git:: entry files are cloned to.
+func gitCloneDir() string {
+	if *gitCacheDir != "" {
+		return *gitCacheDir
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		log.Exitf("Failed to find user cache dir for git clones (set --git_cache_dir): %v", err)
+	}
+	return filepath.Join(dir, "isopod", "git")
+}
+
+// httpModules returns the loader option enabling modules loaded by URL.
+func httpModules() loader.Option {
+	return loader.WithHTTPModules(http.DefaultClient, moduleCache(), *noNetwork)
+}
+
+// moduleCache returns the directory modules loaded by URL are cached in.
+func moduleCache() string {
+	if *moduleCacheDir != "" {
+		return *moduleCacheDir
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		log.Warningf("Failed to find user cache dir, modules loaded by URL won't be cached (set --module_cache_dir): %v", err)
+		return ""
+	}
+	return filepath.Join(dir, "isopod", "modules")
+}
+
+func buildClustersRuntime(mainFile string, ua util.UserAgent) runtime.Runtime {
+	opts := []runtime.Option{runtime.WithHTTPModules(http.DefaultClient, moduleCache(), *noNetwork)}
+	if *stages != "" {
+		opts = append(opts, runtime.WithStages(strings.Split(*stages, ","), *continueStages, *bakeTime))
+	}
 	clusters, err := runtime.New(&runtime.Config{
 		EntryFile:         mainFile,
 		GCPSvcAcctKeyFile: *svcAcctKeyFile,
-		UserAgent:         "Isopod/" + version,
+		GCPSvcAcctKeyJSON: svcAcctKeyContent(),
+		GCPTokenCacheFile: tokenCacheFile(),
+		TLSPolicy:         tlsPolicy,
+		UserAgent:         ua,
 		KubeConfigPath:    *kubeconfig,
 		DryRun:            *dryRun,
-	})
+		Profile:           *profile,
+		Preludes:          *preludes,
+	}, opts...)
 	if err != nil {
 		log.Exitf("Failed to initialize clusters runtime: %v", err)
 	}
 	return clusters
 }
 
-func buildAddonsRuntime(kubeC *rest.Config, mainFile string) (runtime.Runtime, error) {
+func buildAddonsRuntime(kubeC *rest.Config, mainFile string, ua util.UserAgent, coexist map[string]string, diffRules []kube.DiffRule, diffRecord func(addonName, out string), renderOpts []kube.Option, maxDelta corev1.ResourceList, prompter *runtime.Prompter, cluster string, extraOpts ...runtime.Option) (runtime.Runtime, error) {
 	vaultC, err := vaultapi.NewClient(nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize Vault client: %v", err)
@@ -119,6 +502,7 @@ func buildAddonsRuntime(kubeC *rest.Config, mainFile string) (runtime.Runtime, e
 	if *vaultToken != "" {
 		vaultC.SetToken(*vaultToken)
 	}
+	vaultC.SetHeaders(http.Header{"User-Agent": []string{ua.For(util.VaultBackend)}})
 
 	cs, err := kubernetes.NewForConfig(kubeC)
 	if err != nil {
@@ -128,24 +512,192 @@ func buildAddonsRuntime(kubeC *rest.Config, mainFile string) (runtime.Runtime, e
 	if helmBaseDir == "" {
 		helmBaseDir = filepath.Dir(mainFile)
 	}
-	st := store.New(cs, *namespace)
+	if err := store.EnsureNamespace(cs, *namespace, *createStoreNS); err != nil {
+		return nil, fmt.Errorf("invalid store namespace: %v", err)
+	}
+	var st isopodstore.Store = store.New(cs, *namespace)
+	if *mirrorStoreCfg != "" {
+		mirrorC, err := clientcmd.BuildConfigFromFlags("", *mirrorStoreCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load mirror store Kubernetes config: %v", err)
+		}
+		mirrorC.UserAgent = ua.For(util.KubeBackend)
+		mirrorCS, err := kubernetes.NewForConfig(mirrorC)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create mirror store Kubernetes clientset: %v", err)
+		}
+		ns := *mirrorStoreNS
+		if ns == "" {
+			ns = *namespace
+		}
+		st = mirror.New(st, store.New(mirrorCS, ns))
+	}
+	order, err := kube.ParseApplyOrder(*applyOrder)
+	if err != nil {
+		return nil, err
+	}
+	kubeOpts := []kube.Option{
+		kube.WithCoexistAnnotations(coexist),
+		kube.WithInstanceID(*instanceID),
+		kube.WithVerboseDiff(*verboseDiff),
+		kube.WithDiffOnlyChanged(*diffOnlyAddons),
+		kube.WithDiffMaxLines(*diffMaxLines),
+		kube.WithDiffRules(diffRules),
+		kube.WithServerDryRun(*serverDryRun),
+		kube.WithWriteLastApplied(*writeLastApply),
+		kube.WithApplyBatchSize(*applyBatch),
+		kube.WithConflictRetries(*conflictRetry),
+		kube.WithApplyOrder(order),
+		kube.WithDeleteCRDs(*deleteCRDs),
+		kube.WithMaxRequestsDelta(maxDelta),
+		kube.WithDeleteTimeout(*removeTimeout, *forceFinalizer),
+		kube.WithMaxObjectsPerAddon(*maxObjects),
+	}
+	if *applySet {
+		kubeOpts = append(kubeOpts, kube.WithApplySet(*namespace))
+	}
+	if provenance != nil {
+		kubeOpts = append(kubeOpts, kube.WithGitProvenance(provenance.Commit, provenance.Branch, provenance.Dirty))
+	}
+	if snapshotRun != "" {
+		kubeOpts = append(kubeOpts, kube.WithSnapshot(filepath.Join(*snapshotDir, snapshotRun), *snapshotMax, *snapshotSecret))
+	}
+	if diffRecord != nil {
+		kubeOpts = append(kubeOpts, kube.WithDiffRecorder(diffRecord))
+	}
+	kubeOpts = append(kubeOpts, renderOpts...)
+	if *diffSecurity {
+		f := kube.DefaultSecurityFilter
+		if *diffSecRules != "" {
+			var err error
+			if f, err = kube.LoadSecurityFilter(*diffSecRules); err != nil {
+				return nil, err
+			}
+		}
+		kubeOpts = append(kubeOpts, kube.WithSecurityDiff(f))
+	}
+	if *objectFilter != "" {
+		f, err := kube.NewObjectFilter(*objectFilter)
+		if err != nil {
+			return nil, err
+		}
+		kubeOpts = append(kubeOpts, kube.WithObjectFilter(f))
+	}
+	if *regRewrite != "" {
+		rewrites, err := image.ParseRegistryRewrites(*regRewrite)
+		if err != nil {
+			return nil, err
+		}
+		var paths []kube.ImagePath
+		if *rewritePaths != "" {
+			if paths, err = kube.LoadImagePaths(*rewritePaths); err != nil {
+				return nil, err
+			}
+		}
+		kubeOpts = append(kubeOpts, kube.WithRegistryRewrites(rewrites, paths))
+	}
+	if discoveryCache != nil {
+		kubeOpts = append(kubeOpts, kube.WithDiscoveryCache(discoveryCache))
+	}
+	if *profileApplies > 0 {
+		kubeOpts = append(kubeOpts, kube.WithApplyProfile(applyProfile, cluster))
+	}
+	if circuitBreaker != nil {
+		kubeOpts = append(kubeOpts, kube.WithCircuitBreaker(circuitBreaker, cluster))
+	}
+	if policyChecker != nil {
+		kubeOpts = append(kubeOpts, kube.WithPolicy(policyChecker))
+	}
+	imageOpts := []image.Option{
+		image.WithUserAgent(ua.For(util.RegistryBackend)),
+		image.WithDigestCache(imageCache),
+	}
+	if !*noNetwork {
+		creds, err := image.NewDockerCredentials()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Docker credentials: %v", err)
+		}
+		imageOpts = append(imageOpts, image.WithCredentials(creds))
+	}
+	helmOpts := []helm.Option{helm.WithRenderCache(helmCache)}
+	if *helmReleases {
+		helmOpts = append(helmOpts, helm.WithReleaseTracking(cs.CoreV1()))
+	}
 	opts := []runtime.Option{
-		runtime.WithVault(vaultC),
-		runtime.WithKube(kubeC, *kubeDiff),
-		runtime.WithHelm(helmBaseDir),
+		runtime.WithVault(vaultC, vault.WithConcurrency(*vaultConc)),
+		runtime.WithKube(kubeC, *kubeDiff, kubeOpts...),
+		runtime.WithHelm(helmBaseDir, helmOpts...),
+		runtime.WithSops(helmBaseDir, *sopsBinary, *sopsAgeKey),
+		runtime.WithReplicateSecret(),
+		runtime.WithImage(http.DefaultClient, *noNetwork, imageOpts...),
 		runtime.WithAddonRegex(regexp.MustCompile(*addonRegex)),
+		runtime.WithCluster(cluster),
+		runtime.WithMaxAddons(*maxAddons),
+		runtime.WithAddonTimeout(*addonTimeout),
+		runtime.WithStatusTimeout(*statusTimeout),
+		runtime.WithHTTPModules(http.DefaultClient, moduleCache(), *noNetwork),
 	}
 	if *noSpin {
 		opts = append(opts, runtime.WithNoSpin())
 	}
+	if prompter != nil {
+		opts = append(opts, runtime.WithInteractive(prompter))
+	}
+	if *explainSel {
+		opts = append(opts, runtime.WithExplainSelection(os.Stdout))
+	}
+	if *keepLeases {
+		opts = append(opts, runtime.WithKeepLeases())
+	}
+	if *vaultPreflight {
+		opts = append(opts, runtime.WithVaultPreflight())
+	}
+	if *prune {
+		opts = append(opts, runtime.WithPrune())
+	}
+	if *resume {
+		opts = append(opts, runtime.WithResume())
+	}
+	if *reportStatus {
+		opts = append(opts, runtime.WithStatusReport())
+	}
+	if *metricsFile != "" {
+		opts = append(opts, runtime.WithMetricsTextfile(*metricsFile))
+	}
+	if *allowDeprec {
+		opts = append(opts, runtime.WithAllowDeprecated())
+	}
+	if *listFormat == "json" {
+		opts = append(opts, runtime.WithListJSON(os.Stdout, *withObjects))
+	}
+	if *watchResources {
+		if isTerminal(os.Stdout) && os.Getenv("CI") == "" {
+			opts = append(opts, runtime.WithWatchResources())
+		} else {
+			log.Info("Not watching applied objects since stdout is not a terminal or $CI is set")
+		}
+	}
+	if who := whoApplies(); who != "" {
+		opts = append(opts, runtime.WithAppliedBy(who))
+	}
+	if provenance != nil {
+		opts = append(opts, runtime.WithSource(provenance.String()))
+	}
+	opts = append(opts, extraOpts...)
 
 	addons, err := runtime.New(&runtime.Config{
 		EntryFile:         mainFile,
 		GCPSvcAcctKeyFile: *svcAcctKeyFile,
-		UserAgent:         "Isopod/" + version,
+		GCPSvcAcctKeyJSON: svcAcctKeyContent(),
+		GCPTokenCacheFile: tokenCacheFile(),
+		TLSPolicy:         tlsPolicy,
+		UserAgent:         ua,
 		KubeConfigPath:    *kubeconfig,
 		Store:             st,
+		Cluster:           kubeC.Host,
 		DryRun:            *dryRun,
+		Profile:           *profile,
+		Preludes:          *preludes,
 	}, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize addons runtime: %v", err)
@@ -154,6 +706,208 @@ func buildAddonsRuntime(kubeC *rest.Config, mainFile string) (runtime.Runtime, e
 	return addons, nil
 }
 
+// parseRequestsDelta parses comma-separated `cpu=<quantity>' and
+// `memory=<quantity>' params.
+func parseRequestsDelta(s string) (corev1.ResourceList, error) {
+	params, err := util.ParseCommaSeparatedParams(s)
+	if err != nil {
+		return nil, err
+	}
+	out := corev1.ResourceList{}
+	for k, v := range params {
+		name := corev1.ResourceName(k)
+		if name != corev1.ResourceCPU && name != corev1.ResourceMemory {
+			return nil, fmt.Errorf("unsupported resource `%s' (expected cpu or memory)", k)
+		}
+		q, err := resource.ParseQuantity(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s quantity `%s': %v", k, v, err)
+		}
+		out[name] = q
+	}
+	return out, nil
+}
+
+// mutatesClusters returns true if cmd creates, updates or deletes objects
+// applied by addons.
+func mutatesClusters(cmd runtime.Command) bool {
+	return cmd == runtime.InstallCommand || cmd == runtime.RemoveCommand || cmd == runtime.RestoreCommand
+}
+
+// checkAllowedWindow exits unless cmd is allowed to run at now according to
+// --allowed_window (or the window is overridden with --override_window).
+// Commands that don't mutate clusters (and dry runs or explaining selection)
+// are always allowed.
+func checkAllowedWindow(cmd runtime.Command, now time.Time) {
+	if *allowedWindow == "" {
+		return
+	}
+	w, err := util.ParseWindow(*allowedWindow)
+	if err != nil {
+		log.Exitf("Invalid value to --allowed_window: %v", err)
+	}
+	if *dryRun || *explainSel || !mutatesClusters(cmd) {
+		return
+	}
+	if w.Contains(now) {
+		return
+	}
+	if *overrideWindow != "" {
+		log.Warningf("Running `%s' outside of allowed window `%v' (override reason: %s)", cmd, w, *overrideWindow)
+		return
+	}
+	log.Exitf("Refusing to run `%s' outside of allowed window `%v' (now: %v). Pass --override_window=<reason> to bypass in emergencies.", cmd, w, now.Format(time.RFC1123))
+}
+
+// newPrompter returns a Prompter for --interactive mode (nil if disabled).
+// Exits if answers can't be read from a terminal and --yes is not set.
+func newPrompter(cmd runtime.Command) *runtime.Prompter {
+	if !*interactive {
+		return nil
+	}
+	if cmd != runtime.InstallCommand {
+		log.Exitf("--interactive is only supported by `%s' command", runtime.InstallCommand)
+	}
+	if *dryRun {
+		log.Exitf("--interactive cannot be combined with --dry_run")
+	}
+	if !*assumeYes && !isTerminal(os.Stdin) {
+		log.Exitf("--interactive requires stdin to be a terminal (pass --yes to apply all changes without asking)")
+	}
+	return runtime.NewPrompter(os.Stdin, os.Stdout, *assumeYes)
+}
+
+// dumpStarlarkGlobals writes globals of an addons runtime built the same way
+// as for install (but not connected to any cluster) to w in format.
+func dumpStarlarkGlobals(w io.Writer, format string) error {
+	ua := util.UserAgent{Product: "Isopod/" + version}
+	// Packages are only constructed so the cluster is never contacted.
+	kubeC := &rest.Config{Host: "https://localhost"}
+	addons, err := buildAddonsRuntime(kubeC, "main.ipd", ua, nil, nil, nil, nil, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	return runtime.WriteGlobals(w, addons.Globals(), format)
+}
+
+// storeGCOptions returns addons runtime options for `store gc'. Exits if
+// the command can't tell which store entries are stale.
+func storeGCOptions(ctx context.Context, mainFile string, ua util.UserAgent, ctxParams map[string]string) []runtime.Option {
+	if *addonRegex != "" {
+		log.Exitf("--match_addons is not supported by `%s' (addons not matched would look stale)", runtime.StoreGCCommand)
+	}
+	if *stages != "" {
+		log.Exitf("--stages is not supported by `%s'", runtime.StoreGCCommand)
+	}
+	if *singleCluster || *profile != "" || len(ctxParams) > 0 {
+		log.Infof("Not all clusters are known: keeping store entries of other clusters")
+		return nil
+	}
+
+	clusters := buildClustersRuntime(mainFile, ua)
+	if err := clusters.Load(ctx); err != nil {
+		log.Exitf("Failed to load clusters runtime: %v", err)
+	}
+	defined := map[string]bool{}
+	res, err := clusters.ForEachCluster(ctx, ctxParams, func(k8sVendor cloud.KubernetesVendor) error {
+		kubeConfig, err := k8sVendor.KubeConfig(ctx)
+		if err != nil {
+			log.Errorf("Failed to build kube rest config for k8s vendor %v: %v", k8sVendor, err)
+			return err
+		}
+		defined[kubeConfig.Host] = true
+		return nil
+	})
+	if err != nil {
+		log.Exitf("Failed to iterate through clusters: %v", err)
+	}
+	if res.Failed > 0 {
+		log.Warningf("Not all clusters are known: keeping store entries of other clusters")
+		return nil
+	}
+	return []runtime.Option{runtime.WithDefinedClusters(defined)}
+}
+
+// initStore creates --namespace on the cluster of kubeC along with
+// everything the rollout store needs (see store.Bootstrap).
+func initStore(kubeC *rest.Config) error {
+	cs, err := kubernetes.NewForConfig(kubeC)
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes clientset: %v", err)
+	}
+	fmt.Printf("Rollout store on %s:\n", kubeC.Host)
+	return store.Bootstrap(os.Stdout, cs, *namespace, *storeSA, *dryRun)
+}
+
+// verifyIdentity returns an error unless the cluster of kubeC is the one
+// described by k8sVendor (see cloud.VerifyIdentity).
+func verifyIdentity(kubeC *rest.Config, k8sVendor cloud.KubernetesVendor) error {
+	cs, err := kubernetes.NewForConfig(kubeC)
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes clientset: %v", err)
+	}
+	if err := cloud.VerifyIdentity(cs, k8sVendor); err != nil {
+		return err
+	}
+	log.Infof("Verified identity of %v at %s", k8sVendor, kubeC.Host)
+	return nil
+}
+
+// putDiff records diffs (keyed by addon) of run on the cluster of kubeC for
+// review in --namespace of the cluster.
+func putDiff(kubeC *rest.Config, run string, diffs map[string]string) error {
+	cs, err := kubernetes.NewForConfig(kubeC)
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes clientset: %v", err)
+	}
+	if out, ok := diffs[""]; ok {
+		// Objects applied outside of addons (e.g by tests).
+		delete(diffs, "")
+		diffs["_unknown"] += out
+	}
+	name, err := store.New(cs, *namespace).PutDiff(kubeC.Host, run, diffs, *diffStore == "secret")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Diff of %s recorded for review in %s `%s/%s'\n", kubeC.Host, *diffStore, *namespace, name)
+	return nil
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// flagsFetchTimeout bounds fetching feature flags from --flags_url.
+const flagsFetchTimeout = 10 * time.Second
+
+// loadFlags loads feature flags from --flags_file and --flags_url once for
+// the whole run. Exits if --flags_file is invalid, but falls back to defaults
+// (with a warning) if --flags_url can't be fetched.
+func loadFlags(ctx context.Context) *flags.Flags {
+	f := &flags.Flags{}
+	if *flagsFile != "" {
+		var err error
+		if f, err = flags.Load(*flagsFile); err != nil {
+			log.Exitf("Invalid value to --flags_file: %v", err)
+		}
+	}
+	if *flagsURL != "" {
+		ctx, cancel := context.WithTimeout(ctx, flagsFetchTimeout)
+		defer cancel()
+		fetched, err := flags.Fetch(ctx, http.DefaultClient, *flagsURL)
+		if err != nil {
+			log.Warningf("Failed to fetch feature flags, all flags have their default values: %v", err)
+			return &flags.Flags{}
+		}
+		f.Merge(fetched)
+	}
+	return f
+}
+
 func main() {
 	ctx := context.Background()
 
@@ -164,13 +918,42 @@ func main() {
 	if *showVersion {
 		fmt.Println("Version:", version)
 		fmt.Printf("System: %s/%s\n", goruntime.GOOS, goruntime.GOARCH)
+		if flag.NArg() > 0 {
+			// Entry file of the run, e.g `isopod --version install main.ipd'.
+			mainFile := flag.Arg(flag.NArg() - 1)
+			p, err := loader.DetectProvenance(mainFile)
+			switch {
+			case err != nil:
+				fmt.Printf("Entry file: %s (git revision unknown: %v)\n", mainFile, err)
+			case p == nil:
+				fmt.Printf("Entry file: %s (not in a git repo)\n", mainFile)
+			default:
+				fmt.Printf("Entry file: %s at %v (commit %s)\n", mainFile, p, p.Commit)
+			}
+		}
+		return
+	}
+
+	resolveDryRun()
+
+	if *dumpGlobals != "" {
+		if err := dumpStarlarkGlobals(os.Stdout, *dumpGlobals); err != nil {
+			log.Exitf("Failed to dump Starlark globals: %v", err)
+		}
 		return
 	}
 
 	cmd, path := getCmdAndPath(flag.Args())
 
+	if cmd == runtime.TestCommand && *watchTests {
+		if err := runtime.WatchUnitTests(ctx, path, *preludes, watchInterval, os.Stdout, os.Stderr, httpModules()); err != nil {
+			log.Exitf("Failed to watch tests: %v", err)
+		}
+		return
+	}
+
 	if cmd == runtime.TestCommand {
-		ok, err := runtime.RunUnitTests(ctx, path, os.Stdout, os.Stderr)
+		ok, err := runtime.RunUnitTests(ctx, path, *preludes, os.Stdout, os.Stderr, httpModules())
 		if err != nil {
 			log.Exitf("Failed to run tests: %v", err)
 		} else if !ok {
@@ -184,42 +967,412 @@ func main() {
 	if mainFile == "" {
 		log.Exitf("path to main Starlark entry file must be set")
 	}
+	if src, ok, err := loader.ParseGitSource(mainFile); err != nil {
+		log.Exitf("Invalid git entry file: %v", err)
+	} else if ok {
+		if mainFile, err = src.Fetch(gitCloneDir(), *noNetwork); err != nil {
+			log.Exitf("Failed to fetch entry file: %v", err)
+		}
+	}
+
+	if *gitProvenance {
+		var err error
+		if provenance, err = loader.DetectProvenance(mainFile); err != nil {
+			log.Warningf("Failed to detect git revision of the entry file (not recorded): %v", err)
+		} else if provenance != nil {
+			log.Infof("Entry file `%s' is at git revision %v (commit %s)", mainFile, provenance, provenance.Commit)
+			if cmd == runtime.InstallCommand || cmd == runtime.RemoveCommand {
+				fmt.Printf("Running `%s' from git revision %v\n", cmd, provenance)
+			}
+		}
+	}
+
+	switch {
+	case *listFormat != "text" && *listFormat != "json":
+		log.Exitf("Unknown --list_format `%s' (must be `text' or `json')", *listFormat)
+	case *withObjects && (cmd != runtime.ListCommand || *listFormat != "json"):
+		log.Exitf("--with_objects is only supported by `%s' command with --list_format=json", runtime.ListCommand)
+	case *withObjects:
+		// Objects are only rendered, never applied.
+		*dryRun = true
+	}
+
+	if *circuitThresh > 0 {
+		circuitBreaker = kube.NewCircuitBreaker(*circuitThresh)
+	}
+	if !*noDiscCache {
+		discoveryCache = kube.NewDiscoveryCache()
+	}
+
+	if *policyDir != "" {
+		mode, err := policy.ParseMode(*policyMode)
+		if err != nil {
+			log.Exitf("Invalid value to --policy_mode: %v", err)
+		}
+		policyChecker = policy.NewChecker(*policyDir, *opaBinary, mode)
+	}
+
+	var consistency *runtime.Consistency
+	if cmd == runtime.ConsistencyCommand {
+		// Objects are only rendered, never applied.
+		*dryRun = true
+		consistency = runtime.NewConsistency(*consistGroup)
+	} else if *consistGroup != "" {
+		log.Exitf("--group is only supported by `%s' command", runtime.ConsistencyCommand)
+	}
+
+	var chart *helm.ChartExport
+	if cmd == runtime.ExportChartCommand {
+		if *addonRegex != "" {
+			log.Exitf("--match_addons is not supported by `%s'", runtime.ExportChartCommand)
+		}
+		exportAddon := flag.Arg(1)
+		*dryRun = true
+		*addonRegex = "^" + regexp.QuoteMeta(exportAddon) + "$"
+		chart = helm.NewChartExport(exportAddon)
+		if *chartDir == "" {
+			*chartDir = exportAddon
+		}
+	}
+
+	if cmd == runtime.HistoryCommand {
+		if *addonRegex != "" {
+			log.Exitf("--match_addons is not supported by `%s'", runtime.HistoryCommand)
+		}
+		*addonRegex = "^" + regexp.QuoteMeta(flag.Arg(1)) + "$"
+	} else if *histCluster != "" {
+		log.Exitf("--cluster is only supported by `%s' command", runtime.HistoryCommand)
+	}
+
+	if cmd == runtime.RestoreCommand {
+		if *snapshotDir == "" {
+			log.Exitf("`%s' requires --snapshot_dir", runtime.RestoreCommand)
+		}
+		if _, err := os.Stat(filepath.Join(*snapshotDir, restoreRun)); err != nil {
+			log.Exitf("Run `%s' has no snapshots: %v", restoreRun, err)
+		}
+	}
+	if *snapshotDir != "" && mutatesClusters(cmd) && !*dryRun {
+		snapshotRun = xid.New().String()
+		fmt.Printf("Snapshotting live state of run [%s] to `%s'\n", snapshotRun, *snapshotDir)
+	}
+
+	checkAllowedWindow(cmd, time.Now())
+
+	if *verifySig != "" {
+		if *signatureKey == "" {
+			log.Exitf("--verify_signature requires --signature_key")
+		}
+		dir := *relativePath
+		if dir == "" {
+			dir = filepath.Dir(mainFile)
+		}
+		if err := signature.VerifyTree(dir, *verifySig, *signatureKey); err != nil {
+			log.Exitf("Refusing to run unsigned configuration: %v", err)
+		}
+		log.Infof("Verified signature `%s' of `%s'", *verifySig, dir)
+	}
+
+	if *metricsFile != "" {
+		if fi, err := os.Stat(*metricsFile); err != nil || !fi.IsDir() {
+			log.Exitf("--metrics_textfile must be an existing directory: `%s'", *metricsFile)
+		}
+	}
+
+	if *forceFinalizer && *removeTimeout <= 0 {
+		log.Exitf("--force_delete_finalizers requires --remove_timeout")
+	}
 
 	ctxParams, err := util.ParseCommaSeparatedParams(*isopodCtx)
 	if err != nil {
 		log.Exitf("Invalid value to --context: %v", err)
 	}
+	ctxBaseDir := *relativePath
+	if ctxBaseDir == "" {
+		ctxBaseDir = filepath.Dir(mainFile)
+	}
+	if err := util.ReadParamFiles(ctxParams, ctxBaseDir); err != nil {
+		log.Exitf("Invalid value to --context: %v", err)
+	}
+	if *namespace, err = store.ResolveNamespace(*namespace, ctxParams); err != nil {
+		log.Exitf("Invalid value to --namespace: %v", err)
+	}
 
-	clusters := buildClustersRuntime(mainFile)
-	if err := clusters.Load(ctx); err != nil {
-		log.Exitf("Failed to load clusters runtime: %v", err)
+	if tlsPolicy, err = util.ParseTLSPolicy(*tlsMinVersion, *tlsCiphers); err != nil {
+		log.Exitf("Invalid TLS settings: %v", err)
+	}
+
+	coexist, err := util.ParseCommaSeparatedParams(*coexistAnnos)
+	if err != nil {
+		log.Exitf("Invalid value to --coexist_annotations: %v", err)
+	}
+
+	var diffRules []kube.DiffRule
+	if *diffRulesFile != "" {
+		if diffRules, err = kube.LoadDiffRules(*diffRulesFile); err != nil {
+			log.Exitf("Invalid value to --diff_rules: %v", err)
+		}
+	}
+	if *diffSecRules != "" {
+		if !*diffSecurity {
+			log.Exitf("--diff_security_rules requires --diff_security_only")
+		}
+		if _, err := kube.LoadSecurityFilter(*diffSecRules); err != nil {
+			log.Exitf("Invalid value to --diff_security_rules: %v", err)
+		}
+	}
+
+	if _, err := image.ParseRegistryRewrites(*regRewrite); err != nil {
+		log.Exitf("Invalid value to --registry_rewrite: %v", err)
+	}
+	if *rewritePaths != "" {
+		if _, err := kube.LoadImagePaths(*rewritePaths); err != nil {
+			log.Exitf("Invalid value to --registry_rewrite_paths: %v", err)
+		}
+	}
+
+	if _, err := kube.ParseApplyOrder(*applyOrder); err != nil {
+		log.Exitf("Invalid value to --apply_order: %v", err)
+	}
+
+	if *objectFilter != "" {
+		if _, err := kube.NewObjectFilter(*objectFilter); err != nil {
+			log.Exitf("Invalid value to --object_filter: %v", err)
+		}
 	}
 
-	errorReturned := false
+	maxDelta, err := parseRequestsDelta(*maxReqDelta)
+	if err != nil {
+		log.Exitf("Invalid value to --max_request_delta: %v", err)
+	}
+
+	var diffRun string
+	switch *diffStore {
+	case "":
+	case "configmap", "secret":
+		if !*dryRun {
+			log.Exitf("--diff_store requires --dry_run")
+		}
+		diffRun = xid.New().String()
+		fmt.Printf("Recording diffs of run [%s] for review\n", diffRun)
+	default:
+		log.Exitf("Invalid value to --diff_store: `%s' (expected configmap or secret)", *diffStore)
+	}
+
+	var diffReport *kube.DiffReport
+	if *diffMarkdown != "" {
+		if !*dryRun {
+			log.Exitf("--diff_markdown requires --dry_run")
+		}
+		diffReport = kube.NewDiffReport()
+	}
+
+	prompter := newPrompter(cmd)
+
+	ua := util.UserAgent{Product: "Isopod/" + version, Command: string(cmd)}
+
+	runOpts := []runtime.Option{runtime.WithFlags(loadFlags(ctx))}
+	if cmd == runtime.RestoreCommand {
+		runOpts = append(runOpts, runtime.WithRestore(filepath.Join(*snapshotDir, restoreRun)))
+	}
+	if cmd == runtime.StoreGCCommand {
+		runOpts = append(runOpts, storeGCOptions(ctx, mainFile, ua, ctxParams)...)
+	}
+
+	runOnCluster := func(k8sVendor cloud.KubernetesVendor) error {
+		if prompter != nil && prompter.HasQuit() {
+			log.Infof("Skipping %v (quit)", k8sVendor)
+			return nil
+		}
+		if *explainSel {
+			if *singleCluster {
+				fmt.Printf("%v: cluster selected: current kubeconfig context (--single_cluster)\n", k8sVendor)
+			} else {
+				fmt.Printf("%v: cluster selected: returned by `%s'\n", k8sVendor, runtime.ClustersStarFunc)
+			}
+		}
 
-	if err := clusters.ForEachCluster(ctx, ctxParams, func(k8sVendor cloud.KubernetesVendor) {
 		kubeConfig, err := k8sVendor.KubeConfig(ctx)
 		if err != nil {
-			log.Exitf("Failed to build kube rest config for k8s vendor %v: %v", k8sVendor, err)
+			log.Errorf("Failed to build kube rest config for k8s vendor %v: %v", k8sVendor, err)
+			return fmt.Errorf("failed to build kube rest config: %v", err)
+		}
+		kubeConfig.UserAgent = ua.For(util.KubeBackend)
+		kubeConfig.WrapTransport = transport.Wrappers(tlsPolicy.WrapTransport, kubeConfig.WrapTransport)
+		if *histCluster != "" && *histCluster != fmt.Sprint(k8sVendor) && *histCluster != kubeConfig.Host {
+			log.Infof("Skipping %v (not --cluster)", k8sVendor)
+			return nil
+		}
+		if *verifyIdent && mutatesClusters(cmd) && !*dryRun {
+			if err := verifyIdentity(kubeConfig, k8sVendor); err != nil {
+				log.Errorf("Refusing to %s on %v: %v", cmd, k8sVendor, err)
+				return fmt.Errorf("failed to verify cluster identity: %v", err)
+			}
+		}
+		if cmd == runtime.StoreInitCommand {
+			if err := initStore(kubeConfig); err != nil {
+				log.Errorf("Failed to initialize rollout store: %v", err)
+				return fmt.Errorf("failed to initialize rollout store: %v", err)
+			}
+			return nil
+		}
+
+		var diffs map[string]string
+		var diffRecords []func(addonName, out string)
+		if diffRun != "" {
+			diffs = map[string]string{}
+			diffRecords = append(diffRecords, func(addonName, out string) { diffs[addonName] += out })
+		}
+		if diffReport != nil {
+			diffRecords = append(diffRecords, diffReport.Recorder(fmt.Sprint(k8sVendor)))
+		}
+		var diffRecord func(addonName, out string)
+		if len(diffRecords) > 0 {
+			diffRecord = func(addonName, out string) {
+				for _, record := range diffRecords {
+					record(addonName, out)
+				}
+			}
+		}
+
+		var renderOpts []kube.Option
+		if consistency != nil {
+			renderOpts = append(renderOpts, kube.WithRenderRecorder(consistency.Recorder(k8sVendor), false))
+		}
+		if chart != nil {
+			renderOpts = append(renderOpts, kube.WithRenderRecorder(chart.Recorder(fmt.Sprint(k8sVendor)), true))
 		}
-		addons, err := buildAddonsRuntime(kubeConfig, mainFile)
+
+		addonsOpts := runOpts
+		if diffReport != nil {
+			cluster := fmt.Sprint(k8sVendor)
+			addonsOpts = append(append([]runtime.Option{}, runOpts...), runtime.WithDeprecationRecorder(func(msg string) {
+				diffReport.AddWarning(cluster, msg)
+			}))
+		}
+
+		addons, err := buildAddonsRuntime(kubeConfig, mainFile, ua, coexist, diffRules, diffRecord, renderOpts, maxDelta, prompter, fmt.Sprint(k8sVendor), addonsOpts...)
 		if err != nil {
-			log.Exitf("Failed to initialize runtime: %v", err)
+			log.Errorf("Failed to initialize runtime: %v", err)
+			return fmt.Errorf("failed to initialize runtime: %v", err)
 		}
 
 		if err := addons.Load(ctx); err != nil {
-			log.Exitf("Failed to load addons runtime: %v", err)
+			log.Errorf("Failed to load addons runtime: %v", err)
+			return fmt.Errorf("failed to load addons runtime: %v", err)
 		}
 
 		if err := addons.Run(ctx, cmd, k8sVendor.AddonSkyCtx()); err != nil {
-			errorReturned = true
 			log.Errorf("addons run failed: %v", err)
+			return fmt.Errorf("addons run failed: %v", err)
+		}
+
+		if diffs != nil {
+			if err := putDiff(kubeConfig, diffRun, diffs); err != nil {
+				log.Errorf("Failed to record diff for review: %v", err)
+				return fmt.Errorf("failed to record diff for review: %v", err)
+			}
+		}
+		return nil
+	}
+
+	var res *runtime.ClusterResults
+	if *singleCluster {
+		if *stages != "" {
+			log.Exitf("--stages is not supported with --single_cluster")
+		}
+		k8sVendor, err := onprem.NewCurrentContext(*kubeconfig, ctxParams)
+		if err != nil {
+			log.Exitf("Failed to load current kubeconfig context: %v", err)
+		}
+		res = &runtime.ClusterResults{}
+		res.Add(k8sVendor, runOnCluster(k8sVendor))
+	} else {
+		clusters := buildClustersRuntime(mainFile, ua)
+		if err := clusters.Load(ctx); err != nil {
+			log.Exitf("Failed to load clusters runtime: %v", err)
+		}
+
+		if res, err = clusters.ForEachCluster(ctx, ctxParams, runOnCluster); err != nil {
+			log.Exitf("Failed to iterate through clusters: %v", err)
+		}
+	}
+
+	if diffReport != nil {
+		if err := writeDiffMarkdown(*diffMarkdown, diffReport); err != nil {
+			log.Errorf("Failed to write diff summary: %v", err)
+		} else {
+			fmt.Printf("Wrote summary of %d changes to `%s'\n", diffReport.Changes(), *diffMarkdown)
 		}
-	}); err != nil {
-		log.Exitf("Failed to iterate through clusters: %v", err)
 	}
 
-	if errorReturned {
-		os.Exit(2)
+	if circuitBreaker != nil && circuitBreaker.Opened() > 0 {
+		fmt.Printf("%d objects not applied on all clusters after failing on more than %d:\n", circuitBreaker.Opened(), *circuitThresh)
+		if err := circuitBreaker.Print(os.Stdout); err != nil {
+			log.Errorf("Failed to print open circuits: %v", err)
+		}
+	}
+
+	if *profileApplies > 0 {
+		fmt.Printf("Slowest %d object applies:\n", *profileApplies)
+		if err := applyProfile.Print(os.Stdout, *profileApplies); err != nil {
+			log.Errorf("Failed to print apply latencies: %v", err)
+		}
+	}
+
+	if hits, misses := helmCache.Stats(); hits+misses > 0 {
+		log.Infof("Helm render cache: %d hits, %d misses", hits, misses)
+	}
+	if discoveryCache != nil {
+		if hits, misses := discoveryCache.Stats(); hits+misses > 0 {
+			log.Infof("Discovery cache: %d hits, %d misses", hits, misses)
+			if *metricsFile != "" && !*dryRun {
+				if err := runtime.WriteDiscoveryCacheMetrics(*metricsFile, hits, misses); err != nil {
+					log.Warningf("Failed to write discovery cache metrics: %v", err)
+				}
+			}
+		}
+	}
+
+	if consistency != nil && res.Failed == 0 {
+		n, err := consistency.Report(os.Stdout)
+		if err != nil {
+			log.Exitf("Failed to report consistency: %v", err)
+		}
+		if n > 0 {
+			log.Errorf("%d objects differ across clusters", n)
+			log.Flush()
+			os.Exit(runtime.ExitInconsistent)
+		}
+	}
+
+	if chart != nil && res.Failed == 0 {
+		n, err := chart.Write(*chartDir)
+		if err != nil {
+			log.Exitf("Failed to export chart: %v", err)
+		}
+		fmt.Printf("Exported %d objects of addon `%s' to chart `%s'\n", n, flag.Arg(1), *chartDir)
+	}
+
+	if code := res.ExitCode(); code != runtime.ExitSuccess {
+		res.Report(os.Stderr)
+		if res.Halted {
+			log.Errorf("Rollout halted, skipped %d clusters of the remaining stages", res.Skipped)
+		}
+		log.Flush()
+		os.Exit(code)
+	}
+}
+
+// writeDiffMarkdown writes Markdown summary of diffs of r to file at path.
+func writeDiffMarkdown(path string, r *kube.DiffReport) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := r.WriteMarkdown(f); err != nil {
+		f.Close()
+		return err
 	}
+	return f.Close()
 }
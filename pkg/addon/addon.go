@@ -21,12 +21,15 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 
 	log "github.com/golang/glog"
 	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/util/validation"
 
 	"github.com/cruise-automation/isopod/pkg/loader"
+	"github.com/cruise-automation/isopod/pkg/redact"
 )
 
 // Addon implements single addons lifecycle hooks.
@@ -46,19 +49,175 @@ type Addon struct {
 
 	// Defines "print" built-in function.
 	printFn func(t *starlark.Thread, s string)
+
+	// Versions of secrets read during the last execution.
+	secretVersions SecretVersions
+
+	// ApplyStrategy is how objects applied by the addon update their live
+	// state.
+	ApplyStrategy ApplyStrategy
+
+	// MaxObjects caps the number of objects the addon may apply on install
+	// (if positive).
+	MaxObjects int
+
+	// Common are labels and annotations merged onto all objects applied by
+	// the addon.
+	Common CommonMetadata
+
+	// DefaultNamespace is the namespace of namespaced objects applied by the
+	// addon without one (none if empty).
+	DefaultNamespace string
+
+	// Priority orders addons of a run: higher priority addons are installed
+	// first (and removed last). Addons of equal priority keep their order.
+	Priority int
+
+	// Deprecated is why the addon is deprecated (not deprecated if empty).
+	Deprecated string
+	// Sunset is the date (UTC) from which the deprecated addon is no longer
+	// installed (zero if never).
+	Sunset time.Time
+
+	// Atomic rolls back objects applied by the addon if installing it fails
+	// (see kube.Transactor).
+	Atomic bool
+}
+
+// sunsetLayout is the format of the sunset addon argument.
+const sunsetLayout = "2006-01-02"
+
+// parseSunset returns the date s set as the sunset addon argument (zero if
+// empty). Sunset requires the addon to be deprecated.
+func parseSunset(s, deprecated string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if deprecated == "" {
+		return time.Time{}, errors.New("sunset requires deprecated to be set")
+	}
+	t, err := time.Parse(sunsetLayout, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid sunset `%s' (expected YYYY-MM-DD)", s)
+	}
+	return t, nil
+}
+
+// CommonMetadata are labels and annotations merged onto all objects applied
+// by an addon (keys already set by objects take precedence).
+type CommonMetadata struct {
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// parseCommonMetadata returns values of the common_labels and
+// common_annotations addon arguments, validated as Kubernetes labels and
+// annotations respectively.
+func parseCommonMetadata(labels, annotations *starlark.Dict) (CommonMetadata, error) {
+	var c CommonMetadata
+	var err error
+	if c.Labels, err = stringDict("common_labels", labels); err != nil {
+		return c, err
+	}
+	for k, v := range c.Labels {
+		if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			return c, fmt.Errorf("invalid key of common_labels `%s': %s", k, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(v); len(errs) > 0 {
+			return c, fmt.Errorf("invalid value of common_labels `%s=%s': %s", k, v, strings.Join(errs, "; "))
+		}
+	}
+	if c.Annotations, err = stringDict("common_annotations", annotations); err != nil {
+		return c, err
+	}
+	for k := range c.Annotations {
+		if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			return c, fmt.Errorf("invalid key of common_annotations `%s': %s", k, strings.Join(errs, "; "))
+		}
+	}
+	return c, nil
+}
+
+// stringDict converts d (may be nil) to a map of strings.
+func stringDict(arg string, d *starlark.Dict) (map[string]string, error) {
+	if d == nil {
+		return nil, nil
+	}
+	out := make(map[string]string, d.Len())
+	for _, kv := range d.Items() {
+		k, ok := kv[0].(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("%s key %v is not a string (got a %s)", arg, kv[0], kv[0].Type())
+		}
+		v, ok := kv[1].(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("%s value of `%s' is not a string (got a %s)", arg, string(k), kv[1].Type())
+		}
+		out[string(k)] = string(v)
+	}
+	return out, nil
+}
+
+// ApplyStrategy defines how applied objects update their live state.
+type ApplyStrategy string
+
+const (
+	// ApplyStrategyApply updates live objects in place, failing if they were
+	// modified concurrently (default).
+	ApplyStrategyApply ApplyStrategy = "apply"
+	// ApplyStrategyReplace overwrites live objects in place even if they
+	// were modified concurrently.
+	ApplyStrategyReplace ApplyStrategy = "replace"
+	// ApplyStrategyRecreate deletes live objects (waiting for their
+	// dependents to be deleted) and creates them anew.
+	ApplyStrategyRecreate ApplyStrategy = "recreate"
+	// ApplyStrategyMerge merges applied objects into live objects as
+	// kubectl apply does: fields removed since the last applied
+	// configuration are cleared, fields set by others are kept.
+	ApplyStrategyMerge ApplyStrategy = "merge"
+)
+
+// parseApplyStrategy returns ApplyStrategy named s (ApplyStrategyApply if
+// empty).
+func parseApplyStrategy(s string) (ApplyStrategy, error) {
+	switch st := ApplyStrategy(s); st {
+	case "":
+		return ApplyStrategyApply, nil
+	case ApplyStrategyApply, ApplyStrategyReplace, ApplyStrategyRecreate, ApplyStrategyMerge:
+		return st, nil
+	}
+	return "", fmt.Errorf("unknown apply strategy `%s' (expected %s, %s, %s or %s)", s, ApplyStrategyApply, ApplyStrategyReplace, ApplyStrategyRecreate, ApplyStrategyMerge)
 }
 
 // NewAddonBuiltin returns new *starlark.Builtin for Addon with pre-declared
 // pkgs.
-func NewAddonBuiltin(baseDir string, pkgs starlark.StringDict) *starlark.Builtin {
+func NewAddonBuiltin(baseDir string, pkgs starlark.StringDict, loaderOpts ...loader.Option) *starlark.Builtin {
 	return starlark.NewBuiltin(
 		"addon",
 		func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-			var name, path string
+			var name, path, strategy, deprecated, sunset, defaultNamespace string
 			var ctxVal starlark.Value
-			if err := starlark.UnpackPositionalArgs(b.Name(), args, nil, 2, &name, &path, &ctxVal); err != nil {
+			var maxObjects, priority int
+			var commonLabels, commonAnnotations *starlark.Dict
+			var atomic bool
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name, "path", &path, "ctx?", &ctxVal, "apply_strategy?", &strategy, "max_objects?", &maxObjects, "common_labels?", &commonLabels, "common_annotations?", &commonAnnotations, "priority?", &priority, "deprecated?", &deprecated, "sunset?", &sunset, "atomic?", &atomic, "default_namespace?", &defaultNamespace); err != nil {
 				return nil, err
 			}
+			applyStrategy, err := parseApplyStrategy(strategy)
+			if err != nil {
+				return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+			}
+			common, err := parseCommonMetadata(commonLabels, commonAnnotations)
+			if err != nil {
+				return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+			}
+			sunsetDate, err := parseSunset(sunset, deprecated)
+			if err != nil {
+				return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+			}
+			if errs := validation.IsDNS1123Label(defaultNamespace); defaultNamespace != "" && len(errs) > 0 {
+				return nil, fmt.Errorf("<%v>: invalid default_namespace `%s': %s", b.Name(), defaultNamespace, strings.Join(errs, "; "))
+			}
 
 			ctx := starlark.StringDict{}
 			if ctxVal != nil {
@@ -80,15 +239,23 @@ func NewAddonBuiltin(baseDir string, pkgs starlark.StringDict) *starlark.Builtin
 			}
 
 			return &Addon{
-				Name:     name,
-				filepath: path,
-				baseDir:  baseDir,
-				loader:   loader.NewModulesLoaderWithPredeclaredPkgs(baseDir, pkgs),
-				ctx:      ctx,
-				pkgs:     pkgs,
-				globals:  starlark.StringDict{},
+				Name:             name,
+				filepath:         path,
+				baseDir:          baseDir,
+				loader:           loader.NewModulesLoaderWithPredeclaredPkgs(baseDir, pkgs, loaderOpts...),
+				ctx:              ctx,
+				pkgs:             pkgs,
+				globals:          starlark.StringDict{},
+				ApplyStrategy:    applyStrategy,
+				MaxObjects:       maxObjects,
+				Common:           common,
+				Priority:         priority,
+				Deprecated:       deprecated,
+				Sunset:           sunsetDate,
+				Atomic:           atomic,
+				DefaultNamespace: defaultNamespace,
 				printFn: func(t *starlark.Thread, msg string) {
-					fmt.Fprintf(os.Stderr, "%s: %s\n", t.CallStack().At(0).Pos, msg)
+					fmt.Fprintf(os.Stderr, "%s: %s\n", t.CallStack().At(0).Pos, redact.String(msg))
 				},
 			}, nil
 		})
@@ -111,7 +278,40 @@ func NewAddonForTest(name, filepath string, ctx, pkgs starlark.StringDict, f loa
 	}
 }
 
-func (a *Addon) StringPretty() string { return fmt.Sprintf("%s (%s)", a.Name, a.filepath) }
+func (a *Addon) StringPretty() string {
+	if a.Deprecated == "" {
+		return fmt.Sprintf("%s (%s)", a.Name, a.filepath)
+	}
+	return fmt.Sprintf("%s (%s) [%s]", a.Name, a.filepath, a.deprecation())
+}
+
+// DeprecationWarning returns a warning that a is deprecated, e.g "addon
+// `foo' is deprecated: replaced by bar (sunset on 2025-06-01)". Empty if a
+// is not deprecated.
+func (a *Addon) DeprecationWarning() string {
+	if a.Deprecated == "" {
+		return ""
+	}
+	return fmt.Sprintf("addon `%s' is %s", a.Name, a.deprecation())
+}
+
+// deprecation returns e.g "deprecated: replaced by bar (sunset on
+// 2025-06-01)".
+func (a *Addon) deprecation() string {
+	if a.Sunset.IsZero() {
+		return "deprecated: " + a.Deprecated
+	}
+	return fmt.Sprintf("deprecated: %s (sunset on %s)", a.Deprecated, a.Sunset.Format(sunsetLayout))
+}
+
+// PastSunset returns true if a is deprecated and its sunset date is not
+// after now.
+func (a *Addon) PastSunset(now time.Time) bool {
+	return a.Deprecated != "" && !a.Sunset.IsZero() && !now.Before(a.Sunset)
+}
+
+// File returns the path of the Starlark file the addon is defined in.
+func (a *Addon) File() string { return a.filepath }
 
 // String implements starlark.Value.String.
 func (a *Addon) String() string { return fmt.Sprintf("<addon: %s>", a.Name) }
@@ -158,8 +358,51 @@ const (
 	// GoCtxKey is same as SkyCtxKey but for context.Context passed from
 	// main runtime.
 	GoCtxKey = "go_context"
+	// SecretVersionsKey is a key of a thread-local SecretVersions value that
+	// built-ins reading secrets record consumed versions to.
+	SecretVersionsKey = "secret_versions"
+	// NameKey is a key of a thread-local value for the name of the addon
+	// being executed.
+	NameKey = "addon_name"
+	// ApplyStrategyKey is a key of a thread-local ApplyStrategy value of the
+	// addon being installed.
+	ApplyStrategyKey = "apply_strategy"
+	// MaxObjectsKey is a key of a thread-local int value of MaxObjects of the
+	// addon being installed.
+	MaxObjectsKey = "max_objects"
+	// CommonMetadataKey is a key of a thread-local CommonMetadata value of
+	// the addon being installed.
+	CommonMetadataKey = "common_metadata"
+	// DefaultNamespaceKey is a key of a thread-local string value of
+	// DefaultNamespace of the addon being installed.
+	DefaultNamespaceKey = "default_namespace"
 )
 
+// SecretVersions maps secret paths (e.g in Vault) to versions of the secrets
+// consumed by an addon run.
+type SecretVersions map[string]string
+
+// SecretVersions returns versions of secrets read during the last
+// install/remove of the addon.
+func (a *Addon) SecretVersions() SecretVersions {
+	return a.secretVersions
+}
+
+type secretVersionsKey struct{}
+
+// WithSecretVersions returns a copy of ctx that makes secrets read outside of
+// secret built-ins (e.g `vault:' references resolved by helm) record their
+// versions to vs.
+func WithSecretVersions(ctx context.Context, vs SecretVersions) context.Context {
+	return context.WithValue(ctx, secretVersionsKey{}, vs)
+}
+
+// SecretVersionsFrom returns SecretVersions set with WithSecretVersions or nil.
+func SecretVersionsFrom(ctx context.Context) SecretVersions {
+	vs, _ := ctx.Value(secretVersionsKey{}).(SecretVersions)
+	return vs
+}
+
 // Install is called to install an addon.
 // Callback defined by the plugin must perform all necessary work to install
 // the plugin.
@@ -176,8 +419,15 @@ func (a *Addon) Install(ctx context.Context) error {
 		Load:  a.loader.Load,
 	}
 
+	a.secretVersions = SecretVersions{}
 	thread.SetLocal(GoCtxKey, ctx)
 	thread.SetLocal(SkyCtxKey, sCtx)
+	thread.SetLocal(SecretVersionsKey, a.secretVersions)
+	thread.SetLocal(NameKey, a.Name)
+	thread.SetLocal(ApplyStrategyKey, a.ApplyStrategy)
+	thread.SetLocal(MaxObjectsKey, a.MaxObjects)
+	thread.SetLocal(CommonMetadataKey, a.Common)
+	thread.SetLocal(DefaultNamespaceKey, a.DefaultNamespace)
 
 	fn, ok := a.globals["install"]
 	if !ok {
@@ -203,8 +453,11 @@ func (a *Addon) Remove(ctx context.Context) error {
 	thread := &starlark.Thread{
 		Print: a.printFn,
 	}
+	a.secretVersions = SecretVersions{}
 	thread.SetLocal(GoCtxKey, ctx)
 	thread.SetLocal(SkyCtxKey, sCtx)
+	thread.SetLocal(SecretVersionsKey, a.secretVersions)
+	thread.SetLocal(NameKey, a.Name)
 
 	fn, ok := a.globals["remove"]
 	if !ok {
@@ -234,17 +487,31 @@ func ErrorFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwarg
 
 // SleepFn implements built-in for sleep.
 func SleepFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	var dur string
-	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &dur); err != nil {
+	var v starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &v); err != nil {
 		return nil, err
 	}
+	// Accept duration values (their str() is a Go duration string).
+	dur := v.String()
+	if s, ok := v.(starlark.String); ok {
+		dur = string(s)
+	}
 
 	d, err := time.ParseDuration(dur)
 	if err != nil {
 		return nil, fmt.Errorf("<%v>: can not parse duration string `%s': %v", b.Name(), dur, err)
 	}
 
-	time.Sleep(d)
+	// Wake up early if the addon run is cancelled (e.g timed out).
+	ctx, ok := t.Local(GoCtxKey).(context.Context)
+	if !ok {
+		ctx = context.Background()
+	}
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), ctx.Err())
+	}
 
 	return starlark.None, nil
 }
@@ -21,7 +21,9 @@ import (
 	"io"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"go.starlark.net/starlark"
 
 	"github.com/cruise-automation/isopod/pkg/loader"
@@ -108,3 +110,145 @@ func TestAddonInstall(t *testing.T) {
 		t.Fatalf("Unexpected msg. Want: %q, got: %q", wantMsg, sc.Text())
 	}
 }
+
+func TestAddonBuiltinApplyStrategy(t *testing.T) {
+	for _, tc := range []struct {
+		expr    string
+		want    ApplyStrategy
+		wantErr bool
+	}{
+		{expr: `addon("foo", "foo.ipd", {})`, want: ApplyStrategyApply},
+		{expr: `addon("foo", "foo.ipd", {}, apply_strategy="recreate")`, want: ApplyStrategyRecreate},
+		{expr: `addon("foo", "foo.ipd", apply_strategy="replace")`, want: ApplyStrategyReplace},
+		{expr: `addon("foo", "foo.ipd", apply_strategy="merge")`, want: ApplyStrategyMerge},
+		{expr: `addon("foo", "foo.ipd", apply_strategy="patch")`, wantErr: true},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			env := starlark.StringDict{"addon": NewAddonBuiltin(".", starlark.StringDict{})}
+			v, err := starlark.Eval(&starlark.Thread{}, t.Name(), tc.expr, env)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if got := v.(*Addon).ApplyStrategy; got != tc.want {
+				t.Errorf("Unexpected apply strategy, want %q got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestAddonBuiltinCommonMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		expr    string
+		want    CommonMetadata
+		wantErr string
+	}{
+		{expr: `addon("foo", "foo.ipd", {})`},
+		{
+			expr: `addon("foo", "foo.ipd", common_labels={"team": "infra"}, common_annotations={"example.com/owner": "infra@example.com"})`,
+			want: CommonMetadata{
+				Labels:      map[string]string{"team": "infra"},
+				Annotations: map[string]string{"example.com/owner": "infra@example.com"},
+			},
+		},
+		{expr: `addon("foo", "foo.ipd", common_labels={"team": 1})`, wantErr: "<addon>: common_labels value of `team' is not a string (got a int)"},
+		{expr: `addon("foo", "foo.ipd", common_labels={"team": "a b"})`, wantErr: "<addon>: invalid value of common_labels `team=a b'"},
+		{expr: `addon("foo", "foo.ipd", common_annotations={"a/b/c": ""})`, wantErr: "<addon>: invalid key of common_annotations `a/b/c'"},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			env := starlark.StringDict{"addon": NewAddonBuiltin(".", starlark.StringDict{})}
+			v, err := starlark.Eval(&starlark.Thread{}, t.Name(), tc.expr, env)
+			if tc.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+					t.Fatalf("Want error %q, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, v.(*Addon).Common); d != "" {
+				t.Errorf("Unexpected common metadata (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestAddonBuiltinDefaultNamespace(t *testing.T) {
+	for _, tc := range []struct {
+		expr    string
+		want    string
+		wantErr string
+	}{
+		{expr: `addon("foo", "foo.ipd")`},
+		{expr: `addon("foo", "foo.ipd", default_namespace="team")`, want: "team"},
+		{expr: `addon("foo", "foo.ipd", default_namespace="Team")`, wantErr: "<addon>: invalid default_namespace `Team'"},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			env := starlark.StringDict{"addon": NewAddonBuiltin(".", starlark.StringDict{})}
+			v, err := starlark.Eval(&starlark.Thread{}, t.Name(), tc.expr, env)
+			if tc.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+					t.Fatalf("Want error %q, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := v.(*Addon).DefaultNamespace; got != tc.want {
+				t.Errorf("Unexpected default namespace, want %q got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestAddonBuiltinDeprecation(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		expr           string
+		wantWarning    string
+		wantPastSunset bool
+		wantErr        string
+	}{
+		{expr: `addon("foo", "foo.ipd")`},
+		{
+			expr:        `addon("foo", "foo.ipd", deprecated="replaced by bar")`,
+			wantWarning: "addon `foo' is deprecated: replaced by bar",
+		},
+		{
+			expr:           `addon("foo", "foo.ipd", deprecated="replaced by bar", sunset="2025-06-01")`,
+			wantWarning:    "addon `foo' is deprecated: replaced by bar (sunset on 2025-06-01)",
+			wantPastSunset: true,
+		},
+		{
+			expr:        `addon("foo", "foo.ipd", deprecated="replaced by bar", sunset="2025-06-02")`,
+			wantWarning: "addon `foo' is deprecated: replaced by bar (sunset on 2025-06-02)",
+		},
+		{expr: `addon("foo", "foo.ipd", sunset="2025-06-01")`, wantErr: "<addon>: sunset requires deprecated to be set"},
+		{expr: `addon("foo", "foo.ipd", deprecated="old", sunset="June 1st")`, wantErr: "<addon>: invalid sunset `June 1st' (expected YYYY-MM-DD)"},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			env := starlark.StringDict{"addon": NewAddonBuiltin(".", starlark.StringDict{})}
+			v, err := starlark.Eval(&starlark.Thread{}, t.Name(), tc.expr, env)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("Want error %q, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := v.(*Addon)
+			if got := a.DeprecationWarning(); got != tc.wantWarning {
+				t.Errorf("Got warning %q, want %q", got, tc.wantWarning)
+			}
+			if got := a.PastSunset(now); got != tc.wantPastSunset {
+				t.Errorf("PastSunset() = %v, want %v", got, tc.wantPastSunset)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package addon
+
+import "context"
+
+type dryRunKey struct{}
+
+// WithDryRun returns a copy of ctx that forces built-ins to only print their
+// intended actions (as with --dry_run) for a single addon run, e.g to preview
+// changes before applying them.
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// IsDryRun returns true if ctx was derived from WithDryRun (or
+// WithSilentDryRun).
+func IsDryRun(ctx context.Context) bool {
+	v, _ := ctx.Value(dryRunKey{}).(bool)
+	return v
+}
+
+type silentKey struct{}
+
+// WithSilentDryRun returns a copy of ctx as with WithDryRun that also keeps
+// built-ins from printing their intended actions, e.g to only evaluate an
+// addon for what it references.
+func WithSilentDryRun(ctx context.Context) context.Context {
+	return context.WithValue(WithDryRun(ctx), silentKey{}, true)
+}
+
+// IsSilent returns true if ctx was derived from WithSilentDryRun.
+func IsSilent(ctx context.Context) bool {
+	v, _ := ctx.Value(silentKey{}).(bool)
+	return v
+}
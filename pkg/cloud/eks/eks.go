@@ -0,0 +1,151 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package eks implements a cloud.KubernetesVendor for Amazon EKS clusters
+// reached through the kubeconfig written by `aws eks update-kubeconfig'.
+package eks
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/cruise-automation/isopod/pkg/cloud"
+)
+
+const (
+	// ClusterKey is the ctx attribute set to the `name' field.
+	ClusterKey = "cluster"
+	// RegionKey is the name of the region field.
+	RegionKey = "region"
+	// AccountKey is the name of the (optional) AWS account ID field.
+	AccountKey = "account"
+	// ContextKey is the name of the (optional) kubeconfig context field.
+	ContextKey = "context"
+)
+
+var (
+	// asserts *EKS implements starlark.HasAttrs interface.
+	_ starlark.HasAttrs = (*EKS)(nil)
+	// asserts *EKS implements cloud.KubernetesVendor interface.
+	_ cloud.KubernetesVendor = (*EKS)(nil)
+
+	// ClusterSchema is the schema of the `eks_cluster' built-in.
+	ClusterSchema = &cloud.Schema{
+		Type:     "eks",
+		Required: []string{"name", RegionKey},
+		Optional: []string{AccountKey, ContextKey},
+		Rename:   map[string]string{"name": ClusterKey},
+	}
+)
+
+// EKS represents an Amazon EKS cluster. Isopod doesn't talk to AWS APIs
+// itself: the cluster is looked up in the kubeconfig, whose users
+// authenticate with `exec' credential plugins (e.g `aws eks get-token').
+type EKS struct {
+	*cloud.AbstractKubeVendor
+	kubeConfigFile string
+}
+
+// NewEKSClusterBuiltin creates a new `eks_cluster' built-in, e.g:
+//
+//	eks_cluster(name="paas-prod", region="us-east-1", account="123456789012")
+//
+// Clusters are found in the kubeconfig file at kubeConfigFile (or in the
+// files of $KUBECONFIG or ~/.kube/config if empty).
+func NewEKSClusterBuiltin(kubeConfigFile string) *starlark.Builtin {
+	return starlark.NewBuiltin(
+		"eks_cluster",
+		func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			absKubeVendor, err := cloud.NewTypedKubeVendor(b.Name(), ClusterSchema, args, kwargs)
+			if err != nil {
+				return nil, err
+			}
+			return &EKS{
+				AbstractKubeVendor: absKubeVendor,
+				kubeConfigFile:     kubeConfigFile,
+			}, nil
+		},
+	)
+}
+
+// attr returns the string attribute k of the cluster (empty if not set).
+func (e *EKS) attr(k string) string {
+	s, _ := e.Attrs[k].(starlark.String)
+	return string(s)
+}
+
+// KubeConfig is part of the cloud.KubernetesVendor interface.
+func (e *EKS) KubeConfig(ctx context.Context) (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = e.kubeConfigFile
+	raw, err := rules.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %v", err)
+	}
+	kubeCtx, err := e.findContext(raw)
+	if err != nil {
+		return nil, err
+	}
+	return clientcmd.NewNonInteractiveClientConfig(*raw, kubeCtx, &clientcmd.ConfigOverrides{}, rules).ClientConfig()
+}
+
+// findContext returns the kubeconfig context of the cluster: the `context'
+// field if set, or else the only context whose cluster is the ARN of the EKS
+// cluster (as named by `aws eks update-kubeconfig').
+func (e *EKS) findContext(raw *clientcmdapi.Config) (string, error) {
+	if kubeCtx := e.attr(ContextKey); kubeCtx != "" {
+		if _, ok := raw.Contexts[kubeCtx]; !ok {
+			return "", fmt.Errorf("kubeconfig has no context `%s' for %v", kubeCtx, e)
+		}
+		return kubeCtx, nil
+	}
+
+	var found []string
+	for name, c := range raw.Contexts {
+		if e.matchesARN(c.Cluster) {
+			found = append(found, name)
+		}
+	}
+	sort.Strings(found)
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("kubeconfig has no context for %v (add one with `aws eks update-kubeconfig --name %s --region %s')", e, e.attr(ClusterKey), e.attr(RegionKey))
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("kubeconfig has several contexts for %v (set `%s' or `%s' to choose one of %s)", e, AccountKey, ContextKey, strings.Join(found, ", "))
+	}
+}
+
+// matchesARN returns whether arn is that of the cluster, i.e
+// arn:<partition>:eks:<region>:<account>:cluster/<name> (any account if the
+// `account' field isn't set).
+func (e *EKS) matchesARN(arn string) bool {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "eks" {
+		return false
+	}
+	if parts[3] != e.attr(RegionKey) || parts[5] != "cluster/"+e.attr(ClusterKey) {
+		return false
+	}
+	account := e.attr(AccountKey)
+	return account == "" || parts[4] == account
+}
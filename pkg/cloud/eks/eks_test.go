@@ -0,0 +1,134 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eks
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"k8s.io/client-go/rest"
+
+	"github.com/cruise-automation/isopod/pkg/cloud"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+const kubeConfig = `
+apiVersion: v1
+kind: Config
+clusters:
+- name: arn:aws:eks:us-east-1:111111111111:cluster/prod
+  cluster:
+    server: https://prod-111.eks.amazonaws.com
+- name: arn:aws:eks:us-east-1:222222222222:cluster/prod
+  cluster:
+    server: https://prod-222.eks.amazonaws.com
+- name: arn:aws:eks:us-west-2:111111111111:cluster/dev
+  cluster:
+    server: https://dev.eks.amazonaws.com
+contexts:
+- name: prod-111
+  context:
+    cluster: arn:aws:eks:us-east-1:111111111111:cluster/prod
+    user: aws
+- name: prod-222
+  context:
+    cluster: arn:aws:eks:us-east-1:222222222222:cluster/prod
+    user: aws
+- name: arn:aws:eks:us-west-2:111111111111:cluster/dev
+  context:
+    cluster: arn:aws:eks:us-west-2:111111111111:cluster/dev
+    user: aws
+users:
+- name: aws
+  user:
+    token: secret
+`
+
+func TestEKSClusterBuiltin(t *testing.T) {
+	f, err := ioutil.TempFile("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(kubeConfig); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, tc := range []struct {
+		name       string
+		expr       string
+		wantServer string
+		wantErr    error
+	}{
+		{
+			name:       "single match",
+			expr:       `eks_cluster(name="dev", region="us-west-2")`,
+			wantServer: "https://dev.eks.amazonaws.com",
+		},
+		{
+			name:       "match by account",
+			expr:       `eks_cluster(name="prod", region="us-east-1", account="222222222222")`,
+			wantServer: "https://prod-222.eks.amazonaws.com",
+		},
+		{
+			name:       "explicit context",
+			expr:       `eks_cluster(name="prod", region="us-east-1", context="prod-111")`,
+			wantServer: "https://prod-111.eks.amazonaws.com",
+		},
+		{
+			name:    "ambiguous",
+			expr:    `eks_cluster(name="prod", region="us-east-1")`,
+			wantErr: errors.New("kubeconfig has several contexts for <eks: {cluster: \"prod\", region: \"us-east-1\"}> (set `account' or `context' to choose one of prod-111, prod-222)"),
+		},
+		{
+			name:    "not found",
+			expr:    `eks_cluster(name="dev", region="us-east-1")`,
+			wantErr: errors.New("kubeconfig has no context for <eks: {cluster: \"dev\", region: \"us-east-1\"}> (add one with `aws eks update-kubeconfig --name dev --region us-east-1')"),
+		},
+		{
+			name:    "missing context",
+			expr:    `eks_cluster(name="dev", region="us-west-2", context="nope")`,
+			wantErr: errors.New("kubeconfig has no context `nope' for <eks: {cluster: \"dev\", context: \"nope\", region: \"us-west-2\"}>"),
+		},
+		{
+			name:    "missing region",
+			expr:    `eks_cluster(name="dev")`,
+			wantErr: errors.New("<eks_cluster> requires field `region'"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pkgs := starlark.StringDict{"eks_cluster": NewEKSClusterBuiltin(f.Name())}
+			v, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
+			var host string
+			if err == nil {
+				var rc *rest.Config
+				if rc, err = v.(cloud.KubernetesVendor).KubeConfig(context.Background()); err == nil {
+					host = rc.Host
+				}
+			}
+			if !util.ErrsEqual(err, tc.wantErr) {
+				t.Fatalf("want error %v got %v", tc.wantErr, err)
+			}
+			if host != tc.wantServer {
+				t.Errorf("want server %q got %q", tc.wantServer, host)
+			}
+		})
+	}
+}
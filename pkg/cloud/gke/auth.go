@@ -19,6 +19,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -26,6 +27,8 @@ import (
 	"google.golang.org/api/option"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/transport"
+
+	"github.com/cruise-automation/isopod/pkg/util"
 )
 
 // GoogleCredTokenSourceFromSAKey creates a oauth2 token source from google service account key json.
@@ -34,7 +37,13 @@ func GoogleCredTokenSourceFromSAKey(ctx context.Context, svcAcctKeyFile string)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read the SA key json file `%s': %v", svcAcctKeyFile, err)
 	}
-	cred, err := google.CredentialsFromJSON(ctx, b, container.CloudPlatformScope)
+	return GoogleCredTokenSourceFromSAKeyJSON(ctx, b)
+}
+
+// GoogleCredTokenSourceFromSAKeyJSON creates a oauth2 token source from
+// google service account key json content, without touching the filesystem.
+func GoogleCredTokenSourceFromSAKeyJSON(ctx context.Context, svcAcctKeyJSON []byte) (oauth2.TokenSource, error) {
+	cred, err := google.CredentialsFromJSON(ctx, svcAcctKeyJSON, container.CloudPlatformScope)
 	if err != nil {
 		return nil, fmt.Errorf("failed to extract credentials from json: %v", err)
 	}
@@ -54,7 +63,26 @@ func BuildKubeRestConfSACred(
 	if err != nil {
 		return nil, fmt.Errorf("failed to get token source from service account: %v", err)
 	}
-	return buildKubeRestConf(ctx, clusterName, location, project, userAgent, TokenSrc)
+	return buildKubeRestConf(ctx, clusterName, location, project, userAgent, TokenSrc, nil)
+}
+
+// BuildKubeRestConfSAKeyJSON creates a k8s rest.Config using service account
+// JSON key content. If such content is empty, fall back to using default
+// application cred.
+func BuildKubeRestConfSAKeyJSON(
+	ctx context.Context,
+	clusterName, location, project string,
+	svcAcctKeyJSON []byte,
+	userAgent string,
+) (*rest.Config, error) {
+	if len(svcAcctKeyJSON) == 0 {
+		return BuildKubeRestConfDefaultCred(ctx, clusterName, location, project, userAgent)
+	}
+	tokenSrc, err := GoogleCredTokenSourceFromSAKeyJSON(ctx, svcAcctKeyJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token source from service account: %v", err)
+	}
+	return buildKubeRestConf(ctx, clusterName, location, project, userAgent, tokenSrc, nil)
 }
 
 // BuildKubeRestConfDefaultCred creates a k8s rest.Config using the google
@@ -67,18 +95,60 @@ func BuildKubeRestConfDefaultCred(
 	if err != nil {
 		return nil, fmt.Errorf("failed to create the google DefaultTokenSource: %v", err)
 	}
-	return buildKubeRestConf(ctx, clusterName, location, project, userAgent, tokenSrc)
+	return buildKubeRestConf(ctx, clusterName, location, project, userAgent, tokenSrc, nil)
+}
+
+// tokenSource returns a token source for the service account key in
+// svcAcctKeyFile (or svcAcctKeyJSON if not set) or for the default application
+// credentials if neither is set. Tokens are cached in tokenCacheFile (if set)
+// across runs.
+func tokenSource(ctx context.Context, svcAcctKeyFile string, svcAcctKeyJSON []byte, tokenCacheFile string) (oauth2.TokenSource, error) {
+	if svcAcctKeyFile != "" {
+		b, err := ioutil.ReadFile(svcAcctKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the SA key json file `%s': %v", svcAcctKeyFile, err)
+		}
+		svcAcctKeyJSON = b
+	}
+
+	var cred *google.Credentials
+	var err error
+	if len(svcAcctKeyJSON) != 0 {
+		if cred, err = google.CredentialsFromJSON(ctx, svcAcctKeyJSON, container.CloudPlatformScope); err != nil {
+			return nil, fmt.Errorf("failed to extract credentials from json: %v", err)
+		}
+	} else if cred, err = google.FindDefaultCredentials(ctx, container.CloudPlatformScope); err != nil {
+		return nil, fmt.Errorf("failed to find the google default credentials: %v", err)
+	}
+
+	if tokenCacheFile == "" {
+		return cred.TokenSource, nil
+	}
+	return withTokenCache(tokenCacheFile, cred.JSON, cred.TokenSource), nil
 }
 
+// buildKubeRestConf returns rest.Config of the GKE cluster. The GKE API is
+// called over TLS constrained by tlsPolicy (if set).
 func buildKubeRestConf(
 	ctx context.Context,
 	clusterName, location, project, userAgent string,
 	tokenSrc oauth2.TokenSource,
+	tlsPolicy *util.TLSPolicy,
 ) (*rest.Config, error) {
-	containerSvc, err := container.NewService(ctx, option.WithTokenSource(tokenSrc))
+	opts := []option.ClientOption{option.WithTokenSource(tokenSrc), option.WithUserAgent(userAgent)}
+	if tlsPolicy != nil {
+		// Other options are ignored along with a custom HTTP client.
+		opts = []option.ClientOption{option.WithHTTPClient(&http.Client{
+			Transport: &oauth2.Transport{Source: tokenSrc, Base: tlsPolicy.Transport()},
+		})}
+	}
+	containerSvc, err := container.NewService(ctx, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create the container service: %v", err)
 	}
+	if tlsPolicy != nil {
+		containerSvc.UserAgent = userAgent
+	}
 	name := fmt.Sprintf("projects/%s/locations/%s/clusters/%s", project, location, clusterName)
 	cluster, err := containerSvc.Projects.Locations.Clusters.Get(name).Context(ctx).Do()
 	if err != nil {
@@ -0,0 +1,108 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gke
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/container/v1"
+)
+
+// fakeSAKeyJSON returns a service account key whose tokens are issued by
+// tokenURI.
+func fakeSAKeyJSON(t *testing.T, tokenURI string) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	b, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "proj",
+		"private_key_id": "1",
+		"private_key":    string(pemKey),
+		"client_email":   "isopod@proj.iam.gserviceaccount.com",
+		"client_id":      "123",
+		"token_uri":      tokenURI,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestGoogleCredTokenSourceFromSAKeyJSON(t *testing.T) {
+	var gotScope string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The assertion is a JWT signed with the key, claims go second.
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if len(parts) != 3 {
+			http.Error(w, "malformed assertion", http.StatusBadRequest)
+			return
+		}
+		b, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var claims struct {
+			Scope string `json:"scope"`
+		}
+		if err := json.Unmarshal(b, &claims); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		gotScope = claims.Scope
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "token", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer srv.Close()
+
+	src, err := GoogleCredTokenSourceFromSAKeyJSON(context.Background(), fakeSAKeyJSON(t, srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := src.Token()
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+	if tok.AccessToken != "token" {
+		t.Errorf("Want access token %q, got %q", "token", tok.AccessToken)
+	}
+	if gotScope != container.CloudPlatformScope {
+		t.Errorf("Want token requested for scope %q, got %q", container.CloudPlatformScope, gotScope)
+	}
+}
+
+func TestSAKeyJSONParseError(t *testing.T) {
+	ctx := context.Background()
+	key := []byte(`{"type": "service_account", "private_key": `)
+	if _, err := GoogleCredTokenSourceFromSAKeyJSON(ctx, key); err == nil || !strings.Contains(err.Error(), "failed to extract credentials from json") {
+		t.Errorf("Want error extracting credentials, got: %v", err)
+	}
+	if _, err := BuildKubeRestConfSAKeyJSON(ctx, "dev", "us-west1", "proj", key, "Isopod"); err == nil || !strings.Contains(err.Error(), "failed to get token source from service account") {
+		t.Errorf("Want error getting token source, got: %v", err)
+	}
+}
@@ -18,12 +18,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 
 	"go.starlark.net/starlark"
+	"golang.org/x/oauth2"
 	"k8s.io/client-go/rest"
 
 	"github.com/cruise-automation/isopod/pkg/addon"
 	"github.com/cruise-automation/isopod/pkg/cloud"
+	"github.com/cruise-automation/isopod/pkg/util"
 )
 
 const (
@@ -50,10 +53,35 @@ var (
 type GKE struct {
 	*cloud.AbstractKubeVendor
 	svcAcctKeyFile, userAgent string
+	svcAcctKeyJSON            []byte
+	tokenCacheFile            string
+	tlsPolicy                 *util.TLSPolicy
 }
 
-// NewGKEBuiltin creates a new GKE built-in.
-func NewGKEBuiltin(svcAcctKeyFile, userAgent string) *starlark.Builtin {
+// Option is an option of the GKE built-in.
+type Option func(*GKE)
+
+// WithTokenCache returns an Option that caches OAuth2 tokens (keyed by
+// credentials identity) in the file at path so that valid tokens are reused
+// across process restarts instead of obtaining new ones.
+func WithTokenCache(path string) Option {
+	return func(g *GKE) {
+		g.tokenCacheFile = path
+	}
+}
+
+// WithTLSPolicy returns an Option that constrains TLS of the clients of the
+// GKE API and of Google OAuth2 endpoints with p (if set). TLS of Kubernetes
+// clients is up to the users of the built rest.Config.
+func WithTLSPolicy(p *util.TLSPolicy) Option {
+	return func(g *GKE) {
+		g.tlsPolicy = p
+	}
+}
+
+// NewGKEBuiltin creates a new GKE built-in. The svcAcctKeyFile takes
+// precedence over svcAcctKeyJSON if both are set.
+func NewGKEBuiltin(svcAcctKeyFile string, svcAcctKeyJSON []byte, userAgent string, opts ...Option) *starlark.Builtin {
 	return starlark.NewBuiltin(
 		"gke",
 		func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
@@ -61,22 +89,64 @@ func NewGKEBuiltin(svcAcctKeyFile, userAgent string) *starlark.Builtin {
 			if err != nil {
 				return nil, err
 			}
-			return &GKE{
-				AbstractKubeVendor: absKubeVendor,
-				svcAcctKeyFile:     svcAcctKeyFile,
-				userAgent:          userAgent,
-			}, nil
+			return newGKE(absKubeVendor, svcAcctKeyFile, svcAcctKeyJSON, userAgent, opts), nil
+		},
+	)
+}
+
+// ClusterSchema is the schema of the `gke_cluster' built-in. Its `name' field
+// is set to the `cluster' ctx attribute, as with `gke'.
+var ClusterSchema = &cloud.Schema{
+	Type:     "gke",
+	Required: []string{"name", ProjectKey, LocationKey},
+	Rename:   map[string]string{"name": ClusterKey},
+}
+
+// NewGKEClusterBuiltin creates a new `gke_cluster' built-in, the typed
+// counterpart of the GKE built-in (see NewGKEBuiltin), e.g:
+//
+//	gke_cluster(name="dev", project="my-project", location="us-west1", labels={"env": "dev"})
+func NewGKEClusterBuiltin(svcAcctKeyFile string, svcAcctKeyJSON []byte, userAgent string, opts ...Option) *starlark.Builtin {
+	return starlark.NewBuiltin(
+		"gke_cluster",
+		func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			absKubeVendor, err := cloud.NewTypedKubeVendor(b.Name(), ClusterSchema, args, kwargs)
+			if err != nil {
+				return nil, err
+			}
+			return newGKE(absKubeVendor, svcAcctKeyFile, svcAcctKeyJSON, userAgent, opts), nil
 		},
 	)
 }
 
+func newGKE(absKubeVendor *cloud.AbstractKubeVendor, svcAcctKeyFile string, svcAcctKeyJSON []byte, userAgent string, opts []Option) *GKE {
+	g := &GKE{
+		AbstractKubeVendor: absKubeVendor,
+		svcAcctKeyFile:     svcAcctKeyFile,
+		svcAcctKeyJSON:     svcAcctKeyJSON,
+		userAgent:          userAgent,
+	}
+	for _, o := range opts {
+		o(g)
+	}
+	return g
+}
+
 // KubeConfig is part of the cloud.KubernetesVendor interface.
 func (g *GKE) KubeConfig(ctx context.Context) (*rest.Config, error) {
 	cluster, location, project, err := clpFromClusterCtx(g.SkyCtx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to extract cluster info from %v: %v", g, err)
 	}
-	return BuildKubeRestConfSACred(ctx, cluster, location, project, g.svcAcctKeyFile, g.userAgent)
+	if g.tlsPolicy != nil {
+		// Used by oauth2 to obtain tokens.
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: g.tlsPolicy.Transport()})
+	}
+	tokenSrc, err := tokenSource(ctx, g.svcAcctKeyFile, g.svcAcctKeyJSON, g.tokenCacheFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token source for %v: %v", g, err)
+	}
+	return buildKubeRestConf(ctx, cluster, location, project, g.userAgent, tokenSrc, g.tlsPolicy)
 }
 
 func stringFromValue(v starlark.Value) (string, error) {
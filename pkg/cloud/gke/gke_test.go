@@ -52,7 +52,73 @@ func TestGKEBuiltin(t *testing.T) {
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			pkgs := starlark.StringDict{"gke": NewGKEBuiltin("some-sa-key", "Isopod")}
+			pkgs := starlark.StringDict{"gke": NewGKEBuiltin("some-sa-key", nil, "Isopod")}
+			sval, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
+			if !util.ErrsEqual(err, tc.wantErr) {
+				t.Fatalf("want error %v got %v", tc.wantErr, err)
+			}
+			if sval != tc.wantVal {
+				t.Fatalf("want %v got %v", tc.wantVal, sval)
+			}
+		})
+	}
+}
+
+func TestGKEClusterBuiltin(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		expr    string
+		wantVal starlark.Value
+		wantErr error
+	}{
+		{
+			name:    "name is the cluster field",
+			expr:    `gke_cluster(name="dev", location="us-west1", project="projID").cluster`,
+			wantVal: starlark.String("dev"),
+		},
+		{
+			name:    "same type as gke",
+			expr:    `type(gke_cluster(name="dev", location="us-west1", project="projID"))`,
+			wantVal: starlark.String("gke"),
+		},
+		{
+			name:    "labels",
+			expr:    `gke_cluster(name="dev", location="us-west1", project="projID", labels={"env": "dev"}).labels["env"]`,
+			wantVal: starlark.String("dev"),
+		},
+		{
+			name:    "missing required field",
+			expr:    `gke_cluster(name="dev", location="us-west1")`,
+			wantErr: errors.New("<gke_cluster> requires field `project'"),
+		},
+		{
+			name:    "empty required field",
+			expr:    `gke_cluster(name="dev", location="", project="projID")`,
+			wantErr: errors.New("<gke_cluster> field `location' must be a non-empty string (got \"\" of type `string')"),
+		},
+		{
+			name:    "non-string field",
+			expr:    `gke_cluster(name="dev", location="us-west1", project=42)`,
+			wantErr: errors.New("<gke_cluster> field `project' must be a non-empty string (got 42 of type `int')"),
+		},
+		{
+			name:    "unknown field",
+			expr:    `gke_cluster(name="dev", location="us-west1", project="projID", zone="a")`,
+			wantErr: errors.New("<gke_cluster> got unexpected field `zone' (want one of name, project, location, cluster_uid, labels)"),
+		},
+		{
+			name:    "positional arguments",
+			expr:    `gke_cluster("dev")`,
+			wantErr: errors.New("<gke_cluster> only takes keyword arguments (got 1 positional)"),
+		},
+		{
+			name:    "non-string label",
+			expr:    `gke_cluster(name="dev", location="us-west1", project="projID", labels={"tier": 1})`,
+			wantErr: errors.New("<gke_cluster> field `labels': value of `tier' must be a string (got 1 of type `int')"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pkgs := starlark.StringDict{"gke_cluster": NewGKEClusterBuiltin("some-sa-key", nil, "Isopod")}
 			sval, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
 			if !util.ErrsEqual(err, tc.wantErr) {
 				t.Fatalf("want error %v got %v", tc.wantErr, err)
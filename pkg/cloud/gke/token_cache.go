@@ -0,0 +1,164 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gke
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/golang/glog"
+	"golang.org/x/oauth2"
+)
+
+// tokenCacheMu serializes access to token cache files within the process.
+var tokenCacheMu sync.Mutex
+
+// credIdentity returns the identity (e.g service account email) of Google
+// credentials JSON that tokens are cached under, or a hash of credJSON if it
+// names none. Returns false if credJSON is empty (e.g on GCE, where
+// credentials come from the metadata server) so that tokens are not cached.
+func credIdentity(credJSON []byte) (string, bool) {
+	if len(credJSON) == 0 {
+		return "", false
+	}
+	var f struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		ClientID    string `json:"client_id"`
+	}
+	if json.Unmarshal(credJSON, &f) == nil {
+		if f.ClientEmail != "" {
+			return f.Type + ":" + f.ClientEmail, true
+		}
+		if f.ClientID != "" {
+			return f.Type + ":" + f.ClientID, true
+		}
+	}
+	h := sha256.Sum256(credJSON)
+	return "sha256:" + hex.EncodeToString(h[:]), true
+}
+
+// readTokenCache returns tokens in the cache file at path keyed by
+// credentials identity (empty if the file does not exist).
+func readTokenCache(path string) (map[string]*oauth2.Token, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string]*oauth2.Token{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	toks := map[string]*oauth2.Token{}
+	if err := json.Unmarshal(b, &toks); err != nil {
+		return nil, fmt.Errorf("failed to parse token cache `%s': %v", path, err)
+	}
+	return toks, nil
+}
+
+// cachedToken returns the token cached under key in the file at path if it
+// is still valid, nil otherwise.
+func cachedToken(path, key string) *oauth2.Token {
+	tokenCacheMu.Lock()
+	defer tokenCacheMu.Unlock()
+
+	toks, err := readTokenCache(path)
+	if err != nil {
+		log.Warningf("Ignoring token cache: %v", err)
+		return nil
+	}
+	if tok := toks[key]; tok.Valid() {
+		return tok
+	}
+	return nil
+}
+
+// putCachedToken stores tok under key in the file at path (readable by the
+// current user only), replacing the file atomically.
+func putCachedToken(path, key string, tok *oauth2.Token) error {
+	tokenCacheMu.Lock()
+	defer tokenCacheMu.Unlock()
+
+	toks, err := readTokenCache(path)
+	if err != nil {
+		toks = map[string]*oauth2.Token{}
+	}
+	for k, t := range toks {
+		if !t.Valid() {
+			delete(toks, k)
+		}
+	}
+	toks[key] = tok
+	b, err := json.Marshal(toks)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// cachingTokenSource stores tokens obtained from src in the cache file.
+type cachingTokenSource struct {
+	path, key string
+	src       oauth2.TokenSource
+}
+
+// Token implements oauth2.TokenSource.
+func (s *cachingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	if err := putCachedToken(s.path, s.key, tok); err != nil {
+		// Caching is best-effort.
+		log.Warningf("Failed to write token cache `%s': %v", s.path, err)
+	}
+	return tok, nil
+}
+
+// withTokenCache returns a token source that reuses the token cached under
+// the identity of credJSON in the file at path (e.g by a previous run) until
+// it expires, and caches tokens obtained from src after that. Returns src if
+// credJSON has no identity (see credIdentity).
+func withTokenCache(path string, credJSON []byte, src oauth2.TokenSource) oauth2.TokenSource {
+	key, ok := credIdentity(credJSON)
+	if !ok {
+		return src
+	}
+	return oauth2.ReuseTokenSource(cachedToken(path, key), &cachingTokenSource{
+		path: path,
+		key:  key,
+		src:  src,
+	})
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gke
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+type countingTokenSource struct {
+	n      int
+	expiry time.Duration
+}
+
+func (s *countingTokenSource) Token() (*oauth2.Token, error) {
+	s.n++
+	return &oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(s.expiry)}, nil
+}
+
+func TestCredIdentity(t *testing.T) {
+	for _, tc := range []struct {
+		name, json, want string
+		wantOK           bool
+	}{
+		{name: "service account", json: `{"type": "service_account", "client_email": "isopod@proj.iam.gserviceaccount.com"}`, want: "service_account:isopod@proj.iam.gserviceaccount.com", wantOK: true},
+		{name: "authorized user", json: `{"type": "authorized_user", "client_id": "123.apps"}`, want: "authorized_user:123.apps", wantOK: true},
+		{name: "no identity", json: `{"type": "external_account"}`, want: "sha256:0eb80e765d01d6b85eb34b6391cd75c83569b3cbc5d7a132063af0b34707f385", wantOK: true},
+		{name: "metadata server"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := credIdentity([]byte(tc.json))
+			if got != tc.want || ok != tc.wantOK {
+				t.Errorf("credIdentity() = %q, %v, want %q, %v", got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "isopod", "tokens.json")
+	a := []byte(`{"type": "service_account", "client_email": "a@proj.iam.gserviceaccount.com"}`)
+	b := []byte(`{"type": "service_account", "client_email": "b@proj.iam.gserviceaccount.com"}`)
+
+	src := &countingTokenSource{expiry: time.Hour}
+	for i := 0; i < 3; i++ { // Each run builds a new token source.
+		if _, err := withTokenCache(path, a, src).Token(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if src.n != 1 {
+		t.Errorf("Got %d tokens from source for cached identity, want 1", src.n)
+	}
+
+	if _, err := withTokenCache(path, b, src).Token(); err != nil {
+		t.Fatal(err)
+	}
+	if src.n != 2 {
+		t.Errorf("Got %d tokens from source, want 2 (identities are cached separately)", src.n)
+	}
+
+	unknown := &countingTokenSource{expiry: time.Hour}
+	for i := 0; i < 2; i++ {
+		if _, err := withTokenCache(path, nil, unknown).Token(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if unknown.n != 2 {
+		t.Errorf("Got %d tokens from source for unknown identity, want 2 (not cached)", unknown.n)
+	}
+
+	expired := &countingTokenSource{expiry: -time.Minute}
+	for i := 0; i < 2; i++ {
+		if _, err := withTokenCache(filepath.Join(dir, "expired.json"), a, expired).Token(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expired.n != 2 {
+		t.Errorf("Got %d tokens from source for expired tokens, want 2", expired.n)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("Token cache has mode %v, want 0600", perm)
+	}
+}
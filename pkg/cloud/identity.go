@@ -0,0 +1,101 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// IdentityNamespace is the namespace whose UID identifies a cluster and
+	// that holds IdentityConfigMap.
+	IdentityNamespace = "kube-system"
+	// IdentityConfigMap is the ConfigMap describing the cluster it lives in.
+	// Each of its keys (e.g `project', `location' or `cluster') must match
+	// the cluster field of the same name.
+	IdentityConfigMap = "isopod-cluster-identity"
+	// ClusterUIDField is the cluster field holding the expected UID of
+	// IdentityNamespace.
+	ClusterUIDField = "cluster_uid"
+)
+
+// VerifyIdentity returns an error unless the cluster cs is connected to is
+// the one v describes: the UID of IdentityNamespace must equal the
+// ClusterUIDField of v (if set) and every key of IdentityConfigMap (if it
+// exists) must equal the field of v with the same name. Fails if there is
+// nothing to verify the identity against.
+func VerifyIdentity(cs kubernetes.Interface, v KubernetesVendor) error {
+	attrs := v.AddonSkyCtx().Attrs
+	var verified bool
+
+	if want, ok := attrs[ClusterUIDField]; ok {
+		ns, err := cs.CoreV1().Namespaces().Get(IdentityNamespace, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get namespace `%s': %v", IdentityNamespace, err)
+		}
+		if got := string(ns.UID); got != fieldString(want) {
+			return fmt.Errorf("connected to cluster with UID `%s', want `%s' (%s)", got, fieldString(want), ClusterUIDField)
+		}
+		verified = true
+	}
+
+	cm, err := cs.CoreV1().ConfigMaps(IdentityNamespace).Get(IdentityConfigMap, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return fmt.Errorf("failed to get ConfigMap `%s/%s': %v", IdentityNamespace, IdentityConfigMap, err)
+	default:
+		var keys []string
+		for k := range cm.Data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var mismatched []string
+		for _, k := range keys {
+			want, ok := attrs[k]
+			if !ok {
+				mismatched = append(mismatched, fmt.Sprintf("%s=%q (not set on cluster)", k, cm.Data[k]))
+			} else if fieldString(want) != cm.Data[k] {
+				mismatched = append(mismatched, fmt.Sprintf("%s=%q (want %q)", k, cm.Data[k], fieldString(want)))
+			}
+		}
+		if len(mismatched) > 0 {
+			return fmt.Errorf("connected to cluster whose ConfigMap `%s/%s' doesn't match: %s", IdentityNamespace, IdentityConfigMap, strings.Join(mismatched, ", "))
+		}
+		if len(keys) > 0 {
+			verified = true
+		}
+	}
+
+	if !verified {
+		return fmt.Errorf("nothing to verify identity against: set `%s' on the cluster or create ConfigMap `%s/%s'", ClusterUIDField, IdentityNamespace, IdentityConfigMap)
+	}
+	return nil
+}
+
+// fieldString returns v as a plain string (unquoted if a starlark.String).
+func fieldString(v starlark.Value) string {
+	if s, ok := v.(starlark.String); ok {
+		return string(s)
+	}
+	return v.String()
+}
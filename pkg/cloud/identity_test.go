@@ -0,0 +1,109 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.starlark.net/starlark"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+// fakeVendor is a cluster with a static rest config.
+type fakeVendor struct {
+	*AbstractKubeVendor
+}
+
+func (fakeVendor) KubeConfig(context.Context) (*rest.Config, error) {
+	return &rest.Config{Host: "https://localhost"}, nil
+}
+
+func TestVerifyIdentity(t *testing.T) {
+	kubeSystem := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: IdentityNamespace, UID: "uid-1"},
+	}
+	identity := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: IdentityConfigMap, Namespace: IdentityNamespace},
+		Data: map[string]string{
+			"project": "prod-project",
+			"cluster": "prod-1",
+		},
+	}
+	emptyIdentity := identity.DeepCopy()
+	emptyIdentity.Data = nil
+
+	for _, tc := range []struct {
+		name    string
+		fields  map[string]string
+		objs    []runtime.Object
+		wantErr error
+	}{
+		{
+			name:   "UID matches",
+			fields: map[string]string{"cluster": "prod-1", "cluster_uid": "uid-1"},
+			objs:   []runtime.Object{kubeSystem},
+		},
+		{
+			name:    "UID mismatches",
+			fields:  map[string]string{"cluster": "prod-1", "cluster_uid": "uid-2"},
+			objs:    []runtime.Object{kubeSystem, identity},
+			wantErr: errors.New("connected to cluster with UID `uid-1', want `uid-2' (cluster_uid)"),
+		},
+		{
+			name:   "ConfigMap matches",
+			fields: map[string]string{"project": "prod-project", "cluster": "prod-1", "location": "us-west1"},
+			objs:   []runtime.Object{kubeSystem, identity},
+		},
+		{
+			name:    "ConfigMap mismatches",
+			fields:  map[string]string{"cluster": "staging-1"},
+			objs:    []runtime.Object{kubeSystem, identity},
+			wantErr: errors.New("connected to cluster whose ConfigMap `kube-system/isopod-cluster-identity' doesn't match: cluster=\"prod-1\" (want \"staging-1\"), project=\"prod-project\" (not set on cluster)"),
+		},
+		{
+			name:   "UID matches and ConfigMap is empty",
+			fields: map[string]string{"cluster_uid": "uid-1"},
+			objs:   []runtime.Object{kubeSystem, emptyIdentity},
+		},
+		{
+			name:    "Nothing to verify against",
+			fields:  map[string]string{"cluster": "prod-1"},
+			objs:    []runtime.Object{kubeSystem, emptyIdentity},
+			wantErr: errors.New("nothing to verify identity against: set `cluster_uid' on the cluster or create ConfigMap `kube-system/isopod-cluster-identity'"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var kwargs []starlark.Tuple
+			for k, v := range tc.fields {
+				kwargs = append(kwargs, starlark.Tuple{starlark.String(k), starlark.String(v)})
+			}
+			v, err := NewAbstractKubeVendor("fake", nil, kwargs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = VerifyIdentity(fake.NewSimpleClientset(tc.objs...), fakeVendor{v})
+			if (err == nil) != (tc.wantErr == nil) || (err != nil && err.Error() != tc.wantErr.Error()) {
+				t.Errorf("Unexpected error.\nWant: %v\nGot: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package onprem
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"go.starlark.net/starlark"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/cruise-automation/isopod/pkg/cloud"
+)
+
+// asserts *CurrentContext implements cloud.KubernetesVendor interface.
+var _ cloud.KubernetesVendor = (*CurrentContext)(nil)
+
+// CurrentContext represents the cluster of the current kubeconfig context
+// (as used by kubectl). Used to target a single cluster without running the
+// clusters Starlark function.
+type CurrentContext struct {
+	*cloud.AbstractKubeVendor
+	config clientcmd.ClientConfig
+}
+
+// NewCurrentContext returns the cluster of the current context of
+// kubeConfigFile (or of kubeconfig files in $KUBECONFIG or ~/.kube/config if
+// empty). Addon ctx has the `context', `cluster' and `server' fields of the
+// kubeconfig context and params (which don't override those).
+func NewCurrentContext(kubeConfigFile string, params map[string]string) (*CurrentContext, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeConfigFile
+	config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+
+	raw, err := config.RawConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %v", err)
+	}
+	kubeCtx, ok := raw.Contexts[raw.CurrentContext]
+	if !ok {
+		return nil, fmt.Errorf("kubeconfig has no current context (set one with `kubectl config use-context')")
+	}
+
+	attrs := map[string]string{}
+	for k, v := range params {
+		attrs[k] = v
+	}
+	attrs["context"] = raw.CurrentContext
+	attrs["cluster"] = kubeCtx.Cluster
+	if c, ok := raw.Clusters[kubeCtx.Cluster]; ok {
+		attrs["server"] = c.Server
+	}
+
+	var keys []string
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var kwargs []starlark.Tuple
+	for _, k := range keys {
+		kwargs = append(kwargs, starlark.Tuple{starlark.String(k), starlark.String(attrs[k])})
+	}
+	absKubeVendor, err := cloud.NewAbstractKubeVendor("kubeconfig", nil, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	return &CurrentContext{
+		AbstractKubeVendor: absKubeVendor,
+		config:             config,
+	}, nil
+}
+
+// KubeConfig is part of the cloud.KubernetesVendor interface.
+func (c *CurrentContext) KubeConfig(ctx context.Context) (*rest.Config, error) {
+	return c.config.ClientConfig()
+}
@@ -21,6 +21,10 @@ import (
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
+	// Plugin imports for auth providers of kubeconfig users. Exec credential
+	// plugins (e.g for EKS) are supported by client-go as is.
+	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
+
 	"github.com/cruise-automation/isopod/pkg/cloud"
 )
 
@@ -15,9 +15,24 @@
 package onprem
 
 import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"go.starlark.net/starlark"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 
 	util "github.com/cruise-automation/isopod/pkg/testing"
 )
@@ -52,3 +67,193 @@ func TestOnPremBuiltin(t *testing.T) {
 		})
 	}
 }
+
+const kubeConfig = `
+apiVersion: v1
+kind: Config
+current-context: kind-dev
+clusters:
+- name: kind-dev
+  cluster:
+    server: https://127.0.0.1:6443
+contexts:
+- name: kind-dev
+  context:
+    cluster: kind-dev
+    user: kind-dev
+- name: other
+  context:
+    cluster: other
+    user: other
+users:
+- name: kind-dev
+  user:
+    token: secret
+`
+
+func TestCurrentContext(t *testing.T) {
+	f, err := ioutil.TempFile("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(kubeConfig); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	c, err := NewCurrentContext(f.Name(), map[string]string{"env": "dev", "cluster": "ignored"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"context": "kind-dev",
+		"cluster": "kind-dev",
+		"server":  "https://127.0.0.1:6443",
+		"env":     "dev",
+	}
+	got := map[string]string{}
+	for k, v := range c.AddonSkyCtx().Attrs {
+		got[k] = string(v.(starlark.String))
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("Unexpected addon ctx (-want +got):\n%s", d)
+	}
+
+	rc, err := c.KubeConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc.Host != "https://127.0.0.1:6443" || rc.BearerToken != "secret" {
+		t.Errorf("Unexpected rest config: host=%q, token=%q", rc.Host, rc.BearerToken)
+	}
+
+	if _, err := NewCurrentContext(f.Name()+".missing", nil); err == nil {
+		t.Error("Expected error for missing kubeconfig")
+	}
+}
+
+// execPlugin is a fake exec credential plugin that appends a line to the file
+// passed as its argument on every invocation.
+const execPlugin = `#!/bin/sh
+echo >> "$1"
+cat <<EOF
+{
+  "apiVersion": "client.authentication.k8s.io/v1beta1",
+  "kind": "ExecCredential",
+  "status": {"token": "exec-token", "expirationTimestamp": "%s"}
+}
+EOF
+`
+
+const authKubeConfig = `
+apiVersion: v1
+kind: Config
+current-context: %[2]s
+clusters:
+- name: fake
+  cluster:
+    server: %[1]s
+    insecure-skip-tls-verify: true
+contexts:
+- name: exec
+  context:
+    cluster: fake
+    user: exec
+- name: oidc
+  context:
+    cluster: fake
+    user: oidc
+users:
+- name: exec
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: %[3]s
+      args: [%[4]s]
+- name: oidc
+  user:
+    auth-provider:
+      name: oidc
+      config:
+        idp-issuer-url: https://issuer.example.com
+        client-id: isopod
+        id-token: %[5]s
+`
+
+func TestKubeConfigAuth(t *testing.T) {
+	var mu sync.Mutex
+	var auths []string
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auths = append(auths, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"apiVersion": "v1", "kind": "NamespaceList", "items": []}`)
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "kubeconfig-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plugin, calls := filepath.Join(dir, "plugin.sh"), filepath.Join(dir, "calls")
+	expiry := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if err := ioutil.WriteFile(plugin, []byte(fmt.Sprintf(execPlugin, expiry)), 0700); err != nil {
+		t.Fatal(err)
+	}
+	enc := base64.RawURLEncoding.EncodeToString
+	idToken := enc([]byte(`{"alg":"none"}`)) + "." + enc([]byte(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(time.Hour).Unix()))) + ".sig"
+
+	for _, tc := range []struct {
+		context, want string
+	}{
+		{context: "exec", want: "Bearer exec-token"},
+		{context: "oidc", want: "Bearer " + idToken},
+	} {
+		t.Run(tc.context, func(t *testing.T) {
+			kubeConfigFile := filepath.Join(dir, tc.context)
+			if err := ioutil.WriteFile(kubeConfigFile, []byte(fmt.Sprintf(authKubeConfig, s.URL, tc.context, plugin, calls, idToken)), 0600); err != nil {
+				t.Fatal(err)
+			}
+			auths = nil
+
+			current, err := NewCurrentContext(kubeConfigFile, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, v := range []interface {
+				KubeConfig(context.Context) (*rest.Config, error)
+			}{current, &OnPrem{kubeConfigFile: kubeConfigFile}} {
+				rc, err := v.KubeConfig(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Like clientsets of the store and of the addons runtime.
+				for i := 0; i < 2; i++ {
+					cs, err := kubernetes.NewForConfig(rc)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if _, err := cs.CoreV1().Namespaces().List(metav1.ListOptions{}); err != nil {
+						t.Fatalf("Failed to list namespaces: %v", err)
+					}
+				}
+			}
+
+			if d := cmp.Diff([]string{tc.want, tc.want, tc.want, tc.want}, auths); d != "" {
+				t.Errorf("Unexpected Authorization headers (-want +got):\n%s", d)
+			}
+		})
+	}
+
+	b, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "\n"); n != 1 {
+		t.Errorf("Exec plugin invoked %d times, want 1 (until its token expires)", n)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// LabelsField is the field of typed cluster constructors holding the labels
+// of the cluster (a dict of strings, kept as-is in addon ctx).
+const LabelsField = "labels"
+
+// Schema describes the fields accepted by a typed cluster constructor such as
+// `gke_cluster'. Unlike the free-form constructors (e.g `gke'), typed ones
+// reject positional arguments, unknown fields and values that are not
+// non-empty strings so misconfigured clusters fail when `clusters' is called
+// rather than when authenticating to them.
+type Schema struct {
+	// Type is the type of constructed clusters (e.g `gke').
+	Type string
+	// Required and Optional are the string fields of the constructor.
+	Required, Optional []string
+	// Rename maps fields to the addon ctx attributes they are set to (fields
+	// not in Rename are set to attributes of the same name).
+	Rename map[string]string
+}
+
+// fields returns all the fields accepted by s, in declaration order. All
+// typed clusters accept ClusterUIDField (see VerifyIdentity) and LabelsField.
+func (s *Schema) fields() []string {
+	fields := append(append([]string{}, s.Required...), s.Optional...)
+	return append(fields, ClusterUIDField, LabelsField)
+}
+
+// NewTypedKubeVendor creates a new AbstractKubeVendor from the arguments of
+// the typed constructor builtin validated against s.
+func NewTypedKubeVendor(builtin string, s *Schema, args starlark.Tuple, kwargs []starlark.Tuple) (*AbstractKubeVendor, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("<%s> only takes keyword arguments (got %d positional)", builtin, len(args))
+	}
+
+	known := map[string]bool{}
+	for _, f := range s.fields() {
+		known[f] = true
+	}
+	got := map[string]starlark.Value{}
+	for _, kwarg := range kwargs {
+		k := string(kwarg[0].(starlark.String))
+		if !known[k] {
+			return nil, fmt.Errorf("<%s> got unexpected field `%s' (want one of %s)", builtin, k, strings.Join(s.fields(), ", "))
+		}
+		got[k] = kwarg[1]
+	}
+	for _, f := range s.Required {
+		if _, ok := got[f]; !ok {
+			return nil, fmt.Errorf("<%s> requires field `%s'", builtin, f)
+		}
+	}
+
+	var attrs []starlark.Tuple
+	for _, f := range s.fields() {
+		v, ok := got[f]
+		if !ok {
+			continue
+		}
+		if f == LabelsField {
+			labels, err := toLabels(v)
+			if err != nil {
+				return nil, fmt.Errorf("<%s> field `%s': %v", builtin, f, err)
+			}
+			v = labels
+		} else if str, ok := v.(starlark.String); !ok || str == "" {
+			return nil, fmt.Errorf("<%s> field `%s' must be a non-empty string (got %v of type `%s')", builtin, f, v, v.Type())
+		}
+		k := f
+		if renamed, ok := s.Rename[f]; ok {
+			k = renamed
+		}
+		attrs = append(attrs, starlark.Tuple{starlark.String(k), v})
+	}
+	return NewAbstractKubeVendor(s.Type, nil, attrs)
+}
+
+// toLabels returns a frozen copy of v if it is a dict of strings.
+func toLabels(v starlark.Value) (*starlark.Dict, error) {
+	d, ok := v.(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("must be a dict (got a `%s')", v.Type())
+	}
+	var keys []string
+	for _, item := range d.Items() {
+		k, ok := item[0].(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("keys must be strings (got %v of type `%s')", item[0], item[0].Type())
+		}
+		if _, ok := item[1].(starlark.String); !ok {
+			return nil, fmt.Errorf("value of `%s' must be a string (got %v of type `%s')", string(k), item[1], item[1].Type())
+		}
+		keys = append(keys, string(k))
+	}
+	sort.Strings(keys)
+	labels := &starlark.Dict{}
+	for _, k := range keys {
+		v, _, _ := d.Get(starlark.String(k))
+		if err := labels.SetKey(starlark.String(k), v); err != nil {
+			return nil, err
+		}
+	}
+	labels.Freeze()
+	return labels, nil
+}
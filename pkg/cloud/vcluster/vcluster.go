@@ -0,0 +1,168 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vcluster implements a cloud.KubernetesVendor for virtual clusters
+// (https://www.vcluster.com) reached through their connection secrets in
+// host clusters.
+package vcluster
+
+import (
+	"context"
+	"fmt"
+
+	"go.starlark.net/starlark"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/cruise-automation/isopod/pkg/cloud"
+)
+
+const (
+	// vclusterField names the virtual cluster (required).
+	vclusterField = "vcluster"
+	// hostField is the host cluster that runs the virtual cluster (required,
+	// not kept in addon ctx).
+	hostField = "host"
+	// hostClusterField is set in addon ctx to the `cluster' field of host.
+	hostClusterField = "host_cluster"
+	// namespaceField is the namespace of the virtual cluster in host
+	// (defaults to `vcluster-<vcluster>').
+	namespaceField = "namespace"
+	// secretField is the connection secret in namespace (defaults to
+	// `vc-<vcluster>').
+	secretField = "secret"
+	// serverField overrides the server of the kubeconfig in the connection
+	// secret (e.g if it is only reachable through port forwarding).
+	serverField = "server"
+
+	// kubeConfigKey is the key of the kubeconfig in the connection secret.
+	kubeConfigKey = "config"
+)
+
+var (
+	// asserts *VCluster implements starlark.HasAttrs interface.
+	_ starlark.HasAttrs = (*VCluster)(nil)
+	// asserts *VCluster implements cloud.KubernetesVendor interface.
+	_ cloud.KubernetesVendor = (*VCluster)(nil)
+)
+
+// VCluster represents a virtual cluster running in a host cluster.
+type VCluster struct {
+	*cloud.AbstractKubeVendor
+	host cloud.KubernetesVendor
+	// name, namespace, secret and server are fields of the same name.
+	name, namespace, secret, server string
+	newClientset                    func(*rest.Config) (kubernetes.Interface, error)
+}
+
+// NewVClusterBuiltin creates a new VCluster built-in.
+func NewVClusterBuiltin() *starlark.Builtin {
+	return newBuiltin(func(c *rest.Config) (kubernetes.Interface, error) {
+		return kubernetes.NewForConfig(c)
+	})
+}
+
+func newBuiltin(newClientset func(*rest.Config) (kubernetes.Interface, error)) *starlark.Builtin {
+	return starlark.NewBuiltin(
+		"vcluster",
+		func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if len(args) > 0 {
+				return nil, fmt.Errorf("<%s> only takes keyword arguments", b.Name())
+			}
+
+			var host cloud.KubernetesVendor
+			var ctxKwargs []starlark.Tuple
+			for _, kwarg := range kwargs {
+				if string(kwarg[0].(starlark.String)) != hostField {
+					ctxKwargs = append(ctxKwargs, kwarg)
+					continue
+				}
+				var ok bool
+				if host, ok = kwarg[1].(cloud.KubernetesVendor); !ok {
+					return nil, fmt.Errorf("<%s> field `%s' must be a cluster (got a %s)", b.Name(), hostField, kwarg[1].Type())
+				}
+			}
+			if host == nil {
+				return nil, fmt.Errorf("<%s> requires field `%s'", b.Name(), hostField)
+			}
+			if hc, ok := host.AddonSkyCtx().Attrs["cluster"]; ok {
+				ctxKwargs = append(ctxKwargs, starlark.Tuple{starlark.String(hostClusterField), hc})
+			}
+
+			absKubeVendor, err := cloud.NewAbstractKubeVendor(b.Name(), []string{vclusterField}, ctxKwargs)
+			if err != nil {
+				return nil, err
+			}
+			v := &VCluster{
+				AbstractKubeVendor: absKubeVendor,
+				host:               host,
+				newClientset:       newClientset,
+			}
+			for field, dst := range map[string]*string{
+				vclusterField:  &v.name,
+				namespaceField: &v.namespace,
+				secretField:    &v.secret,
+				serverField:    &v.server,
+			} {
+				val, ok := absKubeVendor.Attrs[field]
+				if !ok {
+					continue
+				}
+				s, ok := val.(starlark.String)
+				if !ok {
+					return nil, fmt.Errorf("<%s> field `%s' must be a string (got a %s)", b.Name(), field, val.Type())
+				}
+				*dst = string(s)
+			}
+			if v.namespace == "" {
+				v.namespace = "vcluster-" + v.name
+			}
+			if v.secret == "" {
+				v.secret = "vc-" + v.name
+			}
+			return v, nil
+		},
+	)
+}
+
+// KubeConfig is part of the cloud.KubernetesVendor interface. Reads the
+// kubeconfig of the virtual cluster from its connection secret in host.
+func (v *VCluster) KubeConfig(ctx context.Context) (*rest.Config, error) {
+	hostC, err := v.host.KubeConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build rest config of host cluster %v: %v", v.host, err)
+	}
+	cs, err := v.newClientset(hostC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes clientset of host cluster: %v", err)
+	}
+	s, err := cs.CoreV1().Secrets(v.namespace).Get(v.secret, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection secret `%s/%s' of vcluster `%s': %v", v.namespace, v.secret, v.name, err)
+	}
+	data, ok := s.Data[kubeConfigKey]
+	if !ok {
+		return nil, fmt.Errorf("connection secret `%s/%s' of vcluster `%s' has no `%s' key", v.namespace, v.secret, v.name, kubeConfigKey)
+	}
+	c, err := clientcmd.RESTConfigFromKubeConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig in connection secret `%s/%s': %v", v.namespace, v.secret, err)
+	}
+	if v.server != "" {
+		c.Host = v.server
+	}
+	return c, nil
+}
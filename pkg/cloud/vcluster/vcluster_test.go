@@ -0,0 +1,171 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vcluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.starlark.net/starlark"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+
+	"github.com/cruise-automation/isopod/pkg/cloud"
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+// fakeHost is a host cluster with a static rest config.
+type fakeHost struct {
+	*cloud.AbstractKubeVendor
+}
+
+func (fakeHost) KubeConfig(context.Context) (*rest.Config, error) {
+	return &rest.Config{Host: "https://host"}, nil
+}
+
+func newFakeHost(t *testing.T) starlark.Value {
+	v, err := cloud.NewAbstractKubeVendor("fake", nil, []starlark.Tuple{
+		{starlark.String("cluster"), starlark.String("host-1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fakeHost{v}
+}
+
+const vclusterKubeConfig = `
+apiVersion: v1
+kind: Config
+current-context: tenant-a
+clusters:
+- name: tenant-a
+  cluster:
+    server: https://localhost:8443
+contexts:
+- name: tenant-a
+  context:
+    cluster: tenant-a
+    user: tenant-a
+users:
+- name: tenant-a
+  user:
+    token: secret
+`
+
+func TestVClusterBuiltin(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		expr    string
+		wantVal starlark.Value
+		wantErr error
+	}{
+		{
+			name:    "reference vcluster field",
+			expr:    `vcluster(host=host, vcluster="tenant-a", env="dev").vcluster`,
+			wantVal: starlark.String("tenant-a"),
+		},
+		{
+			name:    "reference host cluster",
+			expr:    `vcluster(host=host, vcluster="tenant-a").host_cluster`,
+			wantVal: starlark.String("host-1"),
+		},
+		{
+			name:    "missing vcluster",
+			expr:    `vcluster(host=host)`,
+			wantErr: errors.New("<vcluster> requires field `vcluster'"),
+		},
+		{
+			name:    "missing host",
+			expr:    `vcluster(vcluster="tenant-a")`,
+			wantErr: errors.New("<vcluster> requires field `host'"),
+		},
+		{
+			name:    "host not a cluster",
+			expr:    `vcluster(host="host-1", vcluster="tenant-a")`,
+			wantErr: errors.New("<vcluster> field `host' must be a cluster (got a string)"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pkgs := starlark.StringDict{"vcluster": NewVClusterBuiltin(), "host": newFakeHost(t)}
+			sval, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
+			if !util.ErrsEqual(err, tc.wantErr) {
+				t.Fatalf("want error %v got %v", tc.wantErr, err)
+			}
+			if sval != tc.wantVal {
+				t.Fatalf("want %v got %v", tc.wantVal, sval)
+			}
+		})
+	}
+}
+
+func TestKubeConfig(t *testing.T) {
+	cs := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "vc-tenant-a", Namespace: "vcluster-tenant-a"},
+		Data:       map[string][]byte{"config": []byte(vclusterKubeConfig)},
+	})
+	var gotHost string
+	b := newBuiltin(func(c *rest.Config) (kubernetes.Interface, error) {
+		gotHost = c.Host
+		return cs, nil
+	})
+
+	for _, tc := range []struct {
+		name     string
+		expr     string
+		wantHost string
+		wantErr  bool
+	}{
+		{
+			name:     "Default secret",
+			expr:     `vcluster(host=host, vcluster="tenant-a")`,
+			wantHost: "https://localhost:8443",
+		},
+		{
+			name:     "Server override",
+			expr:     `vcluster(host=host, vcluster="tenant-a", server="https://tenant-a.vcluster-tenant-a")`,
+			wantHost: "https://tenant-a.vcluster-tenant-a",
+		},
+		{
+			name:    "Missing secret",
+			expr:    `vcluster(host=host, vcluster="tenant-a", secret="missing")`,
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pkgs := starlark.StringDict{"vcluster": b, "host": newFakeHost(t)}
+			sval, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := sval.(cloud.KubernetesVendor).KubeConfig(context.Background())
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if gotHost != "https://host" {
+				t.Errorf("Expected secret to be read from host cluster, got %q", gotHost)
+			}
+			if err != nil {
+				return
+			}
+			if c.Host != tc.wantHost || c.BearerToken != "secret" {
+				t.Errorf("Unexpected rest config: host=%q, token=%q", c.Host, c.BearerToken)
+			}
+		})
+	}
+}
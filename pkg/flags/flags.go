@@ -0,0 +1,149 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package flags implements "flags" built-in package to branch addons on
+// feature flags from a central source.
+package flags
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"go.starlark.net/starlark"
+	"sigs.k8s.io/yaml"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+// Flags are values of feature flags, optionally overridden for each addon.
+// Loaded from YAML or JSON in the following format:
+//
+//	flags:
+//	  new-ingress: true
+//	addons:
+//	  ingress:
+//	    new-ingress: false
+type Flags struct {
+	Flags map[string]bool `json:"flags"`
+	// Addons maps addon names to flag values overriding Flags for the addon.
+	Addons map[string]map[string]bool `json:"addons"`
+}
+
+// Load loads Flags from file at path.
+func Load(path string) (*Flags, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parse(bs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse `%s': %v", path, err)
+	}
+	return f, nil
+}
+
+// Fetch fetches Flags from url with c.
+func Fetch(ctx context.Context, c *http.Client, url string) (*Flags, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching `%s': %s", url, resp.Status)
+	}
+	f, err := parse(bs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse flags from `%s': %v", url, err)
+	}
+	return f, nil
+}
+
+func parse(bs []byte) (*Flags, error) {
+	f := &Flags{}
+	if err := yaml.UnmarshalStrict(bs, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Merge sets values of o in f (overriding those already set).
+func (f *Flags) Merge(o *Flags) {
+	for k, v := range o.Flags {
+		if f.Flags == nil {
+			f.Flags = map[string]bool{}
+		}
+		f.Flags[k] = v
+	}
+	for a, vs := range o.Addons {
+		if f.Addons == nil {
+			f.Addons = map[string]map[string]bool{}
+		}
+		if f.Addons[a] == nil {
+			f.Addons[a] = map[string]bool{}
+		}
+		for k, v := range vs {
+			f.Addons[a][k] = v
+		}
+	}
+}
+
+// Enabled returns value of flag name for addonName and true if it is set.
+func (f *Flags) Enabled(addonName, name string) (enabled, found bool) {
+	if f == nil {
+		return false, false
+	}
+	if enabled, found = f.Addons[addonName][name]; found {
+		return enabled, true
+	}
+	enabled, found = f.Flags[name]
+	return enabled, found
+}
+
+// New returns a new "flags" package evaluating flags against f (all flags
+// have their default values if nil).
+//
+// Methods:
+//   - flags.enabled(name, default=False) returns value of flag name for the
+//     addon being executed.
+func New(f *Flags) *isopod.Module {
+	return &isopod.Module{
+		Name: "flags",
+		Attrs: starlark.StringDict{
+			"enabled": starlark.NewBuiltin("flags.enabled", func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				var name string
+				var def bool
+				if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name, "default?", &def); err != nil {
+					return nil, err
+				}
+				addonName, _ := t.Local(addon.NameKey).(string)
+				if enabled, found := f.Enabled(addonName, name); found {
+					return starlark.Bool(enabled), nil
+				}
+				return starlark.Bool(def), nil
+			}),
+		},
+	}
+}
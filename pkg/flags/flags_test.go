@@ -0,0 +1,180 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flags
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+const flagsYAML = `flags:
+  new-ingress: true
+  canary: false
+addons:
+  ingress:
+    new-ingress: false
+`
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isopod-flags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "flags.yaml")
+	if err := ioutil.WriteFile(path, []byte(flagsYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	want := &Flags{
+		Flags:  map[string]bool{"new-ingress": true, "canary": false},
+		Addons: map[string]map[string]bool{"ingress": {"new-ingress": false}},
+	}
+	if d := cmp.Diff(want, f); d != "" {
+		t.Errorf("Unexpected flags (-want +got):\n%s", d)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("flag:\n  foo: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("Expected Load to fail on unknown field")
+	}
+}
+
+func TestFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flags":
+			w.Write([]byte(`{"flags": {"canary": true}, "addons": {"app": {"canary": false}}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	f, err := Fetch(context.Background(), srv.Client(), srv.URL+"/flags")
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	want := &Flags{
+		Flags:  map[string]bool{"canary": true},
+		Addons: map[string]map[string]bool{"app": {"canary": false}},
+	}
+	if d := cmp.Diff(want, f); d != "" {
+		t.Errorf("Unexpected flags (-want +got):\n%s", d)
+	}
+
+	if _, err := Fetch(context.Background(), srv.Client(), srv.URL+"/missing"); err == nil {
+		t.Error("Expected Fetch to fail on 404")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	f := &Flags{
+		Flags:  map[string]bool{"a": true, "b": true},
+		Addons: map[string]map[string]bool{"app": {"a": false}},
+	}
+	f.Merge(&Flags{
+		Flags:  map[string]bool{"b": false, "c": true},
+		Addons: map[string]map[string]bool{"app": {"c": false}, "other": {"a": false}},
+	})
+	want := &Flags{
+		Flags: map[string]bool{"a": true, "b": false, "c": true},
+		Addons: map[string]map[string]bool{
+			"app":   {"a": false, "c": false},
+			"other": {"a": false},
+		},
+	}
+	if d := cmp.Diff(want, f); d != "" {
+		t.Errorf("Unexpected merged flags (-want +got):\n%s", d)
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	f := &Flags{
+		Flags:  map[string]bool{"new-ingress": true, "canary": false},
+		Addons: map[string]map[string]bool{"ingress": {"new-ingress": false}},
+	}
+	for _, tc := range []struct {
+		name  string
+		flags *Flags
+		addon string
+		expr  string
+		want  bool
+	}{
+		{
+			name:  "Global flag",
+			flags: f,
+			addon: "app",
+			expr:  `flags.enabled("new-ingress")`,
+			want:  true,
+		},
+		{
+			name:  "Addon override",
+			flags: f,
+			addon: "ingress",
+			expr:  `flags.enabled("new-ingress", default=True)`,
+			want:  false,
+		},
+		{
+			name:  "Set flag ignores default",
+			flags: f,
+			addon: "app",
+			expr:  `flags.enabled("canary", default=True)`,
+			want:  false,
+		},
+		{
+			name:  "Unset flag",
+			flags: f,
+			addon: "app",
+			expr:  `flags.enabled("unknown", default=True)`,
+			want:  true,
+		},
+		{
+			name:  "No flags",
+			flags: nil,
+			addon: "app",
+			expr:  `flags.enabled("new-ingress")`,
+			want:  false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			thread := &starlark.Thread{}
+			thread.SetLocal(addon.NameKey, tc.addon)
+			v, err := starlark.Eval(thread, "test", tc.expr, starlark.StringDict{"flags": New(tc.flags)})
+			if err != nil {
+				t.Fatalf("Eval failed: %v", err)
+			}
+			if got := bool(v.(starlark.Bool)); got != tc.want {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
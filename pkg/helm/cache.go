@@ -0,0 +1,101 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"go.starlark.net/starlark"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+// RenderCache memoizes rendered charts so that identical renders (e.g of the
+// same chart to many clusters) are only computed once. Entries are keyed by
+// the chart digest, normalized values, release name and namespace. Safe for
+// concurrent use.
+type RenderCache struct {
+	mu      sync.Mutex
+	entries map[string][]starlark.Value
+	hits    int
+	misses  int
+}
+
+// NewRenderCache returns an empty RenderCache.
+func NewRenderCache() *RenderCache {
+	return &RenderCache{entries: map[string][]starlark.Value{}}
+}
+
+// Stats returns the number of cache hits and misses so far.
+func (c *RenderCache) Stats() (hits, misses int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// get returns the resources cached under key and records a hit or a miss.
+func (c *RenderCache) get(key string) ([]starlark.Value, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rs, ok := c.entries[key]
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return rs, ok
+}
+
+func (c *RenderCache) put(key string, rs []starlark.Value) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = rs
+}
+
+// renderKey returns the cache key for rendering chrt with values (JSON) as
+// name release in namespace.
+func renderKey(chrt *chart.Chart, values []byte, name, namespace string) (string, error) {
+	var buf proto.Buffer
+	buf.SetDeterministic(true)
+	if err := buf.Marshal(chrt); err != nil {
+		return "", err
+	}
+
+	// Round-trip values through a map so that key order and formatting don't
+	// affect the key.
+	var v interface{}
+	if len(values) != 0 {
+		if err := json.Unmarshal(values, &v); err != nil {
+			return "", err
+		}
+	}
+	normalized, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, part := range [][]byte{buf.Bytes(), normalized, []byte(name), []byte(namespace)} {
+		// Length prefix each part so that their boundaries are unambiguous.
+		fmt.Fprintf(h, "%d:", len(part))
+		h.Write(part)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
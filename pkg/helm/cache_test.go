@@ -0,0 +1,85 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"reflect"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestRenderCache(t *testing.T) {
+	apply := func(namespace, values string) string {
+		return `helm.apply(release_name="helm-test", chart="//../../testdata/istio/helm-test", namespace="` + namespace + `", values=[` + values + `])`
+	}
+	values := `{"global": {"priorityClassName": "cluster-critical"}, "pilot": {"replicaCount": 3, "traceSampling": 50, "image": "docker.io/istio/pilot:v1.2.3"}}`
+	reordered := `{"pilot": {"image": "docker.io/istio/pilot:v1.2.3", "traceSampling": 50, "replicaCount": 3}, "global": {"priorityClassName": "cluster-critical"}}`
+	scaled := `{"global": {"priorityClassName": "cluster-critical"}, "pilot": {"replicaCount": 5, "traceSampling": 50, "image": "docker.io/istio/pilot:v1.2.3"}}`
+
+	for _, tc := range []struct {
+		name       string
+		exprs      []string
+		wantHits   int
+		wantMisses int
+	}{
+		{
+			name:       "Same inputs",
+			exprs:      []string{apply("istio-system", values), apply("istio-system", values)},
+			wantHits:   1,
+			wantMisses: 1,
+		},
+		{
+			name:       "Reordered values",
+			exprs:      []string{apply("istio-system", values), apply("istio-system", reordered)},
+			wantHits:   1,
+			wantMisses: 1,
+		},
+		{
+			name:       "Different values",
+			exprs:      []string{apply("istio-system", values), apply("istio-system", scaled)},
+			wantMisses: 2,
+		},
+		{
+			name:       "Different namespace",
+			exprs:      []string{apply("istio-system", values), apply("istio-test", values)},
+			wantMisses: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewRenderCache()
+			var first *starlark.List
+			for i, expr := range tc.exprs {
+				// Each cluster gets its own package.
+				fc := &FakeDynamicClient{}
+				pkgs := starlark.StringDict{"helm": New(fc, nil, "", false, WithRenderCache(c))}
+				if _, _, err := util.Eval(t.Name(), expr, nil, pkgs); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if i == 0 {
+					first = fc.data
+				} else if tc.wantHits > 0 && !reflect.DeepEqual(first, fc.data) {
+					t.Errorf("Unexpected cached render.\nWant: %s\nGot: %s", first, fc.data)
+				}
+			}
+
+			if hits, misses := c.Stats(); hits != tc.wantHits || misses != tc.wantMisses {
+				t.Errorf("Unexpected stats.\nWant: %d hits, %d misses\nGot: %d hits, %d misses", tc.wantHits, tc.wantMisses, hits, misses)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// ChartExport collects objects rendered for an addon (see
+// kube.WithRenderRecorder) to write them as a Helm chart of static templates.
+// Safe for concurrent use.
+type ChartExport struct {
+	addonName string
+
+	mu sync.Mutex
+	// clusters are names of clusters objects were rendered for.
+	clusters []string
+	objs     map[store.ObjRef]string
+	// order is the order objects were first rendered in.
+	order []store.ObjRef
+}
+
+// NewChartExport returns a new ChartExport of objects of addonName.
+func NewChartExport(addonName string) *ChartExport {
+	return &ChartExport{addonName: addonName, objs: map[store.ObjRef]string{}}
+}
+
+// Recorder returns a function recording objects rendered for cluster (to be
+// passed to kube.WithRenderRecorder in raw mode). Objects of other addons
+// are ignored.
+func (e *ChartExport) Recorder(cluster string) func(addonName string, ref store.ObjRef, rendered string) {
+	e.mu.Lock()
+	e.clusters = append(e.clusters, cluster)
+	e.mu.Unlock()
+
+	return func(addonName string, ref store.ObjRef, rendered string) {
+		if addonName != e.addonName {
+			return
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if _, ok := e.objs[ref]; !ok {
+			e.order = append(e.order, ref)
+		}
+		e.objs[ref] = rendered
+	}
+}
+
+// invalidFileChars matches characters not allowed in template file names.
+var invalidFileChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// Write writes the chart to dir (created if missing), templates are named
+// after the kind, namespace and name of each object. Returns the number of
+// templates written. Fails if objects were rendered for more (or less) than
+// one cluster since they may differ between clusters.
+func (e *ChartExport) Write(dir string) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.clusters) != 1 {
+		return 0, fmt.Errorf("addon `%s' was rendered for %d clusters, expected exactly one", e.addonName, len(e.clusters))
+	}
+	if len(e.objs) == 0 {
+		return 0, fmt.Errorf("addon `%s' rendered no objects", e.addonName)
+	}
+
+	templates := filepath.Join(dir, "templates")
+	if err := os.MkdirAll(templates, 0755); err != nil {
+		return 0, err
+	}
+
+	chart := fmt.Sprintf(`apiVersion: v2
+name: %s
+description: Exported from Isopod addon %s rendered for %s.
+type: application
+version: 0.1.0
+`, e.addonName, e.addonName, e.clusters[0])
+	if err := ioutil.WriteFile(filepath.Join(dir, "Chart.yaml"), []byte(chart), 0644); err != nil {
+		return 0, err
+	}
+	values := "# Templates are exported as static objects, add values here to\n# parameterize them.\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "values.yaml"), []byte(values), 0644); err != nil {
+		return 0, err
+	}
+
+	names := map[string]bool{}
+	for _, ref := range e.order {
+		name := templateName(ref)
+		// Names only collide if objects differ in API group.
+		for i := 2; names[name]; i++ {
+			name = fmt.Sprintf("%s-%d", templateName(ref), i)
+		}
+		names[name] = true
+
+		f := filepath.Join(templates, name+".yaml")
+		if err := ioutil.WriteFile(f, []byte(escapeTemplate(e.objs[ref])), 0644); err != nil {
+			return 0, err
+		}
+	}
+	return len(e.order), nil
+}
+
+func templateName(ref store.ObjRef) string {
+	parts := []string{ref.Kind}
+	if ref.Namespace != "" {
+		parts = append(parts, ref.Namespace)
+	}
+	parts = append(parts, ref.Name)
+	return invalidFileChars.ReplaceAllString(strings.ToLower(strings.Join(parts, "-")), "-")
+}
+
+// escapeTemplate escapes template actions in rendered so that Helm renders
+// it as-is.
+func escapeTemplate(rendered string) string {
+	return strings.Replace(rendered, "{{", `{{ "{{" }}`, -1)
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/engine"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+func TestChartExport(t *testing.T) {
+	cm := store.ObjRef{APIVersion: "v1", Kind: "ConfigMap", Namespace: "ingress", Name: "nginx.conf"}
+	crd := store.ObjRef{APIVersion: "apiextensions.k8s.io/v1", Kind: "CustomResourceDefinition", Name: "routes.example.com"}
+	objs := map[store.ObjRef]string{
+		cm:  "apiVersion: v1\nkind: ConfigMap\ndata:\n  tmpl: '{{ .Values.x }}'\n",
+		crd: "apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\n",
+	}
+
+	for _, tc := range []struct {
+		name     string
+		clusters []string
+		wantErr  string
+	}{
+		{name: "Single cluster", clusters: []string{"dev"}},
+		{name: "Many clusters", clusters: []string{"dev", "prod"}, wantErr: "addon `ingress' was rendered for 2 clusters, expected exactly one"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "chart-export")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			e := NewChartExport("ingress")
+			for _, c := range tc.clusters {
+				record := e.Recorder(c)
+				record("ingress", crd, objs[crd])
+				record("ingress", cm, objs[cm])
+				record("other", store.ObjRef{APIVersion: "v1", Kind: "ConfigMap", Name: "other"}, "kind: ConfigMap\n")
+			}
+
+			n, err := e.Write(dir)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("Want error %q, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 2 {
+				t.Errorf("Want 2 templates written, got %d", n)
+			}
+
+			chrt, err := chartutil.Load(dir)
+			if err != nil {
+				t.Fatalf("Failed to load exported chart: %v", err)
+			}
+			if chrt.Metadata.Name != "ingress" {
+				t.Errorf("Want chart name `ingress', got `%s'", chrt.Metadata.Name)
+			}
+			vals, err := chartutil.ToRenderValuesCaps(chrt, &chart.Config{Raw: "{}"}, chartutil.ReleaseOptions{Name: "ingress"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, err := engine.New().Render(chrt, vals)
+			if err != nil {
+				t.Fatalf("Failed to render exported chart: %v", err)
+			}
+
+			got := map[string]string{}
+			for f, s := range files {
+				got[strings.TrimPrefix(f, "ingress/")] = s
+			}
+			want := map[string]string{
+				filepath.Join("templates", "configmap-ingress-nginx.conf.yaml"):                objs[cm],
+				filepath.Join("templates", "customresourcedefinition-routes.example.com.yaml"): objs[crd],
+			}
+			if d := cmp.Diff(want, got); d != "" {
+				t.Errorf("Unexpected rendered templates (-want +got):\n%s", d)
+			}
+		})
+	}
+}
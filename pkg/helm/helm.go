@@ -15,11 +15,16 @@
 package helm
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"path/filepath"
 	"strings"
+	"time"
 
 	jsonpatch "github.com/evanphx/json-patch"
+	log "github.com/golang/glog"
 	"go.starlark.net/starlark"
 	"k8s.io/helm/pkg/chartutil"
 	"k8s.io/helm/pkg/engine"
@@ -27,23 +32,64 @@ import (
 	"k8s.io/helm/pkg/timeconv"
 	"sigs.k8s.io/yaml"
 
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
 	isopod "github.com/cruise-automation/isopod/pkg"
+	"github.com/cruise-automation/isopod/pkg/addon"
 	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/vault"
 )
 
 const yamlSeparator = "---"
 
+const (
+	// vaultRefPrefix marks string values that reference Vault secrets in
+	// the form of `vault:<path>[#<key>]'.
+	vaultRefPrefix = "vault:"
+	redactedValue  = "<redacted>"
+)
+
 type helmPackage struct {
 	*isopod.Module
 	client  kube.DynamicClient
+	secrets vault.SecretReader
 	baseDir string
+	dryRun  bool
+	cache   *RenderCache
+	// releases records applied releases as Helm release Secrets (if set).
+	releases corev1client.SecretsGetter
+}
+
+// Option is an optional helm package setting.
+type Option interface {
+	apply(*helmPackage)
+}
+
+type fnOption func(*helmPackage)
+
+func (fn fnOption) apply(h *helmPackage) { fn(h) }
+
+// WithRenderCache returns an Option that reuses charts rendered with the same
+// inputs from c (and stores new renders in it). Share c between packages of
+// all clusters to render each chart once per run.
+func WithRenderCache(c *RenderCache) Option {
+	return fnOption(func(h *helmPackage) {
+		h.cache = c
+	})
 }
 
-// New returns a new starlark.HasAttrs object for helm package.
-func New(c kube.DynamicClient, baseDir string) starlark.HasAttrs {
+// New returns a new starlark.HasAttrs object for helm package. Vault
+// references in chart values are resolved with s (may be nil if Vault is not
+// available). Resolved values are redacted if dryRun is set.
+func New(c kube.DynamicClient, s vault.SecretReader, baseDir string, dryRun bool, opts ...Option) starlark.HasAttrs {
 	h := &helmPackage{
 		client:  c,
+		secrets: s,
 		baseDir: baseDir,
+		dryRun:  dryRun,
+	}
+	for _, o := range opts {
+		o.apply(h)
 	}
 
 	h.Module = &isopod.Module{
@@ -77,7 +123,11 @@ func (h *helmPackage) helmApplyFn(t *starlark.Thread, b *starlark.Builtin, args
 		return nil, fmt.Errorf("%s: remote repositories are not supported yet <%s>", b.Name(), chartSource)
 	}
 
-	resources, err := h.render(name, namespace, chartSource, values)
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	if vs, ok := t.Local(addon.SecretVersionsKey).(addon.SecretVersions); ok {
+		ctx = addon.WithSecretVersions(ctx, vs)
+	}
+	resources, chrt, merged, err := h.render(ctx, name, namespace, chartSource, values)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %v", b.Name(), err)
 	}
@@ -87,18 +137,50 @@ func (h *helmPackage) helmApplyFn(t *starlark.Thread, b *starlark.Builtin, args
 		return nil, fmt.Errorf("%s: %v", b.Name(), err)
 	}
 
+	if h.releases != nil && !h.dryRun && !addon.IsDryRun(ctx) {
+		ns := namespace
+		if ns == "" {
+			ns = "default"
+		}
+		rls, err := newRelease(name, ns, chrt, merged, resources, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to build release record: %v", b.Name(), err)
+		}
+		if err := h.recordRelease(rls); err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+	}
+
 	return val, nil
 }
 
-func (h *helmPackage) render(name, namespace, chartSource string, values *starlark.List) ([]starlark.Value, error) {
+// render renders chartSource as name release in namespace with values.
+// Returns rendered resources along with the loaded chart and merged values
+// (JSON).
+func (h *helmPackage) render(ctx context.Context, name, namespace, chartSource string, values *starlark.List) ([]starlark.Value, *chart.Chart, []byte, error) {
 	chrt, err := chartutil.Load(chartSource)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	merged, err := mergeValues(values)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
+	}
+
+	if merged, err = h.resolveSecrets(ctx, merged); err != nil {
+		return nil, nil, nil, err
+	}
+
+	var key string
+	if h.cache != nil {
+		if key, err = renderKey(chrt, merged, name, namespace); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to compute render cache key: %v", err)
+		}
+		if l, ok := h.cache.get(key); ok {
+			log.V(1).Infof("Using cached render of `%s' chart for `%s' release", chartSource, name)
+			return l, chrt, merged, nil
+		}
 	}
 
 	config := &chart.Config{Raw: string(merged), Values: map[string]*chart.Value{}}
@@ -111,12 +193,12 @@ func (h *helmPackage) render(name, namespace, chartSource string, values *starla
 
 	vals, err := chartutil.ToRenderValuesCaps(chrt, config, options, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	files, err := engine.New().Render(chrt, vals)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	l := []starlark.Value{}
@@ -135,7 +217,10 @@ func (h *helmPackage) render(name, namespace, chartSource string, values *starla
 		}
 	}
 
-	return l, nil
+	if h.cache != nil {
+		h.cache.put(key, l)
+	}
+	return l, chrt, merged, nil
 }
 
 func mergeValues(values *starlark.List) ([]byte, error) {
@@ -162,3 +247,93 @@ func mergeValues(values *starlark.List) ([]byte, error) {
 	}
 	return merged, nil
 }
+
+// resolveSecrets replaces all `vault:<path>[#<key>]' string values in JSON
+// encoded values with data of the Vault secret at <path> (or just its <key>
+// field if set).
+func (h *helmPackage) resolveSecrets(ctx context.Context, values []byte) ([]byte, error) {
+	if !bytes.Contains(values, []byte(vaultRefPrefix)) {
+		return values, nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(values, &v); err != nil {
+		return nil, err
+	}
+
+	v, err := h.resolveValue(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+func (h *helmPackage) resolveValue(ctx context.Context, v interface{}) (interface{}, error) {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		for k, item := range vv {
+			res, err := h.resolveValue(ctx, item)
+			if err != nil {
+				return nil, err
+			}
+			vv[k] = res
+		}
+		return vv, nil
+	case []interface{}:
+		for i, item := range vv {
+			res, err := h.resolveValue(ctx, item)
+			if err != nil {
+				return nil, err
+			}
+			vv[i] = res
+		}
+		return vv, nil
+	case string:
+		if !strings.HasPrefix(vv, vaultRefPrefix) {
+			return vv, nil
+		}
+		return h.readSecret(ctx, strings.TrimPrefix(vv, vaultRefPrefix))
+	}
+	return v, nil
+}
+
+// readSecret reads Vault secret referenced by ref (`<path>[#<key>]').
+func (h *helmPackage) readSecret(ctx context.Context, ref string) (interface{}, error) {
+	if h.secrets == nil {
+		return nil, fmt.Errorf("failed to resolve `%s%s': vault is not configured", vaultRefPrefix, ref)
+	}
+
+	path, key := ref, ""
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		path, key = ref[:i], ref[i+1:]
+	}
+
+	data, err := h.secrets.ReadSecret(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Vault secret `%s': %v", path, err)
+	}
+	if data == nil {
+		return nil, fmt.Errorf("secret `%s' not found in Vault", path)
+	}
+
+	if key == "" {
+		if h.dryRun || addon.IsDryRun(ctx) {
+			redacted := make(map[string]interface{}, len(data))
+			for k := range data {
+				redacted[k] = redactedValue
+			}
+			return redacted, nil
+		}
+		return data, nil
+	}
+
+	val, ok := data[key]
+	if !ok {
+		return nil, fmt.Errorf("key `%s' not found in Vault secret `%s'", key, path)
+	}
+	if h.dryRun || addon.IsDryRun(ctx) {
+		return redactedValue, nil
+	}
+	return val, nil
+}
@@ -15,6 +15,7 @@
 package helm
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"strings"
@@ -39,6 +40,12 @@ func (f *FakeDynamicClient) Apply(t *starlark.Thread, name, namespace string, da
 	return starlark.None, nil
 }
 
+type FakeSecretReader map[string]map[string]interface{}
+
+func (f FakeSecretReader) ReadSecret(_ context.Context, path string) (map[string]interface{}, error) {
+	return f[path], nil
+}
+
 func TestHelmPackage(t *testing.T) {
 
 	globalValues := `{
@@ -63,6 +70,7 @@ func TestHelmPackage(t *testing.T) {
 		name         string
 		expr         string
 		wantRendered *starlark.List
+		dryRun       bool
 		wantErr      error
 		skip         bool
 	}{
@@ -97,6 +105,35 @@ func TestHelmPackage(t *testing.T) {
 				},
 			),
 		},
+		{
+			name:    "Vault secret key not found",
+			expr:    `helm.apply(release_name="helm-test", chart="//../../testdata/istio/helm-test", namespace="istio-system", values=[` + globalValues + `, ` + values + `, ` + `{"pilot": {"image": "vault:secret/pilot#foo"}}` + `])`,
+			wantErr: errors.New("helm.apply: key `foo' not found in Vault secret `secret/pilot'"),
+		},
+		{
+			name: "Vault secrets",
+			expr: `helm.apply(release_name="helm-test", chart="//../../testdata/istio/helm-test", namespace="istio-system", values=[` + globalValues + `, ` + values + `, ` + `{"pilot": {"image": "vault:secret/pilot#image", "traceSampling": 75}}` + `])`,
+			wantRendered: starlark.NewList(
+				[]starlark.Value{
+					starlark.String(expectedDeployment),
+					starlark.String(expectedMesh),
+				},
+			),
+		},
+		{
+			name:   "Vault secrets (dry run)",
+			expr:   `helm.apply(release_name="helm-test", chart="//../../testdata/istio/helm-test", namespace="istio-system", values=[` + globalValues + `, ` + values + `, ` + `{"global": "vault:secret/global", "pilot": {"image": "vault:secret/pilot#image", "traceSampling": 75}}` + `])`,
+			dryRun: true,
+			wantRendered: starlark.NewList(
+				[]starlark.Value{
+					starlark.String(strings.NewReplacer(
+						`"docker.io/istio/pilot:v1.2.3"`, `"<redacted>"`,
+						`"cluster-critical"`, `"<redacted>"`,
+					).Replace(expectedDeployment)),
+					starlark.String(expectedMesh),
+				},
+			),
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			if tc.skip {
@@ -104,7 +141,11 @@ func TestHelmPackage(t *testing.T) {
 			}
 
 			fc := &FakeDynamicClient{}
-			pkgs := starlark.StringDict{"helm": New(fc, "")}
+			sr := FakeSecretReader{
+				"secret/pilot":  {"image": "docker.io/istio/pilot:v1.2.3"},
+				"secret/global": {"priorityClassName": "cluster-critical"},
+			}
+			pkgs := starlark.StringDict{"helm": New(fc, sr, "", tc.dryRun)}
 			_, _, gotErr := util.Eval(t.Name(), tc.expr, nil, pkgs)
 			if gotErr != nil {
 				if tc.wantErr == nil {
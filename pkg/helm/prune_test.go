@@ -0,0 +1,92 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+func TestPruneDroppedTemplate(t *testing.T) {
+	newKube, closeFn, err := kube.NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	ctx := context.Background()
+	// install applies chart as "app" addon in a new run and prunes objects
+	// applied by the previous run (prev) that are no longer applied.
+	install := func(chart string, prev []store.ObjRef) []store.ObjRef {
+		k := newKube()
+		pkgs := starlark.StringDict{
+			"helm": New(k.(kube.DynamicClient), nil, "", false),
+			"kube": k,
+		}
+		thread := &starlark.Thread{}
+		thread.SetLocal(addon.GoCtxKey, ctx)
+		thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+		thread.SetLocal(addon.NameKey, "app")
+
+		expr := `helm.apply(release_name="prune-test", chart="//../../testdata/prune-test/` + chart + `", namespace="default")`
+		if _, err := starlark.Eval(thread, t.Name(), expr, pkgs); err != nil {
+			t.Fatalf("Failed to apply %s chart: %v", chart, err)
+		}
+
+		p := k.(kube.Pruner)
+		if err := p.Prune(ctx, "app", prev); err != nil {
+			t.Fatalf("Failed to prune after applying %s chart: %v", chart, err)
+		}
+		return p.Applied("app")
+	}
+
+	exists := func(name string) bool {
+		pkgs := starlark.StringDict{"kube": newKube()}
+		thread := &starlark.Thread{}
+		thread.SetLocal(addon.GoCtxKey, ctx)
+		v, err := starlark.Eval(thread, t.Name(), `kube.exists(configmap="default/`+name+`")`, pkgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bool(v.Truth())
+	}
+
+	v1 := install("v1", nil)
+	for _, name := range []string{"prune-test-config", "prune-test-legacy"} {
+		if !exists(name) {
+			t.Errorf("Expected configmap `%s' to be applied by v1 chart", name)
+		}
+	}
+
+	v2 := install("v2", v1)
+	if !exists("prune-test-config") {
+		t.Error("Expected configmap `prune-test-config' to be kept by v2 chart")
+	}
+	if exists("prune-test-legacy") {
+		t.Error("Expected configmap `prune-test-legacy' dropped from v2 chart to be pruned")
+	}
+
+	want := []store.ObjRef{{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "prune-test-config"}}
+	if d := cmp.Diff(want, v2); d != "" {
+		t.Errorf("Unexpected objects applied by v2 chart (-want +got):\n%s", d)
+	}
+}
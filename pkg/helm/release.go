@@ -0,0 +1,298 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"sigs.k8s.io/yaml"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	// releaseSecretType is the type of Secrets Helm 3 stores releases in.
+	releaseSecretType = "helm.sh/release.v1"
+	// releaseHistoryMax is the max number of revisions of each release kept
+	// (as with `helm upgrade --history-max').
+	releaseHistoryMax = 10
+
+	releaseStatusDeployed   = "deployed"
+	releaseStatusSuperseded = "superseded"
+)
+
+// helmRelease is the subset of Helm 3 release record (as stored in release
+// Secrets) that Isopod fills in.
+type helmRelease struct {
+	Name      string                 `json:"name,omitempty"`
+	Info      *releaseInfo           `json:"info,omitempty"`
+	Chart     *releaseChart          `json:"chart,omitempty"`
+	Config    map[string]interface{} `json:"config,omitempty"`
+	Manifest  string                 `json:"manifest,omitempty"`
+	Version   int                    `json:"version,omitempty"`
+	Namespace string                 `json:"namespace,omitempty"`
+}
+
+type releaseInfo struct {
+	FirstDeployed time.Time `json:"first_deployed,omitempty"`
+	LastDeployed  time.Time `json:"last_deployed,omitempty"`
+	Description   string    `json:"description,omitempty"`
+	Status        string    `json:"status,omitempty"`
+}
+
+type releaseChart struct {
+	// Metadata of charts loaded by Helm 2 is serialized the same as by Helm 3
+	// (fields unknown to Helm 3 are ignored).
+	Metadata  *chart.Metadata        `json:"metadata"`
+	Templates []*releaseFile         `json:"templates"`
+	Values    map[string]interface{} `json:"values"`
+	Files     []*releaseFile         `json:"files"`
+}
+
+type releaseFile struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"`
+}
+
+// WithReleaseTracking returns an Option that records each release applied by
+// helm.apply as a Helm 3 release Secret in the release namespace with c, so
+// that `helm list', `helm history' and `helm rollback' work with releases
+// applied by Isopod. A new revision is only recorded if the rendered manifest
+// or values changed since the deployed one.
+func WithReleaseTracking(c corev1client.SecretsGetter) Option {
+	return fnOption(func(h *helmPackage) {
+		h.releases = c
+	})
+}
+
+// releaseName returns name of the Secret of revision version of release.
+func releaseName(release string, version int) string {
+	return fmt.Sprintf("sh.helm.release.v1.%s.v%d", release, version)
+}
+
+// manifest joins rendered resources into a release manifest. Resources are
+// sorted so that identical renders produce identical manifests.
+func manifest(resources []starlark.Value) string {
+	docs := make([]string, 0, len(resources))
+	for _, r := range resources {
+		if s, ok := starlark.AsString(r); ok {
+			docs = append(docs, s)
+		}
+	}
+	sort.Strings(docs)
+
+	var b strings.Builder
+	for _, d := range docs {
+		b.WriteString(yamlSeparator + "\n" + d + "\n")
+	}
+	return b.String()
+}
+
+// newRelease returns deployed release record of name in namespace for chrt
+// rendered with values (JSON) into resources.
+func newRelease(name, namespace string, chrt *chart.Chart, values []byte, resources []starlark.Value, now time.Time) (*helmRelease, error) {
+	config := map[string]interface{}{}
+	if len(values) > 0 {
+		if err := json.Unmarshal(values, &config); err != nil {
+			return nil, err
+		}
+	}
+
+	md := &chart.Metadata{}
+	if chrt.Metadata != nil {
+		*md = *chrt.Metadata
+	}
+	if md.ApiVersion == "" {
+		md.ApiVersion = "v1"
+	}
+	c := &releaseChart{Metadata: md, Values: map[string]interface{}{}}
+	if raw := chrt.GetValues().GetRaw(); raw != "" {
+		if err := yaml.Unmarshal([]byte(raw), &c.Values); err != nil {
+			return nil, fmt.Errorf("failed to parse chart values: %v", err)
+		}
+	}
+	for _, t := range chrt.Templates {
+		c.Templates = append(c.Templates, &releaseFile{Name: t.Name, Data: t.Data})
+	}
+	for _, f := range chrt.Files {
+		c.Files = append(c.Files, &releaseFile{Name: f.TypeUrl, Data: f.Value})
+	}
+
+	return &helmRelease{
+		Name: name,
+		Info: &releaseInfo{
+			FirstDeployed: now,
+			LastDeployed:  now,
+			Description:   "Applied by Isopod",
+			Status:        releaseStatusDeployed,
+		},
+		Chart:     c,
+		Config:    config,
+		Manifest:  manifest(resources),
+		Namespace: namespace,
+	}, nil
+}
+
+// encodeRelease encodes rls as stored in Helm 3 release Secrets (gzipped
+// JSON, base64 encoded).
+func encodeRelease(rls *helmRelease) ([]byte, error) {
+	bs, err := json.Marshal(rls)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(bs); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+// decodeRelease decodes release encoded with encodeRelease (or by Helm).
+func decodeRelease(data []byte) (*helmRelease, error) {
+	bs, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bs, []byte{0x1f, 0x8b}) {
+		r, err := gzip.NewReader(bytes.NewReader(bs))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		if bs, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+	rls := &helmRelease{}
+	if err := json.Unmarshal(bs, rls); err != nil {
+		return nil, err
+	}
+	return rls, nil
+}
+
+// releaseSecret returns the Secret storing rls with status.
+func releaseSecret(rls *helmRelease, data []byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      releaseName(rls.Name, rls.Version),
+			Namespace: rls.Namespace,
+			Labels: map[string]string{
+				"name":    rls.Name,
+				"owner":   "helm",
+				"status":  rls.Info.Status,
+				"version": strconv.Itoa(rls.Version),
+			},
+		},
+		Type: releaseSecretType,
+		Data: map[string][]byte{"release": data},
+	}
+}
+
+// recordRelease records rls as the next deployed revision of its release
+// (unless identical to the deployed one). Previously deployed revisions are
+// marked superseded and revisions beyond releaseHistoryMax are deleted.
+func (h *helmPackage) recordRelease(rls *helmRelease) error {
+	c := h.releases.Secrets(rls.Namespace)
+	l, err := c.List(metav1.ListOptions{LabelSelector: "owner=helm,name=" + rls.Name})
+	if err != nil {
+		return fmt.Errorf("failed to list revisions of `%s' release: %v", rls.Name, err)
+	}
+
+	type revision struct {
+		secret corev1.Secret
+		rls    *helmRelease
+	}
+	var revs []revision
+	for _, s := range l.Items {
+		prev, err := decodeRelease(s.Data["release"])
+		if err != nil {
+			log.Warningf("Ignoring invalid `%s/%s' release Secret: %v", s.Namespace, s.Name, err)
+			continue
+		}
+		revs = append(revs, revision{secret: s, rls: prev})
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i].rls.Version < revs[j].rls.Version })
+
+	rls.Version = 1
+	if len(revs) > 0 {
+		latest := revs[len(revs)-1].rls
+		if latest.Info != nil && latest.Info.Status == releaseStatusDeployed &&
+			latest.Manifest == rls.Manifest && reflect.DeepEqual(latest.Config, rls.Config) {
+			log.V(1).Infof("Revision %d of `%s' release is up to date", latest.Version, rls.Name)
+			return nil
+		}
+		rls.Version = latest.Version + 1
+		if first := revs[0].rls.Info; first != nil && !first.FirstDeployed.IsZero() {
+			rls.Info.FirstDeployed = first.FirstDeployed
+		}
+	}
+
+	for _, rev := range revs {
+		if rev.rls.Info == nil || rev.rls.Info.Status != releaseStatusDeployed {
+			continue
+		}
+		rev.rls.Info.Status = releaseStatusSuperseded
+		data, err := encodeRelease(rev.rls)
+		if err != nil {
+			return err
+		}
+		s := rev.secret
+		s.Labels["status"] = releaseStatusSuperseded
+		s.Data = map[string][]byte{"release": data}
+		if _, err := c.Update(&s); err != nil {
+			return fmt.Errorf("failed to supersede revision %d of `%s' release: %v", rev.rls.Version, rls.Name, err)
+		}
+	}
+
+	data, err := encodeRelease(rls)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Create(releaseSecret(rls, data)); err != nil {
+		return fmt.Errorf("failed to record revision %d of `%s' release: %v", rls.Version, rls.Name, err)
+	}
+	log.Infof("Recorded revision %d of `%s/%s' Helm release", rls.Version, rls.Namespace, rls.Name)
+
+	// Make room for the new revision.
+	for i := 0; i < len(revs)+1-releaseHistoryMax; i++ {
+		if err := c.Delete(revs[i].secret.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete revision %d of `%s' release: %v", revs[i].rls.Version, rls.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helm
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+	"k8s.io/client-go/kubernetes/fake"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestReleaseTracking(t *testing.T) {
+	cs := fake.NewSimpleClientset()
+	apply := func(dryRun bool, replicas int) {
+		pkgs := starlark.StringDict{"helm": New(&FakeDynamicClient{}, nil, "", dryRun, WithReleaseTracking(cs.CoreV1()))}
+		expr := fmt.Sprintf(`helm.apply(release_name="helm-test", chart="//../../testdata/istio/helm-test", namespace="istio-system", values=[{"global": {"priorityClassName": "critical"}, "pilot": {"replicaCount": %d, "image": "pilot:v1"}}])`, replicas)
+		if _, _, err := util.Eval(t.Name(), expr, nil, pkgs); err != nil {
+			t.Fatalf("Failed to apply: %v", err)
+		}
+	}
+	// revisions returns status label value of release Secrets by name.
+	revisions := func() map[string]string {
+		l, err := cs.CoreV1().Secrets("istio-system").List(metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		for _, s := range l.Items {
+			if s.Type != releaseSecretType || s.Labels["owner"] != "helm" || s.Labels["name"] != "helm-test" {
+				t.Errorf("Unexpected type or labels of `%s' Secret: %s %v", s.Name, s.Type, s.Labels)
+			}
+			got[s.Name] = s.Labels["status"]
+		}
+		return got
+	}
+
+	apply(true /* dryRun */, 1)
+	if got := revisions(); len(got) != 0 {
+		t.Fatalf("Expected no revisions recorded in dry run, got: %v", got)
+	}
+
+	apply(false, 1)
+	apply(false, 1)
+	want := map[string]string{"sh.helm.release.v1.helm-test.v1": "deployed"}
+	if d := cmp.Diff(want, revisions()); d != "" {
+		t.Fatalf("Unexpected revisions after unchanged apply (-want +got):\n%s", d)
+	}
+
+	apply(false, 2)
+	want = map[string]string{
+		"sh.helm.release.v1.helm-test.v1": "superseded",
+		"sh.helm.release.v1.helm-test.v2": "deployed",
+	}
+	if d := cmp.Diff(want, revisions()); d != "" {
+		t.Fatalf("Unexpected revisions after changed apply (-want +got):\n%s", d)
+	}
+
+	s, err := cs.CoreV1().Secrets("istio-system").Get("sh.helm.release.v1.helm-test.v2", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rls, err := decodeRelease(s.Data["release"])
+	if err != nil {
+		t.Fatalf("Failed to decode release: %v", err)
+	}
+	if rls.Name != "helm-test" || rls.Namespace != "istio-system" || rls.Version != 2 {
+		t.Errorf("Unexpected release `%s/%s' revision %d", rls.Namespace, rls.Name, rls.Version)
+	}
+	if got := rls.Config["pilot"]; !cmp.Equal(got, map[string]interface{}{"replicaCount": float64(2), "image": "pilot:v1"}) {
+		t.Errorf("Unexpected release config: %v", got)
+	}
+	if rls.Chart.Metadata.Name != "helm-test" || len(rls.Chart.Templates) == 0 {
+		t.Errorf("Unexpected release chart: %+v", rls.Chart)
+	}
+	if rls.Manifest == "" {
+		t.Error("Expected release manifest")
+	}
+
+	for i := 3; i <= releaseHistoryMax+2; i++ {
+		apply(false, i)
+	}
+	var names []string
+	for n := range revisions() {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if len(names) != releaseHistoryMax {
+		t.Errorf("Expected %d revisions kept, got: %v", releaseHistoryMax, names)
+	}
+	if got := revisions()[fmt.Sprintf("sh.helm.release.v1.helm-test.v%d", releaseHistoryMax+2)]; got != "deployed" {
+		t.Errorf("Expected the latest revision deployed, got: %q", got)
+	}
+}
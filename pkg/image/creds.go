@@ -0,0 +1,138 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Credentials looks up registry credentials.
+type Credentials interface {
+	// Get returns username and password for registry (host with optional
+	// port). ok is false if no credentials are configured for it.
+	Get(registry string) (user, pass string, ok bool, err error)
+}
+
+// dockerConfig is the subset of Docker CLI config.json relevant to registry
+// authentication.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth string `json:"auth"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// DockerCredentials implements Credentials the same way Docker CLI does:
+// per-registry credential helpers (credHelpers) take precedence over the
+// default credentials store (credsStore) and static auths.
+type DockerCredentials struct {
+	config dockerConfig
+}
+
+// NewDockerCredentials returns Credentials read from Docker CLI config.json
+// in $DOCKER_CONFIG (or ~/.docker if unset). A missing config file means no
+// credentials.
+func NewDockerCredentials() (*DockerCredentials, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return &DockerCredentials{}, nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(err) {
+		return &DockerCredentials{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	c := &DockerCredentials{}
+	if err := json.Unmarshal(bs, &c.config); err != nil {
+		return nil, fmt.Errorf("failed to parse Docker config: %v", err)
+	}
+	return c, nil
+}
+
+// Get implements Credentials.Get.
+func (c *DockerCredentials) Get(registry string) (user, pass string, ok bool, err error) {
+	// Docker Hub credentials are stored under the legacy index address.
+	keys := []string{registry, "https://" + registry}
+	if registry == dockerHubRegistry {
+		keys = []string{"https://index.docker.io/v1/", "index.docker.io", "docker.io"}
+	}
+
+	for _, k := range keys {
+		if h, found := c.config.CredHelpers[k]; found {
+			return credHelperGet(h, k)
+		}
+	}
+	if c.config.CredsStore != "" {
+		if user, pass, ok, err := credHelperGet(c.config.CredsStore, keys[0]); err != nil || ok {
+			return user, pass, ok, err
+		}
+	}
+	for _, k := range keys {
+		if a, found := c.config.Auths[k]; found && a.Auth != "" {
+			bs, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return "", "", false, fmt.Errorf("invalid auth for `%s': %v", k, err)
+			}
+			ps := strings.SplitN(string(bs), ":", 2)
+			if len(ps) != 2 {
+				return "", "", false, fmt.Errorf("invalid auth for `%s': expected `user:password'", k)
+			}
+			return ps[0], ps[1], true, nil
+		}
+	}
+	return "", "", false, nil
+}
+
+// credHelperGet runs docker-credential-<helper> to get credentials for
+// serverURL (https://github.com/docker/docker-credential-helpers).
+func credHelperGet(helper, serverURL string) (user, pass string, ok bool, err error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// Helpers report missing credentials on stdout.
+		if strings.Contains(string(out), "credentials not found") {
+			return "", "", false, nil
+		}
+		return "", "", false, fmt.Errorf("credential helper `%s' failed: %v: %s", helper, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var c struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(out, &c); err != nil {
+		return "", "", false, fmt.Errorf("failed to parse output of credential helper `%s': %v", helper, err)
+	}
+	return c.Username, c.Secret, true, nil
+}
@@ -0,0 +1,226 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package image implements "image" built-in package to pin container images
+// by digest from an addon.
+package image
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+const (
+	dockerHubRegistry = "registry-1.docker.io"
+	defaultTag        = "latest"
+)
+
+// imagePackage implements image package.
+type imagePackage struct {
+	*isopod.Module
+	client    *http.Client
+	noNetwork bool
+	userAgent string
+	creds     Credentials
+	cache     *DigestCache
+}
+
+// Option is an optional image package setting.
+type Option interface {
+	apply(*imagePackage)
+}
+
+type fnOption func(*imagePackage)
+
+func (fn fnOption) apply(p *imagePackage) { fn(p) }
+
+// WithUserAgent returns an Option that sends registry requests as ua.
+func WithUserAgent(ua string) Option {
+	return fnOption(func(p *imagePackage) {
+		p.userAgent = ua
+	})
+}
+
+// WithCredentials returns an Option that authenticates to registries with c
+// (registries are accessed anonymously otherwise).
+func WithCredentials(c Credentials) Option {
+	return fnOption(func(p *imagePackage) {
+		p.creds = c
+	})
+}
+
+// WithDigestCache returns an Option that reuses digests resolved so far from
+// c. Share c between packages of all clusters to resolve each tag once (and
+// pin it to the same digest everywhere) per run.
+func WithDigestCache(c *DigestCache) Option {
+	return fnOption(func(p *imagePackage) {
+		p.cache = c
+	})
+}
+
+// New returns a new starlark.HasAttrs object for image package. Registry
+// requests are sent with c. If noNetwork is set image references are not
+// resolved.
+func New(c *http.Client, noNetwork bool, opts ...Option) starlark.HasAttrs {
+	p := &imagePackage{
+		client:    c,
+		noNetwork: noNetwork,
+	}
+	for _, o := range opts {
+		o.apply(p)
+	}
+	if p.cache == nil {
+		p.cache = NewDigestCache()
+	}
+
+	p.Module = &isopod.Module{
+		Name: "image",
+		Attrs: starlark.StringDict{
+			"resolve": starlark.NewBuiltin("image.resolve", p.imageResolveFn),
+		},
+	}
+	return p
+}
+
+// DigestCache memoizes digests image tags were resolved to. Safe for
+// concurrent use.
+type DigestCache struct {
+	mu      sync.Mutex
+	digests map[string]string
+}
+
+// NewDigestCache returns an empty DigestCache.
+func NewDigestCache() *DigestCache {
+	return &DigestCache{digests: map[string]string{}}
+}
+
+func (c *DigestCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.digests[key]
+	return d, ok
+}
+
+func (c *DigestCache) put(key, digest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.digests[key] = digest
+}
+
+// imageResolveFn is a starlark built-in function that resolves tag of an
+// image reference to the digest it currently points to in the registry.
+// For multi-arch images the digest of the manifest list is returned.
+// References already pinned by digest are returned as-is.
+// Usage:
+//
+//	image.resolve("gcr.io/foo/bar:v1.2.3") # "gcr.io/foo/bar@sha256:..."
+func (p *imagePackage) imageResolveFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var s string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &s); err != nil {
+		return nil, fmt.Errorf("<%v>: failed to parse args: %v", b.Name(), err)
+	}
+
+	ref, err := parseReference(s)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if ref.digest != "" {
+		return starlark.String(s), nil
+	}
+	if p.noNetwork {
+		log.Warningf("Not resolving image `%s': network access is disabled", s)
+		return starlark.String(s), nil
+	}
+
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	d, err := p.resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to resolve `%s': %v", b.Name(), s, err)
+	}
+	return starlark.String(ref.name + "@" + d), nil
+}
+
+// resolve returns digest of ref (cached).
+func (p *imagePackage) resolve(ctx context.Context, ref *reference) (string, error) {
+	key := ref.registry + "/" + ref.repository + ":" + ref.tag
+	if d, ok := p.cache.get(key); ok {
+		return d, nil
+	}
+
+	d, err := p.fetchDigest(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	log.Infof("Resolved image `%s' to `%s'", key, d)
+	p.cache.put(key, d)
+	return d, nil
+}
+
+// reference is a parsed image reference, e.g "gcr.io/foo/bar:v1" or
+// "ubuntu@sha256:...".
+type reference struct {
+	// name is the reference without tag or digest as it was specified.
+	name string
+	// registry is the registry host (with optional port) and repository is
+	// the path within it (normalized for Docker Hub).
+	registry, repository string
+	tag, digest          string
+}
+
+// parseReference parses s the same way docker does: first path component
+// only names a registry if it looks like a host (contains "." or ":" or is
+// "localhost"), otherwise the image is on Docker Hub.
+func parseReference(s string) (*reference, error) {
+	ref := &reference{name: s}
+	if i := strings.Index(ref.name, "@"); i >= 0 {
+		ref.name, ref.digest = ref.name[:i], ref.name[i+1:]
+		if !strings.HasPrefix(ref.digest, "sha256:") {
+			return nil, fmt.Errorf("unsupported digest in image reference `%s'", s)
+		}
+	}
+	// Tag follows the last colon after the last slash (colon before it
+	// separates registry port).
+	if i := strings.LastIndex(ref.name, ":"); i > strings.LastIndex(ref.name, "/") {
+		ref.name, ref.tag = ref.name[:i], ref.name[i+1:]
+	}
+	if ref.name == "" || (ref.tag == "" && strings.HasSuffix(s, ":")) {
+		return nil, fmt.Errorf("invalid image reference `%s'", s)
+	}
+	if ref.tag == "" {
+		ref.tag = defaultTag
+	}
+
+	ref.registry, ref.repository = dockerHubRegistry, ref.name
+	if i := strings.Index(ref.name, "/"); i >= 0 {
+		if host := ref.name[:i]; strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.registry, ref.repository = host, ref.name[i+1:]
+		}
+	}
+	if ref.registry == "docker.io" || ref.registry == "index.docker.io" {
+		ref.registry = dockerHubRegistry
+	}
+	if ref.registry == dockerHubRegistry && !strings.Contains(ref.repository, "/") {
+		ref.repository = "library/" + ref.repository
+	}
+	return ref, nil
+}
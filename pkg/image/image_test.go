@@ -0,0 +1,185 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestParseReference(t *testing.T) {
+	for _, tc := range []struct {
+		ref     string
+		want    *reference
+		wantErr bool
+	}{
+		{
+			ref:  "ubuntu",
+			want: &reference{name: "ubuntu", registry: dockerHubRegistry, repository: "library/ubuntu", tag: "latest"},
+		},
+		{
+			ref:  "docker.io/istio/pilot:1.2.3",
+			want: &reference{name: "docker.io/istio/pilot", registry: dockerHubRegistry, repository: "istio/pilot", tag: "1.2.3"},
+		},
+		{
+			ref:  "localhost:5000/foo/bar:v1",
+			want: &reference{name: "localhost:5000/foo/bar", registry: "localhost:5000", repository: "foo/bar", tag: "v1"},
+		},
+		{
+			ref:  "gcr.io/foo/bar@sha256:abc",
+			want: &reference{name: "gcr.io/foo/bar", registry: "gcr.io", repository: "foo/bar", tag: "latest", digest: "sha256:abc"},
+		},
+		{
+			ref:     "gcr.io/foo/bar:",
+			wantErr: true,
+		},
+		{
+			ref:     "gcr.io/foo/bar@md5:abc",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.ref, func(t *testing.T) {
+			got, err := parseReference(tc.ref)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if d := cmp.Diff(tc.want, got, cmp.AllowUnexported(reference{})); d != "" {
+				t.Errorf("Unexpected reference (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+type fakeCreds map[string][2]string
+
+func (c fakeCreds) Get(registry string) (string, string, bool, error) {
+	up, ok := c[registry]
+	return up[0], up[1], ok, nil
+}
+
+func TestResolve(t *testing.T) {
+	const digest = "sha256:0123456789abcdef"
+
+	var host string
+	var manifestReqs int
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			if u, p, ok := r.BasicAuth(); !ok || u != "robot" || p != "s3cret" {
+				http.Error(w, "bad credentials", http.StatusUnauthorized)
+				return
+			}
+			if s := r.URL.Query().Get("scope"); s != "repository:team/app:pull" {
+				http.Error(w, "unexpected scope "+s, http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, `{"token": "t0k3n"}`)
+		case r.URL.Path == "/v2/team/app/manifests/v1":
+			if r.Header.Get("Authorization") != "Bearer t0k3n" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="%s"`, host, host))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if !strings.HasPrefix(r.Header.Get("Accept"), "application/vnd.docker.distribution.manifest.list.v2+json") {
+				http.Error(w, "manifest lists not accepted", http.StatusBadRequest)
+				return
+			}
+			manifestReqs++
+			w.Header().Set("Docker-Content-Digest", digest)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	host = strings.TrimPrefix(ts.URL, "https://")
+
+	for _, tc := range []struct {
+		desc      string
+		expr      string
+		noNetwork bool
+		creds     fakeCreds
+		want      starlark.Value
+		wantReqs  int
+		wantErr   string
+	}{
+		{
+			desc:     "Resolve once",
+			expr:     `[image.resolve("HOST/team/app:v1"), image.resolve("HOST/team/app:v1")]`,
+			creds:    fakeCreds{"HOST": {"robot", "s3cret"}},
+			want:     starlark.NewList([]starlark.Value{starlark.String("HOST/team/app@" + digest), starlark.String("HOST/team/app@" + digest)}),
+			wantReqs: 1,
+		},
+		{
+			desc: "Already pinned",
+			expr: `image.resolve("HOST/team/app@sha256:fedcba")`,
+			want: starlark.String("HOST/team/app@sha256:fedcba"),
+		},
+		{
+			desc:      "No network",
+			expr:      `image.resolve("HOST/team/app:v1")`,
+			noNetwork: true,
+			want:      starlark.String("HOST/team/app:v1"),
+		},
+		{
+			desc:    "Bad credentials",
+			expr:    `image.resolve("HOST/team/app:v1")`,
+			creds:   fakeCreds{"HOST": {"robot", "wrong"}},
+			wantErr: "<image.resolve>: failed to resolve `HOST/team/app:v1': failed to authenticate to `HOST': token server returned 401 Unauthorized: bad credentials",
+		},
+		{
+			desc:    "Unknown tag",
+			expr:    `image.resolve("HOST/team/app:v2")`,
+			wantErr: "<image.resolve>: failed to resolve `HOST/team/app:v2': registry returned 404 Not Found: ",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			manifestReqs = 0
+			creds := fakeCreds{}
+			for k, v := range tc.creds {
+				creds[strings.Replace(k, "HOST", host, 1)] = v
+			}
+			pkg := New(ts.Client(), tc.noNetwork, WithCredentials(creds))
+
+			expr := strings.Replace(tc.expr, "HOST", host, -1)
+			got, _, err := util.Eval(t.Name(), expr, nil, starlark.StringDict{"image": pkg})
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if wantErr := strings.Replace(tc.wantErr, "HOST", host, -1); gotErr != wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", wantErr, gotErr)
+			}
+			if err != nil {
+				return
+			}
+
+			want := strings.Replace(tc.want.String(), "HOST", host, -1)
+			if got.String() != want {
+				t.Errorf("Unexpected result.\nWant: %s\nGot: %s", want, got)
+			}
+			if manifestReqs != tc.wantReqs {
+				t.Errorf("Expected %d manifest requests, got %d", tc.wantReqs, manifestReqs)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Manifest media types accepted when resolving a tag. Manifest lists (OCI
+// indexes) come first so that multi-arch images are pinned as a whole rather
+// than to the manifest of a single platform.
+var manifestTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// fetchDigest returns digest of ref manifest via Docker Registry HTTP API V2.
+func (p *imagePackage) fetchDigest(ctx context.Context, ref *reference) (string, error) {
+	u := fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.registry, ref.repository, ref.tag)
+
+	resp, err := p.manifestRequest(ctx, u, "")
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		auth, err := p.authorize(ctx, ref, challenge)
+		if err != nil {
+			return "", fmt.Errorf("failed to authenticate to `%s': %v", ref.registry, err)
+		}
+		if resp, err = p.manifestRequest(ctx, u, auth); err != nil {
+			return "", err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry returned %s: %s", resp.Status, readSnippet(resp.Body))
+	}
+	d := resp.Header.Get("Docker-Content-Digest")
+	if !strings.HasPrefix(d, "sha256:") {
+		return "", fmt.Errorf("registry returned no sha256 digest (got `%s')", d)
+	}
+	return d, nil
+}
+
+// manifestRequest sends HEAD request for manifest at u with optional
+// Authorization header value auth.
+func (p *imagePackage) manifestRequest(ctx context.Context, u, auth string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+	req.Header.Set("User-Agent", p.userAgent)
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+	return resp, nil
+}
+
+// authorize returns Authorization header value that satisfies challenge
+// (value of WWW-Authenticate header) of ref registry.
+func (p *imagePackage) authorize(ctx context.Context, ref *reference, challenge string) (string, error) {
+	var user, pass string
+	var hasCreds bool
+	if p.creds != nil {
+		var err error
+		if user, pass, hasCreds, err = p.creds.Get(ref.registry); err != nil {
+			return "", fmt.Errorf("failed to get credentials: %v", err)
+		}
+	}
+
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if !hasCreds {
+			return "", errors.New("registry requires credentials but none are configured")
+		}
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(user, pass)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+		token, err := p.fetchToken(ctx, params, "repository:"+ref.repository+":pull", user, pass, hasCreds)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	default:
+		return "", fmt.Errorf("unsupported authentication challenge `%s'", challenge)
+	}
+}
+
+// fetchToken obtains a bearer token for scope from the token server named
+// by challenge params (https://docs.docker.com/registry/spec/auth/token/).
+func (p *imagePackage) fetchToken(ctx context.Context, params map[string]string, scope, user, pass string, hasCreds bool) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid token realm `%s'", params["realm"])
+	}
+	q := realm.Query()
+	if s, ok := params["service"]; ok {
+		q.Set("service", s)
+	}
+	if s, ok := params["scope"]; ok {
+		scope = s
+	}
+	q.Set("scope", scope)
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", p.userAgent)
+	if hasCreds {
+		req.SetBasicAuth(user, pass)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token server returned %s: %s", resp.Status, readSnippet(resp.Body))
+	}
+
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", fmt.Errorf("failed to decode token: %v", err)
+	}
+	if t.Token != "" {
+		return t.Token, nil
+	}
+	if t.AccessToken != "" {
+		return t.AccessToken, nil
+	}
+	return "", errors.New("token server returned no token")
+}
+
+// parseChallenge parses WWW-Authenticate header value of the form
+// `Bearer realm="https://auth.example.com/token",service="example.com"'.
+func parseChallenge(s string) (scheme string, params map[string]string) {
+	params = map[string]string{}
+	s = strings.TrimSpace(s)
+	i := strings.IndexByte(s, ' ')
+	if i < 0 {
+		return s, params
+	}
+	scheme, s = s[:i], s[i+1:]
+
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		k := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+
+		var v string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				v, s = s[1:], ""
+			} else {
+				v, s = s[1:end+1], s[end+2:]
+			}
+		} else if end := strings.IndexByte(s, ','); end >= 0 {
+			v, s = s[:end], s[end:]
+		} else {
+			v, s = s, ""
+		}
+		params[k] = v
+	}
+	return scheme, params
+}
+
+// readSnippet returns the beginning of r for error messages.
+func readSnippet(r io.Reader) string {
+	bs, _ := ioutil.ReadAll(io.LimitReader(r, 256))
+	return strings.TrimSpace(string(bs))
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RegistryRewrite replaces the registry (and optional repository prefix)
+// From of image references with To, e.g `docker.io' with
+// `registry.internal/docker'.
+type RegistryRewrite struct {
+	From, To string
+}
+
+// ParseRegistryRewrites parses comma separated from=to rewrites, e.g
+// `docker.io=registry.internal/docker,gcr.io=registry.internal/gcr'. More
+// specific rewrites (longer From) come first.
+func ParseRegistryRewrites(s string) ([]RegistryRewrite, error) {
+	var rs []RegistryRewrite
+	seen := map[string]bool{}
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid registry rewrite `%s' (must be <from>=<to>)", kv)
+		}
+		from := canonicalName(strings.TrimSuffix(parts[0], "/"))
+		if seen[from] {
+			return nil, fmt.Errorf("registry `%s' is rewritten more than once", parts[0])
+		}
+		seen[from] = true
+		rs = append(rs, RegistryRewrite{From: from, To: strings.TrimSuffix(parts[1], "/")})
+	}
+	sort.SliceStable(rs, func(i, j int) bool { return len(rs[i].From) > len(rs[j].From) })
+	return rs, nil
+}
+
+// canonicalName returns name with Docker Hub aliases replaced by `docker.io'.
+func canonicalName(name string) string {
+	for _, alias := range []string{dockerHubRegistry, "index.docker.io"} {
+		if name == alias || strings.HasPrefix(name, alias+"/") {
+			return "docker.io" + name[len(alias):]
+		}
+	}
+	return name
+}
+
+// RewriteReference returns image reference s with the first of rs matching
+// its registry (and repository prefix) applied, keeping its tag and digest
+// as is. Docker Hub references are matched in full form, e.g `nginx:1.17'
+// is `docker.io/library/nginx:1.17'. Returns false if none of rs match.
+func RewriteReference(s string, rs []RegistryRewrite) (string, bool, error) {
+	ref, err := parseReference(s)
+	if err != nil {
+		return "", false, err
+	}
+	registry := ref.registry
+	if registry == dockerHubRegistry {
+		registry = "docker.io"
+	}
+	name := registry + "/" + ref.repository
+	// Tag and digest as specified (tag is defaulted by parseReference).
+	suffix := s[len(ref.name):]
+
+	for _, r := range rs {
+		if name == r.From || strings.HasPrefix(name, r.From+"/") {
+			return r.To + name[len(r.From):] + suffix, true, nil
+		}
+	}
+	return s, false, nil
+}
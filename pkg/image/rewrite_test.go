@@ -0,0 +1,64 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import "testing"
+
+func TestRewriteReference(t *testing.T) {
+	rs, err := ParseRegistryRewrites("docker.io=registry.internal/docker,gcr.io=registry.internal/gcr, gcr.io/special/=registry.internal/special")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		in, want string
+		wantOK   bool
+	}{
+		{in: "nginx", want: "registry.internal/docker/library/nginx", wantOK: true},
+		{in: "nginx:1.17", want: "registry.internal/docker/library/nginx:1.17", wantOK: true},
+		{in: "docker.io/bitnami/redis:5", want: "registry.internal/docker/bitnami/redis:5", wantOK: true},
+		{in: "index.docker.io/library/ubuntu@sha256:abcd", want: "registry.internal/docker/library/ubuntu@sha256:abcd", wantOK: true},
+		{in: "gcr.io/project/app:v1@sha256:abcd", want: "registry.internal/gcr/project/app:v1@sha256:abcd", wantOK: true},
+		{in: "gcr.io/special/app:v1", want: "registry.internal/special/app:v1", wantOK: true},
+		// Registry is matched as a whole, not as a prefix.
+		{in: "gcr.io.example.com/app:v1", want: "gcr.io.example.com/app:v1"},
+		{in: "quay.io/coreos/etcd:v3", want: "quay.io/coreos/etcd:v3"},
+		{in: "registry.internal/docker/library/nginx", want: "registry.internal/docker/library/nginx"},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			got, ok, err := RewriteReference(tc.in, rs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want || ok != tc.wantOK {
+				t.Errorf("RewriteReference(%q) = %q, %v, want %q, %v", tc.in, got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseRegistryRewritesInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		in, wantErr string
+	}{
+		{in: "docker.io", wantErr: "invalid registry rewrite `docker.io' (must be <from>=<to>)"},
+		{in: "=registry.internal", wantErr: "invalid registry rewrite `=registry.internal' (must be <from>=<to>)"},
+		{in: "docker.io=a,index.docker.io=b", wantErr: "registry `index.docker.io' is rewritten more than once"},
+	} {
+		if _, err := ParseRegistryRewrites(tc.in); err == nil || err.Error() != tc.wantErr {
+			t.Errorf("ParseRegistryRewrites(%q): expected error `%s', got: %v", tc.in, tc.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"regexp"
+
+	log "github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	opCreate = "CREATE"
+	opUpdate = "UPDATE"
+)
+
+// webhookNameRe extracts the webhook name from errors returned by API server
+// when an admission webhook rejects a request (or fails to be called).
+var webhookNameRe = regexp.MustCompile(`admission webhook "([^"]+)" denied the request|failed calling (?:admission )?webhook "([^"]+)"`)
+
+// webhookConfigKinds are kinds of webhook configurations (by resource) whose
+// webhooks admission errors are attributed to.
+var webhookConfigKinds = []struct{ resource, kind string }{
+	{"validatingwebhookconfigurations", "ValidatingWebhookConfiguration"},
+	{"mutatingwebhookconfigurations", "MutatingWebhookConfiguration"},
+}
+
+// webhookConfigVersions are versions of admissionregistration.k8s.io API
+// tried in order.
+var webhookConfigVersions = []string{"v1", "v1beta1"}
+
+// webhook is a single admission webhook of a webhook configuration.
+type webhook struct {
+	ConfigKind, ConfigName string
+	Name                   string
+	Rules                  []webhookRule
+}
+
+// webhookRule is a rule of the webhook (see
+// admissionregistration.k8s.io/v1beta1.RuleWithOperations).
+type webhookRule struct {
+	Operations  []string
+	APIGroups   []string
+	APIVersions []string
+	Resources   []string
+	Scope       string
+}
+
+// matches returns true if rule matches operation op on r.
+func (rule webhookRule) matches(r *apiResource, op string) bool {
+	if !matchesAny(rule.Operations, op) || !matchesAny(rule.APIGroups, r.GVK.Group) || !matchesAny(rule.APIVersions, r.GVK.Version) {
+		return false
+	}
+	switch rule.Scope {
+	case "Cluster":
+		if !r.ClusterScoped {
+			return false
+		}
+	case "Namespaced":
+		if r.ClusterScoped {
+			return false
+		}
+	}
+
+	for _, res := range rule.Resources {
+		switch {
+		case res == "*/*":
+			return true
+		case res == "*" && r.Subresource == "":
+			return true
+		case r.Subresource == "" && res == r.Resource:
+			return true
+		case r.Subresource != "" && (res == r.Resource+"/"+r.Subresource || res == r.Resource+"/*" || res == "*/"+r.Subresource):
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(vs []string, v string) bool {
+	for _, s := range vs {
+		if s == "*" || s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// attributeWebhook returns the webhook in hooks that rejected operation op on
+// r with error message msg. Returns false if msg is not an admission error or
+// the webhook can not be told apart from others.
+func attributeWebhook(msg string, hooks []webhook, r *apiResource, op string) (webhook, bool) {
+	ms := webhookNameRe.FindStringSubmatch(msg)
+	if ms == nil {
+		return webhook{}, false
+	}
+	name := ms[1]
+	if name == "" {
+		name = ms[2]
+	}
+
+	var named, matched []webhook
+	for _, h := range hooks {
+		if h.Name != name {
+			continue
+		}
+		named = append(named, h)
+		for _, rule := range h.Rules {
+			if rule.matches(r, op) {
+				matched = append(matched, h)
+				break
+			}
+		}
+	}
+	switch {
+	case len(matched) == 1:
+		return matched[0], true
+	case len(matched) == 0 && len(named) == 1:
+		// Rules don't match (e.g the webhook was reconfigured since) but the
+		// name alone is unambiguous.
+		return named[0], true
+	}
+	return webhook{}, false
+}
+
+// attributeAdmissionError attributes err returned when performing operation
+// op on r to the admission webhook that rejected it (and its configuration).
+// Returns err as-is if it's not an admission error or attributing it fails.
+func (m *kubePackage) attributeAdmissionError(r *apiResource, op string, err error) error {
+	if err == nil || !webhookNameRe.MatchString(err.Error()) {
+		return err
+	}
+
+	hooks, lErr := m.listWebhooks()
+	if lErr != nil {
+		log.Warningf("Failed to list admission webhooks to attribute error for %v: %v", r, lErr)
+		return err
+	}
+	h, ok := attributeWebhook(err.Error(), hooks, r, op)
+	if !ok {
+		return err
+	}
+	return fmt.Errorf("rejected by webhook `%s' of %s `%s': %v", h.Name, h.ConfigKind, h.ConfigName, err)
+}
+
+// listWebhooks returns webhooks of all webhook configurations.
+func (m *kubePackage) listWebhooks() ([]webhook, error) {
+	var hooks []webhook
+	for _, k := range webhookConfigKinds {
+		var l *unstructured.UnstructuredList
+		var err error
+		for _, v := range webhookConfigVersions {
+			gvr := schema.GroupVersionResource{Group: "admissionregistration.k8s.io", Version: v, Resource: k.resource}
+			l, err = m.dynClient.Resource(gvr).List(metav1.ListOptions{})
+			if !apierrors.IsNotFound(err) {
+				break
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %ss: %v", k.kind, err)
+		}
+
+		for _, item := range l.Items {
+			hs, err := webhooksOf(k.kind, &item)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s `%s': %v", k.kind, item.GetName(), err)
+			}
+			hooks = append(hooks, hs...)
+		}
+	}
+	return hooks, nil
+}
+
+// webhooksOf returns webhooks of webhook configuration config of kind.
+func webhooksOf(kind string, config *unstructured.Unstructured) ([]webhook, error) {
+	items, _, err := unstructured.NestedSlice(config.Object, "webhooks")
+	if err != nil {
+		return nil, err
+	}
+
+	var hooks []webhook
+	for _, item := range items {
+		wh, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected webhook type %T", item)
+		}
+		name, _, err := unstructured.NestedString(wh, "name")
+		if err != nil {
+			return nil, err
+		}
+		h := webhook{ConfigKind: kind, ConfigName: config.GetName(), Name: name}
+
+		rules, _, err := unstructured.NestedSlice(wh, "rules")
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rules {
+			rm, ok := r.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("unexpected rule type %T", r)
+			}
+			var rule webhookRule
+			for _, f := range []struct {
+				field string
+				v     *[]string
+			}{
+				{"operations", &rule.Operations},
+				{"apiGroups", &rule.APIGroups},
+				{"apiVersions", &rule.APIVersions},
+				{"resources", &rule.Resources},
+			} {
+				if *f.v, _, err = unstructured.NestedStringSlice(rm, f.field); err != nil {
+					return nil, err
+				}
+			}
+			if rule.Scope, _, err = unstructured.NestedString(rm, "scope"); err != nil {
+				return nil, err
+			}
+			h.Rules = append(h.Rules, rule)
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
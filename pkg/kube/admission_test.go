@@ -0,0 +1,173 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+const webhookConfigs = `
+- apiVersion: admissionregistration.k8s.io/v1
+  kind: ValidatingWebhookConfiguration
+  metadata:
+    name: policy
+  webhooks:
+  - name: pods.policy.example.com
+    rules:
+    - operations: ["CREATE", "UPDATE"]
+      apiGroups: [""]
+      apiVersions: ["v1"]
+      resources: ["pods"]
+      scope: Namespaced
+  - name: shared.example.com
+    rules:
+    - operations: ["CREATE"]
+      apiGroups: ["apps"]
+      apiVersions: ["*"]
+      resources: ["deployments", "deployments/scale"]
+- apiVersion: admissionregistration.k8s.io/v1
+  kind: MutatingWebhookConfiguration
+  metadata:
+    name: defaults
+  webhooks:
+  - name: shared.example.com
+    rules:
+    - operations: ["*"]
+      apiGroups: ["*"]
+      apiVersions: ["*"]
+      resources: ["*"]
+      scope: Cluster
+`
+
+func TestAttributeWebhook(t *testing.T) {
+	var configs []map[string]interface{}
+	if err := yaml.Unmarshal([]byte(webhookConfigs), &configs); err != nil {
+		t.Fatal(err)
+	}
+	var hooks []webhook
+	for _, c := range configs {
+		u := &unstructured.Unstructured{Object: c}
+		hs, err := webhooksOf(u.GetKind(), u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hooks = append(hooks, hs...)
+	}
+
+	pod := &apiResource{GVK: schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, Resource: "pods", Namespace: "default", Name: "foo"}
+	deploy := &apiResource{GVK: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, Resource: "deployments", Namespace: "default", Name: "foo"}
+	scale := &apiResource{GVK: deploy.GVK, Resource: "deployments", Subresource: "scale", Namespace: "default", Name: "foo"}
+	ns := &apiResource{GVK: schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, Resource: "namespaces", Name: "foo", ClusterScoped: true}
+
+	for _, tc := range []struct {
+		desc                 string
+		msg                  string
+		r                    *apiResource
+		op                   string
+		wantKind, wantConfig string
+		wantOK               bool
+	}{
+		{
+			desc:       "Denied by named webhook",
+			msg:        `admission webhook "pods.policy.example.com" denied the request: privileged containers are not allowed`,
+			r:          pod,
+			op:         opCreate,
+			wantKind:   "ValidatingWebhookConfiguration",
+			wantConfig: "policy",
+			wantOK:     true,
+		},
+		{
+			desc:       "Webhook call failed",
+			msg:        `Internal error occurred: failed calling webhook "pods.policy.example.com": Post https://policy.svc:443/validate: dial tcp: i/o timeout`,
+			r:          pod,
+			op:         opUpdate,
+			wantKind:   "ValidatingWebhookConfiguration",
+			wantConfig: "policy",
+			wantOK:     true,
+		},
+		{
+			desc:       "Shared name told apart by rules",
+			msg:        `admission webhook "shared.example.com" denied the request: nope`,
+			r:          deploy,
+			op:         opCreate,
+			wantKind:   "ValidatingWebhookConfiguration",
+			wantConfig: "policy",
+			wantOK:     true,
+		},
+		{
+			desc:       "Shared name told apart by subresource rules",
+			msg:        `admission webhook "shared.example.com" denied the request: nope`,
+			r:          scale,
+			op:         opCreate,
+			wantKind:   "ValidatingWebhookConfiguration",
+			wantConfig: "policy",
+			wantOK:     true,
+		},
+		{
+			desc:       "Shared name told apart by scope",
+			msg:        `admission webhook "shared.example.com" denied the request: nope`,
+			r:          ns,
+			op:         opUpdate,
+			wantKind:   "MutatingWebhookConfiguration",
+			wantConfig: "defaults",
+			wantOK:     true,
+		},
+		{
+			desc:       "Unique name with no matching rules",
+			msg:        `admission webhook "pods.policy.example.com" denied the request: nope`,
+			r:          deploy,
+			op:         opCreate,
+			wantKind:   "ValidatingWebhookConfiguration",
+			wantConfig: "policy",
+			wantOK:     true,
+		},
+		{
+			desc: "Shared name with no matching rules",
+			msg:  `admission webhook "shared.example.com" denied the request: nope`,
+			r:    deploy,
+			op:   opUpdate,
+		},
+		{
+			desc: "Unknown webhook",
+			msg:  `admission webhook "other.example.com" denied the request: nope`,
+			r:    pod,
+			op:   opCreate,
+		},
+		{
+			desc: "Not an admission error",
+			msg:  `pods "foo" is forbidden: exceeded quota`,
+			r:    pod,
+			op:   opCreate,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			h, ok := attributeWebhook(tc.msg, hooks, tc.r, tc.op)
+			if ok != tc.wantOK {
+				t.Fatalf("Unexpected attribution result.\nWant: %v\nGot: %v (%+v)", tc.wantOK, ok, h)
+			}
+			if !ok {
+				return
+			}
+			if d := cmp.Diff([]string{tc.wantKind, tc.wantConfig}, []string{h.ConfigKind, h.ConfigName}); d != "" {
+				t.Errorf("Unexpected webhook configuration (-want +got):\n%s", d)
+			}
+		})
+	}
+}
@@ -21,9 +21,9 @@ import (
 
 	gogo_proto "github.com/gogo/protobuf/proto"
 	"github.com/golang/protobuf/proto"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/discovery"
-	"k8s.io/client-go/restmapper"
 )
 
 type apiResource struct {
@@ -35,6 +35,11 @@ type apiResource struct {
 	Subresource   string
 }
 
+// isCRD returns true if gvk is of a CustomResourceDefinition.
+func isCRD(gvk schema.GroupVersionKind) bool {
+	return gvk.Group == "apiextensions.k8s.io" && gvk.Kind == "CustomResourceDefinition"
+}
+
 // guessGVKFromMsg attempts to guess schema.GroupVersionKind based on Protobuf
 // message type comma-delimited string.
 // e.g "k8s.io.api.core.v1.Pod" turned into "", "v1", "Pod".
@@ -60,21 +65,17 @@ func newResource(
 	dClient discovery.DiscoveryInterface,
 	name, namespace, apiGroup, resource, subresource string,
 ) (*apiResource, error) {
-	gr, err := restmapper.GetAPIGroupResources(dClient)
-	if err != nil {
-		return nil, err
-	}
-
 	partial := schema.GroupVersionResource{Group: apiGroup, Resource: resource}
-	rMapper := restmapper.NewDiscoveryRESTMapper(gr)
-
-	gvk, err := rMapper.KindFor(partial)
-	if err != nil {
-		return nil, err
-	}
-
-	gvr, err := rMapper.ResourceFor(partial)
-	if err != nil {
+	var gvk schema.GroupVersionKind
+	var gvr schema.GroupVersionResource
+	if err := mapWithRetry(dClient, func(rMapper meta.RESTMapper) error {
+		var err error
+		if gvk, err = rMapper.KindFor(partial); err != nil {
+			return err
+		}
+		gvr, err = rMapper.ResourceFor(partial)
+		return err
+	}); err != nil {
 		return nil, err
 	}
 
@@ -105,22 +106,22 @@ func newResourceForMsg(
 		g = apiGroup
 	}
 
-	gr, err := restmapper.GetAPIGroupResources(dClient)
-	if err != nil {
-		return nil, err
-	}
-
-	mapping, err := restmapper.NewDiscoveryRESTMapper(gr).RESTMapping(schema.GroupKind{Group: g, Kind: k}, v)
-	if err != nil {
+	var mapping *meta.RESTMapping
+	if err := mapWithRetry(dClient, func(rMapper meta.RESTMapper) error {
+		var err error
+		mapping, err = rMapper.RESTMapping(schema.GroupKind{Group: g, Kind: k}, v)
+		return err
+	}); err != nil {
 		return nil, err
 	}
 
 	r := &apiResource{
-		GVK:         mapping.GroupVersionKind,
-		Name:        name,
-		Namespace:   namespace,
-		Resource:    mapping.Resource.Resource,
-		Subresource: subresource,
+		GVK:           mapping.GroupVersionKind,
+		Name:          name,
+		Namespace:     namespace,
+		ClusterScoped: mapping.Scope.Name() == "root",
+		Resource:      mapping.Resource.Resource,
+		Subresource:   subresource,
 	}
 	return r.validate()
 }
@@ -130,13 +131,12 @@ func newResourceForKind(
 	name, namespace, subresource string,
 	gvk schema.GroupVersionKind,
 ) (*apiResource, error) {
-	gr, err := restmapper.GetAPIGroupResources(dClient)
-	if err != nil {
-		return nil, err
-	}
-
-	mapping, err := restmapper.NewDiscoveryRESTMapper(gr).RESTMapping(gvk.GroupKind(), gvk.Version)
-	if err != nil {
+	var mapping *meta.RESTMapping
+	if err := mapWithRetry(dClient, func(rMapper meta.RESTMapper) error {
+		var err error
+		mapping, err = rMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		return err
+	}); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,312 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// ApplySet labels and annotations (see
+// https://github.com/kubernetes/enhancements/tree/master/keps/sig-cli/3659-kubectl-apply-prune).
+// Members are labeled with the ID of their parent, which lists their group
+// kinds and namespaces (other than its own).
+const (
+	applySetPartOfLabelKey          = "applyset.kubernetes.io/part-of"
+	applySetIDLabelKey              = "applyset.kubernetes.io/id"
+	applySetToolingAnnotationKey    = "applyset.kubernetes.io/tooling"
+	applySetGroupKindsAnnotationKey = "applyset.kubernetes.io/contains-group-kinds"
+	applySetNamespacesAnnotationKey = "applyset.kubernetes.io/additional-namespaces"
+
+	applySetTooling = "isopod/v1"
+)
+
+// applySetParentGVR is the resource of ApplySet parents (Secrets).
+var applySetParentGVR = schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+
+// applySet is the parent of the ApplySet of an addon as known so far.
+type applySet struct {
+	name       string
+	found      bool
+	groupKinds map[string]bool
+	namespaces map[string]bool
+}
+
+// invalidNameRe matches characters not allowed in object names.
+var invalidNameRe = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// applySetName returns the name of the ApplySet parent of addonName.
+func (m *kubePackage) applySetName(addonName string) string {
+	name := "isopod-applyset-"
+	if m.instanceID != "" {
+		name += m.instanceID + "-"
+	}
+	return strings.Trim(invalidNameRe.ReplaceAllString(strings.ToLower(name+addonName), "-"), "-.")
+}
+
+// applySetID returns the ID of the ApplySet with parent Secret name in
+// namespace (as defined by the ApplySet spec).
+func applySetID(name, namespace string) string {
+	sum := sha256.Sum256([]byte(name + "." + namespace + ".Secret."))
+	return "applyset-" + base64.RawURLEncoding.EncodeToString(sum[:]) + "-v1"
+}
+
+// applySetMemberID returns the ID of the ApplySet objects of addonName are
+// members of (empty if disabled).
+func (m *kubePackage) applySetMemberID(addonName string) string {
+	if m.applySetNamespace == "" || addonName == "" {
+		return ""
+	}
+	return applySetID(m.applySetName(addonName), m.applySetNamespace)
+}
+
+// groupKindString returns gk as in contains-group-kinds, e.g `Deployment.apps'
+// or `ConfigMap'.
+func groupKindString(gk schema.GroupKind) string {
+	if gk.Group == "" {
+		return gk.Kind
+	}
+	return gk.Kind + "." + gk.Group
+}
+
+// splitSet returns the set of comma-separated values in s.
+func splitSet(s string) map[string]bool {
+	out := map[string]bool{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out[v] = true
+		}
+	}
+	return out
+}
+
+// joinSet returns values in set sorted and comma-separated.
+func joinSet(set map[string]bool) string {
+	vs := make([]string, 0, len(set))
+	for v := range set {
+		vs = append(vs, v)
+	}
+	sort.Strings(vs)
+	return strings.Join(vs, ",")
+}
+
+func (m *kubePackage) applySetClient() dynamic.ResourceInterface {
+	return m.dynClient.Resource(applySetParentGVR).Namespace(m.applySetNamespace)
+}
+
+// getApplySet reads the ApplySet parent of addonName.
+func (m *kubePackage) getApplySet(addonName string) (*applySet, error) {
+	s := &applySet{
+		name:       m.applySetName(addonName),
+		groupKinds: map[string]bool{},
+		namespaces: map[string]bool{},
+	}
+	live, err := m.applySetClient().Get(s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	as := live.GetAnnotations()
+	s.found = true
+	s.groupKinds = splitSet(as[applySetGroupKindsAnnotationKey])
+	s.namespaces = splitSet(as[applySetNamespacesAnnotationKey])
+	return s, nil
+}
+
+// putApplySet creates or updates ApplySet parent s.
+func (m *kubePackage) putApplySet(s *applySet) error {
+	parent := &unstructured.Unstructured{}
+	parent.SetAPIVersion("v1")
+	parent.SetKind("Secret")
+	parent.SetName(s.name)
+	parent.SetNamespace(m.applySetNamespace)
+	ls := map[string]string{
+		"heritage":         "isopod",
+		applySetIDLabelKey: applySetID(s.name, m.applySetNamespace),
+	}
+	if m.instanceID != "" {
+		ls[managedByLabelKey] = m.instanceID
+	}
+	parent.SetLabels(ls)
+	parent.SetAnnotations(map[string]string{
+		applySetToolingAnnotationKey:    applySetTooling,
+		applySetGroupKindsAnnotationKey: joinSet(s.groupKinds),
+		applySetNamespacesAnnotationKey: joinSet(s.namespaces),
+	})
+
+	c := m.applySetClient()
+	if !s.found {
+		if _, err := c.Create(parent, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create ApplySet parent secret `%s/%s': %v", m.applySetNamespace, s.name, err)
+		}
+		s.found = true
+		return nil
+	}
+	live, err := c.Get(s.name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get ApplySet parent secret `%s/%s': %v", m.applySetNamespace, s.name, err)
+	}
+	parent.SetResourceVersion(live.GetResourceVersion())
+	if _, err := c.Update(parent, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update ApplySet parent secret `%s/%s': %v", m.applySetNamespace, s.name, err)
+	}
+	return nil
+}
+
+// extendApplySet adds the group kind and namespace of r to the ApplySet
+// parent of addonName before r is applied (the parent must list kinds and
+// namespaces of all its members so that they can be found for pruning).
+// The parent is only written if these weren't listed yet.
+func (m *kubePackage) extendApplySet(ctx context.Context, addonName string, r *apiResource) error {
+	if m.applySetMemberID(addonName) == "" || m.isDryRun(ctx) || r.Subresource != "" {
+		return nil
+	}
+
+	m.applySetMu.Lock()
+	defer m.applySetMu.Unlock()
+	s, ok := m.applySets[addonName]
+	if !ok {
+		var err error
+		if s, err = m.getApplySet(addonName); err != nil {
+			return fmt.Errorf("failed to get ApplySet parent of `%s' addon: %v", addonName, err)
+		}
+		if m.applySets == nil {
+			m.applySets = map[string]*applySet{}
+		}
+		m.applySets[addonName] = s
+	}
+
+	gk := groupKindString(r.GVK.GroupKind())
+	ns := r.Namespace
+	if ns == m.applySetNamespace {
+		ns = ""
+	}
+	if s.found && s.groupKinds[gk] && (ns == "" || s.namespaces[ns]) {
+		return nil
+	}
+	s.groupKinds[gk] = true
+	if ns != "" {
+		s.namespaces[ns] = true
+	}
+	return m.putApplySet(s)
+}
+
+// applySetMembers returns references to live members of the ApplySet of
+// addonName (except those relying on .metadata.generateName, pruned
+// separately, and those controlled by a controller, see controlled). Returns false if the ApplySet has no parent yet (e.g objects
+// were applied without WithApplySet).
+func (m *kubePackage) applySetMembers(addonName string) ([]store.ObjRef, bool, error) {
+	s, err := m.getApplySet(addonName)
+	if err != nil {
+		return nil, false, err
+	}
+	if !s.found {
+		return nil, false, nil
+	}
+
+	gr, err := restmapper.GetAPIGroupResources(m.dClient)
+	if err != nil {
+		return nil, false, err
+	}
+	mapper := restmapper.NewDiscoveryRESTMapper(gr)
+
+	namespaces := []string{m.applySetNamespace}
+	for ns := range s.namespaces {
+		namespaces = append(namespaces, ns)
+	}
+	selector := applySetPartOfLabelKey + "=" + m.applySetMemberID(addonName)
+	var refs []store.ObjRef
+	for gk := range s.groupKinds {
+		mapping, err := mapper.RESTMapping(schema.ParseGroupKind(gk))
+		if err != nil {
+			log.Warningf("Members of `%s' kind of ApplySet of `%s' addon not listed for pruning: %v", gk, addonName, err)
+			continue
+		}
+		r := &apiResource{
+			GVK:           mapping.GroupVersionKind,
+			Resource:      mapping.Resource.Resource,
+			ClusterScoped: mapping.Scope.Name() == "root",
+		}
+		nss := namespaces
+		if r.ClusterScoped {
+			nss = []string{""}
+		}
+		for _, ns := range nss {
+			r.Namespace = ns
+			items, err := m.kubeList(r, selector)
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to list %s%s members: %v", r.Resource, maybeCore(r.GVK.Group), err)
+			}
+			for i := range items {
+				item := &items[i]
+				if _, ok := item.GetLabels()[generateNameLabelKey]; ok || controlled(item) {
+					continue
+				}
+				refs = append(refs, store.ObjRef{
+					APIVersion: r.GVK.GroupVersion().String(),
+					Kind:       r.GVK.Kind,
+					Namespace:  item.GetNamespace(),
+					Name:       item.GetName(),
+				})
+			}
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return objKey(refs[i]) < objKey(refs[j]) })
+	return refs, true, nil
+}
+
+// tightenApplySet sets group kinds and namespaces listed by the ApplySet
+// parent of addonName to those of refs (e.g once objects no longer applied
+// were pruned).
+func (m *kubePackage) tightenApplySet(addonName string, refs []store.ObjRef) error {
+	m.applySetMu.Lock()
+	defer m.applySetMu.Unlock()
+	s, ok := m.applySets[addonName]
+	if !ok {
+		var err error
+		if s, err = m.getApplySet(addonName); err != nil {
+			return err
+		}
+	}
+	if !s.found {
+		return nil
+	}
+	s.groupKinds, s.namespaces = map[string]bool{}, map[string]bool{}
+	for _, ref := range refs {
+		gv, _ := schema.ParseGroupVersion(ref.APIVersion)
+		s.groupKinds[groupKindString(gv.WithKind(ref.Kind).GroupKind())] = true
+		if ref.Namespace != "" && ref.Namespace != m.applySetNamespace {
+			s.namespaces[ref.Namespace] = true
+		}
+	}
+	return m.putApplySet(s)
+}
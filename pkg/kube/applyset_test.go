@@ -0,0 +1,162 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	apiruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func applySetParent(name, groupKinds, namespaces string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion("v1")
+	u.SetKind("Secret")
+	u.SetName(name)
+	u.SetNamespace("isopod")
+	u.SetLabels(map[string]string{applySetIDLabelKey: applySetID(name, "isopod")})
+	u.SetAnnotations(map[string]string{
+		applySetToolingAnnotationKey:    applySetTooling,
+		applySetGroupKindsAnnotationKey: groupKinds,
+		applySetNamespacesAnnotationKey: namespaces,
+	})
+	return u
+}
+
+func parentAnnotations(t *testing.T, m *kubePackage, name string) map[string]string {
+	p, err := m.dynClient.Resource(applySetParentGVR).Namespace("isopod").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get ApplySet parent: %v", err)
+	}
+	if got, want := p.GetLabels()[applySetIDLabelKey], applySetID(name, "isopod"); got != want {
+		t.Errorf("Unexpected ApplySet ID label. Want: %s, got: %s", want, got)
+	}
+	return p.GetAnnotations()
+}
+
+func TestApplySetName(t *testing.T) {
+	for _, tc := range []struct {
+		addon, instanceID string
+		want              string
+	}{
+		{addon: "ingress", want: "isopod-applyset-ingress"},
+		{addon: "Cert_Manager", instanceID: "team-b", want: "isopod-applyset-team-b-cert-manager"},
+	} {
+		m := &kubePackage{instanceID: tc.instanceID, applySetNamespace: "isopod"}
+		if got := m.applySetName(tc.addon); got != tc.want {
+			t.Errorf("Unexpected ApplySet parent name of `%s'. Want: %s, got: %s", tc.addon, tc.want, got)
+		}
+	}
+
+	id := applySetID("isopod-applyset-ingress", "isopod")
+	if len(id) != len("applyset-")+43+len("-v1") || id != applySetID("isopod-applyset-ingress", "isopod") {
+		t.Errorf("Unexpected ApplySet ID: %s", id)
+	}
+}
+
+func TestExtendApplySet(t *testing.T) {
+	dynC := dynamicfake.NewSimpleDynamicClient(apiruntime.NewScheme())
+	m := &kubePackage{dynClient: dynC, applySetNamespace: "isopod"}
+	ctx := context.Background()
+	for _, r := range []*apiResource{
+		{GVK: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, Name: "app", Namespace: "default"},
+		{GVK: schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, Name: "app", Namespace: "isopod"},
+		{GVK: schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, Name: "web", ClusterScoped: true},
+		{GVK: schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, Name: "app", Namespace: "web"},
+	} {
+		if err := m.extendApplySet(ctx, "app", r); err != nil {
+			t.Fatalf("Failed to extend ApplySet with %v: %v", r, err)
+		}
+	}
+
+	as := parentAnnotations(t, m, "isopod-applyset-app")
+	want := map[string]string{
+		applySetToolingAnnotationKey:    applySetTooling,
+		applySetGroupKindsAnnotationKey: "ConfigMap,Deployment.apps,Namespace",
+		applySetNamespacesAnnotationKey: "default,web",
+	}
+	if d := cmp.Diff(want, as); d != "" {
+		t.Errorf("Unexpected ApplySet parent annotations (-want, +got):\n%s", d)
+	}
+}
+
+func TestPruneApplySet(t *testing.T) {
+	member := map[string]string{
+		addonLabelKey:          "app",
+		applySetPartOfLabelKey: applySetID("isopod-applyset-app", "isopod"),
+	}
+	cm := func(name, namespace string, ls map[string]string) *unstructured.Unstructured {
+		u := configMap(name, ls)
+		u.SetNamespace(namespace)
+		return u
+	}
+	generated := map[string]string{generateNameLabelKey: "job-"}
+	for k, v := range member {
+		generated[k] = v
+	}
+
+	dynC := dynamicfake.NewSimpleDynamicClient(apiruntime.NewScheme(),
+		applySetParent("isopod-applyset-app", "ConfigMap", "other"),
+		cm("kept", "other", member),
+		cm("dropped", "other", member),
+		cm("dropped-in-parent-ns", "isopod", member),
+		cm("unlisted-ns", "third", member),
+		cm("generated-x1y2", "other", generated),
+	)
+	m := &kubePackage{
+		dClient:           fakeDiscovery(),
+		dynClient:         dynC,
+		applySetNamespace: "isopod",
+	}
+	m.recordApplied("app", &apiResource{
+		GVK:       schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+		Name:      "kept",
+		Namespace: "other",
+		Resource:  "configmaps",
+	})
+
+	if err := m.Prune(context.Background(), "app", nil); err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+
+	l, err := dynC.Resource(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotLeft []string
+	for _, item := range l.Items {
+		gotLeft = append(gotLeft, item.GetName())
+	}
+	sort.Strings(gotLeft)
+	if d := cmp.Diff([]string{"generated-x1y2", "kept", "unlisted-ns"}, gotLeft); d != "" {
+		t.Errorf("Unexpected objects left (-want, +got):\n%s", d)
+	}
+
+	as := parentAnnotations(t, m, "isopod-applyset-app")
+	if got, want := as[applySetGroupKindsAnnotationKey], "ConfigMap"; got != want {
+		t.Errorf("Unexpected group kinds. Want: %s, got: %s", want, got)
+	}
+	if got, want := as[applySetNamespacesAnnotationKey], "other"; got != want {
+		t.Errorf("Unexpected additional namespaces. Want: %s, got: %s", want, got)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// Transactor rolls back objects mutated by addons installed atomically.
+type Transactor interface {
+	// Begin starts recording prior state of objects addonName mutates.
+	Begin(addonName string)
+	// Commit stops recording for addonName, keeping its changes.
+	Commit(addonName string)
+	// Rollback stops recording for addonName and undoes its changes since
+	// Begin: mutated objects are restored to their prior state and created
+	// ones are deleted.
+	Rollback(ctx context.Context, addonName string) error
+}
+
+// transaction is the state of objects before an addon installed atomically
+// first mutated them.
+type transaction struct {
+	// seen are objects (keyed as snapshots) recorded so far.
+	seen map[string]bool
+	// prior are live states of mutated objects and created are objects that
+	// didn't exist before.
+	prior   []*unstructured.Unstructured
+	created []store.ObjRef
+}
+
+// Begin implements Transactor.
+func (m *kubePackage) Begin(addonName string) {
+	m.transactionsMu.Lock()
+	defer m.transactionsMu.Unlock()
+	if m.transactions == nil {
+		m.transactions = map[string]*transaction{}
+	}
+	m.transactions[addonName] = &transaction{seen: map[string]bool{}}
+}
+
+// Commit implements Transactor.
+func (m *kubePackage) Commit(addonName string) {
+	m.endTransaction(addonName)
+}
+
+// Rollback implements Transactor. Prior states go through the same path as
+// Restore, so objects not deleted as created are those no longer labeled as
+// applied by addonName. Rolling back is best-effort: side effects of applied
+// objects (e.g Jobs that ran or data written by workloads) are not undone.
+func (m *kubePackage) Rollback(ctx context.Context, addonName string) error {
+	tx := m.endTransaction(addonName)
+	if tx == nil {
+		return nil
+	}
+	ctx = withDiffAddon(ctx, addonName)
+	restored, deleted, err := m.undo(ctx, addonName, tx.prior, tx.created)
+	if err != nil {
+		return fmt.Errorf("failed to roll back: %v", err)
+	}
+	log.Infof("Rolled back %d object(s) of `%s' addon and deleted %d it created on %s", restored, addonName, deleted, m.Master)
+	return nil
+}
+
+// endTransaction removes and returns the transaction of addonName (nil if
+// none).
+func (m *kubePackage) endTransaction(addonName string) *transaction {
+	m.transactionsMu.Lock()
+	defer m.transactionsMu.Unlock()
+	tx := m.transactions[addonName]
+	delete(m.transactions, addonName)
+	return tx
+}
+
+// openTransaction returns the transaction of the addon being applied (nil if
+// it is not installed atomically or in dry run). Requires transactionsMu.
+func (m *kubePackage) openTransaction(ctx context.Context) *transaction {
+	if m.isDryRun(ctx) {
+		return nil
+	}
+	addonName, _ := ctx.Value(diffAddonKey{}).(string)
+	return m.transactions[addonName]
+}
+
+// inTransaction returns true if the addon being applied is installed
+// atomically.
+func (m *kubePackage) inTransaction(ctx context.Context) bool {
+	m.transactionsMu.Lock()
+	defer m.transactionsMu.Unlock()
+	return m.openTransaction(ctx) != nil
+}
+
+// recordPrior records live (the state of the object of r before it is
+// mutated) in the transaction of the addon being applied. Only the first
+// state of each object within the transaction is recorded.
+func (m *kubePackage) recordPrior(ctx context.Context, r *apiResource, live runtime.Object) error {
+	if live == nil {
+		return nil
+	}
+	m.transactionsMu.Lock()
+	defer m.transactionsMu.Unlock()
+	tx := m.openTransaction(ctx)
+	if tx == nil || tx.seen[snapshotKey(r)] {
+		return nil
+	}
+
+	obj, err := toUnstructured(live)
+	if err != nil {
+		return fmt.Errorf("failed to record prior state of %v: %v", r, err)
+	}
+	obj.SetAPIVersion(r.GVK.GroupVersion().String())
+	obj.SetKind(r.GVK.Kind)
+	tx.seen[snapshotKey(r)] = true
+	tx.prior = append(tx.prior, obj)
+	return nil
+}
+
+// recordTxCreated records r as created in the transaction of the addon being
+// applied. Objects recorded earlier in the transaction existed before it (or
+// were created by it) and are not recorded again. Objects relying on
+// .metadata.generateName and subresources are ignored as in recordCreated.
+func (m *kubePackage) recordTxCreated(ctx context.Context, r *apiResource) {
+	if r.Name == "" || r.Subresource != "" {
+		return
+	}
+	m.transactionsMu.Lock()
+	defer m.transactionsMu.Unlock()
+	tx := m.openTransaction(ctx)
+	if tx == nil || tx.seen[snapshotKey(r)] {
+		return
+	}
+	tx.seen[snapshotKey(r)] = true
+	tx.created = append(tx.created, store.ObjRef{
+		APIVersion: r.GVK.GroupVersion().String(),
+		Kind:       r.GVK.Kind,
+		Namespace:  r.Namespace,
+		Name:       r.Name,
+	})
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+func TestTransactor(t *testing.T) {
+	newKube, closeFn, err := NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	eval := func(k starlark.HasAttrs, expr string, data ...string) starlark.Value {
+		var vs []starlark.Value
+		for _, d := range data {
+			vs = append(vs, starlark.String(d))
+		}
+		thread := &starlark.Thread{}
+		thread.SetLocal(addon.GoCtxKey, context.Background())
+		thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+		thread.SetLocal(addon.NameKey, "app")
+		env := starlark.StringDict{"kube": k, "data": starlark.NewList(vs)}
+		v, err := starlark.Eval(thread, t.Name(), expr, env)
+		if err != nil {
+			t.Fatalf("Failed to eval `%s': %v", expr, err)
+		}
+		return v
+	}
+
+	for _, tc := range []struct {
+		name      string
+		rollback  bool
+		wantFoo   string
+		wantBar   bool
+		wantCreds bool
+	}{
+		{
+			name:      "Rollback",
+			rollback:  true,
+			wantFoo:   "v1",
+			wantCreds: true,
+		},
+		{
+			name:    "Commit",
+			wantFoo: "v2",
+			wantBar: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			eval(newKube(), "kube.put_yaml(data=data)", snapshotFoo, snapshotSecret)
+			defer eval(newKube(), `kube.delete(configmap="default/foo")`)
+
+			// The failed install updates foo (twice), creates bar and
+			// deletes creds.
+			k := newKube()
+			k.(Transactor).Begin("app")
+			eval(k, "kube.put_yaml(data=data)", snapshotFooChanged, restoreBar)
+			eval(k, "kube.put_yaml(data=data)", snapshotFooChanged)
+			eval(k, `kube.delete(secret="default/creds")`)
+			if tc.rollback {
+				if err := k.(Transactor).Rollback(context.Background(), "app"); err != nil {
+					t.Fatalf("Failed to roll back: %v", err)
+				}
+			} else {
+				k.(Transactor).Commit("app")
+			}
+			// Ended transactions are no-ops.
+			if err := k.(Transactor).Rollback(context.Background(), "app"); err != nil {
+				t.Fatalf("Failed to roll back ended transaction: %v", err)
+			}
+
+			foo := eval(newKube(), `kube.get(configmap="default/foo", json=True)`)
+			if !strings.Contains(foo.String(), tc.wantFoo) {
+				t.Errorf("Expected foo to hold %q, got: %v", tc.wantFoo, foo)
+			}
+			if bar := eval(newKube(), `kube.exists(configmap="default/bar")`); bool(bar.(starlark.Bool)) != tc.wantBar {
+				t.Errorf("Expected bar to exist: %v, got: %v", tc.wantBar, bar)
+			}
+			if creds := eval(newKube(), `kube.exists(secret="default/creds")`); bool(creds.(starlark.Bool)) != tc.wantCreds {
+				t.Errorf("Expected creds to exist: %v, got: %v", tc.wantCreds, creds)
+			}
+			if tc.wantBar {
+				eval(newKube(), `kube.delete(configmap="default/bar")`)
+			}
+			if tc.wantCreds {
+				eval(newKube(), `kube.delete(secret="default/creds")`)
+			}
+		})
+	}
+}
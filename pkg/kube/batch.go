@@ -0,0 +1,96 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// isBarrier returns true if objects of gvk must be applied before any
+// object that follows them (e.g. Namespaces and CRDs must exist before
+// objects that live in or are typed by them).
+func isBarrier(gvk schema.GroupVersionKind) bool {
+	switch {
+	case gvk.Group == "" && gvk.Kind == "Namespace":
+		return true
+	case isCRD(gvk):
+		return true
+	}
+	return false
+}
+
+// isWebhook returns true if objects of gvk configure admission webhooks. They
+// are applied only once all objects queued before them are (e.g the service
+// of the webhook), so that they don't intercept those (see
+// DefaultApplyOrder).
+func isWebhook(gvk schema.GroupVersionKind) bool {
+	return gvk.Group == "admissionregistration.k8s.io"
+}
+
+// applyBatch applies objects within a single kube call concurrently, at most
+// size at a time. With size <= 1 objects are applied one by one as they are
+// added.
+type applyBatch struct {
+	size int
+	fns  []func() error
+}
+
+// add queues up fn. Barrier fns wait for all queued fns and are then
+// executed on their own.
+func (b *applyBatch) add(fn func() error, barrier bool) error {
+	if b.size <= 1 {
+		return fn()
+	}
+	if barrier {
+		if err := b.flush(); err != nil {
+			return err
+		}
+		return fn()
+	}
+	b.fns = append(b.fns, fn)
+	return nil
+}
+
+// flush executes all queued fns and waits for them to finish. Returns the
+// error of the earliest queued fn that failed.
+func (b *applyBatch) flush() error {
+	fns := b.fns
+	b.fns = nil
+
+	errs := make([]error, len(fns))
+	sem := make(chan struct{}, b.size)
+	var wg sync.WaitGroup
+	for i, fn := range fns {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, fn func() error) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = fn()
+		}(i, fn)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
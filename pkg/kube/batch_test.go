@@ -0,0 +1,153 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+func TestApplyBatch(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		size      int
+		barriers  map[int]bool
+		failing   map[int]bool
+		wantOrder []string
+		wantErr   string
+	}{
+		{
+			name:      "Sequential",
+			size:      1,
+			failing:   map[int]bool{1: true},
+			wantOrder: []string{"0", "1"},
+			wantErr:   "failed 1",
+		},
+		{
+			name:      "Barrier",
+			size:      3,
+			barriers:  map[int]bool{2: true},
+			wantOrder: []string{"batch", "batch", "2", "batch"},
+		},
+		{
+			name:      "Earliest error",
+			size:      3,
+			failing:   map[int]bool{1: true, 2: true},
+			wantOrder: []string{"batch", "batch", "batch", "batch"},
+			wantErr:   "failed 1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var order []string
+			b := &applyBatch{size: tc.size}
+
+			var err error
+			for i := 0; i < 4 && err == nil; i++ {
+				i := i
+				err = b.add(func() error {
+					mu.Lock()
+					defer mu.Unlock()
+					if tc.size > 1 && !tc.barriers[i] {
+						order = append(order, "batch")
+					} else {
+						order = append(order, string(rune('0'+i)))
+					}
+					if tc.failing[i] {
+						return errors.New("failed " + string(rune('0'+i)))
+					}
+					return nil
+				}, tc.barriers[i])
+			}
+			if err == nil {
+				err = b.flush()
+			}
+
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Errorf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if d := cmp.Diff(tc.wantOrder, order); d != "" {
+				t.Errorf("Unexpected apply order (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestPutYamlWebhooksAfterBatch(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	fk := &fakeKube{m: map[string][]byte{}}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "webhookconfigurations") {
+			mu.Lock()
+			events = append(events, "webhook")
+			mu.Unlock()
+			fk.ServeHTTP(w, r)
+			return
+		}
+		// Slow down objects batched before the webhook.
+		time.Sleep(20 * time.Millisecond)
+		fk.ServeHTTP(w, r)
+		if r.Method == http.MethodPost {
+			mu.Lock()
+			events = append(events, "configmap")
+			mu.Unlock()
+		}
+	}))
+	defer srv.Close()
+
+	k := New(srv.URL, fakeDiscovery(), dynamic.NewForConfigOrDie(&rest.Config{Host: srv.URL, TLSClientConfig: rest.TLSClientConfig{Insecure: true}}), srv.Client(), false /* dryRun */, false /* diff */, WithApplyBatchSize(4))
+	vs := []starlark.Value{
+		starlark.String("apiVersion: admissionregistration.k8s.io/v1beta1\nkind: ValidatingWebhookConfiguration\nmetadata:\n  name: guard"),
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		vs = append(vs, starlark.String("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: "+name+"\n  namespace: default"))
+	}
+	thread := &starlark.Thread{}
+	thread.SetLocal(addon.GoCtxKey, context.Background())
+	thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+	thread.SetLocal(addon.NameKey, "app")
+	env := starlark.StringDict{"kube": k, "data": starlark.NewList(vs)}
+	if _, err := starlark.Eval(thread, t.Name(), "kube.put_yaml(data=data)", env); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"configmap", "configmap", "configmap"}
+	if len(events) <= len(want) {
+		t.Fatalf("Want webhook applied after configmaps, got: %v", events)
+	}
+	if d := cmp.Diff(want, events[:len(want)]); d != "" {
+		t.Errorf("Want webhook applied after configmaps (-want +got):\n%s", d)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CircuitBreaker stops applying an object on remaining clusters once it
+// failed to apply with the same error on more than threshold clusters (e.g
+// because an admission webhook is down fleet-wide) so that such failures fail
+// fast. Shared by kube packages of all clusters, safe for concurrent use.
+type CircuitBreaker struct {
+	threshold int
+
+	mu sync.Mutex
+	// objs maps keys of objects (see circuitKey) to their failures.
+	objs map[string]*objFailures
+	// order keeps keys of objs in the order circuits opened.
+	order []string
+}
+
+// objFailures are failures to apply a single object on all clusters.
+type objFailures struct {
+	obj string
+	// clusters maps normalized errors (see normalizeApplyError) to clusters
+	// the object failed on with them.
+	clusters map[string][]string
+	// open is the error that opened the circuit (empty while closed).
+	open string
+	// skipped are the clusters the object wasn't applied to once open.
+	skipped []string
+}
+
+// NewCircuitBreaker returns a new CircuitBreaker that opens once an object
+// fails on more than threshold clusters with the same error.
+func NewCircuitBreaker(threshold int) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		objs:      map[string]*objFailures{},
+	}
+}
+
+// circuitKey returns the key of r (the same for all clusters).
+func circuitKey(r *apiResource) string {
+	return fmt.Sprintf("%s/%s/%s/%s", r.GVK.Group, r.GVK.Kind, r.Namespace, r.Name)
+}
+
+// ipPattern matches IPv4 addresses (and ports) that differ between clusters
+// failing with otherwise the same error, e.g webhook service endpoints.
+var ipPattern = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`)
+
+// normalizeApplyError returns err as a string with cluster specific parts
+// (master address and IPs) taken out.
+func normalizeApplyError(err error, master string) string {
+	s := err.Error()
+	if master != "" {
+		s = strings.Replace(s, master, "", -1)
+	}
+	return ipPattern.ReplaceAllString(s, "<ip>")
+}
+
+// Failed records that r failed with err on cluster (with API server at
+// master) and opens the circuit of r if it's the (threshold+1)th cluster r
+// failed on with the same error.
+func (c *CircuitBreaker) Failed(r *apiResource, cluster, master string, err error) {
+	msg := normalizeApplyError(err, master)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := circuitKey(r)
+	f, ok := c.objs[key]
+	if !ok {
+		f = &objFailures{obj: r.String(), clusters: map[string][]string{}}
+		c.objs[key] = f
+	}
+	if f.open != "" {
+		return
+	}
+	for _, cl := range f.clusters[msg] {
+		if cl == cluster {
+			return
+		}
+	}
+	f.clusters[msg] = append(f.clusters[msg], cluster)
+	if len(f.clusters[msg]) > c.threshold {
+		f.open = msg
+		c.order = append(c.order, key)
+	}
+}
+
+// Allow returns an error if the circuit of r is open, recording that r was
+// skipped on cluster.
+func (c *CircuitBreaker) Allow(r *apiResource, cluster string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.objs[circuitKey(r)]
+	if !ok || f.open == "" {
+		return nil
+	}
+	f.skipped = append(f.skipped, cluster)
+	return fmt.Errorf("%v not applied: failed on %d clusters with the same error (circuit open, see --circuit_threshold)", r, len(f.clusters[f.open]))
+}
+
+// Opened returns the number of objects whose circuits opened.
+func (c *CircuitBreaker) Opened() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.order)
+}
+
+// Print writes each object whose circuit opened to w once, along with the
+// error, the clusters it failed on and the clusters it was skipped on.
+func (c *CircuitBreaker) Print(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range c.order {
+		f := c.objs[key]
+		failed := append([]string{}, f.clusters[f.open]...)
+		sort.Strings(failed)
+		if _, err := fmt.Fprintf(w, "%s failed on %d clusters (%s): %s\n", f.obj, len(failed), strings.Join(failed, ", "), f.open); err != nil {
+			return err
+		}
+		if len(f.skipped) == 0 {
+			continue
+		}
+		skipped := append([]string{}, f.skipped...)
+		sort.Strings(skipped)
+		if _, err := fmt.Fprintf(w, "  skipped on %d clusters (%s)\n", len(skipped), strings.Join(skipped, ", ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// passesCircuit returns an error if m.circuitBreaker (if set) has the circuit
+// of r open.
+func (m *kubePackage) passesCircuit(r *apiResource) error {
+	if m.circuitBreaker == nil {
+		return nil
+	}
+	return m.circuitBreaker.Allow(r, m.applyCluster)
+}
+
+// recordFailure records that r failed to apply with err (if m.circuitBreaker
+// is set) and returns err.
+func (m *kubePackage) recordFailure(r *apiResource, err error) error {
+	if m.circuitBreaker != nil && err != nil {
+		m.circuitBreaker.Failed(r, m.applyCluster, m.Master, err)
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	deploy := &apiResource{GVK: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, Resource: "deployments", Namespace: "default", Name: "foo"}
+	cm := &apiResource{GVK: schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, Resource: "configmaps", Namespace: "default", Name: "foo"}
+	webhookErr := func(ip string) error {
+		return errors.New(`Internal error occurred: failed calling webhook "policy.example.com": Post https://` + ip + `:443/validate: connection refused`)
+	}
+
+	c := NewCircuitBreaker(2)
+	c.Failed(deploy, "dev-1", "https://dev-1", webhookErr("10.0.0.1"))
+	c.Failed(deploy, "dev-2", "https://dev-2", webhookErr("10.0.1.1"))
+	// Another error doesn't count towards the same circuit.
+	c.Failed(deploy, "dev-3", "https://dev-3", errors.New("quota exceeded"))
+	// Neither do failures of other objects.
+	c.Failed(cm, "dev-3", "https://dev-3", webhookErr("10.0.2.1"))
+	if err := c.Allow(deploy, "dev-4"); err != nil {
+		t.Fatalf("Circuit opened before threshold was exceeded: %v", err)
+	}
+	if n := c.Opened(); n != 0 {
+		t.Fatalf("Got %d open circuits, want 0", n)
+	}
+
+	c.Failed(deploy, "dev-4", "https://dev-4", webhookErr("10.0.3.1"))
+	err := c.Allow(deploy, "dev-5")
+	want := "deployment.apps/v1 `default/foo' not applied: failed on 3 clusters with the same error (circuit open, see --circuit_threshold)"
+	if err == nil || err.Error() != want {
+		t.Fatalf("Expected error `%s', got: %v", want, err)
+	}
+	if err := c.Allow(cm, "dev-5"); err != nil {
+		t.Errorf("Unexpected error for object with closed circuit: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := c.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	wantOut := "deployment.apps/v1 `default/foo' failed on 3 clusters (dev-1, dev-2, dev-4): Internal error occurred: failed calling webhook \"policy.example.com\": Post https://<ip>/validate: connection refused\n" +
+		"  skipped on 1 clusters (dev-5)\n"
+	if got := buf.String(); got != wantOut {
+		t.Errorf("Unexpected output.\nWant:\n%s\nGot:\n%s", wantOut, got)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// refreshOnConflict is called after update of desired object (the n-th
+// update attempt, starting from 0) was rejected because live object of r
+// changed since it was read (resourceVersion mismatch). It re-reads live
+// object and merges it into a copy of desired (as configured, before any
+// merge) as required by the apply strategy of ctx so that the update can be
+// retried against the latest version. Returns nil if update shouldn't be
+// retried: conflict retries are disabled or used up, or live object is gone.
+func (m *kubePackage) refreshOnConflict(ctx context.Context, r *apiResource, desired runtime.Object, n int) (runtime.Object, error) {
+	if n >= m.conflictRetries {
+		return nil, nil
+	}
+
+	live, found, err := m.kubePeek(ctx, m.Master+r.PathWithName())
+	if err != nil {
+		return nil, fmt.Errorf("failed to re-read %v after conflict: %v", r, err)
+	}
+	if !found {
+		return nil, nil
+	}
+	obj := desired.DeepCopyObject()
+	if _, err := m.mergeForStrategy(ctx, r, live, obj); err != nil {
+		return nil, err
+	}
+
+	log.Warningf("%v was modified concurrently, retrying update against resourceVersion `%s' (%d of %d)",
+		r, obj.(metav1.Object).GetResourceVersion(), n+1, m.conflictRetries)
+	return obj, nil
+}
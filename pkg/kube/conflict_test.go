@@ -0,0 +1,176 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+// conflictingKubernetes implements a fake Kubernetes API endpoint serving
+// ConfigMap `default/foo' whose resourceVersion is bumped by a concurrent
+// writer the first conflicts times it is read, so that updates based on
+// those reads are rejected with a conflict. The writer sets `writer' data
+// key to the resourceVersion.
+type conflictingKubernetes struct {
+	t         *testing.T
+	conflicts int
+
+	mu      sync.Mutex
+	rv      int
+	gets    int
+	puts    int
+	putData map[string]string // Data of the last accepted update.
+}
+
+func (k *conflictingKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if r.URL.Path != "/api/v1/namespaces/default/configmaps/foo" {
+		http.Error(w, "unexpected path", http.StatusNotFound)
+		return
+	}
+
+	cm := &corev1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", ResourceVersion: strconv.Itoa(k.rv)},
+		Data:       map[string]string{"writer": strconv.Itoa(k.rv)},
+	}
+	switch r.Method {
+	case http.MethodGet:
+		k.gets++
+		if k.gets <= k.conflicts {
+			k.rv++ // Modified right after it is read.
+		}
+	case http.MethodPut:
+		k.puts++
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			k.t.Errorf("Failed to read body: %v", err)
+			return
+		}
+		obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(body, nil, nil)
+		if err != nil {
+			k.t.Errorf("Failed to decode body: %v", err)
+			return
+		}
+		if got := obj.(metav1.Object).GetResourceVersion(); got != cm.ResourceVersion {
+			s := apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, "foo", nil).ErrStatus
+			s.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Status"}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(s)
+			return
+		}
+		k.rv++
+		k.putData = obj.(*corev1.ConfigMap).Data
+		cm.ResourceVersion = strconv.Itoa(k.rv)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cm)
+}
+
+func TestConflictRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		retries   int
+		conflicts int
+		strategy  addon.ApplyStrategy
+		wantPuts  int
+		wantData  map[string]string
+		wantErr   bool
+	}{
+		{name: "No conflict", retries: 3, wantPuts: 1, wantData: map[string]string{"key": "value"}},
+		{name: "Retried", retries: 3, conflicts: 2, wantPuts: 3, wantData: map[string]string{"key": "value"}},
+		{name: "Retries used up", retries: 2, conflicts: 3, wantPuts: 3, wantErr: true},
+		{name: "Retries disabled", conflicts: 1, wantPuts: 1, wantErr: true},
+		{
+			name:      "Merged with latest",
+			retries:   3,
+			conflicts: 2,
+			strategy:  addon.ApplyStrategyMerge,
+			wantPuts:  3,
+			// Keeps the field set by the concurrent writer as last read.
+			wantData: map[string]string{"key": "value", "writer": "2"},
+		},
+	} {
+		for _, yaml := range []bool{false, true} {
+			name := tc.name
+			if yaml {
+				name += " (YAML)"
+			}
+			t.Run(name, func(t *testing.T) {
+				k := &conflictingKubernetes{t: t, conflicts: tc.conflicts}
+				srv := httptest.NewTLSServer(k)
+				defer srv.Close()
+
+				m := &kubePackage{
+					dClient:         fakeDiscovery(),
+					dynClient:       dynamic.NewForConfigOrDie(&rest.Config{Host: srv.URL, TLSClientConfig: rest.TLSClientConfig{Insecure: true}}),
+					httpClient:      srv.Client(),
+					Master:          srv.URL,
+					conflictRetries: tc.retries,
+				}
+				r, err := newResourceForKind(m.dClient, "foo", "default", "", schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				obj := &corev1.ConfigMap{
+					TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+					ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+					Data:       map[string]string{"key": "value"},
+				}
+
+				ctx := context.Background()
+				if tc.strategy != "" {
+					ctx = withApplyStrategy(ctx, tc.strategy)
+				}
+				if yaml {
+					err = m.kubeUpdateYaml(ctx, r, obj, 0)
+				} else {
+					err = m.kubeUpdate(ctx, r, obj, 0)
+				}
+				if gotErr := err != nil; gotErr != tc.wantErr {
+					t.Errorf("Unexpected error, want error: %v, got: %v", tc.wantErr, err)
+				}
+				if k.puts != tc.wantPuts {
+					t.Errorf("Unexpected number of updates, want %d got %d", tc.wantPuts, k.puts)
+				}
+				if d := cmp.Diff(tc.wantData, k.putData); d != "" {
+					t.Errorf("Unexpected data updated (-want, +got):\n%s", d)
+				}
+			})
+		}
+	}
+}
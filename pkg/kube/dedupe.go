@@ -0,0 +1,102 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+// declaration is the first declaration of an object applied in a run.
+type declaration struct {
+	addonName string
+	// digest is that of the object minus Isopod metadata (see
+	// declaredDigest).
+	digest string
+}
+
+// declaredDigest returns the digest of obj (to be applied as r) as declared,
+// i.e without Isopod metadata which differs between addons, or
+// "" if r isn't deduplicated (generated names and subresources).
+func (m *kubePackage) declaredDigest(r *apiResource, obj runtime.Object) string {
+	if r.Name == "" || r.Subresource != "" {
+		return ""
+	}
+	stripped, err := m.withoutIsopodMetadata(obj)
+	if err != nil {
+		log.Warningf("%v: not deduplicating: %v", r, err)
+		return ""
+	}
+	bs, err := json.Marshal(stripped)
+	if err != nil {
+		log.Warningf("%v: not deduplicating: %v", r, err)
+		return ""
+	}
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:])
+}
+
+// dedupe records r with digest as declared by addonName. Returns false if
+// an identical declaration of r was already applied in the run (the object
+// is then skipped with a warning, and reported as skipped if declared by
+// another addon), and an error if another addon declared r with different
+// content. Later declarations by the same addon update r as before. Silent
+// dry runs (e.g Vault preflight) aren't tracked and dry runs are tracked apart
+// from actual installs since addons may be previewed before installed.
+func (m *kubePackage) dedupe(ctx context.Context, addonName string, r *apiResource, digest string) (bool, error) {
+	if digest == "" || addon.IsSilent(ctx) {
+		return true, nil
+	}
+	key := strings.Join([]string{fmt.Sprint(m.isDryRun(ctx)), r.GVK.Group, r.GVK.Kind, r.Namespace, r.Name}, "/")
+
+	m.declaredMu.Lock()
+	first, found := m.declared[key]
+	if !found || (first.addonName == addonName && first.digest != digest) {
+		if m.declared == nil {
+			m.declared = map[string]declaration{}
+		}
+		m.declared[key] = declaration{addonName: addonName, digest: digest}
+	}
+	m.declaredMu.Unlock()
+
+	switch {
+	case !found:
+		return true, nil
+	case first.digest != digest && first.addonName != addonName:
+		return false, fmt.Errorf("%v conflicts with a different declaration of the same object by `%s' addon", r, first.addonName)
+	case first.digest != digest:
+		return true, nil
+	case first.addonName == addonName:
+		log.Warningf("%v declared twice by `%s' addon with identical content, applying once", r, addonName)
+		return false, nil
+	}
+
+	reason := fmt.Sprintf("declared identically by `%s' addon", first.addonName)
+	log.Warningf("%v %s, skipping", r, reason)
+	m.recordSkipped(addonName, r, reason)
+	if m.isDryRun(ctx) {
+		m.writeDiff(ctx, addonName, fmt.Sprintf("\n*** %v (%s) ***\n", r, reason))
+	}
+	return false, nil
+}
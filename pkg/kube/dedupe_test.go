@@ -0,0 +1,111 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+func TestDedupe(t *testing.T) {
+	const role = `
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: reader
+rules:
+- apiGroups: [""]
+  resources: [%s]
+  verbs: [get]`
+
+	for _, tc := range []struct {
+		name string
+		// puts are (addon, resources of the ClusterRole) in order.
+		puts        [][2]string
+		dryRun      bool
+		wantErr     string
+		wantSkipped map[string]string
+	}{
+		{
+			name: "Identical across addons",
+			puts: [][2]string{{"a", "pods"}, {"b", "pods"}},
+			wantSkipped: map[string]string{
+				"b": "declared identically by `a' addon",
+			},
+		},
+		{
+			name:   "Identical across addons in dry run",
+			puts:   [][2]string{{"a", "pods"}, {"b", "pods"}},
+			dryRun: true,
+			wantSkipped: map[string]string{
+				"b": "declared identically by `a' addon",
+			},
+		},
+		{
+			name: "Identical within addon",
+			puts: [][2]string{{"a", "pods"}, {"a", "pods"}},
+		},
+		{
+			name: "Updated within addon",
+			puts: [][2]string{{"a", "pods"}, {"a", "secrets"}},
+		},
+		{
+			name:    "Conflicting across addons",
+			puts:    [][2]string{{"a", "pods"}, {"b", "secrets"}},
+			wantErr: "clusterrole.rbac.authorization.k8s.io/v1 `reader' conflicts with a different declaration of the same object by `a' addon",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newKube, closeFn, err := NewFakePackages()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeFn()
+			k := newKube()
+
+			var lastErr error
+			for _, p := range tc.puts {
+				ctx := context.Background()
+				if tc.dryRun {
+					ctx = addon.WithDryRun(ctx)
+				}
+				thread := &starlark.Thread{}
+				thread.SetLocal(addon.GoCtxKey, ctx)
+				thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+				thread.SetLocal(addon.NameKey, p[0])
+				obj := strings.Replace(role, "%s", p[1], 1)
+				_, lastErr = starlark.Eval(thread, t.Name(), `kube.put_yaml(name="reader", data=["""`+obj+`"""])`, starlark.StringDict{"kube": k})
+			}
+			if tc.wantErr == "" && lastErr != nil {
+				t.Fatalf("Unexpected error: %v", lastErr)
+			} else if tc.wantErr != "" && (lastErr == nil || !strings.Contains(lastErr.Error(), tc.wantErr)) {
+				t.Fatalf("Want error containing %q, got: %v", tc.wantErr, lastErr)
+			}
+
+			ref := store.ObjRef{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole", Name: "reader"}
+			for _, a := range []string{"a", "b"} {
+				if got := k.(Skipper).SkipReason(a, ref); got != tc.wantSkipped[a] {
+					t.Errorf("Want skip reason of `%s' %q, got %q", a, tc.wantSkipped[a], got)
+				}
+			}
+		})
+	}
+}
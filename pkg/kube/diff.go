@@ -18,11 +18,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/pmezard/go-difflib/difflib"
 	yaml "gopkg.in/yaml.v2"
 
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 
@@ -68,7 +71,11 @@ func renderObj(obj runtime.Object, gvk *schema.GroupVersionKind, renderYaml bool
 		}
 		obj = newSecret
 	}
+	return marshalObj(obj, gvk, renderYaml)
+}
 
+// marshalObj is like renderObj but keeps Secret data.
+func marshalObj(obj runtime.Object, gvk *schema.GroupVersionKind, renderYaml bool) (string, error) {
 	Scheme.Default(obj)
 
 	mObj, ok := obj.(metav1.Object)
@@ -133,26 +140,275 @@ func maybeCore(group string) string {
 	return "." + group
 }
 
+// withoutAnnotations returns a copy of obj with annotations matching keys
+// removed, as well as those of stamped set to the same value as in stamped.
+// Returns obj as-is if there is nothing to remove.
+func withoutAnnotations(obj runtime.Object, keys []string, stamped map[string]string) (runtime.Object, error) {
+	if len(keys) == 0 && len(stamped) == 0 {
+		return obj, nil
+	}
+
+	a := meta.NewAccessor()
+	as, err := a.Annotations(obj)
+	if err != nil {
+		return nil, err
+	}
+	if len(as) == 0 {
+		return obj, nil
+	}
+
+	filtered := make(map[string]string, len(as))
+	for k, v := range as {
+		filtered[k] = v
+	}
+	for _, k := range keys {
+		delete(filtered, k)
+	}
+	for k, v := range stamped {
+		if fv, ok := filtered[k]; ok && fv == v {
+			delete(filtered, k)
+		}
+	}
+	if len(filtered) == 0 {
+		filtered = nil
+	}
+
+	obj = obj.DeepCopyObject()
+	if err := a.SetAnnotations(obj, filtered); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+const (
+	reasonNew       = "new object"
+	reasonNoChange  = "no change"
+	reasonGenerated = "will create new"
+	reasonPruned    = "will be pruned"
+	reasonRecreate  = "will be recreated"
+	reasonImmutable = "needs recreate for immutable "
+)
+
+// immutableFields are paths of fields of objects (by Kind.group) that can't
+// be updated in place: changing them requires recreating the object.
+var immutableFields = map[string][][]string{
+	"Service":                               {{"spec", "clusterIP"}},
+	"PersistentVolumeClaim":                 {{"spec", "storageClassName"}, {"spec", "volumeName"}, {"spec", "accessModes"}},
+	"Secret":                                {{"type"}},
+	"Deployment.apps":                       {{"spec", "selector"}},
+	"DaemonSet.apps":                        {{"spec", "selector"}},
+	"ReplicaSet.apps":                       {{"spec", "selector"}},
+	"StatefulSet.apps":                      {{"spec", "selector"}, {"spec", "serviceName"}, {"spec", "podManagementPolicy"}, {"spec", "volumeClaimTemplates"}},
+	"RoleBinding.rbac.authorization.k8s.io": {{"roleRef"}},
+	"ClusterRoleBinding.rbac.authorization.k8s.io":  {{"roleRef"}},
+	"CustomResourceDefinition.apiextensions.k8s.io": {{"spec", "group"}},
+}
+
+// immutableChanges returns paths of immutable fields (see immutableFields)
+// set in both rendered YAML objects l and r to different values.
+func immutableChanges(l, r map[string]interface{}) []string {
+	kind, _ := r["kind"].(string)
+	apiVersion, _ := r["apiVersion"].(string)
+	gk := kind
+	if i := strings.LastIndex(apiVersion, "/"); i > 0 {
+		gk += "." + apiVersion[:i]
+	}
+
+	var out []string
+	for _, path := range immutableFields[gk] {
+		lv, rv := fieldAt(l, path), fieldAt(r, path)
+		if lv != nil && rv != nil && !reflect.DeepEqual(lv, rv) {
+			out = append(out, strings.Join(path, "."))
+		}
+	}
+	return out
+}
+
+// fieldAt returns the value at path in rendered YAML object obj (nil if not
+// set).
+func fieldAt(obj map[string]interface{}, path []string) interface{} {
+	v, ok := obj[path[0]]
+	for _, k := range path[1:] {
+		if !ok {
+			return nil
+		}
+		m, isMap := v.(map[interface{}]interface{})
+		if !isMap {
+			return nil
+		}
+		v, ok = m[k]
+	}
+	return v
+}
+
+// changeReasons explains why rendered YAML object right differs from left
+// by comparing their top level fields (and labels/annotations within
+// metadata). Changes to the context annotation are reported separately since
+// they only reflect a different context passed to the addon, as are changes
+// to immutable fields since they can only be applied by recreating the
+// object. Returns empty list if both match.
+func changeReasons(left, right string) ([]string, error) {
+	var l, r map[string]interface{}
+	if err := yaml.Unmarshal([]byte(left), &l); err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal([]byte(right), &r); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]bool{}
+	for k := range l {
+		keys[k] = true
+	}
+	for k := range r {
+		keys[k] = true
+	}
+
+	var out []string
+	for k := range keys {
+		if reflect.DeepEqual(l[k], r[k]) {
+			continue
+		}
+		if k != "metadata" {
+			out = append(out, k+" changed")
+			continue
+		}
+
+		lm, _ := l[k].(map[interface{}]interface{})
+		rm, _ := r[k].(map[interface{}]interface{})
+		for _, mk := range []string{"name", "namespace", "labels", "annotations"} {
+			if reflect.DeepEqual(lm[mk], rm[mk]) {
+				continue
+			}
+			if mk != "annotations" {
+				out = append(out, mk+" changed")
+				continue
+			}
+
+			la, _ := lm[mk].(map[interface{}]interface{})
+			ra, _ := rm[mk].(map[interface{}]interface{})
+			if !reflect.DeepEqual(la[ctxAnnotationKey], ra[ctxAnnotationKey]) {
+				out = append(out, "context annotation changed")
+			}
+			delete(la, ctxAnnotationKey)
+			delete(ra, ctxAnnotationKey)
+			if !reflect.DeepEqual(la, ra) {
+				out = append(out, "annotations changed")
+			}
+		}
+	}
+	for _, f := range immutableChanges(l, r) {
+		out = append(out, reasonImmutable+f)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// needsRecreate returns true if reasons (see changeReasons) include changes
+// to immutable fields.
+func needsRecreate(reasons []string) bool {
+	for _, r := range reasons {
+		if strings.HasPrefix(r, reasonImmutable) {
+			return true
+		}
+	}
+	return false
+}
+
+// diffOptions configure printUnifiedDiff.
+type diffOptions struct {
+	// verbose confirms objects that did not change.
+	verbose bool
+	// onlyChanged omits objects that did not change entirely (overrides
+	// verbose).
+	onlyChanged bool
+	// maxLines caps the number of printed diff lines (if positive).
+	maxLines int
+	// ignoredAnnotations are excluded from both sides of the diff.
+	ignoredAnnotations []string
+	// stampedAnnotations are excluded from both sides of the diff where set
+	// to the same value (i.e not by the addon itself).
+	stampedAnnotations map[string]string
+	// rules normalize both sides of the diff.
+	rules []DiffRule
+	// security (if set) limits both sides of the diff to security-relevant
+	// kinds and fields and omits objects without changes to them.
+	security *SecurityFilter
+	// recreate tells that live objects with changed immutable fields will
+	// be deleted and created anew rather than updated (see
+	// addon.ApplyStrategyRecreate and recreatedFields).
+	recreate bool
+}
+
 // printUnifgiedDiff prints unified diff of live against head. Uses gvk and
 // name to prettify the diff.
-// If live is nil, just prints the right side.
-func printUnifiedDiff(w io.Writer, live, head runtime.Object, gvk schema.GroupVersionKind, name string) error {
+// The header of the diff explains why the object changed. If live is nil,
+// just prints the right side. Objects relying on .metadata.generateName are
+// always reported as new instances.
+func printUnifiedDiff(w io.Writer, live, head runtime.Object, gvk schema.GroupVersionKind, name string, opts diffOptions) error {
 	fullName := fmt.Sprintf("%s%s `%s'", strings.ToLower(gvk.Kind), maybeCore(gvk.Group), name)
 
 	var left string
 	if live != nil {
-		var err error
+		live, err := withoutAnnotations(live, opts.ignoredAnnotations, opts.stampedAnnotations)
+		if err != nil {
+			return fmt.Errorf("failed to filter annotations of :live object for %s: %v", fullName, err)
+		}
 		left, err = renderObj(live, nil, true)
 		if err != nil {
 			return fmt.Errorf("failed to render :live object for %s: %v", fullName, err)
 		}
+		if left, err = normalize(left, opts.rules); err != nil {
+			return fmt.Errorf("failed to normalize :live object for %s: %v", fullName, err)
+		}
 	}
 
+	head, err := withoutAnnotations(head, opts.ignoredAnnotations, opts.stampedAnnotations)
+	if err != nil {
+		return fmt.Errorf("failed to filter annotations of :head object for %s: %v", fullName, err)
+	}
 	right, _ := renderObj(head, &gvk, true)
+	if right, err = normalize(right, opts.rules); err != nil {
+		return fmt.Errorf("failed to normalize :head object for %s: %v", fullName, err)
+	}
+	if opts.security != nil {
+		var lMatched, rMatched bool
+		if left, lMatched, err = opts.security.projectObj(left); err != nil {
+			return fmt.Errorf("failed to filter :live object for %s: %v", fullName, err)
+		}
+		if right, rMatched, err = opts.security.projectObj(right); err != nil {
+			return fmt.Errorf("failed to filter :head object for %s: %v", fullName, err)
+		}
+		if (!lMatched && !rMatched) || (live != nil && left == right) {
+			return nil
+		}
+	}
+
+	reasons := []string{reasonNew}
+	if generateName(head) != "" {
+		reasons = []string{reasonGenerated}
+	} else if live != nil {
+		if reasons, err = changeReasons(left, right); err != nil {
+			return fmt.Errorf("failed to compare :live and :head objects for %s: %v", fullName, err)
+		}
+		if opts.recreate && recreatable(gvk) && needsRecreate(reasons) {
+			reasons = append(reasons, reasonRecreate)
+		}
+		if len(reasons) == 0 && opts.onlyChanged {
+			return nil
+		}
+		if len(reasons) == 0 && opts.verbose {
+			reasons = []string{reasonNoChange}
+		}
+	}
 
-	fmt.Fprintf(w, "\n*** %s ***\n", fullName)
+	if len(reasons) > 0 {
+		fmt.Fprintf(w, "\n*** %s (%s) ***\n", fullName, strings.Join(reasons, ", "))
+	} else {
+		fmt.Fprintf(w, "\n*** %s ***\n", fullName)
+	}
 
-	err := difflib.WriteUnifiedDiff(w, difflib.UnifiedDiff{
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
 		A:        difflib.SplitLines(left),
 		B:        difflib.SplitLines(right),
 		FromFile: "live",
@@ -163,5 +419,25 @@ func printUnifiedDiff(w io.Writer, live, head runtime.Object, gvk schema.GroupVe
 	if err != nil {
 		return fmt.Errorf("failed to print diff for %s: %v", fullName, err)
 	}
+	if _, err := io.WriteString(w, truncateLines(diff, opts.maxLines)); err != nil {
+		return fmt.Errorf("failed to print diff for %s: %v", fullName, err)
+	}
 	return nil
 }
+
+// truncateLines returns first max lines of s followed by a marker line with
+// the number of lines left out (s as-is if max is not positive or s is
+// short enough).
+func truncateLines(s string, max int) string {
+	if max <= 0 {
+		return s
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= max {
+		return s
+	}
+	return strings.Join(lines[:max], "") + fmt.Sprintf("(%d more lines)\n", len(lines)-max)
+}
@@ -24,6 +24,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 
 	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -34,10 +35,16 @@ func multiline(s ...string) string {
 func TestDiff(t *testing.T) {
 	now := metav1.Now()
 	for _, tc := range []struct {
-		name       string
-		live, head runtime.Object
-		wantDiff   string
-		wantErr    error
+		name               string
+		live, head         runtime.Object
+		ignoredAnnotations []string
+		stampedAnnotations map[string]string
+		rules              []DiffRule
+		verbose            bool
+		onlyChanged        bool
+		maxLines           int
+		wantDiff           string
+		wantErr            error
 	}{
 		{
 			name: "No diff",
@@ -131,7 +138,7 @@ func TestDiff(t *testing.T) {
 				},
 			},
 			wantDiff: multiline("",
-				"*** pod.v1 `foobar' ***",
+				"*** pod.v1 `foobar' (spec changed) ***",
 				"--- live",
 				"+++ head",
 				"@@ -4,12 +4,12 @@",
@@ -151,11 +158,275 @@ func TestDiff(t *testing.T) {
 				"     imagePullPolicy: Always",
 				""),
 		},
+		{
+			name: "Ignored annotations",
+			live: &corev1.Pod{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Pod",
+					APIVersion: "v1",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{"foo": "bar"},
+				},
+			},
+			head: &corev1.Pod{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Pod",
+					APIVersion: "v1",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"foo":                                "bar",
+						"argocd.argoproj.io/compare-options": "IgnoreExtraneous",
+					},
+				},
+			},
+			ignoredAnnotations: []string{"argocd.argoproj.io/compare-options"},
+			wantDiff: multiline("",
+				"*** pod.v1 `foobar' ***",
+				""),
+		},
+		{
+			name: "Stamped annotations",
+			live: &corev1.Pod{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Pod",
+					APIVersion: "v1",
+				},
+			},
+			head: &corev1.Pod{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Pod",
+					APIVersion: "v1",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{"argocd.argoproj.io/compare-options": "IgnoreExtraneous"},
+				},
+			},
+			stampedAnnotations: map[string]string{"argocd.argoproj.io/compare-options": "IgnoreExtraneous"},
+			wantDiff: multiline("",
+				"*** pod.v1 `foobar' ***",
+				""),
+		},
+		{
+			name: "Stamped annotations set by addon",
+			live: &corev1.Pod{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Pod",
+					APIVersion: "v1",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{"argocd.argoproj.io/compare-options": "IgnoreExtraneous"},
+				},
+			},
+			head: &corev1.Pod{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Pod",
+					APIVersion: "v1",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{"argocd.argoproj.io/compare-options": "ServerSideDiff=true"},
+				},
+			},
+			stampedAnnotations: map[string]string{"argocd.argoproj.io/compare-options": "IgnoreExtraneous"},
+			wantDiff: multiline("",
+				"*** pod.v1 `foobar' (annotations changed) ***",
+				"--- live",
+				"+++ head",
+				"@@ -1,8 +1,10 @@",
+				" kind: Pod",
+				" apiVersion: v1",
+				"-metadata: {}",
+				"+metadata:",
+				"+  annotations:",
+				"+    argocd.argoproj.io/compare-options: ServerSideDiff=true",
+				" spec:",
+				"   containers: null",
+				"   restartPolicy: Always",
+				"   terminationGracePeriodSeconds: 30",
+				"   dnsPolicy: ClusterFirst",
+				""),
+		},
+		{
+			name: "Normalized by rules",
+			live: &corev1.Pod{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Pod",
+					APIVersion: "v1",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"kubectl.kubernetes.io/last-applied-configuration": "{}",
+					},
+				},
+			},
+			head: &corev1.Pod{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Pod",
+					APIVersion: "v1",
+				},
+			},
+			rules: defaultDiffRules,
+			wantDiff: multiline("",
+				"*** pod.v1 `foobar' ***",
+				""),
+		},
+		{
+			name: "No diff (verbose)",
+			live: &corev1.Pod{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Pod",
+					APIVersion: "v1",
+				},
+			},
+			head: &corev1.Pod{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Pod",
+					APIVersion: "v1",
+				},
+			},
+			verbose:  true,
+			wantDiff: "\n*** pod.v1 `foobar' (no change) ***\n",
+		},
+		{
+			name: "New object",
+			head: &corev1.Namespace{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Namespace",
+					APIVersion: "v1",
+				},
+			},
+			wantDiff: multiline("",
+				"*** namespace.v1 `foobar' (new object) ***",
+				"--- live",
+				"+++ head",
+				"@@ -1 +1,5 @@",
+				"+kind: Namespace",
+				"+apiVersion: v1",
+				"+metadata: {}",
+				"+spec: {}",
+				" ",
+				""),
+		},
+		{
+			name: "No diff (only changed)",
+			live: &corev1.Namespace{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Namespace",
+					APIVersion: "v1",
+				},
+			},
+			head: &corev1.Namespace{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Namespace",
+					APIVersion: "v1",
+				},
+			},
+			verbose:     true,
+			onlyChanged: true,
+			wantDiff:    "",
+		},
+		{
+			name: "New object (max lines)",
+			head: &corev1.Namespace{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Namespace",
+					APIVersion: "v1",
+				},
+			},
+			onlyChanged: true,
+			maxLines:    4,
+			wantDiff: multiline("",
+				"*** namespace.v1 `foobar' (new object) ***",
+				"--- live",
+				"+++ head",
+				"@@ -1 +1,5 @@",
+				"+kind: Namespace",
+				"(4 more lines)",
+				""),
+		},
+		{
+			name: "Generated name",
+			head: &corev1.Namespace{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Namespace",
+					APIVersion: "v1",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					GenerateName: "foo-",
+				},
+			},
+			wantDiff: multiline("",
+				"*** namespace.v1 `foobar' (will create new) ***",
+				"--- live",
+				"+++ head",
+				"@@ -1 +1,6 @@",
+				"+kind: Namespace",
+				"+apiVersion: v1",
+				"+metadata:",
+				"+  generateName: foo-",
+				"+spec: {}",
+				" ",
+				""),
+		},
+		{
+			name: "Context annotation and labels diff",
+			live: &corev1.Pod{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Pod",
+					APIVersion: "v1",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{ctxAnnotationKey: `{"env":"dev"}`, "foo": "bar"},
+				},
+			},
+			head: &corev1.Pod{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Pod",
+					APIVersion: "v1",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      map[string]string{"foo": "bar"},
+					Annotations: map[string]string{ctxAnnotationKey: `{"env":"prod"}`, "foo": "bar"},
+				},
+			},
+			wantDiff: multiline("",
+				"*** pod.v1 `foobar' (context annotation changed, labels changed) ***",
+				"--- live",
+				"+++ head",
+				"@@ -1,11 +1,13 @@",
+				" kind: Pod",
+				" apiVersion: v1",
+				" metadata:",
+				"+  labels:",
+				"+    foo: bar",
+				"   annotations:",
+				"     foo: bar",
+				`-    isopod.getcruise.com/context: '{"env":"dev"}'`,
+				`+    isopod.getcruise.com/context: '{"env":"prod"}'`,
+				" spec:",
+				"   containers: null",
+				"   restartPolicy: Always",
+				"   terminationGracePeriodSeconds: 30",
+				"   dnsPolicy: ClusterFirst",
+				""),
+		},
 	} {
 		var rw bytes.Buffer
 
 		t.Run(tc.name, func(t *testing.T) {
-			err := printUnifiedDiff(&rw, tc.live, tc.head, tc.live.(runtime.Object).GetObjectKind().GroupVersionKind(), "foobar")
+			gvk := tc.head.GetObjectKind().GroupVersionKind()
+			if tc.live != nil {
+				gvk = tc.live.GetObjectKind().GroupVersionKind()
+			}
+			err := printUnifiedDiff(&rw, tc.live, tc.head, gvk, "foobar", diffOptions{
+				verbose:            tc.verbose,
+				onlyChanged:        tc.onlyChanged,
+				maxLines:           tc.maxLines,
+				ignoredAnnotations: tc.ignoredAnnotations,
+				stampedAnnotations: tc.stampedAnnotations,
+				rules:              tc.rules,
+			})
 			if err != nil {
 				t.Fatalf("Failed to write diff: %v", err)
 			}
@@ -176,3 +447,85 @@ func TestDiff(t *testing.T) {
 		})
 	}
 }
+
+func TestChangeReasonsImmutable(t *testing.T) {
+	for _, tc := range []struct {
+		name, left, right string
+		want              []string
+	}{
+		{
+			name:  "Selector changed",
+			left:  "apiVersion: apps/v1\nkind: Deployment\nspec:\n  selector: {matchLabels: {app: a}}\n  replicas: 1",
+			right: "apiVersion: apps/v1\nkind: Deployment\nspec:\n  selector: {matchLabels: {app: b}}\n  replicas: 1",
+			want:  []string{"needs recreate for immutable spec.selector", "spec changed"},
+		},
+		{
+			name:  "Mutable field changed",
+			left:  "apiVersion: apps/v1\nkind: Deployment\nspec:\n  selector: {matchLabels: {app: a}}\n  replicas: 1",
+			right: "apiVersion: apps/v1\nkind: Deployment\nspec:\n  selector: {matchLabels: {app: a}}\n  replicas: 2",
+			want:  []string{"spec changed"},
+		},
+		{
+			name:  "Unset on one side",
+			left:  "apiVersion: v1\nkind: Service\nspec:\n  clusterIP: 10.0.0.1",
+			right: "apiVersion: v1\nkind: Service\nspec: {}",
+			want:  []string{"spec changed"},
+		},
+		{
+			name:  "Core kind",
+			left:  "apiVersion: v1\nkind: Secret\ntype: Opaque",
+			right: "apiVersion: v1\nkind: Secret\ntype: kubernetes.io/tls",
+			want:  []string{"needs recreate for immutable type", "type changed"},
+		},
+		{
+			name:  "Role binding",
+			left:  "apiVersion: rbac.authorization.k8s.io/v1\nkind: RoleBinding\nroleRef: {kind: Role, name: a}",
+			right: "apiVersion: rbac.authorization.k8s.io/v1\nkind: RoleBinding\nroleRef: {kind: Role, name: b}",
+			want:  []string{"needs recreate for immutable roleRef", "roleRef changed"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := changeReasons(tc.left, tc.right)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected reasons (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestDiffRecreate(t *testing.T) {
+	pod := &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}}
+	opaque := &corev1.Secret{TypeMeta: metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"}, Type: corev1.SecretTypeOpaque}
+	tls := &corev1.Secret{TypeMeta: metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"}, Type: corev1.SecretTypeTLS}
+	crd := func(group string) *apiextensionsv1beta1.CustomResourceDefinition {
+		return &apiextensionsv1beta1.CustomResourceDefinition{
+			TypeMeta: metav1.TypeMeta{Kind: "CustomResourceDefinition", APIVersion: "apiextensions.k8s.io/v1beta1"},
+			Spec:     apiextensionsv1beta1.CustomResourceDefinitionSpec{Group: group},
+		}
+	}
+	for _, tc := range []struct {
+		name       string
+		live, head runtime.Object
+		recreate   bool
+		want       bool
+	}{
+		{name: "Unchanged", live: pod, head: pod, recreate: true},
+		{name: "Immutable change", live: opaque, head: tls, recreate: true, want: true},
+		{name: "Immutable change without recreate", live: opaque, head: tls},
+		{name: "CRD", live: crd("example.com"), head: crd("example.org"), recreate: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			gvk := tc.head.GetObjectKind().GroupVersionKind()
+			if err := printUnifiedDiff(&b, tc.live, tc.head, gvk, "foobar", diffOptions{recreate: tc.recreate}); err != nil {
+				t.Fatalf("Failed to write diff: %v", err)
+			}
+			if got := strings.Contains(b.String(), reasonRecreate); got != tc.want {
+				t.Errorf("Want %q in diff %v, got:\n%s", reasonRecreate, tc.want, b.String())
+			}
+		})
+	}
+}
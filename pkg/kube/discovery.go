@@ -0,0 +1,179 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/restmapper"
+)
+
+// DiscoveryCache keeps API groups and resources discovered on clusters
+// within a run, keyed by a fingerprint of the server version and the group
+// versions served, so that clusters with identical API surfaces discover
+// resources of all group versions only once. See WithDiscoveryCache.
+type DiscoveryCache struct {
+	mu           sync.Mutex
+	entries      map[string]*discoveryEntry
+	hits, misses int
+}
+
+// discoveryEntry holds results of discovery.ServerGroupsAndResources.
+type discoveryEntry struct {
+	groups    []*metav1.APIGroup
+	resources []*metav1.APIResourceList
+}
+
+// NewDiscoveryCache returns a new empty DiscoveryCache.
+func NewDiscoveryCache() *DiscoveryCache {
+	return &DiscoveryCache{entries: map[string]*discoveryEntry{}}
+}
+
+// Stats returns the number of lookups of clusters' fingerprints found in c
+// (hits) and not found (misses) so far.
+func (c *DiscoveryCache) Stats() (hits, misses int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+func (c *DiscoveryCache) get(key string) *discoveryEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return e
+}
+
+func (c *DiscoveryCache) put(key string, e *discoveryEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = e
+}
+
+// cachedDiscovery serves ServerGroupsAndResources of a cluster from cache
+// (and memoizes them for the cluster). Other methods go to the cluster.
+type cachedDiscovery struct {
+	discovery.DiscoveryInterface
+	cache *DiscoveryCache
+
+	mu    sync.Mutex
+	entry *discoveryEntry
+	// uncached is set once results from cache failed to map a kind, after
+	// which the cluster is discovered on its own.
+	uncached bool
+}
+
+// ServerGroupsAndResources implements discovery.DiscoveryInterface. Results
+// are only cached if all groups were discovered.
+func (d *cachedDiscovery) ServerGroupsAndResources() ([]*metav1.APIGroup, []*metav1.APIResourceList, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.entry != nil {
+		return d.entry.groups, d.entry.resources, nil
+	}
+
+	var key string
+	if !d.uncached {
+		var err error
+		if key, err = d.fingerprint(); err != nil {
+			return nil, nil, err
+		}
+		if e := d.cache.get(key); e != nil {
+			log.V(1).Infof("Reusing discovered API resources of clusters with fingerprint %s", key)
+			d.entry = e
+			return e.groups, e.resources, nil
+		}
+	}
+
+	gs, rs, err := d.DiscoveryInterface.ServerGroupsAndResources()
+	if err != nil {
+		return gs, rs, err
+	}
+	d.entry = &discoveryEntry{groups: gs, resources: rs}
+	if key != "" {
+		d.cache.put(key, d.entry)
+	}
+	return gs, rs, nil
+}
+
+// fingerprint returns a hash of the server version and of the group
+// versions served by the cluster.
+func (d *cachedDiscovery) fingerprint() (string, error) {
+	v, err := d.ServerVersion()
+	if err != nil {
+		return "", fmt.Errorf("failed to get server version: %v", err)
+	}
+	gl, err := d.ServerGroups()
+	if err != nil {
+		return "", fmt.Errorf("failed to get server groups: %v", err)
+	}
+	var gvs []string
+	for _, g := range gl.Groups {
+		for _, gv := range g.Versions {
+			gvs = append(gvs, gv.GroupVersion)
+		}
+		gvs = append(gvs, "preferred="+g.PreferredVersion.GroupVersion)
+	}
+	sort.Strings(gvs)
+
+	h := sha256.New()
+	fmt.Fprintln(h, v.GitVersion)
+	for _, gv := range gvs {
+		fmt.Fprintln(h, gv)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// invalidate drops memoized results and stops using the cache for the
+// cluster.
+func (d *cachedDiscovery) invalidate() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entry = nil
+	d.uncached = true
+}
+
+// mapWithRetry calls fn with a RESTMapper built from API resources
+// discovered by d. If d is cached (see WithDiscoveryCache) and fn fails to
+// map a kind or resource, fn is called once more with resources discovered
+// anew (e.g served by CRDs created since).
+func mapWithRetry(d discovery.DiscoveryInterface, fn func(meta.RESTMapper) error) error {
+	for retried := false; ; retried = true {
+		gr, err := restmapper.GetAPIGroupResources(d)
+		if err != nil {
+			return err
+		}
+		err = fn(restmapper.NewDiscoveryRESTMapper(gr))
+		cd, ok := d.(*cachedDiscovery)
+		if retried || !ok || !meta.IsNoMatchError(err) {
+			return err
+		}
+		log.V(1).Infof("Discovering API resources anew: %v", err)
+		cd.invalidate()
+	}
+}
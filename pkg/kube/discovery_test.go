@@ -0,0 +1,98 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/discovery"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+)
+
+// countingDiscovery counts calls to ServerGroupsAndResources.
+type countingDiscovery struct {
+	*fakediscovery.FakeDiscovery
+	calls int
+}
+
+func (d *countingDiscovery) ServerGroupsAndResources() ([]*metav1.APIGroup, []*metav1.APIResourceList, error) {
+	d.calls++
+	return d.FakeDiscovery.ServerGroupsAndResources()
+}
+
+func newCountingDiscovery(gitVersion string) *countingDiscovery {
+	fake := fakeDiscovery().(*fakediscovery.FakeDiscovery)
+	fake.FakedServerVersion = &version.Info{GitVersion: gitVersion}
+	return &countingDiscovery{FakeDiscovery: fake}
+}
+
+func TestDiscoveryCache(t *testing.T) {
+	c := NewDiscoveryCache()
+	a, b, other := newCountingDiscovery("v1.15.0"), newCountingDiscovery("v1.15.0"), newCountingDiscovery("v1.16.0")
+
+	var clients []discovery.DiscoveryInterface
+	for _, d := range []discovery.DiscoveryInterface{a, b, other} {
+		clients = append(clients, &cachedDiscovery{DiscoveryInterface: d, cache: c})
+	}
+	for _, d := range clients {
+		for i := 0; i < 2; i++ {
+			if _, err := newResource(d, "foo", "default", "", "configmaps", ""); err != nil {
+				t.Fatalf("Failed to map configmaps: %v", err)
+			}
+		}
+	}
+
+	if a.calls != 1 || b.calls != 0 || other.calls != 1 {
+		t.Errorf("Unexpected discovery calls, want a=1 b=0 other=1, got a=%d b=%d other=%d", a.calls, b.calls, other.calls)
+	}
+	if hits, misses := c.Stats(); hits != 1 || misses != 2 {
+		t.Errorf("Unexpected cache stats, want hits=1 misses=2, got hits=%d misses=%d", hits, misses)
+	}
+}
+
+func TestDiscoveryCacheInvalidate(t *testing.T) {
+	c := NewDiscoveryCache()
+	a, b := newCountingDiscovery("v1.15.0"), newCountingDiscovery("v1.15.0")
+	ca := &cachedDiscovery{DiscoveryInterface: a, cache: c}
+	cb := &cachedDiscovery{DiscoveryInterface: b, cache: c}
+
+	if _, err := newResource(ca, "foo", "default", "", "configmaps", ""); err != nil {
+		t.Fatalf("Failed to map configmaps: %v", err)
+	}
+
+	// Served by b only, with the same fingerprint as a.
+	gvk := schema.GroupVersionKind{Version: "v1", Kind: "Widget"}
+	b.Resources[0].APIResources = append(b.Resources[0].APIResources, metav1.APIResource{Name: "widgets", Namespaced: true, Kind: "Widget"})
+	r, err := newResourceForKind(cb, "foo", "default", "", gvk)
+	if err != nil {
+		t.Fatalf("Failed to map %v: %v", gvk, err)
+	}
+	if r.Resource != "widgets" {
+		t.Errorf("Unexpected resource, want widgets, got %s", r.Resource)
+	}
+	if _, err := newResourceForKind(ca, "foo", "default", "", gvk); err == nil {
+		t.Errorf("Expected %v not to be mapped on cluster not serving it", gvk)
+	}
+
+	if a.calls != 2 || b.calls != 1 {
+		t.Errorf("Unexpected discovery calls, want a=2 b=1, got a=%d b=%d", a.calls, b.calls)
+	}
+	if hits, misses := c.Stats(); hits != 1 || misses != 1 {
+		t.Errorf("Unexpected cache stats, want hits=1 misses=1, got hits=%d misses=%d", hits, misses)
+	}
+}
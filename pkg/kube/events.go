@@ -0,0 +1,148 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// EventReader is implemented by the kube package to read events of applied
+// objects.
+type EventReader interface {
+	// ReadEvents returns events last seen after since about objects in refs
+	// or objects they own by name (e.g ReplicaSets and Pods of a Deployment
+	// are named after it), oldest first. Cluster-scoped objects are skipped.
+	ReadEvents(ctx context.Context, refs []store.ObjRef, since time.Time) ([]ObjEvent, error)
+}
+
+// ObjEvent is an event about an applied object (or one it owns).
+type ObjEvent struct {
+	// Ref is the applied object the event is attributed to.
+	Ref store.ObjRef
+	// Kind, Namespace and Name identify the object the event is about.
+	Kind, Namespace, Name string
+	// Type (Normal or Warning), Reason and Message are those of the event.
+	Type, Reason, Message string
+	// LastSeen is when the event last occurred.
+	LastSeen time.Time
+}
+
+// String returns the event prefixed with the kind and name of its object.
+func (e ObjEvent) String() string {
+	return fmt.Sprintf("%s `%s' %s %s: %s", strings.ToLower(e.Kind), maybeNamespaced(e.Name, e.Namespace), e.Type, e.Reason, e.Message)
+}
+
+// ownerKinds are kinds of workloads whose events include those of the
+// ownedKinds objects they create, named after them.
+var (
+	ownerKinds = map[string]bool{
+		"Deployment":  true,
+		"StatefulSet": true,
+		"DaemonSet":   true,
+		"ReplicaSet":  true,
+		"Job":         true,
+	}
+	ownedKinds = map[string]bool{
+		"ReplicaSet": true,
+		"Pod":        true,
+	}
+)
+
+var eventsGVR = schema.GroupVersionResource{Version: "v1", Resource: "events"}
+
+// ReadEvents implements EventReader.
+func (m *kubePackage) ReadEvents(ctx context.Context, refs []store.ObjRef, since time.Time) ([]ObjEvent, error) {
+	byNamespace := map[string][]store.ObjRef{}
+	var namespaces []string
+	for _, ref := range refs {
+		if ref.Namespace == "" {
+			continue
+		}
+		if _, ok := byNamespace[ref.Namespace]; !ok {
+			namespaces = append(namespaces, ref.Namespace)
+		}
+		byNamespace[ref.Namespace] = append(byNamespace[ref.Namespace], ref)
+	}
+	sort.Strings(namespaces)
+
+	var out []ObjEvent
+	for _, ns := range namespaces {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		l, err := m.dynClient.Resource(eventsGVR).Namespace(ns).List(metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list events in namespace `%s': %v", ns, err)
+		}
+		out = append(out, matchEvents(l.Items, byNamespace[ns], since)...)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].LastSeen.Before(out[j].LastSeen) })
+	return out, nil
+}
+
+// matchEvents returns events in items last seen after since and attributed
+// to one of refs (all in the namespace of items).
+func matchEvents(items []unstructured.Unstructured, refs []store.ObjRef, since time.Time) []ObjEvent {
+	var out []ObjEvent
+	for _, item := range items {
+		o := item.Object
+		str := func(fields ...string) string {
+			v, _, _ := unstructured.NestedString(o, fields...)
+			return v
+		}
+		e := ObjEvent{
+			Kind:      str("involvedObject", "kind"),
+			Namespace: item.GetNamespace(),
+			Name:      str("involvedObject", "name"),
+			Type:      str("type"),
+			Reason:    str("reason"),
+			Message:   strings.TrimSpace(str("message")),
+			LastSeen:  eventTime([]string{str("lastTimestamp"), str("eventTime")}, item.GetCreationTimestamp().Time),
+		}
+		if !e.LastSeen.After(since) {
+			continue
+		}
+		for _, ref := range refs {
+			if (e.Kind == ref.Kind && e.Name == ref.Name) || (ownerKinds[ref.Kind] && ownedKinds[e.Kind] && strings.HasPrefix(e.Name, ref.Name+"-")) {
+				e.Ref = ref
+				out = append(out, e)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// eventTime returns the first of the RFC 3339 timestamps that parses, or
+// fallback.
+func eventTime(timestamps []string, fallback time.Time) time.Time {
+	for _, ts := range timestamps {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			return t
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+func TestMatchEvents(t *testing.T) {
+	event := func(kind, name, reason, lastTimestamp string) unstructured.Unstructured {
+		return *mustUnstructured(t, `
+apiVersion: v1
+kind: Event
+metadata:
+  name: `+name+`.1
+  namespace: default
+involvedObject:
+  kind: `+kind+`
+  name: `+name+`
+type: Warning
+reason: `+reason+`
+message: "`+reason+` happened\n"
+lastTimestamp: "`+lastTimestamp+`"
+`)
+	}
+	items := []unstructured.Unstructured{
+		event("Pod", "web-5d9c7-abcde", "BackOff", "2019-01-01T00:00:10Z"),
+		event("ReplicaSet", "web-5d9c7", "FailedCreate", "2019-01-01T00:00:05Z"),
+		event("Deployment", "web", "ScalingReplicaSet", "2019-01-01T00:00:01Z"),
+		event("Pod", "webhook-0", "BackOff", "2019-01-01T00:00:10Z"),
+		event("ConfigMap", "web-config", "Updated", "2019-01-01T00:00:10Z"),
+		event("Service", "web", "Old", "2018-12-31T23:59:59Z"),
+	}
+	deploy := store.ObjRef{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: "web"}
+	svc := store.ObjRef{APIVersion: "v1", Kind: "Service", Namespace: "default", Name: "web"}
+
+	var got []string
+	for _, e := range matchEvents(items, []store.ObjRef{deploy, svc}, time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		got = append(got, e.Ref.Kind+" <- "+e.String())
+	}
+	want := []string{
+		"Deployment <- pod `default/web-5d9c7-abcde' Warning BackOff: BackOff happened",
+		"Deployment <- replicaset `default/web-5d9c7' Warning FailedCreate: FailedCreate happened",
+		"Deployment <- deployment `default/web' Warning ScalingReplicaSet: ScalingReplicaSet happened",
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("Unexpected events (-want +got):\n%s", d)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+)
+
+// reasonFiltered explains objects skipped since the object filter returned
+// False.
+const reasonFiltered = "filtered out by object filter"
+
+// ObjectFilter is a Starlark expression evaluated with `obj' in scope that
+// decides which objects are applied, deleted and pruned.
+type ObjectFilter struct {
+	expr string
+	fn   starlark.Callable
+}
+
+// NewObjectFilter compiles expr (e.g `obj.kind == "NetworkPolicy"') into an
+// ObjectFilter. obj has the api_version, kind, name, namespace, labels,
+// annotations and addon fields.
+func NewObjectFilter(expr string) (*ObjectFilter, error) {
+	src := fmt.Sprintf("def object_filter(obj):\n    return (%s)\n", expr)
+	globals, err := starlark.ExecFile(&starlark.Thread{Name: "object_filter"}, "object_filter", src, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object filter `%s': %v", expr, err)
+	}
+	// Filters are called concurrently for objects applied in batches.
+	globals.Freeze()
+	return &ObjectFilter{expr: expr, fn: globals["object_filter"].(starlark.Callable)}, nil
+}
+
+func (f *ObjectFilter) String() string { return f.expr }
+
+// match calls f with r (as applied by addonName). obj is the object applied
+// or the live object (if any).
+func (f *ObjectFilter) match(addonName string, r *apiResource, obj runtime.Object) (bool, error) {
+	labels, annotations := &starlark.Dict{}, &starlark.Dict{}
+	if obj != nil {
+		a, err := meta.Accessor(obj)
+		if err != nil {
+			return false, err
+		}
+		for k, v := range a.GetLabels() {
+			labels.SetKey(starlark.String(k), starlark.String(v))
+		}
+		for k, v := range a.GetAnnotations() {
+			annotations.SetKey(starlark.String(k), starlark.String(v))
+		}
+	}
+	v := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"api_version": starlark.String(r.GVK.GroupVersion().String()),
+		"kind":        starlark.String(r.GVK.Kind),
+		"name":        starlark.String(r.Name),
+		"namespace":   starlark.String(r.Namespace),
+		"labels":      labels,
+		"annotations": annotations,
+		"addon":       starlark.String(addonName),
+	})
+
+	ret, err := starlark.Call(&starlark.Thread{Name: "object_filter"}, f.fn, starlark.Tuple{v}, nil)
+	if err != nil {
+		return false, fmt.Errorf("object filter `%s' failed for %v: %v", f.expr, r, err)
+	}
+	pass, ok := ret.(starlark.Bool)
+	if !ok {
+		return false, fmt.Errorf("object filter `%s' must return a bool, got: %s", f.expr, ret.Type())
+	}
+	return bool(pass), nil
+}
+
+// passesFilter returns false if r (to be applied as obj by addonName) is
+// filtered out by m.objectFilter (if set), recording it as skipped.
+func (m *kubePackage) passesFilter(ctx context.Context, addonName string, r *apiResource, obj runtime.Object) (bool, error) {
+	if m.objectFilter == nil {
+		return true, nil
+	}
+	if ok, err := m.objectFilter.match(addonName, r, obj); err != nil || ok {
+		return ok, err
+	}
+
+	log.Infof("%v %s", r, reasonFiltered)
+	m.recordSkipped(addonName, r, reasonFiltered)
+	if m.isDryRun(ctx) {
+		m.writeDiff(ctx, addonName, fmt.Sprintf("\n*** %v (%s) ***\n", r, reasonFiltered))
+	}
+	return false, nil
+}
+
+// getLive returns the live state of r (nil if not found).
+func (m *kubePackage) getLive(r *apiResource) (runtime.Object, error) {
+	var c dynamic.ResourceInterface = m.dynClient.Resource(r.GroupVersionResource())
+	if r.Namespace != "" {
+		c = c.(dynamic.NamespaceableResourceInterface).Namespace(r.Namespace)
+	}
+	live, err := c.Get(r.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get %v: %v", r, err)
+	}
+	return live, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+const filterSrc = `
+def cm(name, worker=False):
+    return """
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+  namespace: default
+  labels: %s
+""" % (name, "{pool: workers}" if worker else "{}")
+`
+
+func TestObjectFilter(t *testing.T) {
+	newKube, closeFn, err := NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	ctx := context.Background()
+	exec := func(k starlark.HasAttrs, src string) error {
+		thread := &starlark.Thread{}
+		thread.SetLocal(addon.GoCtxKey, ctx)
+		thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+		thread.SetLocal(addon.NameKey, "app")
+		_, err := starlark.ExecFile(thread, t.Name(), filterSrc+src, starlark.StringDict{"kube": k})
+		return err
+	}
+
+	// Applied by a previous run.
+	if err := exec(newKube(), `
+kube.put_yaml(name="stale-worker", data=[cm("stale-worker", worker=True)])
+kube.put_yaml(name="stale-other", data=[cm("stale-other")])
+kube.put_yaml(name="keep", data=[cm("keep")])
+`); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewObjectFilter(`obj.kind == "ConfigMap" and obj.labels.get("pool") == "workers"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := newKube(WithObjectFilter(f))
+	if err := exec(k, `
+kube.put_yaml(name="a", data=[cm("a", worker=True)])
+kube.put_yaml(name="b", data=[cm("b")])
+kube.delete(configmap="default/keep")
+`); err != nil {
+		t.Fatalf("Failed to apply: %v", err)
+	}
+	ref := func(name string) store.ObjRef {
+		return store.ObjRef{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: name}
+	}
+	if err := k.(Pruner).Prune(ctx, "app", []store.ObjRef{ref("stale-worker"), ref("stale-other")}); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+
+	if d := cmp.Diff([]store.ObjRef{ref("a")}, k.(Pruner).Applied("app")); d != "" {
+		t.Errorf("Unexpected applied objects (-want +got):\n%s", d)
+	}
+	if d := cmp.Diff([]store.ObjRef{ref("b"), ref("keep"), ref("stale-other")}, k.(Skipper).Skipped("app")); d != "" {
+		t.Errorf("Unexpected skipped objects (-want +got):\n%s", d)
+	}
+	if got := k.(Skipper).SkipReason("app", ref("b")); got != reasonFiltered {
+		t.Errorf("Want skip reason %q, got %q", reasonFiltered, got)
+	}
+	if err := exec(k, `
+def check():
+    for name in ["a", "keep", "stale-other"]:
+        if not kube.exists(configmap="default/" + name):
+            fail(name + " not found")
+    for name in ["b", "stale-worker"]:
+        if kube.exists(configmap="default/" + name):
+            fail(name + " found")
+
+check()
+`); err != nil {
+		t.Error(err)
+	}
+
+	for _, tc := range []struct {
+		expr, wantErr string
+	}{
+		{expr: `obj.kind ==`, wantErr: "invalid object filter `obj.kind =='"},
+		{expr: `obj.kind`, wantErr: "object filter `obj.kind' must return a bool, got: string"},
+	} {
+		f, err := NewObjectFilter(tc.expr)
+		if err == nil {
+			err = exec(newKube(WithObjectFilter(f)), `kube.put_yaml(name="c", data=[cm("c")])`)
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("Want error containing %q, got: %v", tc.wantErr, err)
+		}
+	}
+}
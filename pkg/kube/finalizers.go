@@ -0,0 +1,87 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// removeFinalizersPatch is a JSON merge patch clearing .metadata.finalizers.
+const removeFinalizersPatch = `{"metadata":{"finalizers":null}}`
+
+// waitDeleted waits up to m.deleteTimeout for r (just deleted with c) to be
+// gone, e.g while finalizers of its controller clean up. Once timed out
+// removes finalizers of r if m.forceFinalizers is set and waits for it to be
+// gone once more, or fails otherwise.
+func (m *kubePackage) waitDeleted(ctx context.Context, c dynamic.ResourceInterface, r *apiResource) error {
+	finalizers, err := waitGone(ctx, c, r, m.deleteTimeout)
+	if err != nil || finalizers == nil {
+		return err
+	}
+	if !m.forceFinalizers {
+		return fmt.Errorf("%v still not deleted after %v, held up by finalizers %q (see --force_delete_finalizers)", r, m.deleteTimeout, finalizers)
+	}
+
+	log.Errorf("%v still not deleted after %v: FORCE REMOVING FINALIZERS %q. Whatever they clean up (e.g cloud load balancers, disks or dependent objects) may be left behind!", r, m.deleteTimeout, finalizers)
+	if _, err := c.Patch(r.Name, types.MergePatchType, []byte(removeFinalizersPatch), metav1.PatchOptions{}); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to remove finalizers of %v: %v", r, err)
+	}
+
+	if finalizers, err = waitGone(ctx, c, r, m.deleteTimeout); err != nil {
+		return err
+	} else if finalizers != nil {
+		return fmt.Errorf("%v still not deleted after removing finalizers (now %q)", r, finalizers)
+	}
+	return nil
+}
+
+// waitGone polls r with c every waitRetryInterval until it is gone or
+// timeout expires. Returns (non-nil) finalizers of r if it is still present
+// by then.
+func waitGone(ctx context.Context, c dynamic.ResourceInterface, r *apiResource, timeout time.Duration) ([]string, error) {
+	timeoutCh := time.After(timeout)
+	for {
+		live, err := c.Get(r.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get %v while waiting for deletion: %v", r, err)
+		}
+
+		select {
+		case <-timeoutCh:
+			finalizers := live.GetFinalizers()
+			if finalizers == nil {
+				finalizers = []string{}
+			}
+			return finalizers, nil
+		case <-time.After(waitRetryInterval):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%v not deleted: %v", r, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+func TestDeleteTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		finalizers      string
+		forceFinalizers bool
+		wantErr         string
+		wantExists      bool
+	}{
+		{
+			name: "No finalizers",
+		},
+		{
+			name:       "Stuck on finalizers",
+			finalizers: "[example.com/cleanup]",
+			wantErr:    "held up by finalizers",
+			wantExists: true,
+		},
+		{
+			name:            "Finalizers removed",
+			finalizers:      "[example.com/cleanup]",
+			forceFinalizers: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newKube, closeFn, err := NewFakePackages()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeFn()
+			k := newKube(WithDeleteTimeout(10*time.Millisecond, tc.forceFinalizers))
+
+			eval := func(expr string) (starlark.Value, error) {
+				thread := &starlark.Thread{}
+				thread.SetLocal(addon.GoCtxKey, context.Background())
+				thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+				thread.SetLocal(addon.NameKey, "app")
+				return starlark.Eval(thread, t.Name(), expr, starlark.StringDict{"kube": k})
+			}
+
+			obj := `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: default`
+			if tc.finalizers != "" {
+				obj += "\n  finalizers: " + tc.finalizers
+			}
+			if _, err := eval(`kube.put_yaml(name="foo", namespace="default", data=["""` + obj + `"""])`); err != nil {
+				t.Fatalf("Failed to put object: %v", err)
+			}
+
+			_, err = eval(`kube.delete(configmap="default/foo")`)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("Unexpected delete error: %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("Expected delete error containing %q, got: %v", tc.wantErr, err)
+			}
+
+			exists, err := eval(`kube.exists(configmap="default/foo")`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := bool(exists.(starlark.Bool)); got != tc.wantExists {
+				t.Errorf("Expected object to exist: %v, got: %v", tc.wantExists, got)
+			}
+		})
+	}
+}
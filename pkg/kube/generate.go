@@ -0,0 +1,109 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// generateNameLabelKey is the key of a label tracking all instances created
+// from the same .metadata.generateName so that older instances can be found
+// (and pruned) on subsequent runs.
+const generateNameLabelKey = "isopod.getcruise.com/generate-name"
+
+// generateName returns .metadata.generateName of obj if obj relies on the
+// API server to generate its name (i.e .metadata.name is not set). Returns
+// empty string otherwise.
+func generateName(obj runtime.Object) string {
+	a := meta.NewAccessor()
+	if name, err := a.Name(obj); err != nil || name != "" {
+		return ""
+	}
+	gen, err := a.GenerateName(obj)
+	if err != nil {
+		return ""
+	}
+	return gen
+}
+
+// generateNameLabelValue converts generateName prefix into a valid label
+// value (e.g "migrate-" => "migrate").
+func generateNameLabelValue(gen string) string {
+	const maxLen = 63
+	if len(gen) > maxLen {
+		gen = gen[:maxLen]
+	}
+	return strings.TrimRight(gen, "-_.")
+}
+
+// generatedDisplayName returns a name used in diff and log output for objects
+// that are yet to be created from gen prefix.
+func generatedDisplayName(gen, namespace string) string {
+	return maybeNamespaced(gen+"*", namespace)
+}
+
+// pruneGenerated deletes all but keep most recently created instances of r
+// resource generated from gen prefix. Noop if keep is not positive.
+func (m *kubePackage) pruneGenerated(r *apiResource, gen string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	var c dynamic.ResourceInterface = m.dynClient.Resource(r.GroupVersionResource())
+	if r.Namespace != "" {
+		c = c.(dynamic.NamespaceableResourceInterface).Namespace(r.Namespace)
+	}
+
+	selector := fmt.Sprintf("%s=%s", generateNameLabelKey, generateNameLabelValue(gen))
+	if m.instanceID != "" {
+		selector += fmt.Sprintf(",%s=%s", managedByLabelKey, m.instanceID)
+	}
+	l, err := c.List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return fmt.Errorf("failed to list instances generated from `%s': %v", gen, err)
+	}
+
+	items := l.Items
+	sort.Slice(items, func(i, j int) bool {
+		ti, tj := items[i].GetCreationTimestamp(), items[j].GetCreationTimestamp()
+		if !ti.Equal(&tj) {
+			return tj.Before(&ti)
+		}
+		return items[i].GetName() > items[j].GetName()
+	})
+	if len(items) <= keep {
+		return nil
+	}
+
+	delPolicy := metav1.DeletePropagationBackground
+	for _, item := range items[keep:] {
+		if err := c.Delete(item.GetName(), &metav1.DeleteOptions{
+			PropagationPolicy: &delPolicy,
+		}); err != nil {
+			return fmt.Errorf("failed to prune `%s': %v", item.GetName(), err)
+		}
+		log.Infof("%s%s `%s' pruned", strings.ToLower(r.GVK.Kind), maybeCore(r.GVK.Group), maybeNamespaced(item.GetName(), item.GetNamespace()))
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	apiruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func generatedJob(name string, created time.Time, ls map[string]string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion("batch/v1")
+	u.SetKind("Job")
+	u.SetName(name)
+	u.SetNamespace("default")
+	u.SetLabels(ls)
+	u.SetCreationTimestamp(metav1.NewTime(created))
+	return u
+}
+
+func TestPruneGenerated(t *testing.T) {
+	now := time.Now()
+	migrate := map[string]string{generateNameLabelKey: "migrate"}
+	objs := []apiruntime.Object{
+		generatedJob("migrate-aaaaa", now.Add(-3*time.Hour), migrate),
+		generatedJob("migrate-bbbbb", now.Add(-2*time.Hour), migrate),
+		generatedJob("migrate-ccccc", now.Add(-1*time.Hour), migrate),
+		generatedJob("migrate-ddddd", now, migrate),
+		generatedJob("other-aaaaa", now.Add(-4*time.Hour), map[string]string{generateNameLabelKey: "other"}),
+		generatedJob("migrate-eeeee", now.Add(-5*time.Hour), map[string]string{
+			generateNameLabelKey: "migrate",
+			managedByLabelKey:    "team-b",
+		}),
+		generatedJob("migrate-fffff", now.Add(-30*time.Minute), map[string]string{
+			generateNameLabelKey: "migrate",
+			managedByLabelKey:    "team-b",
+		}),
+	}
+
+	for _, tc := range []struct {
+		name       string
+		keep       int
+		instanceID string
+		wantLeft   []string
+	}{
+		{
+			name:     "Disabled",
+			keep:     0,
+			wantLeft: []string{"migrate-aaaaa", "migrate-bbbbb", "migrate-ccccc", "migrate-ddddd", "migrate-eeeee", "migrate-fffff", "other-aaaaa"},
+		},
+		{
+			name:     "Keep last two",
+			keep:     2,
+			wantLeft: []string{"migrate-ddddd", "migrate-fffff", "other-aaaaa"},
+		},
+		{
+			name:     "Keep more than exist",
+			keep:     10,
+			wantLeft: []string{"migrate-aaaaa", "migrate-bbbbb", "migrate-ccccc", "migrate-ddddd", "migrate-eeeee", "migrate-fffff", "other-aaaaa"},
+		},
+		{
+			name:       "Scoped to instance",
+			keep:       1,
+			instanceID: "team-b",
+			wantLeft:   []string{"migrate-aaaaa", "migrate-bbbbb", "migrate-ccccc", "migrate-ddddd", "migrate-fffff", "other-aaaaa"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var cp []apiruntime.Object
+			for _, o := range objs {
+				cp = append(cp, o.DeepCopyObject())
+			}
+			dynC := dynamicfake.NewSimpleDynamicClient(apiruntime.NewScheme(), cp...)
+			m := &kubePackage{dynClient: dynC, instanceID: tc.instanceID}
+			r := &apiResource{
+				GVK:       schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"},
+				Namespace: "default",
+				Resource:  "jobs",
+			}
+
+			if err := m.pruneGenerated(r, "migrate-", tc.keep); err != nil {
+				t.Fatalf("Failed to prune: %v", err)
+			}
+
+			l, err := dynC.Resource(r.GroupVersionResource()).Namespace("default").List(metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotLeft []string
+			for _, item := range l.Items {
+				gotLeft = append(gotLeft, item.GetName())
+			}
+			sort.Strings(gotLeft)
+
+			if d := cmp.Diff(tc.wantLeft, gotLeft); d != "" {
+				t.Errorf("Unexpected objects left (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestGenerateNameLabelValue(t *testing.T) {
+	for _, tc := range []struct {
+		gen, want string
+	}{
+		{"migrate-", "migrate"},
+		{"migrate", "migrate"},
+		{"db.migrate.", "db.migrate"},
+		{"a-very-long-generate-name-prefix-that-does-not-fit-into-a-label-", "a-very-long-generate-name-prefix-that-does-not-fit-into-a-label"},
+	} {
+		if got := generateNameLabelValue(tc.gen); got != tc.want {
+			t.Errorf("generateNameLabelValue(%q) = %q, want: %q", tc.gen, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// reasonGuarded explains objects skipped since their guard returned False.
+const reasonGuarded = "skipped by guard"
+
+// Skipper is implemented by the kube package to report objects that were
+// not applied since their guard returned False (or they were filtered out
+// with WithObjectFilter).
+type Skipper interface {
+	// Skipped returns references to all objects of addonName skipped so far
+	// (in the order they were skipped).
+	Skipped(addonName string) []store.ObjRef
+	// SkipReason explains why ref was skipped by addonName.
+	SkipReason(addonName string, ref store.ObjRef) string
+}
+
+// passesGuard calls guard (if set) with obj right before r is applied and
+// returns false if r must be skipped (recording it as skipped by addonName).
+// Since guard may read live state with kube.get or kube.list it must be
+// called from the goroutine executing t.
+func (m *kubePackage) passesGuard(ctx context.Context, t *starlark.Thread, guard starlark.Callable, obj starlark.Value, addonName string, r *apiResource) (bool, error) {
+	if guard == nil {
+		return true, nil
+	}
+
+	v, err := starlark.Call(t, guard, starlark.Tuple{obj}, nil)
+	if err != nil {
+		return false, fmt.Errorf("guard of %v failed: %v", r, err)
+	}
+	pass, ok := v.(starlark.Bool)
+	if !ok {
+		return false, fmt.Errorf("guard of %v must return a bool, got: %s", r, v.Type())
+	}
+	if pass {
+		return true, nil
+	}
+
+	log.Infof("%v %s", r, reasonGuarded)
+	m.recordSkipped(addonName, r, reasonGuarded)
+	if m.isDryRun(ctx) {
+		m.writeDiff(ctx, addonName, fmt.Sprintf("\n*** %v (%s) ***\n", r, reasonGuarded))
+	}
+	return false, nil
+}
+
+// recordSkipped records r as skipped by addonName for reason. As with
+// recordApplied objects relying on .metadata.generateName and subresources
+// are ignored.
+func (m *kubePackage) recordSkipped(addonName string, r *apiResource, reason string) {
+	if r.Name == "" || r.Subresource != "" {
+		return
+	}
+	ref := store.ObjRef{
+		APIVersion: r.GVK.GroupVersion().String(),
+		Kind:       r.GVK.Kind,
+		Namespace:  r.Namespace,
+		Name:       r.Name,
+	}
+
+	m.appliedMu.Lock()
+	defer m.appliedMu.Unlock()
+
+	if m.skipReasons == nil {
+		m.skipReasons = map[string]map[store.ObjRef]string{}
+	}
+	if m.skipReasons[addonName] == nil {
+		m.skipReasons[addonName] = map[store.ObjRef]string{}
+	}
+	m.skipReasons[addonName][ref] = reason
+
+	for _, s := range m.skipped[addonName] {
+		if s == ref {
+			return
+		}
+	}
+	if m.skipped == nil {
+		m.skipped = map[string][]store.ObjRef{}
+	}
+	m.skipped[addonName] = append(m.skipped[addonName], ref)
+}
+
+// Skipped implements Skipper.
+func (m *kubePackage) Skipped(addonName string) []store.ObjRef {
+	m.appliedMu.Lock()
+	defer m.appliedMu.Unlock()
+	return append([]store.ObjRef(nil), m.skipped[addonName]...)
+}
+
+// SkipReason implements Skipper.
+func (m *kubePackage) SkipReason(addonName string, ref store.ObjRef) string {
+	m.appliedMu.Lock()
+	defer m.appliedMu.Unlock()
+	return m.skipReasons[addonName][ref]
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+const guardSrc = `
+def fewer_than_2(obj):
+    return len(kube.list("configmap", namespace="default", label_selector="pool=workers")) < 2
+
+def install():
+    for i in range(4):
+        kube.put_yaml(name="worker-%d" % i, namespace="default", guard=fewer_than_2, data=["""
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: worker-%d
+  namespace: default
+  labels:
+    pool: workers
+""" % i])
+
+install()
+`
+
+func TestGuard(t *testing.T) {
+	newKube, closeFn, err := NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	ctx := context.Background()
+	exec := func(k starlark.HasAttrs, src string) error {
+		thread := &starlark.Thread{}
+		thread.SetLocal(addon.GoCtxKey, ctx)
+		thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+		thread.SetLocal(addon.NameKey, "app")
+		_, err := starlark.ExecFile(thread, t.Name(), src, starlark.StringDict{"kube": k})
+		return err
+	}
+
+	// Applied by a previous run (outside of the pool).
+	if err := exec(newKube(), `kube.put_yaml(name="worker-2", namespace="default", data=["""
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: worker-2
+  namespace: default
+"""])`); err != nil {
+		t.Fatal(err)
+	}
+
+	k := newKube()
+	if err := exec(k, guardSrc); err != nil {
+		t.Fatalf("Failed to apply: %v", err)
+	}
+
+	ref := func(name string) store.ObjRef {
+		return store.ObjRef{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: name}
+	}
+	if d := cmp.Diff([]store.ObjRef{ref("worker-0"), ref("worker-1")}, k.(Pruner).Applied("app")); d != "" {
+		t.Errorf("Unexpected applied objects (-want +got):\n%s", d)
+	}
+	if d := cmp.Diff([]store.ObjRef{ref("worker-2"), ref("worker-3")}, k.(Skipper).Skipped("app")); d != "" {
+		t.Errorf("Unexpected skipped objects (-want +got):\n%s", d)
+	}
+
+	// Skipped objects are not pruned.
+	if err := k.(Pruner).Prune(ctx, "app", []store.ObjRef{ref("worker-2")}); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if err := exec(k, `
+def check():
+    if not kube.exists(configmap="default/worker-2"):
+        fail("worker-2 pruned")
+    if kube.exists(configmap="default/worker-3"):
+        fail("worker-3 applied")
+
+check()
+`); err != nil {
+		t.Error(err)
+	}
+
+	if err := exec(newKube(), `kube.put_yaml(name="foo", namespace="default", guard=lambda obj: "yes", data=["""
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+"""])`); err == nil {
+		t.Error("Expected non-bool guard to fail")
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	log "github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8syaml "sigs.k8s.io/yaml"
+
+	"github.com/cruise-automation/isopod/pkg/image"
+)
+
+// ImagePath is a field of image references rewritten by registry rewrites
+// (see WithRegistryRewrites).
+type ImagePath struct {
+	// Path is a JSONPath-like path of the field, e.g `.spec.image` or
+	// `.spec.sidecars[*].image`.
+	Path string `json:"path"`
+	// Kinds (if set) only rewrites the field of objects of these kinds.
+	Kinds []string `json:"kinds,omitempty"`
+
+	segments []pathSegment
+}
+
+// defaultImagePaths are image fields of containers of Pods and of Pod
+// templates of workloads (e.g Deployments or CronJobs, or CRDs following the
+// same layout).
+var defaultImagePaths = mustImagePaths(podSpecImagePaths(
+	".spec",
+	".spec.template.spec",
+	".spec.jobTemplate.spec.template.spec",
+	".template.spec",
+)...)
+
+func podSpecImagePaths(specs ...string) []ImagePath {
+	var ps []ImagePath
+	for _, spec := range specs {
+		for _, cs := range []string{"containers", "initContainers", "ephemeralContainers"} {
+			ps = append(ps, ImagePath{Path: spec + "." + cs + "[*].image"})
+		}
+	}
+	return ps
+}
+
+func mustImagePaths(ps ...ImagePath) []ImagePath {
+	for i := range ps {
+		if err := ps[i].parse(); err != nil {
+			panic(err)
+		}
+	}
+	return ps
+}
+
+// LoadImagePaths loads image paths (in addition to the built-in paths of
+// Pod specs) from YAML file at path in the following format:
+//
+//	paths:
+//	- path: .spec.image
+//	  kinds: [Prometheus, Alertmanager]
+//	- path: .spec.sidecars[*].image
+func LoadImagePaths(path string) ([]ImagePath, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f struct {
+		Paths []ImagePath `json:"paths"`
+	}
+	if err := k8syaml.UnmarshalStrict(bs, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse `%s': %v", path, err)
+	}
+	ps := f.Paths
+	for i := range ps {
+		if err := ps[i].parse(); err != nil {
+			return nil, fmt.Errorf("invalid image path in `%s': %v", path, err)
+		}
+	}
+	return ps, nil
+}
+
+// parse parses p.Path into p.segments.
+func (p *ImagePath) parse() error {
+	segs, err := parsePath(p.Path)
+	if err != nil {
+		return err
+	}
+	if segs[len(segs)-1].isIndex {
+		return fmt.Errorf("path `%s' must end with a field name", p.Path)
+	}
+	p.segments = segs
+	return nil
+}
+
+// appliesTo returns true if p applies to objects of kind.
+func (p *ImagePath) appliesTo(kind string) bool {
+	if len(p.Kinds) == 0 {
+		return true
+	}
+	for _, k := range p.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteImages rewrites registries of image references of obj (of kind)
+// with m.registryRewrites at default and m.imagePaths fields (if any).
+func (m *kubePackage) rewriteImages(obj runtime.Object, kind string) error {
+	if len(m.registryRewrites) == 0 {
+		return nil
+	}
+
+	u, isUnstructured := obj.(*unstructured.Unstructured)
+	var content map[string]interface{}
+	if isUnstructured {
+		content = u.Object
+	} else {
+		var err error
+		if content, err = runtime.DefaultUnstructuredConverter.ToUnstructured(obj); err != nil {
+			return err
+		}
+	}
+
+	var changed bool
+	var rewriteErr error
+	rewrite := func(s string) (string, bool) {
+		out, ok, err := image.RewriteReference(s, m.registryRewrites)
+		if err != nil {
+			if rewriteErr == nil {
+				rewriteErr = err
+			}
+			return s, false
+		}
+		if ok {
+			log.V(1).Infof("Rewrote image `%s' of %s to `%s'", s, kind, out)
+			changed = true
+		}
+		return out, ok
+	}
+	for _, ps := range [][]ImagePath{defaultImagePaths, m.imagePaths} {
+		for _, p := range ps {
+			if p.appliesTo(kind) {
+				rewriteStrings(content, p.segments, rewrite)
+			}
+		}
+	}
+	if rewriteErr != nil {
+		return fmt.Errorf("failed to rewrite image registry: %v", rewriteErr)
+	}
+	if !changed || isUnstructured {
+		return nil
+	}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(content, obj)
+}
+
+// rewriteStrings replaces strings at segs within v with fn.
+func rewriteStrings(v interface{}, segs []pathSegment, fn func(string) (string, bool)) {
+	seg, rest := segs[0], segs[1:]
+
+	if seg.isIndex {
+		l, ok := v.([]interface{})
+		if !ok {
+			return
+		}
+		for i := range l {
+			if !seg.wildcard && i != seg.index {
+				continue
+			}
+			if len(rest) == 0 {
+				continue // Paths end with a field name.
+			}
+			rewriteStrings(l[i], rest, fn)
+		}
+		return
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	e, ok := m[seg.key]
+	if !ok {
+		return
+	}
+	if len(rest) > 0 {
+		rewriteStrings(e, rest, fn)
+		return
+	}
+	if s, ok := e.(string); ok && s != "" {
+		if out, ok := fn(s); ok {
+			m[seg.key] = out
+		}
+	}
+}
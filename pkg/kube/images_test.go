@@ -0,0 +1,154 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/image"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+const imagesSrc = `
+kube.put_yaml(name="app", namespace="default", data=["""
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  selector:
+    matchLabels:
+      app: app
+  template:
+    metadata:
+      labels:
+        app: app
+    spec:
+      initContainers:
+      - name: init
+        image: busybox:1.31
+      containers:
+      - name: app
+        image: gcr.io/project/app@sha256:abcd
+      - name: sidecar
+        image: quay.io/project/sidecar:v2
+"""])
+`
+
+func TestRewriteImagesOnApply(t *testing.T) {
+	rewrites, err := image.ParseRegistryRewrites("docker.io=registry.internal/docker,gcr.io=registry.internal/gcr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKube, closeFn, err := NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	var mu sync.Mutex
+	var rendered string
+	k := newKube(WithRegistryRewrites(rewrites, nil), WithRenderRecorder(func(_ string, _ store.ObjRef, r string) {
+		mu.Lock()
+		defer mu.Unlock()
+		rendered = r
+	}, true))
+
+	thread := &starlark.Thread{}
+	thread.SetLocal(addon.GoCtxKey, context.Background())
+	thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+	thread.SetLocal(addon.NameKey, "app")
+	if _, err := starlark.ExecFile(thread, t.Name(), imagesSrc, starlark.StringDict{"kube": k}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"image: registry.internal/docker/library/busybox:1.31",
+		"image: registry.internal/gcr/project/app@sha256:abcd",
+		"image: quay.io/project/sidecar:v2",
+	} {
+		if !strings.Contains(rendered, want) {
+			t.Errorf("Want %q in applied object, got:\n%s", want, rendered)
+		}
+	}
+}
+
+func TestRewriteImagePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isopod-images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "paths.yaml")
+	if err := ioutil.WriteFile(path, []byte(`
+paths:
+- path: .spec.image
+  kinds: [Prometheus]
+- path: .spec.sidecars[*].image
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := LoadImagePaths(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrites, err := image.ParseRegistryRewrites("quay.io=registry.internal/quay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &kubePackage{registryRewrites: rewrites, imagePaths: paths}
+
+	for _, tc := range []struct {
+		kind  string
+		image string
+	}{
+		{kind: "Prometheus", image: "registry.internal/quay/prometheus/prometheus:v2.15.0"},
+		// Kinds not listed keep .spec.image.
+		{kind: "Widget", image: "quay.io/prometheus/prometheus:v2.15.0"},
+	} {
+		t.Run(tc.kind, func(t *testing.T) {
+			u := &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "monitoring.coreos.com/v1",
+				"kind":       tc.kind,
+				"spec": map[string]interface{}{
+					"image": "quay.io/prometheus/prometheus:v2.15.0",
+					"sidecars": []interface{}{
+						map[string]interface{}{"image": "quay.io/thanos/thanos:v0.10.0"},
+					},
+				},
+			}}
+			if err := m.rewriteImages(u, tc.kind); err != nil {
+				t.Fatal(err)
+			}
+			if got, _, _ := unstructured.NestedString(u.Object, "spec", "image"); got != tc.image {
+				t.Errorf("Got .spec.image `%s', want `%s'", got, tc.image)
+			}
+			sidecars, _, _ := unstructured.NestedSlice(u.Object, "spec", "sidecars")
+			if got, want := sidecars[0].(map[string]interface{})["image"], "registry.internal/quay/thanos/thanos:v0.10.0"; got != want {
+				t.Errorf("Got sidecar image `%s', want `%s'", got, want)
+			}
+		})
+	}
+}
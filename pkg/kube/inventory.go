@@ -0,0 +1,38 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type gvkRecorderKey struct{}
+
+// WithGVKRecorder returns a copy of ctx that makes built-ins call record with
+// the GroupVersionKind of each object they are about to apply (unless the
+// object filter skips it), e.g to inventory kinds managed by an addon. Kinds
+// not known to the API server are recorded in dry run too.
+func WithGVKRecorder(ctx context.Context, record func(gvk schema.GroupVersionKind)) context.Context {
+	return context.WithValue(ctx, gvkRecorderKey{}, record)
+}
+
+// recordGVK passes gvk to the recorder of ctx (if any).
+func recordGVK(ctx context.Context, gvk schema.GroupVersionKind) {
+	if record, ok := ctx.Value(gvkRecorderKey{}).(func(schema.GroupVersionKind)); ok {
+		record(gvk)
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/golang/glog"
@@ -45,6 +46,10 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 
 	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/image"
+	"github.com/cruise-automation/isopod/pkg/policy"
+	"github.com/cruise-automation/isopod/pkg/redact"
+	"github.com/cruise-automation/isopod/pkg/store"
 	"github.com/cruise-automation/isopod/pkg/util"
 )
 
@@ -62,6 +67,147 @@ type kubePackage struct {
 	dryRun, diff bool
 	// host:port of the master endpoint.
 	Master string
+
+	// coexistAnnotations are stamped on every applied object.
+	coexistAnnotations map[string]string
+	// provenanceAnnotations record the git commit of the entry file on
+	// every applied object (see WithGitProvenance).
+	provenanceAnnotations map[string]string
+	// instanceID is set as managedByLabelKey label value on every applied
+	// object (if not empty).
+	instanceID string
+	// verboseDiff confirms unchanged objects in the diff output.
+	verboseDiff bool
+	// diffOnlyChanged omits unchanged objects from the diff output and
+	// prints a header before the first changed object of each addon.
+	diffOnlyChanged bool
+	// diffMaxLines caps diff output of each object (if positive).
+	diffMaxLines int
+	// diffRules normalize both sides of the diff output.
+	diffRules []DiffRule
+	// securityDiff (if set) limits the diff output to security-relevant
+	// changes.
+	securityDiff *SecurityFilter
+	// serverDryRun sends objects to the API server with server-side dry run
+	// in dry run mode.
+	serverDryRun bool
+	// writeLastApplied stamps the kubectl last-applied-configuration
+	// annotation on every applied object.
+	writeLastApplied bool
+	// applyBatchSize is the max number of objects within a single call
+	// applied concurrently.
+	applyBatchSize int
+
+	// maxObjectsPerAddon caps the number of objects applied by each addon
+	// run (if positive). See countObjects.
+	maxObjectsPerAddon int
+
+	// deleteCRDs allows kube.delete to remove CustomResourceDefinitions
+	// (and thus all of their custom resources).
+	deleteCRDs bool
+	// deleteTimeout (if positive) bounds waiting for each object removed by
+	// kube.delete to be gone. Once exceeded its finalizers are removed if
+	// forceFinalizers is set (or kube.delete fails otherwise).
+	deleteTimeout   time.Duration
+	forceFinalizers bool
+
+	// outMu serializes diff output of concurrently applied objects.
+	outMu sync.Mutex
+	// diffAddons are addons whose diff header was printed (guarded by
+	// outMu).
+	diffAddons map[string]bool
+	// diffRecord (if set) is called with diff output of each object
+	// (serialized by outMu).
+	diffRecord func(addonName, out string)
+
+	// requestsDelta is the change in resource requests of the workloads
+	// applied so far (guarded by requestsMu). Applying fails once it exceeds
+	// maxRequestsDelta.
+	requestsMu       sync.Mutex
+	requestsDelta    corev1.ResourceList
+	maxRequestsDelta corev1.ResourceList
+
+	// applied are objects applied so far by each addon and skipped are those
+	// skipped by their guards or objectFilter, for skipReasons (all guarded
+	// by appliedMu). See Pruner and Skipper.
+	appliedMu   sync.Mutex
+	applied     map[string][]store.ObjRef
+	skipped     map[string][]store.ObjRef
+	skipReasons map[string]map[store.ObjRef]string
+
+	// labeled are live objects labeled as applied by each addon, listed
+	// once (on first Prune) across all kinds (guarded by labeledMu). See
+	// labeledLive.
+	labeledMu     sync.Mutex
+	labeled       map[string][]store.ObjRef
+	labeledListed bool
+
+	// applySetNamespace (if set) is the namespace of ApplySet parents of
+	// addons, known so far by addon in applySets (guarded by applySetMu).
+	// See WithApplySet.
+	applySetNamespace string
+	applySetMu        sync.Mutex
+	applySets         map[string]*applySet
+
+	// objectFilter (if set) decides which objects are applied, deleted and
+	// pruned.
+	objectFilter *ObjectFilter
+
+	// resumeApplied and resumeRecord track objects applied across failed
+	// runs (guarded by resumeMu). See Resumer.
+	resumeMu      sync.Mutex
+	resumeApplied map[string]string
+	resumeRecord  func(key, digest string)
+
+	// applyOrder ranks objects of a single call by kind (nil to keep the
+	// order given).
+	applyOrder *ApplyOrder
+	// snapshot records live state of objects before they are mutated (if
+	// set).
+	snapshot *snapshotter
+
+	// renderRecord (if set) is called with the rendered YAML of each object
+	// about to be applied. Rendered as-is (minus Isopod metadata) if
+	// renderRaw is set.
+	renderRecord func(addonName string, ref store.ObjRef, rendered string)
+	renderRaw    bool
+
+	// applyProfile (if set) records how long applying each object takes,
+	// attributed to applyCluster.
+	applyProfile *ApplyProfile
+	applyCluster string
+	// registryRewrites (if set) rewrite registries of image references at
+	// Pod spec and imagePaths fields of applied objects.
+	registryRewrites []image.RegistryRewrite
+	imagePaths       []ImagePath
+
+	// circuitBreaker (if set) records failures to apply objects on
+	// applyCluster and skips objects that failed on too many clusters.
+	circuitBreaker *CircuitBreaker
+
+	// policy (if set) checks objects against policies before they are
+	// applied (see passesPolicy).
+	policy *policy.Checker
+
+	// conflictRetries is the max number of times an update rejected due to
+	// a concurrent modification of the live object is retried against the
+	// latest version (see refreshOnConflict).
+	conflictRetries int
+
+	// dryRunNamespaces are namespaces applied in dry run that don't exist
+	// (see settleNamespace).
+	namespacesMu     sync.Mutex
+	dryRunNamespaces map[string]bool
+
+	// declared are first declarations of objects applied by the run, keyed
+	// by dry run, group, kind, namespace and name (see dedupe).
+	declaredMu sync.Mutex
+	declared   map[string]declaration
+
+	// transactions record prior state of objects mutated by addons installed
+	// atomically, by addon (guarded by transactionsMu). See Transactor.
+	transactionsMu sync.Mutex
+	transactions   map[string]*transaction
 }
 
 // New returns a new skaylark.HasAttrs object for kube package.
@@ -70,16 +216,29 @@ func New(
 	d discovery.DiscoveryInterface,
 	dynC dynamic.Interface,
 	c *http.Client, dryRun,
-	diff bool) starlark.HasAttrs {
+	diff bool,
+	opts ...Option) starlark.HasAttrs {
 
-	return &kubePackage{
+	m := &kubePackage{
 		dClient:    d,
 		dynClient:  dynC,
 		httpClient: c,
 		Master:     addr,
 		dryRun:     dryRun,
 		diff:       diff,
+		diffRules:  defaultDiffRules,
+		applyOrder: defaultApplyOrder,
+	}
+	for _, o := range opts {
+		o.apply(m)
 	}
+	return m
+}
+
+// isDryRun returns true if mutations are disabled for the whole package or
+// just for the addon run that ctx belongs to (see addon.WithDryRun).
+func (m *kubePackage) isDryRun(ctx context.Context) bool {
+	return m.dryRun || addon.IsDryRun(ctx)
 }
 
 // String implements starlark.Value.String.
@@ -104,6 +263,7 @@ const (
 	kubeFromStrMethod          = "from_str"
 	kubeGetMethod              = "get"
 	kubeExistsMethod           = "exists"
+	kubeListMethod             = "list"
 	kubePutMethod              = "put"
 	kubePutYamlMethod          = "put_yaml"
 	kubeResourceQuantityMethod = "resource_quantity"
@@ -122,6 +282,8 @@ func (m *kubePackage) Attr(name string) (starlark.Value, error) {
 		return starlark.NewBuiltin("kube."+kubeGetMethod, m.kubeGetFn), nil
 	case kubeExistsMethod:
 		return starlark.NewBuiltin("kube."+kubeExistsMethod, m.kubeExistsFn), nil
+	case kubeListMethod:
+		return starlark.NewBuiltin("kube."+kubeListMethod, m.kubeListFn), nil
 	case kubePutMethod:
 		return starlark.NewBuiltin("kube."+kubePutMethod, m.kubePutFn), nil
 	case kubePutYamlMethod:
@@ -137,6 +299,7 @@ func (m *kubePackage) AttrNames() []string {
 	return []string{
 		kubeGetMethod,
 		kubeExistsMethod,
+		kubeListMethod,
 		kubePutMethod,
 		kubeDeleteMethod,
 		kubeResourceQuantityMethod,
@@ -148,8 +311,27 @@ func (m *kubePackage) AttrNames() []string {
 // Isopod-provisioned objects.
 const ctxAnnotationKey = "isopod.getcruise.com/context"
 
-// setMetadata sets metadata fields on the obj.
-func (m *kubePackage) setMetadata(tCtx *addon.SkyCtx, name, namespace string, obj runtime.Object) error {
+// Keys of annotations recording the git commit (and branch) of the entry file
+// that applied the object. gitDirtyAnnotationKey is only set if the work tree
+// had uncommitted changes.
+const (
+	gitCommitAnnotationKey = "isopod.getcruise.com/git-commit"
+	gitBranchAnnotationKey = "isopod.getcruise.com/git-branch"
+	gitDirtyAnnotationKey  = "isopod.getcruise.com/git-dirty"
+)
+
+// addonLabelKey is the key of a label identifying the addon that applied the
+// object.
+const addonLabelKey = "isopod.getcruise.com/addon"
+
+// managedByLabelKey is the key of a label identifying the Isopod instance
+// that owns the object. Used to scope selections of Isopod-owned objects
+// when multiple Isopod instances manage the same namespace.
+const managedByLabelKey = "isopod.getcruise.com/managed-by"
+
+// setMetadata sets metadata fields on the obj. addonName (if not empty) is
+// set as addonLabelKey label value.
+func (m *kubePackage) setMetadata(tCtx *addon.SkyCtx, addonName, name, namespace string, common addon.CommonMetadata, obj runtime.Object) error {
 	a := meta.NewAccessor()
 
 	objName, err := a.Name(obj)
@@ -159,6 +341,12 @@ func (m *kubePackage) setMetadata(tCtx *addon.SkyCtx, name, namespace string, ob
 	if objName != "" && objName != name {
 		return fmt.Errorf("name=`%s' argument does not match object's .metadata.name=`%s'", name, objName)
 	}
+	// Unless explicitly named, leave the name for API server to generate
+	// from .metadata.generateName prefix.
+	gen := generateName(obj)
+	if name != "" {
+		gen = ""
+	}
 	if err := a.SetName(obj, name); err != nil {
 		return err
 	}
@@ -184,8 +372,21 @@ func (m *kubePackage) setMetadata(tCtx *addon.SkyCtx, name, namespace string, ob
 	if ls == nil {
 		ls = map[string]string{}
 	}
+	mergeMissing(ls, common.Labels)
 
 	ls["heritage"] = "isopod"
+	if addonName != "" {
+		ls[addonLabelKey] = addonName
+	}
+	if m.instanceID != "" {
+		ls[managedByLabelKey] = m.instanceID
+	}
+	if id := m.applySetMemberID(addonName); id != "" {
+		ls[applySetPartOfLabelKey] = id
+	}
+	if gen != "" {
+		ls[generateNameLabelKey] = generateNameLabelValue(gen)
+	}
 	if err := a.SetLabels(obj, ls); err != nil {
 		return err
 	}
@@ -203,9 +404,125 @@ func (m *kubePackage) setMetadata(tCtx *addon.SkyCtx, name, namespace string, ob
 		return err
 	}
 	as[ctxAnnotationKey] = string(bs)
+	mergeMissing(as, common.Annotations)
+	mergeMissing(as, m.coexistAnnotations)
+	for k, v := range m.provenanceAnnotations {
+		as[k] = v
+	}
+	return a.SetAnnotations(obj, as)
+}
+
+// mergeMissing sets keys of from missing in to.
+func mergeMissing(to, from map[string]string) {
+	for k, v := range from {
+		if _, ok := to[k]; !ok {
+			to[k] = v
+		}
+	}
+}
+
+// setLastApplied sets the annotation kubectl apply uses for its client-side
+// three-way merges to JSON of obj of kind gvk (as kubectl apply would) if
+// writeLastApplied is enabled or obj is merged into its live state (see
+// mergeThreeWay).
+func (m *kubePackage) setLastApplied(ctx context.Context, obj runtime.Object, gvk schema.GroupVersionKind) error {
+	if !m.writeLastApplied && applyStrategy(ctx) != addon.ApplyStrategyMerge {
+		return nil
+	}
+
+	a := meta.NewAccessor()
+	as, err := a.Annotations(obj)
+	if err != nil {
+		return err
+	}
+	if as == nil {
+		as = map[string]string{}
+	}
+	delete(as, corev1.LastAppliedConfigAnnotation)
+	if err := a.SetAnnotations(obj, as); err != nil {
+		return err
+	}
+
+	un, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return err
+	}
+	u := &unstructured.Unstructured{Object: un}
+	if u.GetKind() == "" {
+		u.SetGroupVersionKind(gvk)
+	}
+	bs, err := u.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	as[corev1.LastAppliedConfigAnnotation] = string(bs)
 	return a.SetAnnotations(obj, as)
 }
 
+// printDiff prints unified diff of live against head to stdout with
+// the provenance (and last-applied-configuration if written) annotations
+// filtered out, as well as coexist annotations unless the addon set them to
+// other values.
+func (m *kubePackage) printDiff(ctx context.Context, live, head runtime.Object, gvk schema.GroupVersionKind, name string) error {
+	var ignored []string
+	for k := range m.provenanceAnnotations {
+		ignored = append(ignored, k)
+	}
+	if m.writeLastApplied || applyStrategy(ctx) == addon.ApplyStrategyMerge {
+		ignored = append(ignored, corev1.LastAppliedConfigAnnotation)
+	}
+	var b bytes.Buffer
+	if err := printUnifiedDiff(&b, live, head, gvk, name, diffOptions{
+		verbose:            m.verboseDiff,
+		onlyChanged:        m.diffOnlyChanged,
+		maxLines:           m.diffMaxLines,
+		ignoredAnnotations: ignored,
+		stampedAnnotations: m.coexistAnnotations,
+		rules:              m.diffRules,
+		security:           m.securityDiff,
+		recreate:           applyStrategy(ctx) == addon.ApplyStrategyRecreate,
+	}); err != nil {
+		return err
+	}
+	addonName, _ := ctx.Value(diffAddonKey{}).(string)
+	m.writeDiff(ctx, addonName, b.String())
+	return nil
+}
+
+// diffAddonKey is a context key of the name of the addon whose objects are
+// being applied (see withDiffAddon).
+type diffAddonKey struct{}
+
+// withDiffAddon returns ctx annotated with addonName for the diff output.
+func withDiffAddon(ctx context.Context, addonName string) context.Context {
+	return context.WithValue(ctx, diffAddonKey{}, addonName)
+}
+
+// writeDiff writes diff output of an object applied by addonName to stdout
+// (unless ctx is silent, see addon.WithSilentDryRun) with secret values
+// redacted (see redact.String). If only changed objects
+// are diffed, the first output of each addon is preceded by a header naming
+// the addon and the cluster.
+func (m *kubePackage) writeDiff(ctx context.Context, addonName, out string) {
+	if out == "" || addon.IsSilent(ctx) {
+		return
+	}
+	out = redact.String(out)
+	m.outMu.Lock()
+	defer m.outMu.Unlock()
+	if m.diffOnlyChanged && !m.diffAddons[addonName] {
+		if m.diffAddons == nil {
+			m.diffAddons = map[string]bool{}
+		}
+		m.diffAddons[addonName] = true
+		fmt.Fprintf(os.Stdout, "\n=== `%s' addon on %s ===\n", addonName, m.Master)
+	}
+	fmt.Fprint(os.Stdout, out)
+	if m.diffRecord != nil {
+		m.diffRecord(addonName, out)
+	}
+}
+
 func getResourceAndName(resArg starlark.Tuple) (resource, name string, err error) {
 	resourceArg, ok := resArg[0].(starlark.String)
 	if !ok {
@@ -226,20 +543,32 @@ func getResourceAndName(resArg starlark.Tuple) (resource, name string, err error
 // TODO(dmitry-ilyevskiy): Return Status object from the response as Starlark dict.
 func (m *kubePackage) kubePutFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var name, namespace, apiGroup, subresource string
+	var keepGenerated int
+	var guard starlark.Callable
 	data := &starlark.List{}
 	unpacked := []interface{}{
-		"name", &name,
+		"name?", &name,
 		"data", &data,
 		"namespace?", &namespace,
 		// TODO(dmitry-ilyevskiy): Remove this when https://github.com/stripe/skycfg/issues/14
 		// is resolved upstream.
 		"api_group?", &apiGroup,
 		"subresource?", &subresource,
+		"keep_generated?", &keepGenerated,
+		"guard?", &guard,
 	}
 	if err := starlark.UnpackArgs(b.Name(), args, kwargs, unpacked...); err != nil {
 		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
 	}
 
+	if err := validateMsgNames(name, namespace, data); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if err := m.countObjects(t, data.Len()); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+
+	batch := &applyBatch{size: m.applyBatchSize}
 	for i := 0; i < data.Len(); i++ {
 		maybeMsg := data.Index(i)
 		msg, ok := skycfg.AsProtoMessage(maybeMsg)
@@ -247,21 +576,75 @@ func (m *kubePackage) kubePutFn(t *starlark.Thread, b *starlark.Builtin, args st
 			return nil, fmt.Errorf("<%v>: item %d is not a protobuf type. got: %s", b.Name(), i, maybeMsg.Type())
 		}
 
-		sCtx := t.Local(addon.SkyCtxKey).(*addon.SkyCtx)
-		if err := m.setMetadata(sCtx, name, namespace, msg.(runtime.Object)); err != nil {
-			return nil, fmt.Errorf("<%v>: failed to validate/apply metadata for object %d => %v: %v", b.Name(), i, maybeMsg.Type(), err)
-		}
-
 		r, err := newResourceForMsg(m.dClient, name, namespace, apiGroup, subresource, msg)
 		if err != nil {
 			return nil, fmt.Errorf("<%v>: failed to map resource: %v", b.Name(), err)
 		}
+		if err := setDefaultNamespace(t, r, msg.(runtime.Object)); err != nil {
+			return nil, fmt.Errorf("<%v>: failed to set default namespace of %v: %v", b.Name(), r, err)
+		}
 
-		ctx := t.Local(addon.GoCtxKey).(context.Context)
-		if err := m.kubeUpdate(ctx, r, msg); err != nil {
+		sCtx := t.Local(addon.SkyCtxKey).(*addon.SkyCtx)
+		addonName, _ := t.Local(addon.NameKey).(string)
+		common, _ := t.Local(addon.CommonMetadataKey).(addon.CommonMetadata)
+		if err := m.setMetadata(sCtx, addonName, name, r.Namespace, common, msg.(runtime.Object)); err != nil {
+			return nil, fmt.Errorf("<%v>: failed to validate/apply metadata for object %d => %v: %v", b.Name(), i, maybeMsg.Type(), err)
+		}
+		if err := m.rewriteImages(msg.(runtime.Object), r.GVK.Kind); err != nil {
+			return nil, fmt.Errorf("<%v>: %v: %v", b.Name(), r, err)
+		}
+		ctx := withDiffAddon(t.Local(addon.GoCtxKey).(context.Context), addonName)
+		ctx = withApplyStrategy(ctx, t.Local(addon.ApplyStrategyKey))
+		if err := m.setLastApplied(ctx, msg.(runtime.Object), r.GVK); err != nil {
+			return nil, fmt.Errorf("<%v>: failed to set last applied configuration of %v: %v", b.Name(), r, err)
+		}
+		key, digest := m.resumable(addonName, r, msg.(runtime.Object))
+		declared := m.declaredDigest(r, msg.(runtime.Object))
+		apply := func() error {
+			if ok, err := m.passesFilter(ctx, addonName, r, msg.(runtime.Object)); err != nil || !ok {
+				return err
+			}
+			recordGVK(ctx, r.GVK)
+			if m.alreadyApplied(key, digest) {
+				log.Infof("%v unchanged since applied by resumed run, skipping", r)
+				m.recordApplied(addonName, r)
+				return nil
+			}
+			if ok, err := m.passesGuard(ctx, t, guard, maybeMsg, addonName, r); err != nil || !ok {
+				return err
+			}
+			if ok, err := m.dedupe(ctx, addonName, r, declared); err != nil || !ok {
+				return err
+			}
+			if err := m.passesPolicy(ctx, r, msg.(runtime.Object)); err != nil {
+				return err
+			}
+			if err := m.passesCircuit(r); err != nil {
+				return err
+			}
+			if err := m.recordRender(addonName, r, msg.(runtime.Object)); err != nil {
+				return err
+			}
+			if err := m.extendApplySet(ctx, addonName, r); err != nil {
+				return err
+			}
+			start := time.Now()
+			if err := m.kubeUpdate(ctx, r, msg, keepGenerated); err != nil {
+				return m.recordFailure(r, err)
+			}
+			m.recordLatency(addonName, r, time.Since(start))
+			m.recordApplied(addonName, r)
+			m.recordProgress(ctx, key, digest)
+			return nil
+		}
+		// Guards are evaluated on t so objects are applied one by one.
+		if err := batch.add(apply, isBarrier(r.GVK) || isWebhook(r.GVK) || guard != nil); err != nil {
 			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
 		}
 	}
+	if err := batch.flush(); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
 
 	return starlark.None, nil
 }
@@ -318,7 +701,19 @@ func (m *kubePackage) kubeDeleteFn(t *starlark.Thread, b *starlark.Builtin, args
 		return nil, fmt.Errorf("<%v>: failed to map resource: %v", b.Name(), err)
 	}
 
-	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	addonName, _ := t.Local(addon.NameKey).(string)
+	ctx := withDiffAddon(t.Local(addon.GoCtxKey).(context.Context), addonName)
+	if m.objectFilter != nil {
+		live, err := m.getLive(r)
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+		}
+		if ok, err := m.passesFilter(ctx, addonName, r, live); err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+		} else if !ok {
+			return starlark.None, nil
+		}
+	}
 	if err := m.kubeDelete(ctx, r, bool(foreground)); err != nil {
 		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
 	}
@@ -615,21 +1010,44 @@ func mergeObjects(live, obj runtime.Object) error {
 // kubeUpdate creates or overwrites object in Kubernetes.
 // Path is computed based on msg type, name and (optional) namespace (these must
 // not conflict with name and namespace set in object metadata).
-func (m *kubePackage) kubeUpdate(ctx context.Context, r *apiResource, msg proto.Message) error {
+// Objects relying on .metadata.generateName are always created. Once created,
+// only keepGenerated most recent instances generated from the same prefix are
+// kept (if positive).
+func (m *kubePackage) kubeUpdate(ctx context.Context, r *apiResource, msg proto.Message, keepGenerated int) error {
 	uri := r.PathWithName()
-	live, found, err := m.kubePeek(ctx, m.Master+uri)
-	if err != nil {
-		return err
+	name := r.String()
+	gen := generateName(msg.(runtime.Object))
+
+	var live runtime.Object
+	var found bool
+	if gen != "" {
+		if r.Subresource != "" {
+			return errors.New("subresource cannot be updated for object with generated name")
+		}
+		name = generatedDisplayName(gen, r.Namespace)
+	} else {
+		var err error
+		if live, found, err = m.kubePeek(ctx, m.Master+uri); err != nil {
+			return err
+		}
 	}
 
-	method := http.MethodPut
+	var recreate bool
+	var desired runtime.Object
 	if found {
-		// Reset uri in case subresource update is requested.
-		uri = r.PathWithSubresource()
-		if err := mergeObjects(live, msg.(runtime.Object)); err != nil {
+		// Kept to merge with live object again on conflict.
+		desired = msg.(runtime.Object).DeepCopyObject()
+		var err error
+		if recreate, err = m.mergeForStrategy(ctx, r, live, msg.(runtime.Object)); err != nil {
 			return err
 		}
-	} else { // Object doesn't exist so create it.
+	}
+
+	method := http.MethodPut
+	if found && !recreate {
+		// Reset uri in case subresource update is requested.
+		uri = r.PathWithSubresource()
+	} else { // Object doesn't exist (or is recreated) so create it.
 		if r.Subresource != "" {
 			return errors.New("parent resource does not exist")
 		}
@@ -638,6 +1056,10 @@ func (m *kubePackage) kubeUpdate(ctx context.Context, r *apiResource, msg proto.
 		uri = r.Path()
 	}
 
+	if err := m.addRequestsDelta(ctx, r.GVK, live, msg.(runtime.Object)); err != nil {
+		return err
+	}
+
 	bs, err := marshal(msg, r.GVK)
 	if err != nil {
 		return err
@@ -663,27 +1085,76 @@ func (m *kubePackage) kubeUpdate(ctx context.Context, r *apiResource, msg proto.
 			return fmt.Errorf("failed to render :live object for %s: %v", r.String(), err)
 		}
 
-		log.Infof("%s:\n%s", r.String(), s)
+		log.Infof("%s:\n%s", r.String(), redact.String(s))
 	}
 
 	if m.diff {
-		if err := printUnifiedDiff(os.Stdout, live, msg.(runtime.Object), r.GVK, r.String()); err != nil {
+		if err := m.printDiff(ctx, live, msg.(runtime.Object), r.GVK, name); err != nil {
 			return err
 		}
 	}
 
-	if m.dryRun {
-		return printUnifiedDiff(os.Stdout, live, msg.(runtime.Object), r.GVK, r.String())
+	dryRun := m.isDryRun(ctx)
+	if dryRun {
+		if err := m.printDiff(ctx, live, msg.(runtime.Object), r.GVK, name); err != nil {
+			return err
+		}
+		if err := m.settleNamespace(ctx, r, found); err != nil {
+			return err
+		}
+		if m.skipServerDryRun(ctx, r) {
+			return nil
+		}
+		req.URL.RawQuery = "dryRun=" + metav1.DryRunAll
 	}
 
-	resp, err := m.httpClient.Do(req.WithContext(ctx))
-	if err != nil {
+	if err := m.snapshotLive(ctx, r, live); err != nil {
 		return err
 	}
+	if recreate {
+		if err := m.deleteForRecreate(ctx, r); err != nil {
+			return err
+		}
+	}
 
-	_, rMsg, err := parseHTTPResponse(resp)
-	if err != nil {
-		return err
+	op := opCreate
+	if method == http.MethodPut {
+		op = opUpdate
+	}
+	var rMsg string
+	for n := 0; ; n++ {
+		resp, err := m.httpClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+
+		_, rMsg, err = parseHTTPResponse(resp)
+		if err == nil {
+			break
+		}
+		if op != opUpdate || resp.StatusCode != http.StatusConflict {
+			return m.attributeAdmissionError(r, op, err)
+		}
+		obj, rErr := m.refreshOnConflict(ctx, r, desired, n)
+		if rErr != nil {
+			return rErr
+		}
+		if obj == nil {
+			return err
+		}
+
+		msg = obj.(proto.Message)
+		if bs, err = marshal(msg, r.GVK); err != nil {
+			return err
+		}
+		if req, err = http.NewRequest(method, req.URL.String(), bytes.NewReader(bs)); err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	if dryRun {
+		log.Infof("%s passed server dry run", rMsg)
+		return nil
 	}
 
 	actionMsg := "created"
@@ -692,13 +1163,25 @@ func (m *kubePackage) kubeUpdate(ctx context.Context, r *apiResource, msg proto.
 	}
 	log.Infof("%s %s", rMsg, actionMsg)
 
+	if !found && gen == "" {
+		if err := m.recordCreated(ctx, r); err != nil {
+			return err
+		}
+	}
+	if err := m.settleNamespace(ctx, r, found); err != nil {
+		return err
+	}
+
+	if gen != "" {
+		return m.pruneGenerated(r, gen, keepGenerated)
+	}
 	return nil
 }
 
 // kubeDelete deletes namespace/name resource in Kubernetes.
 // Attempts to deduce GroupVersionResource from apiGroup (optional) and resource
 // strings. Fails if multiple matches found.
-func (m *kubePackage) kubeDelete(_ context.Context, r *apiResource, foreground bool) error {
+func (m *kubePackage) kubeDelete(ctx context.Context, r *apiResource, foreground bool) error {
 	var c dynamic.ResourceInterface = m.dynClient.Resource(r.GroupVersionResource())
 	if r.Namespace != "" {
 		c = c.(dynamic.NamespaceableResourceInterface).Namespace(r.Namespace)
@@ -709,18 +1192,41 @@ func (m *kubePackage) kubeDelete(_ context.Context, r *apiResource, foreground b
 		delPolicy = metav1.DeletePropagationForeground
 	}
 
+	if isCRD(r.GVK) && !m.deleteCRDs {
+		log.Warningf("%v not deleted: deleting CustomResourceDefinitions is disabled", r)
+		return nil
+	}
+
 	log.V(1).Infof("DELETE to %s", m.Master+r.PathWithName())
 
-	if m.dryRun {
+	if m.isDryRun(ctx) {
 		return nil
 	}
 
+	if m.snapshot != nil || m.inTransaction(ctx) {
+		live, err := c.Get(r.Name, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get %v to snapshot: %v", r, err)
+		}
+		if err == nil {
+			if err := m.snapshotLive(ctx, r, live); err != nil {
+				return err
+			}
+		}
+	}
+
 	if err := c.Delete(r.Name, &metav1.DeleteOptions{
 		PropagationPolicy: &delPolicy,
 	}); err != nil {
 		return err
 	}
 
+	if m.deleteTimeout > 0 {
+		if err := m.waitDeleted(ctx, c, r); err != nil {
+			return err
+		}
+	}
+
 	log.Infof("%v deleted", r)
 
 	return nil
@@ -15,6 +15,7 @@
 package kube
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -24,12 +25,15 @@ import (
 	"net/url"
 	"path"
 	"reflect"
+	"sort"
 	"strings"
 
 	log "github.com/golang/glog"
 	"go.starlark.net/starlark"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	apiruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/discovery"
 	fakediscovery "k8s.io/client-go/discovery/fake"
 	"k8s.io/client-go/dynamic"
@@ -159,6 +163,10 @@ func (h *fakeKube) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case http.MethodGet:
 		res, ok := h.m[r.URL.Path]
 		if !ok {
+			if l := h.list(r.URL.Path, r.URL.Query().Get("labelSelector")); l != nil {
+				write(w, l)
+				return
+			}
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
@@ -195,9 +203,59 @@ func (h *fakeKube) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				Name:  name,
 			},
 		}
+		// Objects with finalizers are only marked for deletion (until the
+		// finalizers are removed).
+		if u, err := decodeUnstructured(res); err == nil && len(u.GetFinalizers()) > 0 {
+			now := metav1.Now()
+			u.SetDeletionTimestamp(&now)
+			if h.m[r.URL.Path], err = u.MarshalJSON(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			delete(h.m, r.URL.Path)
+		}
 		bs, _ := apiruntime.Encode(unstructured.UnstructuredJSONScheme, s)
 		write(w, bs)
 		return
+	case http.MethodPatch:
+		res, ok := h.m[r.URL.Path]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != string(types.MergePatchType) {
+			http.Error(w, fmt.Sprintf("unsupported patch type %q", ct), http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		u, err := decodeUnstructured(res)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var patch map[string]interface{}
+		if err := json.Unmarshal(data, &patch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		u.Object = mergePatch(u.Object, patch)
+		if data, err = u.MarshalJSON(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Marked for deletion objects are gone once their finalizers are.
+		if u.GetDeletionTimestamp() != nil && len(u.GetFinalizers()) == 0 {
+			delete(h.m, r.URL.Path)
+		} else {
+			h.m[r.URL.Path] = data
+		}
+		write(w, data)
+		return
 	default:
 		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
 	}
@@ -213,6 +271,88 @@ func (h *fakeKube) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	write(w, bs)
 }
 
+// decodeUnstructured decodes JSON encoded object data.
+func decodeUnstructured(data []byte) (*unstructured.Unstructured, error) {
+	u := &unstructured.Unstructured{}
+	if err := u.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// mergePatch applies JSON merge patch (RFC 7386) to obj.
+func mergePatch(obj, patch map[string]interface{}) map[string]interface{} {
+	if obj == nil {
+		obj = map[string]interface{}{}
+	}
+	for k, v := range patch {
+		switch pv := v.(type) {
+		case nil:
+			delete(obj, k)
+		case map[string]interface{}:
+			ov, _ := obj[k].(map[string]interface{})
+			obj[k] = mergePatch(ov, pv)
+		default:
+			obj[k] = v
+		}
+	}
+	return obj
+}
+
+// list returns JSON encoded list of all objects stored immediately under
+// collection path p that match label selector. Returns nil if no objects are
+// stored under p (or selector is invalid).
+func (h *fakeKube) list(p, selector string) []byte {
+	sel, err := labels.Parse(selector)
+	if err != nil {
+		log.Errorf("invalid label selector %q: %v", selector, err)
+		return nil
+	}
+
+	var keys []string
+	for k := range h.m {
+		if path.Dir(k) == p {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	items := []interface{}{}
+	for _, k := range keys {
+		data := h.m[k]
+		obj, gvk, err := decodeFn(data, nil, nil)
+		if err != nil {
+			log.Errorf("failed to deserialize `%s': %v", k, err)
+			continue
+		}
+		obj.GetObjectKind().SetGroupVersionKind(*gvk)
+		un, err := apiruntime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			log.Errorf("failed to convert `%s' to unstructured: %v", k, err)
+			continue
+		}
+		if !sel.Matches(labels.Set((&unstructured.Unstructured{Object: un}).GetLabels())) {
+			continue
+		}
+		items = append(items, un)
+	}
+
+	bs, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "List",
+		"items":      items,
+	})
+	if err != nil {
+		log.Errorf("failed to encode list `%s': %v", p, err)
+		return nil
+	}
+	return bs
+}
+
 func newFakeModule(k *kubePackage) *isopod.Module {
 	return &isopod.Module{
 		Name: "kube",
@@ -223,6 +363,7 @@ func newFakeModule(k *kubePackage) *isopod.Module {
 			kubePutYamlMethod:          starlark.NewBuiltin("kube."+kubePutYamlMethod, k.kubePutYamlFn),
 			kubeGetMethod:              starlark.NewBuiltin("kube."+kubeGetMethod, k.kubeGetFn),
 			kubeExistsMethod:           starlark.NewBuiltin("kube."+kubeExistsMethod, k.kubeExistsFn),
+			kubeListMethod:             starlark.NewBuiltin("kube."+kubeListMethod, k.kubeListFn),
 			kubeFromIntMethod:          starlark.NewBuiltin("kube."+kubeFromIntMethod, fromIntFn),
 			kubeFromStrMethod:          starlark.NewBuiltin("kube."+kubeFromStrMethod, fromStringFn),
 		},
@@ -389,6 +530,17 @@ func fakeDiscovery() discovery.DiscoveryInterface {
 
 // NewFake returns a new fake kube module for testing.
 func NewFake() (m starlark.HasAttrs, closeFn func(), err error) {
+	newPkg, closeFn, err := NewFakePackages()
+	if err != nil {
+		return nil, nil, err
+	}
+	return newFakeModule(newPkg().(*kubePackage)), closeFn, nil
+}
+
+// NewFakePackages returns newPkg that creates kube packages with opts backed
+// by the same fake API server for testing (e.g to simulate consecutive runs).
+// Unlike NewFake, returned packages also implement DynamicClient and Pruner.
+func NewFakePackages() (newPkg func(opts ...Option) starlark.HasAttrs, closeFn func(), err error) {
 	// Create a fake API store with some endpoints pre-populated
 	cm := core.ConfigMap{
 		TypeMeta: metav1.TypeMeta{
@@ -411,6 +563,7 @@ func NewFake() (m starlark.HasAttrs, closeFn func(), err error) {
 
 	u, err := url.Parse(s.URL)
 	if err != nil {
+		s.Close()
 		return nil, nil, err
 	}
 
@@ -422,10 +575,12 @@ func NewFake() (m starlark.HasAttrs, closeFn func(), err error) {
 
 	t, err := rest.TransportFor(rConf)
 	if err != nil {
+		s.Close()
 		return nil, nil, err
 	}
 
-	k := New(h, fakeDiscovery(), dynamic.NewForConfigOrDie(rConf), &http.Client{Transport: t}, false /* dryRun */, false /* diff */)
-
-	return newFakeModule(k.(*kubePackage)), s.Close, nil
+	newPkg = func(opts ...Option) starlark.HasAttrs {
+		return New(h, fakeDiscovery(), dynamic.NewForConfigOrDie(rConf), &http.Client{Transport: t}, false /* dryRun */, false /* diff */, opts...)
+	}
+	return newPkg, s.Close, nil
 }
@@ -0,0 +1,112 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+
+	log "github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/cruise-automation/isopod/pkg/util"
+)
+
+// kubeListFn is an entry point for `kube.list' built-in.
+func (m *kubePackage) kubeListFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var resource, namespace, apiGroup, selector string
+	var wantJSON bool
+	unpacked := []interface{}{
+		"resource", &resource,
+		"namespace?", &namespace,
+		"api_group?", &apiGroup,
+		"label_selector?", &selector,
+		"json?", &wantJSON,
+	}
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, unpacked...); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+
+	r, err := newResource(m.dClient, "", namespace, apiGroup, resource, "")
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to map resource: %v", b.Name(), err)
+	}
+
+	items, err := m.kubeList(r, selector)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to list %s%s: %v", b.Name(), resource, maybeCore(apiGroup), err)
+	}
+
+	out := make([]starlark.Value, 0, len(items))
+	for i := range items {
+		item := &items[i]
+		if wantJSON {
+			v, err := util.ValueFromNestedMap(item.Object)
+			if err != nil {
+				return nil, fmt.Errorf("<%v>: failed to convert %s%s `%s' to JSON: %v", b.Name(), resource, maybeCore(apiGroup), maybeNamespaced(item.GetName(), item.GetNamespace()), err)
+			}
+			out = append(out, v)
+			continue
+		}
+
+		p, err := toProto(item, r)
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: failed to convert %s%s `%s' to proto (consider json=True): %v", b.Name(), resource, maybeCore(apiGroup), maybeNamespaced(item.GetName(), item.GetNamespace()), err)
+		}
+		out = append(out, skycfg.NewProtoMessage(p))
+	}
+
+	return starlark.NewList(out), nil
+}
+
+// kubeList returns all live objects of r resource (within r.Namespace if not
+// empty) matching label selector.
+func (m *kubePackage) kubeList(r *apiResource, selector string) ([]unstructured.Unstructured, error) {
+	var c dynamic.ResourceInterface = m.dynClient.Resource(r.GroupVersionResource())
+	if r.Namespace != "" {
+		c = c.(dynamic.NamespaceableResourceInterface).Namespace(r.Namespace)
+	}
+
+	log.V(1).Infof("LIST to %s (selector: %q)", m.Master+r.Path(), selector)
+
+	l, err := c.List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	return l.Items, nil
+}
+
+// toProto converts un into a typed object of r kind and returns it as a proto
+// message. Fails if the kind is not registered with the Scheme (e.g CRDs).
+func toProto(un *unstructured.Unstructured, r *apiResource) (proto.Message, error) {
+	obj, err := Scheme.New(r.GVK)
+	if err != nil {
+		return nil, err
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(un.Object, obj); err != nil {
+		return nil, err
+	}
+	p, ok := obj.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto message", obj)
+	}
+	return p, nil
+}
@@ -16,6 +16,7 @@ package kube
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -33,6 +34,7 @@ import (
 	"go.starlark.net/starlark"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	apiruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
@@ -303,6 +305,21 @@ spec:
     image: nginx:latest
 `
 
+const testJobYaml = `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  generateName: migrate-
+  namespace: default
+spec:
+  template:
+    spec:
+      containers:
+      - name: migrate
+        image: migrate:latest
+      restartPolicy: Never
+`
+
 const testNSYaml = `
 apiVersion: v1
 kind: Namespace
@@ -318,15 +335,19 @@ func TestKubePackage(t *testing.T) {
 		return url
 	}
 	for _, tc := range []struct {
-		name         string
-		expr         string
-		gotObj       apiruntime.Object
-		wantURLs     []string
-		wantJSON     bool
-		wantPodMeta  *metav1.ObjectMeta
-		wantDeletion metav1.DeletionPropagation
-		wantErr      string
-		wantResult   string
+		name               string
+		expr               string
+		gotObj             apiruntime.Object
+		coexistAnnotations map[string]string
+		provenance         Option
+		instanceID         string
+		deleteCRDs         bool
+		wantURLs           []string
+		wantJSON           bool
+		wantPodMeta        *metav1.ObjectMeta
+		wantDeletion       metav1.DeletionPropagation
+		wantErr            string
+		wantResult         string
 	}{
 		{
 			name:     "Create Pod",
@@ -485,7 +506,7 @@ func TestKubePackage(t *testing.T) {
 					Name: "foo",
 				},
 			},
-			wantURLs: urls("/api/v1/namespaces/foo", "/api/v1/namespaces/foo"),
+			wantURLs: urls("/api/v1/namespaces/foo", "/api/v1/namespaces/foo", "/api/v1/namespaces/foo"),
 		},
 		{
 			name: "Create Namespace (name mismatch)",
@@ -545,6 +566,21 @@ func TestKubePackage(t *testing.T) {
 			wantURLs:     urls("/api/v1/namespaces/default/pods/test"),
 			wantDeletion: "Foreground",
 		},
+		{
+			name: "Delete CRD (kept)",
+			expr: "kube.delete(customresourcedefinition='foos.example.com', api_group='apiextensions.k8s.io')",
+		},
+		{
+			name: "Delete CRD",
+			expr: "kube.delete(customresourcedefinition='foos.example.com', api_group='apiextensions.k8s.io')",
+			gotObj: &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "apiextensions.k8s.io/v1beta1",
+				"kind":       "CustomResourceDefinition",
+				"metadata":   map[string]interface{}{"name": "foos.example.com"},
+			}},
+			deleteCRDs: true,
+			wantURLs:   urls("/apis/apiextensions.k8s.io/v1beta1/customresourcedefinitions/foos.example.com"),
+		},
 		{
 			name: "Get Deployment",
 			expr: "kube.get(deployment='default/test', wait='10s', api_group='apps')",
@@ -585,11 +621,100 @@ func TestKubePackage(t *testing.T) {
 				Annotations: map[string]string{ctxAnnotationKey: `{"env":"test"}`, "snafoo": "42"},
 			},
 		},
+		{
+			name:               "Coexist annotations must be stamped",
+			expr:               `kube.put(name='foo', namespace='bar', data=[corev1.Pod(metadata=metav1.ObjectMeta(annotations={"snafoo": "42"}))])`,
+			coexistAnnotations: map[string]string{"argocd.argoproj.io/compare-options": "IgnoreExtraneous", "snafoo": "43"},
+			wantURLs:           urls("/api/v1/namespaces/bar/pods"),
+			wantPodMeta: &metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "bar",
+				Labels:    isopodLabels,
+				Annotations: map[string]string{
+					ctxAnnotationKey:                     `{"env":"test"}`,
+					"snafoo":                             "42",
+					"argocd.argoproj.io/compare-options": "IgnoreExtraneous",
+				},
+			},
+		},
+		{
+			name:       "Git provenance must be stamped",
+			expr:       `kube.put(name='foo', namespace='bar', data=[corev1.Pod(metadata=metav1.ObjectMeta(annotations={"isopod.getcruise.com/git-commit": "stale"}))])`,
+			provenance: WithGitProvenance("3f2c1ab", "main", true),
+			wantURLs:   urls("/api/v1/namespaces/bar/pods"),
+			wantPodMeta: &metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "bar",
+				Labels:    isopodLabels,
+				Annotations: map[string]string{
+					ctxAnnotationKey:       `{"env":"test"}`,
+					gitCommitAnnotationKey: "3f2c1ab",
+					gitBranchAnnotationKey: "main",
+					gitDirtyAnnotationKey:  "true",
+				},
+			},
+		},
+		{
+			name:       "Instance label must be set",
+			expr:       `kube.put(name='foo', namespace='bar', data=[corev1.Pod()])`,
+			instanceID: "team-a",
+			wantURLs:   urls("/api/v1/namespaces/bar/pods"),
+			wantPodMeta: &metav1.ObjectMeta{
+				Name:        "foo",
+				Namespace:   "bar",
+				Labels:      withNewLabels(isopodLabels, map[string]string{managedByLabelKey: "team-a"}),
+				Annotations: map[string]string{ctxAnnotationKey: `{"env":"test"}`},
+			},
+		},
+		{
+			name:     "Create object with generated name",
+			expr:     `kube.put(namespace='bar', data=[corev1.Pod(metadata=metav1.ObjectMeta(generateName='foo-'))])`,
+			wantURLs: urls("/api/v1/namespaces/bar/pods"),
+			wantPodMeta: &metav1.ObjectMeta{
+				GenerateName: "foo-",
+				Namespace:    "bar",
+				Labels:       withNewLabels(isopodLabels, map[string]string{generateNameLabelKey: "foo"}),
+				Annotations:  map[string]string{ctxAnnotationKey: `{"env":"test"}`},
+			},
+		},
+		{
+			name: "Create object with generated name (live exists)",
+			expr: `kube.put(namespace='bar', data=[corev1.Pod(metadata=metav1.ObjectMeta(generateName='foo-'))])`,
+			gotObj: &corev1.Pod{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "Pod",
+					APIVersion: "v1",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "foo-abcde",
+					Namespace: "bar",
+				},
+			},
+			// Must create without peeking at the live object.
+			wantURLs: urls("/api/v1/namespaces/bar/pods"),
+		},
+		{
+			name:     "Create YAML object with generated name",
+			expr:     fmt.Sprintf(`kube.put_yaml(data=["""%s"""])`, testJobYaml),
+			wantURLs: urls("/apis/batch/v1/namespaces/default/jobs"),
+			wantJSON: true,
+			wantPodMeta: &metav1.ObjectMeta{
+				GenerateName: "migrate-",
+				Namespace:    "default",
+				Labels:       withNewLabels(isopodLabels, map[string]string{generateNameLabelKey: "migrate"}),
+				Annotations:  map[string]string{ctxAnnotationKey: `{"env":"test"}`},
+			},
+		},
 		{
 			name:    "Override Namespace (Failure)",
 			expr:    `kube.put(name='test', namespace='default', data=[corev1.Pod(metadata=metav1.ObjectMeta(namespace='foobar'))])`,
 			wantErr: "<kube.put>: failed to validate/apply metadata for object 0 => k8s.io.api.core.v1.Pod: namespace=`default' argument does not match object's .metadata.namespace=`foobar'",
 		},
+		{
+			name:    "No name (Failure)",
+			expr:    `kube.put(namespace='default', data=[corev1.Pod()])`,
+			wantErr: "<kube.put>: 1 object(s) violate Kubernetes naming rules: pod `default/': .metadata.name or .metadata.generateName must be set",
+		},
 		{
 			name:     "Create CRD definition",
 			expr:     `kube.put(name='foo', api_group='apiextensions.k8s.io', data=[ext.CustomResourceDefinition()])`,
@@ -665,7 +790,7 @@ func TestKubePackage(t *testing.T) {
 					ResourceVersion: "42",
 				},
 			},
-			wantURLs: urls("/api/v1/namespaces/istio-system", "/api/v1/namespaces/istio-system"),
+			wantURLs: urls("/api/v1/namespaces/istio-system", "/api/v1/namespaces/istio-system", "/api/v1/namespaces/istio-system"),
 		},
 	} {
 		wantDel := metav1.DeletePropagationBackground
@@ -685,12 +810,19 @@ func TestKubePackage(t *testing.T) {
 		tlsConfig := rest.TLSClientConfig{
 			Insecure: true,
 		}
-		pkgs["kube"] = &kubePackage{
-			dClient:    fakeDiscovery(),
-			dynClient:  dynamic.NewForConfigOrDie(&rest.Config{Host: h, TLSClientConfig: tlsConfig}),
-			httpClient: fakeHTTPClient,
-			Master:     h,
+		m := &kubePackage{
+			dClient:            fakeDiscovery(),
+			dynClient:          dynamic.NewForConfigOrDie(&rest.Config{Host: h, TLSClientConfig: tlsConfig}),
+			httpClient:         fakeHTTPClient,
+			Master:             h,
+			coexistAnnotations: tc.coexistAnnotations,
+			instanceID:         tc.instanceID,
+			deleteCRDs:         tc.deleteCRDs,
 		}
+		if tc.provenance != nil {
+			tc.provenance.apply(m)
+		}
+		pkgs["kube"] = m
 
 		sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{"env": starlark.String("test")}}
 		t.Run(tc.name, func(t *testing.T) {
@@ -774,3 +906,166 @@ func TestKubeExists(t *testing.T) {
 		})
 	}
 }
+
+func TestKubeList(t *testing.T) {
+	pkgs := skycfg.UnstablePredeclaredModules(&protoRegistry{})
+	addImports(t, pkgs)
+
+	k, kClose, err := NewFake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kClose()
+
+	pkgs["kube"] = k
+
+	sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{"env": starlark.String("test")}}
+	for _, expr := range []string{
+		`kube.put(name='team-a', data=[corev1.Namespace(metadata=metav1.ObjectMeta(labels={'team': 'a'}))])`,
+		`kube.put(name='team-b', data=[corev1.Namespace(metadata=metav1.ObjectMeta(labels={'team': 'b'}))])`,
+	} {
+		if _, _, err := util.Eval("kube", expr, sCtx, pkgs); err != nil {
+			t.Fatalf("Failed to put objects: %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name       string
+		expr       string
+		wantErr    string
+		wantResult string
+	}{
+		{
+			name:       "List all",
+			expr:       `[ns.metadata.name for ns in kube.list('namespace')]`,
+			wantResult: `["team-a", "team-b"]`,
+		},
+		{
+			name:       "List by label selector",
+			expr:       `[ns.metadata.name for ns in kube.list('namespace', label_selector='team=b')]`,
+			wantResult: `["team-b"]`,
+		},
+		{
+			name:       "List as JSON",
+			expr:       `[ns['metadata']['labels']['team'] for ns in kube.list('namespace', json=True)]`,
+			wantResult: `["a", "b"]`,
+		},
+		{
+			name:    "Unknown resource",
+			expr:    `kube.list('foobar')`,
+			wantErr: `<kube.list>: failed to map resource: no matches for /, Resource=foobar`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v, _, err := util.Eval("kube", tc.expr, sCtx, pkgs)
+
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if tc.wantErr != gotErr {
+				t.Errorf("Unexpected error.\nWant:\n\t%s\nGot:\n\t%s", tc.wantErr, gotErr)
+			}
+			gotV := ""
+			if v != nil && v.String() != "None" {
+				gotV = v.String()
+			}
+			if tc.wantResult != gotV {
+				t.Fatalf("Unexpected expression result.\nWant: %s\nGot: %s", tc.wantResult, gotV)
+			}
+		})
+	}
+}
+
+func TestSetMetadataAddonLabel(t *testing.T) {
+	m := &kubePackage{}
+	sCtx := &addon.SkyCtx{Attrs: starlark.StringDict{}}
+	for _, tc := range []struct {
+		name, addonName string
+		labels          map[string]string
+		common          addon.CommonMetadata
+		wantLabels      map[string]string
+		wantAnnotations map[string]string
+	}{
+		{
+			name:       "No addon",
+			wantLabels: isopodLabels,
+		},
+		{
+			name:       "Addon label must be set",
+			addonName:  "netpol",
+			wantLabels: withNewLabels(isopodLabels, map[string]string{addonLabelKey: "netpol"}),
+		},
+		{
+			name:      "Common labels and annotations are merged",
+			addonName: "netpol",
+			labels:    map[string]string{"team": "security"},
+			common: addon.CommonMetadata{
+				Labels:      map[string]string{"team": "infra", "cost-center": "42", "heritage": "helm"},
+				Annotations: map[string]string{"owner": "infra@example.com"},
+			},
+			wantLabels: withNewLabels(isopodLabels, map[string]string{
+				addonLabelKey: "netpol",
+				"team":        "security",
+				"cost-center": "42",
+			}),
+			wantAnnotations: map[string]string{"owner": "infra@example.com"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{}
+			pod.Labels = tc.labels
+			if err := m.setMetadata(sCtx, tc.addonName, "foo", "bar", tc.common, pod); err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.wantLabels, pod.Labels); d != "" {
+				t.Errorf("Unexpected labels (-want, +got):\n%s", d)
+			}
+			delete(pod.Annotations, ctxAnnotationKey)
+			if len(pod.Annotations) == 0 {
+				pod.Annotations = nil
+			}
+			if d := cmp.Diff(tc.wantAnnotations, pod.Annotations); d != "" {
+				t.Errorf("Unexpected annotations (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestSetLastApplied(t *testing.T) {
+	podGVK := schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	for _, tc := range []struct {
+		name        string
+		enabled     bool
+		annotations map[string]string
+		want        string
+	}{
+		{
+			name: "Disabled",
+		},
+		{
+			name:    "Kind recovered from GVK",
+			enabled: true,
+			want:    `{"apiVersion":"v1","kind":"Pod","metadata":{"creationTimestamp":null,"name":"foo"},"spec":{"containers":null},"status":{}}` + "\n",
+		},
+		{
+			name:        "Previous configuration is not nested",
+			enabled:     true,
+			annotations: map[string]string{corev1.LastAppliedConfigAnnotation: `{"kind":"Pod"}`, "owner": "infra"},
+			want:        `{"apiVersion":"v1","kind":"Pod","metadata":{"annotations":{"owner":"infra"},"creationTimestamp":null,"name":"foo"},"spec":{"containers":null},"status":{}}` + "\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &kubePackage{writeLastApplied: tc.enabled}
+			pod := &corev1.Pod{}
+			pod.Name = "foo"
+			pod.Annotations = tc.annotations
+			if err := m.setLastApplied(context.Background(), pod, podGVK); err != nil {
+				t.Fatal(err)
+			}
+			if got := pod.Annotations[corev1.LastAppliedConfigAnnotation]; got != tc.want {
+				t.Errorf("Unexpected last applied configuration.\nWant: %s\nGot: %s", tc.want, got)
+			}
+		})
+	}
+}
@@ -17,11 +17,12 @@ package kube
 import (
 	"context"
 	"fmt"
-	"os"
 	"strings"
+	"time"
 
 	log "github.com/golang/glog"
 	"go.starlark.net/starlark"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/dynamic"
@@ -30,6 +31,7 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 
 	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/redact"
 )
 
 // DynamicClient used for applying dynamic resource manifests with no
@@ -41,17 +43,21 @@ type DynamicClient interface {
 // kubePutYamlFn is entry point for `kube.put_yaml' callable.
 func (m *kubePackage) kubePutYamlFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var name, namespace string
+	var keepGenerated int
+	var guard starlark.Callable
 	data := &starlark.List{}
 	unpacked := []interface{}{
-		"name", &name,
+		"name?", &name,
 		"data", &data,
 		"namespace?", &namespace,
+		"keep_generated?", &keepGenerated,
+		"guard?", &guard,
 	}
 	if err := starlark.UnpackArgs(b.Name(), args, kwargs, unpacked...); err != nil {
 		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
 	}
 
-	val, err := m.Apply(t, name, namespace, data)
+	val, err := m.apply(t, name, namespace, data, keepGenerated, guard)
 	if err != nil {
 		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
 	}
@@ -68,6 +74,8 @@ func nameAndNamespace(name, namespace string, obj runtime.Object) (string, strin
 	}
 	if objName != "" {
 		name = objName
+	} else if generateName(obj) != "" {
+		name = ""
 	}
 
 	objNs, err := a.Namespace(obj)
@@ -83,7 +91,22 @@ func nameAndNamespace(name, namespace string, obj runtime.Object) (string, strin
 }
 
 func (m *kubePackage) Apply(t *starlark.Thread, name, namespace string, data *starlark.List) (starlark.Value, error) {
-	for i := 0; i < data.Len(); i++ {
+	return m.apply(t, name, namespace, data, 0, nil)
+}
+
+// apply implements Apply. Only keepGenerated most recent instances of objects
+// relying on .metadata.generateName are kept (if positive). Objects are
+// skipped if guard (if set) returns False right before they are applied.
+func (m *kubePackage) apply(t *starlark.Thread, name, namespace string, data *starlark.List, keepGenerated int, guard starlark.Callable) (starlark.Value, error) {
+	if err := validateYAMLNames(name, namespace, data); err != nil {
+		return nil, err
+	}
+	if err := m.countObjects(t, data.Len()); err != nil {
+		return nil, err
+	}
+
+	batch := &applyBatch{size: m.applyBatchSize}
+	for _, i := range m.orderedIndices(data) {
 		maybeObj := data.Index(i)
 
 		obj, gvk, err := decode([]byte(maybeObj.(starlark.String)))
@@ -92,6 +115,9 @@ func (m *kubePackage) Apply(t *starlark.Thread, name, namespace string, data *st
 		}
 
 		sCtx := t.Local(addon.SkyCtxKey).(*addon.SkyCtx)
+		addonName, _ := t.Local(addon.NameKey).(string)
+		ctx := withDiffAddon(t.Local(addon.GoCtxKey).(context.Context), addonName)
+		ctx = withApplyStrategy(ctx, t.Local(addon.ApplyStrategyKey))
 		// Override name and namespace if runtime.Object already set these.
 		name, namespace, err = nameAndNamespace(name, namespace, obj)
 		if err != nil {
@@ -100,27 +126,85 @@ func (m *kubePackage) Apply(t *starlark.Thread, name, namespace string, data *st
 
 		r, err := newResourceForKind(m.dClient, name, namespace, "", *gvk)
 		if err != nil {
-			if _, ok := err.(*meta.NoKindMatchError); ok && m.dryRun {
-				if err := printUnifiedDiff(os.Stdout, nil, obj, *gvk, maybeNamespaced(name, namespace)); err != nil {
+			if _, ok := err.(*meta.NoKindMatchError); ok && m.isDryRun(ctx) {
+				if err := batch.flush(); err != nil {
+					return nil, err
+				}
+				recordGVK(ctx, *gvk)
+				displayName := maybeNamespaced(name, namespace)
+				if gen := generateName(obj); gen != "" {
+					displayName = generatedDisplayName(gen, namespace)
+				}
+				if err := m.printDiff(ctx, nil, obj, *gvk, displayName); err != nil {
 					return nil, err
 				}
-				return starlark.None, nil
+				continue
 			}
 			return nil, fmt.Errorf("failed to map resource: %v", err)
 		}
-		if r.ClusterScoped {
-			namespace = ""
+		if err := setDefaultNamespace(t, r, obj); err != nil {
+			return nil, fmt.Errorf("failed to set default namespace of %v: %v", r, err)
 		}
+		namespace = r.Namespace
 
-		if err := m.setMetadata(sCtx, name, namespace, obj); err != nil {
+		common, _ := t.Local(addon.CommonMetadataKey).(addon.CommonMetadata)
+		if err := m.setMetadata(sCtx, addonName, name, namespace, common, obj); err != nil {
 			return nil, fmt.Errorf("failed to validate/apply metadata for object %v/%s => %v", gvk.Kind, name, err)
 		}
+		if err := m.rewriteImages(obj, r.GVK.Kind); err != nil {
+			return nil, fmt.Errorf("%v: %v", r, err)
+		}
+		if err := m.setLastApplied(ctx, obj, r.GVK); err != nil {
+			return nil, fmt.Errorf("failed to set last applied configuration of %v: %v", r, err)
+		}
 
-		ctx := t.Local(addon.GoCtxKey).(context.Context)
-		if err := m.kubeUpdateYaml(ctx, r, obj); err != nil {
+		key, digest := m.resumable(addonName, r, obj)
+		declared := m.declaredDigest(r, obj)
+		apply := func() error {
+			if ok, err := m.passesFilter(ctx, addonName, r, obj); err != nil || !ok {
+				return err
+			}
+			recordGVK(ctx, r.GVK)
+			if m.alreadyApplied(key, digest) {
+				log.Infof("%v unchanged since applied by resumed run, skipping", r)
+				m.recordApplied(addonName, r)
+				return nil
+			}
+			if ok, err := m.passesGuard(ctx, t, guard, maybeObj, addonName, r); err != nil || !ok {
+				return err
+			}
+			if ok, err := m.dedupe(ctx, addonName, r, declared); err != nil || !ok {
+				return err
+			}
+			if err := m.passesPolicy(ctx, r, obj); err != nil {
+				return err
+			}
+			if err := m.passesCircuit(r); err != nil {
+				return err
+			}
+			if err := m.recordRender(addonName, r, obj); err != nil {
+				return err
+			}
+			if err := m.extendApplySet(ctx, addonName, r); err != nil {
+				return err
+			}
+			start := time.Now()
+			if err := m.kubeUpdateYaml(ctx, r, obj, keepGenerated); err != nil {
+				return m.recordFailure(r, err)
+			}
+			m.recordLatency(addonName, r, time.Since(start))
+			m.recordApplied(addonName, r)
+			m.recordProgress(ctx, key, digest)
+			return nil
+		}
+		// Guards are evaluated on t so objects are applied one by one.
+		if err := batch.add(apply, isBarrier(r.GVK) || isWebhook(r.GVK) || guard != nil); err != nil {
 			return nil, err
 		}
 	}
+	if err := batch.flush(); err != nil {
+		return nil, err
+	}
 
 	return starlark.None, nil
 }
@@ -142,19 +226,47 @@ func parseUnstructuredStatus(un *unstructured.Unstructured) (details string, err
 	return fmt.Sprintf("%s%s `%s'", strings.ToLower(gvk.Kind), maybeCore(gvk.Group), maybeNamespaced(un.GetName(), un.GetNamespace())), nil
 }
 
-func (m *kubePackage) kubeUpdateYaml(ctx context.Context, r *apiResource, obj runtime.Object) error {
-	live, found, err := m.kubePeek(ctx, m.Master+r.PathWithName())
-	if err != nil {
-		return err
+func (m *kubePackage) kubeUpdateYaml(ctx context.Context, r *apiResource, obj runtime.Object, keepGenerated int) error {
+	name := maybeNamespaced(r.Name, r.Namespace)
+	gen := generateName(obj)
+
+	var live runtime.Object
+	var found bool
+	if gen != "" { // Always create new instance.
+		name = generatedDisplayName(gen, r.Namespace)
+	} else {
+		var err error
+		if live, found, err = m.kubePeek(ctx, m.Master+r.PathWithName()); err != nil {
+			return err
+		}
 	}
+	var recreate bool
+	var desired runtime.Object
 	if found {
-		if err := mergeObjects(live, obj); err != nil {
+		// Kept to merge with live object again on conflict.
+		desired = obj.DeepCopyObject()
+		var err error
+		if recreate, err = m.mergeForStrategy(ctx, r, live, obj); err != nil {
 			return err
 		}
 	}
 
-	if m.dryRun {
-		return printUnifiedDiff(os.Stdout, live, obj, r.GVK, maybeNamespaced(r.Name, r.Namespace))
+	if err := m.addRequestsDelta(ctx, r.GVK, live, obj); err != nil {
+		return err
+	}
+
+	var dryRunOpts []string
+	if m.isDryRun(ctx) {
+		if err := m.printDiff(ctx, live, obj, r.GVK, name); err != nil {
+			return err
+		}
+		if err := m.settleNamespace(ctx, r, found); err != nil {
+			return err
+		}
+		if m.skipServerDryRun(ctx, r) {
+			return nil
+		}
+		dryRunOpts = []string{metav1.DryRunAll}
 	}
 
 	var c dynamic.ResourceInterface = m.dynClient.Resource(r.GroupVersionResource())
@@ -168,7 +280,16 @@ func (m *kubePackage) kubeUpdateYaml(ctx context.Context, r *apiResource, obj ru
 			return fmt.Errorf("failed to render :live object for %v: %v", r, err)
 		}
 
-		log.Infof("%v:\n%s", r, s)
+		log.Infof("%v:\n%s", r, redact.String(s))
+	}
+
+	if err := m.snapshotLive(ctx, r, live); err != nil {
+		return err
+	}
+	if recreate {
+		if err := m.deleteForRecreate(ctx, r); err != nil {
+			return err
+		}
 	}
 
 	un, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
@@ -177,21 +298,54 @@ func (m *kubePackage) kubeUpdateYaml(ctx context.Context, r *apiResource, obj ru
 	}
 
 	var resp *unstructured.Unstructured
-	if found {
-		resp, err = c.Update(&unstructured.Unstructured{Object: un}, metav1.UpdateOptions{})
+	op := opCreate
+	if found && !recreate {
+		op = opUpdate
+		for n := 0; ; n++ {
+			resp, err = c.Update(&unstructured.Unstructured{Object: un}, metav1.UpdateOptions{DryRun: dryRunOpts})
+			if !apierrors.IsConflict(err) {
+				break
+			}
+			refreshed, rErr := m.refreshOnConflict(ctx, r, desired, n)
+			if rErr != nil {
+				return rErr
+			}
+			if refreshed == nil {
+				return err
+			}
+			obj = refreshed
+			if un, err = runtime.DefaultUnstructuredConverter.ToUnstructured(obj); err != nil {
+				return err
+			}
+		}
 	} else {
-		resp, err = c.Create(&unstructured.Unstructured{Object: un}, metav1.CreateOptions{})
+		resp, err = c.Create(&unstructured.Unstructured{Object: un}, metav1.CreateOptions{DryRun: dryRunOpts})
 	}
 	if err != nil {
-		return err
+		return m.attributeAdmissionError(r, op, err)
 	}
 
 	rMsg, err := parseUnstructuredStatus(resp)
 	if err != nil {
 		return err
 	}
+	if dryRunOpts != nil {
+		log.Infof("%s passed server dry run", rMsg)
+		return nil
+	}
 
 	log.Infof("%s updated", rMsg)
+	if !found && gen == "" {
+		if err := m.recordCreated(ctx, r); err != nil {
+			return err
+		}
+	}
+	if err := m.settleNamespace(ctx, r, found); err != nil {
+		return err
+	}
 
-	return err
+	if gen != "" {
+		return m.pruneGenerated(r, gen, keepGenerated)
+	}
+	return nil
 }
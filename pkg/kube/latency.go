@@ -0,0 +1,95 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// ApplyLatency is the time it took to apply a single object.
+type ApplyLatency struct {
+	// GVK is the lowercase kind and group version of the object, e.g
+	// `deployment.apps/v1'.
+	GVK      string        `json:"gvk"`
+	Name     string        `json:"name"`
+	Addon    string        `json:"addon"`
+	Cluster  string        `json:"cluster"`
+	Duration time.Duration `json:"duration"`
+}
+
+// ApplyProfile collects latencies of objects applied by kube packages of all
+// clusters. Safe for concurrent use.
+type ApplyProfile struct {
+	mu        sync.Mutex
+	latencies []ApplyLatency
+}
+
+// NewApplyProfile returns a new empty ApplyProfile.
+func NewApplyProfile() *ApplyProfile {
+	return &ApplyProfile{}
+}
+
+// Record adds l to the profile.
+func (p *ApplyProfile) Record(l ApplyLatency) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.latencies = append(p.latencies, l)
+}
+
+// Slowest returns the n slowest applies recorded so far, slowest first (all
+// of them if n is not positive).
+func (p *ApplyProfile) Slowest(n int) []ApplyLatency {
+	p.mu.Lock()
+	ls := append([]ApplyLatency{}, p.latencies...)
+	p.mu.Unlock()
+
+	sort.SliceStable(ls, func(i, j int) bool { return ls[i].Duration > ls[j].Duration })
+	if n > 0 && len(ls) > n {
+		ls = ls[:n]
+	}
+	return ls
+}
+
+// Print writes a table of the n slowest applies to w.
+func (p *ApplyProfile) Print(w io.Writer, n int) error {
+	ls := p.Slowest(n)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "DURATION\tGVK\tNAME\tADDON\tCLUSTER\n")
+	for _, l := range ls {
+		fmt.Fprintf(tw, "%v\t%s\t%s\t%s\t%s\n", l.Duration.Round(time.Millisecond), l.GVK, l.Name, l.Addon, l.Cluster)
+	}
+	return tw.Flush()
+}
+
+// recordLatency records that applying r on behalf of addonName took d (if
+// profiling applies).
+func (m *kubePackage) recordLatency(addonName string, r *apiResource, d time.Duration) {
+	if m.applyProfile == nil {
+		return
+	}
+	m.applyProfile.Record(ApplyLatency{
+		GVK:      strings.ToLower(r.GVK.Kind) + "." + r.GVK.GroupVersion().String(),
+		Name:     maybeNamespaced(r.Name, r.Namespace),
+		Addon:    addonName,
+		Cluster:  m.applyCluster,
+		Duration: d,
+	})
+}
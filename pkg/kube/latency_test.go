@@ -0,0 +1,85 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+func TestApplyProfileSlowest(t *testing.T) {
+	p := NewApplyProfile()
+	for i, d := range []time.Duration{2 * time.Second, 5 * time.Second, time.Second} {
+		p.Record(ApplyLatency{GVK: "configmap.v1", Name: string(rune('a' + i)), Duration: d})
+	}
+
+	var names []string
+	for _, l := range p.Slowest(2) {
+		names = append(names, l.Name)
+	}
+	if got, want := strings.Join(names, ","), "b,a"; got != want {
+		t.Errorf("Slowest(2) = %v, want %v", got, want)
+	}
+	if got := len(p.Slowest(0)); got != 3 {
+		t.Errorf("Slowest(0) returned %d applies, want 3", got)
+	}
+
+	var buf bytes.Buffer
+	if err := p.Print(&buf, 1); err != nil {
+		t.Fatal(err)
+	}
+	want := "DURATION  GVK           NAME  ADDON  CLUSTER\n5s        configmap.v1  b            \n"
+	if got := buf.String(); got != want {
+		t.Errorf("Print() = %q, want %q", got, want)
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	newKube, closeFn, err := NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	p := NewApplyProfile()
+	thread := &starlark.Thread{}
+	thread.SetLocal(addon.GoCtxKey, context.Background())
+	thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+	thread.SetLocal(addon.NameKey, "app")
+	pkgs := starlark.StringDict{"kube": newKube(WithApplyProfile(p, "dev"))}
+	if _, err := starlark.ExecFile(thread, t.Name(), `kube.put_yaml(name="foo", namespace="default", data=["""
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+"""])`, pkgs); err != nil {
+		t.Fatal(err)
+	}
+
+	ls := p.Slowest(0)
+	if len(ls) != 1 {
+		t.Fatalf("Got %d applies recorded, want 1", len(ls))
+	}
+	if l := ls[0]; l.GVK != "configmap.v1" || l.Name != "default/foo" || l.Addon != "app" || l.Cluster != "dev" || l.Duration <= 0 {
+		t.Errorf("Unexpected apply recorded: %+v", l)
+	}
+}
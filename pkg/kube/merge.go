@@ -0,0 +1,89 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// mergeThreeWay replaces obj with live merged with obj the way kubectl apply
+// does it client-side: fields set by obj overwrite those of live, fields of
+// the last configuration applied to live (its last-applied-configuration
+// annotation) missing from obj are removed, and all other fields of live
+// (e.g set by controllers or defaulted) are kept. Lists are replaced as a
+// whole. If live has no last applied configuration (e.g it was last applied
+// with another strategy) no field is removed.
+func mergeThreeWay(live, obj runtime.Object) error {
+	current, err := toUnstructured(live)
+	if err != nil {
+		return err
+	}
+	modified, err := toUnstructured(obj)
+	if err != nil {
+		return err
+	}
+
+	var original map[string]interface{}
+	if s := current.GetAnnotations()[corev1.LastAppliedConfigAnnotation]; s != "" {
+		if err := json.Unmarshal([]byte(s), &original); err != nil {
+			return fmt.Errorf("failed to parse last applied configuration of live object: %v", err)
+		}
+	} else {
+		log.V(1).Infof("Live object %s has no last applied configuration, no fields are removed", maybeNamespaced(current.GetName(), current.GetNamespace()))
+	}
+
+	merged := mergeFields(original, modified.Object, current.Object)
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		u.Object = merged
+		return nil
+	}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(merged, obj)
+}
+
+// mergeFields returns current with fields of modified set (merging nested
+// objects) and fields of original missing from modified removed. Null
+// fields of modified are treated as unset.
+func mergeFields(original, modified, current map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(current))
+	for k, v := range current {
+		out[k] = v
+	}
+	for k := range original {
+		if _, ok := modified[k]; !ok {
+			delete(out, k)
+		}
+	}
+	for k, v := range modified {
+		if v == nil {
+			continue
+		}
+		vm, ok := v.(map[string]interface{})
+		cm, cOK := out[k].(map[string]interface{})
+		if !ok || !cOK {
+			out[k] = v
+			continue
+		}
+		om, _ := original[k].(map[string]interface{})
+		out[k] = mergeFields(om, vm, cm)
+	}
+	return out
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+func TestMergeFields(t *testing.T) {
+	for _, tc := range []struct {
+		name                        string
+		original, modified, current map[string]interface{}
+		want                        map[string]interface{}
+	}{
+		{
+			name:     "Field set",
+			modified: map[string]interface{}{"a": "2"},
+			current:  map[string]interface{}{"a": "1", "b": "1"},
+			want:     map[string]interface{}{"a": "2", "b": "1"},
+		},
+		{
+			name:     "Field no longer applied",
+			original: map[string]interface{}{"a": "1", "b": "1"},
+			modified: map[string]interface{}{"a": "1"},
+			current:  map[string]interface{}{"a": "1", "b": "1", "c": "1"},
+			want:     map[string]interface{}{"a": "1", "c": "1"},
+		},
+		{
+			name:     "Nested fields",
+			original: map[string]interface{}{"spec": map[string]interface{}{"a": "1", "b": "1"}},
+			modified: map[string]interface{}{"spec": map[string]interface{}{"a": "2"}},
+			current:  map[string]interface{}{"spec": map[string]interface{}{"a": "1", "b": "1", "c": "1"}},
+			want:     map[string]interface{}{"spec": map[string]interface{}{"a": "2", "c": "1"}},
+		},
+		{
+			name:     "Lists replaced",
+			original: map[string]interface{}{"l": []interface{}{"a", "b"}},
+			modified: map[string]interface{}{"l": []interface{}{"a"}},
+			current:  map[string]interface{}{"l": []interface{}{"a", "b", "c"}},
+			want:     map[string]interface{}{"l": []interface{}{"a"}},
+		},
+		{
+			name:     "Null fields unset",
+			modified: map[string]interface{}{"a": nil},
+			current:  map[string]interface{}{"a": "1"},
+			want:     map[string]interface{}{"a": "1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mergeFields(tc.original, tc.modified, tc.current)
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected merge (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestMergeThreeWay(t *testing.T) {
+	live := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "foo",
+			ResourceVersion: "42",
+			Labels:          map[string]string{"owner": "controller"},
+			Annotations: map[string]string{
+				corev1.LastAppliedConfigAnnotation: `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"foo"},"data":{"a":"1","b":"1"}}`,
+			},
+		},
+		Data: map[string]string{"a": "1", "b": "1", "c": "1"},
+	}
+	obj := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "foo",
+			Annotations: map[string]string{
+				corev1.LastAppliedConfigAnnotation: `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"foo"},"data":{"a":"2"}}`,
+			},
+		},
+		Data: map[string]string{"a": "2"},
+	}
+	if err := mergeThreeWay(live, obj); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := cmp.Diff(map[string]string{"a": "2", "c": "1"}, obj.Data); d != "" {
+		t.Errorf("Unexpected data (-want, +got):\n%s", d)
+	}
+	if d := cmp.Diff(map[string]string{"owner": "controller"}, obj.Labels); d != "" {
+		t.Errorf("Unexpected labels (-want, +got):\n%s", d)
+	}
+	if got, want := obj.Annotations[corev1.LastAppliedConfigAnnotation], `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"foo"},"data":{"a":"2"}}`; got != want {
+		t.Errorf("Unexpected last applied configuration.\nWant: %s\nGot: %s", want, got)
+	}
+}
+
+func TestPutYamlMerge(t *testing.T) {
+	newKube, closeFn, err := NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+	k := newKube()
+
+	eval := func(expr string, data ...string) starlark.Value {
+		var vs []starlark.Value
+		for _, d := range data {
+			vs = append(vs, starlark.String(d))
+		}
+		thread := &starlark.Thread{}
+		thread.SetLocal(addon.GoCtxKey, context.Background())
+		thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+		thread.SetLocal(addon.NameKey, "app")
+		thread.SetLocal(addon.ApplyStrategyKey, addon.ApplyStrategyMerge)
+		env := starlark.StringDict{"kube": k, "data": starlark.NewList(vs)}
+		v, err := starlark.Eval(thread, t.Name(), expr, env)
+		if err != nil {
+			t.Fatalf("Failed to eval `%s': %v", expr, err)
+		}
+		return v
+	}
+
+	eval("kube.put_yaml(data=data)", `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: default
+data:
+  a: "1"
+  b: "1"
+`)
+	eval("kube.put_yaml(data=data)", `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: default
+data:
+  a: "2"
+`)
+	got := eval(`kube.get(configmap="default/foo")`)
+	data, err := got.(starlark.HasAttrs).Attr("data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := data.String(); s != `{"a": "2"}` {
+		t.Errorf("Expected field no longer applied to be removed, got: %s", s)
+	}
+}
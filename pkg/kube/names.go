@@ -0,0 +1,203 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// objectNames are the names of an object to be applied that API server
+// validates.
+type objectNames struct {
+	kind         string
+	name         string
+	generateName string
+	namespace    string
+	labels       map[string]string
+}
+
+// namesOf returns names of obj of kind applied as name in namespace
+// (overridden by those set in obj).
+func namesOf(kind, name, namespace string, obj runtime.Object) (*objectNames, error) {
+	a := meta.NewAccessor()
+	n := &objectNames{kind: kind, name: name, namespace: namespace, generateName: generateName(obj)}
+
+	objName, err := a.Name(obj)
+	if err != nil {
+		return nil, err
+	}
+	if objName != "" {
+		n.name = objName
+	}
+	if objNs, err := a.Namespace(obj); err == nil && objNs != "" {
+		n.namespace = objNs
+	}
+	if n.labels, err = a.Labels(obj); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// kindOfMsg returns kind of Kubernetes proto message msg (named after its Go
+// type, e.g Deployment).
+func kindOfMsg(msg proto.Message) string {
+	t := reflect.TypeOf(msg)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// nameRule returns the function validating names of objects of kind.
+func nameRule(kind string) func(string) []string {
+	switch kind {
+	case "Namespace":
+		return validation.IsDNS1123Label
+	case "Service":
+		return validation.IsDNS1035Label
+	case "Role", "ClusterRole", "RoleBinding", "ClusterRoleBinding":
+		// RBAC names only have to be valid path segments (e.g
+		// `system:controller:foo').
+		return isPathSegmentName
+	}
+	return validation.IsDNS1123Subdomain
+}
+
+func isPathSegmentName(name string) []string {
+	if name == "." || name == ".." {
+		return []string{fmt.Sprintf("may not be %q", name)}
+	}
+	var errs []string
+	for _, illegal := range []string{"/", "%"} {
+		if strings.Contains(name, illegal) {
+			errs = append(errs, fmt.Sprintf("may not contain %q", illegal))
+		}
+	}
+	return errs
+}
+
+// violations returns violations of Kubernetes naming rules by n.
+func (n *objectNames) violations() []string {
+	var out []string
+	add := func(field, value string, errs []string) {
+		for _, e := range errs {
+			out = append(out, fmt.Sprintf("%s `%s': %s", field, value, e))
+		}
+	}
+
+	rule := nameRule(n.kind)
+	if n.name != "" {
+		add(".metadata.name", n.name, rule(n.name))
+	} else if n.generateName != "" {
+		// API server appends a random suffix to the prefix (so a trailing
+		// dash is fine).
+		prefix := n.generateName
+		if strings.HasSuffix(prefix, "-") {
+			prefix = prefix[:len(prefix)-1] + "a"
+		}
+		add(".metadata.generateName", n.generateName, rule(prefix))
+	} else {
+		out = append(out, ".metadata.name or .metadata.generateName must be set")
+	}
+	if n.namespace != "" {
+		add(".metadata.namespace", n.namespace, validation.IsDNS1123Label(n.namespace))
+	}
+
+	keys := make([]string, 0, len(n.labels))
+	for k := range n.labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		add("label key", k, validation.IsQualifiedName(k))
+		add(fmt.Sprintf("value of label `%s'", k), n.labels[k], validation.IsValidLabelValue(n.labels[k]))
+	}
+	return out
+}
+
+// validateNames checks names of all objs against Kubernetes naming rules
+// (DNS-1123 names and length limits as enforced by API server) so that
+// invalid objects are caught before any of them is applied (and without a
+// cluster, e.g in unit tests). Reports all violations at once.
+func validateNames(objs []*objectNames) error {
+	var errs []string
+	for _, n := range objs {
+		vs := n.violations()
+		if len(vs) == 0 {
+			continue
+		}
+		display := n.name
+		if display == "" && n.generateName != "" {
+			display = n.generateName + "*"
+		}
+		errs = append(errs, fmt.Sprintf("%s `%s': %s", strings.ToLower(n.kind), maybeNamespaced(display, n.namespace), strings.Join(vs, ", ")))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d object(s) violate Kubernetes naming rules: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// validateMsgNames validates names of proto messages in data (as passed to
+// kube.put with name and namespace args). Items that aren't valid objects
+// are skipped (and reported once applied).
+func validateMsgNames(name, namespace string, data *starlark.List) error {
+	var objs []*objectNames
+	for i := 0; i < data.Len(); i++ {
+		msg, ok := skycfg.AsProtoMessage(data.Index(i))
+		if !ok {
+			continue
+		}
+		obj, ok := msg.(runtime.Object)
+		if !ok {
+			continue
+		}
+		if n, err := namesOf(kindOfMsg(msg), name, namespace, obj); err == nil {
+			objs = append(objs, n)
+		}
+	}
+	return validateNames(objs)
+}
+
+// validateYAMLNames validates names of YAML objects in data (as passed to
+// kube.put_yaml with name and namespace args). Items that aren't valid
+// objects are skipped (and reported once applied).
+func validateYAMLNames(name, namespace string, data *starlark.List) error {
+	var objs []*objectNames
+	for i := 0; i < data.Len(); i++ {
+		s, ok := starlark.AsString(data.Index(i))
+		if !ok {
+			continue
+		}
+		obj, gvk, err := decode([]byte(s))
+		if err != nil {
+			continue
+		}
+		if n, err := namesOf(gvk.Kind, name, namespace, obj); err == nil {
+			objs = append(objs, n)
+		}
+	}
+	return validateNames(objs)
+}
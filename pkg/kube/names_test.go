@@ -0,0 +1,130 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+func TestNameViolations(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		names objectNames
+		want  []string
+	}{
+		{
+			name:  "Valid",
+			names: objectNames{kind: "ConfigMap", name: "app.config", namespace: "default", labels: map[string]string{"example.com/app": "foo_bar"}},
+		},
+		{
+			name:  "Service name too long",
+			names: objectNames{kind: "Service", name: strings.Repeat("a", 64)},
+			want:  []string{".metadata.name `" + strings.Repeat("a", 64) + "': must be no more than 63 characters"},
+		},
+		{
+			name:  "Service name with dots",
+			names: objectNames{kind: "Service", name: "app.v2"},
+			want:  []string{".metadata.name `app.v2': a DNS-1035 label must consist of lower case alphanumeric characters or '-', start with an alphabetic character, and end with an alphanumeric character (e.g. 'my-name',  or 'abc-123', regex used for validation is '[a-z]([-a-z0-9]*[a-z0-9])?')"},
+		},
+		{
+			name:  "RBAC name",
+			names: objectNames{kind: "ClusterRole", name: "system:controller:app"},
+		},
+		{
+			name:  "Generate name prefix",
+			names: objectNames{kind: "Job", generateName: "migrate-"},
+		},
+		{
+			name:  "No name",
+			names: objectNames{kind: "ConfigMap", namespace: "default"},
+			want:  []string{".metadata.name or .metadata.generateName must be set"},
+		},
+		{
+			name:  "Invalid namespace and label",
+			names: objectNames{kind: "ConfigMap", name: "app", namespace: "Prod", labels: map[string]string{"a/b/c": "ok"}},
+			want: []string{
+				".metadata.namespace `Prod': a DNS-1123 label must consist of lower case alphanumeric characters or '-', and must start and end with an alphanumeric character (e.g. 'my-name',  or '123-abc', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?')",
+				"label key `a/b/c': a qualified name must consist of alphanumeric characters, '-', '_' or '.', and must start and end with an alphanumeric character (e.g. 'MyName',  or 'my.name',  or '123-abc', regex used for validation is '([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9]') with an optional DNS subdomain prefix and '/' (e.g. 'example.com/MyName')",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if d := cmp.Diff(tc.want, tc.names.violations()); d != "" {
+				t.Errorf("Unexpected violations (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestPutYamlInvalidNames(t *testing.T) {
+	newKube, closeFn, err := NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+	k := newKube()
+
+	eval := func(expr string) (starlark.Value, error) {
+		thread := &starlark.Thread{}
+		thread.SetLocal(addon.GoCtxKey, context.Background())
+		thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+		thread.SetLocal(addon.NameKey, "app")
+		return starlark.Eval(thread, t.Name(), expr, starlark.StringDict{"kube": k})
+	}
+
+	_, err = eval(`kube.put_yaml(data=["""
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: valid
+  namespace: default
+""", """
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: Invalid_Name
+  namespace: default
+""", """
+apiVersion: v1
+kind: Service
+metadata:
+  name: ` + strings.Repeat("s", 64) + `
+  namespace: default
+"""])`)
+	if err == nil {
+		t.Fatal("Expected put_yaml to fail")
+	}
+	for _, want := range []string{"2 object(s) violate Kubernetes naming rules", "configmap `default/Invalid_Name'", "service `default/sss"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to contain %q, got: %v", want, err)
+		}
+	}
+
+	// Nothing is applied.
+	exists, err := eval(`kube.exists(configmap="default/valid")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists == starlark.True {
+		t.Error("Expected valid object not to be applied")
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+// namespaceReadyTimeout is how long applying a Namespace waits for it to be
+// visible and active so that objects applied into it later in the run
+// (e.g by the next addon) don't fail with NotFound.
+const namespaceReadyTimeout = 30 * time.Second
+
+func isNamespace(gvk schema.GroupVersionKind) bool {
+	return gvk.Group == "" && gvk.Kind == "Namespace"
+}
+
+// setDefaultNamespace sets namespace of r to the default_namespace of the
+// addon run by t (if any) if r is namespaced and neither r nor obj have
+// one.
+func setDefaultNamespace(t *starlark.Thread, r *apiResource, obj runtime.Object) error {
+	ns, _ := t.Local(addon.DefaultNamespaceKey).(string)
+	if ns == "" || r.ClusterScoped || r.Namespace != "" {
+		return nil
+	}
+	objNs, err := meta.NewAccessor().Namespace(obj)
+	if err != nil || objNs != "" {
+		return err
+	}
+	r.Namespace = ns
+	return nil
+}
+
+// settleNamespace is called once r is applied (found tells whether it was
+// live before). Namespaces only created in dry run are recorded so that
+// objects into them skip server dry run (which would fail with NotFound);
+// otherwise waits for the namespace to be served and active.
+func (m *kubePackage) settleNamespace(ctx context.Context, r *apiResource, found bool) error {
+	if !isNamespace(r.GVK) || r.Subresource != "" {
+		return nil
+	}
+	if m.isDryRun(ctx) {
+		if !found {
+			m.namespacesMu.Lock()
+			if m.dryRunNamespaces == nil {
+				m.dryRunNamespaces = map[string]bool{}
+			}
+			m.dryRunNamespaces[r.Name] = true
+			m.namespacesMu.Unlock()
+		}
+		return nil
+	}
+	return m.waitNamespaceActive(ctx, r, namespaceReadyTimeout)
+}
+
+// waitNamespaceActive polls namespace r every waitRetryInterval until it is
+// found and not terminating or timeout expires. Terminating namespaces fail
+// right away since nothing can be created in them until they are gone.
+func (m *kubePackage) waitNamespaceActive(ctx context.Context, r *apiResource, timeout time.Duration) error {
+	timeoutCh := time.After(timeout)
+	for {
+		live, found, err := m.kubePeek(ctx, m.Master+r.PathWithName())
+		if err != nil {
+			return fmt.Errorf("failed to get namespace `%s' while waiting for it to be active: %v", r.Name, err)
+		}
+		if found {
+			if namespacePhase(live) == string(corev1.NamespaceTerminating) {
+				return fmt.Errorf("namespace `%s' is being terminated so objects can't be applied into it, rerun once it is gone", r.Name)
+			}
+			return nil
+		}
+
+		log.V(1).Infof("Waiting for namespace `%s' to be active", r.Name)
+		select {
+		case <-timeoutCh:
+			return fmt.Errorf("namespace `%s' still not found %v after being applied", r.Name, timeout)
+		case <-time.After(waitRetryInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("namespace `%s' not active: %v", r.Name, ctx.Err())
+		}
+	}
+}
+
+// namespacePhase returns .status.phase of live namespace.
+func namespacePhase(live runtime.Object) string {
+	switch ns := live.(type) {
+	case *corev1.Namespace:
+		return string(ns.Status.Phase)
+	case *unstructured.Unstructured:
+		phase, _, _ := unstructured.NestedString(ns.Object, "status", "phase")
+		return phase
+	}
+	return ""
+}
+
+// skipServerDryRun returns whether dry run of r stops at the diff, i.e
+// server dry run is disabled or silenced for ctx, or r is headed into a
+// namespace that is only created by this (dry) run.
+func (m *kubePackage) skipServerDryRun(ctx context.Context, r *apiResource) bool {
+	if !m.serverDryRun || addon.IsSilent(ctx) {
+		return true
+	}
+	if r.Namespace == "" || isNamespace(r.GVK) {
+		return false
+	}
+	m.namespacesMu.Lock()
+	pending := m.dryRunNamespaces[r.Namespace]
+	m.namespacesMu.Unlock()
+	if pending {
+		log.Infof("%v skipped server dry run: namespace `%s' is only created by this run", r, r.Namespace)
+	}
+	return pending
+}
@@ -0,0 +1,172 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stripe/skycfg"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+func TestNamespaceBarrier(t *testing.T) {
+	const configMap = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: team`
+
+	for _, tc := range []struct {
+		name string
+		// dryRun runs both addons in (server) dry run.
+		dryRun    bool
+		namespace string
+		// wantErr is the error of the dependent addon.
+		wantErr string
+		// wantCM tells whether the ConfigMap reached the API server.
+		wantCM bool
+	}{
+		{
+			name: "Namespace created by prior addon",
+			namespace: `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: team`,
+			wantCM: true,
+		},
+		{
+			name:   "Server dry run into namespace only created by run",
+			dryRun: true,
+			namespace: `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: team`,
+		},
+		{
+			name: "Terminating namespace",
+			namespace: `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: team
+status:
+  phase: Terminating`,
+			wantErr: "namespace `team' is being terminated",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newKube, closeFn, err := NewFakePackages()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeFn()
+			k := newKube(WithServerDryRun(true))
+
+			eval := func(addonName, expr string) (starlark.Value, error) {
+				ctx := context.Background()
+				if tc.dryRun {
+					ctx = addon.WithDryRun(ctx)
+				}
+				thread := &starlark.Thread{}
+				thread.SetLocal(addon.GoCtxKey, ctx)
+				thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+				thread.SetLocal(addon.NameKey, addonName)
+				return starlark.Eval(thread, t.Name(), expr, starlark.StringDict{"kube": k})
+			}
+
+			_, err = eval("namespaces", `kube.put_yaml(name="team", data=["""`+tc.namespace+`"""])`)
+			if err == nil {
+				_, err = eval("app", `kube.put_yaml(name="foo", namespace="team", data=["""`+configMap+`"""])`)
+			}
+			if tc.wantErr == "" && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			} else if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Fatalf("Want error containing %q, got: %v", tc.wantErr, err)
+			}
+
+			got, err := eval("check", `kube.exists(configmap="team/foo")`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != starlark.Bool(tc.wantCM) {
+				t.Errorf("Want ConfigMap applied: %v, got: %v", tc.wantCM, got)
+			}
+		})
+	}
+}
+
+func TestDefaultNamespace(t *testing.T) {
+	newKube, closeFn, err := NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	pkgs := skycfg.UnstablePredeclaredModules(&protoRegistry{})
+	addImports(t, pkgs)
+	pkgs["kube"] = newKube()
+
+	eval := func(defaultNamespace, expr string) (starlark.Value, error) {
+		thread := &starlark.Thread{}
+		thread.SetLocal(addon.GoCtxKey, context.Background())
+		thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+		thread.SetLocal(addon.NameKey, "app")
+		thread.SetLocal(addon.DefaultNamespaceKey, defaultNamespace)
+		return starlark.Eval(thread, t.Name(), expr, pkgs)
+	}
+
+	for _, expr := range []string{
+		`kube.put_yaml(name="yaml", data=["apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: yaml"])`,
+		`kube.put_yaml(name="explicit", data=["apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: explicit\n  namespace: other"])`,
+		`kube.put_yaml(name="arg", namespace="other", data=["apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: arg"])`,
+		`kube.put_yaml(name="cluster", data=["apiVersion: rbac.authorization.k8s.io/v1\nkind: ClusterRole\nmetadata:\n  name: cluster"])`,
+		`kube.put(name="proto", data=[corev1.ConfigMap()])`,
+		`kube.put(name="proto-arg", namespace="other", data=[corev1.ConfigMap()])`,
+	} {
+		if _, err := eval("team", expr); err != nil {
+			t.Fatalf("Failed to apply %s: %v", expr, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		expr string
+		want bool
+	}{
+		{expr: `kube.exists(configmap="team/yaml")`, want: true},
+		{expr: `kube.exists(configmap="other/explicit")`, want: true},
+		{expr: `kube.exists(configmap="team/explicit")`},
+		{expr: `kube.exists(configmap="other/arg")`, want: true},
+		{expr: `kube.exists(configmap="team/arg")`},
+		{expr: `kube.exists(clusterrole="cluster", api_group="rbac.authorization.k8s.io")`, want: true},
+		{expr: `kube.exists(configmap="team/proto")`, want: true},
+		{expr: `kube.exists(configmap="other/proto-arg")`, want: true},
+		{expr: `kube.exists(configmap="team/proto-arg")`},
+	} {
+		got, err := eval("", tc.expr)
+		if err != nil {
+			t.Fatalf("Failed to evaluate %s: %v", tc.expr, err)
+		}
+		if got != starlark.Bool(tc.want) {
+			t.Errorf("%s = %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+	k8syaml "sigs.k8s.io/yaml"
+)
+
+// DiffRule removes a field from both sides of the diff output so that noise
+// added by controllers or API server defaults doesn't show up as changes.
+type DiffRule struct {
+	// Path is a JSONPath-like path of the field, e.g
+	// `.metadata.annotations['deployment.kubernetes.io/revision']` or
+	// `.spec.ports[*].protocol`.
+	Path string `json:"path"`
+	// Value (if set) only removes the field if it has this value.
+	Value *string `json:"value,omitempty"`
+	// Kinds (if set) only removes the field from objects of these kinds.
+	Kinds []string `json:"kinds,omitempty"`
+
+	segments []pathSegment
+}
+
+// pathSegment is a map key or a list index (any index if wildcard) of a
+// parsed DiffRule.Path.
+type pathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// diffRulesFile is the format of the file loaded by LoadDiffRules.
+type diffRulesFile struct {
+	// Annotations are shorthands for rules removing annotations by key.
+	Annotations []string   `json:"annotations"`
+	Rules       []DiffRule `json:"rules"`
+}
+
+// defaultDiffRules normalize away noise commonly added by API server and
+// built-in controllers.
+var defaultDiffRules = mustDiffRules(
+	DiffRule{Path: ".metadata.annotations['kubectl.kubernetes.io/last-applied-configuration']"},
+	DiffRule{Path: ".metadata.annotations['deployment.kubernetes.io/revision']"},
+	DiffRule{Path: ".spec.ports[*].protocol", Value: strPtr("TCP"), Kinds: []string{"Service"}},
+	DiffRule{Path: ".spec.containers[*].ports[*].protocol", Value: strPtr("TCP"), Kinds: []string{"Pod"}},
+	DiffRule{Path: ".spec.template.spec.containers[*].ports[*].protocol", Value: strPtr("TCP")},
+	DiffRule{Path: ".spec.template.spec.initContainers[*].ports[*].protocol", Value: strPtr("TCP")},
+)
+
+func strPtr(s string) *string { return &s }
+
+func mustDiffRules(rules ...DiffRule) []DiffRule {
+	for i := range rules {
+		if err := rules[i].parse(); err != nil {
+			panic(err)
+		}
+	}
+	return rules
+}
+
+// LoadDiffRules loads diff rules from YAML file at path in the following
+// format:
+//
+//	annotations:
+//	- example.com/last-synced
+//	rules:
+//	- path: .spec.replicas
+//	  kinds: [Deployment]
+//	- path: .spec.template.spec.containers[*].imagePullPolicy
+//	  value: IfNotPresent
+func LoadDiffRules(path string) ([]DiffRule, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f diffRulesFile
+	if err := k8syaml.UnmarshalStrict(bs, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse `%s': %v", path, err)
+	}
+
+	var rules []DiffRule
+	for _, a := range f.Annotations {
+		rules = append(rules, DiffRule{Path: fmt.Sprintf(".metadata.annotations[%q]", a)})
+	}
+	rules = append(rules, f.Rules...)
+	for i := range rules {
+		if err := rules[i].parse(); err != nil {
+			return nil, fmt.Errorf("invalid rule in `%s': %v", path, err)
+		}
+	}
+	return rules, nil
+}
+
+// parse parses r.Path into r.segments.
+func (r *DiffRule) parse() error {
+	segs, err := parsePath(r.Path)
+	if err != nil {
+		return err
+	}
+	if segs[len(segs)-1].isIndex {
+		// Removing list items would shift the rest.
+		return fmt.Errorf("path `%s' must end with a field name", r.Path)
+	}
+	r.segments = segs
+	return nil
+}
+
+// parsePath parses JSONPath-like path into segments.
+func parsePath(path string) ([]pathSegment, error) {
+	p := strings.TrimSpace(path)
+	if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+		p = p[1 : len(p)-1]
+	}
+	p = strings.TrimPrefix(p, "$")
+
+	var segs []pathSegment
+	for len(p) > 0 {
+		switch {
+		case p[0] == '.':
+			p = p[1:]
+			end := strings.IndexAny(p, ".[")
+			if end < 0 {
+				end = len(p)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty key in path `%s'", path)
+			}
+			segs = append(segs, pathSegment{key: p[:end]})
+			p = p[end:]
+		case p[0] == '[':
+			end := strings.Index(p, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated `[' in path `%s'", path)
+			}
+			in := p[1:end]
+			p = p[end+1:]
+			switch {
+			case in == "*":
+				segs = append(segs, pathSegment{isIndex: true, wildcard: true})
+			case len(in) >= 2 && (in[0] == '\'' || in[0] == '"') && in[len(in)-1] == in[0]:
+				segs = append(segs, pathSegment{key: in[1 : len(in)-1]})
+			default:
+				i, err := strconv.Atoi(in)
+				if err != nil || i < 0 {
+					return nil, fmt.Errorf("invalid index `%s' in path `%s'", in, path)
+				}
+				segs = append(segs, pathSegment{isIndex: true, index: i})
+			}
+		case len(segs) == 0:
+			// Allow leading dot to be omitted.
+			p = "." + p
+		default:
+			return nil, fmt.Errorf("unexpected `%c' in path `%s'", p[0], path)
+		}
+	}
+	if len(segs) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+	return segs, nil
+}
+
+// appliesTo returns true if r applies to objects of kind.
+func (r *DiffRule) appliesTo(kind string) bool {
+	if len(r.Kinds) == 0 {
+		return true
+	}
+	for _, k := range r.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize removes fields matching rules from rendered YAML object obj.
+// Returns obj as-is if no rules apply.
+func normalize(obj string, rules []DiffRule) (string, error) {
+	if len(rules) == 0 || obj == "" {
+		return obj, nil
+	}
+
+	var m yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(obj), &m); err != nil {
+		return "", err
+	}
+	kind, _ := mapSliceGet(m, "kind").(string)
+
+	var changed bool
+	for _, r := range rules {
+		if !r.appliesTo(kind) {
+			continue
+		}
+		v, removed := removePath(m, r.segments, r.Value, true)
+		if removed {
+			m, _ = v.(yaml.MapSlice)
+			changed = true
+		}
+	}
+	if !changed {
+		return obj, nil
+	}
+
+	bs, err := yaml.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
+
+func mapSliceGet(m yaml.MapSlice, key string) interface{} {
+	for _, item := range m {
+		if k, ok := item.Key.(string); ok && k == key {
+			return item.Value
+		}
+	}
+	return nil
+}
+
+// removePath removes the field at segs within v if it matches value (any
+// value if nil). Maps emptied by the removal are removed as well (unless top
+// level fields of the object, which are always rendered). Returns updated v
+// and true if anything was removed.
+func removePath(v interface{}, segs []pathSegment, value *string, top bool) (interface{}, bool) {
+	seg, rest := segs[0], segs[1:]
+
+	if seg.isIndex {
+		l, ok := v.([]interface{})
+		if !ok {
+			return v, false
+		}
+		var removed bool
+		out := make([]interface{}, len(l))
+		copy(out, l)
+		for i := range out {
+			if !seg.wildcard && i != seg.index {
+				continue
+			}
+			var r bool
+			if out[i], r = removePath(out[i], rest, value, false); r {
+				removed = true
+			}
+		}
+		return out, removed
+	}
+
+	m, ok := v.(yaml.MapSlice)
+	if !ok {
+		return v, false
+	}
+	var removed bool
+	out := make(yaml.MapSlice, 0, len(m))
+	for _, item := range m {
+		if k, ok := item.Key.(string); !ok || k != seg.key {
+			out = append(out, item)
+			continue
+		}
+		if len(rest) == 0 {
+			if value == nil || fmt.Sprint(item.Value) == *value {
+				removed = true
+				continue
+			}
+			out = append(out, item)
+			continue
+		}
+
+		nv, r := removePath(item.Value, rest, value, false)
+		if !r {
+			out = append(out, item)
+			continue
+		}
+		removed = true
+		if nm, ok := nv.(yaml.MapSlice); ok && len(nm) == 0 && !top {
+			continue
+		}
+		out = append(out, yaml.MapItem{Key: item.Key, Value: nv})
+	}
+	return out, removed
+}
@@ -0,0 +1,211 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const normalizeObj = `kind: Deployment
+apiVersion: apps/v1
+metadata:
+  name: foo
+  annotations:
+    deployment.kubernetes.io/revision: "3"
+    kubectl.kubernetes.io/last-applied-configuration: '{}'
+spec:
+  replicas: 3
+  template:
+    spec:
+      containers:
+      - name: nginx
+        ports:
+        - containerPort: 80
+          protocol: TCP
+        - containerPort: 53
+          protocol: UDP
+`
+
+func TestNormalize(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		rules []DiffRule
+		want  string
+	}{
+		{
+			name:  "No rules",
+			rules: nil,
+			want:  normalizeObj,
+		},
+		{
+			name:  "Default rules",
+			rules: defaultDiffRules,
+			want: multiline(
+				"kind: Deployment",
+				"apiVersion: apps/v1",
+				"metadata:",
+				"  name: foo",
+				"spec:",
+				"  replicas: 3",
+				"  template:",
+				"    spec:",
+				"      containers:",
+				"      - name: nginx",
+				"        ports:",
+				"        - containerPort: 80",
+				"        - containerPort: 53",
+				"          protocol: UDP",
+				""),
+		},
+		{
+			name:  "Leading dot and brackets",
+			rules: mustDiffRules(DiffRule{Path: `{$.spec["replicas"]}`}, DiffRule{Path: "spec.template.spec.containers[0].name"}),
+			want: multiline(
+				"kind: Deployment",
+				"apiVersion: apps/v1",
+				"metadata:",
+				"  name: foo",
+				"  annotations:",
+				"    deployment.kubernetes.io/revision: \"3\"",
+				"    kubectl.kubernetes.io/last-applied-configuration: '{}'",
+				"spec:",
+				"  template:",
+				"    spec:",
+				"      containers:",
+				"      - ports:",
+				"        - containerPort: 80",
+				"          protocol: TCP",
+				"        - containerPort: 53",
+				"          protocol: UDP",
+				""),
+		},
+		{
+			name:  "Other kinds untouched",
+			rules: mustDiffRules(DiffRule{Path: ".spec.replicas", Kinds: []string{"StatefulSet"}}),
+			want:  normalizeObj,
+		},
+		{
+			name:  "Value mismatch untouched",
+			rules: mustDiffRules(DiffRule{Path: ".spec.replicas", Value: strPtr("1")}),
+			want:  normalizeObj,
+		},
+		{
+			name:  "Missing path untouched",
+			rules: mustDiffRules(DiffRule{Path: ".spec.selector.matchLabels"}),
+			want:  normalizeObj,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := normalize(normalizeObj, tc.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected normalized object (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestParseDiffRule(t *testing.T) {
+	for _, tc := range []struct {
+		path    string
+		want    []pathSegment
+		wantErr bool
+	}{
+		{
+			path: ".metadata.annotations['example.com/foo']",
+			want: []pathSegment{{key: "metadata"}, {key: "annotations"}, {key: "example.com/foo"}},
+		},
+		{
+			path: "spec.ports[*].protocol",
+			want: []pathSegment{{key: "spec"}, {key: "ports"}, {isIndex: true, wildcard: true}, {key: "protocol"}},
+		},
+		{
+			path: "{$.spec.containers[1].name}",
+			want: []pathSegment{{key: "spec"}, {key: "containers"}, {isIndex: true, index: 1}, {key: "name"}},
+		},
+		{path: ".spec.containers[*]", wantErr: true},
+		{path: "", wantErr: true},
+		{path: ".spec..replicas", wantErr: true},
+		{path: ".spec[foo]", wantErr: true},
+		{path: ".spec[0", wantErr: true},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			r := DiffRule{Path: tc.path}
+			err := r.parse()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if d := cmp.Diff(tc.want, r.segments, cmp.AllowUnexported(pathSegment{})); d != "" {
+				t.Errorf("Unexpected segments (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestLoadDiffRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isopod-diff-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules.yaml")
+	data := `
+annotations:
+- example.com/last-synced
+rules:
+- path: .spec.replicas
+  kinds: [Deployment]
+- path: .spec.template.spec.containers[*].imagePullPolicy
+  value: IfNotPresent
+`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadDiffRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, r := range rules {
+		paths = append(paths, r.Path)
+	}
+	want := []string{
+		`.metadata.annotations["example.com/last-synced"]`,
+		".spec.replicas",
+		".spec.template.spec.containers[*].imagePullPolicy",
+	}
+	if d := cmp.Diff(want, paths); d != "" {
+		t.Errorf("Unexpected rules (-want +got):\n%s", d)
+	}
+	if v := rules[2].Value; v == nil || *v != "IfNotPresent" {
+		t.Errorf("Unexpected value of rule: %v", v)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("rules:\n- path: .spec[\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDiffRules(path); err == nil {
+		t.Error("Expected invalid rule to fail")
+	}
+}
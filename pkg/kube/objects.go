@@ -0,0 +1,48 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+// objectCountKey is the key of a thread-local int value counting objects
+// passed to kube.put, kube.put_yaml and helm.apply by the addon running on the
+// thread. Since each addon run uses its own thread, counts don't carry over
+// from previews (e.g in --interactive mode).
+const objectCountKey = "kube_object_count"
+
+// countObjects adds n objects about to be applied to the count of the addon
+// running on t and fails (before any of these is applied) if that exceeds
+// max_objects of the addon or maxObjectsPerAddon (if positive).
+func (m *kubePackage) countObjects(t *starlark.Thread, n int) error {
+	max, flag := m.maxObjectsPerAddon, "--max_objects_per_addon"
+	if v, ok := t.Local(addon.MaxObjectsKey).(int); ok && v > 0 {
+		max, flag = v, "max_objects of the addon"
+	}
+	count, _ := t.Local(objectCountKey).(int)
+	count += n
+	t.SetLocal(objectCountKey, count)
+
+	if max > 0 && count > max {
+		addonName, _ := t.Local(addon.NameKey).(string)
+		return fmt.Errorf("addon `%s' produced %d objects, which exceeds the limit of %d (%s)", addonName, count, max, flag)
+	}
+	return nil
+}
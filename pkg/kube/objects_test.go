@@ -0,0 +1,82 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+const objectsSrc = `
+def cm(name):
+    return """
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+  namespace: default
+""" % name
+
+kube.put_yaml(name="a", data=[cm("a"), cm("b")])
+kube.put_yaml(name="c", data=[cm("c"), cm("d")])
+`
+
+func TestMaxObjects(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		global, perAddon int
+		wantErr          string
+	}{
+		{name: "No limit"},
+		{name: "Within global limit", global: 4},
+		{name: "Global limit exceeded", global: 3, wantErr: "addon `app' produced 4 objects, which exceeds the limit of 3 (--max_objects_per_addon)"},
+		{name: "Addon limit takes precedence", global: 3, perAddon: 10},
+		{name: "Addon limit exceeded", global: 10, perAddon: 2, wantErr: "exceeds the limit of 2 (max_objects of the addon)"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newKube, closeFn, err := NewFakePackages()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeFn()
+			k := newKube(WithMaxObjectsPerAddon(tc.global))
+
+			thread := &starlark.Thread{}
+			thread.SetLocal(addon.GoCtxKey, context.Background())
+			thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+			thread.SetLocal(addon.NameKey, "app")
+			thread.SetLocal(addon.MaxObjectsKey, tc.perAddon)
+			_, err = starlark.ExecFile(thread, t.Name(), objectsSrc, starlark.StringDict{"kube": k})
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Expected error containing %q, got: %v", tc.wantErr, err)
+			}
+			// Objects of the call exceeding the limit are not applied.
+			if n := len(k.(Pruner).Applied("app")); n != 2 {
+				t.Errorf("Got %d objects applied, want 2", n)
+			}
+		})
+	}
+}
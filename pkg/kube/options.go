@@ -0,0 +1,311 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/cruise-automation/isopod/pkg/image"
+	"github.com/cruise-automation/isopod/pkg/policy"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// Option is an interface that applies (enables) a specific option to the
+// kube package.
+type Option interface {
+	apply(*kubePackage)
+}
+
+type fnOption func(*kubePackage)
+
+func (fn fnOption) apply(m *kubePackage) { fn(m) }
+
+// WithCoexistAnnotations returns an Option that stamps as on every object
+// applied by the kube package (unless the object already sets the key). This
+// allows other controllers (e.g ArgoCD or Flux) to ignore Isopod-owned
+// objects. These annotations are excluded from the diff output.
+func WithCoexistAnnotations(as map[string]string) Option {
+	return fnOption(func(m *kubePackage) {
+		m.coexistAnnotations = as
+	})
+}
+
+// WithGitProvenance returns an Option that annotates every object applied by
+// the kube package with commit and branch (if not empty) of the entry file,
+// and whether its work tree was dirty, so that live state can be traced back
+// to the commit that produced it. These annotations are excluded from the
+// diff output, so moving to another commit doesn't show every object as
+// changed.
+func WithGitProvenance(commit, branch string, dirty bool) Option {
+	return fnOption(func(m *kubePackage) {
+		as := map[string]string{gitCommitAnnotationKey: commit}
+		if branch != "" {
+			as[gitBranchAnnotationKey] = branch
+		}
+		if dirty {
+			as[gitDirtyAnnotationKey] = "true"
+		}
+		m.provenanceAnnotations = as
+	})
+}
+
+// WithInstanceID returns an Option that labels every object applied by the
+// kube package with id so that objects owned by different Isopod instances
+// sharing a namespace can be told apart.
+func WithInstanceID(id string) Option {
+	return fnOption(func(m *kubePackage) {
+		m.instanceID = id
+	})
+}
+
+// WithApplySet returns an Option that manages objects applied by each addon
+// as an ApplySet (see KEP-3659) with a parent Secret in namespace, so that other tools (e.g `kubectl apply
+// --prune --applyset') understand which objects belong to the addon. Prune
+// lists live objects of an addon through its ApplySet parent.
+func WithApplySet(namespace string) Option {
+	return fnOption(func(m *kubePackage) {
+		m.applySetNamespace = namespace
+	})
+}
+
+// WithVerboseDiff returns an Option that makes the diff output confirm
+// objects that match their live state instead of only listing their names.
+func WithVerboseDiff(verbose bool) Option {
+	return fnOption(func(m *kubePackage) {
+		m.verboseDiff = verbose
+	})
+}
+
+// WithDiffOnlyChanged returns an Option that omits objects that match their
+// live state from the diff output (even if verbose) and prints a header
+// naming the addon and the cluster before the diff of each addon that
+// changes anything.
+func WithDiffOnlyChanged(enabled bool) Option {
+	return fnOption(func(m *kubePackage) {
+		m.diffOnlyChanged = enabled
+	})
+}
+
+// WithDiffMaxLines returns an Option that prints at most n lines of the diff
+// of each object followed by the number of lines left out. No limit if n is
+// not positive.
+func WithDiffMaxLines(n int) Option {
+	return fnOption(func(m *kubePackage) {
+		m.diffMaxLines = n
+	})
+}
+
+// WithDiffRules returns an Option that removes fields matching rules (in
+// addition to the built-in ones) from both sides of the diff output.
+func WithDiffRules(rules []DiffRule) Option {
+	return fnOption(func(m *kubePackage) {
+		m.diffRules = append(append([]DiffRule{}, defaultDiffRules...), rules...)
+	})
+}
+
+// WithDiscoveryCache returns an Option that discovers API resources of the
+// cluster through c, reusing those of clusters with the same fingerprint and
+// memoizing them for the cluster. Kinds that fail to map are looked up again
+// after discovering the cluster anew.
+func WithDiscoveryCache(c *DiscoveryCache) Option {
+	return fnOption(func(m *kubePackage) {
+		m.dClient = &cachedDiscovery{DiscoveryInterface: m.dClient, cache: c}
+	})
+}
+
+// WithSecurityDiff returns an Option that limits the diff output to the
+// kinds and fields selected by f, omitting objects without changes to them.
+// Full diff if f is nil.
+func WithSecurityDiff(f *SecurityFilter) Option {
+	return fnOption(func(m *kubePackage) {
+		m.securityDiff = f
+	})
+}
+
+// WithServerDryRun returns an Option that also sends objects applied in dry
+// run mode to the API server with server-side dry run so that validation and
+// admission webhooks get to reject them. Rejections are attributed to the
+// webhook (and its configuration) responsible where possible.
+func WithServerDryRun(enabled bool) Option {
+	return fnOption(func(m *kubePackage) {
+		m.serverDryRun = enabled
+	})
+}
+
+// WithWriteLastApplied returns an Option that stamps the
+// kubectl.kubernetes.io/last-applied-configuration annotation on applied
+// objects (like kubectl apply does) so that client-side three-way merges of
+// kubectl apply on the same objects behave. The annotation is excluded from
+// the diff output.
+func WithWriteLastApplied(enabled bool) Option {
+	return fnOption(func(m *kubePackage) {
+		m.writeLastApplied = enabled
+	})
+}
+
+// WithApplyBatchSize returns an Option that applies up to n objects passed
+// to a single kube.put or kube.put_yaml call concurrently. Namespaces and
+// CRDs act as barriers: they are applied only after all objects preceding
+// them and before any object that follows.
+func WithApplyBatchSize(n int) Option {
+	return fnOption(func(m *kubePackage) {
+		m.applyBatchSize = n
+	})
+}
+
+// WithPolicy returns an Option that checks every object against the
+// policies of c right before it is applied (also in dry run), failing
+// objects that violate a policy that denies them.
+func WithPolicy(c *policy.Checker) Option {
+	return fnOption(func(m *kubePackage) {
+		m.policy = c
+	})
+}
+
+// WithConflictRetries returns an Option that retries updates rejected
+// because the live object was modified since it was read (e.g by a
+// controller) up to n times, each time re-reading the live object and
+// re-applying the desired state on top of it. Conflicts fail the update
+// right away if n is not positive.
+func WithConflictRetries(n int) Option {
+	return fnOption(func(m *kubePackage) {
+		m.conflictRetries = n
+	})
+}
+
+// WithMaxObjectsPerAddon returns an Option that fails kube.put, kube.put_yaml
+// and helm.apply (before applying anything) once the objects passed to them
+// by a single addon run exceed n in total, unless the addon sets its own
+// max_objects. No limit if n is not positive.
+func WithMaxObjectsPerAddon(n int) Option {
+	return fnOption(func(m *kubePackage) {
+		m.maxObjectsPerAddon = n
+	})
+}
+
+// WithDeleteCRDs returns an Option that allows kube.delete to remove
+// CustomResourceDefinitions. Disabled by default since removing a CRD also
+// removes all of its custom resources cluster-wide.
+func WithDeleteCRDs(enabled bool) Option {
+	return fnOption(func(m *kubePackage) {
+		m.deleteCRDs = enabled
+	})
+}
+
+// WithDeleteTimeout returns an Option that makes kube.delete wait up to
+// timeout (if positive) for each deleted object to be gone so that objects
+// stuck on finalizers don't go unnoticed. Finalizers of objects still present
+// by then are removed if forceFinalizers is set, kube.delete fails otherwise.
+func WithDeleteTimeout(timeout time.Duration, forceFinalizers bool) Option {
+	return fnOption(func(m *kubePackage) {
+		m.deleteTimeout = timeout
+		m.forceFinalizers = forceFinalizers
+	})
+}
+
+// WithMaxRequestsDelta returns an Option that fails applying once the total
+// change in requested CPU or memory of the applied workloads (see
+// RequestsCounter) exceeds the corresponding max.
+func WithMaxRequestsDelta(max corev1.ResourceList) Option {
+	return fnOption(func(m *kubePackage) {
+		m.maxRequestsDelta = max
+	})
+}
+
+// WithApplyOrder returns an Option that applies objects of a single call in
+// order o ranks them in (instead of DefaultApplyOrder). Objects are applied
+// in the order given if o is nil.
+func WithApplyOrder(o *ApplyOrder) Option {
+	return fnOption(func(m *kubePackage) {
+		m.applyOrder = o
+	})
+}
+
+// WithSnapshot returns an Option that writes the live state of each object
+// to dir before it is first updated or deleted within a run (e.g to restore
+// or diff against it later), as <dir>/<host>/<addon>/<namespace>/<file>.yaml.
+// Objects created within the run are listed in <dir>/<host>/<addon> (see
+// Restorer). Secret data is redacted unless secrets is set. Objects that would make
+// snapshots exceed maxBytes in total (if positive) are skipped with a
+// warning.
+func WithSnapshot(dir string, maxBytes int64, secrets bool) Option {
+	return fnOption(func(m *kubePackage) {
+		m.snapshot = &snapshotter{dir: dir, maxBytes: maxBytes, secrets: secrets}
+	})
+}
+
+// WithDiffRecorder returns an Option that calls record with the diff output
+// of each object (along with the name of the addon applying it) in addition
+// to writing it to stdout, e.g to store the diff for review. Calls are
+// serialized.
+func WithDiffRecorder(record func(addonName, out string)) Option {
+	return fnOption(func(m *kubePackage) {
+		m.diffRecord = record
+	})
+}
+
+// WithApplyProfile returns an Option that records how long applying each
+// object takes in p, attributed to cluster (e.g to find the slowest objects
+// across all clusters once done).
+func WithApplyProfile(p *ApplyProfile, cluster string) Option {
+	return fnOption(func(m *kubePackage) {
+		m.applyProfile = p
+		m.applyCluster = cluster
+	})
+}
+
+// WithRegistryRewrites returns an Option that rewrites registries of image
+// references of containers in Pod specs, as well as at paths, of objects
+// about to be applied with rewrites (keeping tags and digests).
+func WithRegistryRewrites(rewrites []image.RegistryRewrite, paths []ImagePath) Option {
+	return fnOption(func(m *kubePackage) {
+		m.registryRewrites = rewrites
+		m.imagePaths = paths
+	})
+}
+
+// WithCircuitBreaker returns an Option that records objects failing to
+// apply on cluster in c and fails objects whose circuit c opened without
+// applying them.
+func WithCircuitBreaker(c *CircuitBreaker, cluster string) Option {
+	return fnOption(func(m *kubePackage) {
+		m.circuitBreaker = c
+		m.applyCluster = cluster
+	})
+}
+
+// WithRenderRecorder returns an Option that calls record with the YAML (with
+// Secret data redacted and normalized with diff rules) of each named object
+// about to be applied, along with the name of the addon applying it, e.g to
+// compare objects rendered for different clusters. If raw is set, objects are
+// rendered as-is instead minus the labels and annotations stamped by Isopod
+// (e.g to export them). Calls may be concurrent.
+func WithRenderRecorder(record func(addonName string, ref store.ObjRef, rendered string), raw bool) Option {
+	return fnOption(func(m *kubePackage) {
+		m.renderRecord = record
+		m.renderRaw = raw
+	})
+}
+
+// WithObjectFilter returns an Option that only applies, deletes and prunes
+// objects that f returns True for. Objects filtered out are reported as
+// skipped (and kept by prune).
+func WithObjectFilter(f *ObjectFilter) Option {
+	return fnOption(func(m *kubePackage) {
+		m.objectFilter = f
+	})
+}
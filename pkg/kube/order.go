@@ -0,0 +1,163 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// DefaultApplyOrder is the order objects are applied in unless overridden
+// with WithApplyOrder: namespaces and CRDs first so that objects in or of
+// them can be applied, webhooks last so that they don't intercept objects
+// of the same addon (e.g their own Deployment) before it is up.
+const DefaultApplyOrder = "namespaces,crds,rbac,config,*,webhooks"
+
+// applyCategories match kinds of each category of ApplyOrder.
+var applyCategories = map[string]func(gvk schema.GroupVersionKind) bool{
+	"namespaces": func(gvk schema.GroupVersionKind) bool {
+		return gvk.Group == "" && gvk.Kind == "Namespace"
+	},
+	"crds": isCRD,
+	"rbac": func(gvk schema.GroupVersionKind) bool {
+		return gvk.Group == "rbac.authorization.k8s.io" || (gvk.Group == "" && gvk.Kind == "ServiceAccount")
+	},
+	"config": func(gvk schema.GroupVersionKind) bool {
+		return gvk.Group == "" && (gvk.Kind == "ConfigMap" || gvk.Kind == "Secret")
+	},
+	"webhooks": isWebhook,
+}
+
+var defaultApplyOrder = mustParseApplyOrder(DefaultApplyOrder)
+
+// ApplyOrder ranks objects by kind. Objects of a single kube.put_yaml call
+// (e.g rendered by helm.apply) are applied by rank, keeping the order given
+// among objects of equal rank, and pruned in reverse.
+type ApplyOrder struct {
+	// categories and kinds map entries to their rank. Kinds are keyed by
+	// Kind.group (Kind only if matching all groups).
+	categories, kinds map[string]int
+	// other is the rank of objects not matching any entry ("*").
+	other int
+}
+
+// ParseApplyOrder parses comma-separated s listing categories (namespaces,
+// crds, rbac, config or webhooks), kinds as Kind or Kind.group (e.g
+// PriorityClass.scheduling.k8s.io) and * (everything else) in the order
+// objects matching them are applied in. Kinds take precedence over
+// categories. Objects not matching any entry go last if * is not listed.
+// Returns nil (objects are applied in the order given) if s is empty.
+func ParseApplyOrder(s string) (*ApplyOrder, error) {
+	if s == "" {
+		return nil, nil
+	}
+	entries := strings.Split(s, ",")
+	o := &ApplyOrder{
+		categories: map[string]int{},
+		kinds:      map[string]int{},
+		other:      len(entries),
+	}
+	seen := map[string]bool{}
+	for i, e := range entries {
+		e = strings.TrimSpace(e)
+		if seen[e] {
+			return nil, fmt.Errorf("`%s' is listed more than once", e)
+		}
+		seen[e] = true
+		switch _, ok := applyCategories[e]; {
+		case e == "*":
+			o.other = i
+		case ok:
+			o.categories[e] = i
+		case e != "" && unicode.IsUpper(rune(e[0])):
+			o.kinds[e] = i
+		default:
+			return nil, fmt.Errorf("unknown category `%s' (expected namespaces, crds, rbac, config, webhooks, * or Kind[.group])", e)
+		}
+	}
+	return o, nil
+}
+
+func mustParseApplyOrder(s string) *ApplyOrder {
+	o, err := ParseApplyOrder(s)
+	if err != nil {
+		panic(err)
+	}
+	return o
+}
+
+// rank returns the rank of objects of gvk (0 if o is nil).
+func (o *ApplyOrder) rank(gvk schema.GroupVersionKind) int {
+	if o == nil {
+		return 0
+	}
+	if r, ok := o.kinds[gvk.GroupKind().String()]; ok {
+		return r
+	}
+	if r, ok := o.kinds[gvk.Kind]; ok {
+		return r
+	}
+	best, found := 0, false
+	for c, r := range o.categories {
+		if applyCategories[c](gvk) && (!found || r < best) {
+			best, found = r, true
+		}
+	}
+	if found {
+		return best
+	}
+	return o.other
+}
+
+// orderedIndices returns indices of YAML objects in data in the order they
+// are applied in. Items that fail to decode rank as objects not matching any
+// entry (the error is reported once they are applied).
+func (m *kubePackage) orderedIndices(data *starlark.List) []int {
+	idx := make([]int, data.Len())
+	ranks := make([]int, data.Len())
+	for i := range idx {
+		idx[i] = i
+		var gvk schema.GroupVersionKind
+		if s, ok := starlark.AsString(data.Index(i)); ok {
+			if _, g, err := decode([]byte(s)); err == nil {
+				gvk = *g
+			}
+		}
+		ranks[i] = m.applyOrder.rank(gvk)
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return ranks[idx[i]] < ranks[idx[j]] })
+	return idx
+}
+
+// sortByApplyOrder sorts refs by the rank of their kinds, keeping the order
+// of refs of equal rank (so that deleting them in reverse undoes applying
+// them in order).
+func (m *kubePackage) sortByApplyOrder(refs []store.ObjRef) {
+	sort.SliceStable(refs, func(i, j int) bool {
+		return m.applyOrder.rank(refGVK(refs[i])) < m.applyOrder.rank(refGVK(refs[j]))
+	})
+}
+
+func refGVK(ref store.ObjRef) schema.GroupVersionKind {
+	gv, _ := schema.ParseGroupVersion(ref.APIVersion)
+	return gv.WithKind(ref.Kind)
+}
@@ -0,0 +1,173 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+func TestParseApplyOrder(t *testing.T) {
+	var (
+		ns      = schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}
+		crd     = schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"}
+		role    = schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}
+		sa      = schema.GroupVersionKind{Version: "v1", Kind: "ServiceAccount"}
+		cm      = schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+		deploy  = schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+		webhook = schema.GroupVersionKind{Group: "admissionregistration.k8s.io", Version: "v1", Kind: "ValidatingWebhookConfiguration"}
+		prio    = schema.GroupVersionKind{Group: "scheduling.k8s.io", Version: "v1", Kind: "PriorityClass"}
+	)
+	all := []schema.GroupVersionKind{ns, crd, role, sa, cm, deploy, webhook, prio}
+
+	for _, tc := range []struct {
+		name      string
+		order     string
+		wantRanks []int
+		wantErr   string
+	}{
+		{
+			name:      "Default",
+			order:     DefaultApplyOrder,
+			wantRanks: []int{0, 1, 2, 2, 3, 4, 5, 4},
+		},
+		{
+			name:      "Kinds before categories",
+			order:     "PriorityClass.scheduling.k8s.io,namespaces,ServiceAccount,rbac,*",
+			wantRanks: []int{1, 4, 3, 2, 4, 4, 4, 0},
+		},
+		{
+			name:      "Others last",
+			order:     "webhooks,crds",
+			wantRanks: []int{2, 1, 2, 2, 2, 2, 0, 2},
+		},
+		{
+			name:      "Disabled",
+			wantRanks: []int{0, 0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:    "Unknown category",
+			order:   "namespaces,pods",
+			wantErr: "unknown category `pods'",
+		},
+		{
+			name:    "Duplicate",
+			order:   "crds,*,crds",
+			wantErr: "`crds' is listed more than once",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o, err := ParseApplyOrder(tc.order)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Expected error containing %q, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to parse `%s': %v", tc.order, err)
+			}
+			var ranks []int
+			for _, gvk := range all {
+				ranks = append(ranks, o.rank(gvk))
+			}
+			if d := cmp.Diff(tc.wantRanks, ranks); d != "" {
+				t.Errorf("Unexpected ranks (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestOrderedIndices(t *testing.T) {
+	objs := []string{
+		"apiVersion: admissionregistration.k8s.io/v1beta1\nkind: ValidatingWebhookConfiguration\nmetadata:\n  name: guard",
+		"apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: app",
+		"not: [valid",
+		"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config",
+		"apiVersion: v1\nkind: Namespace\nmetadata:\n  name: app",
+		"apiVersion: v1\nkind: Service\nmetadata:\n  name: app",
+	}
+	var vs []starlark.Value
+	for _, o := range objs {
+		vs = append(vs, starlark.String(o))
+	}
+	data := starlark.NewList(vs)
+
+	for _, tc := range []struct {
+		name  string
+		order *ApplyOrder
+		want  []int
+	}{
+		{
+			name:  "Default",
+			order: defaultApplyOrder,
+			want:  []int{4, 3, 1, 2, 5, 0},
+		},
+		{
+			name: "Disabled",
+			want: []int{0, 1, 2, 3, 4, 5},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &kubePackage{applyOrder: tc.order}
+			if d := cmp.Diff(tc.want, m.orderedIndices(data)); d != "" {
+				t.Errorf("Unexpected order (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestPutYamlDryRunOrderAfterUnservedKind(t *testing.T) {
+	newKube, closeFn, err := NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+	var out strings.Builder
+	k := newKube(WithDiffRecorder(func(_, s string) { out.WriteString(s) }))
+
+	data := starlark.NewList([]starlark.Value{
+		starlark.String("apiVersion: admissionregistration.k8s.io/v1beta1\nkind: ValidatingWebhookConfiguration\nmetadata:\n  name: guard"),
+		starlark.String("apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: w\n  namespace: default"),
+		starlark.String("apiVersion: v1\nkind: Service\nmetadata:\n  name: app\n  namespace: default"),
+	})
+	thread := &starlark.Thread{}
+	thread.SetLocal(addon.GoCtxKey, addon.WithDryRun(context.Background()))
+	thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+	thread.SetLocal(addon.NameKey, "app")
+	env := starlark.StringDict{"kube": k, "data": data}
+	if _, err := starlark.Eval(thread, t.Name(), "kube.put_yaml(data=data)", env); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	// Objects ranked after the unserved Widget are still diffed in order.
+	var got []string
+	for _, l := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(l, "*** ") {
+			got = append(got, strings.Fields(l)[1])
+		}
+	}
+	want := []string{"widget.example.com", "service.v1", "validatingwebhookconfiguration.admissionregistration.k8s.io"}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("Unexpected diffed objects (-want +got):\n%s", d)
+	}
+}
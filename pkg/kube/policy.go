@@ -0,0 +1,50 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/cruise-automation/isopod/pkg/redact"
+)
+
+// passesPolicy evaluates policies of m.policy (if set) against obj right
+// before r is applied as obj. Fails if obj violates a policy that denies
+// it, warnings are logged.
+func (m *kubePackage) passesPolicy(ctx context.Context, r *apiResource, obj runtime.Object) error {
+	if m.policy == nil {
+		return nil
+	}
+
+	un, err := toUnstructured(obj)
+	if err != nil {
+		return fmt.Errorf("failed to check %v against policies: %v", r, err)
+	}
+	un.SetAPIVersion(r.GVK.GroupVersion().String())
+	un.SetKind(r.GVK.Kind)
+
+	warnings, err := m.policy.Check(ctx, un.Object)
+	for _, w := range warnings {
+		log.Warningf("%v: %s", r, redact.String(w))
+	}
+	if err != nil {
+		return fmt.Errorf("%v %s", r, redact.String(err.Error()))
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/policy"
+)
+
+func TestPutYamlPolicy(t *testing.T) {
+	newKube, closeFn, err := NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	// Denies ConfigMaps named `bad' and requires the heritage label (set by
+	// the kube package) so that the object is checked as applied.
+	eval := func(ctx context.Context, input []byte) ([]policy.Violation, error) {
+		var obj struct {
+			APIVersion string `json:"apiVersion"`
+			Kind       string `json:"kind"`
+			Metadata   struct {
+				Name   string            `json:"name"`
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(input, &obj); err != nil {
+			return nil, err
+		}
+		var vs []policy.Violation
+		if obj.APIVersion != "v1" || obj.Kind != "ConfigMap" {
+			vs = append(vs, policy.Violation{Policy: "types", Rule: "deny", Msg: "unexpected type " + obj.APIVersion + "/" + obj.Kind})
+		}
+		if obj.Metadata.Labels["heritage"] != "isopod" {
+			vs = append(vs, policy.Violation{Policy: "labels", Rule: "deny", Msg: "missing heritage label"})
+		}
+		if obj.Metadata.Name == "bad" {
+			vs = append(vs, policy.Violation{Policy: "names", Rule: "deny", Msg: "name `bad' is reserved"})
+		}
+		return vs, nil
+	}
+	k := newKube(WithPolicy(policy.NewChecker("policies", "", policy.ModeDeny, policy.WithEvaluator(eval))))
+
+	exec := func(src string) error {
+		thread := &starlark.Thread{}
+		thread.SetLocal(addon.GoCtxKey, context.Background())
+		thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+		thread.SetLocal(addon.NameKey, "app")
+		_, err := starlark.ExecFile(thread, t.Name(), src, starlark.StringDict{"kube": k})
+		return err
+	}
+	cm := func(name string) string {
+		return `"""
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ` + name + `
+  namespace: default
+"""`
+	}
+
+	if err := exec(`kube.put_yaml(name="good", data=[` + cm("good") + `])`); err != nil {
+		t.Fatalf("Failed to apply object passing policies: %v", err)
+	}
+
+	err = exec(`kube.put_yaml(name="bad", data=[` + cm("bad") + `])`)
+	if err == nil {
+		t.Fatal("Expected object violating policy to fail")
+	}
+	if want := "configmap.v1 `default/bad' violates policy `names': name `bad' is reserved"; !strings.Contains(err.Error(), want) {
+		t.Errorf("Unexpected error, want it to contain %q, got: %v", want, err)
+	}
+	if err := exec(`
+def check():
+    if kube.exists(configmap="default/bad"):
+        fail("object violating policy was applied")
+
+check()
+`); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,379 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// Pruner is implemented by the kube package to delete objects that addons no
+// longer apply (e.g a template removed from a Helm chart).
+type Pruner interface {
+	// Applied returns references to all objects applied by addonName so far
+	// (in the order they were first applied).
+	Applied(addonName string) []store.ObjRef
+
+	// Prune deletes objects in prev (e.g applied by the live rollout) that
+	// addonName no longer applies. Objects no longer labeled as applied by
+	// addonName (and by this instance if WithInstanceID is set) are kept.
+	Prune(ctx context.Context, addonName string, prev []store.ObjRef) error
+}
+
+// recordApplied records r as applied by addonName. Objects relying on
+// .metadata.generateName (pruned separately) and subresources are ignored.
+func (m *kubePackage) recordApplied(addonName string, r *apiResource) {
+	if r.Name == "" || r.Subresource != "" {
+		return
+	}
+	ref := store.ObjRef{
+		APIVersion: r.GVK.GroupVersion().String(),
+		Kind:       r.GVK.Kind,
+		Namespace:  r.Namespace,
+		Name:       r.Name,
+	}
+
+	m.appliedMu.Lock()
+	defer m.appliedMu.Unlock()
+
+	// Same object may be applied more than once (e.g when previewed first).
+	for _, a := range m.applied[addonName] {
+		if a == ref {
+			return
+		}
+	}
+	if m.applied == nil {
+		m.applied = map[string][]store.ObjRef{}
+	}
+	m.applied[addonName] = append(m.applied[addonName], ref)
+}
+
+// Applied implements Pruner.
+func (m *kubePackage) Applied(addonName string) []store.ObjRef {
+	m.appliedMu.Lock()
+	defer m.appliedMu.Unlock()
+	return append([]store.ObjRef(nil), m.applied[addonName]...)
+}
+
+// Prune implements Pruner. Besides prev, live members of the ApplySet of
+// addonName (if WithApplySet is set) are pruned too. Objects are deleted in
+// reverse of the apply order of their kinds (see WithApplyOrder), then of the
+// order they were applied in (e.g webhooks go first and namespaces last).
+// Objects skipped by their guards are kept. In dry run mode objects that
+// would be deleted are listed once the addon is done, along with live objects
+// labeled as applied by addonName that are missing from prev (e.g applied by
+// a run that failed before recording them), which are never pruned.
+func (m *kubePackage) Prune(ctx context.Context, addonName string, prev []store.ObjRef) error {
+	applied := map[string]bool{}
+	for _, ref := range m.Applied(addonName) {
+		applied[objKey(ref)] = true
+	}
+	for _, ref := range m.Skipped(addonName) {
+		applied[objKey(ref)] = true
+	}
+
+	candidates := prev
+	var unrecorded []string
+	members, fromApplySet, err := m.liveMembers(ctx, addonName)
+	if err != nil {
+		log.Warningf("Failed to list live objects of `%s' addon, pruning objects recorded in the store only: %v", addonName, err)
+	}
+	if fromApplySet {
+		candidates = withLabeled(prev, members)
+	} else {
+		recorded := map[string]bool{}
+		for _, ref := range prev {
+			recorded[objKey(ref)] = true
+		}
+		for _, ref := range m.ofAppliedKinds(addonName, prev, members) {
+			if k := objKey(ref); !recorded[k] && !applied[k] {
+				unrecorded = append(unrecorded, refDisplayName(ref))
+			}
+		}
+	}
+	m.sortByApplyOrder(candidates)
+
+	var errs, pruned []string
+	for i := len(candidates) - 1; i >= 0; i-- {
+		ref := candidates[i]
+		if applied[objKey(ref)] {
+			continue
+		}
+		ok, err := m.pruneObj(ctx, addonName, ref)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s `%s': %v", strings.ToLower(ref.Kind), maybeNamespaced(ref.Name, ref.Namespace), err))
+		} else if ok {
+			pruned = append(pruned, refDisplayName(ref))
+		}
+	}
+	if m.isDryRun(ctx) && len(pruned)+len(unrecorded) > 0 {
+		var b strings.Builder
+		if len(pruned) > 0 {
+			fmt.Fprintf(&b, "\n--- `%s' addon would prune %d object(s) on %s ---\n", addonName, len(pruned), m.Master)
+			for _, p := range pruned {
+				fmt.Fprintf(&b, "  - %s\n", p)
+			}
+		}
+		if len(unrecorded) > 0 {
+			fmt.Fprintf(&b, "\n--- `%s' addon keeps %d object(s) labeled as applied by it but not recorded in the store on %s ---\n", addonName, len(unrecorded), m.Master)
+			for _, u := range unrecorded {
+				fmt.Fprintf(&b, "  ? %s\n", u)
+			}
+		}
+		m.writeDiff(ctx, addonName, b.String())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to prune: %s", strings.Join(errs, ", "))
+	}
+	if m.applySetMemberID(addonName) != "" && !m.isDryRun(ctx) {
+		members := append(m.Applied(addonName), m.Skipped(addonName)...)
+		if err := m.tightenApplySet(addonName, members); err != nil {
+			return fmt.Errorf("failed to update ApplySet parent of `%s' addon: %v", addonName, err)
+		}
+	}
+	return nil
+}
+
+// liveMembers returns references to live objects of addonName: members of
+// its ApplySet if WithApplySet is set and it has a parent (returning true),
+// those labeled as applied by it otherwise (only listed in dry run mode as
+// they are reported but never pruned).
+func (m *kubePackage) liveMembers(ctx context.Context, addonName string) ([]store.ObjRef, bool, error) {
+	if m.applySetMemberID(addonName) != "" {
+		refs, found, err := m.applySetMembers(addonName)
+		if err != nil || found {
+			return refs, found, err
+		}
+		log.Infof("ApplySet of `%s' addon has no parent yet, pruning objects recorded in the store only", addonName)
+	}
+	if !m.isDryRun(ctx) {
+		return nil, false, nil
+	}
+	refs, err := m.labeledLive(addonName)
+	return refs, false, err
+}
+
+// ofAppliedKinds returns refs of group kinds that addonName applied (in
+// prev or so far), e.g so that Endpoints inheriting labels of a Service are
+// not mistaken for objects of the addon.
+func (m *kubePackage) ofAppliedKinds(addonName string, prev, refs []store.ObjRef) []store.ObjRef {
+	kinds := map[string]bool{}
+	for _, l := range [][]store.ObjRef{prev, m.Applied(addonName), m.Skipped(addonName)} {
+		for _, ref := range l {
+			kinds[groupKindOf(ref)] = true
+		}
+	}
+	var out []store.ObjRef
+	for _, ref := range refs {
+		if kinds[groupKindOf(ref)] {
+			out = append(out, ref)
+		}
+	}
+	return out
+}
+
+// groupKindOf returns e.g "Deployment.apps" for ref.
+func groupKindOf(ref store.ObjRef) string {
+	gv, _ := schema.ParseGroupVersion(ref.APIVersion)
+	return schema.GroupKind{Group: gv.Group, Kind: ref.Kind}.String()
+}
+
+// controlled returns true if item is owned or managed by a controller (e.g
+// Endpoints and EndpointSlices of a Service carrying its labels) rather
+// than applied by an addon.
+func controlled(item *unstructured.Unstructured) bool {
+	if len(item.GetOwnerReferences()) > 0 {
+		return true
+	}
+	for k := range item.GetLabels() {
+		if k != managedByLabelKey && strings.HasSuffix(k, "/managed-by") {
+			return true
+		}
+	}
+	return false
+}
+
+// objKey identifies the object ref refers to regardless of its API version.
+func objKey(ref store.ObjRef) string {
+	gv, _ := schema.ParseGroupVersion(ref.APIVersion)
+	return strings.Join([]string{gv.Group, ref.Kind, ref.Namespace, ref.Name}, "/")
+}
+
+// refDisplayName returns e.g "deployment.apps `ns/name'".
+func refDisplayName(ref store.ObjRef) string {
+	gv, _ := schema.ParseGroupVersion(ref.APIVersion)
+	return fmt.Sprintf("%s%s `%s'", strings.ToLower(ref.Kind), maybeCore(gv.Group), maybeNamespaced(ref.Name, ref.Namespace))
+}
+
+// withLabeled returns prev followed by refs in labeled that are not in prev.
+// Namespaces go first among those so they are pruned last.
+func withLabeled(prev, labeled []store.ObjRef) []store.ObjRef {
+	seen := map[string]bool{}
+	for _, ref := range prev {
+		seen[objKey(ref)] = true
+	}
+	var extra []store.ObjRef
+	for _, ref := range labeled {
+		if k := objKey(ref); !seen[k] {
+			seen[k] = true
+			extra = append(extra, ref)
+		}
+	}
+	sort.SliceStable(extra, func(i, j int) bool {
+		return extra[i].Kind == "Namespace" && extra[j].Kind != "Namespace"
+	})
+	return append(append([]store.ObjRef(nil), prev...), extra...)
+}
+
+// labeledLive returns references to live objects labeled as applied by
+// addonName (and by this instance if WithInstanceID is set), except those
+// controlled by a controller (see controlled). Objects of all served kinds
+// that can be listed and deleted are listed once and reused by later calls:
+// objects applied since are recorded as applied anyway.
+func (m *kubePackage) labeledLive(addonName string) ([]store.ObjRef, error) {
+	m.labeledMu.Lock()
+	defer m.labeledMu.Unlock()
+	if m.labeledListed {
+		return m.labeled[addonName], nil
+	}
+
+	lists, err := m.dClient.ServerPreferredResources()
+	if discovery.IsGroupDiscoveryFailedError(err) {
+		log.Warningf("Some kinds are not listed for pruning: %v", err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	selector := addonLabelKey
+	if m.instanceID != "" {
+		selector += "," + managedByLabelKey + "=" + m.instanceID
+	}
+	labeled := map[string][]store.ObjRef{}
+	for _, l := range lists {
+		gv, err := schema.ParseGroupVersion(l.GroupVersion)
+		if err != nil {
+			return nil, err
+		}
+		for _, res := range l.APIResources {
+			if strings.Contains(res.Name, "/") || !hasVerbs(res.Verbs, "list", "delete") {
+				continue
+			}
+			r := &apiResource{GVK: gv.WithKind(res.Kind), Resource: res.Name, ClusterScoped: !res.Namespaced}
+			items, err := m.kubeList(r, selector)
+			if err != nil {
+				log.Warningf("Failed to list %s%s labeled as applied by addons for pruning: %v", res.Name, maybeCore(gv.Group), err)
+				continue
+			}
+			for i := range items {
+				item := &items[i]
+				if _, ok := item.GetLabels()[generateNameLabelKey]; ok {
+					continue // Pruned separately (see pruneGenerated).
+				}
+				if controlled(item) {
+					continue
+				}
+				name := item.GetLabels()[addonLabelKey]
+				labeled[name] = append(labeled[name], store.ObjRef{
+					APIVersion: l.GroupVersion,
+					Kind:       res.Kind,
+					Namespace:  item.GetNamespace(),
+					Name:       item.GetName(),
+				})
+			}
+		}
+	}
+	m.labeled, m.labeledListed = labeled, true
+	return labeled[addonName], nil
+}
+
+// hasVerbs returns true if verbs include all of want.
+func hasVerbs(verbs metav1.Verbs, want ...string) bool {
+	for _, w := range want {
+		found := false
+		for _, v := range verbs {
+			if v == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// pruneObj deletes the object ref refers to if still labeled as applied by
+// addonName. Returns true if it was (or, in dry run mode, would be) deleted.
+func (m *kubePackage) pruneObj(ctx context.Context, addonName string, ref store.ObjRef) (bool, error) {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return false, err
+	}
+	gvk := gv.WithKind(ref.Kind)
+	displayName := refDisplayName(ref)
+
+	r, err := newResourceForKind(m.dClient, ref.Name, ref.Namespace, "", gvk)
+	if _, ok := err.(*meta.NoKindMatchError); ok {
+		log.Warningf("%s not pruned: kind is no longer served", displayName)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	var c dynamic.ResourceInterface = m.dynClient.Resource(r.GroupVersionResource())
+	if r.Namespace != "" {
+		c = c.(dynamic.NamespaceableResourceInterface).Namespace(r.Namespace)
+	}
+	live, err := c.Get(r.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	ls := live.GetLabels()
+	if ls[addonLabelKey] != addonName || (m.instanceID != "" && ls[managedByLabelKey] != m.instanceID) {
+		log.Warningf("%s not pruned: no longer labeled as applied by `%s' addon", displayName, addonName)
+		return false, nil
+	}
+	if ok, err := m.passesFilter(ctx, addonName, r, live); err != nil || !ok {
+		return false, err
+	}
+
+	if m.isDryRun(ctx) {
+		m.writeDiff(ctx, addonName, fmt.Sprintf("\n*** %s (%s) ***\n", displayName, reasonPruned))
+		return true, nil
+	}
+	log.Infof("Pruning %s no longer applied by `%s' addon", displayName, addonName)
+	if err := m.kubeDelete(withDiffAddon(ctx, addonName), r, false /* foreground */); err != nil {
+		return false, err
+	}
+	return true, nil
+}
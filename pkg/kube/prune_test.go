@@ -0,0 +1,299 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+	apiruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	coretesting "k8s.io/client-go/testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+func configMap(name string, ls map[string]string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion("v1")
+	u.SetKind("ConfigMap")
+	u.SetName(name)
+	u.SetNamespace("default")
+	u.SetLabels(ls)
+	return u
+}
+
+func configMapRef(name string) store.ObjRef {
+	return store.ObjRef{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: name}
+}
+
+func TestPrune(t *testing.T) {
+	app := map[string]string{addonLabelKey: "app"}
+	objs := []apiruntime.Object{
+		configMap("kept", app),
+		configMap("dropped", app),
+		configMap("adopted", map[string]string{addonLabelKey: "other"}),
+		configMap("other-instance", map[string]string{addonLabelKey: "app", managedByLabelKey: "team-b"}),
+	}
+	prev := []store.ObjRef{
+		configMapRef("kept"),
+		configMapRef("dropped"),
+		configMapRef("adopted"),
+		configMapRef("other-instance"),
+		configMapRef("already-deleted"),
+		{APIVersion: "example.com/v1", Kind: "Gone", Name: "no-longer-served"},
+	}
+
+	for _, tc := range []struct {
+		name       string
+		instanceID string
+		dryRun     bool
+		wantLeft   []string
+	}{
+		{
+			name:     "Prune dropped",
+			wantLeft: []string{"adopted", "kept"},
+		},
+		{
+			name:       "Scoped to instance",
+			instanceID: "team-b",
+			wantLeft:   []string{"adopted", "dropped", "kept"},
+		},
+		{
+			name:     "Dry run",
+			dryRun:   true,
+			wantLeft: []string{"adopted", "dropped", "kept", "other-instance"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var cp []apiruntime.Object
+			for _, o := range objs {
+				cp = append(cp, o.DeepCopyObject())
+			}
+			dynC := dynamicfake.NewSimpleDynamicClient(apiruntime.NewScheme(), cp...)
+			m := &kubePackage{
+				dClient:    fakeDiscovery(),
+				dynClient:  dynC,
+				instanceID: tc.instanceID,
+				dryRun:     tc.dryRun,
+			}
+			m.recordApplied("app", &apiResource{
+				GVK:       schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+				Name:      "kept",
+				Namespace: "default",
+				Resource:  "configmaps",
+			})
+
+			if err := m.Prune(context.Background(), "app", prev); err != nil {
+				t.Fatalf("Failed to prune: %v", err)
+			}
+
+			l, err := dynC.Resource(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}).Namespace("default").List(metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotLeft []string
+			for _, item := range l.Items {
+				gotLeft = append(gotLeft, item.GetName())
+			}
+			sort.Strings(gotLeft)
+
+			if d := cmp.Diff(tc.wantLeft, gotLeft); d != "" {
+				t.Errorf("Unexpected objects left (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+// preferredDiscovery serves Resources of the fake as preferred resources.
+type preferredDiscovery struct {
+	*fakediscovery.FakeDiscovery
+}
+
+func (d preferredDiscovery) ServerPreferredResources() ([]*metav1.APIResourceList, error) {
+	return d.Resources, nil
+}
+
+func TestPruneLabeled(t *testing.T) {
+	verbs := metav1.Verbs{"get", "list", "delete"}
+	d := preferredDiscovery{&fakediscovery.FakeDiscovery{Fake: &coretesting.Fake{}}}
+	d.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "configmaps", Namespaced: true, Kind: "ConfigMap", Verbs: verbs},
+			{Name: "configmaps/status", Namespaced: true, Kind: "ConfigMap", Verbs: verbs},
+			{Name: "services", Namespaced: true, Kind: "Service", Verbs: verbs},
+			{Name: "endpoints", Namespaced: true, Kind: "Endpoints", Verbs: verbs},
+			{Name: "bindings", Namespaced: true, Kind: "Binding", Verbs: metav1.Verbs{"create"}},
+		},
+	}}
+
+	app := map[string]string{addonLabelKey: "app"}
+	owned := configMap("owned", app)
+	owned.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "v1", Kind: "Service", Name: "svc"}})
+	svc := configMap("svc", app)
+	svc.SetKind("Service")
+	// Endpoints controller copies labels of the Service.
+	endpoints := configMap("svc", app)
+	endpoints.SetKind("Endpoints")
+	objs := []apiruntime.Object{
+		configMap("kept", app),
+		configMap("recorded", app),
+		configMap("unrecorded", app),
+		configMap("other-addon", map[string]string{addonLabelKey: "other"}),
+		configMap("unlabeled", nil),
+		owned,
+		svc,
+		endpoints,
+	}
+
+	for _, tc := range []struct {
+		name     string
+		dryRun   bool
+		wantLeft []string
+		wantOut  string
+	}{
+		{
+			name:     "Prune recorded only",
+			wantLeft: []string{"endpoints/svc", "kept", "other-addon", "owned", "service/svc", "unlabeled", "unrecorded"},
+		},
+		{
+			name:     "Dry run",
+			dryRun:   true,
+			wantLeft: []string{"endpoints/svc", "kept", "other-addon", "owned", "recorded", "service/svc", "unlabeled", "unrecorded"},
+			wantOut: "\n*** configmap.v1 `default/recorded' (will be pruned) ***\n" +
+				"\n--- `app' addon would prune 1 object(s) on https://k8s ---\n" +
+				"  - configmap.v1 `default/recorded'\n" +
+				"\n--- `app' addon keeps 1 object(s) labeled as applied by it but not recorded in the store on https://k8s ---\n" +
+				"  ? configmap.v1 `default/unrecorded'\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var cp []apiruntime.Object
+			for _, o := range objs {
+				cp = append(cp, o.DeepCopyObject())
+			}
+			dynC := dynamicfake.NewSimpleDynamicClient(apiruntime.NewScheme(), cp...)
+			var out strings.Builder
+			m := &kubePackage{
+				Master:     "https://k8s",
+				dClient:    d,
+				dynClient:  dynC,
+				dryRun:     tc.dryRun,
+				diffRecord: func(_, s string) { out.WriteString(s) },
+			}
+			for _, r := range []*apiResource{
+				{GVK: schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, Name: "kept", Namespace: "default", Resource: "configmaps"},
+				{GVK: schema.GroupVersionKind{Version: "v1", Kind: "Service"}, Name: "svc", Namespace: "default", Resource: "services"},
+			} {
+				m.recordApplied("app", r)
+			}
+
+			if err := m.Prune(context.Background(), "app", []store.ObjRef{configMapRef("kept"), configMapRef("recorded")}); err != nil {
+				t.Fatalf("Failed to prune: %v", err)
+			}
+
+			var gotLeft []string
+			for _, res := range []string{"configmaps", "services", "endpoints"} {
+				l, err := dynC.Resource(schema.GroupVersionResource{Version: "v1", Resource: res}).Namespace("default").List(metav1.ListOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, item := range l.Items {
+					name := item.GetName()
+					if res != "configmaps" {
+						name = strings.ToLower(item.GetKind()) + "/" + name
+					}
+					gotLeft = append(gotLeft, name)
+				}
+			}
+			sort.Strings(gotLeft)
+
+			if d := cmp.Diff(tc.wantLeft, gotLeft); d != "" {
+				t.Errorf("Unexpected objects left (-want, +got):\n%s", d)
+			}
+			if d := cmp.Diff(tc.wantOut, out.String()); d != "" {
+				t.Errorf("Unexpected dry run output (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestPruneDryRunAfterUnservedKind(t *testing.T) {
+	newKube, closeFn, err := NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+	const widget = `
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: w
+  namespace: default
+`
+	const service = `
+apiVersion: v1
+kind: Service
+metadata:
+  name: svc
+  namespace: default
+spec:
+  ports:
+  - port: 80
+`
+	put := func(ctx context.Context, k starlark.Value, data ...string) {
+		var vs []starlark.Value
+		for _, d := range data {
+			vs = append(vs, starlark.String(d))
+		}
+		thread := &starlark.Thread{}
+		thread.SetLocal(addon.GoCtxKey, ctx)
+		thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+		thread.SetLocal(addon.NameKey, "app")
+		env := starlark.StringDict{"kube": k, "data": starlark.NewList(vs)}
+		if _, err := starlark.Eval(thread, t.Name(), "kube.put_yaml(data=data)", env); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	put(context.Background(), newKube(), snapshotFoo, service)
+
+	// Widget kind isn't served (e.g its CRD is applied by the same run) and
+	// ranks the same as the Service after it.
+	var out strings.Builder
+	k := newKube(WithDiffRecorder(func(_, s string) { out.WriteString(s) }))
+	ctx := addon.WithDryRun(context.Background())
+	put(ctx, k, snapshotFoo, widget, service)
+	prev := []store.ObjRef{
+		configMapRef("foo"),
+		{APIVersion: "v1", Kind: "Service", Namespace: "default", Name: "svc"},
+	}
+	if err := k.(Pruner).Prune(ctx, "app", prev); err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+	if s := out.String(); strings.Contains(s, reasonPruned) || strings.Contains(s, "would prune") {
+		t.Errorf("Want no objects applied after unserved kind pruned, got:\n%s", s)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/cruise-automation/isopod/pkg/redact"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// recordRender passes rendered YAML of obj about to be applied as r by
+// addonName to renderRecord (if set): normalized with diffRules unless
+// m.renderRaw is set. Objects relying on .metadata.generateName and
+// subresources are ignored. Secret values are redacted (see redact.String).
+func (m *kubePackage) recordRender(addonName string, r *apiResource, obj runtime.Object) error {
+	if m.renderRecord == nil || r.Name == "" || r.Subresource != "" {
+		return nil
+	}
+	var rendered string
+	var err error
+	if m.renderRaw {
+		if obj, err = m.withoutIsopodMetadata(obj); err != nil {
+			return fmt.Errorf("failed to strip metadata of %v: %v", r, err)
+		}
+		if rendered, err = marshalObj(obj, &r.GVK, true); err != nil {
+			return fmt.Errorf("failed to render %v: %v", r, err)
+		}
+	} else {
+		if rendered, err = renderObj(obj, &r.GVK, true); err != nil {
+			return fmt.Errorf("failed to render %v: %v", r, err)
+		}
+		if rendered, err = normalize(rendered, m.diffRules); err != nil {
+			return fmt.Errorf("failed to normalize %v: %v", r, err)
+		}
+	}
+	rendered = redact.String(rendered)
+	m.renderRecord(addonName, store.ObjRef{
+		APIVersion: r.GVK.GroupVersion().String(),
+		Kind:       r.GVK.Kind,
+		Namespace:  r.Namespace,
+		Name:       r.Name,
+	}, rendered)
+	return nil
+}
+
+// withoutIsopodMetadata returns a copy of obj without the labels and
+// annotations stamped by setMetadata.
+func (m *kubePackage) withoutIsopodMetadata(obj runtime.Object) (runtime.Object, error) {
+	keys := []string{ctxAnnotationKey, corev1.LastAppliedConfigAnnotation}
+	for k := range m.provenanceAnnotations {
+		keys = append(keys, k)
+	}
+	obj, err := withoutAnnotations(obj.DeepCopyObject(), keys, m.coexistAnnotations)
+	if err != nil {
+		return nil, err
+	}
+
+	a := meta.NewAccessor()
+	ls, err := a.Labels(obj)
+	if err != nil {
+		return nil, err
+	}
+	if ls["heritage"] == "isopod" {
+		delete(ls, "heritage")
+	}
+	delete(ls, addonLabelKey)
+	delete(ls, managedByLabelKey)
+	delete(ls, applySetPartOfLabelKey)
+	if len(ls) == 0 {
+		ls = nil
+	}
+	return obj, a.SetLabels(obj, ls)
+}
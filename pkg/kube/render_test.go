@@ -0,0 +1,103 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+const renderSrc = `
+kube.put_yaml(name="creds", namespace="default", data=["""
+apiVersion: v1
+kind: Secret
+metadata:
+  name: creds
+  labels:
+    team: infra
+stringData:
+  password: hunter2
+"""])
+`
+
+func TestRenderRecorder(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		raw           bool
+		want, notWant []string
+	}{
+		{
+			name:    "Redacted",
+			want:    []string{"password: <redacted>", "heritage: isopod", ctxAnnotationKey, "team: infra"},
+			notWant: []string{"hunter2"},
+		},
+		{
+			name:    "Raw",
+			raw:     true,
+			want:    []string{"password: hunter2", "team: infra"},
+			notWant: []string{"heritage", ctxAnnotationKey, addonLabelKey},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newKube, closeFn, err := NewFakePackages()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeFn()
+
+			var mu sync.Mutex
+			got := map[store.ObjRef]string{}
+			k := newKube(WithRenderRecorder(func(addonName string, ref store.ObjRef, rendered string) {
+				mu.Lock()
+				defer mu.Unlock()
+				if addonName != "app" {
+					t.Errorf("Unexpected addon `%s'", addonName)
+				}
+				got[ref] = rendered
+			}, tc.raw))
+
+			thread := &starlark.Thread{}
+			thread.SetLocal(addon.GoCtxKey, context.Background())
+			thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{"cluster": starlark.String("dev")}})
+			thread.SetLocal(addon.NameKey, "app")
+			if _, err := starlark.ExecFile(thread, t.Name(), renderSrc, starlark.StringDict{"kube": k}); err != nil {
+				t.Fatal(err)
+			}
+
+			ref := store.ObjRef{APIVersion: "v1", Kind: "Secret", Namespace: "default", Name: "creds"}
+			rendered, ok := got[ref]
+			if !ok || len(got) != 1 {
+				t.Fatalf("Want %v recorded, got: %v", ref, got)
+			}
+			for _, s := range tc.want {
+				if !strings.Contains(rendered, s) {
+					t.Errorf("Want %q in rendered object, got:\n%s", s, rendered)
+				}
+			}
+			for _, s := range tc.notWant {
+				if strings.Contains(rendered, s) {
+					t.Errorf("Want no %q in rendered object, got:\n%s", s, rendered)
+				}
+			}
+		})
+	}
+}
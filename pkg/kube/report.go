@@ -0,0 +1,185 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// markdownMaxBytes is roughly the max size of a Markdown diff report (GitHub
+// rejects comments longer than 65536 characters). Diffs of sections past it
+// are left out.
+const markdownMaxBytes = 60000
+
+// DiffReport collects diff output of kube packages of all clusters (see
+// WithDiffRecorder) to summarize it in Markdown, e.g to post it as a review
+// comment. Safe for concurrent use.
+type DiffReport struct {
+	mu sync.Mutex
+	// sections are diffs of each addon on each cluster in the order they
+	// were first recorded.
+	sections []*diffSection
+	index    map[[2]string]*diffSection
+	// warnings are listed above the diffs (once each, in the order they
+	// were first added).
+	warnings []string
+}
+
+// diffSection is the diff output of an addon on a cluster.
+type diffSection struct {
+	cluster, addon string
+	out            strings.Builder
+	changes        int
+}
+
+// NewDiffReport returns a new empty DiffReport.
+func NewDiffReport() *DiffReport {
+	return &DiffReport{index: map[[2]string]*diffSection{}}
+}
+
+// diffHeaderPattern matches the header printed before the diff of each
+// object, e.g "*** deployment.apps `ns/app' (spec changed) ***".
+var diffHeaderPattern = regexp.MustCompile(`(?m)^\*\*\* .+? (?:\((.+)\) )?\*\*\*$`)
+
+// countChanges returns the number of objects that change in diff output out
+// (not those unchanged or skipped).
+func countChanges(out string) int {
+	var n int
+	for _, m := range diffHeaderPattern.FindAllStringSubmatch(out, -1) {
+		switch m[1] {
+		case "", reasonNoChange, reasonFiltered, reasonGuarded:
+		default:
+			if !strings.HasPrefix(m[1], "declared identically by ") {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Recorder returns a function recording diff output of addons on cluster
+// (to be passed to WithDiffRecorder).
+func (d *DiffReport) Recorder(cluster string) func(addonName, out string) {
+	return func(addonName, out string) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		key := [2]string{cluster, addonName}
+		s, ok := d.index[key]
+		if !ok {
+			s = &diffSection{cluster: cluster, addon: addonName}
+			d.index[key] = s
+			d.sections = append(d.sections, s)
+		}
+		s.out.WriteString(out)
+		s.changes += countChanges(out)
+	}
+}
+
+// AddWarning adds warning msg (e.g that an addon is deprecated) about
+// cluster to the report.
+func (d *DiffReport) AddWarning(cluster, msg string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	w := fmt.Sprintf("%s: %s", cluster, msg)
+	for _, seen := range d.warnings {
+		if seen == w {
+			return
+		}
+	}
+	d.warnings = append(d.warnings, w)
+}
+
+// Changes returns the total number of objects that change.
+func (d *DiffReport) Changes() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var n int
+	for _, s := range d.sections {
+		n += s.changes
+	}
+	return n
+}
+
+// WriteMarkdown writes a Markdown summary of the diffs to w: a header with
+// the total number of changes and warnings (if any) followed by a
+// collapsible section with the fenced diff of each addon on each cluster
+// that changes anything.
+func (d *DiffReport) WriteMarkdown(w io.Writer) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var changed []*diffSection
+	var total int
+	addons, clusters := map[string]bool{}, map[string]bool{}
+	for _, s := range d.sections {
+		if s.changes == 0 {
+			continue
+		}
+		changed = append(changed, s)
+		total += s.changes
+		addons[s.addon] = true
+		clusters[s.cluster] = true
+	}
+
+	var b strings.Builder
+	if total == 0 {
+		b.WriteString("### Isopod diff: no changes\n")
+	} else {
+		fmt.Fprintf(&b, "### Isopod diff: %s in %s on %s\n", plural(total, "change"), plural(len(addons), "addon"), plural(len(clusters), "cluster"))
+	}
+	if len(d.warnings) > 0 {
+		b.WriteString("\n")
+		for _, warn := range d.warnings {
+			fmt.Fprintf(&b, "- :warning: %s\n", html.EscapeString(warn))
+		}
+	}
+	if total == 0 {
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+
+	var omitted int
+	for _, s := range changed {
+		summary := fmt.Sprintf("<code>%s</code> on <code>%s</code>: %s", html.EscapeString(s.addon), html.EscapeString(s.cluster), plural(s.changes, "change"))
+		diff := strings.Trim(s.out.String(), "\n") + "\n"
+		fence := "```"
+		for strings.Contains(diff, fence) {
+			fence += "`"
+		}
+		section := fmt.Sprintf("\n<details><summary>%s</summary>\n\n%sdiff\n%s%s\n\n</details>\n", summary, fence, diff, fence)
+		if b.Len()+len(section) > markdownMaxBytes {
+			omitted++
+			section = fmt.Sprintf("\n- %s (diff omitted, too long)\n", summary)
+		}
+		b.WriteString(section)
+	}
+	if omitted > 0 {
+		fmt.Fprintf(&b, "\n_Diffs of %s left out to fit the comment, see the full `--dry_run` output._\n", plural(omitted, "section"))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
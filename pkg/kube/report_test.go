@@ -0,0 +1,114 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDiffReportMarkdown(t *testing.T) {
+	r := NewDiffReport()
+	dev, prod := r.Recorder("dev"), r.Recorder("prod")
+	dev("ingress", "\n*** deployment.apps `ingress/nginx' (spec changed) ***\n--- live\n+++ head\n@@ -1 +1 @@\n-replicas: 1\n+replicas: 2\n")
+	dev("ingress", "\n*** service `ingress/nginx' ***\n")
+	dev("ingress", "\n*** configmap `ingress/conf' (new object) ***\n--- live\n+++ head\n@@ -0,0 +1 @@\n+data: {}\n")
+	dev("dns", "\n*** configmap `kube-system/coredns' (no change) ***\n")
+	prod("ingress", "\n*** networkpolicy.networking.k8s.io `ingress/deny' (skipped by guard) ***\n")
+	prod("ingress", "\n*** configmap `ingress/old' (will be pruned) ***\n")
+
+	if got, want := r.Changes(), 3; got != want {
+		t.Errorf("Changes() = %d, want %d", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteMarkdown(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "### Isopod diff: 3 changes in 1 addon on 2 clusters\n" +
+		"\n<details><summary><code>ingress</code> on <code>dev</code>: 2 changes</summary>\n\n```diff\n" +
+		"*** deployment.apps `ingress/nginx' (spec changed) ***\n--- live\n+++ head\n@@ -1 +1 @@\n-replicas: 1\n+replicas: 2\n\n" +
+		"*** service `ingress/nginx' ***\n\n" +
+		"*** configmap `ingress/conf' (new object) ***\n--- live\n+++ head\n@@ -0,0 +1 @@\n+data: {}\n" +
+		"```\n\n</details>\n" +
+		"\n<details><summary><code>ingress</code> on <code>prod</code>: 1 change</summary>\n\n```diff\n" +
+		"*** networkpolicy.networking.k8s.io `ingress/deny' (skipped by guard) ***\n\n" +
+		"*** configmap `ingress/old' (will be pruned) ***\n" +
+		"```\n\n</details>\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Unexpected Markdown.\nWant:\n%s\nGot:\n%s", want, got)
+	}
+}
+
+func TestDiffReportWarnings(t *testing.T) {
+	r := NewDiffReport()
+	r.AddWarning("dev", "addon `old' is deprecated: use <new>")
+	r.AddWarning("dev", "addon `old' is deprecated: use <new>")
+	r.Recorder("dev")("old", "\n*** configmap `default/old' (no change) ***\n")
+
+	var buf bytes.Buffer
+	if err := r.WriteMarkdown(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "### Isopod diff: no changes\n\n- :warning: dev: addon `old&#39; is deprecated: use &lt;new&gt;\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestDiffReportMarkdownLimits(t *testing.T) {
+	r := NewDiffReport()
+	r.Recorder("dev")("app", "\n*** configmap `default/app' (no change) ***\n")
+
+	var buf bytes.Buffer
+	if err := r.WriteMarkdown(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "### Isopod diff: no changes\n"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+
+	big := "\n*** configmap `default/big' (data changed) ***\n" + strings.Repeat("+a long line of diff output\n", markdownMaxBytes/20)
+	r.Recorder("dev")("big", big)
+	r.Recorder("dev")("small", "\n*** configmap `default/small' (data changed) ***\n+x\n")
+	buf.Reset()
+	if err := r.WriteMarkdown(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, want := range []string{
+		"- <code>big</code> on <code>dev</code>: 1 change (diff omitted, too long)\n",
+		"```diff\n*** configmap `default/small' (data changed) ***\n+x\n```\n",
+		"_Diffs of 1 section left out",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Want %q in Markdown, got:\n%s", want, got)
+		}
+	}
+}
+
+func TestDiffReportMarkdownFence(t *testing.T) {
+	r := NewDiffReport()
+	r.Recorder("dev")("docs", "\n*** configmap `default/readme' (data changed) ***\n+  ```sh\n")
+
+	var buf bytes.Buffer
+	if err := r.WriteMarkdown(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := "````diff\n*** configmap `default/readme' (data changed) ***\n+  ```sh\n````\n"; !strings.Contains(buf.String(), want) {
+		t.Errorf("Want %q in Markdown, got:\n%s", want, buf.String())
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+// RequestsCounter is implemented by the kube package to report the delta in
+// total resource requests of the workloads applied so far.
+type RequestsCounter interface {
+	// RequestsDelta returns the aggregate change in requested CPU and memory
+	// of all Deployments, StatefulSets, DaemonSets and Jobs compared to their
+	// live state.
+	RequestsDelta() corev1.ResourceList
+	// MaxRequestsDelta returns the max total delta configured with
+	// WithMaxRequestsDelta (nil if unlimited).
+	MaxRequestsDelta() corev1.ResourceList
+}
+
+type requestsEstimateKey struct{}
+
+// RequestsEstimate accumulates changes in resource requests of workloads
+// previewed with a ctx derived from WithRequestsEstimate, e.g to check the
+// max delta of a whole rollout before anything is applied.
+type RequestsEstimate struct {
+	mu    sync.Mutex
+	delta corev1.ResourceList
+}
+
+// WithRequestsEstimate returns a copy of ctx that makes built-ins previewing
+// changes (see addon.WithDryRun) add their changes in resource requests to e.
+func WithRequestsEstimate(ctx context.Context, e *RequestsEstimate) context.Context {
+	return context.WithValue(ctx, requestsEstimateKey{}, e)
+}
+
+// Delta returns the estimated change in resource requests.
+func (e *RequestsEstimate) Delta() corev1.ResourceList {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	out := corev1.ResourceList{}
+	for name, q := range e.delta {
+		out[name] = q.DeepCopy()
+	}
+	return out
+}
+
+// CheckRequestsDelta fails if any resource in delta exceeds the
+// corresponding one in max.
+func CheckRequestsDelta(delta, max corev1.ResourceList) error {
+	for _, name := range countedResources {
+		total := delta[name]
+		if limit, ok := max[name]; ok && total.Cmp(limit) > 0 {
+			return fmt.Errorf("total %s requests delta of %s exceeds the max of %s", name, total.String(), limit.String())
+		}
+	}
+	return nil
+}
+
+// countedResources are resources tracked by RequestsCounter.
+var countedResources = []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory}
+
+// workloadRequests returns total resource requests of all pods managed by obj
+// of gvk kind. DaemonSets are counted as running a single pod. Returns nil
+// for kinds other than Deployments, StatefulSets, DaemonSets and Jobs (and for
+// nil obj).
+func workloadRequests(gvk schema.GroupVersionKind, obj runtime.Object) (corev1.ResourceList, error) {
+	if obj == nil {
+		return nil, nil
+	}
+
+	var replicasField string
+	switch gvk.Kind {
+	case "Deployment", "StatefulSet":
+		replicasField = "replicas"
+	case "Job":
+		replicasField = "parallelism"
+	case "DaemonSet":
+	default:
+		return nil, nil
+	}
+
+	un, ok := obj.(*unstructured.Unstructured)
+	var m map[string]interface{}
+	if ok {
+		m = un.Object
+	} else {
+		var err error
+		if m, err = runtime.DefaultUnstructuredConverter.ToUnstructured(obj); err != nil {
+			return nil, err
+		}
+	}
+
+	replicas := int64(1)
+	if replicasField != "" {
+		if v, found, _ := unstructured.NestedFieldNoCopy(m, "spec", replicasField); found && v != nil {
+			n, err := toInt64(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid .spec.%s: %v", replicasField, err)
+			}
+			replicas = n
+		}
+	}
+
+	cs, _, err := unstructured.NestedSlice(m, "spec", "template", "spec", "containers")
+	if err != nil {
+		return nil, err
+	}
+
+	out := corev1.ResourceList{}
+	for _, c := range cs {
+		cm, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		rs, _, _ := unstructured.NestedMap(cm, "resources", "requests")
+		for _, name := range countedResources {
+			v, ok := rs[string(name)]
+			if !ok {
+				continue
+			}
+			q, err := toQuantity(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s request: %v", name, err)
+			}
+			total := out[name]
+			total.Add(q)
+			out[name] = total
+		}
+	}
+
+	for name, q := range out {
+		out[name] = *resource.NewMilliQuantity(q.MilliValue()*replicas, q.Format)
+	}
+	return out, nil
+}
+
+func toInt64(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case int64:
+		return n, nil
+	case int32:
+		return int64(n), nil
+	case int:
+		return int64(n), nil
+	case float64:
+		return int64(n), nil
+	}
+	return 0, fmt.Errorf("expected a number, got: %v", v)
+}
+
+func toQuantity(v interface{}) (resource.Quantity, error) {
+	switch q := v.(type) {
+	case string:
+		return resource.ParseQuantity(q)
+	case int64, int32, int, float64:
+		return resource.ParseQuantity(fmt.Sprint(q))
+	}
+	return resource.Quantity{}, fmt.Errorf("expected a quantity, got: %v", v)
+}
+
+// addRequestsDelta records the change in resource requests from live to head
+// (either may be nil) of gvk kind. Fails if the total delta exceeds the max
+// configured with WithMaxRequestsDelta. Changes previewed with
+// addon.WithDryRun are not recorded as they will be counted once applied
+// (but are added to the RequestsEstimate of ctx if any).
+func (m *kubePackage) addRequestsDelta(ctx context.Context, gvk schema.GroupVersionKind, live, head runtime.Object) error {
+	e, _ := ctx.Value(requestsEstimateKey{}).(*RequestsEstimate)
+	if !m.dryRun && addon.IsDryRun(ctx) && e == nil {
+		return nil
+	}
+
+	liveRs, err := workloadRequests(gvk, live)
+	if err != nil {
+		return fmt.Errorf("failed to compute resource requests of :live object: %v", err)
+	}
+	headRs, err := workloadRequests(gvk, head)
+	if err != nil {
+		return fmt.Errorf("failed to compute resource requests of :head object: %v", err)
+	}
+	if liveRs == nil && headRs == nil {
+		return nil
+	}
+
+	if e != nil {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		if e.delta == nil {
+			e.delta = corev1.ResourceList{}
+		}
+		addDelta(e.delta, liveRs, headRs)
+		return nil
+	}
+
+	m.requestsMu.Lock()
+	defer m.requestsMu.Unlock()
+
+	if m.requestsDelta == nil {
+		m.requestsDelta = corev1.ResourceList{}
+	}
+	addDelta(m.requestsDelta, liveRs, headRs)
+	return CheckRequestsDelta(m.requestsDelta, m.maxRequestsDelta)
+}
+
+// addDelta adds the change from liveRs to headRs to delta.
+func addDelta(delta, liveRs, headRs corev1.ResourceList) {
+	for _, name := range countedResources {
+		total := delta[name]
+		if q, ok := headRs[name]; ok {
+			total.Add(q)
+		}
+		if q, ok := liveRs[name]; ok {
+			total.Sub(q)
+		}
+		delta[name] = total
+	}
+}
+
+// RequestsDelta implements RequestsCounter.
+func (m *kubePackage) RequestsDelta() corev1.ResourceList {
+	m.requestsMu.Lock()
+	defer m.requestsMu.Unlock()
+
+	out := corev1.ResourceList{}
+	for name, q := range m.requestsDelta {
+		out[name] = q.DeepCopy()
+	}
+	return out
+}
+
+// MaxRequestsDelta implements RequestsCounter.
+func (m *kubePackage) MaxRequestsDelta() corev1.ResourceList {
+	return m.maxRequestsDelta
+}
+
+// FormatRequests renders rs as e.g "cpu +1500m, memory -1Gi".
+func FormatRequests(rs corev1.ResourceList) string {
+	var out []string
+	for name, q := range rs {
+		sign := ""
+		if q.Sign() >= 0 {
+			sign = "+"
+		}
+		out = append(out, fmt.Sprintf("%s %s%s", name, sign, q.String()))
+	}
+	sort.Strings(out)
+	return strings.Join(out, ", ")
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	apiruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+func deployment(replicas int32, cpu, mem string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{Kind: "Deployment", APIVersion: "apps/v1"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name: "app",
+						Resources: corev1.ResourceRequirements{
+							Requests: corev1.ResourceList{
+								corev1.ResourceCPU:    resource.MustParse(cpu),
+								corev1.ResourceMemory: resource.MustParse(mem),
+							},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+const testDaemonSetYaml = `
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: agent
+spec:
+  template:
+    spec:
+      containers:
+      - name: agent
+        resources:
+          requests:
+            cpu: 1
+            memory: 64Mi
+      - name: sidecar
+        resources:
+          requests:
+            cpu: 100m
+`
+
+func TestRequestsDelta(t *testing.T) {
+	ds, _, err := decode([]byte(testDaemonSetYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployGVK := appsv1.SchemeGroupVersion.WithKind("Deployment")
+
+	type change struct {
+		gvk        schema.GroupVersionKind
+		live, head apiruntime.Object
+	}
+	for _, tc := range []struct {
+		name      string
+		changes   []change
+		max       corev1.ResourceList
+		wantDelta string
+		wantErr   string
+	}{
+		{
+			name:      "New deployment",
+			changes:   []change{{gvk: deployGVK, head: deployment(3, "500m", "1Gi")}},
+			wantDelta: "cpu +1500m, memory +3Gi",
+		},
+		{
+			name: "Scaled up and down",
+			changes: []change{
+				{gvk: deployGVK, live: deployment(2, "1", "1Gi"), head: deployment(20, "1", "1Gi")},
+				{gvk: deployGVK, live: deployment(4, "250m", "512Mi"), head: deployment(2, "250m", "512Mi")},
+			},
+			wantDelta: "cpu +17500m, memory +17Gi",
+		},
+		{
+			name: "Removed requests",
+			changes: []change{
+				{gvk: deployGVK, live: deployment(1, "2", "2Gi"), head: deployment(1, "0", "0")},
+			},
+			wantDelta: "cpu -2, memory -2Gi",
+		},
+		{
+			name:      "DaemonSet",
+			changes:   []change{{gvk: ds.GetObjectKind().GroupVersionKind(), head: ds}},
+			wantDelta: "cpu +1100m, memory +64Mi",
+		},
+		{
+			name:    "Exceeds max",
+			changes: []change{{gvk: deployGVK, live: deployment(1, "1", "1Gi"), head: deployment(100, "1", "1Gi")}},
+			max: corev1.ResourceList{
+				corev1.ResourceCPU: resource.MustParse("10"),
+			},
+			wantDelta: "cpu +99, memory +99Gi",
+			wantErr:   "total cpu requests delta of 99 exceeds the max of 10",
+		},
+		{
+			name:      "Not a workload",
+			changes:   []change{{gvk: corev1.SchemeGroupVersion.WithKind("Pod"), head: &corev1.Pod{}}},
+			wantDelta: "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &kubePackage{maxRequestsDelta: tc.max}
+
+			gotErr := ""
+			for _, c := range tc.changes {
+				if err := m.addRequestsDelta(context.Background(), c.gvk, c.live, c.head); err != nil {
+					gotErr = err.Error()
+					break
+				}
+			}
+			if gotErr != tc.wantErr {
+				t.Errorf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+
+			if got := FormatRequests(m.RequestsDelta()); got != tc.wantDelta {
+				t.Errorf("Unexpected delta.\nWant: %s\nGot: %s", tc.wantDelta, got)
+			}
+		})
+	}
+}
+
+func TestRequestsEstimate(t *testing.T) {
+	deployGVK := appsv1.SchemeGroupVersion.WithKind("Deployment")
+	m := &kubePackage{maxRequestsDelta: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("10")}}
+
+	e := &RequestsEstimate{}
+	ctx := WithRequestsEstimate(addon.WithSilentDryRun(context.Background()), e)
+	for _, replicas := range []int32{8, 8} {
+		if err := m.addRequestsDelta(ctx, deployGVK, nil, deployment(replicas, "1", "1Gi")); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if got, want := FormatRequests(e.Delta()), "cpu +16, memory +16Gi"; got != want {
+		t.Errorf("Unexpected estimated delta.\nWant: %s\nGot: %s", want, got)
+	}
+	if got := FormatRequests(m.RequestsDelta()); got != "" {
+		t.Errorf("Expected estimate not to be recorded as applied, got: %s", got)
+	}
+	wantErr := "total cpu requests delta of 16 exceeds the max of 10"
+	if err := CheckRequestsDelta(e.Delta(), m.MaxRequestsDelta()); err == nil || err.Error() != wantErr {
+		t.Errorf("Unexpected error.\nWant: %s\nGot: %v", wantErr, err)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+	goyaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// Restorer undoes runs of addons snapshotted with WithSnapshot.
+type Restorer interface {
+	// Restore re-applies objects of addonName snapshotted in dir (the
+	// snapshot directory of a run) and deletes objects the run created.
+	Restore(ctx context.Context, addonName, dir string) error
+}
+
+// serverFields are set by the API server and dropped from snapshots before
+// they are re-applied.
+var serverFields = [][]string{
+	{"metadata", "resourceVersion"},
+	{"metadata", "uid"},
+	{"metadata", "creationTimestamp"},
+	{"metadata", "generation"},
+	{"metadata", "managedFields"},
+	{"metadata", "selfLink"},
+	{"metadata", "deletionTimestamp"},
+	{"metadata", "deletionGracePeriodSeconds"},
+	{"status"},
+}
+
+// Restore implements Restorer. Snapshots go through the same path as objects
+// applied by addons (so --dry_run and diffs apply) in apply order (see
+// WithApplyOrder), namespaces and CRDs first. Secrets redacted in the
+// snapshot are skipped with a warning. Created objects are deleted in
+// reverse, as if pruned: those no longer labeled as applied by addonName are
+// kept.
+func (m *kubePackage) Restore(ctx context.Context, addonName, dir string) error {
+	ctx = withDiffAddon(ctx, addonName)
+	addonDir := filepath.Join(dir, safePath(snapshotHost(m.Master)), safePath(addonName))
+	objs, created, err := readSnapshots(addonDir)
+	if os.IsNotExist(err) {
+		log.Infof("No snapshots of `%s' addon on %s in `%s', nothing to restore", addonName, m.Master, dir)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read snapshots of `%s' addon: %v", addonName, err)
+	}
+	restored, deleted, err := m.undo(ctx, addonName, objs, created)
+	if err != nil {
+		return fmt.Errorf("failed to restore: %v", err)
+	}
+	log.Infof("Restored %d object(s) of `%s' addon and deleted %d it created on %s", restored, addonName, deleted, m.Master)
+	return nil
+}
+
+// undo re-applies prior states objs of objects mutated by addonName and
+// then deletes objects it created, in apply order (see Restore). Returns
+// the number of objects restored and deleted.
+func (m *kubePackage) undo(ctx context.Context, addonName string, objs []*unstructured.Unstructured, created []store.ObjRef) (restored, deleted int, err error) {
+	sort.SliceStable(objs, func(i, j int) bool {
+		return m.applyOrder.rank(objs[i].GroupVersionKind()) < m.applyOrder.rank(objs[j].GroupVersionKind())
+	})
+	m.sortByApplyOrder(created)
+
+	var errs []string
+	for _, obj := range objs {
+		ok, err := m.restoreObj(ctx, addonName, obj)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s `%s': %v", strings.ToLower(obj.GetKind()), maybeNamespaced(obj.GetName(), obj.GetNamespace()), err))
+		} else if ok {
+			restored++
+		}
+	}
+	for i := len(created) - 1; i >= 0; i-- {
+		ref := created[i]
+		ok, err := m.pruneObj(ctx, addonName, ref)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s `%s': %v", strings.ToLower(ref.Kind), maybeNamespaced(ref.Name, ref.Namespace), err))
+		} else if ok {
+			deleted++
+		}
+	}
+	if len(errs) > 0 {
+		return restored, deleted, errors.New(strings.Join(errs, ", "))
+	}
+	return restored, deleted, nil
+}
+
+// restoreObj re-applies snapshotted obj. Returns true if it was (or, in dry
+// run mode, would be) applied.
+func (m *kubePackage) restoreObj(ctx context.Context, addonName string, obj *unstructured.Unstructured) (bool, error) {
+	gvk := obj.GroupVersionKind()
+	if gvk.Group == "" && gvk.Kind == "Secret" && hasRedacted(obj) {
+		log.Warningf("secret `%s' not restored: its data is redacted in the snapshot (see --snapshot_secrets)", maybeNamespaced(obj.GetName(), obj.GetNamespace()))
+		return false, nil
+	}
+	for _, f := range serverFields {
+		unstructured.RemoveNestedField(obj.Object, f...)
+	}
+
+	r, err := newResourceForKind(m.dClient, obj.GetName(), obj.GetNamespace(), "", gvk)
+	if _, ok := err.(*meta.NoKindMatchError); ok {
+		log.Warningf("%s%s `%s' not restored: kind is no longer served", strings.ToLower(gvk.Kind), maybeCore(gvk.Group), maybeNamespaced(obj.GetName(), obj.GetNamespace()))
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if r.ClusterScoped {
+		r.Namespace = ""
+	}
+	if ok, err := m.passesFilter(ctx, addonName, r, obj); err != nil || !ok {
+		return false, err
+	}
+
+	log.Infof("Restoring %v from snapshot", r)
+	if err := m.kubeUpdateYaml(ctx, r, obj, 0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// hasRedacted returns true if values of Secret obj were redacted by
+// redactSecret.
+func hasRedacted(obj *unstructured.Unstructured) bool {
+	for _, field := range []string{"data", "stringData"} {
+		data, _, _ := unstructured.NestedMap(obj.Object, field)
+		for _, v := range data {
+			if v == redacted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readSnapshots reads snapshots of objects in addonDir (see snapshotLive)
+// along with objects recorded as created (see recordCreated). Namespaces and
+// CRDs go first among objects.
+func readSnapshots(addonDir string) (objs []*unstructured.Unstructured, created []store.ObjRef, err error) {
+	if _, err := os.Stat(addonDir); err != nil {
+		return nil, nil, err
+	}
+	err = filepath.Walk(addonDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".yaml" {
+			return err
+		}
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if filepath.Dir(path) == addonDir && info.Name() == snapshotCreatedFile {
+			if err := goyaml.Unmarshal(bs, &created); err != nil {
+				return fmt.Errorf("`%s': %v", path, err)
+			}
+			return nil
+		}
+		obj := &unstructured.Unstructured{}
+		if err := yaml.Unmarshal(bs, &obj.Object); err != nil {
+			return fmt.Errorf("`%s': %v", path, err)
+		}
+		objs = append(objs, obj)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.SliceStable(objs, func(i, j int) bool {
+		return isBarrier(objs[i].GroupVersionKind()) && !isBarrier(objs[j].GroupVersionKind())
+	})
+	return objs, created, nil
+}
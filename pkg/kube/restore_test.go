@@ -0,0 +1,122 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+const restoreBar = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar
+  namespace: default
+data:
+  key: v1
+`
+
+func TestRestore(t *testing.T) {
+	newKube, closeFn, err := NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	eval := func(k starlark.HasAttrs, expr string, data ...string) starlark.Value {
+		var vs []starlark.Value
+		for _, d := range data {
+			vs = append(vs, starlark.String(d))
+		}
+		thread := &starlark.Thread{}
+		thread.SetLocal(addon.GoCtxKey, context.Background())
+		thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+		thread.SetLocal(addon.NameKey, "app")
+		env := starlark.StringDict{"kube": k, "data": starlark.NewList(vs)}
+		v, err := starlark.Eval(thread, t.Name(), expr, env)
+		if err != nil {
+			t.Fatalf("Failed to eval `%s': %v", expr, err)
+		}
+		return v
+	}
+
+	for _, tc := range []struct {
+		name    string
+		dryRun  bool
+		wantFoo string
+		wantBar bool
+	}{
+		{
+			name:    "Restore",
+			wantFoo: "v1",
+		},
+		{
+			name:    "Dry run",
+			dryRun:  true,
+			wantFoo: "v2",
+			wantBar: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "isopod-restore")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			eval(newKube(), "kube.put_yaml(data=data)", snapshotFoo, snapshotSecret)
+			defer eval(newKube(), `kube.delete(configmap="default/foo")`)
+			defer eval(newKube(), `kube.delete(secret="default/creds")`)
+
+			// The bad run updates foo, creates bar and re-creates creds.
+			k := newKube(WithSnapshot(dir, 0, false))
+			eval(k, "kube.put_yaml(data=data)", snapshotFooChanged, restoreBar)
+			eval(k, `kube.delete(secret="default/creds")`)
+			eval(k, "kube.put_yaml(data=data)", snapshotSecret)
+
+			ctx := context.Background()
+			if tc.dryRun {
+				ctx = addon.WithDryRun(ctx)
+			}
+			if err := newKube().(Restorer).Restore(ctx, "app", dir); err != nil {
+				t.Fatalf("Failed to restore: %v", err)
+			}
+
+			foo := eval(newKube(), `kube.get(configmap="default/foo", json=True)`)
+			if !strings.Contains(foo.String(), tc.wantFoo) {
+				t.Errorf("Expected foo to hold %q, got: %v", tc.wantFoo, foo)
+			}
+			if bar := eval(newKube(), `kube.exists(configmap="default/bar")`); bool(bar.(starlark.Bool)) != tc.wantBar {
+				t.Errorf("Expected bar to exist: %v, got: %v", tc.wantBar, bar)
+			}
+			// Redacted in the snapshot and existed before the run so
+			// left as re-created by it.
+			if creds := eval(newKube(), `kube.exists(secret="default/creds")`); !bool(creds.(starlark.Bool)) {
+				t.Errorf("Expected creds to be kept")
+			}
+			if tc.wantBar {
+				eval(newKube(), `kube.delete(configmap="default/bar")`)
+			}
+		})
+	}
+}
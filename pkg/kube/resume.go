@@ -0,0 +1,90 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	log "github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Resumer is implemented by the kube package to resume applying objects
+// after a failed run.
+type Resumer interface {
+	// Resume makes put and put_yaml skip objects whose digest matches the one
+	// in applied (keyed by resume key) and calls record with resume key and
+	// digest of every object applied from now on. Either may be nil.
+	// Objects relying on .metadata.generateName and subresources are never
+	// skipped or recorded.
+	Resume(applied map[string]string, record func(key, digest string))
+}
+
+// Resume implements Resumer.
+func (m *kubePackage) Resume(applied map[string]string, record func(key, digest string)) {
+	m.resumeMu.Lock()
+	defer m.resumeMu.Unlock()
+	m.resumeApplied = applied
+	m.resumeRecord = record
+}
+
+// resumable returns resume key and digest of obj (applied by addonName as r)
+// if progress is tracked for it (empty key otherwise). Must be called before
+// obj is merged with its live state.
+func (m *kubePackage) resumable(addonName string, r *apiResource, obj runtime.Object) (key, digest string) {
+	m.resumeMu.Lock()
+	tracked := m.resumeApplied != nil || m.resumeRecord != nil
+	m.resumeMu.Unlock()
+	if !tracked || r.Name == "" || r.Subresource != "" {
+		return "", ""
+	}
+
+	bs, err := json.Marshal(obj)
+	if err != nil {
+		log.Warningf("%s: not tracking resume progress: %v", r, err)
+		return "", ""
+	}
+	sum := sha256.Sum256(bs)
+	key = strings.Join([]string{addonName, r.GVK.GroupVersion().String(), r.GVK.Kind, r.Namespace, r.Name}, "/")
+	return key, hex.EncodeToString(sum[:])
+}
+
+// alreadyApplied returns true if object with resume key and digest was
+// applied by the run being resumed.
+func (m *kubePackage) alreadyApplied(key, digest string) bool {
+	if key == "" {
+		return false
+	}
+	m.resumeMu.Lock()
+	defer m.resumeMu.Unlock()
+	return m.resumeApplied[key] == digest
+}
+
+// recordProgress records object with resume key and digest as applied.
+func (m *kubePackage) recordProgress(ctx context.Context, key, digest string) {
+	if key == "" || m.isDryRun(ctx) {
+		return
+	}
+	m.resumeMu.Lock()
+	record := m.resumeRecord
+	m.resumeMu.Unlock()
+	if record != nil {
+		record(key, digest)
+	}
+}
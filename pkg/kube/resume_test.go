@@ -0,0 +1,130 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+const (
+	resumeFoo = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: default
+data:
+  key: v1
+`
+	resumeFooChanged = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: default
+data:
+  key: v2
+`
+	resumeBar = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar
+  namespace: default
+`
+)
+
+func TestResume(t *testing.T) {
+	newKube, closeFn, err := NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	ctx := context.Background()
+	eval := func(k starlark.HasAttrs, expr string, data ...string) starlark.Value {
+		var vs []starlark.Value
+		for _, d := range data {
+			vs = append(vs, starlark.String(d))
+		}
+		thread := &starlark.Thread{}
+		thread.SetLocal(addon.GoCtxKey, ctx)
+		thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+		thread.SetLocal(addon.NameKey, "app")
+		env := starlark.StringDict{"kube": k, "data": starlark.NewList(vs)}
+		v, err := starlark.Eval(thread, t.Name(), expr, env)
+		if err != nil {
+			t.Fatalf("Failed to eval `%s': %v", expr, err)
+		}
+		return v
+	}
+	// run applies yamls resuming from applied and returns objects recorded as
+	// applied and names of configmaps left in default namespace.
+	run := func(applied map[string]string, yamls ...string) (recorded map[string]string, names []string) {
+		recorded = map[string]string{}
+		k := newKube()
+		k.(Resumer).Resume(applied, func(key, digest string) { recorded[key] = digest })
+
+		eval(k, "kube.put_yaml(data=data)", yamls...)
+
+		for _, n := range []string{"foo", "bar"} {
+			if eval(k, `kube.exists(configmap="default/`+n+`")`).Truth() {
+				names = append(names, n)
+			}
+		}
+		sort.Strings(names)
+		return recorded, names
+	}
+
+	first, names := run(nil, resumeFoo, resumeBar)
+	if d := cmp.Diff([]string{"bar", "foo"}, names); d != "" {
+		t.Errorf("Unexpected configmaps after first run (-want +got):\n%s", d)
+	}
+	var keys []string
+	for k := range first {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if d := cmp.Diff([]string{"app/v1/ConfigMap/default/bar", "app/v1/ConfigMap/default/foo"}, keys); d != "" {
+		t.Errorf("Unexpected objects recorded by first run (-want +got):\n%s", d)
+	}
+
+	// Unchanged objects applied by the resumed run are skipped (deleted foo
+	// isn't recreated).
+	eval(newKube(), `kube.delete(configmap="default/foo")`)
+	recorded, names := run(first, resumeFoo, resumeBar)
+	if d := cmp.Diff([]string{"bar"}, names); d != "" {
+		t.Errorf("Unexpected configmaps after resumed run (-want +got):\n%s", d)
+	}
+	if len(recorded) != 0 {
+		t.Errorf("Expected skipped objects not to be recorded again, got: %v", recorded)
+	}
+
+	// Changed objects are applied.
+	recorded, names = run(first, resumeFooChanged, resumeBar)
+	if d := cmp.Diff([]string{"bar", "foo"}, names); d != "" {
+		t.Errorf("Unexpected configmaps after resumed run with changes (-want +got):\n%s", d)
+	}
+	if d := recorded["app/v1/ConfigMap/default/foo"]; d == "" || d == first["app/v1/ConfigMap/default/foo"] {
+		t.Errorf("Expected changed object to be recorded with new digest, got: %v", recorded)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// SecretGetter reads Secrets from the cluster. Used by other packages (e.g
+// replicate) to read Secrets they derive objects from.
+type SecretGetter interface {
+	// GetSecret returns Secret namespace/name (nil if not found).
+	GetSecret(ctx context.Context, namespace, name string) (*corev1.Secret, error)
+}
+
+// GetSecret implements SecretGetter.
+func (m *kubePackage) GetSecret(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+	un, err := m.dynClient.Resource(gvr).Namespace(namespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	s := &corev1.Secret{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(un.Object, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
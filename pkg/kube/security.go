@@ -0,0 +1,172 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+	k8syaml "sigs.k8s.io/yaml"
+)
+
+// SecurityFilter selects the security-relevant part of objects for the diff
+// output (see WithSecurityDiff).
+type SecurityFilter struct {
+	// Kinds are diffed in full, e.g `Role' or `NetworkPolicy'.
+	Kinds []string `json:"kinds"`
+	// Fields are diffed wherever they appear in objects of other kinds (at
+	// any depth), e.g `image' or `privileged'. A trailing `*' matches any
+	// field with the prefix, e.g `pod-security.kubernetes.io/*' labels.
+	Fields []string `json:"fields"`
+}
+
+// DefaultSecurityFilter selects RBAC, network policies, secrets, webhooks
+// and Pod fields affecting privileges, images and access to secrets or the
+// node.
+var DefaultSecurityFilter = &SecurityFilter{
+	Kinds: []string{
+		"Role", "ClusterRole", "RoleBinding", "ClusterRoleBinding", "ServiceAccount",
+		"NetworkPolicy", "PodSecurityPolicy", "Secret",
+		"ValidatingWebhookConfiguration", "MutatingWebhookConfiguration",
+	},
+	Fields: []string{
+		"rules", "image", "securityContext", "capabilities", "privileged",
+		"allowPrivilegeEscalation", "runAsUser", "runAsNonRoot", "hostPath",
+		"hostNetwork", "hostPID", "hostIPC", "hostPort", "serviceAccountName",
+		"automountServiceAccountToken", "secret", "secretKeyRef", "secretRef",
+		"pod-security.kubernetes.io/*",
+	},
+}
+
+// LoadSecurityFilter loads a SecurityFilter from YAML file at path in the
+// following format (lists left out are those of DefaultSecurityFilter):
+//
+//	kinds: [ClusterRole, ClusterRoleBinding, NetworkPolicy]
+//	fields: [image, privileged, hostPath]
+func LoadSecurityFilter(path string) (*SecurityFilter, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f SecurityFilter
+	if err := k8syaml.UnmarshalStrict(bs, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse `%s': %v", path, err)
+	}
+	if f.Kinds == nil {
+		f.Kinds = DefaultSecurityFilter.Kinds
+	}
+	if f.Fields == nil {
+		f.Fields = DefaultSecurityFilter.Fields
+	}
+	return &f, nil
+}
+
+func (f *SecurityFilter) matchesKind(kind string) bool {
+	for _, k := range f.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *SecurityFilter) matchesField(key string) bool {
+	for _, field := range f.Fields {
+		if prefix := strings.TrimSuffix(field, "*"); prefix != field && strings.HasPrefix(key, prefix) {
+			return true
+		}
+		if key == field {
+			return true
+		}
+	}
+	return false
+}
+
+// projectObj returns the security-relevant part of rendered YAML object obj:
+// the whole object if it is one of f.Kinds, or its kind and apiVersion only
+// followed by the fields matching f.Fields (see project). Returns true if
+// anything besides kind and apiVersion is left.
+func (f *SecurityFilter) projectObj(obj string) (string, bool, error) {
+	if obj == "" {
+		return "", false, nil
+	}
+	var m yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(obj), &m); err != nil {
+		return "", false, err
+	}
+	kind, _ := mapSliceGet(m, "kind").(string)
+	if f.matchesKind(kind) {
+		return obj, true, nil
+	}
+
+	out := yaml.MapSlice{
+		{Key: "kind", Value: kind},
+		{Key: "apiVersion", Value: mapSliceGet(m, "apiVersion")},
+	}
+	var rest yaml.MapSlice
+	for _, item := range m {
+		if k, _ := item.Key.(string); k != "kind" && k != "apiVersion" {
+			rest = append(rest, item)
+		}
+	}
+	v, matched := f.project(rest)
+	if matched {
+		out = append(out, v.(yaml.MapSlice)...)
+	}
+
+	bs, err := yaml.Marshal(out)
+	if err != nil {
+		return "", false, err
+	}
+	return string(bs), matched, nil
+}
+
+// project returns the parts of v matching f.Fields and true if there are
+// any. Matching map entries are kept whole while other maps and lists only
+// keep entries containing matches (plus the name of maps, which tells items
+// of lists such as containers apart).
+func (f *SecurityFilter) project(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		var out yaml.MapSlice
+		for _, item := range v {
+			if k, ok := item.Key.(string); ok && f.matchesField(k) {
+				out = append(out, item)
+				continue
+			}
+			if pv, ok := f.project(item.Value); ok {
+				out = append(out, yaml.MapItem{Key: item.Key, Value: pv})
+			}
+		}
+		if len(out) == 0 {
+			return nil, false
+		}
+		if name := mapSliceGet(v, "name"); name != nil && mapSliceGet(out, "name") == nil {
+			out = append(yaml.MapSlice{{Key: "name", Value: name}}, out...)
+		}
+		return out, true
+	case []interface{}:
+		var out []interface{}
+		for _, item := range v {
+			if pv, ok := f.project(item); ok {
+				out = append(out, pv)
+			}
+		}
+		return out, len(out) > 0
+	}
+	return nil, false
+}
@@ -0,0 +1,287 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const securityObj = `kind: Deployment
+apiVersion: apps/v1
+metadata:
+  name: foo
+  labels:
+    app: foo
+spec:
+  replicas: 3
+  template:
+    spec:
+      serviceAccountName: foo
+      containers:
+      - name: nginx
+        image: nginx:1.17
+        ports:
+        - containerPort: 80
+      - name: sidecar
+        image: envoy:1.12
+        securityContext:
+          privileged: true
+      volumes:
+      - name: data
+        hostPath:
+          path: /var/lib/data
+      - name: cache
+        emptyDir: {}
+`
+
+func TestProjectObj(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		f           *SecurityFilter
+		obj         string
+		want        string
+		wantMatched bool
+	}{
+		{
+			name: "Default fields",
+			f:    DefaultSecurityFilter,
+			obj:  securityObj,
+			want: multiline(
+				"kind: Deployment",
+				"apiVersion: apps/v1",
+				"spec:",
+				"  template:",
+				"    spec:",
+				"      serviceAccountName: foo",
+				"      containers:",
+				"      - name: nginx",
+				"        image: nginx:1.17",
+				"      - name: sidecar",
+				"        image: envoy:1.12",
+				"        securityContext:",
+				"          privileged: true",
+				"      volumes:",
+				"      - name: data",
+				"        hostPath:",
+				"          path: /var/lib/data",
+				""),
+			wantMatched: true,
+		},
+		{
+			name: "Prefix field",
+			f:    &SecurityFilter{Fields: []string{"app*"}},
+			obj:  securityObj,
+			want: multiline(
+				"kind: Deployment",
+				"apiVersion: apps/v1",
+				"metadata:",
+				"  name: foo",
+				"  labels:",
+				"    app: foo",
+				""),
+			wantMatched: true,
+		},
+		{
+			name: "Nothing matched",
+			f:    &SecurityFilter{Fields: []string{"capabilities"}},
+			obj:  securityObj,
+			want: multiline(
+				"kind: Deployment",
+				"apiVersion: apps/v1",
+				""),
+		},
+		{
+			name:        "Whole kind",
+			f:           &SecurityFilter{Kinds: []string{"Deployment"}},
+			obj:         securityObj,
+			want:        securityObj,
+			wantMatched: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, matched, err := tc.f.projectObj(tc.obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected projection (-want +got):\n%s", d)
+			}
+			if matched != tc.wantMatched {
+				t.Errorf("Expected matched to be %v, got: %v", tc.wantMatched, matched)
+			}
+		})
+	}
+}
+
+func TestSecurityDiff(t *testing.T) {
+	deployment := func(replicas int32, image string) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			TypeMeta:   metav1.TypeMeta{Kind: "Deployment", APIVersion: "apps/v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{Name: "nginx", Image: image}},
+					},
+				},
+			},
+		}
+	}
+	role := func(verbs ...string) *rbacv1.Role {
+		return &rbacv1.Role{
+			TypeMeta:   metav1.TypeMeta{Kind: "Role", APIVersion: "rbac.authorization.k8s.io/v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: verbs}},
+		}
+	}
+	configMap := &corev1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{Kind: "ConfigMap", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Data:       map[string]string{"key": "value"},
+	}
+
+	for _, tc := range []struct {
+		name       string
+		live, head runtime.Object
+		gvk        schema.GroupVersionKind
+		wantDiff   string
+	}{
+		{
+			name: "Image changed",
+			live: deployment(3, "nginx:1.17"),
+			head: deployment(5, "nginx:1.18"),
+			gvk:  schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			wantDiff: multiline(
+				"",
+				"*** deployment.apps `default/foo' (spec changed) ***",
+				"--- live",
+				"+++ head",
+				"@@ -3,8 +3,8 @@",
+				" spec:",
+				"   template:",
+				"     spec:",
+				"       containers:",
+				"       - name: nginx",
+				"-        image: nginx:1.17",
+				"+        image: nginx:1.18",
+				"       securityContext: {}",
+				" ",
+				""),
+		},
+		{
+			name: "Only replicas changed",
+			live: deployment(3, "nginx:1.17"),
+			head: deployment(5, "nginx:1.17"),
+			gvk:  schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+		},
+		{
+			name: "Role changed",
+			live: role("get"),
+			head: role("get", "list"),
+			gvk:  schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "Role"},
+			wantDiff: multiline(
+				"",
+				"*** role.rbac.authorization.k8s.io `default/foo' (rules changed) ***",
+				"--- live",
+				"+++ head",
+				"@@ -4,10 +4,11 @@",
+				"   name: foo",
+				"   namespace: default",
+				" rules:",
+				" - verbs:",
+				"   - get",
+				"+  - list",
+				"   apiGroups:",
+				"   - \"\"",
+				"   resources:",
+				"   - secrets",
+				" ",
+				""),
+		},
+		{
+			name: "New object without security fields",
+			head: configMap,
+			gvk:  schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := printUnifiedDiff(&b, tc.live, tc.head, tc.gvk, "default/foo", diffOptions{security: DefaultSecurityFilter}); err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.wantDiff, b.String()); d != "" {
+				t.Errorf("Unexpected diff (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestLoadSecurityFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isopod-security")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name    string
+		data    string
+		want    *SecurityFilter
+		wantErr bool
+	}{
+		{
+			name: "Both lists",
+			data: "kinds: [ClusterRole]\nfields: [image]\n",
+			want: &SecurityFilter{Kinds: []string{"ClusterRole"}, Fields: []string{"image"}},
+		},
+		{
+			name: "Default kinds",
+			data: "fields: [image]\n",
+			want: &SecurityFilter{Kinds: DefaultSecurityFilter.Kinds, Fields: []string{"image"}},
+		},
+		{
+			name:    "Unknown key",
+			data:    "kind: [ClusterRole]\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, "security.yaml")
+			if err := ioutil.WriteFile(path, []byte(tc.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadSecurityFilter(path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected filter (-want +got):\n%s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+	goyaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+const (
+	redacted                 = "<redacted>"
+	lastAppliedAnnotationKey = "kubectl.kubernetes.io/last-applied-configuration"
+	snapshotUnknownAddon     = "_unknown"
+	snapshotClusterScopedDir = "_cluster"
+	// snapshotCreatedFile lists objects created by the run (which have no
+	// snapshot) in the directory of each addon.
+	snapshotCreatedFile = "_created.yaml"
+)
+
+// unsafePathChars matches characters not allowed in snapshot file names.
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// snapshotter writes live state of objects to files before they are first
+// updated or deleted within a run.
+type snapshotter struct {
+	dir      string
+	maxBytes int64
+	// secrets keeps Secret data in snapshots (redacted by default).
+	secrets bool
+
+	mu      sync.Mutex
+	written int64
+	// seen are objects (keyed by namespace and file name) snapshotted or
+	// skipped so far.
+	seen    map[string]bool
+	skipped int
+	// created are objects created within the run by addon.
+	created map[string][]store.ObjRef
+}
+
+// snapshotLive writes live (the state of the object of r before it is
+// mutated) under the snapshot directory of the addon being applied. Only
+// the first state of each object within the run is written. Objects
+// exceeding the size bound are skipped with a warning. No-op in dry run or
+// if snapshots are disabled. live is also recorded for rollback if the addon
+// is installed atomically (see recordPrior).
+func (m *kubePackage) snapshotLive(ctx context.Context, r *apiResource, live runtime.Object) error {
+	if err := m.recordPrior(ctx, r, live); err != nil {
+		return err
+	}
+	s := m.snapshot
+	if s == nil || live == nil || m.isDryRun(ctx) {
+		return nil
+	}
+
+	obj, err := toUnstructured(live)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot %v: %v", r, err)
+	}
+	obj.SetAPIVersion(r.GVK.GroupVersion().String())
+	obj.SetKind(r.GVK.Kind)
+	if !s.secrets && r.GVK.Group == "" && r.GVK.Kind == "Secret" {
+		redactSecret(obj)
+	}
+	bs, err := yaml.Marshal(obj.Object)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot %v: %v", r, err)
+	}
+
+	addonName, _ := ctx.Value(diffAddonKey{}).(string)
+	if addonName == "" {
+		addonName = snapshotUnknownAddon
+	}
+	key := snapshotKey(r)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen[key] {
+		return nil
+	}
+	if s.seen == nil {
+		s.seen = map[string]bool{}
+	}
+	s.seen[key] = true
+	if s.maxBytes > 0 && s.written+int64(len(bs)) > s.maxBytes {
+		s.skipped++
+		log.Warningf("%v not snapshotted: snapshots of %s would exceed %d bytes (%d objects skipped)", r, m.Master, s.maxBytes, s.skipped)
+		return nil
+	}
+
+	path := filepath.Join(s.dir, safePath(snapshotHost(m.Master)), safePath(addonName), key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to snapshot %v: %v", r, err)
+	}
+	if err := ioutil.WriteFile(path, bs, 0600); err != nil {
+		return fmt.Errorf("failed to snapshot %v: %v", r, err)
+	}
+	s.written += int64(len(bs))
+	log.V(1).Infof("Snapshotted %v to %s", r, path)
+	return nil
+}
+
+// snapshotKey returns the path of the snapshot of r relative to the
+// directory of its addon.
+func snapshotKey(r *apiResource) string {
+	ns := r.Namespace
+	if ns == "" {
+		ns = snapshotClusterScopedDir
+	}
+	group := r.GVK.Group
+	if group == "" {
+		group = "core"
+	}
+	return filepath.Join(ns, safePath(fmt.Sprintf("%s.%s.%s.yaml", strings.ToLower(r.GVK.Kind), group, r.Name)))
+}
+
+// recordCreated records r as created by the addon being applied, listing it
+// in the snapshot directory of the addon so that restoring the run deletes
+// it. Objects snapshotted earlier in the run (e.g deleted and created again)
+// existed before it and are not recorded. Objects relying on
+// .metadata.generateName (pruned separately) and subresources are ignored.
+// No-op in dry run or if snapshots are disabled. r is also recorded for
+// rollback if the addon is installed atomically (see recordTxCreated).
+func (m *kubePackage) recordCreated(ctx context.Context, r *apiResource) error {
+	m.recordTxCreated(ctx, r)
+	s := m.snapshot
+	if s == nil || r.Name == "" || r.Subresource != "" || m.isDryRun(ctx) {
+		return nil
+	}
+
+	addonName, _ := ctx.Value(diffAddonKey{}).(string)
+	if addonName == "" {
+		addonName = snapshotUnknownAddon
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen[snapshotKey(r)] {
+		return nil
+	}
+	if s.created == nil {
+		s.created = map[string][]store.ObjRef{}
+	}
+	s.created[addonName] = append(s.created[addonName], store.ObjRef{
+		APIVersion: r.GVK.GroupVersion().String(),
+		Kind:       r.GVK.Kind,
+		Namespace:  r.Namespace,
+		Name:       r.Name,
+	})
+	bs, err := goyaml.Marshal(s.created[addonName])
+	if err != nil {
+		return fmt.Errorf("failed to record %v as created: %v", r, err)
+	}
+
+	path := filepath.Join(s.dir, safePath(snapshotHost(m.Master)), safePath(addonName), snapshotCreatedFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to record %v as created: %v", r, err)
+	}
+	if err := ioutil.WriteFile(path, bs, 0600); err != nil {
+		return fmt.Errorf("failed to record %v as created: %v", r, err)
+	}
+	return nil
+}
+
+func toUnstructured(obj runtime.Object) (*unstructured.Unstructured, error) {
+	if un, ok := obj.(*unstructured.Unstructured); ok {
+		return un.DeepCopy(), nil
+	}
+	m, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: m}, nil
+}
+
+// redactSecret replaces values of Secret obj (including the last applied
+// configuration, which embeds them) with a placeholder. Keys are kept.
+func redactSecret(obj *unstructured.Unstructured) {
+	for _, field := range []string{"data", "stringData"} {
+		data, found, _ := unstructured.NestedMap(obj.Object, field)
+		if !found {
+			continue
+		}
+		for k := range data {
+			data[k] = redacted
+		}
+		unstructured.SetNestedMap(obj.Object, data, field)
+	}
+	if as := obj.GetAnnotations(); as[lastAppliedAnnotationKey] != "" {
+		as[lastAppliedAnnotationKey] = redacted
+		obj.SetAnnotations(as)
+	}
+}
+
+// snapshotHost returns host:port of master address addr (addr if it can't
+// be told).
+func snapshotHost(addr string) string {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		addr = addr[i+3:]
+	}
+	return strings.TrimSuffix(addr, "/")
+}
+
+func safePath(s string) string {
+	return unsafePathChars.ReplaceAllString(s, "_")
+}
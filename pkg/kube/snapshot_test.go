@@ -0,0 +1,168 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+const (
+	snapshotFoo = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: default
+data:
+  key: v1
+`
+	snapshotFooChanged = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: default
+data:
+  key: v2
+`
+	snapshotSecret = `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: creds
+  namespace: default
+stringData:
+  password: hunter2
+`
+)
+
+func TestSnapshot(t *testing.T) {
+	newKube, closeFn, err := NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	ctx := context.Background()
+	eval := func(k starlark.HasAttrs, expr string, data ...string) {
+		var vs []starlark.Value
+		for _, d := range data {
+			vs = append(vs, starlark.String(d))
+		}
+		thread := &starlark.Thread{}
+		thread.SetLocal(addon.GoCtxKey, ctx)
+		thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+		thread.SetLocal(addon.NameKey, "app")
+		env := starlark.StringDict{"kube": k, "data": starlark.NewList(vs)}
+		if _, err := starlark.Eval(thread, t.Name(), expr, env); err != nil {
+			t.Fatalf("Failed to eval `%s': %v", expr, err)
+		}
+	}
+	// snapshots returns contents of snapshot files in dir by their paths
+	// relative to the host directory.
+	snapshots := func(dir string) map[string]string {
+		got := map[string]string{}
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			bs, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(dir, path)
+			// Drop the host directory.
+			got[rel[strings.Index(rel, "/")+1:]] = string(bs)
+			return nil
+		})
+		return got
+	}
+
+	for _, tc := range []struct {
+		name      string
+		maxBytes  int64
+		secrets   bool
+		wantFiles []string
+		wantData  string
+	}{
+		{
+			name: "Redacted",
+			wantFiles: []string{
+				"app/default/configmap.core.foo.yaml",
+				"app/default/secret.core.creds.yaml",
+			},
+			wantData: "password: <redacted>",
+		},
+		{
+			name:    "Secrets kept",
+			secrets: true,
+			wantFiles: []string{
+				"app/default/configmap.core.foo.yaml",
+				"app/default/secret.core.creds.yaml",
+			},
+			wantData: "hunter2",
+		},
+		{
+			name:     "Size bound",
+			maxBytes: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "isopod-snapshot")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			eval(newKube(), "kube.put_yaml(data=data)", snapshotFoo, snapshotSecret)
+			defer eval(newKube(), `kube.delete(configmap="default/foo")`)
+
+			k := newKube(WithSnapshot(dir, tc.maxBytes, tc.secrets))
+			eval(k, "kube.put_yaml(data=data)", snapshotFooChanged)
+			eval(k, `kube.delete(secret="default/creds")`)
+			eval(k, "kube.put_yaml(data=data)", snapshotFoo)
+
+			got := snapshots(dir)
+			var files []string
+			for f := range got {
+				files = append(files, f)
+			}
+			sort.Strings(files)
+			if d := cmp.Diff(tc.wantFiles, files); d != "" {
+				t.Fatalf("Unexpected snapshots (-want +got):\n%s", d)
+			}
+			if len(files) == 0 {
+				return
+			}
+			if foo := got[files[0]]; !strings.Contains(foo, "key: v1") {
+				t.Errorf("Expected state before the first update, got:\n%s", foo)
+			}
+			if creds := got[files[1]]; !strings.Contains(creds, tc.wantData) {
+				t.Errorf("Expected secret snapshot to contain %q, got:\n%s", tc.wantData, creds)
+			}
+		})
+	}
+}
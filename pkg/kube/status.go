@@ -0,0 +1,281 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// StatusReader is implemented by the kube package to read back status of
+// applied objects.
+type StatusReader interface {
+	// ReadStatus returns summaries of live status of workloads, Services
+	// and PersistentVolumeClaims in refs (other kinds are skipped). Objects
+	// that failed to be read (or weren't read before ctx is done) are
+	// reported with unknown status.
+	ReadStatus(ctx context.Context, refs []store.ObjRef) []ObjStatus
+}
+
+// ObjStatus is a summary of status of a live object.
+type ObjStatus struct {
+	Ref store.ObjRef
+	// Status is a short human-readable summary, e.g "2/3 ready".
+	Status string
+	// Healthy is set if the object is done rolling out (see isHealthy).
+	Healthy bool
+}
+
+// String returns status prefixed with the object's kind and name.
+func (s ObjStatus) String() string {
+	gv, _ := schema.ParseGroupVersion(s.Ref.APIVersion)
+	return fmt.Sprintf("%s%s `%s': %s", strings.ToLower(s.Ref.Kind), maybeCore(gv.Group), maybeNamespaced(s.Ref.Name, s.Ref.Namespace), s.Status)
+}
+
+// statusKinds are kinds (by group) whose status is read back.
+var statusKinds = map[schema.GroupKind]bool{
+	{Group: "apps", Kind: "Deployment"}:  true,
+	{Group: "apps", Kind: "StatefulSet"}: true,
+	{Group: "apps", Kind: "DaemonSet"}:   true,
+	{Group: "apps", Kind: "ReplicaSet"}:  true,
+	{Group: "batch", Kind: "Job"}:        true,
+	{Kind: "Pod"}:                        true,
+	{Kind: "Service"}:                    true,
+	{Kind: "PersistentVolumeClaim"}:      true,
+}
+
+// ReadStatus implements StatusReader.
+func (m *kubePackage) ReadStatus(ctx context.Context, refs []store.ObjRef) []ObjStatus {
+	var todo []store.ObjRef
+	for _, ref := range refs {
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err == nil && statusKinds[gv.WithKind(ref.Kind).GroupKind()] {
+			todo = append(todo, ref)
+		}
+	}
+	if len(todo) == 0 {
+		return nil
+	}
+
+	// Dynamic client calls can't be cancelled so give up waiting on them
+	// once ctx is done.
+	ch := make(chan ObjStatus, len(todo))
+	go func() {
+		for _, ref := range todo {
+			if ctx.Err() != nil {
+				return
+			}
+			status, healthy, err := m.readStatus(ref)
+			if err != nil {
+				status = fmt.Sprintf("unknown (%v)", err)
+			}
+			ch <- ObjStatus{Ref: ref, Status: status, Healthy: healthy}
+		}
+	}()
+
+	var out []ObjStatus
+	for len(out) < len(todo) {
+		select {
+		case s := <-ch:
+			out = append(out, s)
+		case <-ctx.Done():
+			for _, ref := range todo[len(out):] {
+				out = append(out, ObjStatus{Ref: ref, Status: fmt.Sprintf("unknown (%v)", ctx.Err())})
+			}
+		}
+	}
+	return out
+}
+
+// readStatus reads back live status of object ref, summarizes it and tells
+// whether it is healthy.
+func (m *kubePackage) readStatus(ref store.ObjRef) (string, bool, error) {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return "", false, err
+	}
+	r, err := newResourceForKind(m.dClient, ref.Name, ref.Namespace, "", gv.WithKind(ref.Kind))
+	if err != nil {
+		return "", false, err
+	}
+
+	obj, err := m.getUnstructured(r.GroupVersionResource(), r.Namespace, r.Name)
+	if apierrors.IsNotFound(err) {
+		return "not found", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	var endpoints *unstructured.Unstructured
+	if ref.Kind == "Service" && ref.APIVersion == "v1" {
+		endpoints, err = m.getUnstructured(schema.GroupVersionResource{Version: "v1", Resource: "endpoints"}, r.Namespace, r.Name)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return "", false, err
+		}
+	}
+	return summarizeStatus(obj, endpoints), isHealthy(obj), nil
+}
+
+func (m *kubePackage) getUnstructured(gvr schema.GroupVersionResource, namespace, name string) (*unstructured.Unstructured, error) {
+	var c dynamic.ResourceInterface = m.dynClient.Resource(gvr)
+	if namespace != "" {
+		c = c.(dynamic.NamespaceableResourceInterface).Namespace(namespace)
+	}
+	return c.Get(name, metav1.GetOptions{})
+}
+
+// summarizeStatus returns a short summary of key status fields of obj.
+// endpoints are Endpoints of obj if it's a Service (nil if not found).
+func summarizeStatus(obj, endpoints *unstructured.Unstructured) string {
+	o := obj.Object
+	num := func(fields ...string) int64 {
+		v, _, _ := unstructured.NestedInt64(o, fields...)
+		return v
+	}
+	str := func(fields ...string) string {
+		v, _, _ := unstructured.NestedString(o, fields...)
+		return v
+	}
+
+	var parts []string
+	switch obj.GetKind() {
+	case "Deployment", "StatefulSet", "ReplicaSet":
+		replicas, found, _ := unstructured.NestedInt64(o, "spec", "replicas")
+		if !found {
+			replicas = 1
+		}
+		parts = append(parts, fmt.Sprintf("%d/%d ready", num("status", "readyReplicas"), replicas))
+		if obj.GetKind() != "ReplicaSet" {
+			parts = append(parts, fmt.Sprintf("%d updated", num("status", "updatedReplicas")))
+		}
+		if obj.GetKind() == "Deployment" {
+			parts = append(parts, fmt.Sprintf("%d available", num("status", "availableReplicas")))
+		}
+	case "DaemonSet":
+		parts = append(parts,
+			fmt.Sprintf("%d/%d ready", num("status", "numberReady"), num("status", "desiredNumberScheduled")),
+			fmt.Sprintf("%d updated", num("status", "updatedNumberScheduled")),
+			fmt.Sprintf("%d available", num("status", "numberAvailable")))
+	case "Job":
+		parts = append(parts,
+			fmt.Sprintf("%d succeeded", num("status", "succeeded")),
+			fmt.Sprintf("%d active", num("status", "active")),
+			fmt.Sprintf("%d failed", num("status", "failed")))
+	case "Pod", "PersistentVolumeClaim":
+		phase := str("status", "phase")
+		if phase == "" {
+			phase = "Unknown"
+		}
+		parts = append(parts, phase)
+	case "Service":
+		parts = append(parts, str("spec", "type"))
+		if endpoints != nil {
+			subsets, _, _ := unstructured.NestedSlice(endpoints.Object, "subsets")
+			var ready, notReady int
+			for _, s := range subsets {
+				sm, _ := s.(map[string]interface{})
+				as, _, _ := unstructured.NestedSlice(sm, "addresses")
+				nas, _, _ := unstructured.NestedSlice(sm, "notReadyAddresses")
+				ready += len(as)
+				notReady += len(nas)
+			}
+			parts = append(parts, fmt.Sprintf("%d endpoints ready", ready))
+			if notReady > 0 {
+				parts = append(parts, fmt.Sprintf("%d not ready", notReady))
+			}
+		}
+		ingress, _, _ := unstructured.NestedSlice(o, "status", "loadBalancer", "ingress")
+		for _, i := range ingress {
+			im, _ := i.(map[string]interface{})
+			if ip, _, _ := unstructured.NestedString(im, "ip"); ip != "" {
+				parts = append(parts, "ingress "+ip)
+			} else if h, _, _ := unstructured.NestedString(im, "hostname"); h != "" {
+				parts = append(parts, "ingress "+h)
+			}
+		}
+	}
+
+	if observed, found, _ := unstructured.NestedInt64(o, "status", "observedGeneration"); found && observed < obj.GetGeneration() {
+		parts = append(parts, "update not yet observed")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// isHealthy returns whether obj is done rolling out: all replicas of
+// workloads are updated and ready (and observed by their controller), Jobs
+// have all completions succeeded, Pods are running (or succeeded), claims
+// are bound and LoadBalancer Services have an ingress.
+func isHealthy(obj *unstructured.Unstructured) bool {
+	o := obj.Object
+	num := func(fields ...string) int64 {
+		v, _, _ := unstructured.NestedInt64(o, fields...)
+		return v
+	}
+	str := func(fields ...string) string {
+		v, _, _ := unstructured.NestedString(o, fields...)
+		return v
+	}
+	if observed, found, _ := unstructured.NestedInt64(o, "status", "observedGeneration"); found && observed < obj.GetGeneration() {
+		return false
+	}
+
+	switch obj.GetKind() {
+	case "Deployment", "StatefulSet", "ReplicaSet":
+		replicas, found, _ := unstructured.NestedInt64(o, "spec", "replicas")
+		if !found {
+			replicas = 1
+		}
+		if num("status", "readyReplicas") < replicas {
+			return false
+		}
+		if obj.GetKind() != "ReplicaSet" && num("status", "updatedReplicas") < replicas {
+			return false
+		}
+		return obj.GetKind() != "Deployment" || num("status", "availableReplicas") >= replicas
+	case "DaemonSet":
+		desired := num("status", "desiredNumberScheduled")
+		return num("status", "numberReady") >= desired &&
+			num("status", "updatedNumberScheduled") >= desired &&
+			num("status", "numberAvailable") >= desired
+	case "Job":
+		completions, found, _ := unstructured.NestedInt64(o, "spec", "completions")
+		if !found {
+			completions = 1
+		}
+		return num("status", "succeeded") >= completions
+	case "Pod":
+		phase := str("status", "phase")
+		return phase == "Running" || phase == "Succeeded"
+	case "PersistentVolumeClaim":
+		return str("status", "phase") == "Bound"
+	case "Service":
+		if str("spec", "type") != "LoadBalancer" {
+			return true
+		}
+		ingress, _, _ := unstructured.NestedSlice(o, "status", "loadBalancer", "ingress")
+		return len(ingress) > 0
+	}
+	return true
+}
@@ -0,0 +1,350 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+func TestSummarizeStatus(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		obj       string
+		endpoints string
+		want      string
+	}{
+		{
+			desc: "Deployment rolling out",
+			obj: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+  generation: 3
+spec:
+  replicas: 3
+status:
+  observedGeneration: 3
+  readyReplicas: 2
+  updatedReplicas: 3
+  availableReplicas: 2
+`,
+			want: "2/3 ready, 3 updated, 2 available",
+		},
+		{
+			desc: "Deployment update not observed",
+			obj: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+  generation: 4
+status:
+  observedGeneration: 3
+  readyReplicas: 1
+  updatedReplicas: 1
+  availableReplicas: 1
+`,
+			want: "1/1 ready, 1 updated, 1 available, update not yet observed",
+		},
+		{
+			desc: "StatefulSet",
+			obj: `
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: foo
+spec:
+  replicas: 2
+status:
+  readyReplicas: 2
+  updatedReplicas: 2
+`,
+			want: "2/2 ready, 2 updated",
+		},
+		{
+			desc: "DaemonSet",
+			obj: `
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: foo
+status:
+  desiredNumberScheduled: 5
+  numberReady: 4
+  updatedNumberScheduled: 5
+  numberAvailable: 4
+`,
+			want: "4/5 ready, 5 updated, 4 available",
+		},
+		{
+			desc: "Job",
+			obj: `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: foo
+status:
+  succeeded: 1
+  failed: 2
+`,
+			want: "1 succeeded, 0 active, 2 failed",
+		},
+		{
+			desc: "PersistentVolumeClaim",
+			obj: `
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: foo
+status:
+  phase: Bound
+`,
+			want: "Bound",
+		},
+		{
+			desc: "Pod with no status",
+			obj: `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: foo
+`,
+			want: "Unknown",
+		},
+		{
+			desc: "Service with endpoints and load balancer",
+			obj: `
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+spec:
+  type: LoadBalancer
+status:
+  loadBalancer:
+    ingress:
+    - ip: 1.2.3.4
+    - hostname: foo.example.com
+`,
+			endpoints: `
+apiVersion: v1
+kind: Endpoints
+metadata:
+  name: foo
+subsets:
+- addresses:
+  - ip: 10.0.0.1
+  - ip: 10.0.0.2
+  notReadyAddresses:
+  - ip: 10.0.0.3
+- addresses:
+  - ip: 10.0.0.4
+`,
+			want: "LoadBalancer, 3 endpoints ready, 1 not ready, ingress 1.2.3.4, ingress foo.example.com",
+		},
+		{
+			desc: "Service with no endpoints",
+			obj: `
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+spec:
+  type: ClusterIP
+`,
+			want: "ClusterIP",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			obj := mustUnstructured(t, tc.obj)
+			var endpoints *unstructured.Unstructured
+			if tc.endpoints != "" {
+				endpoints = mustUnstructured(t, tc.endpoints)
+			}
+			if d := cmp.Diff(tc.want, summarizeStatus(obj, endpoints)); d != "" {
+				t.Errorf("Unexpected status (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestReadStatusTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	m := &kubePackage{}
+	got := m.ReadStatus(ctx, []store.ObjRef{
+		{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "foo"},
+		{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: "foo"},
+		{APIVersion: "v1", Kind: "Service", Namespace: "default", Name: "foo"},
+	})
+
+	var lines []string
+	for _, s := range got {
+		lines = append(lines, s.String())
+	}
+	want := []string{
+		"deployment.apps `default/foo': unknown (context canceled)",
+		"service.v1 `default/foo': unknown (context canceled)",
+	}
+	if d := cmp.Diff(want, lines); d != "" {
+		t.Errorf("Unexpected statuses (-want +got):\n%s", d)
+	}
+}
+
+func mustUnstructured(t *testing.T, s string) *unstructured.Unstructured {
+	j, err := yaml.YAMLToJSON([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(j); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func TestIsHealthy(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		obj  string
+		want bool
+	}{
+		{
+			desc: "Deployment rolled out",
+			obj: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+  generation: 3
+spec:
+  replicas: 2
+status:
+  observedGeneration: 3
+  readyReplicas: 2
+  updatedReplicas: 2
+  availableReplicas: 2
+`,
+			want: true,
+		},
+		{
+			desc: "Deployment rolling out",
+			obj: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+spec:
+  replicas: 2
+status:
+  readyReplicas: 2
+  updatedReplicas: 1
+  availableReplicas: 2
+`,
+		},
+		{
+			desc: "Deployment update not observed",
+			obj: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+  generation: 4
+status:
+  observedGeneration: 3
+  readyReplicas: 1
+  updatedReplicas: 1
+  availableReplicas: 1
+`,
+		},
+		{
+			desc: "DaemonSet not ready",
+			obj: `
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: foo
+status:
+  desiredNumberScheduled: 5
+  numberReady: 4
+  updatedNumberScheduled: 5
+  numberAvailable: 4
+`,
+		},
+		{
+			desc: "Job completed",
+			obj: `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: foo
+spec:
+  completions: 2
+status:
+  succeeded: 2
+`,
+			want: true,
+		},
+		{
+			desc: "Pending Pod",
+			obj: `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: foo
+status:
+  phase: Pending
+`,
+		},
+		{
+			desc: "LoadBalancer without ingress",
+			obj: `
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+spec:
+  type: LoadBalancer
+`,
+		},
+		{
+			desc: "ClusterIP Service",
+			obj: `
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+spec:
+  type: ClusterIP
+`,
+			want: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := isHealthy(mustUnstructured(t, tc.obj)); got != tc.want {
+				t.Errorf("Want healthy: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
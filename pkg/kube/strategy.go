@@ -0,0 +1,145 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	yaml "gopkg.in/yaml.v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+// applyStrategyKey is a context key of the addon.ApplyStrategy of the addon
+// whose objects are being applied (see withApplyStrategy).
+type applyStrategyKey struct{}
+
+// withApplyStrategy returns ctx annotated with apply strategy s (a
+// thread-local addon.ApplyStrategyKey value, if any).
+func withApplyStrategy(ctx context.Context, s interface{}) context.Context {
+	st, _ := s.(addon.ApplyStrategy)
+	return context.WithValue(ctx, applyStrategyKey{}, st)
+}
+
+// applyStrategy returns apply strategy of ctx (addon.ApplyStrategyApply if
+// not set).
+func applyStrategy(ctx context.Context) addon.ApplyStrategy {
+	if st, _ := ctx.Value(applyStrategyKey{}).(addon.ApplyStrategy); st != "" {
+		return st
+	}
+	return addon.ApplyStrategyApply
+}
+
+// mergeForStrategy merges fields of live object into obj (see mergeObjects)
+// as required by the apply strategy of ctx. Returns true if live must be
+// recreated instead of updated (see recreatedFields), never in dry run or
+// for subresources.
+func (m *kubePackage) mergeForStrategy(ctx context.Context, r *apiResource, live, obj runtime.Object) (recreate bool, err error) {
+	st := applyStrategy(ctx)
+	if st == addon.ApplyStrategyRecreate && r.Subresource == "" {
+		fields, err := recreatedFields(r.GVK, live, obj)
+		if err != nil {
+			return false, fmt.Errorf("failed to compare %v with live object: %v", r, err)
+		}
+		if len(fields) > 0 {
+			if !m.isDryRun(ctx) {
+				return true, nil
+			}
+			log.Infof("%v would be recreated for immutable %s (`%s' apply strategy)", r, strings.Join(fields, ", "), st)
+		}
+	}
+
+	if st == addon.ApplyStrategyMerge && r.Subresource == "" {
+		if err := mergeThreeWay(live, obj); err != nil {
+			return false, fmt.Errorf("failed to merge %v into live object: %v", r, err)
+		}
+	}
+	if err := mergeObjects(live, obj); err != nil {
+		return false, err
+	}
+	if st == addon.ApplyStrategyReplace {
+		// Overwrite regardless of concurrent modifications.
+		obj.(metav1.Object).SetResourceVersion("")
+	}
+	return false, nil
+}
+
+// recreatedFields returns paths of immutable fields (see immutableFields) that
+// obj of gvk kind changes in live, requiring it to be recreated with
+// addon.ApplyStrategyRecreate. Namespaces and CRDs are never recreated as
+// that would delete everything in them (returns nothing).
+func recreatedFields(gvk schema.GroupVersionKind, live, obj runtime.Object) ([]string, error) {
+	if !recreatable(gvk) {
+		return nil, nil
+	}
+	var l, r map[string]interface{}
+	for _, o := range []struct {
+		obj runtime.Object
+		out *map[string]interface{}
+	}{{live, &l}, {obj, &r}} {
+		s, err := renderObj(o.obj.DeepCopyObject(), &gvk, true)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal([]byte(s), o.out); err != nil {
+			return nil, err
+		}
+	}
+	return immutableChanges(l, r), nil
+}
+
+// recreatable returns true if objects of gvk kind may be recreated.
+func recreatable(gvk schema.GroupVersionKind) bool {
+	return !isCRD(gvk) && !(gvk.Group == "" && gvk.Kind == "Namespace")
+}
+
+// deleteForRecreate deletes live object of r in the foreground and waits
+// until it (and its dependents) are gone so that it can be created anew.
+func (m *kubePackage) deleteForRecreate(ctx context.Context, r *apiResource) error {
+	var c dynamic.ResourceInterface = m.dynClient.Resource(r.GroupVersionResource())
+	if r.Namespace != "" {
+		c = c.(dynamic.NamespaceableResourceInterface).Namespace(r.Namespace)
+	}
+
+	log.Infof("Deleting %v to recreate it", r)
+	policy := metav1.DeletePropagationForeground
+	if err := c.Delete(r.Name, &metav1.DeleteOptions{PropagationPolicy: &policy}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete %v to recreate it: %v", r, err)
+	}
+
+	for {
+		_, found, err := m.kubePeek(ctx, m.Master+r.PathWithName())
+		if err != nil {
+			return err
+		}
+		if !found {
+			return nil
+		}
+		select {
+		case <-time.After(waitRetryInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("%v not recreated: %v", r, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"go.starlark.net/starlark"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+func TestMergeForStrategy(t *testing.T) {
+	configMapGVK := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	secretGVK := schema.GroupVersionKind{Version: "v1", Kind: "Secret"}
+	crdGVK := schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1beta1", Kind: "CustomResourceDefinition"}
+	for _, tc := range []struct {
+		name         string
+		strategy     interface{}
+		gvk          schema.GroupVersionKind
+		live, obj    runtime.Object
+		subresource  string
+		dryRun       bool
+		wantRecreate bool
+		wantRV       string
+	}{
+		{name: "Default", strategy: nil, wantRV: "42"},
+		{name: "Apply", strategy: addon.ApplyStrategyApply, wantRV: "42"},
+		{name: "Replace", strategy: addon.ApplyStrategyReplace, wantRV: ""},
+		{name: "Recreate unchanged", strategy: addon.ApplyStrategyRecreate, wantRV: "42"},
+		{
+			name:     "Recreate mutable change",
+			strategy: addon.ApplyStrategyRecreate,
+			obj:      &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "foo"}, Data: map[string]string{"key": "v2"}},
+			wantRV:   "42",
+		},
+		{
+			name:         "Recreate immutable change",
+			strategy:     addon.ApplyStrategyRecreate,
+			gvk:          secretGVK,
+			live:         &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "foo", ResourceVersion: "42"}, Type: corev1.SecretTypeOpaque},
+			obj:          &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "foo"}, Type: corev1.SecretTypeTLS},
+			wantRecreate: true,
+		},
+		{
+			name:     "Recreate immutable change in dry run",
+			strategy: addon.ApplyStrategyRecreate,
+			gvk:      secretGVK,
+			live:     &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "foo", ResourceVersion: "42"}, Type: corev1.SecretTypeOpaque},
+			obj:      &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "foo"}, Type: corev1.SecretTypeTLS},
+			dryRun:   true,
+			wantRV:   "42",
+		},
+		{
+			name:     "Recreate immutable change of subresource",
+			strategy: addon.ApplyStrategyRecreate,
+			gvk:      secretGVK,
+			live:     &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "foo", ResourceVersion: "42"}, Type: corev1.SecretTypeOpaque},
+			obj:      &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "foo"}, Type: corev1.SecretTypeTLS},
+			// Not a real Secret subresource, exercises the guard only.
+			subresource: "scale",
+			wantRV:      "42",
+		},
+		{
+			name:     "Recreate CRD",
+			strategy: addon.ApplyStrategyRecreate,
+			gvk:      crdGVK,
+			live: &apiextensionsv1beta1.CustomResourceDefinition{
+				ObjectMeta: metav1.ObjectMeta{Name: "foos.example.com", ResourceVersion: "42"},
+				Spec:       apiextensionsv1beta1.CustomResourceDefinitionSpec{Group: "example.com"},
+			},
+			obj: &apiextensionsv1beta1.CustomResourceDefinition{
+				ObjectMeta: metav1.ObjectMeta{Name: "foos.example.com"},
+				Spec:       apiextensionsv1beta1.CustomResourceDefinitionSpec{Group: "example.org"},
+			},
+			wantRV: "42",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.gvk.Empty() {
+				tc.gvk = configMapGVK
+			}
+			if tc.live == nil {
+				tc.live = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "foo", ResourceVersion: "42"}}
+			}
+			if tc.obj == nil {
+				tc.obj = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "foo"}}
+			}
+			m := &kubePackage{dryRun: tc.dryRun}
+			r := &apiResource{
+				GVK:         tc.gvk,
+				Name:        "foo",
+				Namespace:   "default",
+				Subresource: tc.subresource,
+			}
+
+			ctx := withApplyStrategy(context.Background(), tc.strategy)
+			recreate, err := m.mergeForStrategy(ctx, r, tc.live, tc.obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recreate != tc.wantRecreate {
+				t.Errorf("Unexpected recreate, want %v got %v", tc.wantRecreate, recreate)
+			}
+			if got := tc.obj.(metav1.Object).GetResourceVersion(); got != tc.wantRV {
+				t.Errorf("Unexpected resource version, want %q got %q", tc.wantRV, got)
+			}
+		})
+	}
+}
+
+func TestPutYamlRecreate(t *testing.T) {
+	newKube, closeFn, err := NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+	k := newKube()
+
+	eval := func(expr string, st addon.ApplyStrategy, data ...string) starlark.Value {
+		var vs []starlark.Value
+		for _, d := range data {
+			vs = append(vs, starlark.String(d))
+		}
+		thread := &starlark.Thread{}
+		thread.SetLocal(addon.GoCtxKey, context.Background())
+		thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+		thread.SetLocal(addon.NameKey, "app")
+		thread.SetLocal(addon.ApplyStrategyKey, st)
+		env := starlark.StringDict{"kube": k, "data": starlark.NewList(vs)}
+		v, err := starlark.Eval(thread, t.Name(), expr, env)
+		if err != nil {
+			t.Fatalf("Failed to eval `%s': %v", expr, err)
+		}
+		return v
+	}
+
+	eval("kube.put_yaml(data=data)", addon.ApplyStrategyRecreate, snapshotFoo)
+	eval("kube.put_yaml(data=data)", addon.ApplyStrategyRecreate, snapshotFooChanged)
+	got := eval(`kube.get(configmap="default/foo")`, addon.ApplyStrategyApply)
+	data, err := got.(starlark.HasAttrs).Attr("data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := data.String(); s != `{"key": "v2"}` {
+		t.Errorf("Expected updated object to have new data, got: %s", s)
+	}
+}
@@ -22,15 +22,25 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 
 	"github.com/stripe/skycfg"
+
+	"github.com/cruise-automation/isopod/pkg/util"
 )
 
 // resourceQuantityFn returns a starlark.Value that represents
 // *resource.Quantity (implements msg.Proto).
 func resourceQuantityFn(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
-	var v string
-	if err := starlark.UnpackPositionalArgs(b.Name(), args, nil, 1, &v); err != nil {
+	var sv starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, nil, 1, &sv); err != nil {
 		return nil, err
 	}
+	if uq, ok := sv.(*util.Quantity); ok {
+		q := uq.Quantity()
+		return skycfg.NewProtoMessage(&q), nil
+	}
+	v, ok := starlark.AsString(sv)
+	if !ok {
+		return nil, fmt.Errorf("%v: expected string or quantity, got %s", b.Name(), sv.Type())
+	}
 
 	q, err := resource.ParseQuantity(v)
 	if err != nil {
@@ -0,0 +1,207 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/golang/glog"
+)
+
+// gitPrefix marks entry file paths that refer to files in git repos, e.g
+// `git::https://github.com/org/addons//clusters/main.ipd?ref=v1.2.0'.
+const gitPrefix = "git::"
+
+// commitRe matches full commit SHAs (refs that never move).
+var commitRe = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// GitSource is a file in a git repo.
+type GitSource struct {
+	// Repo is the URL of the repo (as passed to git clone).
+	Repo string
+	// Path is the path of the file in the repo.
+	Path string
+	// Ref is the branch, tag or commit to check out (the default branch if
+	// empty).
+	Ref string
+}
+
+// ParseGitSource parses s in the form of `git::<repo>//<path>[?ref=<ref>]'.
+// Returns false if s is not prefixed with `git::'.
+func ParseGitSource(s string) (*GitSource, bool, error) {
+	if !strings.HasPrefix(s, gitPrefix) {
+		return nil, false, nil
+	}
+	s = strings.TrimPrefix(s, gitPrefix)
+
+	src := &GitSource{}
+	if i := strings.LastIndex(s, "?"); i >= 0 {
+		q, err := url.ParseQuery(s[i+1:])
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid query of `%s': %v", s, err)
+		}
+		for k := range q {
+			if k != "ref" {
+				return nil, true, fmt.Errorf("unknown parameter `%s' of `%s' (expected ref)", k, s)
+			}
+		}
+		src.Ref = q.Get("ref")
+		s = s[:i]
+	}
+
+	// Skip past the scheme (if any) so that its `//' is not taken for the
+	// path separator.
+	start := 0
+	if i := strings.Index(s, "://"); i >= 0 {
+		start = i + len("://")
+	}
+	i := strings.Index(s[start:], "//")
+	if i < 0 {
+		return nil, true, fmt.Errorf("no path in repo of `%s' (expected <repo>//<path>)", s)
+	}
+	src.Repo, src.Path = s[:start+i], s[start+i+2:]
+	if src.Repo == "" || src.Path == "" {
+		return nil, true, fmt.Errorf("repo and path of `%s' must be set (expected <repo>//<path>)", s)
+	}
+	if filepath.IsAbs(src.Path) || strings.HasPrefix(filepath.Clean(src.Path), "..") {
+		return nil, true, fmt.Errorf("path `%s' must be within the repo", src.Path)
+	}
+	if err := src.validate(); err != nil {
+		return nil, true, err
+	}
+	return src, true, nil
+}
+
+// validate returns an error if repo or ref of s would be taken by git for
+// options (e.g `--upload-pack=...').
+func (s *GitSource) validate() error {
+	if strings.HasPrefix(s.Repo, "-") {
+		return fmt.Errorf("repo `%s' must not start with `-'", s.Repo)
+	}
+	if strings.HasPrefix(s.Ref, "-") {
+		return fmt.Errorf("ref `%s' must not start with `-'", s.Ref)
+	}
+	return nil
+}
+
+func (s *GitSource) String() string {
+	ref := s.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	return fmt.Sprintf("%s//%s at %s", s.Repo, s.Path, ref)
+}
+
+// Fetch shallow-clones s.Ref of the repo to a directory under cacheDir (or
+// updates an existing clone) and returns the local path of s.Path. Clones of
+// commits are reused as-is. If offline is set, the repo is not fetched and
+// the cached clone is used regardless of its age.
+func (s *GitSource) Fetch(cacheDir string, offline bool) (string, error) {
+	if err := s.validate(); err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(s.Repo + "\x00" + s.Ref))
+	dir := filepath.Join(cacheDir, hex.EncodeToString(h[:8]))
+	path := filepath.Join(dir, s.Path)
+
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	cached := err == nil
+	switch {
+	case cached && (offline || commitRe.MatchString(s.Ref)):
+		log.Infof("Using cached clone of %v in `%s'", s, dir)
+	case offline:
+		return "", fmt.Errorf("%v is not cached in `%s' (and network access is disabled)", s, cacheDir)
+	case cached:
+		if err := s.checkout(dir); err != nil {
+			return "", err
+		}
+	default:
+		if err := os.MkdirAll(cacheDir, 0755); err != nil {
+			return "", err
+		}
+		// Clone next to dir and move it in place once complete so that a
+		// failed clone is not taken for a cached one.
+		tmp, err := ioutil.TempDir(cacheDir, ".clone-")
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(tmp)
+		if err := runGit(tmp, "init", "--quiet"); err != nil {
+			return "", err
+		}
+		if err := runGit(tmp, "remote", "add", "--", "origin", s.Repo); err != nil {
+			return "", err
+		}
+		if err := s.checkout(tmp); err != nil {
+			return "", err
+		}
+		if err := os.Rename(tmp, dir); err != nil {
+			return "", err
+		}
+	}
+
+	if commit, err := gitOutput(dir, "rev-parse", "HEAD"); err == nil {
+		log.Infof("Loading `%s' from %v (commit %s)", s.Path, s, commit)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("no `%s' in %v: %v", s.Path, s, err)
+	}
+	return path, nil
+}
+
+// checkout fetches s.Ref (with depth of 1) to repo in dir and checks it out.
+func (s *GitSource) checkout(dir string) error {
+	ref := s.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if err := runGit(dir, "fetch", "--quiet", "--depth", "1", "--", "origin", ref); err != nil {
+		return fmt.Errorf("failed to fetch %v: %v", s, err)
+	}
+	if err := runGit(dir, "checkout", "--quiet", "--force", "FETCH_HEAD"); err != nil {
+		return fmt.Errorf("failed to check out %v: %v", s, err)
+	}
+	return runGit(dir, "clean", "--quiet", "-fdx")
+}
+
+func runGit(dir string, args ...string) error {
+	_, err := gitOutput(dir, args...)
+	return err
+}
+
+// gitOutput runs git with args in dir and returns its (trimmed) output.
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	// Never prompt for credentials (configure a credential helper instead).
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
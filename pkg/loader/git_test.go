@@ -0,0 +1,152 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loader
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseGitSource(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    *GitSource
+		wantOK  bool
+		wantErr string
+	}{
+		{in: "main.ipd"},
+		{
+			in:     "git::https://github.com/org/addons//clusters/main.ipd?ref=v1.2.0",
+			want:   &GitSource{Repo: "https://github.com/org/addons", Path: "clusters/main.ipd", Ref: "v1.2.0"},
+			wantOK: true,
+		},
+		{
+			in:     "git::git@github.com:org/addons.git//main.ipd",
+			want:   &GitSource{Repo: "git@github.com:org/addons.git", Path: "main.ipd"},
+			wantOK: true,
+		},
+		{in: "git::https://github.com/org/addons", wantOK: true, wantErr: "no path in repo"},
+		{in: "git::https://github.com/org/addons//main.ipd?branch=main", wantOK: true, wantErr: "unknown parameter `branch'"},
+		{in: "git::https://github.com/org/addons//../main.ipd", wantOK: true, wantErr: "must be within the repo"},
+		{in: "git::--upload-pack=touch /tmp/pwned;//main.ipd", wantOK: true, wantErr: "repo `--upload-pack=touch /tmp/pwned;' must not start with `-'"},
+		{in: "git::https://github.com/org/addons//main.ipd?ref=--upload-pack=touch", wantOK: true, wantErr: "ref `--upload-pack=touch' must not start with `-'"},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			got, ok, err := ParseGitSource(tc.in)
+			if ok != tc.wantOK {
+				t.Errorf("Want ok=%v, got %v", tc.wantOK, ok)
+			}
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Want error containing %q, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected source (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestGitSourceFetch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "git-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, cache := filepath.Join(dir, "repo"), filepath.Join(dir, "cache")
+	git := func(args ...string) string {
+		out, err := gitOutput(repo, append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	commit := func(content string) string {
+		if err := ioutil.WriteFile(filepath.Join(repo, "clusters", "main.ipd"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", "-A")
+		git("commit", "--quiet", "-m", content)
+		return git("rev-parse", "HEAD")
+	}
+	if err := os.MkdirAll(filepath.Join(repo, "clusters"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	git("init", "--quiet")
+	v1 := commit("v1")
+	git("tag", "v1")
+	commit("v2")
+
+	fetch := func(ref string, offline bool) (string, error) {
+		path, err := (&GitSource{Repo: "file://" + repo, Path: "clusters/main.ipd", Ref: ref}).Fetch(cache, offline)
+		if err != nil {
+			return "", err
+		}
+		b, err := ioutil.ReadFile(path)
+		return string(b), err
+	}
+
+	for _, tc := range []struct {
+		name     string
+		ref      string
+		offline  bool
+		want     string
+		wantErr  string
+		thenPush string
+	}{
+		{name: "Not cached offline", ref: "v1", offline: true, wantErr: "is not cached"},
+		{name: "Option as ref", ref: "--upload-pack=false", wantErr: "must not start with `-'"},
+		{name: "Tag", ref: "v1", want: "v1"},
+		{name: "Tag cached offline", ref: "v1", offline: true, want: "v1"},
+		{name: "Commit", ref: v1, want: "v1"},
+		{name: "Default branch", want: "v2", thenPush: "v3"},
+		{name: "Default branch offline", offline: true, want: "v2"},
+		{name: "Default branch updated", want: "v3"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := fetch(tc.ref, tc.offline)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Want error containing %q, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("Want %q fetched, got %q", tc.want, got)
+			}
+			if tc.thenPush != "" {
+				commit(tc.thenPush)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/golang/glog"
+)
+
+// maxModuleSize bounds the size of modules fetched over HTTP(S).
+const maxModuleSize = 10 << 20
+
+// sha256Re matches hex-encoded SHA-256 digests.
+var sha256Re = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// HTTPModule is a module served over HTTP(S) and pinned to the digest of its
+// content, e.g `https://modules.internal/lib/foo.star@sha256:<digest>'.
+type HTTPModule struct {
+	URL string
+	// Digest is the hex-encoded SHA-256 digest of the module.
+	Digest string
+}
+
+func (m *HTTPModule) String() string { return m.URL + "@sha256:" + m.Digest }
+
+// isURL returns true if s is an HTTP(S) URL.
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// ParseHTTPModule parses module in the form of `<url>@sha256:<digest>'
+// loaded by a module at base (relative URLs are resolved against base if it
+// is a URL too).
+func ParseHTTPModule(base, module string) (*HTTPModule, error) {
+	i := strings.LastIndex(module, "@")
+	if i < 0 {
+		return nil, fmt.Errorf("module `%s' must be pinned to the digest of its content (expected <url>@sha256:<digest>)", module)
+	}
+	ref, digest := module[:i], module[i+1:]
+	if !strings.HasPrefix(digest, "sha256:") || !sha256Re.MatchString(strings.TrimPrefix(digest, "sha256:")) {
+		return nil, fmt.Errorf("invalid digest `%s' of module `%s' (expected sha256:<64 hex digits>)", digest, module)
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL of module `%s': %v", module, err)
+	}
+	if !isURL(ref) {
+		if !isURL(base) {
+			return nil, fmt.Errorf("module `%s' must be an http:// or https:// URL", module)
+		}
+		b, err := url.Parse(base)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL `%s' of loading module: %v", base, err)
+		}
+		u = b.ResolveReference(u)
+	}
+	return &HTTPModule{URL: u.String(), Digest: strings.TrimPrefix(digest, "sha256:")}, nil
+}
+
+// remoteModules fetches HTTPModules, caching them by digest in cacheDir (if
+// set).
+type remoteModules struct {
+	client   *http.Client
+	cacheDir string
+	offline  bool
+}
+
+func digestOf(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// fetch returns the content of m from cache or fetches it (unless offline).
+// Fails if the content doesn't match the digest of m.
+func (r *remoteModules) fetch(m *HTTPModule) ([]byte, error) {
+	path := ""
+	if r.cacheDir != "" {
+		path = filepath.Join(r.cacheDir, "sha256", m.Digest)
+		if data, err := ioutil.ReadFile(path); err == nil {
+			if digestOf(data) == m.Digest {
+				log.V(1).Infof("Using cached `%s' from `%s'", m, path)
+				return data, nil
+			}
+			log.Warningf("Cached `%s' in `%s' doesn't match its digest, fetching it again", m, path)
+		}
+	}
+	if r.offline {
+		return nil, fmt.Errorf("module `%s' is not cached in `%s' (and network access is disabled)", m, r.cacheDir)
+	}
+
+	log.Infof("Fetching module `%s'", m)
+	resp, err := r.client.Get(m.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch `%s': %v", m.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch `%s': %s", m.URL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxModuleSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read `%s': %v", m.URL, err)
+	}
+	if len(data) > maxModuleSize {
+		return nil, fmt.Errorf("module `%s' is larger than %d bytes", m.URL, maxModuleSize)
+	}
+	if got := digestOf(data); got != m.Digest {
+		return nil, fmt.Errorf("digest of `%s' is sha256:%s, expected sha256:%s", m.URL, got, m.Digest)
+	}
+
+	if path != "" {
+		if err := writeFileAtomic(path, data); err != nil {
+			log.Warningf("Failed to cache `%s': %v", m, err)
+		}
+	}
+	return data, nil
+}
+
+// writeFileAtomic writes data to a file next to path and moves it in place
+// so that partially written files are never read.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
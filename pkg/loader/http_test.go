@@ -0,0 +1,166 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loader
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+)
+
+func TestParseHTTPModule(t *testing.T) {
+	digest := strings.Repeat("ab", 32)
+	for _, tc := range []struct {
+		base, in string
+		want     *HTTPModule
+		wantErr  string
+	}{
+		{
+			in:   "https://modules.internal/lib/foo.star@sha256:" + digest,
+			want: &HTTPModule{URL: "https://modules.internal/lib/foo.star", Digest: digest},
+		},
+		{
+			base: "https://modules.internal/lib/foo.star",
+			in:   "util/bar.star@sha256:" + digest,
+			want: &HTTPModule{URL: "https://modules.internal/lib/util/bar.star", Digest: digest},
+		},
+		{
+			base: "https://modules.internal/lib/foo.star",
+			in:   "../bar.star@sha256:" + digest,
+			want: &HTTPModule{URL: "https://modules.internal/bar.star", Digest: digest},
+		},
+		{in: "https://modules.internal/lib/foo.star", wantErr: "must be pinned to the digest of its content"},
+		{in: "https://modules.internal/lib/foo.star@sha256:abc", wantErr: "invalid digest `sha256:abc'"},
+		{base: "/addons", in: "bar.star@sha256:" + digest, wantErr: "must be an http:// or https:// URL"},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := ParseHTTPModule(tc.base, tc.in)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Want error containing %q, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected module (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestLoadHTTPModule(t *testing.T) {
+	bar := []byte("bar = 'bar'\n")
+	foo := []byte("load('util/bar.star@sha256:" + digestOf(bar) + "', 'bar')\nfoo = 'foo' + bar\n")
+	served := map[string][]byte{
+		"/lib/foo.star":      foo,
+		"/lib/util/bar.star": bar,
+		"/lib/tampered.star": []byte("foo = 'evil'\n"),
+	}
+	var fetched []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := served[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fetched = append(fetched, r.URL.Path)
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	cacheDir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	fooModule := ts.URL + "/lib/foo.star@sha256:" + digestOf(foo)
+	for _, tc := range []struct {
+		desc    string
+		module  string
+		opts    []Option
+		want    string
+		wantErr string
+		// wantFetched are paths fetched from the server (others are
+		// expected to be cached by previous cases).
+		wantFetched []string
+	}{
+		{
+			desc:    "Not enabled",
+			module:  fooModule,
+			wantErr: "loading modules by URL is not enabled",
+		},
+		{
+			desc:    "Not cached offline",
+			module:  fooModule,
+			opts:    []Option{WithHTTPModules(ts.Client(), cacheDir, true /* offline */)},
+			wantErr: "is not cached in",
+		},
+		{
+			desc:        "Fetch and cache",
+			module:      fooModule,
+			opts:        []Option{WithHTTPModules(ts.Client(), cacheDir, false)},
+			want:        `"foobar"`,
+			wantFetched: []string{"/lib/foo.star", "/lib/util/bar.star"},
+		},
+		{
+			desc:   "Cached offline",
+			module: fooModule,
+			opts:   []Option{WithHTTPModules(ts.Client(), cacheDir, true /* offline */)},
+			want:   `"foobar"`,
+		},
+		{
+			desc:    "Digest mismatch",
+			module:  ts.URL + "/lib/tampered.star@sha256:" + digestOf(foo[1:]),
+			opts:    []Option{WithHTTPModules(ts.Client(), cacheDir, false)},
+			wantErr: "expected sha256:" + digestOf(foo[1:]),
+			// Fetched but not cached.
+			wantFetched: []string{"/lib/tampered.star"},
+		},
+		{
+			desc:    "Not found",
+			module:  ts.URL + "/lib/missing.star@sha256:" + digestOf(foo),
+			opts:    []Option{WithHTTPModules(ts.Client(), "", false)},
+			wantErr: "404 Not Found",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			fetched = nil
+			l := NewModulesLoader("/addons", tc.opts...)
+			globals, err := l.Load(nil, tc.module)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Want error containing %q, got: %v", tc.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if got := globals["foo"].(starlark.String).String(); got != tc.want {
+				t.Errorf("Unexpected foo. Want: %s, got: %s", tc.want, got)
+			}
+			if d := cmp.Diff(tc.wantFetched, fetched); d != "" {
+				t.Errorf("Unexpected fetches (-want +got):\n%s", d)
+			}
+		})
+	}
+}
@@ -19,7 +19,10 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 
 	log "github.com/golang/glog"
@@ -48,11 +51,26 @@ type modulesLoader struct {
 	baseDir         string
 	loaded          map[string]*Module
 	predeclaredPkgs starlark.StringDict
+	// remote fetches modules loaded by URL (disabled if nil).
+	remote *remoteModules
+}
+
+// Option configures a ModulesLoader.
+type Option func(*modulesLoader)
+
+// WithHTTPModules returns an Option that enables loading modules by URL
+// pinned to their digest (see ParseHTTPModule) with c. Modules are cached in
+// cacheDir (if set) by digest. If offline is set, only cached modules can be
+// loaded.
+func WithHTTPModules(c *http.Client, cacheDir string, offline bool) Option {
+	return func(l *modulesLoader) {
+		l.remote = &remoteModules{client: c, cacheDir: cacheDir, offline: offline}
+	}
 }
 
 // NewModulesLoader creates a new loader for modules.
-func NewModulesLoader(baseDir string) ModulesLoader {
-	return NewModulesLoaderWithPredeclaredPkgs(baseDir, nil)
+func NewModulesLoader(baseDir string, opts ...Option) ModulesLoader {
+	return NewModulesLoaderWithPredeclaredPkgs(baseDir, nil, opts...)
 }
 
 // NewModulesLoaderWithPredeclaredPkgs creates a new loader for modules with
@@ -60,12 +78,17 @@ func NewModulesLoader(baseDir string) ModulesLoader {
 func NewModulesLoaderWithPredeclaredPkgs(
 	baseDir string,
 	predeclaredPkgs starlark.StringDict,
+	opts ...Option,
 ) ModulesLoader {
-	return &modulesLoader{
+	l := &modulesLoader{
 		baseDir:         baseDir,
 		loaded:          map[string]*Module{},
 		predeclaredPkgs: predeclaredPkgs,
 	}
+	for _, o := range opts {
+		o(l)
+	}
+	return l
 }
 
 // Load implements module loading. Repeated calls with the same module name
@@ -75,12 +98,17 @@ func (l *modulesLoader) Load(_ *starlark.Thread, module string) (starlark.String
 }
 
 // anchoredLoadFn loads modules relative to the baseDir. It accepts a ModuleReaderFactory
-// to allow unit testing with mocked readers.
+// to allow unit testing with mocked readers. Modules loaded by URL (and
+// modules they load, relative to their URL) are fetched with l.remote.
 func (l *modulesLoader) anchoredLoadFn(
 	baseDir string,
 	mockReaderFn *ModuleReaderFactory,
 ) func(t *starlark.Thread, module string) (starlark.StringDict, error) {
 	return func(t *starlark.Thread, module string) (starlark.StringDict, error) {
+		if isURL(module) || isURL(baseDir) {
+			return l.loadHTTP(baseDir, module, mockReaderFn)
+		}
+
 		m, ok := l.loaded[module]
 		if m != nil {
 			return m.globals, m.err
@@ -126,6 +154,46 @@ func (l *modulesLoader) anchoredLoadFn(
 	}
 }
 
+// loadHTTP loads module (by URL or relative to baseDir URL) with l.remote.
+func (l *modulesLoader) loadHTTP(baseDir, module string, mockReaderFn *ModuleReaderFactory) (starlark.StringDict, error) {
+	src, err := ParseHTTPModule(baseDir, module)
+	if err != nil {
+		return nil, err
+	}
+	if l.remote == nil {
+		return nil, fmt.Errorf("can't load `%s': loading modules by URL is not enabled", src)
+	}
+	u, err := url.Parse(src.URL)
+	if err != nil {
+		return nil, err
+	}
+	if ext := path.Ext(u.Path); ext != ".ipd" && ext != ".star" {
+		return nil, fmt.Errorf("unknown file extension: %s", ext)
+	}
+
+	key := src.String()
+	m, ok := l.loaded[key]
+	if m != nil {
+		return m.globals, m.err
+	}
+	if ok {
+		return nil, errors.New("cycle in load graph")
+	}
+	l.loaded[key] = nil
+
+	data, err := l.remote.fetch(src)
+	if err != nil {
+		l.loaded[key] = &Module{err: err}
+		return nil, err
+	}
+
+	thread := &starlark.Thread{Load: l.anchoredLoadFn(src.URL, mockReaderFn)}
+	globals, err := starlark.ExecFile(thread, key, data, l.predeclaredPkgs)
+	m = &Module{globals: globals, data: data, err: err}
+	l.loaded[key] = m
+	return m.globals, m.err
+}
+
 func (l *modulesLoader) GetLoaded() map[string]string {
 	modules := make(map[string]string, len(l.loaded))
 	for m, v := range l.loaded {
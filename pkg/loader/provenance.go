@@ -0,0 +1,86 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loader
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+
+	log "github.com/golang/glog"
+)
+
+// Provenance is the git commit a file was read at.
+type Provenance struct {
+	// Commit is the full SHA of the checked out commit.
+	Commit string
+	// Branch is the checked out branch (empty if HEAD is detached).
+	Branch string
+	// Dirty is set if the work tree has uncommitted changes.
+	Dirty bool
+}
+
+// String returns e.g `3f2c1ab (main, dirty)'.
+func (p *Provenance) String() string {
+	short := p.Commit
+	if len(short) > 7 {
+		short = short[:7]
+	}
+	branch := p.Branch
+	if branch == "" {
+		branch = "detached"
+	}
+	if p.Dirty {
+		return fmt.Sprintf("%s (%s, dirty)", short, branch)
+	}
+	return fmt.Sprintf("%s (%s)", short, branch)
+}
+
+// DetectProvenance returns the provenance of the git work tree that path is
+// in. Returns nil if path is not in a git work tree (or git is not
+// installed).
+func DetectProvenance(path string) (*Provenance, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		log.V(1).Infof("No git provenance of `%s': %v", path, err)
+		return nil, nil
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	if inside, err := gitOutput(dir, "rev-parse", "--is-inside-work-tree"); err != nil || inside != "true" {
+		log.V(1).Infof("No git provenance of `%s': not in a git work tree", path)
+		return nil, nil
+	}
+
+	p := &Provenance{}
+	if p.Commit, err = gitOutput(dir, "rev-parse", "HEAD"); err != nil {
+		// E.g a repo with no commits yet.
+		log.V(1).Infof("No git provenance of `%s': %v", path, err)
+		return nil, nil
+	}
+	if p.Branch, err = gitOutput(dir, "rev-parse", "--abbrev-ref", "HEAD"); err != nil {
+		return nil, err
+	}
+	if p.Branch == "HEAD" {
+		p.Branch = ""
+	}
+	status, err := gitOutput(dir, "status", "--porcelain")
+	if err != nil {
+		return nil, err
+	}
+	p.Dirty = status != ""
+	return p, nil
+}
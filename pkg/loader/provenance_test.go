@@ -0,0 +1,108 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loader
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectProvenance(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "provenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "repo")
+	main := filepath.Join(repo, "clusters", "main.ipd")
+	git := func(args ...string) string {
+		out, err := gitOutput(repo, append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	write := func(content string) {
+		if err := ioutil.WriteFile(main, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(main), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write("v1")
+
+	if p, err := DetectProvenance(filepath.Join(dir, "main.ipd")); err != nil || p != nil {
+		t.Errorf("DetectProvenance outside of a repo = %v, %v, want nil", p, err)
+	}
+
+	git("init", "--quiet")
+	git("checkout", "--quiet", "-b", "main")
+	if p, err := DetectProvenance(main); err != nil || p != nil {
+		t.Errorf("DetectProvenance in a repo with no commits = %v, %v, want nil", p, err)
+	}
+
+	git("add", "-A")
+	git("commit", "--quiet", "-m", "v1")
+	v1 := git("rev-parse", "HEAD")
+
+	for _, tc := range []struct {
+		name    string
+		setup   func()
+		want    Provenance
+		wantStr string
+	}{
+		{
+			name:    "Clean",
+			want:    Provenance{Commit: v1, Branch: "main"},
+			wantStr: v1[:7] + " (main)",
+		},
+		{
+			name:    "Dirty",
+			setup:   func() { write("v2") },
+			want:    Provenance{Commit: v1, Branch: "main", Dirty: true},
+			wantStr: v1[:7] + " (main, dirty)",
+		},
+		{
+			name:    "Detached",
+			setup:   func() { git("checkout", "--quiet", "--force", v1) },
+			want:    Provenance{Commit: v1},
+			wantStr: v1[:7] + " (detached)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.setup != nil {
+				tc.setup()
+			}
+			p, err := DetectProvenance(main)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p == nil || *p != tc.want {
+				t.Fatalf("DetectProvenance = %+v, want %+v", p, tc.want)
+			}
+			if got := p.String(); got != tc.wantStr {
+				t.Errorf("String() = %q, want %q", got, tc.wantStr)
+			}
+		})
+	}
+}
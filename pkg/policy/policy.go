@@ -0,0 +1,191 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package policy evaluates objects about to be applied against Rego policies
+// (https://www.openpolicyagent.org/docs/latest/policy-language/) with the
+// same conventions as conftest: policies are `deny' and `warn' rules whose
+// values are messages about the object passed as input.
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// Mode controls what happens to objects violating `deny' rules.
+type Mode string
+
+const (
+	// ModeDeny fails objects violating `deny' rules.
+	ModeDeny Mode = "deny"
+	// ModeWarn only warns about objects violating `deny' rules.
+	ModeWarn Mode = "warn"
+)
+
+// ParseMode returns Mode of s.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case ModeDeny, ModeWarn:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown policy mode `%s' (want `%s' or `%s')", s, ModeDeny, ModeWarn)
+}
+
+// Violation is a message of a `deny' or `warn' rule about an object.
+type Violation struct {
+	// Policy is the Rego package of the rule, e.g `kubernetes.pods'.
+	Policy string `json:"policy"`
+	// Rule is either `deny' or `warn'.
+	Rule string `json:"rule"`
+	// Msg is the message of the rule (or its `msg' field if the rule
+	// returns objects).
+	Msg interface{} `json:"msg"`
+}
+
+// Message returns Msg as a string.
+func (v Violation) Message() string {
+	switch msg := v.Msg.(type) {
+	case string:
+		return msg
+	case map[string]interface{}:
+		if s, ok := msg["msg"].(string); ok {
+			return s
+		}
+	}
+	bs, _ := json.Marshal(v.Msg)
+	return string(bs)
+}
+
+// Evaluator evaluates policies against input (an object as JSON) and
+// returns the violations found.
+type Evaluator func(ctx context.Context, input []byte) ([]Violation, error)
+
+// Checker checks objects against policies.
+type Checker struct {
+	mode Mode
+	eval Evaluator
+}
+
+// Option is an option of Checker.
+type Option func(*Checker)
+
+// WithEvaluator returns an Option that evaluates policies with e instead of
+// the opa binary.
+func WithEvaluator(e Evaluator) Option {
+	return func(c *Checker) {
+		c.eval = e
+	}
+}
+
+// NewChecker returns a new Checker of the policies under dir, evaluated by
+// running binary (`opa' if empty), which handles violations of `deny'
+// rules according to mode.
+func NewChecker(dir, binary string, mode Mode, opts ...Option) *Checker {
+	c := &Checker{
+		mode: mode,
+		eval: execEvaluator(dir, binary),
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// Check evaluates policies against obj (a JSON-serializable object) and
+// returns messages of the violations that only warrant a warning and an
+// error listing the ones that fail obj (if any).
+func (c *Checker) Check(ctx context.Context, obj interface{}) (warnings []string, err error) {
+	input, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	vs, err := c.eval(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate policies: %v", err)
+	}
+	sort.SliceStable(vs, func(i, j int) bool { return vs[i].Policy < vs[j].Policy })
+
+	var denied []string
+	for _, v := range vs {
+		msg := fmt.Sprintf("policy `%s': %s", v.Policy, v.Message())
+		if v.Rule == "deny" && c.mode == ModeDeny {
+			denied = append(denied, msg)
+		} else {
+			warnings = append(warnings, msg)
+		}
+	}
+	if len(denied) > 0 {
+		return warnings, fmt.Errorf("violates %s", strings.Join(denied, "; "))
+	}
+	return warnings, nil
+}
+
+// query collects messages of all `deny' and `warn' rules of all packages.
+const query = `[v |
+	walk(data, [path, msgs])
+	n := count(path)
+	n > 1
+	rule := path[n-1]
+	{"deny", "warn"}[rule]
+	msg := msgs[_]
+	v := {"policy": concat(".", array.slice(path, 0, n-1)), "rule": rule, "msg": msg}
+]`
+
+// opaOutput is the output of `opa eval --format json'.
+type opaOutput struct {
+	Result []struct {
+		Expressions []struct {
+			Value []Violation `json:"value"`
+		} `json:"expressions"`
+	} `json:"result"`
+}
+
+// parseOutput returns violations of out written by `opa eval --format json'.
+func parseOutput(out []byte) ([]Violation, error) {
+	var o opaOutput
+	if err := json.Unmarshal(out, &o); err != nil {
+		return nil, fmt.Errorf("failed to parse opa output: %v", err)
+	}
+	var vs []Violation
+	for _, r := range o.Result {
+		for _, e := range r.Expressions {
+			vs = append(vs, e.Value...)
+		}
+	}
+	return vs, nil
+}
+
+// execEvaluator returns an Evaluator that runs binary with the policies
+// (and data files) under dir.
+func execEvaluator(dir, binary string) Evaluator {
+	if binary == "" {
+		binary = "opa"
+	}
+	return func(ctx context.Context, input []byte) ([]Violation, error) {
+		cmd := exec.CommandContext(ctx, binary, "eval", "--format", "json", "--data", dir, "--stdin-input", query)
+		cmd.Stdin = bytes.NewReader(input)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v: %s", binary, err, strings.TrimSpace(stderr.String()+string(out)))
+		}
+		return parseOutput(out)
+	}
+}
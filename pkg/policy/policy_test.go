@@ -0,0 +1,130 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseOutput(t *testing.T) {
+	out := `{
+  "result": [
+    {
+      "expressions": [
+        {
+          "value": [
+            {"msg": "privileged containers are not allowed", "policy": "kubernetes.pods", "rule": "deny"},
+            {"msg": {"msg": "missing label team"}, "policy": "main", "rule": "warn"}
+          ],
+          "text": "[v | ...]",
+          "location": {"row": 1, "col": 1}
+        }
+      ]
+    }
+  ]
+}`
+	vs, err := parseOutput([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, v := range vs {
+		got = append(got, v.Rule+" "+v.Policy+": "+v.Message())
+	}
+	want := []string{
+		"deny kubernetes.pods: privileged containers are not allowed",
+		"warn main: missing label team",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected violations.\nWant: %q\nGot: %q", want, got)
+	}
+
+	if _, err := parseOutput([]byte("not json")); err == nil {
+		t.Error("Expected error parsing garbage")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	eval := func(ctx context.Context, input []byte) ([]Violation, error) {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(input, &obj); err != nil {
+			return nil, err
+		}
+		var vs []Violation
+		if obj["kind"] == "Pod" {
+			vs = append(vs, Violation{Policy: "pods", Rule: "deny", Msg: "privileged"})
+		}
+		vs = append(vs, Violation{Policy: "labels", Rule: "warn", Msg: "missing label team"})
+		return vs, nil
+	}
+
+	for _, tc := range []struct {
+		name         string
+		mode         Mode
+		kind         string
+		wantWarnings []string
+		wantErr      string
+	}{
+		{
+			name:         "Allowed",
+			mode:         ModeDeny,
+			kind:         "ConfigMap",
+			wantWarnings: []string{"policy `labels': missing label team"},
+		},
+		{
+			name:         "Denied",
+			mode:         ModeDeny,
+			kind:         "Pod",
+			wantWarnings: []string{"policy `labels': missing label team"},
+			wantErr:      "violates policy `pods': privileged",
+		},
+		{
+			name: "Denied in warn mode",
+			mode: ModeWarn,
+			kind: "Pod",
+			wantWarnings: []string{
+				"policy `labels': missing label team",
+				"policy `pods': privileged",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewChecker("policies", "", tc.mode, WithEvaluator(eval))
+			warnings, err := c.Check(context.Background(), map[string]interface{}{"kind": tc.kind})
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Errorf("Unexpected error, want %q got %q", tc.wantErr, gotErr)
+			}
+			if !reflect.DeepEqual(warnings, tc.wantWarnings) {
+				t.Errorf("Unexpected warnings.\nWant: %q\nGot: %q", tc.wantWarnings, warnings)
+			}
+		})
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	if m, err := ParseMode("warn"); err != nil || m != ModeWarn {
+		t.Errorf("Unexpected mode %q (error: %v)", m, err)
+	}
+	if _, err := ParseMode("audit"); err == nil {
+		t.Error("Expected error for unknown mode")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package redact keeps track of secret values (e.g decrypted files) so that
+// they are redacted in output.
+package redact
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Placeholder replaces registered secret values in output.
+const Placeholder = "<redacted>"
+
+// minRedactLen is the length of the shortest secret values redacted. Shorter
+// ones (e.g `true' or `1') would garble unrelated output.
+const minRedactLen = 6
+
+var redactions = struct {
+	sync.Mutex
+	values []string
+	// replacer is rebuilt lazily once values change.
+	replacer *strings.Replacer
+}{}
+
+// Register registers the plaintext values of secrets (e.g decrypted files)
+// so that they are replaced with Placeholder in output passed through
+// String. Values shorter than 6 bytes are ignored.
+func Register(values ...string) {
+	redactions.Lock()
+	defer redactions.Unlock()
+	for _, v := range values {
+		if len(v) >= minRedactLen {
+			redactions.values = append(redactions.values, v)
+			redactions.replacer = nil
+		}
+	}
+}
+
+// String returns s with all registered secret values replaced with
+// Placeholder (longer values first so that values containing others are
+// redacted whole).
+func String(s string) string {
+	redactions.Lock()
+	if redactions.replacer == nil {
+		if len(redactions.values) == 0 {
+			redactions.Unlock()
+			return s
+		}
+		values := append([]string{}, redactions.values...)
+		sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+		var oldnew []string
+		for _, v := range values {
+			oldnew = append(oldnew, v, Placeholder)
+		}
+		redactions.replacer = strings.NewReplacer(oldnew...)
+	}
+	r := redactions.replacer
+	redactions.Unlock()
+	return r.Replace(s)
+}
@@ -0,0 +1,33 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redact
+
+import "testing"
+
+func TestString(t *testing.T) {
+	Register("password", "password-with-suffix", "abc")
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{in: "no secrets here", want: "no secrets here"},
+		{in: "pw=password", want: "pw=<redacted>"},
+		{in: "pw=password-with-suffix", want: "pw=<redacted>"},
+		{in: "abc is too short", want: "abc is too short"},
+	} {
+		if got := String(tc.in); got != tc.want {
+			t.Errorf("String(%q): expected %q, got %q", tc.in, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package replicate implements the "replicate_secret" built-in that copies a
+// secret from a source of truth to Secrets in many namespaces.
+package replicate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/vault"
+)
+
+const (
+	// vaultPrefix marks sources that are Vault secrets (`vault:<path>').
+	vaultPrefix = "vault:"
+	// kubePrefix marks sources that are Secrets in the cluster
+	// (`kube:<namespace>/<name>').
+	kubePrefix = "kube:"
+
+	// sourceAnnotationKey is the annotation of replicated Secrets that
+	// holds their source.
+	sourceAnnotationKey = "isopod.getcruise.com/replicated-from"
+	// checksumAnnotationKey is the annotation of replicated Secrets that
+	// holds the checksum of their data so that rotations of the source show
+	// up in (redacted) diffs.
+	checksumAnnotationKey = "isopod.getcruise.com/source-checksum"
+)
+
+type replicator struct {
+	client  kube.DynamicClient
+	secrets kube.SecretGetter
+	vault   vault.SecretReader
+}
+
+// New returns the "replicate_secret" built-in that applies Secrets with c
+// (reading sources with s and v, Vault is optional).
+func New(c kube.DynamicClient, s kube.SecretGetter, v vault.SecretReader) *starlark.Builtin {
+	r := &replicator{client: c, secrets: s, vault: v}
+	return starlark.NewBuiltin("replicate_secret", r.replicateSecretFn)
+}
+
+// replicateSecretFn is entry point for `replicate_secret' callable.
+func (r *replicator) replicateSecretFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var source, name, typ string
+	var targets *starlark.List
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "source", &source, "targets", &targets, "name?", &name, "type?", &typ); err != nil {
+		return nil, err
+	}
+
+	var namespaces []string
+	for i := 0; i < targets.Len(); i++ {
+		ns, ok := targets.Index(i).(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("<%v>: target %d is not a namespace string (got a %s)", b.Name(), i, targets.Index(i).Type())
+		}
+		namespaces = append(namespaces, string(ns))
+	}
+
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	src, err := r.read(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if name == "" {
+		name = src.Name
+	}
+	if typ == "" {
+		typ = string(src.Type)
+	}
+
+	data := starlark.NewList(nil)
+	for _, ns := range namespaces {
+		if strings.HasPrefix(source, kubePrefix) && ns == src.Namespace && name == src.Name {
+			return nil, fmt.Errorf("<%v>: target `%s/%s' would overwrite source `%s'", b.Name(), ns, name, source)
+		}
+		s, err := replica(source, src, name, ns, corev1.SecretType(typ))
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+		}
+		if err := data.Append(starlark.String(s)); err != nil {
+			return nil, err
+		}
+	}
+	if data.Len() == 0 {
+		return starlark.None, nil
+	}
+
+	if _, err := r.client.Apply(t, name, "", data); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+// read returns the Secret referenced by source (`vault:<path>' or
+// `kube:<namespace>/<name>').
+func (r *replicator) read(ctx context.Context, source string) (*corev1.Secret, error) {
+	switch {
+	case strings.HasPrefix(source, vaultPrefix):
+		p := strings.TrimPrefix(source, vaultPrefix)
+		if r.vault == nil {
+			return nil, fmt.Errorf("failed to read `%s': vault is not configured", source)
+		}
+		vals, err := r.vault.ReadSecret(ctx, p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Vault secret `%s': %v", p, err)
+		}
+		if vals == nil {
+			return nil, fmt.Errorf("secret `%s' not found in Vault", p)
+		}
+		s := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: path.Base(p)},
+			Type:       corev1.SecretTypeOpaque,
+			Data:       map[string][]byte{},
+		}
+		for k, v := range vals {
+			str, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("key `%s' of Vault secret `%s' is not a string (got a %T)", k, p, v)
+			}
+			s.Data[k] = []byte(str)
+		}
+		return s, nil
+	case strings.HasPrefix(source, kubePrefix):
+		ref := strings.TrimPrefix(source, kubePrefix)
+		ss := strings.Split(ref, "/")
+		if len(ss) != 2 || ss[0] == "" || ss[1] == "" {
+			return nil, fmt.Errorf("invalid source `%s' (expected %s<namespace>/<name>)", source, kubePrefix)
+		}
+		s, err := r.secrets.GetSecret(ctx, ss[0], ss[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret `%s': %v", ref, err)
+		}
+		if s == nil {
+			return nil, fmt.Errorf("secret `%s' not found", ref)
+		}
+		if s.Type == "" {
+			s.Type = corev1.SecretTypeOpaque
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("invalid source `%s' (expected %s<path> or %s<namespace>/<name>)", source, vaultPrefix, kubePrefix)
+}
+
+// replica returns JSON of Secret name in namespace with data of src read
+// from source. Labels and annotations of src are not copied.
+func replica(source string, src *corev1.Secret, name, namespace string, typ corev1.SecretType) (string, error) {
+	data := map[string][]byte{}
+	for k, v := range src.Data {
+		data[k] = v
+	}
+	for k, v := range src.StringData {
+		data[k] = []byte(v)
+	}
+
+	s := &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Annotations: map[string]string{
+				sourceAnnotationKey:   source,
+				checksumAnnotationKey: checksum(data),
+			},
+		},
+		Type: typ,
+		Data: data,
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal secret `%s/%s': %v", namespace, name, err)
+	}
+	return string(b), nil
+}
+
+// checksum returns sha256 of data (in order of keys).
+func checksum(data map[string][]byte) string {
+	var keys []string
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s\x00%s\x00", k, data[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,194 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replicate
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/vault"
+)
+
+type fakeSecretReader map[string]map[string]interface{}
+
+func (f fakeSecretReader) ReadSecret(_ context.Context, path string) (map[string]interface{}, error) {
+	return f[path], nil
+}
+
+const sourceSecret = `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: registry
+  namespace: default
+type: kubernetes.io/dockerconfigjson
+data:
+  .dockerconfigjson: e30=
+`
+
+func TestReplicateSecret(t *testing.T) {
+	newKube, closeFn, err := kube.NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	ctx := context.Background()
+	secrets := fakeSecretReader{
+		"secret/tls":    {"tls.crt": "cert", "tls.key": "key"},
+		"secret/broken": {"port": 443},
+	}
+	eval := func(k starlark.HasAttrs, r vault.SecretReader, expr string) error {
+		pkgs := starlark.StringDict{
+			"kube":             k,
+			"replicate_secret": New(k.(kube.DynamicClient), k.(kube.SecretGetter), r),
+		}
+		thread := &starlark.Thread{}
+		thread.SetLocal(addon.GoCtxKey, ctx)
+		thread.SetLocal(addon.SkyCtxKey, &addon.SkyCtx{Attrs: starlark.StringDict{}})
+		thread.SetLocal(addon.NameKey, "secrets")
+		_, err := starlark.Eval(thread, t.Name(), expr, pkgs)
+		return err
+	}
+
+	if err := eval(newKube(), secrets, `kube.put_yaml(data=["""`+sourceSecret+`"""])`); err != nil {
+		t.Fatalf("Failed to apply source secret: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		vault    vault.SecretReader
+		expr     string
+		wantErr  string
+		wantName string
+		wantNs   []string
+		wantType string
+		wantData map[string]string
+	}{
+		{
+			name:     "From Vault",
+			vault:    secrets,
+			expr:     `replicate_secret("vault:secret/tls", ["app-a", "app-b"], type="kubernetes.io/tls")`,
+			wantName: "tls",
+			wantNs:   []string{"app-a", "app-b"},
+			wantType: "kubernetes.io/tls",
+			wantData: map[string]string{"tls.crt": "cert", "tls.key": "key"},
+		},
+		{
+			name:     "From cluster",
+			expr:     `replicate_secret("kube:default/registry", ["app-a"], name="pull-secret")`,
+			wantName: "pull-secret",
+			wantNs:   []string{"app-a"},
+			wantType: "kubernetes.io/dockerconfigjson",
+			wantData: map[string]string{".dockerconfigjson": "{}"},
+		},
+		{
+			name:    "Invalid source",
+			expr:    `replicate_secret("default/registry", ["app-a"])`,
+			wantErr: "invalid source `default/registry'",
+		},
+		{
+			name:    "Vault not configured",
+			expr:    `replicate_secret("vault:secret/tls", ["app-a"])`,
+			wantErr: "vault is not configured",
+		},
+		{
+			name:    "Vault secret not found",
+			vault:   secrets,
+			expr:    `replicate_secret("vault:secret/missing", ["app-a"])`,
+			wantErr: "secret `secret/missing' not found in Vault",
+		},
+		{
+			name:    "Vault value not a string",
+			vault:   secrets,
+			expr:    `replicate_secret("vault:secret/broken", ["app-a"])`,
+			wantErr: "key `port' of Vault secret `secret/broken' is not a string",
+		},
+		{
+			name:    "Cluster secret not found",
+			expr:    `replicate_secret("kube:default/missing", ["app-a"])`,
+			wantErr: "secret `default/missing' not found",
+		},
+		{
+			name:    "Overwrites source",
+			expr:    `replicate_secret("kube:default/registry", ["app-a", "default"])`,
+			wantErr: "target `default/registry' would overwrite source `kube:default/registry'",
+		},
+		{
+			name:    "Target not a string",
+			vault:   secrets,
+			expr:    `replicate_secret("vault:secret/tls", [1])`,
+			wantErr: "target 0 is not a namespace string",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k := newKube()
+			err := eval(k, tc.vault, tc.expr)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Expected error containing `%s', got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, ns := range tc.wantNs {
+				s, err := k.(kube.SecretGetter).GetSecret(ctx, ns, tc.wantName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if s == nil {
+					t.Fatalf("Expected secret `%s/%s' to be applied", ns, tc.wantName)
+				}
+				if string(s.Type) != tc.wantType {
+					t.Errorf("Unexpected type of `%s/%s': want %s, got %s", ns, tc.wantName, tc.wantType, s.Type)
+				}
+				if len(s.Data) != len(tc.wantData) {
+					t.Errorf("Unexpected keys of `%s/%s': %v", ns, tc.wantName, s.Data)
+				}
+				for key, want := range tc.wantData {
+					if got := string(s.Data[key]); got != want {
+						t.Errorf("Unexpected value of `%s' in `%s/%s': want %q, got %q", key, ns, tc.wantName, want, got)
+					}
+				}
+				if got := s.Labels["isopod.getcruise.com/addon"]; got != "secrets" {
+					t.Errorf("Expected `%s/%s' to be labeled with addon `secrets', got `%s'", ns, tc.wantName, got)
+				}
+				if s.Annotations[checksumAnnotationKey] == "" {
+					t.Errorf("Expected `%s/%s' to be annotated with source checksum", ns, tc.wantName)
+				}
+			}
+		})
+	}
+}
+
+func TestChecksumTracksRotation(t *testing.T) {
+	a := checksum(map[string][]byte{"user": []byte("admin"), "password": []byte("hunter2")})
+	b := checksum(map[string][]byte{"password": []byte("hunter2"), "user": []byte("admin")})
+	c := checksum(map[string][]byte{"user": []byte("admin"), "password": []byte("hunter3")})
+	if a != b {
+		t.Errorf("Expected checksum to be independent of key order: %s != %s", a, b)
+	}
+	if a == c {
+		t.Errorf("Expected checksum to change when secret rotates: %s", a)
+	}
+}
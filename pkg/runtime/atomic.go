@@ -0,0 +1,43 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/golang/glog"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/kube"
+)
+
+// endTransaction ends the transaction of atomically installed addon a begun
+// on tx: changes are kept if the install succeeded (err is nil) and rolled
+// back otherwise. Returns err, noting whether the rollback succeeded.
+func (r *runtime) endTransaction(ctx context.Context, tx kube.Transactor, a *addon.Addon, err error) error {
+	if err == nil {
+		tx.Commit(a.Name)
+		return nil
+	}
+
+	log.Warningf("%s: install failed, rolling back objects it applied: %v", a.Name, err)
+	if rbErr := tx.Rollback(ctx, a.Name); rbErr != nil {
+		log.Errorf("%s: %v", a.Name, rbErr)
+		return fmt.Errorf("%v (%v)", err, rbErr)
+	}
+	r.printf("%s: rolled back after failed install\n", a.Name)
+	return fmt.Errorf("%v (rolled back)", err)
+}
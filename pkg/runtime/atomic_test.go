@@ -0,0 +1,160 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/util"
+)
+
+func TestAtomicInstall(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "isopod-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"main.ipd": `
+def addons(ctx):
+    return [addon("app", "app.ipd", ctx, atomic=ctx.atomic == "true")]
+`,
+		"app.ipd": `
+def configmap(name, value):
+    return """
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+  namespace: default
+data:
+  key: %s
+""" % (name, value)
+
+def install(ctx):
+    kube.put_yaml(data=[configmap("foo", ctx.value)])
+    if ctx.fail == "true":
+        kube.put_yaml(data=[configmap("bar", ctx.value)])
+        error("boom")
+
+def remove(ctx):
+    pass
+`,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		atomic  string
+		dryRun  bool
+		wantErr string
+		wantFoo string
+		wantBar bool
+	}{
+		{
+			name:    "Rolled back",
+			atomic:  "true",
+			wantErr: "(rolled back)",
+			wantFoo: "v1",
+		},
+		{
+			name:    "Not atomic",
+			atomic:  "false",
+			wantErr: "boom",
+			wantFoo: "v2",
+			wantBar: true,
+		},
+		{
+			name:    "Dry run",
+			atomic:  "true",
+			dryRun:  true,
+			wantErr: "boom",
+			wantFoo: "v1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newKube, closeFn, err := kube.NewFakePackages()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeFn()
+
+			install := func(dryRun bool, attrs map[string]string) error {
+				r, err := New(&Config{
+					EntryFile:         filepath.Join(dir, "main.ipd"),
+					GCPSvcAcctKeyFile: "some-sa-key",
+					UserAgent:         util.UserAgent{Product: "Isopod"},
+					KubeConfigPath:    "kubeconfig",
+					Store:             storeStub{},
+					DryRun:            dryRun,
+				}, WithNoSpin(), WithPackage("kube", newKube()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := r.Load(ctx); err != nil {
+					t.Fatal(err)
+				}
+				attrs["atomic"] = tc.atomic
+				runCtx := ctx
+				if dryRun {
+					runCtx = addon.WithDryRun(ctx)
+				}
+				return r.Run(runCtx, InstallCommand, goMapToSkyCtx(attrs))
+			}
+			if err := install(false, map[string]string{"value": "v1", "fail": "false"}); err != nil {
+				t.Fatalf("Initial install failed: %v", err)
+			}
+
+			err = install(tc.dryRun, map[string]string{"value": "v2", "fail": "true"})
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Expected install to fail with %q, got: %v", tc.wantErr, err)
+			}
+
+			thread := &starlark.Thread{}
+			thread.SetLocal(addon.GoCtxKey, ctx)
+			env := starlark.StringDict{"kube": newKube()}
+			foo, err := starlark.Eval(thread, t.Name(), `kube.get(configmap="default/foo", json=True)`, env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(foo.String(), tc.wantFoo) {
+				t.Errorf("Expected foo to hold %q, got: %v", tc.wantFoo, foo)
+			}
+			bar, err := starlark.Eval(thread, t.Name(), `kube.exists(configmap="default/bar")`, env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bool(bar.(starlark.Bool)) != tc.wantBar {
+				t.Errorf("Expected bar to exist: %v, got: %v", tc.wantBar, bar)
+			}
+		})
+	}
+}
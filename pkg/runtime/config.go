@@ -18,6 +18,7 @@ import (
 	"errors"
 
 	"github.com/cruise-automation/isopod/pkg/store"
+	"github.com/cruise-automation/isopod/pkg/util"
 )
 
 // Config is used to create a new Runtime.
@@ -31,9 +32,21 @@ type Config struct {
 	// Credential file. It is used to authenticate with GKE clusters.
 	GCPSvcAcctKeyFile string
 
-	// UserAgent is the UserAgent name used by Isopod to communicate with all
-	// Kubernetes masters.
-	UserAgent string
+	// GCPSvcAcctKeyJSON is the content of the Google Service Account
+	// Credential JSON. It is used when GCPSvcAcctKeyFile is not set so that
+	// credentials need not be written to disk.
+	GCPSvcAcctKeyJSON string
+
+	// GCPTokenCacheFile is the path to the file caching OAuth2 tokens used to
+	// authenticate with GKE clusters across runs. Disabled if empty.
+	GCPTokenCacheFile string
+
+	// TLSPolicy constrains TLS of the GKE API clients. Optional.
+	TLSPolicy *util.TLSPolicy
+
+	// UserAgent builds User-Agent strings used by Isopod to identify itself
+	// to each backend (GKE API, Kubernetes masters, Vault).
+	UserAgent util.UserAgent
 
 	// KubeConfigPath is the path to the kubeconfig file on the local machine.
 	// It is used to authenticate with self-managed or on-premise Kubernetes.
@@ -44,8 +57,23 @@ type Config struct {
 	// live objects in cluster.
 	DryRun bool
 
+	// Profile is the name of the environment profile (e.g "dev" or "prod")
+	// exposed to the Starlark entry file as `ctx.profile' so that a single
+	// repo can manage multiple environments. Optional.
+	Profile string
+
+	// Preludes are Starlark files executed in order before EntryFile whose
+	// globals are predeclared in it and in addons (see loadPreludes).
+	// Optional.
+	Preludes []string
+
 	// Store is the storage to keep all rollout status.
 	Store store.Store
+
+	// Cluster identifies the target cluster in Store (e.g by its API server
+	// address) so that rollouts of clusters sharing a Store are kept apart.
+	// Optional if Store only keeps rollouts of a single cluster.
+	Cluster string
 }
 
 // Validate checks if all required fields are set.
@@ -53,8 +81,8 @@ func Validate(c *Config) error {
 	if c.EntryFile == "" {
 		return errors.New("runtime.Config.EntryFile cannot be empty")
 	}
-	if c.UserAgent == "" {
-		return errors.New("runtime.Config.UserAgent cannot be empty")
+	if c.UserAgent.Product == "" {
+		return errors.New("runtime.Config.UserAgent.Product cannot be empty")
 	}
 	return nil
 }
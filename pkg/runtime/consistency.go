@@ -0,0 +1,233 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/cloud"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// minPlaceholderLen is the min length of cluster attribute values replaced by
+// placeholders so that short values (e.g `1') don't mangle unrelated fields.
+const minPlaceholderLen = 3
+
+// Consistency collects objects rendered by addons for each cluster (see
+// kube.WithRenderRecorder) and reports objects that differ between clusters
+// of the same group. Safe for concurrent use.
+type Consistency struct {
+	// groupBy is the cluster attribute clusters are grouped by (all
+	// clusters are in the same group if empty).
+	groupBy string
+
+	mu sync.Mutex
+	// clusters are names of clusters in each group.
+	clusters map[string][]string
+	// renders maps group to object (keyed by addon and reference) to
+	// cluster name to normalized YAML of the object.
+	renders map[string]map[consistencyKey]map[string]string
+}
+
+// consistencyKey identifies an object rendered by an addon.
+type consistencyKey struct {
+	addon string
+	ref   store.ObjRef
+}
+
+func (k consistencyKey) String() string {
+	name := k.ref.Name
+	if k.ref.Namespace != "" {
+		name = k.ref.Namespace + "/" + name
+	}
+	return fmt.Sprintf("%s: %s.%s `%s'", k.addon, strings.ToLower(k.ref.Kind), k.ref.APIVersion, name)
+}
+
+// NewConsistency returns a new Consistency grouping clusters by their
+// groupBy attribute.
+func NewConsistency(groupBy string) *Consistency {
+	return &Consistency{
+		groupBy:  groupBy,
+		clusters: map[string][]string{},
+		renders:  map[string]map[consistencyKey]map[string]string{},
+	}
+}
+
+// Recorder registers cluster and returns a function recording objects
+// rendered for it (to be passed to kube.WithRenderRecorder). Values of string
+// attributes of the cluster (e.g its name or project) are replaced by
+// ${attribute} placeholders as expected per-cluster differences.
+func (c *Consistency) Recorder(cluster cloud.KubernetesVendor) func(addonName string, ref store.ObjRef, rendered string) {
+	attrs := cluster.AddonSkyCtx().Attrs
+	group := ""
+	if c.groupBy != "" {
+		if v, ok := attrs[c.groupBy].(starlark.String); ok {
+			group = fmt.Sprintf("%s=%s", c.groupBy, string(v))
+		} else {
+			group = fmt.Sprintf("%s=None", c.groupBy)
+		}
+	}
+
+	var oldnew []string
+	var keys []string
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	// Longest values first so that values containing others are replaced
+	// as a whole.
+	sort.Slice(keys, func(i, j int) bool {
+		vi, _ := starlark.AsString(attrs[keys[i]])
+		vj, _ := starlark.AsString(attrs[keys[j]])
+		if len(vi) != len(vj) {
+			return len(vi) > len(vj)
+		}
+		return keys[i] < keys[j]
+	})
+	for _, k := range keys {
+		if v, ok := starlark.AsString(attrs[k]); ok && len(v) >= minPlaceholderLen {
+			oldnew = append(oldnew, v, "${"+k+"}")
+		}
+	}
+	placeholders := strings.NewReplacer(oldnew...)
+
+	name := fmt.Sprint(cluster)
+	c.mu.Lock()
+	c.clusters[group] = append(c.clusters[group], name)
+	c.mu.Unlock()
+
+	return func(addonName string, ref store.ObjRef, rendered string) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		objs, ok := c.renders[group]
+		if !ok {
+			objs = map[consistencyKey]map[string]string{}
+			c.renders[group] = objs
+		}
+		key := consistencyKey{addon: addonName, ref: ref}
+		if objs[key] == nil {
+			objs[key] = map[string]string{}
+		}
+		objs[key][name] = placeholders.Replace(rendered)
+	}
+}
+
+// Report writes objects that differ between (or are missing on some)
+// clusters of the same group to w, along with the diff of each against its
+// most common rendering. Returns the number of such objects.
+func (c *Consistency) Report(w io.Writer) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var groups []string
+	for g := range c.clusters {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+
+	var n int
+	for _, g := range groups {
+		clusters := c.clusters[g]
+		if len(clusters) < 2 {
+			continue
+		}
+		title := "All clusters"
+		if g != "" {
+			title = fmt.Sprintf("Group `%s'", g)
+		}
+		fmt.Fprintf(w, "%s (%d clusters):\n", title, len(clusters))
+
+		var keys []consistencyKey
+		for k := range c.renders[g] {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+		var groupN int
+		for _, k := range keys {
+			inconsistent, err := reportObject(w, k, clusters, c.renders[g][k])
+			if err != nil {
+				return n, err
+			}
+			if inconsistent {
+				groupN++
+			}
+		}
+		if groupN == 0 {
+			fmt.Fprintf(w, "  %d objects rendered consistently\n", len(keys))
+		}
+		n += groupN
+	}
+	return n, nil
+}
+
+// reportObject writes clusters that object k is missing on or renders
+// differently on (compared to its most common rendering) to w. Returns false
+// if it renders the same on all clusters.
+func reportObject(w io.Writer, k consistencyKey, clusters []string, renders map[string]string) (bool, error) {
+	var missing []string
+	counts := map[string]int{}
+	for _, c := range clusters {
+		r, ok := renders[c]
+		if !ok {
+			missing = append(missing, c)
+			continue
+		}
+		counts[r]++
+	}
+	if len(missing) == 0 && len(counts) == 1 {
+		return false, nil
+	}
+
+	if len(missing) > 0 {
+		fmt.Fprintf(w, "  %v missing on: %s\n", k, strings.Join(missing, ", "))
+	}
+	if len(counts) < 2 {
+		return true, nil
+	}
+
+	var common, commonCluster string
+	for _, c := range clusters {
+		if r, ok := renders[c]; ok && counts[r] > counts[common] {
+			common, commonCluster = r, c
+		}
+	}
+	for _, c := range clusters {
+		r, ok := renders[c]
+		if !ok || r == common {
+			continue
+		}
+		fmt.Fprintf(w, "  %v differs on %s:\n", k, c)
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(common),
+			B:        difflib.SplitLines(r),
+			FromFile: commonCluster,
+			ToFile:   c,
+			Context:  3,
+			Eol:      "\n",
+		})
+		if err != nil {
+			return true, fmt.Errorf("failed to diff %v: %v", k, err)
+		}
+		fmt.Fprint(w, diff)
+	}
+	return true, nil
+}
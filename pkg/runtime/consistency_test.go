@@ -0,0 +1,141 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"k8s.io/client-go/rest"
+
+	"github.com/cruise-automation/isopod/pkg/cloud"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// namedVendor is a cluster printed as its name.
+type namedVendor struct {
+	*cloud.AbstractKubeVendor
+	name string
+}
+
+func (v *namedVendor) String() string { return v.name }
+
+func (v *namedVendor) KubeConfig(context.Context) (*rest.Config, error) { return &rest.Config{}, nil }
+
+func newNamedVendor(t *testing.T, attrs ...string) cloud.KubernetesVendor {
+	var kwargs []starlark.Tuple
+	for i := 0; i < len(attrs); i += 2 {
+		kwargs = append(kwargs, starlark.Tuple{starlark.String(attrs[i]), starlark.String(attrs[i+1])})
+	}
+	v, err := cloud.NewAbstractKubeVendor("onprem", nil, kwargs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &namedVendor{AbstractKubeVendor: v, name: attrs[1]}
+}
+
+func TestConsistency(t *testing.T) {
+	cm := store.ObjRef{APIVersion: "v1", Kind: "ConfigMap", Namespace: "kube-system", Name: "config"}
+	deploy := store.ObjRef{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "kube-system", Name: "app"}
+
+	for _, tc := range []struct {
+		name    string
+		groupBy string
+		// renders maps cluster (as in clusters) to rendered objects.
+		renders map[string]map[store.ObjRef]string
+		wantN   int
+		want    string
+	}{
+		{
+			name:    "Cluster attributes are expected to differ",
+			groupBy: "env",
+			renders: map[string]map[store.ObjRef]string{
+				"prod-1":    {cm: "cluster: prod-1\nenv: prod\n"},
+				"prod-2":    {cm: "cluster: prod-2\nenv: prod\n"},
+				"staging-1": {cm: "cluster: staging-1\nenv: staging\n"},
+			},
+			want: `Group ` + "`env=prod'" + ` (2 clusters):
+  1 objects rendered consistently
+`,
+		},
+		{
+			name:    "Differing and missing objects",
+			groupBy: "env",
+			renders: map[string]map[store.ObjRef]string{
+				"prod-1":    {cm: "replicas: 3\n", deploy: "image: app:v1\n"},
+				"prod-2":    {cm: "replicas: 3\n", deploy: "image: app:v1\n"},
+				"prod-3":    {cm: "replicas: 5\n"},
+				"staging-1": {cm: "replicas: 1\n"},
+			},
+			wantN: 2,
+			want: `Group ` + "`env=prod'" + ` (3 clusters):
+  cm: configmap.v1 ` + "`kube-system/config'" + ` differs on prod-3:
+--- prod-1
++++ prod-3
+@@ -1,2 +1,2 @@
+-replicas: 3
++replicas: 5
+` + " \n" + `  cm: deployment.apps/v1 ` + "`kube-system/app'" + ` missing on: prod-3
+`,
+		},
+		{
+			name: "All clusters compared without group",
+			renders: map[string]map[store.ObjRef]string{
+				"prod-1":    {cm: "replicas: 3\n"},
+				"staging-1": {cm: "replicas: 1\n"},
+			},
+			wantN: 1,
+			want: `All clusters (2 clusters):
+  cm: configmap.v1 ` + "`kube-system/config'" + ` differs on staging-1:
+--- prod-1
++++ staging-1
+@@ -1,2 +1,2 @@
+-replicas: 3
++replicas: 1
+` + " \n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewConsistency(tc.groupBy)
+			for _, cluster := range []string{"prod-1", "prod-2", "prod-3", "staging-1"} {
+				objs, ok := tc.renders[cluster]
+				if !ok {
+					continue
+				}
+				env := cluster[:len(cluster)-2]
+				record := c.Recorder(newNamedVendor(t, "cluster", cluster, "env", env))
+				for _, ref := range []store.ObjRef{cm, deploy} {
+					if r, ok := objs[ref]; ok {
+						record("cm", ref, r)
+					}
+				}
+			}
+
+			var b bytes.Buffer
+			n, err := c.Report(&b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tc.wantN {
+				t.Errorf("Want %d inconsistent objects, got %d", tc.wantN, n)
+			}
+			if got := b.String(); got != tc.want {
+				t.Errorf("Unexpected report, want:\n%s\ngot:\n%s", tc.want, got)
+			}
+		})
+	}
+}
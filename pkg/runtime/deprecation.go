@@ -0,0 +1,59 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+// checkDeprecated warns about deprecated addons (passing warnings to the
+// recorder set with WithDeprecationRecorder) and fails install of addons
+// past their sunset date at now unless WithAllowDeprecated is set. Other
+// commands (e.g remove) are allowed past sunset.
+func (r *runtime) checkDeprecated(cmd Command, addons []*addon.Addon, now time.Time) error {
+	var sunset []string
+	for _, a := range addons {
+		msg := a.DeprecationWarning()
+		if msg == "" {
+			continue
+		}
+		log.Warning(msg)
+		// JSON list output carries deprecation of each addon instead.
+		if r.listW == nil {
+			r.printf("Warning: %s\n", msg)
+		}
+		if r.recordDeprecation != nil {
+			r.recordDeprecation(msg)
+		}
+		if a.PastSunset(now) {
+			sunset = append(sunset, a.Name)
+		}
+	}
+
+	if len(sunset) == 0 || cmd != InstallCommand {
+		return nil
+	}
+	if r.allowDeprecated {
+		log.Warningf("Installing addons past their sunset date (--allow_deprecated): %s", strings.Join(sunset, ", "))
+		return nil
+	}
+	return fmt.Errorf("addons past their sunset date: %s (pass --allow_deprecated to install them anyway)", strings.Join(sunset, ", "))
+}
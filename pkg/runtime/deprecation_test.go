@@ -0,0 +1,85 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+func TestCheckDeprecated(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	addons := []*addon.Addon{
+		{Name: "current"},
+		{Name: "old", Deprecated: "replaced by new"},
+		{Name: "gone", Deprecated: "replaced by new", Sunset: now},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		cmd     Command
+		allow   bool
+		wantErr string
+	}{
+		{
+			name:    "Install past sunset",
+			cmd:     InstallCommand,
+			wantErr: "addons past their sunset date: gone (pass --allow_deprecated to install them anyway)",
+		},
+		{
+			name:  "Allowed",
+			cmd:   InstallCommand,
+			allow: true,
+		},
+		{
+			name: "Remove past sunset",
+			cmd:  RemoveCommand,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			var recorded []string
+			r := &runtime{
+				out:               newDisplay(&out, false, false /* redirectStderr */),
+				allowDeprecated:   tc.allow,
+				recordDeprecation: func(msg string) { recorded = append(recorded, msg) },
+			}
+
+			err := r.checkDeprecated(tc.cmd, addons, now)
+			if tc.wantErr == "" && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			} else if tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+				t.Fatalf("Want error %q, got: %v", tc.wantErr, err)
+			}
+
+			wantRecorded := []string{
+				"addon `old' is deprecated: replaced by new",
+				"addon `gone' is deprecated: replaced by new (sunset on 2025-06-01)",
+			}
+			if d := cmp.Diff(wantRecorded, recorded); d != "" {
+				t.Errorf("Unexpected warnings recorded (-want +got):\n%s", d)
+			}
+			wantOut := "Warning: " + wantRecorded[0] + "\nWarning: " + wantRecorded[1] + "\n"
+			if d := cmp.Diff(wantOut, out.String()); d != "" {
+				t.Errorf("Unexpected output (-want +got):\n%s", d)
+			}
+		})
+	}
+}
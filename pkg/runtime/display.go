@@ -0,0 +1,236 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	spin "github.com/tj/go-spin"
+)
+
+// display multiplexes progress of addons being installed (one line per
+// active install, e.g one per cluster when clusters are rolled out
+// concurrently) and lines printed in between onto w. Safe for concurrent use.
+//
+// If w is a terminal, active installs are redrawn with a spinner below lines
+// printed so far and stderr is captured while any install is active (so that
+// logs don't break up the progress lines). Otherwise progress is written as
+// plain lines as installs start and finish.
+type display struct {
+	w   io.Writer
+	tty bool
+	// redirectStderr is set to capture stderr while spinning on a terminal.
+	redirectStderr bool
+
+	mu     sync.Mutex
+	active []*progressLine
+	// drawn is the number of progress lines currently drawn on the terminal.
+	drawn   int
+	spinner *spin.Spinner
+	stopCh  chan struct{}
+	// oldErr and errW are set while stderr is redirected to errW.
+	oldErr, errW *os.File
+}
+
+// progressLine is an install in progress.
+type progressLine struct {
+	prefix, msg string
+}
+
+// stdout is the display shared by all runtimes writing to stdout.
+var stdout = newDisplay(os.Stdout, isTerminal(os.Stdout), true)
+
+func newDisplay(w io.Writer, tty, redirectStderr bool) *display {
+	return &display{w: w, tty: tty, redirectStderr: redirectStderr}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// clusterPrefix returns the prefix of lines printed for cluster (none if not
+// known).
+func clusterPrefix(cluster string) string {
+	if cluster == "" {
+		return ""
+	}
+	return "[" + cluster + "] "
+}
+
+// start shows msg (prefixed by prefix) as in progress until passed to finish.
+func (d *display) start(prefix, msg string) *progressLine {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	l := &progressLine{prefix: prefix, msg: msg}
+	d.active = append(d.active, l)
+	if !d.tty {
+		fmt.Fprintf(d.w, "%s%s...\n", prefix, msg)
+		return l
+	}
+	if len(d.active) == 1 {
+		d.spinner = spin.New()
+		d.spinner.Set(spin.Spin1)
+		d.stopCh = make(chan struct{})
+		go d.spin(d.stopCh)
+		if d.redirectStderr {
+			d.captureStderr()
+		}
+	}
+	d.redraw()
+	return l
+}
+
+// finish replaces progress of l with a line ending in err (or done if nil).
+func (d *display) finish(l *progressLine, err error) {
+	status := "done"
+	if err != nil {
+		status = fmt.Sprintf("err: %v", err)
+	}
+
+	d.mu.Lock()
+	for i, a := range d.active {
+		if a == l {
+			d.active = append(d.active[:i], d.active[i+1:]...)
+			break
+		}
+	}
+	d.printLocked(fmt.Sprintf("%s%s... %s", l.prefix, l.msg, status))
+	var errW *os.File
+	if d.tty && len(d.active) == 0 {
+		close(d.stopCh)
+		errW = d.restoreStderr()
+	}
+	d.mu.Unlock()
+
+	// Closing the pipe flushes remaining captured lines (these are printed
+	// with the lock held).
+	if errW != nil {
+		errW.Close()
+	}
+}
+
+// println prints prefix and each line of msg above progress lines.
+func (d *display) println(prefix, msg string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, line := range strings.Split(msg, "\n") {
+		d.printLocked(prefix + line)
+	}
+}
+
+// printf formats according to format and prints the result as println.
+func (d *display) printf(prefix, format string, args ...interface{}) {
+	d.println(prefix, strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+}
+
+// printLocked prints line above progress lines. Requires d.mu.
+func (d *display) printLocked(line string) {
+	if !d.tty {
+		fmt.Fprintln(d.w, line)
+		return
+	}
+	d.clear()
+	fmt.Fprintf(d.w, "%s\n", line)
+	d.redraw()
+}
+
+// clear erases progress lines drawn so far. Requires d.mu.
+func (d *display) clear() {
+	if d.drawn > 0 {
+		// Move up to the first progress line and erase to end of screen.
+		fmt.Fprintf(d.w, "\x1b[%dA\x1b[J", d.drawn)
+	}
+	d.drawn = 0
+}
+
+// redraw draws all active progress lines with the next spinner frame.
+// Requires d.mu.
+func (d *display) redraw() {
+	d.clear()
+	if len(d.active) == 0 {
+		return
+	}
+	frame := d.spinner.Next()
+	for _, l := range d.active {
+		fmt.Fprintf(d.w, "\r %s%s... %s\n", l.prefix, l.msg, frame)
+	}
+	d.drawn = len(d.active)
+}
+
+// spin redraws progress lines until stopCh is closed.
+func (d *display) spin(stopCh chan struct{}) {
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			d.mu.Lock()
+			select {
+			case <-stopCh:
+			default:
+				d.redraw()
+			}
+			d.mu.Unlock()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// captureStderr redirects stderr to print its lines above progress lines,
+// filtering out "proto: X" log spam. Requires d.mu.
+func (d *display) captureStderr() {
+	r, w, err := os.Pipe()
+	if err != nil {
+		// Logs will break up progress lines.
+		return
+	}
+	d.oldErr, d.errW = os.Stderr, w
+	os.Stderr = w
+
+	go func() {
+		defer r.Close()
+		sc := bufio.NewScanner(r)
+		for sc.Scan() {
+			if strings.Contains(sc.Text(), "proto: ") {
+				continue
+			}
+			d.println("", sc.Text())
+		}
+	}()
+}
+
+// restoreStderr restores stderr redirected by captureStderr (if any) and
+// returns the pipe it was redirected to. Requires d.mu.
+func (d *display) restoreStderr() *os.File {
+	if d.errW == nil {
+		return nil
+	}
+	os.Stderr = d.oldErr
+	w := d.errW
+	d.oldErr, d.errW = nil, nil
+	return w
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// eraseRe matches moving the cursor up and erasing to end of screen.
+var eraseRe = regexp.MustCompile(`\x1b\[(\d+)A\x1b\[J`)
+
+// frameRe matches a spinner frame at the end of a progress line.
+var frameRe = regexp.MustCompile(`\.\.\. .$`)
+
+// screen returns lines left on a terminal that out was written to.
+func screen(out string) []string {
+	var lines []string
+	for {
+		loc := eraseRe.FindStringSubmatchIndex(out)
+		end := len(out)
+		if loc != nil {
+			end = loc[0]
+		}
+		for _, l := range strings.SplitAfter(out[:end], "\n") {
+			if l != "" {
+				lines = append(lines, strings.TrimPrefix(strings.TrimSuffix(l, "\n"), "\r"))
+			}
+		}
+		if loc == nil {
+			return lines
+		}
+		n, _ := strconv.Atoi(out[loc[2]:loc[3]])
+		lines = lines[:len(lines)-n]
+		out = out[loc[1]:]
+	}
+}
+
+func TestDisplay(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		tty  bool
+
+		wantLines []string
+	}{
+		{
+			desc: "Terminal",
+			tty:  true,
+			wantLines: []string{
+				"[a] Beginning rollout",
+				"[b] addon `foo': skipped",
+				"[a] Installing foo... done",
+				"[b] Installing foo... err: boom",
+			},
+		},
+		{
+			desc: "Not a terminal",
+			wantLines: []string{
+				"[a] Beginning rollout",
+				"[a] Installing foo...",
+				"[b] Installing foo...",
+				"[b] addon `foo': skipped",
+				"[a] Installing foo... done",
+				"[b] Installing foo... err: boom",
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			b := &bytes.Buffer{}
+			d := newDisplay(b, tc.tty, false /* redirectStderr */)
+
+			d.printf("[a] ", "Beginning rollout\n")
+			a := d.start("[a] ", "Installing foo")
+			bl := d.start("[b] ", "Installing foo")
+			if tc.tty {
+				var got []string
+				for _, l := range screen(b.String()) {
+					got = append(got, frameRe.ReplaceAllString(l, "... *"))
+				}
+				if want := []string{"[a] Beginning rollout", " [a] Installing foo... *", " [b] Installing foo... *"}; !cmp.Equal(want, got) {
+					t.Errorf("Unexpected progress (-want +got):\n%s", cmp.Diff(want, got))
+				}
+			}
+			d.println("[b] ", "addon `foo': skipped")
+			d.finish(a, nil)
+			d.finish(bl, errors.New("boom"))
+
+			if d := cmp.Diff(tc.wantLines, screen(b.String())); d != "" {
+				t.Errorf("Unexpected output (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestDisplayConcurrent(t *testing.T) {
+	for _, tty := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tty=%v", tty), func(t *testing.T) {
+			b := &bytes.Buffer{}
+			d := newDisplay(b, tty, false /* redirectStderr */)
+
+			var want []string
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				prefix := fmt.Sprintf("[cluster-%02d] ", i)
+				want = append(want, prefix+"Installing foo... done", prefix+"opened lease")
+				if !tty {
+					want = append(want, prefix+"Installing foo...")
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					l := d.start(prefix, "Installing foo")
+					d.println(prefix, "opened lease")
+					d.finish(l, nil)
+				}()
+			}
+			wg.Wait()
+
+			got := screen(b.String())
+			sort.Strings(want)
+			sort.Strings(got)
+			if d := cmp.Diff(want, got); d != "" {
+				t.Errorf("Unexpected output (-want +got):\n%s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// gcStore deletes entries of r.store that are stale given addons defined for
+// r.Cluster and r.definedClusters (see store.Stale). Only prints entries that
+// would be deleted in dry run.
+func (r *runtime) gcStore(addons []*addon.Addon) error {
+	if r.addonRe != nil && r.addonRe.String() != "" {
+		// Entries of unmatched addons would look stale.
+		return errors.New("addon filter must not be set to garbage collect the store")
+	}
+
+	names := make([]string, 0, len(addons))
+	for _, a := range addons {
+		names = append(names, a.Name)
+	}
+	defined := store.Defined{
+		Clusters: r.definedClusters,
+		Addons:   map[string][]string{r.Cluster: names},
+	}
+
+	stores := []store.Store{r.store}
+	if m, ok := r.store.(store.Multi); ok {
+		stores = m.Stores()
+	}
+
+	var stale int
+	for _, s := range stores {
+		c, ok := s.(store.Collector)
+		if !ok {
+			return fmt.Errorf("store %T doesn't support garbage collection", s)
+		}
+		entries, err := c.Entries()
+		if err != nil {
+			return fmt.Errorf("failed to list store entries: %v", err)
+		}
+		for _, e := range store.Stale(entries, defined) {
+			stale++
+			if r.DryRun {
+				fmt.Printf("Would delete %s `%s': %s\n", e.Kind, e.ID, e.Reason)
+				continue
+			}
+			if err := c.DeleteEntry(e.ID); err != nil {
+				return fmt.Errorf("failed to delete %s `%s': %v", e.Kind, e.ID, err)
+			}
+			fmt.Printf("Deleted %s `%s': %s\n", e.Kind, e.ID, e.Reason)
+		}
+	}
+	if stale == 0 {
+		fmt.Printf("No stale store entries on %s.\n", r.Cluster)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/store"
+	kubestore "github.com/cruise-automation/isopod/pkg/store/kube"
+	"github.com/cruise-automation/isopod/pkg/util"
+)
+
+func TestStoreGC(t *testing.T) {
+	ctx := context.Background()
+	const cluster, gone = "https://a", "https://gone"
+
+	dir, err := ioutil.TempDir("", "isopod-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mainFile := filepath.Join(dir, "main.ipd")
+	for name, data := range map[string]string{
+		"main.ipd": `
+def addons(ctx):
+    return [addon("foo", "foo.ipd", ctx)]
+`,
+		"foo.ipd": `
+def install(ctx):
+    pass
+`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Returns ID of a new (not live) rollout of addons to c.
+	putRollout := func(t *testing.T, s store.Store, c string, addons ...string) store.RolloutID {
+		r, err := s.CreateRollout(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range addons {
+			if _, err := s.PutAddonRun(c, r.ID, &store.AddonRun{Name: a}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return r.ID
+	}
+
+	for _, tc := range []struct {
+		name        string
+		dryRun      bool
+		addonRe     string
+		wantDeleted bool
+		wantErr     bool
+	}{
+		{name: "Deleted", wantDeleted: true},
+		{name: "Dry run", dryRun: true},
+		{name: "Addon filter", addonRe: "foo", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := kubestore.New(fake.NewSimpleClientset(), "default")
+			live := putRollout(t, s, cluster, "foo")
+			if err := s.CompleteRollout(cluster, live); err != nil {
+				t.Fatal(err)
+			}
+			old := putRollout(t, s, cluster, "bar")
+			other := putRollout(t, s, gone, "foo")
+
+			r, err := New(&Config{
+				EntryFile: mainFile,
+				UserAgent: util.UserAgent{Product: "Isopod"},
+				Store:     s,
+				Cluster:   cluster,
+				DryRun:    tc.dryRun,
+			}, WithAddonRegex(regexp.MustCompile(tc.addonRe)), WithDefinedClusters(map[string]bool{cluster: true}), WithNoSpin())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Load(ctx); err != nil {
+				t.Fatal(err)
+			}
+			err = r.Run(ctx, StoreGCCommand, addon.NewCtx())
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if _, found, err := s.GetLive(cluster); err != nil || !found {
+				t.Errorf("Expected live rollout to be kept, got found=%v, err=%v", found, err)
+			}
+			for c, id := range map[string]store.RolloutID{cluster: old, gone: other} {
+				_, found, err := s.GetRollout(c, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if found == tc.wantDeleted {
+					t.Errorf("Unexpected rollout `%s' found=%v (wanted deleted: %v)", id, found, tc.wantDeleted)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// maxGlobalDepth bounds how deep members of modules are described (some
+// values, e.g protobuf packages, nest indefinitely).
+const maxGlobalDepth = 3
+
+// Global describes a predeclared Starlark global (or a member of one).
+type Global struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Params and Doc are only known for functions defined in Starlark.
+	// Signatures of Go built-ins can't be introspected.
+	Params  []string  `json:"params,omitempty"`
+	Doc     string    `json:"doc,omitempty"`
+	Members []*Global `json:"members,omitempty"`
+}
+
+// DescribeGlobals returns descriptions of globals sorted by name.
+func DescribeGlobals(globals starlark.StringDict) []*Global {
+	var gs []*Global
+	for _, name := range globals.Keys() {
+		gs = append(gs, describe(name, globals[name], 1))
+	}
+	return gs
+}
+
+func describe(name string, v starlark.Value, depth int) *Global {
+	g := &Global{Name: name, Type: v.Type()}
+	switch v := v.(type) {
+	case *starlark.Function:
+		g.Doc = v.Doc()
+		for i := 0; i < v.NumParams(); i++ {
+			p, _ := v.Param(i)
+			switch {
+			case v.HasKwargs() && i == v.NumParams()-1:
+				p = "**" + p
+			case v.HasVarargs() && i == v.NumParams()-1-boolToInt(v.HasKwargs()):
+				p = "*" + p
+			}
+			g.Params = append(g.Params, p)
+		}
+	case *starlark.Builtin:
+	case starlark.HasAttrs:
+		if depth >= maxGlobalDepth {
+			break
+		}
+		names := v.AttrNames()
+		sort.Strings(names)
+		for _, n := range names {
+			attr, err := v.Attr(n)
+			if err != nil || attr == nil {
+				continue
+			}
+			g.Members = append(g.Members, describe(n, attr, depth+1))
+		}
+	}
+	return g
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// WriteGlobals writes descriptions of globals to w in format ("text" or
+// "json").
+func WriteGlobals(w io.Writer, globals starlark.StringDict, format string) error {
+	gs := DescribeGlobals(globals)
+	switch format {
+	case "json":
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		e.SetEscapeHTML(false)
+		return e.Encode(gs)
+	case "text":
+		for _, g := range gs {
+			writeGlobal(w, g, "")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown format `%s' (must be `text' or `json')", format)
+	}
+}
+
+func writeGlobal(w io.Writer, g *Global, prefix string) {
+	name := prefix + g.Name
+	if g.Params != nil || g.Type == "function" {
+		name += "(" + strings.Join(g.Params, ", ") + ")"
+	}
+	fmt.Fprintf(w, "%s: %s\n", name, g.Type)
+	if g.Doc != "" {
+		for _, l := range strings.Split(strings.TrimSpace(g.Doc), "\n") {
+			if l = strings.TrimSpace(l); l == "" {
+				fmt.Fprintln(w)
+				continue
+			}
+			fmt.Fprintf(w, "    %s\n", l)
+		}
+	}
+	for _, m := range g.Members {
+		writeGlobal(w, m, name+".")
+	}
+}
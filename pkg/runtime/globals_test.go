@@ -0,0 +1,121 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+)
+
+const globalsSrc = `
+def deploy(name, replicas=1, *args, **kwargs):
+    """Deploys name.
+
+    Scales to replicas.
+    """
+    pass
+`
+
+func TestWriteGlobals(t *testing.T) {
+	thread := &starlark.Thread{}
+	defined, err := starlark.ExecFile(thread, "globals.ipd", globalsSrc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	globals := starlark.StringDict{
+		"deploy": defined["deploy"],
+		"sleep":  starlark.NewBuiltin("sleep", nil),
+		"vault": &isopod.Module{
+			Name: "vault",
+			Attrs: starlark.StringDict{
+				"read":  starlark.NewBuiltin("vault.read", nil),
+				"write": starlark.NewBuiltin("vault.write", nil),
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{
+			format: "text",
+			want: `deploy(name, replicas, *args, **kwargs): function
+    Deploys name.
+
+    Scales to replicas.
+sleep: builtin_function_or_method
+vault: <module>
+vault.read: builtin_function_or_method
+vault.write: builtin_function_or_method
+`,
+		},
+		{
+			format: "json",
+			want: `[
+  {
+    "name": "deploy",
+    "type": "function",
+    "params": [
+      "name",
+      "replicas",
+      "*args",
+      "**kwargs"
+    ],
+    "doc": "Deploys name.\n\n    Scales to replicas.\n    "
+  },
+  {
+    "name": "sleep",
+    "type": "builtin_function_or_method"
+  },
+  {
+    "name": "vault",
+    "type": "<module>",
+    "members": [
+      {
+        "name": "read",
+        "type": "builtin_function_or_method"
+      },
+      {
+        "name": "write",
+        "type": "builtin_function_or_method"
+      }
+    ]
+  }
+]
+`,
+		},
+		{
+			format:  "xml",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			var b bytes.Buffer
+			err := WriteGlobals(&b, globals, tc.format)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := b.String(); got != tc.want {
+				t.Errorf("Unexpected output.\nWant:\n%s\nGot:\n%s", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// printHistory prints revisions of addons recorded in r.store for r.Cluster
+// (oldest first) to w.
+func (r *runtime) printHistory(w io.Writer, addons []*addon.Addon) error {
+	h, ok := r.store.(store.Historian)
+	if !ok {
+		return fmt.Errorf("store %T doesn't keep history", r.store)
+	}
+
+	for _, a := range addons {
+		revs, err := h.History(r.Cluster, a.Name)
+		if err != nil {
+			return fmt.Errorf("failed to get history of `%s': %v", a.Name, err)
+		}
+		fmt.Fprintf(w, "History of `%s' on %s:\n", a.Name, r.Cluster)
+		if len(revs) == 0 {
+			fmt.Fprintln(w, "  No runs recorded.")
+			continue
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "  ROLLOUT\tAPPLIED AT\tAPPLIED BY\tSOURCE\tOBJECTS\t")
+		for _, rev := range revs {
+			at, by, src := "-", "-", "-"
+			if !rev.AppliedAt.IsZero() {
+				at = rev.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			if rev.AppliedBy != "" {
+				by = rev.AppliedBy
+			}
+			if rev.Source != "" {
+				src = rev.Source
+			}
+			live := ""
+			if rev.Live {
+				live = "(live)"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%d\t%s\n", rev.Rollout, at, by, src, rev.Objects, live)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/store"
+	kubestore "github.com/cruise-automation/isopod/pkg/store/kube"
+)
+
+func TestPrintHistory(t *testing.T) {
+	const cluster = "https://a"
+	s := kubestore.New(fake.NewSimpleClientset(), "default")
+
+	start := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+	var ids []store.RolloutID
+	for i, run := range []*store.AddonRun{
+		{Name: "foo", ObjRefs: make([]store.ObjRef, 2), AppliedAt: start, AppliedBy: "alice@laptop", Source: "3f2c1ab (main)"},
+		{Name: "foo", ObjRefs: make([]store.ObjRef, 3), AppliedAt: start.Add(time.Hour)},
+	} {
+		r, err := s.CreateRollout(cluster)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.PutAddonRun(cluster, r.ID, run); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if err := s.CompleteRollout(cluster, r.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ids = append(ids, r.ID)
+	}
+
+	r := &runtime{Config: Config{Cluster: cluster}, store: s}
+	var b bytes.Buffer
+	if err := r.printHistory(&b, []*addon.Addon{{Name: "foo"}, {Name: "bar"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "History of `foo' on https://a:\n" +
+		"  ROLLOUT                       APPLIED AT            APPLIED BY    SOURCE          OBJECTS  \n" +
+		"  " + string(ids[0]) + "  2019-07-01T12:00:00Z  alice@laptop  3f2c1ab (main)  2        (live)\n" +
+		"  " + string(ids[1]) + "  2019-07-01T13:00:00Z  -             -               3        \n" +
+		"History of `bar' on https://a:\n" +
+		"  No runs recorded.\n"
+	if d := cmp.Diff(want, b.String()); d != "" {
+		t.Errorf("Unexpected history (-want +got):\n%s", d)
+	}
+}
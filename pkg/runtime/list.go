@@ -0,0 +1,116 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	log "github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/kube"
+)
+
+// ListedCluster is the JSON list output of a single cluster.
+type ListedCluster struct {
+	Cluster string         `json:"cluster"`
+	Addons  []*ListedAddon `json:"addons"`
+}
+
+// ListedAddon describes a configured addon in JSON list output, along with
+// kinds of objects it renders (see WithListJSON).
+type ListedAddon struct {
+	Name string      `json:"name"`
+	File string      `json:"file"`
+	GVKs []ListedGVK `json:"gvks,omitempty"`
+	// Deprecated is why the addon is deprecated and Sunset (YYYY-MM-DD)
+	// when it stops being installed (both empty if not deprecated).
+	Deprecated string `json:"deprecated,omitempty"`
+	Sunset     string `json:"sunset,omitempty"`
+	// Error is why rendering the addon failed (GVKs are those rendered up
+	// to the failure).
+	Error string `json:"error,omitempty"`
+}
+
+// ListedGVK is a kind of objects rendered by an addon.
+type ListedGVK struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+}
+
+// listJSON writes addons to w as a single line of JSON. If r.listObjects is
+// set, install of each addon is evaluated in a silent dry run to collect
+// kinds of objects it renders. Addons that fail to render are reported
+// along with the error rather than failing the listing.
+func (r *runtime) listJSON(ctx context.Context, w io.Writer, addons []*addon.Addon) error {
+	out := &ListedCluster{Cluster: r.target, Addons: []*ListedAddon{}}
+	for _, a := range addons {
+		la := &ListedAddon{Name: a.Name, File: a.File(), Deprecated: a.Deprecated}
+		if !a.Sunset.IsZero() {
+			la.Sunset = a.Sunset.Format("2006-01-02")
+		}
+		if r.listObjects {
+			gvks, err := r.renderedGVKs(ctx, a)
+			if err != nil {
+				log.Warningf("Failed to render %v: %v", a, err)
+				la.Error = err.Error()
+			}
+			la.GVKs = gvks
+		}
+		out.Addons = append(out.Addons, la)
+	}
+
+	e := json.NewEncoder(w)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(out); err != nil {
+		return fmt.Errorf("failed to write addons list: %v", err)
+	}
+	return nil
+}
+
+// renderedGVKs evaluates install of a in a silent dry run and returns kinds
+// of objects it applies sorted by API version and kind.
+func (r *runtime) renderedGVKs(ctx context.Context, a *addon.Addon) ([]ListedGVK, error) {
+	// Objects may be applied concurrently (and past a timeout).
+	var mu sync.Mutex
+	seen := map[schema.GroupVersionKind]bool{}
+	rCtx := kube.WithGVKRecorder(addon.WithSilentDryRun(ctx), func(gvk schema.GroupVersionKind) {
+		mu.Lock()
+		seen[gvk] = true
+		mu.Unlock()
+	})
+	err := r.withTimeout(rCtx, a.Install)
+
+	mu.Lock()
+	gvks := make([]ListedGVK, 0, len(seen))
+	for gvk := range seen {
+		apiVersion, kind := gvk.ToAPIVersionAndKind()
+		gvks = append(gvks, ListedGVK{APIVersion: apiVersion, Kind: kind})
+	}
+	mu.Unlock()
+	sort.Slice(gvks, func(i, j int) bool {
+		if gvks[i].APIVersion != gvks[j].APIVersion {
+			return gvks[i].APIVersion < gvks[j].APIVersion
+		}
+		return gvks[i].Kind < gvks[j].Kind
+	})
+	return gvks, err
+}
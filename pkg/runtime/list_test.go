@@ -0,0 +1,131 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/util"
+)
+
+func TestListJSON(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "isopod-list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"main.ipd": `
+def addons(ctx):
+    return [addon("app", "app.ipd", ctx), addon("broken", "broken.ipd", ctx)]
+`,
+		"app.ipd": `
+def install(ctx):
+    kube.put_yaml(name="app", namespace="default", data=["""
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+""", """
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+""", """
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: app
+"""])
+
+def remove(ctx):
+    pass
+`,
+		"broken.ipd": `
+def install(ctx):
+    kube.put_yaml(name="broken", namespace="default", data=["""
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: broken
+"""])
+    error("boom")
+
+def remove(ctx):
+    pass
+`,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newKube, closeFn, err := kube.NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	for _, tc := range []struct {
+		name        string
+		withObjects bool
+		want        string
+	}{
+		{
+			name: "Names only",
+			want: `{"cluster":"dev","addons":[{"name":"app","file":"app.ipd"},{"name":"broken","file":"broken.ipd"}]}` + "\n",
+		},
+		{
+			name:        "With objects",
+			withObjects: true,
+			want: `{"cluster":"dev","addons":[` +
+				`{"name":"app","file":"app.ipd","gvks":[{"apiVersion":"example.com/v1","kind":"Widget"},{"apiVersion":"v1","kind":"ConfigMap"}]},` +
+				`{"name":"broken","file":"broken.ipd","gvks":[{"apiVersion":"v1","kind":"ConfigMap"}],"error":"<error>: boom\n\nTraceback (most recent call last):\n  broken.ipd:9:10: in install\n  <builtin>: in error\n"}]}` + "\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			r, err := New(&Config{
+				EntryFile:         filepath.Join(dir, "main.ipd"),
+				GCPSvcAcctKeyFile: "some-sa-key",
+				UserAgent:         util.UserAgent{Product: "Isopod"},
+				KubeConfigPath:    "kubeconfig",
+				Store:             storeStub{},
+			}, WithNoSpin(), WithCluster("dev"), WithPackage("kube", newKube()), WithListJSON(&buf, tc.withObjects))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Load(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(ctx, ListCommand, goMapToSkyCtx(map[string]string{})); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tc.want {
+				t.Errorf("Unexpected list.\nWant: %s\nGot:  %s", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+const lastSuccessMetric = "isopod_addon_last_success_timestamp_seconds"
+
+// unsafeFileChars matches characters not allowed in names of metrics files.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// addonMetrics describe the last install of an addon on a cluster.
+type addonMetrics struct {
+	Addon, Cluster string
+	Success        bool
+	Applied        int
+	Skipped        int
+	Duration       time.Duration
+	Finished       time.Time
+	// LastSuccess is when the addon last installed successfully (zero if
+	// never).
+	LastSuccess time.Time
+}
+
+// recordMetrics writes metrics of the install of a that started at start and
+// failed with err (if not nil) to the directory set with WithMetricsTextfile.
+// Failures to write them are logged.
+func (r *runtime) recordMetrics(a *addon.Addon, start time.Time, err error) {
+	cluster := r.target
+	if cluster == "" {
+		cluster = r.Cluster
+	}
+	now := time.Now()
+	m := addonMetrics{
+		Addon:    a.Name,
+		Cluster:  cluster,
+		Success:  err == nil,
+		Applied:  len(r.applied(a.Name)),
+		Skipped:  len(r.skipped(a.Name)),
+		Duration: now.Sub(start),
+		Finished: now,
+	}
+	if err := writeMetrics(r.metricsDir, m); err != nil {
+		log.Warningf("Failed to write metrics of `%s' addon: %v", a.Name, err)
+	}
+}
+
+// writeMetrics replaces the metrics file of m in dir for the node_exporter
+// textfile collector. LastSuccess is carried over from the previous file if
+// m is not successful.
+func writeMetrics(dir string, m addonMetrics) error {
+	path := filepath.Join(dir, metricsFileName(m.Cluster, m.Addon))
+	if m.Success {
+		m.LastSuccess = m.Finished
+	} else if prev, err := ioutil.ReadFile(path); err == nil {
+		m.LastSuccess = parseLastSuccess(prev)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var b bytes.Buffer
+	formatMetrics(&b, m)
+	return writeTextfile(path, b.Bytes())
+}
+
+// WriteDiscoveryCacheMetrics replaces isopod_discovery_cache.prom in dir for
+// the node_exporter textfile collector with hits and misses of the discovery
+// cache of the run (see kube.DiscoveryCache).
+func WriteDiscoveryCacheMetrics(dir string, hits, misses int) error {
+	var b bytes.Buffer
+	for _, s := range []struct {
+		name, help string
+		v          int
+	}{
+		{"isopod_discovery_cache_hits", "Clusters of the last run whose API resources were reused from a cluster with the same server version and group versions.", hits},
+		{"isopod_discovery_cache_misses", "Clusters of the last run whose API resources were discovered.", misses},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", s.name, s.help, s.name, s.name, s.v)
+	}
+	return writeTextfile(filepath.Join(dir, "isopod_discovery_cache.prom"), b.Bytes())
+}
+
+// writeTextfile replaces the file at path with b. b is written to a
+// temporary file first and renamed so that the collector never reads it
+// partially written.
+func writeTextfile(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".isopod-metrics-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// Readable by the collector, which may run as another user.
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// metricsFileName returns e.g "isopod_prod-us_ingress.prom".
+func metricsFileName(cluster, addonName string) string {
+	return fmt.Sprintf("isopod_%s_%s.prom", unsafeFileChars.ReplaceAllString(cluster, "_"), unsafeFileChars.ReplaceAllString(addonName, "_"))
+}
+
+// formatMetrics writes m to w in OpenMetrics text format.
+func formatMetrics(w io.Writer, m addonMetrics) {
+	labels := fmt.Sprintf(`addon="%s",cluster="%s"`, escapeLabel(m.Addon), escapeLabel(m.Cluster))
+	gauge := func(name, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	sample := func(name, extraLabels string, v float64) {
+		fmt.Fprintf(w, "%s{%s%s} %s\n", name, labels, extraLabels, strconv.FormatFloat(v, 'f', -1, 64))
+	}
+
+	success := 0.
+	if m.Success {
+		success = 1
+	}
+	gauge("isopod_addon_last_run_success", "Whether the last install of the addon succeeded.")
+	sample("isopod_addon_last_run_success", "", success)
+	gauge("isopod_addon_last_run_timestamp_seconds", "When the last install of the addon finished.")
+	sample("isopod_addon_last_run_timestamp_seconds", "", unixSeconds(m.Finished))
+	gauge("isopod_addon_last_run_duration_seconds", "How long the last install of the addon took.")
+	sample("isopod_addon_last_run_duration_seconds", "", m.Duration.Seconds())
+	gauge("isopod_addon_objects", "Number of objects applied or skipped by the last install of the addon.")
+	sample("isopod_addon_objects", `,state="applied"`, float64(m.Applied))
+	sample("isopod_addon_objects", `,state="skipped"`, float64(m.Skipped))
+	if !m.LastSuccess.IsZero() {
+		gauge(lastSuccessMetric, "When an install of the addon last succeeded.")
+		sample(lastSuccessMetric, "", unixSeconds(m.LastSuccess))
+	}
+	fmt.Fprintln(w, "# EOF")
+}
+
+// parseLastSuccess returns the last success timestamp in metrics file data
+// (zero if missing).
+func parseLastSuccess(data []byte) time.Time {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, lastSuccessMetric+"{") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		secs, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			log.Warningf("Ignoring invalid %s: %v", lastSuccessMetric, err)
+			return time.Time{}
+		}
+		return time.Unix(0, int64(secs*float64(time.Second)))
+	}
+	return time.Time{}
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// escapeLabel escapes backslashes, double quotes and line feeds in label
+// value v.
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
@@ -0,0 +1,171 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isopod-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t0 := time.Unix(1571140800, 0)
+	for _, tc := range []struct {
+		name string
+		m    addonMetrics
+		want string
+	}{
+		{
+			name: "Never succeeded",
+			m: addonMetrics{
+				Addon:    "ingress",
+				Cluster:  `prod "us"`,
+				Applied:  3,
+				Duration: 1500 * time.Millisecond,
+				Finished: t0,
+			},
+			want: `# HELP isopod_addon_last_run_success Whether the last install of the addon succeeded.
+# TYPE isopod_addon_last_run_success gauge
+isopod_addon_last_run_success{addon="ingress",cluster="prod \"us\""} 0
+# HELP isopod_addon_last_run_timestamp_seconds When the last install of the addon finished.
+# TYPE isopod_addon_last_run_timestamp_seconds gauge
+isopod_addon_last_run_timestamp_seconds{addon="ingress",cluster="prod \"us\""} 1571140800
+# HELP isopod_addon_last_run_duration_seconds How long the last install of the addon took.
+# TYPE isopod_addon_last_run_duration_seconds gauge
+isopod_addon_last_run_duration_seconds{addon="ingress",cluster="prod \"us\""} 1.5
+# HELP isopod_addon_objects Number of objects applied or skipped by the last install of the addon.
+# TYPE isopod_addon_objects gauge
+isopod_addon_objects{addon="ingress",cluster="prod \"us\"",state="applied"} 3
+isopod_addon_objects{addon="ingress",cluster="prod \"us\"",state="skipped"} 0
+# EOF
+`,
+		},
+		{
+			name: "Succeeded",
+			m: addonMetrics{
+				Addon:    "ingress",
+				Cluster:  `prod "us"`,
+				Success:  true,
+				Applied:  3,
+				Skipped:  1,
+				Duration: 2 * time.Second,
+				Finished: t0.Add(time.Hour),
+			},
+			want: `# HELP isopod_addon_last_run_success Whether the last install of the addon succeeded.
+# TYPE isopod_addon_last_run_success gauge
+isopod_addon_last_run_success{addon="ingress",cluster="prod \"us\""} 1
+# HELP isopod_addon_last_run_timestamp_seconds When the last install of the addon finished.
+# TYPE isopod_addon_last_run_timestamp_seconds gauge
+isopod_addon_last_run_timestamp_seconds{addon="ingress",cluster="prod \"us\""} 1571144400
+# HELP isopod_addon_last_run_duration_seconds How long the last install of the addon took.
+# TYPE isopod_addon_last_run_duration_seconds gauge
+isopod_addon_last_run_duration_seconds{addon="ingress",cluster="prod \"us\""} 2
+# HELP isopod_addon_objects Number of objects applied or skipped by the last install of the addon.
+# TYPE isopod_addon_objects gauge
+isopod_addon_objects{addon="ingress",cluster="prod \"us\"",state="applied"} 3
+isopod_addon_objects{addon="ingress",cluster="prod \"us\"",state="skipped"} 1
+# HELP isopod_addon_last_success_timestamp_seconds When an install of the addon last succeeded.
+# TYPE isopod_addon_last_success_timestamp_seconds gauge
+isopod_addon_last_success_timestamp_seconds{addon="ingress",cluster="prod \"us\""} 1571144400
+# EOF
+`,
+		},
+		{
+			name: "Failed since",
+			m: addonMetrics{
+				Addon:    "ingress",
+				Cluster:  `prod "us"`,
+				Duration: 250 * time.Millisecond,
+				Finished: t0.Add(2 * time.Hour),
+			},
+			want: `# HELP isopod_addon_last_run_success Whether the last install of the addon succeeded.
+# TYPE isopod_addon_last_run_success gauge
+isopod_addon_last_run_success{addon="ingress",cluster="prod \"us\""} 0
+# HELP isopod_addon_last_run_timestamp_seconds When the last install of the addon finished.
+# TYPE isopod_addon_last_run_timestamp_seconds gauge
+isopod_addon_last_run_timestamp_seconds{addon="ingress",cluster="prod \"us\""} 1571148000
+# HELP isopod_addon_last_run_duration_seconds How long the last install of the addon took.
+# TYPE isopod_addon_last_run_duration_seconds gauge
+isopod_addon_last_run_duration_seconds{addon="ingress",cluster="prod \"us\""} 0.25
+# HELP isopod_addon_objects Number of objects applied or skipped by the last install of the addon.
+# TYPE isopod_addon_objects gauge
+isopod_addon_objects{addon="ingress",cluster="prod \"us\"",state="applied"} 0
+isopod_addon_objects{addon="ingress",cluster="prod \"us\"",state="skipped"} 0
+# HELP isopod_addon_last_success_timestamp_seconds When an install of the addon last succeeded.
+# TYPE isopod_addon_last_success_timestamp_seconds gauge
+isopod_addon_last_success_timestamp_seconds{addon="ingress",cluster="prod \"us\""} 1571144400
+# EOF
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := writeMetrics(dir, tc.m); err != nil {
+				t.Fatalf("Failed to write metrics: %v", err)
+			}
+
+			files, err := filepath.Glob(filepath.Join(dir, "*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{filepath.Join(dir, "isopod_prod_us__ingress.prom")}
+			if d := cmp.Diff(want, files); d != "" {
+				t.Fatalf("Unexpected files (-want +got):\n%s", d)
+			}
+			got, err := ioutil.ReadFile(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, string(got)); d != "" {
+				t.Errorf("Unexpected metrics (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestWriteDiscoveryCacheMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isopod-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := WriteDiscoveryCacheMetrics(dir, 3, 1); err != nil {
+		t.Fatalf("Failed to write metrics: %v", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "isopod_discovery_cache.prom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP isopod_discovery_cache_hits Clusters of the last run whose API resources were reused from a cluster with the same server version and group versions.
+# TYPE isopod_discovery_cache_hits gauge
+isopod_discovery_cache_hits 3
+# HELP isopod_discovery_cache_misses Clusters of the last run whose API resources were discovered.
+# TYPE isopod_discovery_cache_misses gauge
+isopod_discovery_cache_misses 1
+`
+	if d := cmp.Diff(want, string(got)); d != "" {
+		t.Errorf("Unexpected metrics (-want +got):\n%s", d)
+	}
+}
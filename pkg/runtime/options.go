@@ -15,10 +15,13 @@
 package runtime
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"reflect"
 	"regexp"
+	"time"
 
 	gogo_proto "github.com/gogo/protobuf/proto"
 	"github.com/golang/protobuf/proto"
@@ -38,8 +41,13 @@ import (
 	// Plugin imports for auth.
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 
+	"github.com/cruise-automation/isopod/pkg/flags"
 	"github.com/cruise-automation/isopod/pkg/helm"
+	"github.com/cruise-automation/isopod/pkg/image"
 	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/loader"
+	"github.com/cruise-automation/isopod/pkg/replicate"
+	"github.com/cruise-automation/isopod/pkg/sops"
 	"github.com/cruise-automation/isopod/pkg/vault"
 )
 
@@ -50,10 +58,47 @@ type Option interface {
 }
 
 type options struct {
-	dryRun  bool
-	noSpin  bool
-	pkgs    starlark.StringDict
-	addonRe *regexp.Regexp
+	dryRun   bool
+	noSpin   bool
+	pkgs     starlark.StringDict
+	addonRe  *regexp.Regexp
+	prompter *Prompter
+	target   string
+	// maxAddons and addonTimeout are disabled if not positive.
+	maxAddons      int
+	addonTimeout   time.Duration
+	keepLeases     bool
+	prune          bool
+	resume         bool
+	explainW       io.Writer
+	reportStatus   bool
+	statusTimeout  time.Duration
+	watchResources bool
+	listW          io.Writer
+	listObjects    bool
+	stages         *stages
+	// definedClusters are all currently defined clusters (for store gc).
+	definedClusters map[string]bool
+	// restoreDir is the snapshot directory of the run to restore.
+	restoreDir string
+	// metricsDir is where metrics of addon installs are written (disabled if
+	// empty).
+	metricsDir string
+	// allowDeprecated allows installing addons past their sunset date and
+	// recordDeprecation is passed deprecation warnings (if set).
+	allowDeprecated   bool
+	recordDeprecation func(msg string)
+	// appliedBy is recorded with addon runs as who applied them and source
+	// as the git revision of the entry file.
+	appliedBy string
+	source    string
+	// vaultPreflight checks Vault paths addons reference before install.
+	vaultPreflight bool
+	// loaderOpts configure loading of the entry file and addon modules.
+	loaderOpts []loader.Option
+	// late are applied once all other options are, e.g so that packages
+	// using others don't depend on the order options are passed in.
+	late []fnOption
 }
 
 type fnOption func(*options) error
@@ -68,10 +113,213 @@ func WithNoSpin() Option {
 	})
 }
 
-// WithVault returns an Option that enables "vault" package.
-func WithVault(c *vapi.Client) Option {
+// WithMaxAddons returns an Option that fails Run if more than n addons are
+// returned by the addons Starlark function.
+func WithMaxAddons(n int) Option {
 	return fnOption(func(opts *options) error {
-		opts.pkgs["vault"] = vault.New(c, opts.dryRun)
+		opts.maxAddons = n
+		return nil
+	})
+}
+
+// WithAddonTimeout returns an Option that bounds loading and running each
+// addon to d.
+func WithAddonTimeout(d time.Duration) Option {
+	return fnOption(func(opts *options) error {
+		opts.addonTimeout = d
+		return nil
+	})
+}
+
+// WithCluster returns an Option that names the cluster the runtime targets
+// in prompts and explanations.
+func WithCluster(name string) Option {
+	return fnOption(func(opts *options) error {
+		opts.target = name
+		return nil
+	})
+}
+
+// WithInteractive option makes install preview changes of each addon and ask
+// p whether to apply them. Disables the spinner.
+func WithInteractive(p *Prompter) Option {
+	return fnOption(func(opts *options) error {
+		if opts.dryRun {
+			return errors.New("interactive mode cannot be combined with dry run")
+		}
+		opts.prompter = p
+		opts.noSpin = true
+		return nil
+	})
+}
+
+// WithExplainSelection returns an Option that makes Run print to w whether
+// each addon was selected (and why) instead of executing the command.
+func WithExplainSelection(w io.Writer) Option {
+	return fnOption(func(opts *options) error {
+		opts.explainW = w
+		return nil
+	})
+}
+
+// WithKeepLeases option keeps leases of dynamic Vault secrets read during Run
+// (these are revoked once Run returns by default).
+func WithKeepLeases() Option {
+	return fnOption(func(opts *options) error {
+		opts.keepLeases = true
+		return nil
+	})
+}
+
+// WithPrune option makes install delete objects applied by an addon in the
+// live rollout that the addon no longer applies.
+func WithPrune() Option {
+	return fnOption(func(opts *options) error {
+		opts.prune = true
+		return nil
+	})
+}
+
+// WithResume option makes install skip objects that a previous failed
+// install applied and that haven't changed since.
+func WithResume() Option {
+	return fnOption(func(opts *options) error {
+		opts.resume = true
+		return nil
+	})
+}
+
+// WithAppliedBy option records who (e.g user@host) applied each addon run in
+// the rollout store (see store.AddonRun).
+func WithAppliedBy(who string) Option {
+	return fnOption(func(opts *options) error {
+		opts.appliedBy = who
+		return nil
+	})
+}
+
+// WithSource option records the git revision of the entry file (e.g
+// `3f2c1ab (main, dirty)') each addon run was made from in the rollout store
+// (see store.AddonRun).
+func WithSource(rev string) Option {
+	return fnOption(func(opts *options) error {
+		opts.source = rev
+		return nil
+	})
+}
+
+// WithVaultPreflight option makes install first evaluate all selected addons
+// in a (silent) dry run to check that the Vault token has needed capabilities
+// on each path they read or write, and fail before applying anything if not.
+func WithVaultPreflight() Option {
+	return fnOption(func(opts *options) error {
+		opts.vaultPreflight = true
+		return nil
+	})
+}
+
+// WithStatusReport option makes install print status of objects applied by
+// each addon (e.g ready replicas of Deployments) once the rollout is live.
+func WithStatusReport() Option {
+	return fnOption(func(opts *options) error {
+		opts.reportStatus = true
+		return nil
+	})
+}
+
+// WithWatchResources option makes install tail status changes and events of
+// objects applied by each addon once the rollout is live, until all of them
+// are healthy or the user interrupts (skipped in dry run).
+func WithWatchResources() Option {
+	return fnOption(func(opts *options) error {
+		opts.watchResources = true
+		return nil
+	})
+}
+
+// WithListJSON option makes list write addons of each cluster to w as a
+// single line of JSON. If withObjects is set, install of each addon is
+// evaluated in a silent dry run and the kinds of objects it renders are
+// listed too.
+func WithListJSON(w io.Writer, withObjects bool) Option {
+	return fnOption(func(opts *options) error {
+		opts.listW = w
+		opts.listObjects = withObjects
+		return nil
+	})
+}
+
+// WithStatusTimeout option bounds reading back status of applied objects by
+// install (with WithStatusReport) and status commands. Status of objects not
+// read by then is reported as unknown. Disabled if not positive.
+func WithStatusTimeout(d time.Duration) Option {
+	return fnOption(func(opts *options) error {
+		opts.statusTimeout = d
+		return nil
+	})
+}
+
+// WithStages option makes ForEachCluster roll out to clusters stage by stage
+// in order of names, where the stage of a cluster is its `stage' attribute
+// (clusters of other stages are skipped). The rollout halts once a stage has
+// failures unless continueOnFailure is set. If bakeTime is positive it waits
+// that long in between stages (except in dry run mode).
+func WithStages(names []string, continueOnFailure bool, bakeTime time.Duration) Option {
+	return fnOption(func(opts *options) error {
+		if len(names) == 0 {
+			return fmt.Errorf("no stages given")
+		}
+		seen := map[string]bool{}
+		for _, n := range names {
+			if n == "" || seen[n] {
+				return fmt.Errorf("invalid stages %q: stage names must be non-empty and unique", names)
+			}
+			seen[n] = true
+		}
+		opts.stages = &stages{
+			names:             names,
+			continueOnFailure: continueOnFailure,
+			bakeTime:          bakeTime,
+		}
+		return nil
+	})
+}
+
+// WithHTTPModules returns an Option that enables loading modules by URL
+// pinned to their digest, e.g
+// `load("https://modules.internal/lib/foo.star@sha256:<digest>", "foo")'. See
+// loader.WithHTTPModules.
+func WithHTTPModules(c *http.Client, cacheDir string, offline bool) Option {
+	return fnOption(func(opts *options) error {
+		opts.loaderOpts = append(opts.loaderOpts, loader.WithHTTPModules(c, cacheDir, offline))
+		return nil
+	})
+}
+
+// WithVault returns an Option that enables "vault" package. vaultOpts are
+// passed to the package as-is.
+func WithVault(c *vapi.Client, vaultOpts ...vault.Option) Option {
+	return fnOption(func(opts *options) error {
+		opts.pkgs["vault"] = vault.New(c, opts.dryRun, vaultOpts...)
+		return nil
+	})
+}
+
+// WithImage returns an Option that enables "image" package. If noNetwork is
+// set image.resolve returns references unresolved. imageOpts are passed to the
+// package as-is.
+func WithImage(c *http.Client, noNetwork bool, imageOpts ...image.Option) Option {
+	return fnOption(func(opts *options) error {
+		opts.pkgs["image"] = image.New(c, noNetwork, imageOpts...)
+		return nil
+	})
+}
+
+// WithFlags returns an Option that makes flags.enabled evaluate feature flags
+// against f (flags have their default values otherwise).
+func WithFlags(f *flags.Flags) Option {
+	return fnOption(func(opts *options) error {
+		opts.pkgs["flags"] = flags.New(f)
 		return nil
 	})
 }
@@ -104,8 +352,9 @@ func (*protoRegistry) UnstableEnumValueMap(name string) map[string]int32 {
 	return nil
 }
 
-// WithKube returns an Option that enables "kube" package.
-func WithKube(c *rest.Config, diff bool) Option {
+// WithKube returns an Option that enables "kube" package. kubeOpts are passed
+// to the package as-is.
+func WithKube(c *rest.Config, diff bool, kubeOpts ...kube.Option) Option {
 	return fnOption(func(opts *options) error {
 		dC := discovery.NewDiscoveryClientForConfigOrDie(c)
 
@@ -119,29 +368,103 @@ func WithKube(c *rest.Config, diff bool) Option {
 			return err
 		}
 
-		opts.pkgs["kube"] = kube.New(c.Host, dC, dynC, &http.Client{Transport: t}, opts.dryRun, diff)
-		pkgs := skycfg.UnstablePredeclaredModules(&protoRegistry{})
-		for name, pkg := range pkgs {
-			opts.pkgs[name] = pkg
+		opts.pkgs["kube"] = kube.New(c.Host, dC, dynC, &http.Client{Transport: t}, opts.dryRun, diff, kubeOpts...)
+		predeclareProtos(opts)
+
+		return nil
+	})
+}
+
+// WithPackage returns an Option that predeclares pkg as name, e.g to enable
+// fake "kube" or "vault" packages in tests (see runtimetest package). Proto
+// packages are predeclared along with "kube" as in WithKube.
+func WithPackage(name string, pkg starlark.HasAttrs) Option {
+	return fnOption(func(opts *options) error {
+		opts.pkgs[name] = pkg
+		if name == "kube" {
+			predeclareProtos(opts)
 		}
+		return nil
+	})
+}
+
+// predeclareProtos predeclares proto packages used to construct Kubernetes
+// objects.
+func predeclareProtos(opts *options) {
+	for name, pkg := range skycfg.UnstablePredeclaredModules(&protoRegistry{}) {
+		opts.pkgs[name] = pkg
+	}
+}
+
+// WithHelm returns an Option that enables "helm" package (requires "kube"
+// package, and uses "vault" package if enabled, in any order). helmOpts are
+// passed to the package as-is.
+func WithHelm(baseDir string, helmOpts ...helm.Option) Option {
+	return fnOption(func(opts *options) error {
+		opts.late = append(opts.late, func(opts *options) error {
+			return newHelm(opts, baseDir, helmOpts)
+		})
+		return nil
+	})
+}
 
+// newHelm adds "helm" package to opts.
+func newHelm(opts *options, baseDir string, helmOpts []helm.Option) error {
+	v, ok := opts.pkgs["kube"]
+	if !ok {
+		return fmt.Errorf("kube package must be enabled")
+	}
+
+	d, ok := v.(kube.DynamicClient)
+	if !ok {
+		return fmt.Errorf("package doesn't implement kube.DynamicClient")
+	}
+
+	// Vault is optional and only used to resolve secrets in chart values.
+	var sr vault.SecretReader
+	if v, ok := opts.pkgs["vault"]; ok {
+		sr, _ = v.(vault.SecretReader)
+	}
+
+	opts.pkgs["helm"] = helm.New(d, sr, baseDir, opts.dryRun, helmOpts...)
+	return nil
+}
+
+// WithSops returns an Option that enables "sops" package decrypting files
+// under baseDir with sops binary (age private keys are read from ageKeyFile
+// if set, KMS keys are resolved by sops itself).
+func WithSops(baseDir, binary, ageKeyFile string) Option {
+	return fnOption(func(opts *options) error {
+		opts.pkgs["sops"] = sops.New(baseDir, binary, ageKeyFile)
 		return nil
 	})
 }
 
-func WithHelm(baseDir string) Option {
+// WithReplicateSecret returns an Option that enables "replicate_secret"
+// built-in (requires "kube" and, to replicate Vault secrets, "vault" options
+// to be applied first).
+func WithReplicateSecret() Option {
 	return fnOption(func(opts *options) error {
 		v, ok := opts.pkgs["kube"]
 		if !ok {
-			return fmt.Errorf("kube package must be initialized first")
+			return fmt.Errorf("kube package must be enabled")
 		}
 
 		d, ok := v.(kube.DynamicClient)
 		if !ok {
 			return fmt.Errorf("package doesn't implement kube.DynamicClient")
 		}
+		g, ok := v.(kube.SecretGetter)
+		if !ok {
+			return fmt.Errorf("package doesn't implement kube.SecretGetter")
+		}
 
-		opts.pkgs["helm"] = helm.New(d, baseDir)
+		var sr vault.SecretReader
+		if v, ok := opts.pkgs["vault"]; ok {
+			sr, _ = v.(vault.SecretReader)
+		}
+
+		opts.pkgs["replicate_secret"] = replicate.New(d, g, sr)
 
 		return nil
 	})
@@ -154,3 +477,52 @@ func WithAddonRegex(r *regexp.Regexp) Option {
 		return nil
 	})
 }
+
+// WithDefinedClusters option makes the `store gc' command delete store
+// entries of clusters that are not among clusters (identified as
+// Config.Cluster). Entries of other clusters are kept if not set.
+func WithDefinedClusters(clusters map[string]bool) Option {
+	return fnOption(func(opts *options) error {
+		opts.definedClusters = clusters
+		return nil
+	})
+}
+
+// WithRestore returns an Option that makes the `restore' command undo the run
+// snapshotted in dir (see kube.WithSnapshot).
+func WithRestore(dir string) Option {
+	return fnOption(func(opts *options) error {
+		opts.restoreDir = dir
+		return nil
+	})
+}
+
+// WithMetricsTextfile returns an Option that makes install write metrics of
+// each addon (e.g whether its last install succeeded and when it last did) to
+// a .prom file per addon and cluster in dir, to be read by the node_exporter
+// textfile collector. Nothing is written in dry run.
+func WithMetricsTextfile(dir string) Option {
+	return fnOption(func(opts *options) error {
+		opts.metricsDir = dir
+		return nil
+	})
+}
+
+// WithAllowDeprecated option makes install proceed with addons past their
+// sunset date (with a warning) rather than fail.
+func WithAllowDeprecated() Option {
+	return fnOption(func(opts *options) error {
+		opts.allowDeprecated = true
+		return nil
+	})
+}
+
+// WithDeprecationRecorder returns an Option that calls record with the
+// warning about each deprecated addon selected (e.g to add it to a diff
+// report).
+func WithDeprecationRecorder(record func(msg string)) Option {
+	return fnOption(func(opts *options) error {
+		opts.recordDeprecation = record
+		return nil
+	})
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+	isotesting "github.com/cruise-automation/isopod/pkg/testing"
+	"github.com/cruise-automation/isopod/pkg/util"
+)
+
+// kubeStub implements kube.DynamicClient without applying anything.
+type kubeStub struct{ *isopod.Module }
+
+func (kubeStub) Apply(*starlark.Thread, string, string, *starlark.List) (starlark.Value, error) {
+	return starlark.None, nil
+}
+
+// vaultStub implements vault.SecretReader with fixed secrets.
+type vaultStub struct {
+	*isopod.Module
+	secrets map[string]map[string]interface{}
+}
+
+func (v vaultStub) ReadSecret(_ context.Context, path string) (map[string]interface{}, error) {
+	return v.secrets[path], nil
+}
+
+func TestWithHelmOrder(t *testing.T) {
+	vault := vaultStub{
+		Module:  &isopod.Module{Name: "vault"},
+		secrets: map[string]map[string]interface{}{"secret/pilot": {"image": "pilot:v1"}},
+	}
+	c := &Config{
+		EntryFile:         "main.ipd",
+		GCPSvcAcctKeyFile: "some-sa-key",
+		UserAgent:         util.UserAgent{Product: "Isopod"},
+		KubeConfigPath:    "kubeconfig",
+		Store:             storeStub{},
+	}
+	// helm is enabled before the packages it uses.
+	r, err := New(c, WithNoSpin(), WithHelm("."), WithPackage("vault", vault), WithPackage("kube", kubeStub{&isopod.Module{Name: "kube"}}))
+	if err != nil {
+		t.Fatalf("Failed to create runtime: %v", err)
+	}
+
+	// Resolving a missing key tells that secrets are read from vault.
+	_, _, err = isotesting.Eval(t.Name(), `helm.apply(release_name="helm-test", chart="//../../testdata/istio/helm-test", namespace="istio-system", values=[{"pilot": {"image": "vault:secret/pilot#tag"}}])`, nil, r.(*runtime).pkgs)
+	if want := "key `tag' not found in Vault secret `secret/pilot'"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Want error containing %q, got: %v", want, err)
+	}
+
+	if _, err := New(c, WithNoSpin(), WithHelm(".")); err == nil || !strings.Contains(err.Error(), "kube package must be enabled") {
+		t.Errorf("Want error without kube package, got: %v", err)
+	}
+}
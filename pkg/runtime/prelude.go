@@ -0,0 +1,65 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// loadPreludes executes Starlark files at paths in order on thread and adds
+// their globals to pkgs so that they are predeclared in the entry file, in
+// addons and in modules these load (and in later preludes). Globals starting
+// with "_" are private to their prelude. Fails if a global would shadow a
+// built-in or a global of an earlier prelude.
+func loadPreludes(thread *starlark.Thread, paths []string, pkgs starlark.StringDict) error {
+	definedBy := map[string]string{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to load prelude: %v", err)
+		}
+		globals, err := starlark.ExecFile(thread, path, data, pkgs)
+		if err != nil {
+			return fmt.Errorf("failed to load prelude `%s': %v", path, err)
+		}
+
+		// Keys are sorted so that the same collision is always reported.
+		for _, name := range globals.Keys() {
+			if strings.HasPrefix(name, "_") {
+				continue
+			}
+			if prev, ok := definedBy[name]; ok {
+				return fmt.Errorf("prelude `%s' redefines `%s' already defined by prelude `%s'", path, name, prev)
+			}
+			if _, ok := pkgs[name]; ok || starlark.Universe.Has(name) {
+				return fmt.Errorf("prelude `%s' defines `%s' shadowing a built-in", path, name)
+			}
+		}
+		for _, name := range globals.Keys() {
+			if strings.HasPrefix(name, "_") {
+				continue
+			}
+			v := globals[name]
+			v.Freeze()
+			pkgs[name] = v
+			definedBy[name] = path
+		}
+	}
+	return nil
+}
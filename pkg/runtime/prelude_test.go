@@ -0,0 +1,138 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cruise-automation/isopod/pkg/util"
+)
+
+func TestPreludes(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "isopod-prelude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"main.ipd": `
+def addons(ctx):
+    return [addon(addon_name(), "addon.ipd", ctx)]
+`,
+		"addon.ipd": `
+def install(ctx):
+    if greeting() != "hello from helpers":
+        error("unexpected greeting: %s" % greeting())
+
+def remove(ctx):
+    pass
+`,
+		"helpers.ipd": `
+_prefix = "hello"
+
+def greeting():
+    return _prefix + " from helpers"
+`,
+		"names.ipd": `
+_prefix = "prelude"
+
+def addon_name():
+    return _prefix + "-addon"
+`,
+		"shadow_builtin.ipd": `
+def addon(name):
+    return name
+`,
+		"shadow_universe.ipd": `
+def len(x):
+    return 0
+`,
+		"redefine.ipd": `
+def greeting():
+    return "hi"
+`,
+		"broken.ipd": `
+greeting(
+`,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := func(name string) string { return filepath.Join(dir, name) }
+
+	for _, tc := range []struct {
+		name     string
+		preludes []string
+		wantErr  string
+	}{
+		{
+			name:     "Helpers predeclared in entry file and addons",
+			preludes: []string{p("helpers.ipd"), p("names.ipd")},
+		},
+		{
+			name:     "Shadows predeclared package",
+			preludes: []string{p("helpers.ipd"), p("names.ipd"), p("shadow_builtin.ipd")},
+			wantErr:  "prelude `" + p("shadow_builtin.ipd") + "' defines `addon' shadowing a built-in",
+		},
+		{
+			name:     "Shadows universe",
+			preludes: []string{p("shadow_universe.ipd")},
+			wantErr:  "prelude `" + p("shadow_universe.ipd") + "' defines `len' shadowing a built-in",
+		},
+		{
+			name:     "Redefines earlier prelude",
+			preludes: []string{p("helpers.ipd"), p("redefine.ipd")},
+			wantErr:  "prelude `" + p("redefine.ipd") + "' redefines `greeting' already defined by prelude `" + p("helpers.ipd") + "'",
+		},
+		{
+			name:     "Fails to execute",
+			preludes: []string{p("broken.ipd")},
+			wantErr:  "failed to load prelude `" + p("broken.ipd") + "': " + p("broken.ipd") + ":3:1: got end of file, want ')'",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := New(&Config{
+				EntryFile:         p("main.ipd"),
+				GCPSvcAcctKeyFile: "some-sa-key",
+				UserAgent:         util.UserAgent{Product: "Isopod"},
+				KubeConfigPath:    "kubeconfig",
+				Store:             storeStub{},
+				Preludes:          tc.preludes,
+			}, WithNoSpin())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotErr := ""
+			if err := r.Load(ctx); err != nil {
+				gotErr = err.Error()
+			} else if err := r.Run(ctx, InstallCommand, goMapToSkyCtx(nil)); err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Errorf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+		})
+	}
+}
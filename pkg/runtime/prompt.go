@@ -0,0 +1,89 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Decision is the answer to a Prompter question.
+type Decision int
+
+const (
+	// Apply means the addon should be applied.
+	Apply Decision = iota
+	// Skip means the addon should be left as is.
+	Skip
+	// Quit means neither this nor any of the remaining addons (and clusters)
+	// should be applied.
+	Quit
+)
+
+// Prompter asks the user whether to apply each addon in interactive mode.
+// A single Prompter is meant to be shared by runtimes of all clusters so that
+// quitting stops the whole run.
+type Prompter struct {
+	in          *bufio.Reader
+	out         io.Writer
+	autoApprove bool
+	quit        bool
+}
+
+// NewPrompter returns a Prompter reading answers from in and writing
+// questions to out. If autoApprove is set, every question is answered with
+// Apply without reading from in.
+func NewPrompter(in io.Reader, out io.Writer, autoApprove bool) *Prompter {
+	return &Prompter{in: bufio.NewReader(in), out: out, autoApprove: autoApprove}
+}
+
+// Ask prints question and reads the answer until a valid one is given.
+// Returns Quit without asking once the user has quit.
+func (p *Prompter) Ask(question string) (Decision, error) {
+	if p.quit {
+		return Quit, nil
+	}
+	if p.autoApprove {
+		fmt.Fprintf(p.out, "%s [a]pply/[s]kip/[q]uit: a (--yes)\n", question)
+		return Apply, nil
+	}
+
+	for {
+		fmt.Fprintf(p.out, "%s [a]pply/[s]kip/[q]uit: ", question)
+		line, err := p.in.ReadString('\n')
+		if err == io.EOF && line == "" {
+			p.quit = true
+			return Quit, fmt.Errorf("no answer given to `%s'", question)
+		} else if err != nil && err != io.EOF {
+			return Quit, err
+		}
+
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "a", "apply", "y", "yes":
+			return Apply, nil
+		case "s", "skip", "n", "no":
+			return Skip, nil
+		case "q", "quit":
+			p.quit = true
+			return Quit, nil
+		}
+		fmt.Fprintf(p.out, "Unrecognized answer %q.\n", strings.TrimSpace(line))
+	}
+}
+
+// HasQuit returns true if the user has quit.
+func (p *Prompter) HasQuit() bool { return p.quit }
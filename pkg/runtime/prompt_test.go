@@ -0,0 +1,95 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPrompter(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		input       string
+		autoApprove bool
+		want        []Decision
+		wantErr     string
+		wantOut     string
+	}{
+		{
+			name:  "Apply and skip",
+			input: "a\nskip\nYes\n",
+			want:  []Decision{Apply, Skip, Apply},
+			wantOut: "q? [a]pply/[s]kip/[q]uit: " +
+				"q? [a]pply/[s]kip/[q]uit: " +
+				"q? [a]pply/[s]kip/[q]uit: ",
+		},
+		{
+			name:  "Unrecognized answer",
+			input: "maybe\ns\n",
+			want:  []Decision{Skip},
+			wantOut: "q? [a]pply/[s]kip/[q]uit: Unrecognized answer \"maybe\".\n" +
+				"q? [a]pply/[s]kip/[q]uit: ",
+		},
+		{
+			name:    "Quit skips remaining questions",
+			input:   "q\na\n",
+			want:    []Decision{Quit, Quit},
+			wantOut: "q? [a]pply/[s]kip/[q]uit: ",
+		},
+		{
+			name:    "No answer",
+			input:   "",
+			want:    []Decision{Quit},
+			wantErr: "no answer given to `q?'",
+			wantOut: "q? [a]pply/[s]kip/[q]uit: ",
+		},
+		{
+			name:        "Auto approve",
+			autoApprove: true,
+			want:        []Decision{Apply, Apply},
+			wantOut:     strings.Repeat("q? [a]pply/[s]kip/[q]uit: a (--yes)\n", 2),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			p := NewPrompter(strings.NewReader(tc.input), out, tc.autoApprove)
+
+			var got []Decision
+			gotErr := ""
+			for range tc.want {
+				d, err := p.Ask("q?")
+				got = append(got, d)
+				if err != nil {
+					gotErr = err.Error()
+					break
+				}
+			}
+
+			if gotErr != tc.wantErr {
+				t.Errorf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected decisions (-want, +got):\n%s", d)
+			}
+			if d := cmp.Diff(tc.wantOut, out.String()); d != "" {
+				t.Errorf("Unexpected output (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
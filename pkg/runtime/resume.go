@@ -0,0 +1,110 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/golang/glog"
+
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// progress tracks objects applied during install so that the rollout can be
+// resumed if it fails (see kube.Resumer).
+type progress struct {
+	mu    sync.Mutex
+	state *store.ResumeState
+	// dirty is set if state changed since last stored.
+	dirty bool
+}
+
+func (p *progress) record(key, digest string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state.Applied[key] = digest
+	p.dirty = true
+}
+
+// trackProgress starts tracking objects applied by install. If r.resume is
+// set objects applied (and not changed since) by the previous failed run are
+// skipped. Returns nil progress if kube package is not available.
+func (r *runtime) trackProgress() (*progress, error) {
+	res, ok := r.pkgs["kube"].(kube.Resumer)
+	if !ok {
+		return nil, nil
+	}
+
+	p := &progress{state: &store.ResumeState{Applied: map[string]string{}}}
+	var applied map[string]string
+	if r.resume {
+		s, found, err := r.store.GetResumeState(r.Cluster)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get resume state: %v", err)
+		}
+		if found {
+			log.Infof("Resuming rollout, %d objects applied by previous run", len(s.Applied))
+			applied = s.Applied
+			for k, d := range applied {
+				p.state.Applied[k] = d
+			}
+		} else {
+			log.Info("No failed rollout to resume, applying all objects")
+		}
+	} else if !r.DryRun {
+		// Start over.
+		if err := r.store.DeleteResumeState(r.Cluster); err != nil {
+			return nil, fmt.Errorf("failed to delete resume state: %v", err)
+		}
+	}
+
+	var record func(key, digest string)
+	if !r.DryRun {
+		record = p.record
+	}
+	res.Resume(applied, record)
+	return p, nil
+}
+
+// storeProgress stores objects applied so far (if changed).
+func (r *runtime) storeProgress(p *progress) error {
+	if p == nil || r.DryRun {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.dirty {
+		return nil
+	}
+	if err := r.store.PutResumeState(r.Cluster, p.state); err != nil {
+		return fmt.Errorf("failed to store resume state: %v", err)
+	}
+	p.dirty = false
+	return nil
+}
+
+// completeProgress deletes progress stored for the completed rollout.
+func (r *runtime) completeProgress(p *progress) error {
+	if p == nil || r.DryRun {
+		return nil
+	}
+	if err := r.store.DeleteResumeState(r.Cluster); err != nil {
+		return fmt.Errorf("failed to delete resume state: %v", err)
+	}
+	return nil
+}
@@ -15,28 +15,34 @@
 package runtime
 
 import (
-	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
 	log "github.com/golang/glog"
-	spin "github.com/tj/go-spin"
 	"go.starlark.net/resolve"
 	"go.starlark.net/starlark"
 
 	"github.com/cruise-automation/isopod/pkg/addon"
 	"github.com/cruise-automation/isopod/pkg/cloud"
+	"github.com/cruise-automation/isopod/pkg/cloud/eks"
 	"github.com/cruise-automation/isopod/pkg/cloud/gke"
 	"github.com/cruise-automation/isopod/pkg/cloud/onprem"
+	"github.com/cruise-automation/isopod/pkg/cloud/vcluster"
+	"github.com/cruise-automation/isopod/pkg/flags"
+	"github.com/cruise-automation/isopod/pkg/kube"
 	"github.com/cruise-automation/isopod/pkg/loader"
+	"github.com/cruise-automation/isopod/pkg/redact"
 	"github.com/cruise-automation/isopod/pkg/store"
 	"github.com/cruise-automation/isopod/pkg/util"
+	"github.com/cruise-automation/isopod/pkg/vault"
 )
 
 const (
@@ -51,6 +57,28 @@ const (
 	// TestCommand will run Isopod in unit test mode with external services
 	// stubbed with mocks.
 	TestCommand Command = "test"
+	// StatusCommand will print status of live objects applied by all chosen
+	// addons in the live rollout.
+	StatusCommand Command = "status"
+	// StoreGCCommand will delete stale entries of the rollout store (e.g of
+	// addons or clusters that are no longer defined).
+	StoreGCCommand Command = "store gc"
+	// StoreInitCommand will create the rollout store namespace along with
+	// the ServiceAccount and RBAC it needs (no addons are run).
+	StoreInitCommand Command = "store init"
+	// ConsistencyCommand will render all chosen addons (in dry run) so that
+	// objects rendered differently across clusters can be reported.
+	ConsistencyCommand Command = "consistency"
+	// ExportChartCommand will render the chosen addon (in dry run) so that
+	// its objects can be exported as a Helm chart.
+	ExportChartCommand Command = "export-chart"
+	// HistoryCommand will print past runs of the chosen addon recorded in the
+	// rollout store.
+	HistoryCommand Command = "history"
+	// RestoreCommand will undo a past run of all chosen addons by re-applying
+	// objects snapshotted before the run mutated them and deleting objects
+	// the run created (see WithRestore).
+	RestoreCommand Command = "restore"
 
 	// ClustersStarFunc is the name of the function in Starlark that returns
 	// a list of Starlark built-ins that implement cloud.KubernetesVendor
@@ -76,8 +104,85 @@ type Runtime interface {
 	// ForEachCluster calls the ClustersStarFunc in the main Starlark file with
 	// userCtx as argument to get a list of Starlark built-ins that implement
 	// the cloud.KubernetesVendor interface. It then iterates through each
-	// cluster to call the user given fn.
-	ForEachCluster(ctx context.Context, userCtx map[string]string, fn func(k8sVendor cloud.KubernetesVendor)) error
+	// cluster to call the user given fn and aggregates the results of all
+	// calls.
+	ForEachCluster(ctx context.Context, userCtx map[string]string, fn func(k8sVendor cloud.KubernetesVendor) error) (*ClusterResults, error)
+
+	// Globals returns Starlark globals predeclared for the main entry file
+	// and addons (built-in packages and functions).
+	Globals() starlark.StringDict
+}
+
+// Exit codes reported by Isopod binary.
+const (
+	// ExitSuccess is returned if all clusters succeeded (or none were
+	// selected).
+	ExitSuccess = 0
+	// ExitFatal is returned on failures not specific to any cluster (e.g
+	// invalid flags or main Starlark file).
+	ExitFatal = 1
+	// ExitPartialFailure is returned if some (but not all) clusters failed.
+	ExitPartialFailure = 2
+	// ExitTotalFailure is returned if all selected clusters failed.
+	ExitTotalFailure = 3
+	// ExitInconsistent is returned by `consistency' if objects differ
+	// between clusters of the same group.
+	ExitInconsistent = 4
+)
+
+// ClusterResults aggregates per-cluster results of ForEachCluster.
+type ClusterResults struct {
+	// Total is the number of clusters visited.
+	Total int
+	// Failed is the number of clusters for which fn returned an error.
+	Failed int
+	// Errors are the errors returned by fn keyed by cluster name.
+	Errors map[string]error
+	// Halted is set if a failed stage halted a staged rollout, in which
+	// case Skipped is the number of clusters in the remaining stages.
+	Halted  bool
+	Skipped int
+}
+
+// Add records result err of visiting cluster.
+func (r *ClusterResults) Add(cluster cloud.KubernetesVendor, err error) {
+	r.Total++
+	if err == nil {
+		return
+	}
+	r.Failed++
+	if r.Errors == nil {
+		r.Errors = map[string]error{}
+	}
+	r.Errors[fmt.Sprint(cluster)] = err
+}
+
+// Report writes the number of failed clusters and the error of each (sorted
+// by cluster name) to w. Writes nothing if no cluster failed.
+func (r *ClusterResults) Report(w io.Writer) {
+	if r.Failed == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%d out of %d clusters failed:\n", r.Failed, r.Total)
+	var names []string
+	for name := range r.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s: %v\n", name, r.Errors[name])
+	}
+}
+
+// ExitCode maps r to one of the Exit* codes.
+func (r *ClusterResults) ExitCode() int {
+	switch {
+	case r.Failed == 0:
+		return ExitSuccess
+	case r.Failed < r.Total:
+		return ExitPartialFailure
+	}
+	return ExitTotalFailure
 }
 
 // runtime implements Runtime with Isopod builtins and globals from entry file.
@@ -89,6 +194,55 @@ type runtime struct {
 	addonRe *regexp.Regexp
 	store   store.Store
 	noSpin  bool
+	// out multiplexes progress and output of concurrent runtimes.
+	out *display
+	// target names the cluster the runtime targets.
+	target string
+	// prompter is set in interactive mode to confirm each addon installed
+	// to target cluster.
+	prompter *Prompter
+	// maxAddons and addonTimeout are disabled if not positive.
+	maxAddons    int
+	addonTimeout time.Duration
+	keepLeases   bool
+	prune        bool
+	resume       bool
+	// explainW is set to explain addon selection instead of running.
+	explainW io.Writer
+	// reportStatus prints status of applied objects once installed.
+	reportStatus  bool
+	statusTimeout time.Duration
+	// watchResources tails status and events of applied objects once
+	// installed.
+	watchResources bool
+	// listW is set to write list of addons to as JSON, along with kinds of
+	// objects they render if listObjects is set.
+	listW       io.Writer
+	listObjects bool
+	// stages orders ForEachCluster by cluster stage if set.
+	stages *stages
+	// definedClusters are all currently defined clusters (for store gc).
+	definedClusters map[string]bool
+	// restoreDir is the snapshot directory of the run to restore.
+	restoreDir string
+	// metricsDir is where metrics of addon installs are written (disabled if
+	// empty).
+	metricsDir string
+	// allowDeprecated allows installing addons past their sunset date and
+	// recordDeprecation is passed deprecation warnings (if set).
+	allowDeprecated   bool
+	recordDeprecation func(msg string)
+	// appliedBy is recorded with addon runs as who applied them and source
+	// as the git revision of the entry file.
+	appliedBy string
+	source    string
+	// vaultPreflight checks Vault capabilities before install.
+	vaultPreflight bool
+	// loaderOpts configure loading of the entry file (and addon modules).
+	loaderOpts []loader.Option
+	// timedOut is set once a run exceeds addonTimeout. It may still be
+	// running, so nothing else is run on target (see withTimeout).
+	timedOut error
 }
 
 func init() {
@@ -109,10 +263,14 @@ func New(c *Config, opts ...Option) (Runtime, error) {
 	options := &options{
 		dryRun: c.DryRun,
 		pkgs: starlark.StringDict{
-			"error":  starlark.NewBuiltin("error", addon.ErrorFn),
-			"sleep":  starlark.NewBuiltin("sleep", addon.SleepFn),
-			"gke":    gke.NewGKEBuiltin(c.GCPSvcAcctKeyFile, c.UserAgent),
-			"onprem": onprem.NewOnPremBuiltin(c.KubeConfigPath),
+			"error":       starlark.NewBuiltin("error", addon.ErrorFn),
+			"sleep":       starlark.NewBuiltin("sleep", addon.SleepFn),
+			"gke":         gke.NewGKEBuiltin(c.GCPSvcAcctKeyFile, []byte(c.GCPSvcAcctKeyJSON), c.UserAgent.For(util.GKEBackend), gke.WithTokenCache(c.GCPTokenCacheFile), gke.WithTLSPolicy(c.TLSPolicy)),
+			"gke_cluster": gke.NewGKEClusterBuiltin(c.GCPSvcAcctKeyFile, []byte(c.GCPSvcAcctKeyJSON), c.UserAgent.For(util.GKEBackend), gke.WithTokenCache(c.GCPTokenCacheFile), gke.WithTLSPolicy(c.TLSPolicy)),
+			"eks_cluster": eks.NewEKSClusterBuiltin(c.KubeConfigPath),
+			"onprem":      onprem.NewOnPremBuiltin(c.KubeConfigPath),
+			"vcluster":    vcluster.NewVClusterBuiltin(),
+			"flags":       flags.New(nil),
 		},
 	}
 	for _, o := range opts {
@@ -120,26 +278,61 @@ func New(c *Config, opts ...Option) (Runtime, error) {
 			return nil, fmt.Errorf("failed to apply options: %v", err)
 		}
 	}
+	for _, o := range options.late {
+		if err := o.apply(options); err != nil {
+			return nil, fmt.Errorf("failed to apply options: %v", err)
+		}
+	}
 
 	pkgs := options.pkgs
-	pkgs["addon"] = addon.NewAddonBuiltin(filepath.Dir(c.EntryFile), options.pkgs)
+	pkgs["addon"] = addon.NewAddonBuiltin(filepath.Dir(c.EntryFile), options.pkgs, options.loaderOpts...)
 	for n, pkg := range util.Predeclared() {
 		pkgs[n] = pkg
 	}
 
 	return &runtime{
-		Config:  *c,
-		pkgs:    pkgs,
-		addonRe: options.addonRe,
-		store:   c.Store,
-		noSpin:  options.noSpin,
+		Config:         *c,
+		pkgs:           pkgs,
+		addonRe:        options.addonRe,
+		store:          c.Store,
+		noSpin:         options.noSpin,
+		out:            stdout,
+		prompter:       options.prompter,
+		target:         options.target,
+		maxAddons:      options.maxAddons,
+		addonTimeout:   options.addonTimeout,
+		keepLeases:     options.keepLeases,
+		prune:          options.prune,
+		resume:         options.resume,
+		explainW:       options.explainW,
+		reportStatus:   options.reportStatus,
+		statusTimeout:  options.statusTimeout,
+		watchResources: options.watchResources,
+		listW:          options.listW,
+		listObjects:    options.listObjects,
+		stages:         options.stages,
+
+		definedClusters: options.definedClusters,
+		restoreDir:      options.restoreDir,
+		metricsDir:      options.metricsDir,
+		appliedBy:       options.appliedBy,
+		source:          options.source,
+		vaultPreflight:  options.vaultPreflight,
+		loaderOpts:      options.loaderOpts,
+
+		allowDeprecated:   options.allowDeprecated,
+		recordDeprecation: options.recordDeprecation,
 	}, nil
 }
 
 func (r *runtime) Load(ctx context.Context) error {
 	thread := &starlark.Thread{
 		Print: printFn,
-		Load:  loader.NewModulesLoaderWithPredeclaredPkgs(filepath.Dir(r.EntryFile), r.pkgs).Load,
+		Load:  loader.NewModulesLoaderWithPredeclaredPkgs(filepath.Dir(r.EntryFile), r.pkgs, r.loaderOpts...).Load,
+	}
+
+	if err := loadPreludes(thread, r.Preludes, r.pkgs); err != nil {
+		return err
 	}
 
 	data, err := ioutil.ReadFile(r.EntryFile)
@@ -154,34 +347,43 @@ func (r *runtime) Load(ctx context.Context) error {
 	return nil
 }
 
-type runStatus struct {
-	err    error
-	msgs   []string
-	doneCh chan struct{}
+// printf prints a line of install output prefixed by the target cluster
+// (keeping it coherent with output of runtimes of other clusters).
+func (r *runtime) printf(format string, args ...interface{}) {
+	r.out.printf(clusterPrefix(r.target), format, args...)
 }
 
-// spinMsg prints spinner while waiting on doneCh to return status, then exits.
-// Closes doneCh on exit.
-func spinMsg(addonName string, doneCh chan *runStatus) {
-	s := spin.New()
-	s.Set(spin.Spin1)
-	for {
-		select {
-		case <-time.After(100 * time.Millisecond):
-			fmt.Printf("\r Installing %s... %s", addonName, s.Next())
-		case s := <-doneCh:
-			defer close(s.doneCh)
-
-			if s.err != nil {
-				fmt.Printf("\r Installing %s... err: %v\n", addonName, s.err)
-			} else {
-				fmt.Printf("\r Installing %s... done\n", addonName)
-			}
-			fmt.Printf("\t%s\n", strings.Join(s.msgs, "\n\t"))
+// changedSecrets describes secrets in cur whose versions differ from ones in
+// live. Returns nothing if there are no live versions to compare against.
+// Secrets without a version (in either) are only reported if newly consumed.
+func changedSecrets(live, cur map[string]string) []string {
+	if live == nil {
+		return nil
+	}
 
-			return
+	var out []string
+	for path, v := range cur {
+		liveV, ok := live[path]
+		switch {
+		case !ok && v == "":
+			out = append(out, fmt.Sprintf("secret `%s' newly consumed (unversioned)", path))
+		case !ok:
+			out = append(out, fmt.Sprintf("secret `%s' newly consumed (version %s)", path, v))
+		case !versioned(liveV) || !versioned(v):
+			// Changes of secrets without a version can't be told from
+			// reads of dynamic secrets, which differ every time.
+		case liveV != v:
+			out = append(out, fmt.Sprintf("secret `%s' changed (version %s -> %s)", path, liveV, v))
 		}
 	}
+	sort.Strings(out)
+	return out
+}
+
+// versioned returns true if v is an actual version of a secret, as opposed to
+// empty or a hash of unversioned data recorded by earlier runs.
+func versioned(v string) bool {
+	return v != "" && !strings.HasPrefix(v, "sha256:")
 }
 
 func (r *runtime) runCommand(ctx context.Context, cmd Command, addons []*addon.Addon) error {
@@ -196,6 +398,9 @@ func (r *runtime) runCommand(ctx context.Context, cmd Command, addons []*addon.A
 
 	switch cmd {
 	case ListCommand:
+		if r.listW != nil {
+			return r.listJSON(ctx, r.listW, addons)
+		}
 		var lstMsgs []string
 		for _, a := range addons {
 			lstMsgs = append(lstMsgs, a.StringPretty())
@@ -203,71 +408,181 @@ func (r *runtime) runCommand(ctx context.Context, cmd Command, addons []*addon.A
 		// TODO(dmitry-ilyevskiy): Print "live" status.
 		fmt.Printf("Configured addons:\n\t%s\n", strings.Join(lstMsgs, "\n\t"))
 	case InstallCommand:
-		rollout, err := r.store.CreateRollout()
+		rollout, err := r.store.CreateRollout(r.Cluster)
 		if err != nil {
 			return fmt.Errorf("failed to initilize rollout state: %v", err)
 		}
 
-		fmt.Printf("Beginning rollout [%v] installation...\n", rollout.ID)
+		r.printf("Beginning rollout [%v] installation...\n", rollout.ID)
+
+		p, err := r.trackProgress()
+		if err != nil {
+			return err
+		}
+
+		// Secret versions consumed and objects applied by the addons in the
+		// live rollout.
+		liveSecrets := map[string]map[string]string{}
+		liveObjRefs := map[string][]store.ObjRef{}
+		if live, found, err := r.store.GetLive(r.Cluster); err != nil {
+			log.Warningf("Failed to get live rollout state: %v", err)
+		} else if found {
+			for _, a := range live.Addons {
+				liveSecrets[a.Name] = a.SecretVersions
+				liveObjRefs[a.Name] = a.ObjRefs
+			}
+		}
 
 		if err := runUntilErr(addons, func(a *addon.Addon) (err error) {
-			if !r.noSpin {
-				doneCh := make(chan *runStatus)
-
-				// Redirect stderr while we're spinning and filter out "proto: X"
-				// log spam (restore stderr on exit).
-				oldErr := os.Stderr
-				r, w, err := os.Pipe()
-				if err != nil {
-					return fmt.Errorf("can't create pipe2 for stderr redirect: %v", err)
+			if r.prompter != nil {
+				if ok, err := r.confirmInstall(ctx, a, liveObjRefs[a.Name]); err != nil || !ok {
+					return err
 				}
-				os.Stderr = w
-
-				defer func() {
-					// Restor stderr and close pipe.
-					os.Stderr = oldErr
-					w.Close()
-
-					sc := bufio.NewScanner(r)
-					s := &runStatus{err: err, doneCh: make(chan struct{})}
-					for sc.Scan() {
-						if strings.Contains(sc.Text(), "proto: ") {
-							continue
-						}
-						s.msgs = append(s.msgs, sc.Text())
-					}
-
-					doneCh <- s
-					<-s.doneCh
-				}()
-
-				go spinMsg(a.Name, doneCh)
 			}
 
-			if err := a.Install(ctx); err != nil {
+			if r.metricsDir != "" && !r.DryRun {
+				start := time.Now()
+				defer func() { r.recordMetrics(a, start, err) }()
+			}
+
+			if !r.noSpin {
+				l := r.out.start(clusterPrefix(r.target), "Installing "+a.Name)
+				defer func() { r.out.finish(l, err) }()
+			}
+
+			if tx, ok := r.pkgs["kube"].(kube.Transactor); ok && a.Atomic && !r.DryRun {
+				tx.Begin(a.Name)
+				defer func() { err = r.endTransaction(ctx, tx, a, err) }()
+			}
+
+			nLeases := len(r.leases())
+			err = r.install(ctx, a, liveObjRefs[a.Name])
+			if serr := r.storeProgress(p); serr != nil {
+				log.Errorf("%s: %v", a.Name, serr)
+			}
+			if err != nil {
 				return err
 			}
+			leases := r.leases()[nLeases:]
+			for _, id := range leases {
+				if r.DryRun {
+					r.printf("%s: opened Vault lease `%s'\n", a.Name, id)
+				}
+				log.Infof("%s: opened Vault lease `%s'", a.Name, id)
+			}
 
-			if _, err := r.store.PutAddonRun(rollout.ID, &store.AddonRun{
-				Name:    a.Name,
-				Modules: a.LoadedModules(),
-				// TODO(dmitry-ilyevskiy): Fill in .Data and .ObjRefs.
+			for _, ref := range r.skipped(a.Name) {
+				name := ref.Name
+				if ref.Namespace != "" {
+					name = ref.Namespace + "/" + name
+				}
+				msg := fmt.Sprintf("%s: %s `%s' %s", a.Name, strings.ToLower(ref.Kind), name, r.skipReason(a.Name, ref))
+				r.printf("%s\n", msg)
+				log.Info(msg)
+			}
+
+			for _, msg := range changedSecrets(liveSecrets[a.Name], a.SecretVersions()) {
+				if r.DryRun {
+					r.printf("%s: %s\n", a.Name, msg)
+				}
+				log.Infof("%s: %s", a.Name, msg)
+			}
+
+			if _, err := r.store.PutAddonRun(r.Cluster, rollout.ID, &store.AddonRun{
+				Name:           a.Name,
+				Modules:        a.LoadedModules(),
+				SecretVersions: a.SecretVersions(),
+				Leases:         leases,
+				ObjRefs:        r.applied(a.Name),
+				AppliedAt:      time.Now(),
+				AppliedBy:      r.appliedBy,
+				Source:         r.source,
+				// TODO(dmitry-ilyevskiy): Fill in .Data.
 			}); err != nil {
 				return fmt.Errorf("failed to store run state for `%s' addon: %v", a.Name, err)
 			}
 			return err
 		}); err != nil {
-			return fmt.Errorf("failed addon installation: %v", err)
+			return fmt.Errorf("failed addon installation: %s", redact.String(err.Error()))
 		}
 
-		if err := r.store.CompleteRollout(rollout.ID); err != nil {
+		if rc, ok := r.pkgs["kube"].(kube.RequestsCounter); ok {
+			if delta := rc.RequestsDelta(); len(delta) > 0 {
+				msg := fmt.Sprintf("Resource requests delta: %s", kube.FormatRequests(delta))
+				if r.DryRun {
+					r.printf("%s\n", msg)
+				}
+				log.Info(msg)
+			}
+		}
+
+		if err := r.store.CompleteRollout(r.Cluster, rollout.ID); err != nil {
 			return fmt.Errorf("failed to commit `live' rollout state: %v", err)
 		}
+		if err := r.completeProgress(p); err != nil {
+			log.Error(err)
+		}
 
-		fmt.Printf("Rollout [%v] is live!\n", rollout.ID)
-	case RemoveCommand:
+		r.printf("Rollout [%v] is live!\n", rollout.ID)
+
+		if r.reportStatus && !r.DryRun {
+			objRefs := map[string][]store.ObjRef{}
+			for _, a := range addons {
+				objRefs[a.Name] = r.applied(a.Name)
+			}
+			r.printStatus(ctx, addons, objRefs)
+		}
+		if r.watchResources && !r.DryRun {
+			objRefs := map[string][]store.ObjRef{}
+			for _, a := range addons {
+				objRefs[a.Name] = r.applied(a.Name)
+			}
+			r.watchApplied(ctx, addons, objRefs)
+		}
+	case StatusCommand:
+		live, found, err := r.store.GetLive(r.Cluster)
+		if err != nil {
+			return fmt.Errorf("failed to get live rollout state: %v", err)
+		}
+		if !found {
+			fmt.Printf("No live rollout on %s.\n", r.Cluster)
+			return nil
+		}
+		objRefs := map[string][]store.ObjRef{}
+		for _, a := range live.Addons {
+			objRefs[a.Name] = a.ObjRefs
+		}
+		fmt.Printf("Rollout [%v] is live.\n", live.ID)
+		r.printStatus(ctx, addons, objRefs)
+	case StoreGCCommand:
+		return r.gcStore(addons)
+	case HistoryCommand:
+		return r.printHistory(os.Stdout, addons)
+	case ConsistencyCommand, ExportChartCommand:
+		// Objects are recorded as they are rendered (see
+		// kube.WithRenderRecorder), so no rollout is created.
+		return runUntilErr(addons, func(a *addon.Addon) error {
+			return r.withTimeout(addon.WithDryRun(ctx), a.Install)
+		})
+	case RestoreCommand:
+		rs, ok := r.pkgs["kube"].(kube.Restorer)
+		if !ok {
+			return fmt.Errorf("`%s' requires kube package", cmd)
+		}
 		return runUntilErr(addons, func(a *addon.Addon) error {
-			return a.Remove(ctx)
+			return r.withTimeout(ctx, func(ctx context.Context) error {
+				return rs.Restore(ctx, a.Name, r.restoreDir)
+			})
+		})
+	case RemoveCommand:
+		// Remove in reverse order of install so that addons others depend on
+		// (e.g CRDs or namespaces) go last.
+		reversed := make([]*addon.Addon, 0, len(addons))
+		for i := len(addons) - 1; i >= 0; i-- {
+			reversed = append(reversed, addons[i])
+		}
+		return runUntilErr(reversed, func(a *addon.Addon) error {
+			return r.withTimeout(ctx, a.Remove)
 		})
 	default:
 		return fmt.Errorf("command `%s' is not implemented", cmd)
@@ -275,9 +590,251 @@ func (r *runtime) runCommand(ctx context.Context, cmd Command, addons []*addon.A
 	return nil
 }
 
-func (r *runtime) Run(ctx context.Context, cmd Command, skyCtx starlark.Value) error {
+// preflightVault evaluates install of addons in a silent dry run to find Vault
+// paths they need capabilities on that the token lacks. Fails listing these
+// if any. Addons that fail to evaluate are logged and skipped (install will
+// report their errors).
+func (r *runtime) preflightVault(ctx context.Context, addons []*addon.Addon) error {
+	pf := &vault.Preflight{}
+	for _, a := range addons {
+		pCtx := vault.WithPreflight(addon.WithSilentDryRun(ctx), pf, a.Name)
+		if err := r.withTimeout(pCtx, a.Install); err != nil {
+			log.Warningf("Vault preflight of %v stopped: %v", a, err)
+		}
+	}
+
+	missing := pf.Missing()
+	if len(missing) == 0 {
+		log.Infof("Vault preflight passed for %d addon(s)", len(addons))
+		return nil
+	}
+	lines := make([]string, 0, len(missing))
+	for _, m := range missing {
+		lines = append(lines, "  "+m.String())
+	}
+	return fmt.Errorf("Vault preflight failed, token lacks capabilities on %d path(s):\n%s", len(missing), strings.Join(lines, "\n"))
+}
+
+// checkRequestsDelta evaluates install of addons in a silent dry run to
+// estimate the total change in resource requests of their workloads. Fails
+// if it exceeds the max (if any is configured) so that nothing is applied
+// rather than the rollout stopping half way. Addons that fail to evaluate are
+// logged and skipped (install will report their errors). In dry run mode
+// each object is checked as it is previewed instead.
+func (r *runtime) checkRequestsDelta(ctx context.Context, addons []*addon.Addon) error {
+	rc, ok := r.pkgs["kube"].(kube.RequestsCounter)
+	if !ok || r.DryRun || len(rc.MaxRequestsDelta()) == 0 {
+		return nil
+	}
+
+	e := &kube.RequestsEstimate{}
+	for _, a := range addons {
+		eCtx := kube.WithRequestsEstimate(addon.WithSilentDryRun(ctx), e)
+		if err := r.withTimeout(eCtx, a.Install); err != nil {
+			log.Warningf("Resource requests estimate of %v stopped: %v", a, err)
+		}
+	}
+
+	delta := rc.RequestsDelta()
+	for name, q := range e.Delta() {
+		total := delta[name]
+		total.Add(q)
+		delta[name] = total
+	}
+	log.Infof("Estimated resource requests delta: %s", kube.FormatRequests(delta))
+	if err := kube.CheckRequestsDelta(delta, rc.MaxRequestsDelta()); err != nil {
+		return fmt.Errorf("resource requests check failed, nothing was applied: %v", err)
+	}
+	return nil
+}
+
+// withTimeout calls fn with ctx bounded by r.addonTimeout (if set).
+// Starlark execution can't be interrupted, so once the timeout expires fn is
+// abandoned (built-ins abort pending requests and sleeps made with ctx and
+// fail right away) and fails every later call so that nothing runs alongside
+// it.
+func (r *runtime) withTimeout(ctx context.Context, fn func(context.Context) error) error {
+	if r.timedOut != nil {
+		return fmt.Errorf("cluster failed: an earlier addon run %v and may still be running", r.timedOut)
+	}
+	if r.addonTimeout <= 0 {
+		return fn(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.addonTimeout)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- fn(ctx) }()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		if ctx.Err() != context.DeadlineExceeded {
+			return ctx.Err()
+		}
+		r.timedOut = fmt.Errorf("timed out after %v", r.addonTimeout)
+		go func() {
+			if err := <-errCh; err != nil {
+				log.Infof("Run interrupted by timeout ended with: %v", err)
+			}
+		}()
+		return r.timedOut
+	}
+}
+
+// install installs a and (if pruning is enabled) prunes objects in prev that
+// a no longer applies.
+func (r *runtime) install(ctx context.Context, a *addon.Addon, prev []store.ObjRef) error {
+	return r.withTimeout(ctx, func(ctx context.Context) error {
+		if err := a.Install(ctx); err != nil {
+			return err
+		}
+		p, ok := r.pkgs["kube"].(kube.Pruner)
+		if !r.prune || !ok {
+			return nil
+		}
+		return p.Prune(ctx, a.Name, prev)
+	})
+}
+
+// applied returns references to objects applied by addonName (if "kube"
+// package is enabled).
+func (r *runtime) applied(addonName string) []store.ObjRef {
+	if p, ok := r.pkgs["kube"].(kube.Pruner); ok {
+		return p.Applied(addonName)
+	}
+	return nil
+}
+
+// skipped returns references to objects of addonName skipped by their guards
+// or the object filter (if "kube" package is enabled).
+func (r *runtime) skipped(addonName string) []store.ObjRef {
+	if s, ok := r.pkgs["kube"].(kube.Skipper); ok {
+		return s.Skipped(addonName)
+	}
+	return nil
+}
+
+// skipReason explains why ref was skipped by addonName.
+func (r *runtime) skipReason(addonName string, ref store.ObjRef) string {
+	if s, ok := r.pkgs["kube"].(kube.Skipper); ok {
+		return s.SkipReason(addonName, ref)
+	}
+	return ""
+}
+
+// printStatus prints status of objRefs (by addon name) applied by addons.
+// Gives up on objects not read within r.statusTimeout (if set).
+func (r *runtime) printStatus(ctx context.Context, addons []*addon.Addon, objRefs map[string][]store.ObjRef) {
+	sr, ok := r.pkgs["kube"].(kube.StatusReader)
+	if !ok {
+		return
+	}
+	if r.statusTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.statusTimeout)
+		defer cancel()
+	}
+
+	fmt.Println("Status of applied objects:")
+	for _, a := range addons {
+		statuses := sr.ReadStatus(ctx, objRefs[a.Name])
+		if len(statuses) == 0 {
+			continue
+		}
+		fmt.Printf("  %s:\n", a.Name)
+		for _, s := range statuses {
+			fmt.Printf("\t%v\n", s)
+			log.Infof("%s: %v", a.Name, s)
+		}
+	}
+}
+
+// confirmInstall previews changes a would make (as with dry run) and asks
+// r.prompter whether to install it. Returns false if the addon must be
+// skipped.
+func (r *runtime) confirmInstall(ctx context.Context, a *addon.Addon, prev []store.ObjRef) (bool, error) {
+	if r.prompter.HasQuit() {
+		return false, nil
+	}
+
+	fmt.Printf("Changes to `%s' addon on %s:\n", a.Name, r.target)
+	if err := r.install(addon.WithDryRun(ctx), a, prev); err != nil {
+		return false, fmt.Errorf("failed to preview changes: %v", err)
+	}
+
+	d, err := r.prompter.Ask(fmt.Sprintf("Apply `%s' addon to %s?", a.Name, r.target))
+	if err != nil {
+		return false, err
+	}
+	switch d {
+	case Skip:
+		fmt.Printf("Skipped `%s' addon.\n", a.Name)
+		return false, nil
+	case Quit:
+		fmt.Println("Quit, remaining addons and clusters are skipped.")
+		return false, nil
+	}
+	return true, nil
+}
+
+// explain prints selection decision for a (and the reason behind it) if
+// explaining selection.
+func (r *runtime) explain(a *addon.Addon, selected bool, reason string) {
+	if r.explainW == nil {
+		return
+	}
+	decision := "skipped"
+	if selected {
+		decision = "selected"
+	}
+	fmt.Fprintf(r.explainW, "%s: addon `%s' %s: %s\n", r.target, a.Name, decision, reason)
+}
+
+// leases returns IDs of Vault leases opened so far (if "vault" package is
+// enabled).
+func (r *runtime) leases() []string {
+	if lr, ok := r.pkgs["vault"].(vault.LeaseRevoker); ok {
+		return lr.Leases()
+	}
+	return nil
+}
+
+// revokeLeases revokes all Vault leases opened so far unless r.keepLeases is
+// set.
+func (r *runtime) revokeLeases(ctx context.Context) error {
+	lr, ok := r.pkgs["vault"].(vault.LeaseRevoker)
+	if !ok || len(lr.Leases()) == 0 {
+		return nil
+	}
+	if r.keepLeases {
+		log.Infof("Keeping Vault leases: %v", lr.Leases())
+		return nil
+	}
+	return lr.RevokeLeases(ctx)
+}
+
+func (r *runtime) Run(ctx context.Context, cmd Command, skyCtx starlark.Value) (err error) {
 	log.Infof("runtime running with `%v' command", cmd)
 
+	// Revoke leases on both success and failure.
+	defer func() {
+		if rErr := r.revokeLeases(ctx); rErr != nil {
+			if err == nil {
+				err = rErr
+			} else {
+				log.Errorf("Failed to revoke Vault leases: %v", rErr)
+			}
+		}
+	}()
+
+	if sCtx, ok := skyCtx.(*addon.SkyCtx); ok && r.Profile != "" {
+		if _, ok := sCtx.Attrs[profileCtxKey]; !ok {
+			sCtx.Attrs[profileCtxKey] = starlark.String(r.Profile)
+		}
+	}
+
 	ret, err := r.callStarlarkFunc(ctx, AddonsStarFunc, starlark.Tuple{skyCtx})
 	if err != nil {
 		return err
@@ -288,6 +845,10 @@ func (r *runtime) Run(ctx context.Context, cmd Command, skyCtx starlark.Value) e
 		return fmt.Errorf("%v must be a list (got a %s)", ret, ret.Type())
 	}
 
+	if r.maxAddons > 0 && addonsList.Len() > r.maxAddons {
+		return fmt.Errorf("`%s' returned %d addons, more than the max of %d", AddonsStarFunc, addonsList.Len(), r.maxAddons)
+	}
+
 	var loaded []*addon.Addon
 	var loadedNs []string
 	for i := 0; i < addonsList.Len(); i++ {
@@ -299,16 +860,50 @@ func (r *runtime) Run(ctx context.Context, cmd Command, skyCtx starlark.Value) e
 
 		if r.addonRe != nil && !r.addonRe.MatchString(a.Name) {
 			log.V(1).Infof("%v doesn't match filter regexp (%v), skipping...", a, r.addonRe)
+			r.explain(a, false, fmt.Sprintf("doesn't match addon filter `%v'", r.addonRe))
+			continue
+		}
+		if r.addonRe == nil || r.addonRe.String() == "" {
+			r.explain(a, true, fmt.Sprintf("returned by `%s' with no addon filter", AddonsStarFunc))
+		} else {
+			r.explain(a, true, fmt.Sprintf("matches addon filter `%v'", r.addonRe))
+		}
+		if r.explainW != nil {
 			continue
 		}
 
-		if err := a.Load(ctx); err != nil {
+		if err := r.withTimeout(ctx, a.Load); err != nil {
 			return fmt.Errorf("%v load failed: %v", a, err)
 		}
 		loaded = append(loaded, a)
+	}
+
+	if r.explainW != nil {
+		return nil
+	}
+
+	// Higher priority addons go first, otherwise in order returned.
+	sort.SliceStable(loaded, func(i, j int) bool { return loaded[i].Priority > loaded[j].Priority })
+	for _, a := range loaded {
 		loadedNs = append(loadedNs, a.Name)
 	}
 
+	if err := r.checkDeprecated(cmd, loaded, time.Now()); err != nil {
+		return err
+	}
+
+	if cmd == InstallCommand && r.vaultPreflight {
+		if err := r.preflightVault(ctx, loaded); err != nil {
+			return err
+		}
+	}
+
+	if cmd == InstallCommand {
+		if err := r.checkRequestsDelta(ctx, loaded); err != nil {
+			return err
+		}
+	}
+
 	log.Infof("Running `%s' for %v...", cmd, loadedNs)
 
 	if err := r.runCommand(ctx, cmd, loaded); err != nil {
@@ -346,17 +941,59 @@ func goMapToSkyCtx(m map[string]string) *addon.SkyCtx {
 	return &addon.SkyCtx{Attrs: skyParams}
 }
 
-func (r *runtime) ForEachCluster(ctx context.Context, userCtx map[string]string, fn func(k8sVendor cloud.KubernetesVendor)) error {
-	ret, err := r.callStarlarkFunc(ctx, "clusters", starlark.Tuple{goMapToSkyCtx(userCtx)})
+// Globals implements Runtime.Globals.
+func (r *runtime) Globals() starlark.StringDict { return r.pkgs }
+
+// profileCtxKey is the ctx attribute that holds Config.Profile.
+const profileCtxKey = "profile"
+
+// clusterWithCtx is a cluster whose addon ctx has global context params
+// merged in.
+type clusterWithCtx struct {
+	cloud.KubernetesVendor
+	skyCtx *addon.SkyCtx
+}
+
+// AddonSkyCtx implements cloud.KubernetesVendor.
+func (c *clusterWithCtx) AddonSkyCtx() *addon.SkyCtx { return c.skyCtx }
+
+// String returns the name of the wrapped cluster.
+func (c *clusterWithCtx) String() string { return fmt.Sprint(c.KubernetesVendor) }
+
+// withGlobalCtx returns cluster with userCtx params merged into its addon
+// ctx (attributes of the cluster take precedence). The cluster itself is left
+// as-is since it may be shared, e.g defined in a loaded module.
+func withGlobalCtx(cluster cloud.KubernetesVendor, userCtx map[string]string) cloud.KubernetesVendor {
+	if len(userCtx) == 0 {
+		return cluster
+	}
+	skyCtx := goMapToSkyCtx(userCtx)
+	for k, v := range cluster.AddonSkyCtx().Attrs {
+		skyCtx.Attrs[k] = v
+	}
+	return &clusterWithCtx{KubernetesVendor: cluster, skyCtx: skyCtx}
+}
+
+func (r *runtime) ForEachCluster(ctx context.Context, userCtx map[string]string, fn func(k8sVendor cloud.KubernetesVendor) error) (*ClusterResults, error) {
+	skyCtx := goMapToSkyCtx(userCtx)
+	if r.Profile != "" {
+		if p, ok := userCtx[profileCtxKey]; ok && p != r.Profile {
+			return nil, fmt.Errorf("profile `%s' conflicts with `%s=%s' context parameter", r.Profile, profileCtxKey, p)
+		}
+		skyCtx.Attrs[profileCtxKey] = starlark.String(r.Profile)
+	}
+
+	ret, err := r.callStarlarkFunc(ctx, "clusters", starlark.Tuple{skyCtx})
 	if err != nil {
-		return fmt.Errorf("error when calling `clusters': %v ", err)
+		return nil, fmt.Errorf("error when calling `clusters': %v ", err)
 	}
 
 	chosenClusters, ok := ret.(*starlark.List)
 	if !ok {
-		return fmt.Errorf("%v must be a list (got a `%s')", ret, ret.Type())
+		return nil, fmt.Errorf("%v must be a list (got a `%s')", ret, ret.Type())
 	}
 
+	var clusters []cloud.KubernetesVendor
 	iter := chosenClusters.Iterate()
 	defer iter.Done()
 	var cluster starlark.Value
@@ -367,10 +1004,18 @@ func (r *runtime) ForEachCluster(ctx context.Context, userCtx map[string]string,
 			log.Errorf("Builtin `%v' does not implement cloud.KubernetesVendor interface. Skipping...", cluster)
 			continue
 		}
+		clusters = append(clusters, withGlobalCtx(k8sVendor, userCtx))
+	}
 
-		fn(k8sVendor)
+	if r.stages != nil {
+		return r.forEachStage(ctx, clusters, fn)
 	}
-	return nil
+
+	res := &ClusterResults{}
+	for _, k8sVendor := range clusters {
+		res.Add(k8sVendor, fn(k8sVendor))
+	}
+	return res, nil
 }
 
-func printFn(_ *starlark.Thread, msg string) { fmt.Println(msg) }
+func printFn(_ *starlark.Thread, msg string) { fmt.Println(redact.String(msg)) }
@@ -15,42 +15,66 @@
 package runtime
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"go.starlark.net/starlark"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 
+	isopod "github.com/cruise-automation/isopod/pkg"
+	"github.com/cruise-automation/isopod/pkg/addon"
 	"github.com/cruise-automation/isopod/pkg/cloud"
+	"github.com/cruise-automation/isopod/pkg/kube"
 	"github.com/cruise-automation/isopod/pkg/store"
+	"github.com/cruise-automation/isopod/pkg/util"
 )
 
 // storeStub implements Store interface for no-op store.
 type storeStub struct{}
 
-func (storeStub) CreateRollout() (*store.Rollout, error) { return &store.Rollout{}, nil }
+func (storeStub) CreateRollout(string) (*store.Rollout, error) { return &store.Rollout{}, nil }
 
-func (storeStub) PutAddonRun(id store.RolloutID, _ *store.AddonRun) (store.RunID, error) {
+func (storeStub) PutAddonRun(_ string, id store.RolloutID, _ *store.AddonRun) (store.RunID, error) {
 	return "", nil
 }
 
-func (storeStub) CompleteRollout(id store.RolloutID) error { return nil }
+func (storeStub) CompleteRollout(_ string, id store.RolloutID) error { return nil }
 
-func (storeStub) GetLive() (*store.Rollout, bool, error) {
+func (storeStub) GetLive(string) (*store.Rollout, bool, error) {
 	return nil, false, nil
 }
 
-func (storeStub) GetRollout(id store.RolloutID) (r *store.Rollout, found bool, err error) {
+func (storeStub) GetRollout(_ string, id store.RolloutID) (r *store.Rollout, found bool, err error) {
 	return nil, false, nil
 }
 
+func (storeStub) PutResumeState(string, *store.ResumeState) error { return nil }
+
+func (storeStub) GetResumeState(string) (*store.ResumeState, bool, error) {
+	return nil, false, nil
+}
+
+func (storeStub) DeleteResumeState(string) error { return nil }
+
 func TestForEachCluster(t *testing.T) {
 	ctx := context.Background()
 
 	runtime, err := New(&Config{
 		EntryFile:         "../../testdata/main.ipd",
 		GCPSvcAcctKeyFile: "some-sa-key",
-		UserAgent:         "Isopod",
+		UserAgent:         util.UserAgent{Product: "Isopod"},
 		KubeConfigPath:    "kubeconfig",
 		Store:             storeStub{},
 		DryRun:            false,
@@ -81,16 +105,21 @@ func TestForEachCluster(t *testing.T) {
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			var gotClusters []string
-			if err := runtime.ForEachCluster(ctx, tc.selector, func(k8sVendor cloud.KubernetesVendor) {
+			res, err := runtime.ForEachCluster(ctx, tc.selector, func(k8sVendor cloud.KubernetesVendor) error {
 				c := k8sVendor.AddonSkyCtx()
 				gotClusters = append(gotClusters, string(c.Attrs["cluster"].(starlark.String)))
 
 				if err := runtime.Run(ctx, InstallCommand, c); err != nil {
 					t.Errorf("Run failed: %v", err)
 				}
-			}); err != nil {
+				return nil
+			})
+			if err != nil {
 				t.Fatal(err)
 			}
+			if res.Total != len(tc.expectClusters) || res.Failed != 0 {
+				t.Errorf("Unexpected results: %+v", res)
+			}
 
 			if d := cmp.Diff(tc.expectClusters, gotClusters); d != "" {
 				t.Errorf("Unexpected cluster (-want, +got):\n%s", d)
@@ -98,3 +127,582 @@ func TestForEachCluster(t *testing.T) {
 		})
 	}
 }
+
+func TestForEachClusterWithProfile(t *testing.T) {
+	ctx := context.Background()
+
+	runtime, err := New(&Config{
+		EntryFile:         "../../testdata/main.ipd",
+		GCPSvcAcctKeyFile: "some-sa-key",
+		UserAgent:         util.UserAgent{Product: "Isopod"},
+		KubeConfigPath:    "kubeconfig",
+		Store:             storeStub{},
+		Profile:           "staging",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runtime.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotClusters []string
+	if _, err := runtime.ForEachCluster(ctx, map[string]string{}, func(k8sVendor cloud.KubernetesVendor) error {
+		c := k8sVendor.AddonSkyCtx()
+		gotClusters = append(gotClusters, string(c.Attrs["cluster"].(starlark.String)))
+
+		if err := runtime.Run(ctx, InstallCommand, c); err != nil {
+			t.Errorf("Run failed: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := cmp.Diff([]string{"paas-staging"}, gotClusters); d != "" {
+		t.Errorf("Unexpected cluster (-want, +got):\n%s", d)
+	}
+
+	wantErr := "profile `staging' conflicts with `profile=prod' context parameter"
+	_, err = runtime.ForEachCluster(ctx, map[string]string{"profile": "prod"}, func(cloud.KubernetesVendor) error { return nil })
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("Unexpected error.\nWant: %s\nGot: %v", wantErr, err)
+	}
+}
+
+func TestForEachClusterGlobalCtx(t *testing.T) {
+	ctx := context.Background()
+
+	runtime, err := New(&Config{
+		EntryFile:         "../../testdata/main.ipd",
+		GCPSvcAcctKeyFile: "some-sa-key",
+		UserAgent:         util.UserAgent{Product: "Isopod"},
+		KubeConfigPath:    "kubeconfig",
+		Store:             storeStub{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runtime.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]map[string]string{}
+	userCtx := map[string]string{"env": "dev", "location": "global", "cidr": "10.0.0.0/8"}
+	if _, err := runtime.ForEachCluster(ctx, userCtx, func(k8sVendor cloud.KubernetesVendor) error {
+		attrs := map[string]string{}
+		for k, v := range k8sVendor.AddonSkyCtx().Attrs {
+			attrs[k] = string(v.(starlark.String))
+		}
+		got[attrs["cluster"]] = attrs
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]string{
+		// Attributes of the cluster take precedence.
+		"paas-dev": {
+			"cluster":  "paas-dev",
+			"env":      "dev",
+			"location": "us-west1",
+			"project":  "cruise-paas-dev",
+			"cidr":     "10.0.0.0/8",
+		},
+		"minikube": {
+			"cluster":  "minikube",
+			"env":      "dev",
+			"location": "global",
+			"cidr":     "10.0.0.0/8",
+		},
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("Unexpected addon ctx (-want, +got):\n%s", d)
+	}
+}
+
+func TestForEachClusterResults(t *testing.T) {
+	ctx := context.Background()
+
+	runtime, err := New(&Config{
+		EntryFile:         "../../testdata/main.ipd",
+		GCPSvcAcctKeyFile: "some-sa-key",
+		UserAgent:         util.UserAgent{Product: "Isopod"},
+		KubeConfigPath:    "kubeconfig",
+		Store:             storeStub{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runtime.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name         string
+		failClusters map[string]bool
+		want         ClusterResults
+		wantCode     int
+	}{
+		{
+			name:     "Success",
+			want:     ClusterResults{Total: 4},
+			wantCode: ExitSuccess,
+		},
+		{
+			name:         "Partial failure",
+			failClusters: map[string]bool{"paas-prod": true},
+			want:         ClusterResults{Total: 4, Failed: 1},
+			wantCode:     ExitPartialFailure,
+		},
+		{
+			name:         "Total failure",
+			failClusters: map[string]bool{"paas-dev": true, "paas-staging": true, "paas-prod": true, "minikube": true},
+			want:         ClusterResults{Total: 4, Failed: 4},
+			wantCode:     ExitTotalFailure,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := runtime.ForEachCluster(ctx, map[string]string{}, func(k8sVendor cloud.KubernetesVendor) error {
+				c := string(k8sVendor.AddonSkyCtx().Attrs["cluster"].(starlark.String))
+				if tc.failClusters[c] {
+					return errors.New(c + " failed")
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wantErrs, gotErrs []string
+			for c := range tc.failClusters {
+				wantErrs = append(wantErrs, c+" failed")
+			}
+			for _, err := range res.Errors {
+				gotErrs = append(gotErrs, err.Error())
+			}
+			sort.Strings(wantErrs)
+			sort.Strings(gotErrs)
+			if d := cmp.Diff(wantErrs, gotErrs); d != "" {
+				t.Errorf("Unexpected cluster errors (-want, +got):\n%s", d)
+			}
+			res.Errors = nil
+			if d := cmp.Diff(tc.want, *res); d != "" {
+				t.Errorf("Unexpected results (-want, +got):\n%s", d)
+			}
+			if got := res.ExitCode(); got != tc.wantCode {
+				t.Errorf("Unexpected exit code. Want: %d, got: %d", tc.wantCode, got)
+			}
+		})
+	}
+}
+
+func TestClusterResultsReport(t *testing.T) {
+	var buf bytes.Buffer
+	(&ClusterResults{Total: 3}).Report(&buf)
+	if buf.Len() != 0 {
+		t.Errorf("Unexpected report of successful clusters: %q", buf.String())
+	}
+
+	res := &ClusterResults{
+		Total:  3,
+		Failed: 2,
+		Errors: map[string]error{
+			"<gke: prod>":    errors.New("addons run failed"),
+			"<gke: staging>": errors.New("failed to build kube rest config"),
+		},
+	}
+	res.Report(&buf)
+	want := `2 out of 3 clusters failed:
+  <gke: prod>: addons run failed
+  <gke: staging>: failed to build kube rest config
+`
+	if d := cmp.Diff(want, buf.String()); d != "" {
+		t.Errorf("Unexpected report (-want, +got):\n%s", d)
+	}
+}
+
+func TestChangedSecrets(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		live, cur map[string]string
+		want      []string
+	}{
+		{
+			name: "No live run",
+			cur:  map[string]string{"secret/foo": "1"},
+		},
+		{
+			name: "Changed and new secrets",
+			live: map[string]string{"secret/foo": "1", "secret/bar": "2", "secret/baz": "1"},
+			cur:  map[string]string{"secret/foo": "2", "secret/bar": "2", "secret/qux": "5"},
+			want: []string{
+				"secret `secret/foo' changed (version 1 -> 2)",
+				"secret `secret/qux' newly consumed (version 5)",
+			},
+		},
+		{
+			name: "Unversioned secrets",
+			live: map[string]string{"secret/foo": "sha256:db4a7ecb114b", "secret/bar": "", "secret/baz": "3"},
+			cur:  map[string]string{"secret/foo": "", "secret/bar": "", "secret/baz": "", "secret/qux": ""},
+			want: []string{"secret `secret/qux' newly consumed (unversioned)"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if d := cmp.Diff(tc.want, changedSecrets(tc.live, tc.cur)); d != "" {
+				t.Errorf("Unexpected changed secrets (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestCheckRequestsDelta(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "isopod-requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	deployment := func(name string, replicas int) string {
+		return fmt.Sprintf(`
+def install(ctx):
+    kube.put_yaml(data=["""
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: %s
+  namespace: default
+spec:
+  replicas: %d
+  template:
+    spec:
+      containers:
+      - name: app
+        resources:
+          requests:
+            cpu: 1
+"""])
+
+def remove(ctx):
+    pass
+`, name, replicas)
+	}
+	files := map[string]string{
+		"main.ipd": `
+def addons(ctx):
+    return [addon("small", "small.ipd", ctx), addon("big", "big.ipd", ctx)]
+`,
+		"small.ipd": deployment("small", 1),
+		"big.ipd":   deployment("big", 20),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newKube, closeFn, err := kube.NewFakePackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	max := corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("10")}
+	r, err := New(&Config{
+		EntryFile:         filepath.Join(dir, "main.ipd"),
+		GCPSvcAcctKeyFile: "some-sa-key",
+		UserAgent:         util.UserAgent{Product: "Isopod"},
+		KubeConfigPath:    "kubeconfig",
+		Store:             storeStub{},
+	}, WithNoSpin(), WithPackage("kube", newKube(kube.WithMaxRequestsDelta(max))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Run(ctx, InstallCommand, goMapToSkyCtx(map[string]string{}))
+	if want := "nothing was applied: total cpu requests delta of 21 exceeds the max of 10"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("Expected install to fail with %q, got: %v", want, err)
+	}
+
+	// The addon within the max isn't applied either.
+	thread := &starlark.Thread{}
+	thread.SetLocal(addon.GoCtxKey, ctx)
+	exists, err := starlark.Eval(thread, t.Name(), `kube.exists(deployment="default/small")`, starlark.StringDict{"kube": newKube()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists == starlark.True {
+		t.Error("Expected `small' deployment not to be applied")
+	}
+}
+
+func TestAddonBounds(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "isopod-bounds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"main.ipd": `
+def addons(ctx):
+    return [addon("addon-%d" % i, "addon.ipd", ctx) for i in range(int(ctx.count))]
+`,
+		"addon.ipd": `
+def install(ctx):
+    sleep(ctx.delay)
+
+def remove(ctx):
+    pass
+`,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		count   string
+		delay   string
+		opts    []Option
+		wantErr string
+	}{
+		{
+			name:  "Within bounds",
+			count: "3",
+			delay: "1ms",
+			opts:  []Option{WithMaxAddons(3), WithAddonTimeout(time.Minute)},
+		},
+		{
+			name:    "Too many addons",
+			count:   "4",
+			delay:   "1ms",
+			opts:    []Option{WithMaxAddons(3)},
+			wantErr: "`addons' returned 4 addons, more than the max of 3",
+		},
+		{
+			name:    "Timed out",
+			count:   "2",
+			delay:   "1m",
+			opts:    []Option{WithAddonTimeout(10 * time.Millisecond)},
+			wantErr: "`install' execution failed: failed addon installation: <addon: addon-0> run failed: timed out after 10ms",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := New(&Config{
+				EntryFile:         filepath.Join(dir, "main.ipd"),
+				GCPSvcAcctKeyFile: "some-sa-key",
+				UserAgent:         util.UserAgent{Product: "Isopod"},
+				KubeConfigPath:    "kubeconfig",
+				Store:             storeStub{},
+			}, append(tc.opts, WithNoSpin())...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Load(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			gotErr := ""
+			skyCtx := goMapToSkyCtx(map[string]string{"count": tc.count, "delay": tc.delay})
+			if err := r.Run(ctx, InstallCommand, skyCtx); err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Errorf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+		})
+	}
+}
+
+func TestWithTimeoutAbandons(t *testing.T) {
+	r := &runtime{addonTimeout: 10 * time.Millisecond}
+	stuck := make(chan struct{})
+	defer close(stuck)
+	start := time.Now()
+	err := r.withTimeout(context.Background(), func(context.Context) error {
+		// Ignores ctx and never returns, as a busy-looping addon would.
+		<-stuck
+		return nil
+	})
+	if want := "timed out after 10ms"; err == nil || err.Error() != want {
+		t.Errorf("Unexpected error.\nWant: %s\nGot: %v", want, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected withTimeout to return right after the timeout, took %v", d)
+	}
+
+	called := false
+	err = r.withTimeout(context.Background(), func(context.Context) error {
+		called = true
+		return nil
+	})
+	if want := "cluster failed: an earlier addon run timed out after 10ms and may still be running"; err == nil || err.Error() != want {
+		t.Errorf("Unexpected error.\nWant: %s\nGot: %v", want, err)
+	}
+	if called {
+		t.Error("Expected no further runs once a run timed out")
+	}
+}
+
+func TestExplainSelection(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name    string
+		addonRe string
+		want    string
+	}{
+		{
+			name: "No filter",
+			want: "minikube: addon `test' selected: returned by `addons' with no addon filter\n",
+		},
+		{
+			name:    "Matched",
+			addonRe: "^te",
+			want:    "minikube: addon `test' selected: matches addon filter `^te'\n",
+		},
+		{
+			name:    "Filtered out",
+			addonRe: "^ingress$",
+			want:    "minikube: addon `test' skipped: doesn't match addon filter `^ingress$'\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			r, err := New(&Config{
+				EntryFile:         "../../testdata/main.ipd",
+				GCPSvcAcctKeyFile: "some-sa-key",
+				UserAgent:         util.UserAgent{Product: "Isopod"},
+				KubeConfigPath:    "kubeconfig",
+				Store:             storeStub{},
+			},
+				WithAddonRegex(regexp.MustCompile(tc.addonRe)),
+				WithCluster("minikube"),
+				WithExplainSelection(out),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Load(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			skyCtx := goMapToSkyCtx(map[string]string{"cluster": "minikube", "env": "dev"})
+			if err := r.Run(ctx, InstallCommand, skyCtx); err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, out.String()); d != "" {
+				t.Errorf("Unexpected explanation (-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestAddonOrder(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "isopod-order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"main.ipd": `
+def addons(ctx):
+    return [addon(n, "addon.ipd", ctx) for n in ["crds", "namespaces", "app"]]
+`,
+		"priority.ipd": `
+def addons(ctx):
+    return [
+        addon("app", "addon.ipd", ctx),
+        addon("dns", "addon.ipd", ctx, priority=100),
+        addon("monitoring", "addon.ipd", ctx, priority=-1),
+        addon("cni", "addon.ipd", ctx, priority=100),
+        addon("ingress", "addon.ipd", ctx),
+    ]
+`,
+		"addon.ipd": `
+def install(ctx):
+    recorder.record()
+
+def remove(ctx):
+    recorder.record()
+`,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name, entryFile string
+		cmd             Command
+		want            []string
+	}{
+		{
+			name:      "Remove in reverse",
+			entryFile: "main.ipd",
+			cmd:       RemoveCommand,
+			want:      []string{"app", "namespaces", "crds"},
+		},
+		{
+			name:      "Install by priority",
+			entryFile: "priority.ipd",
+			cmd:       InstallCommand,
+			want:      []string{"dns", "cni", "app", "ingress", "monitoring"},
+		},
+		{
+			name:      "Remove by priority",
+			entryFile: "priority.ipd",
+			cmd:       RemoveCommand,
+			want:      []string{"monitoring", "ingress", "app", "cni", "dns"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			recorder := &isopod.Module{
+				Name: "recorder",
+				Attrs: starlark.StringDict{
+					"record": starlark.NewBuiltin("recorder.record", func(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+						got = append(got, t.Local(addon.NameKey).(string))
+						return starlark.None, nil
+					}),
+				},
+			}
+			r, err := New(&Config{
+				EntryFile:         filepath.Join(dir, tc.entryFile),
+				GCPSvcAcctKeyFile: "some-sa-key",
+				UserAgent:         util.UserAgent{Product: "Isopod"},
+				KubeConfigPath:    "kubeconfig",
+				Store:             storeStub{},
+			}, WithNoSpin(), WithPackage("recorder", recorder))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Load(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(ctx, tc.cmd, goMapToSkyCtx(map[string]string{})); err != nil {
+				t.Fatal(err)
+			}
+
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected %s order (-want +got):\n%s", tc.cmd, d)
+			}
+		})
+	}
+}
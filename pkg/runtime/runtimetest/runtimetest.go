@@ -0,0 +1,168 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package runtimetest provides a Runtime backed by fake Kubernetes and Vault
+// servers and an in-memory rollout store for integration tests of Isopod
+// features.
+//
+// Usage:
+//
+//	f, err := runtimetest.New("testdata/main.ipd")
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer f.Close()
+//
+//	if err := f.Load(ctx); err != nil {
+//		t.Fatal(err)
+//	}
+//	if err := f.Run(ctx, runtime.InstallCommand, runtimetest.Ctx(map[string]string{"env": "dev"})); err != nil {
+//		t.Fatal(err)
+//	}
+//	live, found, err := f.Store.GetLive(runtimetest.Cluster)
+package runtimetest
+
+import (
+	"go.starlark.net/starlark"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/runtime"
+	"github.com/cruise-automation/isopod/pkg/store"
+	kubestore "github.com/cruise-automation/isopod/pkg/store/kube"
+	"github.com/cruise-automation/isopod/pkg/util"
+	"github.com/cruise-automation/isopod/pkg/vault"
+)
+
+// Cluster identifies the fake cluster in Fake.Store.
+const Cluster = "https://fake-cluster"
+
+// Fake is a Runtime with "kube" and "vault" packages backed by fake servers
+// and an in-memory store.
+type Fake struct {
+	runtime.Runtime
+
+	// Store keeps rollouts of Cluster in Clientset.
+	Store store.Store
+	// Clientset backs Store.
+	Clientset *fake.Clientset
+	// Kube is the "kube" package (also implements kube.Pruner, kube.Resumer,
+	// etc).
+	Kube starlark.HasAttrs
+	// Vault is the "vault" package.
+	Vault starlark.HasAttrs
+
+	closeFns []func()
+}
+
+// options configure New.
+type options struct {
+	kubeOpts    []kube.Option
+	runtimeOpts []runtime.Option
+	config      runtime.Config
+}
+
+// Option configures Fake returned by New.
+type Option interface {
+	apply(*options)
+}
+
+type fnOption func(*options)
+
+func (fn fnOption) apply(opts *options) { fn(opts) }
+
+// WithKubeOptions returns an Option that passes kubeOpts to the "kube"
+// package.
+func WithKubeOptions(kubeOpts ...kube.Option) Option {
+	return fnOption(func(opts *options) {
+		opts.kubeOpts = append(opts.kubeOpts, kubeOpts...)
+	})
+}
+
+// WithRuntimeOptions returns an Option that passes runtimeOpts to
+// runtime.New (after the ones enabling fake packages).
+func WithRuntimeOptions(runtimeOpts ...runtime.Option) Option {
+	return fnOption(func(opts *options) {
+		opts.runtimeOpts = append(opts.runtimeOpts, runtimeOpts...)
+	})
+}
+
+// WithProfile returns an Option that sets runtime.Config.Profile.
+func WithProfile(profile string) Option {
+	return fnOption(func(opts *options) {
+		opts.config.Profile = profile
+	})
+}
+
+// New returns a Fake runtime for entryFile configured with opts. Close must
+// be called once done to shut down the fake servers.
+func New(entryFile string, opts ...Option) (*Fake, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt.apply(o)
+	}
+
+	f := &Fake{Clientset: fake.NewSimpleClientset()}
+	f.Store = kubestore.New(f.Clientset, "default")
+
+	newKube, kClose, err := kube.NewFakePackages()
+	if err != nil {
+		return nil, err
+	}
+	f.closeFns = append(f.closeFns, kClose)
+	f.Kube = newKube(o.kubeOpts...)
+
+	v, vClose, err := vault.NewFake()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.closeFns = append(f.closeFns, vClose)
+	f.Vault = v
+
+	c := o.config
+	c.EntryFile = entryFile
+	c.UserAgent = util.UserAgent{Product: "Isopod/test"}
+	c.Store = f.Store
+	c.Cluster = Cluster
+	rOpts := append([]runtime.Option{
+		runtime.WithPackage("kube", f.Kube),
+		runtime.WithPackage("vault", f.Vault),
+		runtime.WithNoSpin(),
+	}, o.runtimeOpts...)
+	if f.Runtime, err = runtime.New(&c, rOpts...); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Close shuts down the fake servers.
+func (f *Fake) Close() {
+	for _, fn := range f.closeFns {
+		fn()
+	}
+	f.closeFns = nil
+}
+
+// Ctx returns addon ctx with attrs (as passed to the addons Starlark
+// function by Runtime.Run).
+func Ctx(attrs map[string]string) *addon.SkyCtx {
+	c := addon.NewCtx()
+	for k, v := range attrs {
+		c.Attrs[k] = starlark.String(v)
+	}
+	return c
+}
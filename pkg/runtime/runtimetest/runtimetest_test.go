@@ -0,0 +1,97 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtimetest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/cruise-automation/isopod/pkg/runtime"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+var files = map[string]string{
+	"main.ipd": `
+def addons(ctx):
+    return [addon("app", "app.ipd", ctx)]
+`,
+	"app.ipd": `
+def install(ctx):
+    vault.write("secret/app", password="hunter2")
+    password = vault.read("secret/app")["password"]
+    kube.put_yaml(name="app", namespace="default", data=["""
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+  namespace: default
+data:
+  env: %s
+  password: %s
+""" % (ctx.env, password)])
+
+def remove(ctx):
+    kube.delete(configmap="default/app")
+`,
+}
+
+func TestFake(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "isopod-runtimetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := New(filepath.Join(dir, "main.ipd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := f.Load(ctx); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := f.Run(ctx, runtime.InstallCommand, Ctx(map[string]string{"env": "dev"})); err != nil {
+		t.Fatalf("Install failed: %v", err)
+	}
+
+	live, found, err := f.Store.GetLive(Cluster)
+	if err != nil || !found {
+		t.Fatalf("Expected live rollout, got found=%v, err=%v", found, err)
+	}
+	if len(live.Addons) != 1 {
+		t.Fatalf("Expected a single addon run, got: %+v", live.Addons)
+	}
+	want := []store.ObjRef{{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "app"}}
+	if d := cmp.Diff(want, live.Addons[0].ObjRefs); d != "" {
+		t.Errorf("Unexpected objects applied (-want +got):\n%s", d)
+	}
+
+	if err := f.Run(ctx, runtime.RemoveCommand, Ctx(map[string]string{"env": "dev"})); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+}
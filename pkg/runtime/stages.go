@@ -0,0 +1,105 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/golang/glog"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/cloud"
+)
+
+// stageCtxKey is the cluster attribute that assigns it to a rollout stage.
+const stageCtxKey = "stage"
+
+// stages configures staged rollout (see WithStages).
+type stages struct {
+	names             []string
+	continueOnFailure bool
+	bakeTime          time.Duration
+}
+
+// stageOf returns the stage of cluster (empty if not set).
+func stageOf(cluster cloud.KubernetesVendor) string {
+	if s, ok := cluster.AddonSkyCtx().Attrs[stageCtxKey].(starlark.String); ok {
+		return string(s)
+	}
+	return ""
+}
+
+// forEachStage calls fn on clusters stage by stage in order of r.stages.
+// Clusters of stages not listed are skipped. Stops before the next stage once
+// a stage has failures (unless continuing on failure) and waits for bake time
+// in between stages (unless in dry run mode).
+func (r *runtime) forEachStage(ctx context.Context, clusters []cloud.KubernetesVendor, fn func(k8sVendor cloud.KubernetesVendor) error) (*ClusterResults, error) {
+	byStage := map[string][]cloud.KubernetesVendor{}
+	for _, c := range clusters {
+		byStage[stageOf(c)] = append(byStage[stageOf(c)], c)
+	}
+	listed := map[string]bool{}
+	for _, s := range r.stages.names {
+		listed[s] = true
+	}
+	for s, cs := range byStage {
+		if !listed[s] {
+			for _, c := range cs {
+				log.Infof("Skipping %v: stage `%s' is not in %v", c, s, r.stages.names)
+			}
+		}
+	}
+
+	res := &ClusterResults{}
+	for i, s := range r.stages.names {
+		cs := byStage[s]
+		if res.Halted {
+			res.Skipped += len(cs)
+			continue
+		}
+		if len(cs) == 0 {
+			log.Warningf("No clusters in stage `%s'", s)
+			continue
+		}
+
+		fmt.Printf("Rolling out stage `%s' (%d clusters)...\n", s, len(cs))
+		failedBefore := res.Failed
+		for _, c := range cs {
+			res.Add(c, fn(c))
+		}
+		failed := res.Failed - failedBefore
+
+		switch {
+		case failed > 0 && !r.stages.continueOnFailure:
+			fmt.Printf("Stage `%s' failed on %d out of %d clusters, halting rollout.\n", s, failed, len(cs))
+			res.Halted = true
+		case failed > 0:
+			fmt.Printf("Stage `%s' failed on %d out of %d clusters, continuing.\n", s, failed, len(cs))
+		}
+		if res.Halted || i == len(r.stages.names)-1 || r.stages.bakeTime <= 0 || r.DryRun {
+			continue
+		}
+
+		fmt.Printf("Baking stage `%s' for %v...\n", s, r.stages.bakeTime)
+		select {
+		case <-time.After(r.stages.bakeTime):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("interrupted while baking stage `%s': %v", s, ctx.Err())
+		}
+	}
+	return res, nil
+}
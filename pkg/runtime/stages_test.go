@@ -0,0 +1,169 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/cloud"
+	"github.com/cruise-automation/isopod/pkg/util"
+)
+
+const stagesMain = `
+def clusters(ctx):
+    return [
+        onprem(cluster="canary-1", stage="canary"),
+        onprem(cluster="prod-1", stage="prod"),
+        onprem(cluster="canary-2", stage="canary"),
+        onprem(cluster="prod-2", stage="prod"),
+        onprem(cluster="sandbox"),
+    ]
+`
+
+func TestForEachClusterStages(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "isopod-stages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mainFile := filepath.Join(dir, "main.ipd")
+	if err := ioutil.WriteFile(mainFile, []byte(stagesMain), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name              string
+		stages            []string
+		continueOnFailure bool
+		bakeTime          time.Duration
+		dryRun            bool
+		failClusters      map[string]bool
+		wantClusters      []string
+		want              ClusterResults
+		wantBake          bool
+	}{
+		{
+			name:         "Stages in order",
+			stages:       []string{"canary", "prod"},
+			wantClusters: []string{"canary-1", "canary-2", "prod-1", "prod-2"},
+			want:         ClusterResults{Total: 4},
+		},
+		{
+			name:         "Unlisted stages skipped",
+			stages:       []string{"prod"},
+			wantClusters: []string{"prod-1", "prod-2"},
+			want:         ClusterResults{Total: 2},
+		},
+		{
+			name:         "Failed stage halts rollout",
+			stages:       []string{"canary", "prod"},
+			failClusters: map[string]bool{"canary-2": true},
+			wantClusters: []string{"canary-1", "canary-2"},
+			want:         ClusterResults{Total: 2, Failed: 1, Halted: true, Skipped: 2},
+		},
+		{
+			name:              "Continue on stage failure",
+			stages:            []string{"canary", "prod"},
+			continueOnFailure: true,
+			failClusters:      map[string]bool{"canary-2": true},
+			wantClusters:      []string{"canary-1", "canary-2", "prod-1", "prod-2"},
+			want:              ClusterResults{Total: 4, Failed: 1},
+		},
+		{
+			name:         "Bake in between stages",
+			stages:       []string{"canary", "prod"},
+			bakeTime:     50 * time.Millisecond,
+			wantClusters: []string{"canary-1", "canary-2", "prod-1", "prod-2"},
+			want:         ClusterResults{Total: 4},
+			wantBake:     true,
+		},
+		{
+			name:         "No bake in dry run",
+			stages:       []string{"canary", "prod"},
+			bakeTime:     time.Hour,
+			dryRun:       true,
+			wantClusters: []string{"canary-1", "canary-2", "prod-1", "prod-2"},
+			want:         ClusterResults{Total: 4},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runtime, err := New(&Config{
+				EntryFile: mainFile,
+				UserAgent: util.UserAgent{Product: "Isopod"},
+				Store:     storeStub{},
+				DryRun:    tc.dryRun,
+			}, WithStages(tc.stages, tc.continueOnFailure, tc.bakeTime))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := runtime.Load(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			var gotClusters []string
+			var canaryDone, prodStart time.Time
+			res, err := runtime.ForEachCluster(ctx, map[string]string{}, func(k8sVendor cloud.KubernetesVendor) error {
+				c := string(k8sVendor.AddonSkyCtx().Attrs["cluster"].(starlark.String))
+				gotClusters = append(gotClusters, c)
+				switch c {
+				case "canary-2":
+					canaryDone = time.Now()
+				case "prod-1":
+					prodStart = time.Now()
+				}
+				if tc.failClusters[c] {
+					return errors.New("failed")
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if d := cmp.Diff(tc.wantClusters, gotClusters); d != "" {
+				t.Errorf("Unexpected clusters (-want, +got):\n%s", d)
+			}
+			if len(res.Errors) != res.Failed {
+				t.Errorf("Got %d cluster errors, want %d", len(res.Errors), res.Failed)
+			}
+			res.Errors = nil
+			if d := cmp.Diff(tc.want, *res); d != "" {
+				t.Errorf("Unexpected results (-want, +got):\n%s", d)
+			}
+			if baked := prodStart.Sub(canaryDone) >= tc.bakeTime; tc.wantBake && !baked {
+				t.Errorf("Expected prod stage to start at least %v after canary, got %v", tc.bakeTime, prodStart.Sub(canaryDone))
+			}
+		})
+	}
+}
+
+func TestWithStagesInvalid(t *testing.T) {
+	for _, names := range [][]string{nil, {"canary", ""}, {"canary", "prod", "canary"}} {
+		if _, err := New(&Config{}, WithStages(names, false, 0)); err == nil {
+			t.Errorf("Expected error for stages %q", names)
+		}
+	}
+}
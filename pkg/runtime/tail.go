@@ -0,0 +1,137 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// tailInterval is how often status and events of applied objects are polled
+// with WithWatchResources.
+const tailInterval = 2 * time.Second
+
+// watchApplied tails status changes and events of objRefs (by addon name)
+// applied by addons until all of them are healthy, ctx is done or the user
+// interrupts (which only stops watching).
+func (r *runtime) watchApplied(ctx context.Context, addons []*addon.Addon, objRefs map[string][]store.ObjRef) {
+	sr, ok := r.pkgs["kube"].(kube.StatusReader)
+	if !ok {
+		return
+	}
+	er, _ := r.pkgs["kube"].(kube.EventReader)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	defer signal.Stop(sigCh)
+	go func() {
+		select {
+		case <-sigCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var names []string
+	for _, a := range addons {
+		names = append(names, a.Name)
+	}
+	t := &tail{
+		status:        sr,
+		events:        er,
+		printf:        r.printf,
+		statusTimeout: r.statusTimeout,
+		interval:      tailInterval,
+	}
+	r.printf("Watching applied objects until healthy (interrupt to stop)...\n")
+	if t.run(ctx, names, objRefs, time.Now()) {
+		r.printf("All applied objects are healthy\n")
+	} else {
+		r.printf("Stopped watching applied objects\n")
+	}
+}
+
+// tail polls status and events of applied objects every interval.
+type tail struct {
+	status kube.StatusReader
+	// events is optional.
+	events kube.EventReader
+	printf func(format string, args ...interface{})
+	// statusTimeout bounds each poll of status (if positive).
+	statusTimeout time.Duration
+	interval      time.Duration
+}
+
+// run prints status of objRefs of addons whenever it changes and events
+// since then, until all of them are healthy (returns true) or ctx is done.
+func (t *tail) run(ctx context.Context, addons []string, objRefs map[string][]store.ObjRef, since time.Time) bool {
+	last := map[store.ObjRef]string{}
+	seen := map[kube.ObjEvent]bool{}
+	for {
+		healthy := true
+		for _, name := range addons {
+			sCtx, cancel := ctx, context.CancelFunc(func() {})
+			if t.statusTimeout > 0 {
+				sCtx, cancel = context.WithTimeout(ctx, t.statusTimeout)
+			}
+			statuses := t.status.ReadStatus(sCtx, objRefs[name])
+			cancel()
+			if ctx.Err() != nil {
+				return false
+			}
+			for _, s := range statuses {
+				healthy = healthy && s.Healthy
+				if last[s.Ref] != s.Status {
+					last[s.Ref] = s.Status
+					t.printf("%s: %v\n", name, s)
+				}
+			}
+
+			if t.events == nil {
+				continue
+			}
+			events, err := t.events.ReadEvents(ctx, objRefs[name], since)
+			if err != nil {
+				log.Warningf("Failed to read events of `%s' addon: %v", name, err)
+				continue
+			}
+			for _, e := range events {
+				if !seen[e] {
+					seen[e] = true
+					t.printf("%s: %v\n", name, e)
+				}
+			}
+		}
+		if healthy {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(t.interval):
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/cruise-automation/isopod/pkg/kube"
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// fakeTailed returns statuses[i] and events[i] on the i-th poll (the last
+// ones once exhausted).
+type fakeTailed struct {
+	polls    int
+	statuses [][]kube.ObjStatus
+	events   [][]kube.ObjEvent
+}
+
+func (f *fakeTailed) ReadStatus(ctx context.Context, refs []store.ObjRef) []kube.ObjStatus {
+	i := f.polls
+	if i >= len(f.statuses) {
+		i = len(f.statuses) - 1
+	}
+	return f.statuses[i]
+}
+
+func (f *fakeTailed) ReadEvents(ctx context.Context, refs []store.ObjRef, since time.Time) ([]kube.ObjEvent, error) {
+	i := f.polls
+	f.polls++
+	if i >= len(f.events) {
+		i = len(f.events) - 1
+	}
+	return f.events[i], nil
+}
+
+func TestTail(t *testing.T) {
+	deploy := store.ObjRef{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: "web"}
+	backOff := kube.ObjEvent{Kind: "Pod", Namespace: "default", Name: "web-1", Type: "Warning", Reason: "BackOff", Message: "restarting"}
+	scaled := kube.ObjEvent{Kind: "Deployment", Namespace: "default", Name: "web", Type: "Normal", Reason: "ScalingReplicaSet", Message: "scaled up"}
+
+	for _, tc := range []struct {
+		name        string
+		fake        *fakeTailed
+		cancelAfter time.Duration
+		wantHealthy bool
+		wantOut     []string
+	}{
+		{
+			name: "Until healthy",
+			fake: &fakeTailed{
+				statuses: [][]kube.ObjStatus{
+					{{Ref: deploy, Status: "0/2 ready"}},
+					{{Ref: deploy, Status: "0/2 ready"}},
+					{{Ref: deploy, Status: "2/2 ready", Healthy: true}},
+				},
+				events: [][]kube.ObjEvent{
+					{scaled},
+					{scaled, backOff},
+					{scaled, backOff},
+				},
+			},
+			wantHealthy: true,
+			wantOut: []string{
+				"web: deployment.apps `default/web': 0/2 ready\n",
+				"web: deployment `default/web' Normal ScalingReplicaSet: scaled up\n",
+				"web: pod `default/web-1' Warning BackOff: restarting\n",
+				"web: deployment.apps `default/web': 2/2 ready\n",
+			},
+		},
+		{
+			name: "Interrupted",
+			fake: &fakeTailed{
+				statuses: [][]kube.ObjStatus{{{Ref: deploy, Status: "0/2 ready"}}},
+				events:   [][]kube.ObjEvent{nil},
+			},
+			cancelAfter: 20 * time.Millisecond,
+			wantOut: []string{
+				"web: deployment.apps `default/web': 0/2 ready\n",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out []string
+			tl := &tail{
+				status:   tc.fake,
+				events:   tc.fake,
+				printf:   func(format string, args ...interface{}) { out = append(out, fmt.Sprintf(format, args...)) },
+				interval: time.Millisecond,
+			}
+			ctx := context.Background()
+			if tc.cancelAfter > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.cancelAfter)
+				defer cancel()
+			}
+			healthy := tl.run(ctx, []string{"web"}, map[string][]store.ObjRef{"web": {deploy}}, time.Time{})
+			if healthy != tc.wantHealthy {
+				t.Errorf("Want healthy: %v, got: %v", tc.wantHealthy, healthy)
+			}
+			if d := cmp.Diff(tc.wantOut, out); d != "" {
+				t.Errorf("Unexpected output (-want +got):\n%s", d)
+			}
+		})
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -31,8 +32,12 @@ import (
 
 	isopod "github.com/cruise-automation/isopod/pkg"
 	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/cloud/eks"
 	"github.com/cruise-automation/isopod/pkg/cloud/gke"
 	"github.com/cruise-automation/isopod/pkg/cloud/onprem"
+	"github.com/cruise-automation/isopod/pkg/cloud/vcluster"
+	"github.com/cruise-automation/isopod/pkg/flags"
+	"github.com/cruise-automation/isopod/pkg/image"
 	"github.com/cruise-automation/isopod/pkg/kube"
 	"github.com/cruise-automation/isopod/pkg/loader"
 	"github.com/cruise-automation/isopod/pkg/util"
@@ -144,8 +149,9 @@ type result struct {
 	Runtime    time.Duration
 }
 
-// exec executes all test cases within a file referenced by path.
-func exec(ctx context.Context, path string) (*result, error) {
+// exec executes all test cases within a file referenced by path after
+// loading preludes.
+func exec(ctx context.Context, path string, preludes []string, loaderOpts []loader.Option) (*result, error) {
 	v, vClose, err := vault.NewFake()
 	if err != nil {
 		return nil, err
@@ -159,13 +165,18 @@ func exec(ctx context.Context, path string) (*result, error) {
 	defer kClose()
 
 	pkgs := starlark.StringDict{
-		"assert": makeAssertFn(),
-		"vault":  v,
-		"kube":   k,
-		"gke":    gke.NewGKEBuiltin("sa-kay-not-used-since-mocked", "Isopod"),
-		"onprem": onprem.NewOnPremBuiltin("fake-kubeconfig"),
-		"error":  starlark.NewBuiltin("error", addon.ErrorFn),
-		"sleep":  starlark.NewBuiltin("sleep", addon.SleepFn),
+		"assert":      makeAssertFn(),
+		"vault":       v,
+		"kube":        k,
+		"image":       image.New(http.DefaultClient, true /* noNetwork */),
+		"gke":         gke.NewGKEBuiltin("sa-kay-not-used-since-mocked", nil, "Isopod"),
+		"gke_cluster": gke.NewGKEClusterBuiltin("sa-kay-not-used-since-mocked", nil, "Isopod"),
+		"eks_cluster": eks.NewEKSClusterBuiltin("fake-kubeconfig"),
+		"onprem":      onprem.NewOnPremBuiltin("fake-kubeconfig"),
+		"vcluster":    vcluster.NewVClusterBuiltin(),
+		"flags":       flags.New(nil),
+		"error":       starlark.NewBuiltin("error", addon.ErrorFn),
+		"sleep":       starlark.NewBuiltin("sleep", addon.SleepFn),
 	}
 
 	scPkgs := skycfg.UnstablePredeclaredModules(&protoRegistry{})
@@ -181,10 +192,13 @@ func exec(ctx context.Context, path string) (*result, error) {
 	startT := time.Now()
 
 	out := new(bytes.Buffer)
-	outFn := func(_ *starlark.Thread, msg string) { fmt.Fprintf(out, msg) }
+	outFn := func(_ *starlark.Thread, msg string) { fmt.Fprint(out, msg) }
 	thread := &starlark.Thread{
 		Print: outFn,
-		Load:  loader.NewModulesLoaderWithPredeclaredPkgs(filepath.Dir(path), pkgs).Load,
+		Load:  loader.NewModulesLoaderWithPredeclaredPkgs(filepath.Dir(path), pkgs, loaderOpts...).Load,
+	}
+	if err := loadPreludes(thread, preludes, pkgs); err != nil {
+		return nil, err
 	}
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -246,8 +260,9 @@ func exec(ctx context.Context, path string) (*result, error) {
 }
 
 // RunUnitTests executes (if found) tests reference by path. Writes test
-// output to w.
-func RunUnitTests(ctx context.Context, path string, outW, errW io.Writer) (bool, error) {
+// output to w. preludes are loaded before each test file as in
+// Config.Preludes. loaderOpts configure loading of modules (e.g by URL).
+func RunUnitTests(ctx context.Context, path string, preludes []string, outW, errW io.Writer, loaderOpts ...loader.Option) (bool, error) {
 	ts, err := search(path)
 	if err != nil {
 		return false, err
@@ -257,9 +272,14 @@ func RunUnitTests(ctx context.Context, path string, outW, errW io.Writer) (bool,
 		return true, nil
 	}
 
+	return runTests(ctx, ts, preludes, outW, errW, loaderOpts), nil
+}
+
+// runTests executes test files ts and reports their status to outW.
+func runTests(ctx context.Context, ts, preludes []string, outW, errW io.Writer, loaderOpts []loader.Option) bool {
 	var rs []*result
 	for _, t := range ts {
-		res, err := exec(ctx, t)
+		res, err := exec(ctx, t, preludes, loaderOpts)
 		if err != nil {
 			fmt.Fprintf(errW, "%v\n", err)
 			rs = append(rs, &result{
@@ -284,5 +304,5 @@ func RunUnitTests(ctx context.Context, path string, outW, errW io.Writer) (bool,
 		}
 	}
 
-	return status, nil
+	return status
 }
@@ -0,0 +1,186 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cruise-automation/isopod/pkg/loader"
+)
+
+// clearScreen is the ANSI sequence moving the cursor home and clearing the
+// terminal.
+const clearScreen = "\033[H\033[2J"
+
+// snapshot maps Starlark file paths to their last modification time.
+type snapshot map[string]time.Time
+
+// watchRoot returns the directory to watch for test path. Watching is always
+// recursive since tests commonly load addon files from sub-directories.
+func watchRoot(path string) (string, error) {
+	if path == "" {
+		path = "./..."
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(path, "/...") {
+		return filepath.Dir(path), nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return path, nil
+	}
+	return filepath.Dir(path), nil
+}
+
+// takeSnapshot records modification times of all .ipd files under root.
+func takeSnapshot(root string) (snapshot, error) {
+	s := snapshot{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".ipd") {
+			s[path] = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// changed returns sorted list of files that were added, modified or removed
+// in s compared to prev.
+func (s snapshot) changed(prev snapshot) []string {
+	var out []string
+	for path, t := range s {
+		if pt, ok := prev[path]; !ok || !pt.Equal(t) {
+			out = append(out, path)
+		}
+	}
+	for path := range prev {
+		if _, ok := s[path]; !ok {
+			out = append(out, path)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// affectedTests returns tests (subset of ts) that need to re-run after files
+// changed. Only modified tests are re-run when nothing but test files
+// changed, otherwise all of ts are re-run since any test may load the
+// modified file.
+func affectedTests(ts, changed []string) []string {
+	inTs := map[string]bool{}
+	for _, t := range ts {
+		inTs[t] = true
+	}
+	var out []string
+	for _, c := range changed {
+		if !isTest(c) {
+			return ts
+		}
+		if inTs[c] {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// WatchUnitTests runs tests referenced by path and then polls the Starlark
+// files around them every interval, re-running affected tests on change.
+// Changes are debounced until files stop changing for a full interval.
+// Blocks until ctx is cancelled. preludes and loaderOpts are passed as in
+// RunUnitTests.
+func WatchUnitTests(ctx context.Context, path string, preludes []string, interval time.Duration, outW, errW io.Writer, loaderOpts ...loader.Option) error {
+	root, err := watchRoot(path)
+	if err != nil {
+		return err
+	}
+	prev, err := takeSnapshot(root)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprint(outW, clearScreen)
+	if _, err := RunUnitTests(ctx, path, preludes, outW, errW, loaderOpts...); err != nil {
+		fmt.Fprintf(errW, "%v\n", err)
+	}
+
+	pending := map[string]bool{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		cur, err := takeSnapshot(root)
+		if err != nil {
+			fmt.Fprintf(errW, "%v\n", err)
+			continue
+		}
+		if c := cur.changed(prev); len(c) > 0 {
+			// Still changing, wait for next tick before running.
+			for _, f := range c {
+				pending[f] = true
+			}
+			prev = cur
+			continue
+		}
+		if len(pending) == 0 {
+			continue
+		}
+
+		ts, err := search(path)
+		if err != nil {
+			fmt.Fprintf(errW, "%v\n", err)
+			pending = map[string]bool{}
+			continue
+		}
+
+		var changed []string
+		for f := range pending {
+			changed = append(changed, f)
+		}
+		sort.Strings(changed)
+
+		fmt.Fprint(outW, clearScreen)
+		fmt.Fprintf(outW, "Changed: %s\n", strings.Join(changed, ", "))
+		if rerun := affectedTests(ts, changed); len(rerun) > 0 {
+			runTests(ctx, rerun, preludes, outW, errW, loaderOpts)
+		} else {
+			fmt.Fprintf(outW, "No tests affected.\n")
+		}
+		pending = map[string]bool{}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSnapshotChanged(t *testing.T) {
+	t0 := time.Unix(0, 0)
+	t1 := time.Unix(1, 0)
+
+	for _, tc := range []struct {
+		name      string
+		prev, cur snapshot
+		want      []string
+	}{
+		{
+			name: "no change",
+			prev: snapshot{"a.ipd": t0},
+			cur:  snapshot{"a.ipd": t0},
+		},
+		{
+			name: "modified, added and removed",
+			prev: snapshot{"a.ipd": t0, "b.ipd": t0},
+			cur:  snapshot{"a.ipd": t1, "c.ipd": t0},
+			want: []string{"a.ipd", "b.ipd", "c.ipd"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if d := cmp.Diff(tc.want, tc.cur.changed(tc.prev)); d != "" {
+				t.Errorf("Unexpected changed files (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestAffectedTests(t *testing.T) {
+	ts := []string{"a_test.ipd", "b_test.ipd"}
+
+	for _, tc := range []struct {
+		name    string
+		changed []string
+		want    []string
+	}{
+		{
+			name:    "only test changed",
+			changed: []string{"b_test.ipd"},
+			want:    []string{"b_test.ipd"},
+		},
+		{
+			name:    "addon file changed",
+			changed: []string{"b_test.ipd", "addon.ipd"},
+			want:    ts,
+		},
+		{
+			name:    "unknown test removed",
+			changed: []string{"c_test.ipd"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if d := cmp.Diff(tc.want, affectedTests(ts, tc.changed)); d != "" {
+				t.Errorf("Unexpected affected tests (-want +got):\n%s", d)
+			}
+		})
+	}
+}
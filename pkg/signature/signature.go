@@ -0,0 +1,135 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package signature verifies cosign signatures over the tree of Starlark
+// files and manifests that Isopod applies.
+package signature
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TreeDigest returns the listing of SHA-256 digests of all regular files
+// under dir (skipping hidden files and directories) in the format of
+//
+//	find . -type f ! -path '*/.*' | LC_ALL=C sort | xargs sha256sum
+//
+// run in dir, so that it can be signed with `cosign sign-blob' as is.
+func TreeDigest(dir string) ([]byte, error) {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, "./"+filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files of `%s': %v", dir, err)
+	}
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	for _, p := range paths {
+		b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(p)))
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		fmt.Fprintf(&buf, "%s  %s\n", hex.EncodeToString(sum[:]), p)
+	}
+	return buf.Bytes(), nil
+}
+
+// LoadPublicKey returns the ECDSA public key (e.g `cosign.pub' generated by
+// `cosign generate-key-pair') PEM-encoded in the file at path.
+func LoadPublicKey(path string) (*ecdsa.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("`%s' is not a PEM-encoded public key", path)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key `%s': %v", path, err)
+	}
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key `%s' is a %T, only ECDSA keys are supported", path, pub)
+	}
+	return ecPub, nil
+}
+
+// Verify checks that sig (base64-encoded, as written by `cosign sign-blob')
+// is a valid signature of blob by pub.
+func Verify(pub *ecdsa.PublicKey, blob, sig []byte) error {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return fmt.Errorf("signature is not base64-encoded: %v", err)
+	}
+	digest := sha256.Sum256(blob)
+	if !ecdsa.VerifyASN1(pub, digest[:], raw) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// VerifyTree verifies the signature in sigFile of the TreeDigest of dir
+// against the public key in keyFile.
+func VerifyTree(dir, sigFile, keyFile string) error {
+	pub, err := LoadPublicKey(keyFile)
+	if err != nil {
+		return err
+	}
+	sig, err := ioutil.ReadFile(sigFile)
+	if err != nil {
+		return err
+	}
+	digest, err := TreeDigest(dir)
+	if err != nil {
+		return err
+	}
+	if err := Verify(pub, digest, sig); err != nil {
+		return fmt.Errorf("signature `%s' of `%s' doesn't match key `%s': %v", sigFile, dir, keyFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTreeDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"main.ipd":           "a\n",
+		"addons/ingress.ipd": "b\n",
+		".git/HEAD":          "ignored",
+		"addons/.swp":        "ignored",
+	})
+
+	got, err := TreeDigest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Output of sha256sum.
+	want := "0263829989b6fd954f72baaf2fc64bc2e2f01d692d4de72986ea808f6e99813f  ./addons/ingress.ipd\n" +
+		"87428fc522803d31065e7bce3cf03fe475096631e5e07bbd7a0fde60c4cf25c7  ./main.ipd\n"
+	if string(got) != want {
+		t.Errorf("TreeDigest() =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestVerifyTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tree := filepath.Join(dir, "tree")
+	writeFiles(t, tree, map[string]string{"main.ipd": "a\n"})
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "cosign.pub")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := TreeDigest(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(digest)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigFile := filepath.Join(dir, "tree.sig")
+	if err := ioutil.WriteFile(sigFile, []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyTree(tree, sigFile, keyFile); err != nil {
+		t.Errorf("VerifyTree() of signed tree failed: %v", err)
+	}
+
+	writeFiles(t, tree, map[string]string{"addons/unreviewed.ipd": "c\n"})
+	if err := VerifyTree(tree, sigFile, keyFile); err == nil {
+		t.Error("Expected VerifyTree() of changed tree to fail")
+	}
+
+	if err := VerifyTree(tree, sigFile, sigFile); err == nil {
+		t.Error("Expected VerifyTree() with invalid key to fail")
+	}
+}
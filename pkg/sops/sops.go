@@ -0,0 +1,183 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sops implements the "sops" built-in package to decrypt files
+// encrypted with sops (https://github.com/mozilla/sops), e.g Secrets
+// committed to git, at apply time.
+package sops
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"sigs.k8s.io/yaml"
+
+	isopod "github.com/cruise-automation/isopod/pkg"
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/redact"
+)
+
+// Decrypter decrypts the sops file at path. Only the value at extract (a
+// sops --extract path, e.g `["data"]["password"]') is returned if set.
+type Decrypter func(ctx context.Context, path, extract string) ([]byte, error)
+
+// sopsPackage implements the sops package.
+type sopsPackage struct {
+	*isopod.Module
+	baseDir string
+	decrypt Decrypter
+}
+
+// Option is an option of the sops package.
+type Option func(*sopsPackage)
+
+// WithDecrypter returns an Option that decrypts files with d instead of the
+// sops binary.
+func WithDecrypter(d Decrypter) Option {
+	return func(p *sopsPackage) {
+		p.decrypt = d
+	}
+}
+
+// New returns a new starlark.HasAttrs object for the sops package. Relative
+// paths are resolved under baseDir and files are decrypted by running
+// binary (`sops' if empty), which uses the keys configured for sops (KMS,
+// age, PGP, etc). ageKeyFile (if set) is passed to it as the age key file.
+func New(baseDir, binary, ageKeyFile string, opts ...Option) starlark.HasAttrs {
+	p := &sopsPackage{
+		baseDir: baseDir,
+		decrypt: execDecrypter(binary, ageKeyFile),
+	}
+	for _, o := range opts {
+		o(p)
+	}
+	p.Module = &isopod.Module{
+		Name: "sops",
+		Attrs: starlark.StringDict{
+			"decrypt": starlark.NewBuiltin("sops.decrypt", p.sopsDecryptFn),
+		},
+	}
+	return p
+}
+
+// sopsDecryptFn is a starlark built-in function that decrypts a sops file and
+// returns its plaintext, which is redacted in output (see redact.String).
+// Usage:
+//
+//	password = sops.decrypt("secrets/db.enc.yaml", extract='["password"]')
+//	config = sops.decrypt("secrets/config.enc.json")
+func (p *sopsPackage) sopsDecryptFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var path, extract string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "path", &path, "extract?", &extract); err != nil {
+		return nil, fmt.Errorf("<%v>: failed to parse args: %v", b.Name(), err)
+	}
+	resolved, err := p.resolve(path)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	out, err := p.decrypt(ctx, resolved, extract)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: failed to decrypt `%s': %v", b.Name(), path, err)
+	}
+	if err := checkDecrypted(out); err != nil {
+		return nil, fmt.Errorf("<%v>: failed to decrypt `%s': %v", b.Name(), path, err)
+	}
+
+	registerSecrets(out)
+	return starlark.String(out), nil
+}
+
+// resolve returns path resolved under p.baseDir. Fails if path is absolute
+// or escapes p.baseDir.
+func (p *sopsPackage) resolve(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return "", fmt.Errorf("path `%s' must be relative to `%s'", path, p.baseDir)
+	}
+	rel := filepath.Clean(path)
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path `%s' is outside of `%s'", path, p.baseDir)
+	}
+	return filepath.Join(p.baseDir, rel), nil
+}
+
+// checkDecrypted fails if out still has values encrypted by sops (e.g a
+// decrypter that passed the file through as is) so that ciphertext is never
+// applied.
+func checkDecrypted(out []byte) error {
+	if bytes.Contains(out, []byte("ENC[")) {
+		return fmt.Errorf("output still has encrypted values")
+	}
+	return nil
+}
+
+// registerSecrets registers out and, if it is a YAML or JSON document, all
+// of its string values for redaction.
+func registerSecrets(out []byte) {
+	redact.Register(strings.TrimSpace(string(out)))
+	var doc interface{}
+	if err := yaml.Unmarshal(out, &doc); err != nil {
+		return
+	}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		case string:
+			redact.Register(v)
+		case float64:
+			redact.Register(strconv.FormatFloat(v, 'f', -1, 64))
+		}
+	}
+	walk(doc)
+}
+
+// execDecrypter returns a Decrypter that runs binary.
+func execDecrypter(binary, ageKeyFile string) Decrypter {
+	if binary == "" {
+		binary = "sops"
+	}
+	return func(ctx context.Context, path, extract string) ([]byte, error) {
+		args := []string{"--decrypt"}
+		if extract != "" {
+			args = append(args, "--extract", extract)
+		}
+		cmd := exec.CommandContext(ctx, binary, append(args, path)...)
+		if ageKeyFile != "" {
+			cmd.Env = append(os.Environ(), "SOPS_AGE_KEY_FILE="+ageKeyFile)
+		}
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v: %s", binary, err, strings.TrimSpace(stderr.String()))
+		}
+		return out, nil
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sops
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+	"github.com/cruise-automation/isopod/pkg/redact"
+)
+
+func TestDecrypt(t *testing.T) {
+	files := map[string]string{
+		"/repo/secrets/db.enc.yaml": "user: admin\npassword: hunter2-db\n",
+		"/repo/token.enc":           "s3cr3t-token\n",
+		"/repo/passthrough.enc":     "password: ENC[AES256_GCM,data:abc]\n",
+	}
+	var gotExtract string
+	decrypt := func(_ context.Context, path, extract string) ([]byte, error) {
+		gotExtract = extract
+		out, ok := files[path]
+		if !ok {
+			return nil, errors.New("no such file")
+		}
+		return []byte(out), nil
+	}
+
+	for _, tc := range []struct {
+		name        string
+		expr        string
+		want        string
+		wantExtract string
+		wantErr     string
+		wantRedact  []string
+	}{
+		{
+			name:       "Decrypt YAML",
+			expr:       `sops.decrypt("secrets/db.enc.yaml")`,
+			want:       "user: admin\npassword: hunter2-db\n",
+			wantRedact: []string{"hunter2-db"},
+		},
+		{
+			name:        "Extract",
+			expr:        `sops.decrypt("token.enc", extract='["token"]')`,
+			want:        "s3cr3t-token\n",
+			wantExtract: `["token"]`,
+			wantRedact:  []string{"s3cr3t-token"},
+		},
+		{
+			name:    "Missing file",
+			expr:    `sops.decrypt("missing.enc")`,
+			wantErr: "<sops.decrypt>: failed to decrypt `missing.enc': no such file",
+		},
+		{
+			name:    "Still encrypted",
+			expr:    `sops.decrypt("passthrough.enc")`,
+			wantErr: "<sops.decrypt>: failed to decrypt `passthrough.enc': output still has encrypted values",
+		},
+		{
+			name:    "Outside of base dir",
+			expr:    `sops.decrypt("../etc/secrets.enc")`,
+			wantErr: "<sops.decrypt>: path `../etc/secrets.enc' is outside of `/repo'",
+		},
+		{
+			name:    "Absolute path",
+			expr:    `sops.decrypt("/etc/secrets.enc")`,
+			wantErr: "<sops.decrypt>: path `/etc/secrets.enc' must be relative to `/repo'",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gotExtract = ""
+			pkg := New(filepath.FromSlash("/repo"), "", "", WithDecrypter(decrypt))
+			thread := &starlark.Thread{}
+			thread.SetLocal(addon.GoCtxKey, context.Background())
+			v, err := starlark.Eval(thread, t.Name(), tc.expr, starlark.StringDict{"sops": pkg})
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("Expected error `%s', got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := string(v.(starlark.String)); got != tc.want {
+				t.Errorf("Expected:\n%s\ngot:\n%s", tc.want, got)
+			}
+			if gotExtract != tc.wantExtract {
+				t.Errorf("Expected extract `%s', got `%s'", tc.wantExtract, gotExtract)
+			}
+			for _, s := range tc.wantRedact {
+				if got := redact.String("value: " + s); got != "value: "+redact.Placeholder {
+					t.Errorf("Expected `%s' to be redacted, got: %s", s, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRedactionKeepsShortValues(t *testing.T) {
+	registerSecrets([]byte("enabled: true\nreplicas: 3\nkey: long-enough-value\n"))
+	got := redact.String("enabled: true, replicas: 3, key: long-enough-value")
+	if want := "enabled: true, replicas: 3, key: " + redact.Placeholder; !strings.Contains(got, want) {
+		t.Errorf("Expected `%s', got `%s'", want, got)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Defined describes clusters and addons currently defined by the entry file,
+// against which Stale classifies store entries.
+type Defined struct {
+	// Clusters are all currently defined clusters. If nil, entries are never
+	// classified as stale for belonging to an undefined cluster.
+	Clusters map[string]bool
+	// Addons maps clusters to names of addons currently defined for them.
+	// Rollouts of clusters missing from Addons are not checked against
+	// defined addons.
+	Addons map[string][]string
+}
+
+// StaleEntry is an entry classified as stale by Stale.
+type StaleEntry struct {
+	Entry
+	// Reason explains why the entry is stale.
+	Reason string
+}
+
+// Stale returns entries that are no longer needed given currently defined
+// clusters and addons:
+//   - entries of clusters that are no longer defined;
+//   - addon runs of rollouts that no longer exist;
+//   - rollouts (along with their addon runs) that aren't live and consist
+//     only of runs of addons that are no longer defined for their cluster.
+//
+// Entries whose cluster isn't known are never stale.
+func Stale(entries []Entry, d Defined) []StaleEntry {
+	var stale []StaleEntry
+	rollouts := map[RolloutID]bool{}
+	live := map[RolloutID]bool{}
+	runs := map[RolloutID][]Entry{}
+	for _, e := range entries {
+		switch e.Kind {
+		case RolloutEntry:
+			rollouts[RolloutID(e.ID)] = true
+		case LiveEntry:
+			live[e.Rollout] = true
+		case AddonRunEntry:
+			runs[e.Rollout] = append(runs[e.Rollout], e)
+		}
+	}
+
+	for _, e := range entries {
+		if !e.ClusterKnown {
+			continue
+		}
+		if d.Clusters != nil && !d.Clusters[e.Cluster] {
+			stale = append(stale, StaleEntry{
+				Entry:  e,
+				Reason: fmt.Sprintf("cluster `%s' is no longer defined", e.Cluster),
+			})
+			continue
+		}
+
+		switch e.Kind {
+		case AddonRunEntry:
+			if !rollouts[e.Rollout] {
+				stale = append(stale, StaleEntry{
+					Entry:  e,
+					Reason: fmt.Sprintf("rollout `%s' no longer exists", e.Rollout),
+				})
+			}
+		case RolloutEntry:
+			id := RolloutID(e.ID)
+			addons, ok := d.Addons[e.Cluster]
+			if !ok || live[id] || len(runs[id]) == 0 {
+				continue
+			}
+			undefined := undefinedAddons(runs[id], addons)
+			if len(undefined) < len(runs[id]) {
+				continue
+			}
+			reason := fmt.Sprintf("addons `%s' are no longer defined", strings.Join(undefined, ", "))
+			stale = append(stale, StaleEntry{Entry: e, Reason: reason})
+			for _, run := range runs[id] {
+				if run.ClusterKnown && run.Cluster == e.Cluster {
+					stale = append(stale, StaleEntry{Entry: run, Reason: reason})
+				}
+			}
+		}
+	}
+	return stale
+}
+
+// undefinedAddons returns sorted names of addons of runs missing from
+// addons.
+func undefinedAddons(runs []Entry, addons []string) []string {
+	defined := map[string]bool{}
+	for _, a := range addons {
+		defined[a] = true
+	}
+	var undefined []string
+	for _, r := range runs {
+		if !defined[r.Addon] {
+			undefined = append(undefined, r.Addon)
+		}
+	}
+	sort.Strings(undefined)
+	return undefined
+}
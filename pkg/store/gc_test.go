@@ -0,0 +1,91 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStale(t *testing.T) {
+	const a, b = "https://a", "https://b"
+	entries := []Entry{
+		{ID: "rollout-live-a", Kind: LiveEntry, Cluster: a, ClusterKnown: true, Rollout: "rollout-1"},
+		{ID: "rollout-1", Kind: RolloutEntry, Cluster: a, ClusterKnown: true},
+		{ID: "foo-run-1", Kind: AddonRunEntry, Cluster: a, ClusterKnown: true, Addon: "foo", Rollout: "rollout-1"},
+		{ID: "rollout-2", Kind: RolloutEntry, Cluster: a, ClusterKnown: true},
+		{ID: "bar-run-2", Kind: AddonRunEntry, Cluster: a, ClusterKnown: true, Addon: "bar", Rollout: "rollout-2"},
+		{ID: "rollout-3", Kind: RolloutEntry, Cluster: a, ClusterKnown: true},
+		{ID: "bar-run-3", Kind: AddonRunEntry, Cluster: a, ClusterKnown: true, Addon: "bar", Rollout: "rollout-3"},
+		{ID: "foo-run-3", Kind: AddonRunEntry, Cluster: a, ClusterKnown: true, Addon: "foo", Rollout: "rollout-3"},
+		{ID: "foo-run-4", Kind: AddonRunEntry, Cluster: a, ClusterKnown: true, Addon: "foo", Rollout: "rollout-4"},
+		{ID: "rollout-resume-a", Kind: ResumeEntry, Cluster: a, ClusterKnown: true},
+		{ID: "rollout-5", Kind: RolloutEntry, Cluster: b, ClusterKnown: true},
+		{ID: "rollout-live", Kind: LiveEntry, Rollout: "rollout-6"},
+		{ID: "rollout-6", Kind: RolloutEntry},
+		{ID: "bar-run-6", Kind: AddonRunEntry, Addon: "bar", Rollout: "rollout-6"},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		defined Defined
+		want    []string
+	}{
+		{
+			name: "Nothing defined",
+			want: []string{"foo-run-4: rollout `rollout-4' no longer exists"},
+		},
+		{
+			name:    "Addons defined",
+			defined: Defined{Addons: map[string][]string{a: {"foo"}}},
+			want: []string{
+				"rollout-2: addons `bar' are no longer defined",
+				"bar-run-2: addons `bar' are no longer defined",
+				"foo-run-4: rollout `rollout-4' no longer exists",
+			},
+		},
+		{
+			name:    "Clusters defined",
+			defined: Defined{Clusters: map[string]bool{a: true}},
+			want: []string{
+				"foo-run-4: rollout `rollout-4' no longer exists",
+				"rollout-5: cluster `https://b' is no longer defined",
+			},
+		},
+		{
+			name:    "Live rollout kept",
+			defined: Defined{Clusters: map[string]bool{a: true, b: true}, Addons: map[string][]string{a: {"baz"}}},
+			want: []string{
+				"rollout-2: addons `bar' are no longer defined",
+				"bar-run-2: addons `bar' are no longer defined",
+				"rollout-3: addons `bar, foo' are no longer defined",
+				"bar-run-3: addons `bar, foo' are no longer defined",
+				"foo-run-3: addons `bar, foo' are no longer defined",
+				"foo-run-4: rollout `rollout-4' no longer exists",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, e := range Stale(entries, tc.defined) {
+				got = append(got, e.ID+": "+e.Reason)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected stale entries (-want +got):\n%s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+
+	log "github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultServiceAccount is the name of the ServiceAccount Bootstrap grants
+// access to the store by default.
+const DefaultServiceAccount = "isopod"
+
+// storeRoleName is the name of the Role (and RoleBinding) granting access to
+// the store.
+const storeRoleName = "isopod-store"
+
+// storeRules are the permissions Store needs within its namespace: rollouts,
+// addon runs and resume states are ConfigMaps, diffs recorded for review are
+// ConfigMaps or Secrets (see PutDiff). No CRDs are needed.
+var storeRules = []rbacv1.PolicyRule{
+	{
+		APIGroups: []string{""},
+		Resources: []string{"configmaps"},
+		Verbs:     []string{"get", "list", "create", "update", "delete"},
+	},
+	{
+		APIGroups: []string{""},
+		Resources: []string{"secrets"},
+		Verbs:     []string{"get", "create", "update"},
+	},
+}
+
+// Bootstrap creates everything Store needs in namespace: the namespace
+// itself, serviceAccount ServiceAccount and a Role (bound to it) granting
+// access to the store. Objects that already exist are kept, except for the
+// Role and RoleBinding which are updated if they differ. Each step is
+// reported to w. Nothing is mutated if dryRun is set.
+func Bootstrap(w io.Writer, c kubernetes.Interface, namespace, serviceAccount string, dryRun bool) error {
+	labels := map[string]string{"app.kubernetes.io/managed-by": "isopod"}
+	meta := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels}
+	}
+	report := func(kind, name, what string) {
+		if dryRun {
+			what = "would be " + what
+		}
+		fmt.Fprintf(w, "%s `%s' %s\n", kind, name, what)
+		log.Infof("Store bootstrap: %s `%s' %s", kind, name, what)
+	}
+	nsName := namespace + "/"
+
+	// Namespace.
+	if _, err := c.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{}); err == nil {
+		report("namespace", namespace, "exists")
+	} else if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get namespace `%s': %v", namespace, err)
+	} else {
+		if !dryRun {
+			ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace, Labels: labels}}
+			if _, err := c.CoreV1().Namespaces().Create(ns); err != nil && !apierrors.IsAlreadyExists(err) {
+				return fmt.Errorf("failed to create namespace `%s': %v", namespace, err)
+			}
+		}
+		report("namespace", namespace, "created")
+	}
+
+	// ServiceAccount.
+	if _, err := c.CoreV1().ServiceAccounts(namespace).Get(serviceAccount, metav1.GetOptions{}); err == nil {
+		report("serviceaccount", nsName+serviceAccount, "exists")
+	} else if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get serviceaccount `%s%s': %v", nsName, serviceAccount, err)
+	} else {
+		if !dryRun {
+			if _, err := c.CoreV1().ServiceAccounts(namespace).Create(&corev1.ServiceAccount{ObjectMeta: meta(serviceAccount)}); err != nil && !apierrors.IsAlreadyExists(err) {
+				return fmt.Errorf("failed to create serviceaccount `%s%s': %v", nsName, serviceAccount, err)
+			}
+		}
+		report("serviceaccount", nsName+serviceAccount, "created")
+	}
+
+	// Role.
+	role := &rbacv1.Role{ObjectMeta: meta(storeRoleName), Rules: storeRules}
+	if live, err := c.RbacV1().Roles(namespace).Get(storeRoleName, metav1.GetOptions{}); err == nil {
+		if reflect.DeepEqual(live.Rules, role.Rules) {
+			report("role", nsName+storeRoleName, "unchanged")
+		} else {
+			if !dryRun {
+				live.Rules = role.Rules
+				if _, err := c.RbacV1().Roles(namespace).Update(live); err != nil {
+					return fmt.Errorf("failed to update role `%s%s': %v", nsName, storeRoleName, err)
+				}
+			}
+			report("role", nsName+storeRoleName, "updated")
+		}
+	} else if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get role `%s%s': %v", nsName, storeRoleName, err)
+	} else {
+		if !dryRun {
+			if _, err := c.RbacV1().Roles(namespace).Create(role); err != nil {
+				return fmt.Errorf("failed to create role `%s%s': %v", nsName, storeRoleName, err)
+			}
+		}
+		report("role", nsName+storeRoleName, "created")
+	}
+
+	// RoleBinding. Its roleRef is immutable so it is recreated if it differs.
+	binding := &rbacv1.RoleBinding{
+		ObjectMeta: meta(storeRoleName),
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: storeRoleName},
+		Subjects: []rbacv1.Subject{
+			{Kind: rbacv1.ServiceAccountKind, Name: serviceAccount, Namespace: namespace},
+		},
+	}
+	live, err := c.RbacV1().RoleBindings(namespace).Get(storeRoleName, metav1.GetOptions{})
+	switch {
+	case err == nil && reflect.DeepEqual(live.RoleRef, binding.RoleRef) && reflect.DeepEqual(live.Subjects, binding.Subjects):
+		report("rolebinding", nsName+storeRoleName, "unchanged")
+	case err == nil:
+		if !dryRun {
+			if err := c.RbacV1().RoleBindings(namespace).Delete(storeRoleName, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+				return fmt.Errorf("failed to delete rolebinding `%s%s': %v", nsName, storeRoleName, err)
+			}
+			if _, err := c.RbacV1().RoleBindings(namespace).Create(binding); err != nil {
+				return fmt.Errorf("failed to create rolebinding `%s%s': %v", nsName, storeRoleName, err)
+			}
+		}
+		report("rolebinding", nsName+storeRoleName, "updated")
+	case apierrors.IsNotFound(err):
+		if !dryRun {
+			if _, err := c.RbacV1().RoleBindings(namespace).Create(binding); err != nil {
+				return fmt.Errorf("failed to create rolebinding `%s%s': %v", nsName, storeRoleName, err)
+			}
+		}
+		report("rolebinding", nsName+storeRoleName, "created")
+	default:
+		return fmt.Errorf("failed to get rolebinding `%s%s': %v", nsName, storeRoleName, err)
+	}
+	return nil
+}
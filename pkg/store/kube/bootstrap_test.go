@@ -0,0 +1,115 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestBootstrap(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	bootstrap := func(dryRun bool) string {
+		var b bytes.Buffer
+		if err := Bootstrap(&b, client, "isopod", DefaultServiceAccount, dryRun); err != nil {
+			t.Fatalf("Bootstrap(dryRun=%v) failed: %v", dryRun, err)
+		}
+		return b.String()
+	}
+
+	for _, tc := range []struct {
+		name   string
+		dryRun bool
+		mutate func()
+		want   string
+	}{
+		{
+			name:   "Dry run",
+			dryRun: true,
+			want: "namespace `isopod' would be created\n" +
+				"serviceaccount `isopod/isopod' would be created\n" +
+				"role `isopod/isopod-store' would be created\n" +
+				"rolebinding `isopod/isopod-store' would be created\n",
+		},
+		{
+			name: "Create",
+			want: "namespace `isopod' created\n" +
+				"serviceaccount `isopod/isopod' created\n" +
+				"role `isopod/isopod-store' created\n" +
+				"rolebinding `isopod/isopod-store' created\n",
+		},
+		{
+			name: "Re-run",
+			want: "namespace `isopod' exists\n" +
+				"serviceaccount `isopod/isopod' exists\n" +
+				"role `isopod/isopod-store' unchanged\n" +
+				"rolebinding `isopod/isopod-store' unchanged\n",
+		},
+		{
+			name: "Drifted role",
+			mutate: func() {
+				r, err := client.RbacV1().Roles("isopod").Get(storeRoleName, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.Rules = r.Rules[:1]
+				if _, err := client.RbacV1().Roles("isopod").Update(r); err != nil {
+					t.Fatal(err)
+				}
+				b, err := client.RbacV1().RoleBindings("isopod").Get(storeRoleName, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				b.Subjects[0].Name = "someone-else"
+				if _, err := client.RbacV1().RoleBindings("isopod").Update(b); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: "namespace `isopod' exists\n" +
+				"serviceaccount `isopod/isopod' exists\n" +
+				"role `isopod/isopod-store' updated\n" +
+				"rolebinding `isopod/isopod-store' updated\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.mutate != nil {
+				tc.mutate()
+			}
+			if d := cmp.Diff(tc.want, bootstrap(tc.dryRun)); d != "" {
+				t.Errorf("Unexpected output (-want, +got):\n%s", d)
+			}
+		})
+	}
+
+	r, err := client.RbacV1().Roles("isopod").Get(storeRoleName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(storeRules, r.Rules); d != "" {
+		t.Errorf("Unexpected role rules (-want, +got):\n%s", d)
+	}
+	b, err := client.RbacV1().RoleBindings("isopod").Get(storeRoleName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Subjects[0].Name; got != DefaultServiceAccount {
+		t.Errorf("RoleBinding subject = %q, want %q", got, DefaultServiceAccount)
+	}
+}
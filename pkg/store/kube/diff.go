@@ -0,0 +1,68 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// diffRunLabelKey labels diffs recorded by PutDiff with their run.
+const diffRunLabelKey = "diff-run"
+
+// diffName returns name of the config recording diff of run on cluster.
+func diffName(cluster, run string) string {
+	if cluster == "" {
+		return "diff-" + run
+	}
+	return "diff-" + run + "-" + clusterKey(cluster)
+}
+
+// PutDiff records diffs (keyed by addon) proposed by dry run run on cluster
+// for review as a ConfigMap (or a Secret if secret is set) labeled with run
+// and cluster. Replaces diffs previously recorded for the same run and
+// cluster. Returns the name of the recorded object.
+func (s *Store) PutDiff(cluster, run string, diffs map[string]string, secret bool) (string, error) {
+	ls, annos := clusterMeta(cluster, map[string]string{diffRunLabelKey: run})
+	meta := metav1.ObjectMeta{
+		Name:        diffName(cluster, run),
+		Labels:      ls,
+		Annotations: annos,
+	}
+
+	var err error
+	if secret {
+		data := map[string][]byte{}
+		for k, v := range diffs {
+			data[k] = []byte(v)
+		}
+		sec := &corev1.Secret{ObjectMeta: meta, Data: data}
+		_, err = s.clientset.CoreV1().Secrets(s.namespace).Update(sec)
+		if apierrors.IsNotFound(err) {
+			_, err = s.clientset.CoreV1().Secrets(s.namespace).Create(sec)
+		}
+	} else {
+		cm := &corev1.ConfigMap{ObjectMeta: meta, Data: diffs}
+		_, err = s.clientset.CoreV1().ConfigMaps(s.namespace).Update(cm)
+		if apierrors.IsNotFound(err) {
+			_, err = s.clientset.CoreV1().ConfigMaps(s.namespace).Create(cm)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return meta.Name, nil
+}
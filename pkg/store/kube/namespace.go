@@ -0,0 +1,73 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ResolveNamespace returns tmpl (e.g `isopod-${team}') with ${key}
+// placeholders replaced by their values in params. Fails if a placeholder has
+// no value or the result is not a valid namespace name.
+func ResolveNamespace(tmpl string, params map[string]string) (string, error) {
+	var missing []string
+	ns := os.Expand(tmpl, func(key string) string {
+		v, ok := params[key]
+		if !ok {
+			missing = append(missing, key)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return "", fmt.Errorf("no value for placeholder(s) %q of namespace `%s'", missing, tmpl)
+	}
+	if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+		return "", fmt.Errorf("`%s' (resolved from `%s') is not a valid namespace name: %s", ns, tmpl, strings.Join(errs, "; "))
+	}
+	return ns, nil
+}
+
+// EnsureNamespace checks that namespace exists, creating it if create is set.
+func EnsureNamespace(c kubernetes.Interface, namespace string, create bool) error {
+	_, err := c.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get namespace `%s': %v", namespace, err)
+	}
+	if !create {
+		return fmt.Errorf("namespace `%s' does not exist", namespace)
+	}
+
+	if _, err := c.CoreV1().Namespaces().Create(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: namespace},
+	}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create namespace `%s': %v", namespace, err)
+	}
+	log.Infof("Created store namespace `%s'", namespace)
+	return nil
+}
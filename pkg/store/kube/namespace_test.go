@@ -0,0 +1,64 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestResolveNamespace(t *testing.T) {
+	params := map[string]string{"team": "infra", "env": "Prod"}
+	for _, tc := range []struct {
+		name, tmpl, want string
+		wantErr          bool
+	}{
+		{name: "static", tmpl: "default", want: "default"},
+		{name: "placeholder", tmpl: "isopod-${team}", want: "isopod-infra"},
+		{name: "missing", tmpl: "isopod-${team}-${region}", wantErr: true},
+		{name: "invalid", tmpl: "isopod-${env}", wantErr: true},
+		{name: "empty", tmpl: "${empty}", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ResolveNamespace(tc.tmpl, params)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ResolveNamespace(%q) error = %v, wantErr %v", tc.tmpl, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("ResolveNamespace(%q) = %q, want %q", tc.tmpl, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEnsureNamespace(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "isopod-infra"}})
+
+	if err := EnsureNamespace(client, "isopod-infra", false); err != nil {
+		t.Errorf("EnsureNamespace of existing namespace failed: %v", err)
+	}
+	if err := EnsureNamespace(client, "isopod-web", false); err == nil {
+		t.Error("Expected EnsureNamespace of missing namespace to fail")
+	}
+	if err := EnsureNamespace(client, "isopod-web", true); err != nil {
+		t.Fatalf("EnsureNamespace with create failed: %v", err)
+	}
+	if _, err := client.CoreV1().Namespaces().Get("isopod-web", metav1.GetOptions{}); err != nil {
+		t.Errorf("Namespace not created: %v", err)
+	}
+}
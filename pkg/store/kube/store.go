@@ -16,25 +16,85 @@
 package kube
 
 import (
-	"errors"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	log "github.com/golang/glog"
 	"github.com/rs/xid"
 	yaml "gopkg.in/yaml.v2"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes"
 
 	"github.com/cruise-automation/isopod/pkg/store"
 )
 
+const (
+	// legacyLiveName is the name of the live rollout config of the empty
+	// cluster (and of all clusters before they were kept apart).
+	legacyLiveName = "rollout-live"
+
+	clusterLabelKey      = "cluster"
+	clusterAnnotationKey = "isopod.getcruise.com/cluster"
+)
+
+// clusterKey returns a label-safe key that identifies cluster (empty for the
+// empty cluster).
+func clusterKey(cluster string) string {
+	if cluster == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(cluster))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// resumeName returns name of the resume state config of cluster.
+func resumeName(cluster string) string {
+	if cluster == "" {
+		return "rollout-resume"
+	}
+	return "rollout-resume-" + clusterKey(cluster)
+}
+
+// liveName returns name of the live rollout config of cluster.
+func liveName(cluster string) string {
+	if cluster == "" {
+		return legacyLiveName
+	}
+	return legacyLiveName + "-" + clusterKey(cluster)
+}
+
+// clusterMeta returns labels and annotations that identify cluster merged
+// into ls.
+func clusterMeta(cluster string, ls map[string]string) (labels, annotations map[string]string) {
+	if cluster == "" {
+		return ls, nil
+	}
+	if ls == nil {
+		ls = map[string]string{}
+	}
+	ls[clusterLabelKey] = clusterKey(cluster)
+	return ls, map[string]string{clusterAnnotationKey: cluster}
+}
+
 type Store struct {
 	namespace string
 	clientset kubernetes.Interface
 }
 
+var (
+	_ store.Store     = &Store{}
+	_ store.Collector = &Store{}
+	_ store.Historian = &Store{}
+)
+
 // New returns new Kubernetes-based Store implementation.
 func New(c kubernetes.Interface, namespace string) *Store {
 	return &Store{
@@ -44,11 +104,14 @@ func New(c kubernetes.Interface, namespace string) *Store {
 }
 
 // CreateRollout implements store.Store.CreateRollout.
-func (s *Store) CreateRollout() (*store.Rollout, error) {
+func (s *Store) CreateRollout(cluster string) (*store.Rollout, error) {
+	ls, annos := clusterMeta(cluster, nil)
 	cm, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Create(
 		&corev1.ConfigMap{
 			ObjectMeta: metav1.ObjectMeta{
-				Name: "rollout-" + xid.New().String(),
+				Name:        "rollout-" + xid.New().String(),
+				Labels:      ls,
+				Annotations: annos,
 			},
 		},
 	)
@@ -61,7 +124,7 @@ func (s *Store) CreateRollout() (*store.Rollout, error) {
 }
 
 // PutAddonRun implements store.Store.PutAddonRun.
-func (s *Store) PutAddonRun(id store.RolloutID, addon *store.AddonRun) (store.RunID, error) {
+func (s *Store) PutAddonRun(cluster string, id store.RolloutID, addon *store.AddonRun) (store.RunID, error) {
 	rollout, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(
 		string(id),
 		metav1.GetOptions{},
@@ -69,31 +132,47 @@ func (s *Store) PutAddonRun(id store.RolloutID, addon *store.AddonRun) (store.Ru
 	if err != nil {
 		return "", err
 	}
+	if err := checkCluster(rollout, cluster); err != nil {
+		return "", err
+	}
 
 	mods, err := yaml.Marshal(addon.Modules)
 	if err != nil {
 		return "", fmt.Errorf("could not marshal addon modules: %v", err)
 	}
 
+	secretVersions, err := yaml.Marshal(addon.SecretVersions)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal addon secret versions: %v", err)
+	}
+
+	leases, err := yaml.Marshal(addon.Leases)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal addon leases: %v", err)
+	}
+
+	objRefs, err := yaml.Marshal(addon.ObjRefs)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal addon object references: %v", err)
+	}
+
 	ref := metav1.NewControllerRef(rollout, schema.GroupVersionKind{
 		Version: "v1",
 		Kind:    "ConfigMap",
 	})
-	runLabels := map[string]string{
+	runLabels, runAnnos := clusterMeta(cluster, map[string]string{
 		"addon": addon.Name,
 		"owner": string(id),
-	}
+	})
 	run, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Create(
 		&corev1.ConfigMap{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:            fmt.Sprintf("%s-run-%v", addon.Name, xid.New()),
 				OwnerReferences: []metav1.OwnerReference{*ref},
 				Labels:          runLabels,
+				Annotations:     runAnnos,
 			},
-			Data: map[string]string{
-				"addon":   addon.Name,
-				"modules": string(mods),
-			},
+			Data:       runData(addon, mods, secretVersions, leases, objRefs),
 			BinaryData: addon.Data,
 		},
 	)
@@ -118,12 +197,35 @@ func (s *Store) PutAddonRun(id store.RolloutID, addon *store.AddonRun) (store.Ru
 	return store.RunID(run.Name), nil
 }
 
+// runData returns data of the run config of addon with its modules, secret
+// versions, leases and object references marshaled already.
+func runData(addon *store.AddonRun, mods, secretVersions, leases, objRefs []byte) map[string]string {
+	data := map[string]string{
+		"addon":           addon.Name,
+		"modules":         string(mods),
+		"secret_versions": string(secretVersions),
+		"leases":          string(leases),
+		"obj_refs":        string(objRefs),
+	}
+	if !addon.AppliedAt.IsZero() {
+		data["applied_at"] = addon.AppliedAt.UTC().Format(time.RFC3339)
+	}
+	if addon.AppliedBy != "" {
+		data["applied_by"] = addon.AppliedBy
+	}
+	if addon.Source != "" {
+		data["source"] = addon.Source
+	}
+	return data
+}
+
 // CompleteRollout implements store.Store.CompleteRollout.
-func (s *Store) CompleteRollout(id store.RolloutID) error {
+func (s *Store) CompleteRollout(cluster string, id store.RolloutID) error {
+	ls, annos := clusterMeta(cluster, map[string]string{"rollout": "live"})
 	lst, err := s.clientset.CoreV1().ConfigMaps(s.namespace).List(
 		metav1.ListOptions{
-			FieldSelector: "metadata.name=rollout-live",
-			LabelSelector: "rollout=live", // fakeclient is kind of trash and doesn't support field selectors.
+			FieldSelector: "metadata.name=" + liveName(cluster),
+			LabelSelector: labels.SelectorFromSet(ls).String(), // fakeclient is kind of trash and doesn't support field selectors.
 			Limit:         1,
 		},
 	)
@@ -136,8 +238,9 @@ func (s *Store) CompleteRollout(id store.RolloutID) error {
 		log.Infof("Creating new live rollout config for `%v'", id)
 		_, err = s.clientset.CoreV1().ConfigMaps(s.namespace).Create(&corev1.ConfigMap{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:   "rollout-live",
-				Labels: map[string]string{"rollout": "live"},
+				Name:        liveName(cluster),
+				Labels:      ls,
+				Annotations: annos,
 			},
 			Data: map[string]string{"rollout": string(id)},
 		})
@@ -151,12 +254,282 @@ func (s *Store) CompleteRollout(id store.RolloutID) error {
 	return err
 }
 
-// GetLive implements store.Store.GetLive.
-func (s *Store) GetLive() (r *store.Rollout, found bool, err error) {
-	return nil, false, errors.New("not implemented")
+// GetLive implements store.Store.GetLive. Falls back to the live rollout
+// config of the empty cluster if it was recorded before clusters were kept
+// apart (and doesn't belong to another cluster).
+func (s *Store) GetLive(cluster string) (r *store.Rollout, found bool, err error) {
+	name := liveName(cluster)
+	live, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) && cluster != "" {
+		name = legacyLiveName
+		live, err = s.clientset.CoreV1().ConfigMaps(s.namespace).Get(name, metav1.GetOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	id := store.RolloutID(live.Data["rollout"])
+	if name == legacyLiveName && cluster != "" {
+		rollout, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(string(id), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		if rollout.Labels[clusterLabelKey] != "" {
+			return nil, false, nil
+		}
+		log.Infof("Using live rollout `%s' recorded before clusters were kept apart for %s", id, cluster)
+		cluster = ""
+	}
+
+	r, found, err = s.GetRollout(cluster, id)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	r.Live = true
+	return r, true, nil
 }
 
 // GetRollout implements store.Store.GetRollout.
-func (s *Store) GetRollout(id store.RolloutID) (r *store.Rollout, found bool, err error) {
-	return nil, false, errors.New("not implemented")
+func (s *Store) GetRollout(cluster string, id store.RolloutID) (r *store.Rollout, found bool, err error) {
+	rollout, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(string(id), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if err := checkCluster(rollout, cluster); err != nil {
+		return nil, false, err
+	}
+
+	r = &store.Rollout{ID: id}
+	for addonName, runName := range rollout.Data {
+		run, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(runName, metav1.GetOptions{})
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to get run `%s' for addon `%s': %v", runName, addonName, err)
+		}
+
+		a := &store.AddonRun{
+			Name: run.Data["addon"],
+			Data: run.BinaryData,
+		}
+		if err := yaml.Unmarshal([]byte(run.Data["modules"]), &a.Modules); err != nil {
+			return nil, false, fmt.Errorf("could not unmarshal modules of run `%s': %v", runName, err)
+		}
+		if err := yaml.Unmarshal([]byte(run.Data["secret_versions"]), &a.SecretVersions); err != nil {
+			return nil, false, fmt.Errorf("could not unmarshal secret versions of run `%s': %v", runName, err)
+		}
+		if err := yaml.Unmarshal([]byte(run.Data["leases"]), &a.Leases); err != nil {
+			return nil, false, fmt.Errorf("could not unmarshal leases of run `%s': %v", runName, err)
+		}
+		if err := yaml.Unmarshal([]byte(run.Data["obj_refs"]), &a.ObjRefs); err != nil {
+			return nil, false, fmt.Errorf("could not unmarshal object references of run `%s': %v", runName, err)
+		}
+		if a.AppliedAt, err = appliedAt(run); err != nil {
+			return nil, false, err
+		}
+		a.AppliedBy = run.Data["applied_by"]
+		a.Source = run.Data["source"]
+		r.Addons = append(r.Addons, a)
+	}
+	sort.Slice(r.Addons, func(i, j int) bool { return r.Addons[i].Name < r.Addons[j].Name })
+
+	return r, true, nil
+}
+
+// appliedAt returns when run was applied (unset if it was recorded before
+// this was tracked).
+func appliedAt(run *corev1.ConfigMap) (time.Time, error) {
+	v, ok := run.Data["applied_at"]
+	if !ok {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse time run `%s' was applied at: %v", run.Name, err)
+	}
+	return t, nil
+}
+
+// History implements store.Historian.History. Runs recorded before clusters
+// were kept apart only belong to the empty cluster.
+func (s *Store) History(cluster, addon string) ([]store.Revision, error) {
+	sel := labels.Set{"addon": addon}.AsSelector().String()
+	if key := clusterKey(cluster); key != "" {
+		sel += "," + clusterLabelKey + "=" + key
+	} else {
+		sel += ",!" + clusterLabelKey
+	}
+	lst, err := s.clientset.CoreV1().ConfigMaps(s.namespace).List(metav1.ListOptions{LabelSelector: sel})
+	if err != nil {
+		return nil, err
+	}
+
+	var liveID store.RolloutID
+	if live, found, err := s.GetLive(cluster); err != nil {
+		return nil, fmt.Errorf("failed to get live rollout: %v", err)
+	} else if found {
+		liveID = live.ID
+	}
+
+	var revs []store.Revision
+	for i := range lst.Items {
+		run := &lst.Items[i]
+		if run.Labels["owner"] == "" || run.Labels[clusterLabelKey] != clusterKey(cluster) {
+			continue
+		}
+		var objRefs []store.ObjRef
+		if err := yaml.Unmarshal([]byte(run.Data["obj_refs"]), &objRefs); err != nil {
+			return nil, fmt.Errorf("could not unmarshal object references of run `%s': %v", run.Name, err)
+		}
+		at, err := appliedAt(run)
+		if err != nil {
+			return nil, err
+		}
+		if at.IsZero() {
+			at = run.CreationTimestamp.Time
+		}
+		id := store.RolloutID(run.Labels["owner"])
+		revs = append(revs, store.Revision{
+			Rollout:   id,
+			Run:       store.RunID(run.Name),
+			AppliedAt: at,
+			AppliedBy: run.Data["applied_by"],
+			Source:    run.Data["source"],
+			Objects:   len(objRefs),
+			Live:      id == liveID,
+		})
+	}
+	// Names of runs end with xids which sort by creation time too.
+	sort.Slice(revs, func(i, j int) bool {
+		if !revs[i].AppliedAt.Equal(revs[j].AppliedAt) {
+			return revs[i].AppliedAt.Before(revs[j].AppliedAt)
+		}
+		return revs[i].Run < revs[j].Run
+	})
+	return revs, nil
+}
+
+// PutResumeState implements store.Store.PutResumeState.
+func (s *Store) PutResumeState(cluster string, rs *store.ResumeState) error {
+	applied, err := yaml.Marshal(rs.Applied)
+	if err != nil {
+		return fmt.Errorf("could not marshal applied objects: %v", err)
+	}
+
+	ls, annos := clusterMeta(cluster, nil)
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        resumeName(cluster),
+			Labels:      ls,
+			Annotations: annos,
+		},
+		Data: map[string]string{"applied": string(applied)},
+	}
+	_, err = s.clientset.CoreV1().ConfigMaps(s.namespace).Update(cm)
+	if apierrors.IsNotFound(err) {
+		_, err = s.clientset.CoreV1().ConfigMaps(s.namespace).Create(cm)
+	}
+	return err
+}
+
+// GetResumeState implements store.Store.GetResumeState.
+func (s *Store) GetResumeState(cluster string) (rs *store.ResumeState, found bool, err error) {
+	cm, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(resumeName(cluster), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	rs = &store.ResumeState{}
+	if err := yaml.Unmarshal([]byte(cm.Data["applied"]), &rs.Applied); err != nil {
+		return nil, false, fmt.Errorf("could not unmarshal applied objects: %v", err)
+	}
+	return rs, true, nil
+}
+
+// DeleteResumeState implements store.Store.DeleteResumeState.
+func (s *Store) DeleteResumeState(cluster string) error {
+	err := s.clientset.CoreV1().ConfigMaps(s.namespace).Delete(resumeName(cluster), &metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// checkCluster returns error if rollout config doesn't belong to cluster.
+func checkCluster(rollout *corev1.ConfigMap, cluster string) error {
+	if got := rollout.Labels[clusterLabelKey]; got != clusterKey(cluster) {
+		return fmt.Errorf("rollout `%s' belongs to another cluster (%s)", rollout.Name, rollout.Annotations[clusterAnnotationKey])
+	}
+	return nil
+}
+
+// Entries implements store.Collector.Entries. Config maps of the namespace
+// that weren't created by Store are skipped.
+func (s *Store) Entries() ([]store.Entry, error) {
+	lst, err := s.clientset.CoreV1().ConfigMaps(s.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []store.Entry
+	for i := range lst.Items {
+		cm := &lst.Items[i]
+		e := store.Entry{ID: cm.Name}
+		switch {
+		case cm.Labels["rollout"] == "live" && strings.HasPrefix(cm.Name, legacyLiveName):
+			e.Kind = store.LiveEntry
+			e.Rollout = store.RolloutID(cm.Data["rollout"])
+		case cm.Name == resumeName("") || strings.HasPrefix(cm.Name, resumeName("")+"-"):
+			e.Kind = store.ResumeEntry
+		case cm.Labels["owner"] != "" && cm.Labels["addon"] != "":
+			e.Kind = store.AddonRunEntry
+			e.Addon = cm.Labels["addon"]
+			e.Rollout = store.RolloutID(cm.Labels["owner"])
+		case isRolloutName(cm.Name):
+			e.Kind = store.RolloutEntry
+		default:
+			continue
+		}
+		e.Cluster, e.ClusterKnown = entryCluster(cm)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// DeleteEntry implements store.Collector.DeleteEntry.
+func (s *Store) DeleteEntry(id string) error {
+	err := s.clientset.CoreV1().ConfigMaps(s.namespace).Delete(id, &metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// isRolloutName returns true if name is a name of a rollout config.
+func isRolloutName(name string) bool {
+	if !strings.HasPrefix(name, "rollout-") {
+		return false
+	}
+	_, err := xid.FromString(strings.TrimPrefix(name, "rollout-"))
+	return err == nil
+}
+
+// entryCluster returns cluster config map cm belongs to and true if it can be
+// told (i.e cm has matching cluster label and annotation).
+func entryCluster(cm *corev1.ConfigMap) (string, bool) {
+	key := cm.Labels[clusterLabelKey]
+	cluster := cm.Annotations[clusterAnnotationKey]
+	if key == "" || cluster == "" || clusterKey(cluster) != key {
+		return "", false
+	}
+	return cluster, true
 }
@@ -19,7 +19,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/tools/cache"
@@ -86,20 +88,301 @@ func TestRollout(t *testing.T) {
 
 	ks := &Store{clientset: client, namespace: "test-ns"}
 
-	r, err := ks.CreateRollout()
+	r, err := ks.CreateRollout("")
 	if err != nil {
 		t.Errorf("error creating rollout: %v", err)
 	}
 	waitN(t, ch, 1)
 
-	_, err = ks.PutAddonRun(r.ID, &store.AddonRun{Name: "test-addon", Modules: map[string]string{"main.ipd": addonText}})
+	run := &store.AddonRun{
+		Name:           "test-addon",
+		Modules:        map[string]string{"main.ipd": addonText},
+		SecretVersions: map[string]string{"secret/data/foo": "3"},
+		Leases:         []string{"database/creds/readonly/abc123"},
+		ObjRefs: []store.ObjRef{
+			{APIVersion: "v1", Kind: "Namespace", Name: "test"},
+			{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "test", Name: "app"},
+		},
+		AppliedAt: time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC),
+		AppliedBy: "alice@laptop",
+		Source:    "3f2c1ab (main, dirty)",
+	}
+	_, err = ks.PutAddonRun("", r.ID, run)
 	if err != nil {
 		t.Errorf("error creating run for rollout `%s': %v", r.ID, err)
 	}
 	waitN(t, ch, 2)
 
-	if err = ks.CompleteRollout(r.ID); err != nil {
+	if _, found, err := ks.GetLive(""); err != nil || found {
+		t.Errorf("unexpected live rollout before completion (found: %v): %v", found, err)
+	}
+
+	if err = ks.CompleteRollout("", r.ID); err != nil {
 		t.Errorf("error completing rollout `%s': %v", r.ID, err)
 	}
 	waitN(t, ch, 1)
+
+	live, found, err := ks.GetLive("")
+	if err != nil || !found {
+		t.Fatalf("error getting live rollout (found: %v): %v", found, err)
+	}
+	want := &store.Rollout{ID: r.ID, Addons: []*store.AddonRun{run}, Live: true}
+	if d := cmp.Diff(want, live); d != "" {
+		t.Errorf("unexpected live rollout (-want +got):\n%s", d)
+	}
+}
+
+func TestClusters(t *testing.T) {
+	ks := &Store{clientset: fake.NewSimpleClientset(), namespace: "test-ns"}
+
+	// complete records a rollout of the same addon for cluster.
+	complete := func(cluster string) store.RolloutID {
+		r, err := ks.CreateRollout(cluster)
+		if err != nil {
+			t.Fatalf("error creating rollout for `%s': %v", cluster, err)
+		}
+		run := &store.AddonRun{Name: "test-addon", Modules: map[string]string{"main.ipd": cluster}}
+		if _, err := ks.PutAddonRun(cluster, r.ID, run); err != nil {
+			t.Fatalf("error creating run for `%s': %v", cluster, err)
+		}
+		if err := ks.CompleteRollout(cluster, r.ID); err != nil {
+			t.Fatalf("error completing rollout for `%s': %v", cluster, err)
+		}
+		return r.ID
+	}
+
+	// Recorded before clusters were kept apart.
+	legacy := complete("")
+	a := complete("https://10.0.0.1")
+	b := complete("https://10.0.0.2")
+
+	for _, tc := range []struct {
+		cluster string
+		wantID  store.RolloutID
+	}{
+		{cluster: "", wantID: legacy},
+		{cluster: "https://10.0.0.1", wantID: a},
+		{cluster: "https://10.0.0.2", wantID: b},
+		{cluster: "https://10.0.0.3", wantID: legacy},
+	} {
+		live, found, err := ks.GetLive(tc.cluster)
+		if err != nil || !found {
+			t.Fatalf("error getting live rollout of `%s' (found: %v): %v", tc.cluster, found, err)
+		}
+		if live.ID != tc.wantID {
+			t.Errorf("unexpected live rollout of `%s': want %s, got %s", tc.cluster, tc.wantID, live.ID)
+		}
+	}
+
+	if _, _, err := ks.GetRollout("https://10.0.0.2", a); err == nil {
+		t.Error("expected error getting rollout of another cluster")
+	}
+	if _, err := ks.PutAddonRun("https://10.0.0.1", b, &store.AddonRun{Name: "other"}); err == nil {
+		t.Error("expected error recording run in rollout of another cluster")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	ks := &Store{clientset: fake.NewSimpleClientset(), namespace: "test-ns"}
+
+	start := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+	// rollout records a run of addon applying n objects for cluster at
+	// start+i hours (and completes the rollout if live is set).
+	rollout := func(cluster, addon string, i, n int, live bool) store.RolloutID {
+		r, err := ks.CreateRollout(cluster)
+		if err != nil {
+			t.Fatalf("error creating rollout for `%s': %v", cluster, err)
+		}
+		run := &store.AddonRun{
+			Name:      addon,
+			ObjRefs:   make([]store.ObjRef, n),
+			AppliedAt: start.Add(time.Duration(i) * time.Hour),
+			AppliedBy: "ci",
+		}
+		if _, err := ks.PutAddonRun(cluster, r.ID, run); err != nil {
+			t.Fatalf("error creating run for `%s': %v", cluster, err)
+		}
+		if live {
+			if err := ks.CompleteRollout(cluster, r.ID); err != nil {
+				t.Fatalf("error completing rollout for `%s': %v", cluster, err)
+			}
+		}
+		return r.ID
+	}
+
+	// Recorded first since the fake client ignores field selectors of
+	// CompleteRollout.
+	rollout("", "app", 0, 1, true)
+	const cluster = "https://10.0.0.1"
+	second := rollout(cluster, "app", 2, 3, true)
+	first := rollout(cluster, "app", 1, 2, true)
+	failed := rollout(cluster, "app", 3, 1, false)
+	rollout(cluster, "other", 4, 1, false)
+	rollout("https://10.0.0.2", "app", 5, 1, true)
+
+	got, err := ks.History(cluster, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		got[i].Run = ""
+	}
+	want := []store.Revision{
+		{Rollout: first, AppliedAt: start.Add(time.Hour), AppliedBy: "ci", Objects: 2, Live: true},
+		{Rollout: second, AppliedAt: start.Add(2 * time.Hour), AppliedBy: "ci", Objects: 3},
+		{Rollout: failed, AppliedAt: start.Add(3 * time.Hour), AppliedBy: "ci", Objects: 1},
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("unexpected history (-want +got):\n%s", d)
+	}
+
+	if got, err := ks.History("", "app"); err != nil || len(got) != 1 {
+		t.Errorf("expected single revision of the empty cluster, got %v: %v", got, err)
+	}
+	if got, err := ks.History(cluster, "missing"); err != nil || len(got) != 0 {
+		t.Errorf("expected no revisions of missing addon, got %v: %v", got, err)
+	}
+}
+
+func TestResumeState(t *testing.T) {
+	ks := &Store{clientset: fake.NewSimpleClientset(), namespace: "test-ns"}
+
+	for _, cluster := range []string{"", "https://10.0.0.1"} {
+		if _, found, err := ks.GetResumeState(cluster); err != nil || found {
+			t.Fatalf("unexpected resume state of `%s' before put (found: %v): %v", cluster, found, err)
+		}
+
+		for _, applied := range []map[string]string{
+			{"app/v1/ConfigMap/default/foo": "abc"},
+			{"app/v1/ConfigMap/default/foo": "abc", "app/v1/ConfigMap/default/bar": "def"},
+		} {
+			if err := ks.PutResumeState(cluster, &store.ResumeState{Applied: applied}); err != nil {
+				t.Fatalf("error putting resume state of `%s': %v", cluster, err)
+			}
+			got, found, err := ks.GetResumeState(cluster)
+			if err != nil || !found {
+				t.Fatalf("error getting resume state of `%s' (found: %v): %v", cluster, found, err)
+			}
+			if d := cmp.Diff(applied, got.Applied); d != "" {
+				t.Errorf("unexpected resume state of `%s' (-want +got):\n%s", cluster, d)
+			}
+		}
+	}
+
+	if err := ks.DeleteResumeState(""); err != nil {
+		t.Fatalf("error deleting resume state: %v", err)
+	}
+	if _, found, _ := ks.GetResumeState(""); found {
+		t.Error("expected resume state to be deleted")
+	}
+	if _, found, _ := ks.GetResumeState("https://10.0.0.1"); !found {
+		t.Error("expected resume state of another cluster to be kept")
+	}
+	if err := ks.DeleteResumeState(""); err != nil {
+		t.Errorf("error deleting missing resume state: %v", err)
+	}
+}
+
+func TestEntries(t *testing.T) {
+	const cluster = "https://10.0.0.1"
+	client := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "unrelated", Namespace: "test-ns"},
+	})
+	ks := &Store{clientset: client, namespace: "test-ns"}
+
+	for _, c := range []string{"", cluster} {
+		r, err := ks.CreateRollout(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ks.PutAddonRun(c, r.ID, &store.AddonRun{Name: "foo"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ks.CompleteRollout(c, r.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := ks.PutResumeState(c, &store.ResumeState{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := ks.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[store.EntryKind][]store.Entry{}
+	for _, e := range entries {
+		got[e.Kind] = append(got[e.Kind], e)
+	}
+	for _, kind := range []store.EntryKind{store.RolloutEntry, store.AddonRunEntry, store.LiveEntry, store.ResumeEntry} {
+		es := got[kind]
+		if len(es) != 2 {
+			t.Fatalf("expected 2 %s entries, got: %+v", kind, es)
+		}
+		for _, e := range es {
+			if want := e.Cluster != ""; e.ClusterKnown != want {
+				t.Errorf("unexpected cluster of %s `%s': %q (known: %v)", kind, e.ID, e.Cluster, e.ClusterKnown)
+			}
+		}
+	}
+	if len(entries) != 8 {
+		t.Errorf("expected unrelated config map to be skipped, got: %+v", entries)
+	}
+	for _, e := range got[store.AddonRunEntry] {
+		if e.Addon != "foo" || e.Rollout == "" {
+			t.Errorf("unexpected addon run entry: %+v", e)
+		}
+	}
+
+	run := got[store.AddonRunEntry][0]
+	if err := ks.DeleteEntry(run.ID); err != nil {
+		t.Fatalf("error deleting entry: %v", err)
+	}
+	if err := ks.DeleteEntry(run.ID); err != nil {
+		t.Errorf("error deleting missing entry: %v", err)
+	}
+	if entries, _ := ks.Entries(); len(entries) != 7 {
+		t.Errorf("expected entry to be deleted, got: %+v", entries)
+	}
+}
+
+func TestPutDiff(t *testing.T) {
+	const cluster = "https://10.0.0.1"
+	client := fake.NewSimpleClientset()
+	ks := &Store{clientset: client, namespace: "test-ns"}
+
+	for _, diffs := range []map[string]string{
+		{"app": "--- a\n+++ b\n"},
+		{"app": "--- a\n+++ c\n", "other": "--- d\n+++ e\n"},
+	} {
+		name, err := ks.PutDiff(cluster, "run1", diffs, false)
+		if err != nil {
+			t.Fatalf("error putting diff: %v", err)
+		}
+		cm, err := client.CoreV1().ConfigMaps("test-ns").Get(name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := cmp.Diff(diffs, cm.Data); d != "" {
+			t.Errorf("unexpected diff data (-want +got):\n%s", d)
+		}
+		if cm.Labels[diffRunLabelKey] != "run1" || cm.Annotations[clusterAnnotationKey] != cluster {
+			t.Errorf("unexpected diff metadata: %v, %v", cm.Labels, cm.Annotations)
+		}
+	}
+
+	name, err := ks.PutDiff(cluster, "run1", map[string]string{"app": "secret diff"}, true)
+	if err != nil {
+		t.Fatalf("error putting diff as secret: %v", err)
+	}
+	s, err := client.CoreV1().Secrets("test-ns").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(s.Data["app"]); got != "secret diff" {
+		t.Errorf("unexpected diff in secret: %q", got)
+	}
+	if other, _ := ks.PutDiff("https://10.0.0.2", "run1", nil, false); other == name {
+		t.Errorf("expected diffs of clusters to be kept apart, got `%s' for both", name)
+	}
 }
@@ -0,0 +1,233 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mirror implements a store.Store that mirrors rollouts of a primary
+// store into another (mirror) store.
+package mirror
+
+import (
+	"errors"
+	"sync"
+
+	log "github.com/golang/glog"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+)
+
+// Store writes to both primary and mirror stores and reads from primary,
+// falling back to mirror if primary fails or doesn't have the requested
+// state. Failures to write to mirror are logged as warnings; primary write
+// failures are returned.
+//
+// Backends assign their own RolloutIDs so IDs of rollouts created through
+// Store are those of primary; Store keeps track of corresponding mirror IDs.
+type Store struct {
+	primary, mirror store.Store
+
+	mu sync.Mutex
+	// ids maps primary RolloutIDs to mirror ones. Missing if rollout failed
+	// to be created in mirror.
+	ids map[store.RolloutID]store.RolloutID
+}
+
+var (
+	_ store.Store     = &Store{}
+	_ store.Multi     = &Store{}
+	_ store.Historian = &Store{}
+)
+
+// New returns a new Store mirroring primary into mirror.
+func New(primary, mirror store.Store) *Store {
+	return &Store{
+		primary: primary,
+		mirror:  mirror,
+		ids:     map[store.RolloutID]store.RolloutID{},
+	}
+}
+
+// Stores implements store.Multi.Stores.
+func (s *Store) Stores() []store.Store {
+	return []store.Store{s.primary, s.mirror}
+}
+
+// mirrorID returns mirror ID of the rollout with primary id.
+func (s *Store) mirrorID(id store.RolloutID) (store.RolloutID, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mID, ok := s.ids[id]
+	return mID, ok
+}
+
+// CreateRollout implements store.Store.CreateRollout.
+func (s *Store) CreateRollout(cluster string) (*store.Rollout, error) {
+	r, err := s.primary.CreateRollout(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	mr, err := s.mirror.CreateRollout(cluster)
+	if err != nil {
+		log.Warningf("Failed to create rollout `%s' in mirror store (won't be mirrored): %v", r.ID, err)
+		return r, nil
+	}
+	s.mu.Lock()
+	s.ids[r.ID] = mr.ID
+	s.mu.Unlock()
+	return r, nil
+}
+
+// PutAddonRun implements store.Store.PutAddonRun.
+func (s *Store) PutAddonRun(cluster string, id store.RolloutID, addon *store.AddonRun) (store.RunID, error) {
+	runID, err := s.primary.PutAddonRun(cluster, id, addon)
+	if err != nil {
+		return "", err
+	}
+
+	if mID, ok := s.mirrorID(id); ok {
+		if _, err := s.mirror.PutAddonRun(cluster, mID, addon); err != nil {
+			log.Warningf("Failed to put run of addon `%s' of rollout `%s' to mirror store: %v", addon.Name, id, err)
+		}
+	}
+	return runID, nil
+}
+
+// CompleteRollout implements store.Store.CompleteRollout.
+func (s *Store) CompleteRollout(cluster string, id store.RolloutID) error {
+	if err := s.primary.CompleteRollout(cluster, id); err != nil {
+		return err
+	}
+
+	if mID, ok := s.mirrorID(id); ok {
+		if err := s.mirror.CompleteRollout(cluster, mID); err != nil {
+			log.Warningf("Failed to complete rollout `%s' in mirror store: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// GetLive implements store.Store.GetLive.
+func (s *Store) GetLive(cluster string) (*store.Rollout, bool, error) {
+	r, found, err := s.primary.GetLive(cluster)
+	if err == nil && found {
+		return r, true, nil
+	}
+	if err != nil {
+		log.Warningf("Failed to get live rollout from primary store, reading from mirror: %v", err)
+	}
+
+	mr, mFound, mErr := s.mirror.GetLive(cluster)
+	if mErr != nil {
+		if err != nil {
+			return nil, false, err
+		}
+		log.Warningf("Failed to get live rollout from mirror store: %v", mErr)
+		return nil, false, nil
+	}
+	if mFound && err == nil {
+		log.Warningf("Live rollout not found in primary store, using `%s' from mirror store", mr.ID)
+	}
+	return mr, mFound, nil
+}
+
+// History implements store.Historian.History. Falls back to mirror if primary
+// fails or doesn't keep history (RolloutIDs are mirror's then).
+func (s *Store) History(cluster, addon string) ([]store.Revision, error) {
+	var err error
+	if h, ok := s.primary.(store.Historian); ok {
+		revs, pErr := h.History(cluster, addon)
+		if pErr == nil {
+			return revs, nil
+		}
+		log.Warningf("Failed to get history from primary store, reading from mirror: %v", pErr)
+		err = pErr
+	}
+
+	h, ok := s.mirror.(store.Historian)
+	if !ok {
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New("neither primary nor mirror store keeps history")
+	}
+	return h.History(cluster, addon)
+}
+
+// GetRollout implements store.Store.GetRollout. Rollouts not found in
+// primary are looked up in mirror by their mirror ID (if known) or id.
+func (s *Store) GetRollout(cluster string, id store.RolloutID) (*store.Rollout, bool, error) {
+	r, found, err := s.primary.GetRollout(cluster, id)
+	if err == nil && found {
+		return r, true, nil
+	}
+	if err != nil {
+		log.Warningf("Failed to get rollout `%s' from primary store, reading from mirror: %v", id, err)
+	}
+
+	mID, ok := s.mirrorID(id)
+	if !ok {
+		mID = id
+	}
+	mr, mFound, mErr := s.mirror.GetRollout(cluster, mID)
+	if mErr != nil {
+		if err != nil {
+			return nil, false, err
+		}
+		log.Warningf("Failed to get rollout `%s' from mirror store: %v", id, mErr)
+		return nil, false, nil
+	}
+	return mr, mFound, nil
+}
+
+// PutResumeState implements store.Store.PutResumeState.
+func (s *Store) PutResumeState(cluster string, st *store.ResumeState) error {
+	if err := s.primary.PutResumeState(cluster, st); err != nil {
+		return err
+	}
+	if err := s.mirror.PutResumeState(cluster, st); err != nil {
+		log.Warningf("Failed to put resume state to mirror store: %v", err)
+	}
+	return nil
+}
+
+// GetResumeState implements store.Store.GetResumeState.
+func (s *Store) GetResumeState(cluster string) (*store.ResumeState, bool, error) {
+	st, found, err := s.primary.GetResumeState(cluster)
+	if err == nil && found {
+		return st, true, nil
+	}
+	if err != nil {
+		log.Warningf("Failed to get resume state from primary store, reading from mirror: %v", err)
+	}
+
+	mst, mFound, mErr := s.mirror.GetResumeState(cluster)
+	if mErr != nil {
+		if err != nil {
+			return nil, false, err
+		}
+		log.Warningf("Failed to get resume state from mirror store: %v", mErr)
+		return nil, false, nil
+	}
+	return mst, mFound, nil
+}
+
+// DeleteResumeState implements store.Store.DeleteResumeState.
+func (s *Store) DeleteResumeState(cluster string) error {
+	if err := s.primary.DeleteResumeState(cluster); err != nil {
+		return err
+	}
+	if err := s.mirror.DeleteResumeState(cluster); err != nil {
+		log.Warningf("Failed to delete resume state from mirror store: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mirror
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/cruise-automation/isopod/pkg/store"
+	kubestore "github.com/cruise-automation/isopod/pkg/store/kube"
+)
+
+const cluster = "https://10.0.0.1"
+
+// brokenStore fails all operations.
+type brokenStore struct{}
+
+var errBroken = errors.New("broken")
+
+func (brokenStore) CreateRollout(string) (*store.Rollout, error) { return nil, errBroken }
+func (brokenStore) PutAddonRun(string, store.RolloutID, *store.AddonRun) (store.RunID, error) {
+	return "", errBroken
+}
+func (brokenStore) CompleteRollout(string, store.RolloutID) error { return errBroken }
+func (brokenStore) GetLive(string) (*store.Rollout, bool, error)  { return nil, false, errBroken }
+func (brokenStore) GetRollout(string, store.RolloutID) (*store.Rollout, bool, error) {
+	return nil, false, errBroken
+}
+func (brokenStore) PutResumeState(string, *store.ResumeState) error { return errBroken }
+func (brokenStore) GetResumeState(string) (*store.ResumeState, bool, error) {
+	return nil, false, errBroken
+}
+func (brokenStore) DeleteResumeState(string) error { return errBroken }
+
+// rollout creates and completes a rollout of a single addon in s.
+func rollout(t *testing.T, s store.Store, addon string) store.RolloutID {
+	r, err := s.CreateRollout(cluster)
+	if err != nil {
+		t.Fatalf("Failed to create rollout: %v", err)
+	}
+	if _, err := s.PutAddonRun(cluster, r.ID, &store.AddonRun{Name: addon}); err != nil {
+		t.Fatalf("Failed to put addon run: %v", err)
+	}
+	if err := s.CompleteRollout(cluster, r.ID); err != nil {
+		t.Fatalf("Failed to complete rollout: %v", err)
+	}
+	return r.ID
+}
+
+func addonNames(r *store.Rollout) []string {
+	var names []string
+	for _, a := range r.Addons {
+		names = append(names, a.Name)
+	}
+	return names
+}
+
+func TestMirror(t *testing.T) {
+	primary := kubestore.New(fake.NewSimpleClientset(), "default")
+	mirror := kubestore.New(fake.NewSimpleClientset(), "default")
+	s := New(primary, mirror)
+
+	id := rollout(t, s, "foo")
+
+	// Both stores have the live rollout.
+	for name, st := range map[string]store.Store{"primary": primary, "mirror": mirror} {
+		live, found, err := st.GetLive(cluster)
+		if err != nil || !found {
+			t.Fatalf("Expected live rollout in %s store, got found=%v, err=%v", name, found, err)
+		}
+		if d := cmp.Diff([]string{"foo"}, addonNames(live)); d != "" {
+			t.Errorf("Unexpected addons of live rollout in %s store (-want +got):\n%s", name, d)
+		}
+	}
+
+	// Rollouts are read from mirror by primary IDs if missing in primary.
+	s = &Store{primary: kubestore.New(fake.NewSimpleClientset(), "default"), mirror: mirror, ids: s.ids}
+	r, found, err := s.GetRollout(cluster, id)
+	if err != nil || !found {
+		t.Fatalf("Expected rollout `%s' in mirror store, got found=%v, err=%v", id, found, err)
+	}
+	if d := cmp.Diff([]string{"foo"}, addonNames(r)); d != "" {
+		t.Errorf("Unexpected addons of mirrored rollout (-want +got):\n%s", d)
+	}
+	live, found, err := s.GetLive(cluster)
+	if err != nil || !found {
+		t.Fatalf("Expected live rollout from mirror store, got found=%v, err=%v", found, err)
+	}
+	if d := cmp.Diff([]string{"foo"}, addonNames(live)); d != "" {
+		t.Errorf("Unexpected addons of live rollout from mirror store (-want +got):\n%s", d)
+	}
+
+	state := &store.ResumeState{Applied: map[string]string{"foo/v1/ConfigMap/default/foo": "abc"}}
+	if err := s.PutResumeState(cluster, state); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteResumeState(cluster); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := s.GetResumeState(cluster); err != nil || found {
+		t.Errorf("Expected resume state to be deleted from both stores, got found=%v, err=%v", found, err)
+	}
+}
+
+func TestBrokenMirror(t *testing.T) {
+	primary := kubestore.New(fake.NewSimpleClientset(), "default")
+	s := New(primary, brokenStore{})
+
+	rollout(t, s, "foo")
+	live, found, err := s.GetLive(cluster)
+	if err != nil || !found {
+		t.Fatalf("Expected live rollout, got found=%v, err=%v", found, err)
+	}
+	if d := cmp.Diff([]string{"foo"}, addonNames(live)); d != "" {
+		t.Errorf("Unexpected addons of live rollout (-want +got):\n%s", d)
+	}
+
+	state := &store.ResumeState{Applied: map[string]string{"k": "v"}}
+	if err := s.PutResumeState(cluster, state); err != nil {
+		t.Errorf("Expected mirror failure to be ignored, got: %v", err)
+	}
+	if err := s.DeleteResumeState(cluster); err != nil {
+		t.Errorf("Expected mirror failure to be ignored, got: %v", err)
+	}
+}
+
+func TestBrokenPrimary(t *testing.T) {
+	mirror := kubestore.New(fake.NewSimpleClientset(), "default")
+	rollout(t, mirror, "foo")
+	s := New(brokenStore{}, mirror)
+
+	if _, err := s.CreateRollout(cluster); err != errBroken {
+		t.Errorf("Expected primary failure, got: %v", err)
+	}
+	if err := s.PutResumeState(cluster, &store.ResumeState{}); err != errBroken {
+		t.Errorf("Expected primary failure, got: %v", err)
+	}
+
+	// Reads fall back to mirror.
+	live, found, err := s.GetLive(cluster)
+	if err != nil || !found {
+		t.Fatalf("Expected live rollout from mirror store, got found=%v, err=%v", found, err)
+	}
+	if d := cmp.Diff([]string{"foo"}, addonNames(live)); d != "" {
+		t.Errorf("Unexpected addons of live rollout (-want +got):\n%s", d)
+	}
+	revs, err := s.History(cluster, "foo")
+	if err != nil || len(revs) != 1 || revs[0].Rollout != live.ID {
+		t.Errorf("Expected live revision from mirror store, got %v: %v", revs, err)
+	}
+
+	// Primary error is returned if both fail.
+	s = New(brokenStore{}, brokenStore{})
+	if _, _, err := s.GetLive(cluster); err != errBroken {
+		t.Errorf("Expected primary failure, got: %v", err)
+	}
+	if _, err := s.History(cluster, "foo"); err == nil {
+		t.Error("Expected failure getting history from stores that don't keep it")
+	}
+}
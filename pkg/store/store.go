@@ -16,6 +16,8 @@
 // of the addon rollouts.
 package store
 
+import "time"
+
 // RunID is id of an addon run.
 type RunID string
 
@@ -30,11 +32,42 @@ type AddonRun struct {
 	// Data is opaque data passed in by addon during execution.
 	Data map[string][]byte
 
-	// ObjRefs is a slice of object references (could be external to
-	// Kubernetes objects) that were part of this run.
-	// TODO(dmitry-ilyevskiy): Make this into proper interface definition
-	// once the scope of operations is a little bit more defined.
-	ObjRefs []interface{}
+	// SecretVersions maps paths of secrets (e.g in Vault) read by the addon
+	// to their versions at the time of the run.
+	SecretVersions map[string]string
+
+	// Leases are IDs of leases of dynamic secrets (e.g in Vault) opened by
+	// the addon during the run.
+	Leases []string
+
+	// ObjRefs is a slice of references to Kubernetes objects applied by the
+	// addon during the run (in the order they were applied).
+	ObjRefs []ObjRef
+
+	// AppliedAt is when the run completed and AppliedBy who ran it (e.g
+	// user@host). Both are unset for runs recorded before they were tracked.
+	AppliedAt time.Time
+	AppliedBy string
+
+	// Source is the git revision of the entry file the run was made from
+	// (e.g `3f2c1ab (main, dirty)'), unset if it's not in a git repo.
+	Source string
+}
+
+// ObjRef identifies a Kubernetes object.
+type ObjRef struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Namespace  string `yaml:"namespace,omitempty"`
+	Name       string `yaml:"name"`
+}
+
+// ResumeState records progress of a rollout that has not completed (yet) so
+// that a subsequent run can resume it.
+type ResumeState struct {
+	// Applied maps keys of objects applied so far (identifying the addon
+	// and the object) to digests of their applied content.
+	Applied map[string]string
 }
 
 // RolloutID is a unique rollout ID string.
@@ -49,22 +82,106 @@ type Rollout struct {
 	Live   bool
 }
 
-// Store defines a rollout store interface.
+// Store defines a rollout store interface. Rollouts of each cluster are kept
+// apart by a cluster identifier (e.g its API server address) so that many
+// clusters may share a store. Empty cluster identifies the only cluster of a
+// store.
 type Store interface {
 	// CreateRollout initializes and returns a new *Rollout object with
-	// defaults and new RolloutID (committed to the store).
-	CreateRollout() (*Rollout, error)
+	// defaults and new RolloutID (committed to the store) for cluster.
+	CreateRollout(cluster string) (*Rollout, error)
+
+	// PutAddonRun records addon rollout for run id of cluster.
+	PutAddonRun(cluster string, id RolloutID, addon *AddonRun) (RunID, error)
+
+	// CompleteRollout marks rollout run as complete (sets it as "live" for
+	// cluster). All further PutAddonRun operations will fail.
+	CompleteRollout(cluster string, id RolloutID) error
+
+	// GetLive returns a single "live" rollout of cluster, if found.
+	GetLive(cluster string) (r *Rollout, found bool, err error)
+
+	// GetRollout returns past or live rollout of cluster by id.
+	GetRollout(cluster string, id RolloutID) (r *Rollout, found bool, err error)
 
-	// PutAddonRun records addon rollout for run id.
-	PutAddonRun(id RolloutID, addon *AddonRun) (RunID, error)
+	// PutResumeState records progress of the incomplete rollout of cluster
+	// (replacing previously recorded one).
+	PutResumeState(cluster string, s *ResumeState) error
 
-	// CompleteRollout marks rollout run as complete (sets it as "live").
-	// All further PutAddonRun operations will fail.
-	CompleteRollout(id RolloutID) error
+	// GetResumeState returns progress of the incomplete rollout of cluster,
+	// if found.
+	GetResumeState(cluster string) (s *ResumeState, found bool, err error)
 
-	// GetLive returns a single "live" rollout, if found.
-	GetLive() (r *Rollout, found bool, err error)
+	// DeleteResumeState deletes progress recorded for cluster (if any).
+	DeleteResumeState(cluster string) error
+}
+
+// EntryKind is a kind of an entry kept by a store.
+type EntryKind string
+
+const (
+	// RolloutEntry records a rollout (see Store.CreateRollout).
+	RolloutEntry EntryKind = "rollout"
+	// AddonRunEntry records an addon run of a rollout (see Store.PutAddonRun).
+	AddonRunEntry EntryKind = "addon run"
+	// LiveEntry marks a rollout as "live" (see Store.CompleteRollout).
+	LiveEntry EntryKind = "live"
+	// ResumeEntry records progress of an incomplete rollout (see
+	// Store.PutResumeState).
+	ResumeEntry EntryKind = "resume state"
+)
+
+// Entry describes a single entry kept by a store.
+type Entry struct {
+	// ID identifies the entry within the store.
+	ID   string
+	Kind EntryKind
+	// Cluster the entry belongs to. Only meaningful if ClusterKnown is set
+	// (it isn't for entries recorded before clusters were kept apart).
+	Cluster      string
+	ClusterKnown bool
+	// Addon is the name of the addon of an AddonRunEntry.
+	Addon string
+	// Rollout is the rollout an AddonRunEntry belongs to or a LiveEntry
+	// marks as "live".
+	Rollout RolloutID
+}
+
+// Collector is implemented by stores whose entries can be listed and deleted
+// (e.g to garbage collect stale ones, see Stale).
+type Collector interface {
+	// Entries lists all entries kept by the store.
+	Entries() ([]Entry, error)
+
+	// DeleteEntry deletes entry by its Entry.ID.
+	DeleteEntry(id string) error
+}
+
+// Revision summarizes a past (or live) run of an addon.
+type Revision struct {
+	// Rollout and Run identify the run.
+	Rollout RolloutID
+	Run     RunID
+	// AppliedAt, AppliedBy and Source are as in AddonRun.
+	AppliedAt time.Time
+	AppliedBy string
+	Source    string
+	// Objects is the number of objects applied by the run.
+	Objects int
+	// Live is set if Rollout is the live rollout of the cluster.
+	Live bool
+}
+
+// Historian is implemented by stores that can list past runs of an addon
+// (e.g to render a deploy timeline).
+type Historian interface {
+	// History returns revisions of addon recorded for cluster ordered oldest
+	// first.
+	History(cluster, addon string) ([]Revision, error)
+}
 
-	// GetRollout returns past or live rollout by id.
-	GetRollout(id RolloutID) (r *Rollout, found bool, err error)
+// Multi is implemented by stores backed by several other stores.
+type Multi interface {
+	// Stores returns the backing stores.
+	Stores() []Store
 }
@@ -0,0 +1,166 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Duration is a Starlark value of a time duration (e.g of a timeout or a
+// probe period). Durations can be compared, added and subtracted, and scaled
+// by numbers. str() of a duration is its normalized Go (and Kubernetes)
+// representation, e.g "1m30s".
+type Duration time.Duration
+
+var (
+	_ starlark.Comparable = Duration(0)
+	_ starlark.HasBinary  = Duration(0)
+	_ starlark.HasUnary   = Duration(0)
+	_ starlark.HasAttrs   = Duration(0)
+)
+
+// durationFn is a built-in that parses a duration string (e.g "30s" or
+// "1h15m").
+// Usage:
+//
+//	timeout = duration("30s") * 2
+//	print(timeout)           # "1m0s"
+//	print(timeout.seconds)   # 60.0
+func durationFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var v starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &v); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+
+	switch v := v.(type) {
+	case Duration:
+		return v, nil
+	case starlark.String:
+		d, err := time.ParseDuration(string(v))
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: invalid duration `%s' (must be e.g \"30s\" or \"1h15m\")", b.Name(), string(v))
+		}
+		return Duration(d), nil
+	default:
+		return nil, fmt.Errorf("<%v>: expected string, got %s", b.Name(), v.Type())
+	}
+}
+
+// String implements starlark.Value.String.
+func (d Duration) String() string { return time.Duration(d).String() }
+
+// Type implements starlark.Value.Type.
+func (d Duration) Type() string { return "duration" }
+
+// Freeze implements starlark.Value.Freeze.
+func (d Duration) Freeze() {}
+
+// Truth implements starlark.Value.Truth. Zero duration is false.
+func (d Duration) Truth() starlark.Bool { return d != 0 }
+
+// Hash implements starlark.Value.Hash.
+func (d Duration) Hash() (uint32, error) { return starlark.MakeInt64(int64(d)).Hash() }
+
+// CompareSameType implements starlark.Comparable.
+func (d Duration) CompareSameType(op syntax.Token, y starlark.Value, depth int) (bool, error) {
+	return starlark.MakeInt64(int64(d)).CompareSameType(op, starlark.MakeInt64(int64(y.(Duration))), depth)
+}
+
+// Attr implements starlark.HasAttrs.Attr.
+func (d Duration) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "seconds":
+		return starlark.Float(time.Duration(d).Seconds()), nil
+	case "milliseconds":
+		return starlark.MakeInt64(int64(time.Duration(d) / time.Millisecond)), nil
+	}
+	return nil, nil
+}
+
+// AttrNames implements starlark.HasAttrs.AttrNames.
+func (d Duration) AttrNames() []string { return []string{"milliseconds", "seconds"} }
+
+// Unary implements starlark.HasUnary.
+func (d Duration) Unary(op syntax.Token) (starlark.Value, error) {
+	switch op {
+	case syntax.MINUS:
+		return -d, nil
+	case syntax.PLUS:
+		return d, nil
+	}
+	return nil, nil
+}
+
+// Binary implements starlark.HasBinary. Supports duration +/- duration,
+// duration * number, number * duration, duration / (or //) number and
+// duration / duration (a float ratio).
+func (d Duration) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	if yd, ok := y.(Duration); ok {
+		x, y := d, yd
+		if side == starlark.Right {
+			x, y = y, x
+		}
+		switch op {
+		case syntax.PLUS:
+			return x + y, nil
+		case syntax.MINUS:
+			return x - y, nil
+		case syntax.SLASH:
+			if y == 0 {
+				return nil, fmt.Errorf("duration division by zero")
+			}
+			return starlark.Float(float64(x) / float64(y)), nil
+		}
+		return nil, nil
+	}
+
+	f, ok := asFloat(y)
+	if !ok {
+		return nil, nil
+	}
+	switch {
+	case op == syntax.STAR:
+		return scaleDuration(float64(d) * f)
+	case (op == syntax.SLASH || op == syntax.SLASHSLASH) && side == starlark.Left:
+		if f == 0 {
+			return nil, fmt.Errorf("duration division by zero")
+		}
+		return scaleDuration(float64(d) / f)
+	}
+	return nil, nil
+}
+
+func scaleDuration(ns float64) (starlark.Value, error) {
+	if math.IsNaN(ns) || ns > math.MaxInt64 || ns < math.MinInt64 {
+		return nil, fmt.Errorf("duration out of range")
+	}
+	return Duration(math.Round(ns)), nil
+}
+
+// asFloat returns v as float64 if it's a Starlark number.
+func asFloat(v starlark.Value) (float64, bool) {
+	switch v := v.(type) {
+	case starlark.Int:
+		return float64(v.Float()), true
+	case starlark.Float:
+		return float64(v), true
+	}
+	return 0, false
+}
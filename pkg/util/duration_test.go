@@ -0,0 +1,68 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestDuration(t *testing.T) {
+	resolve.AllowFloat = true
+	pkgs := starlark.StringDict{"duration": starlark.NewBuiltin("duration", durationFn)}
+
+	for _, tc := range []struct {
+		expr    string
+		want    string
+		wantErr bool
+	}{
+		{expr: `duration("90s")`, want: "1m30s"},
+		{expr: `duration("1h") + duration("15m")`, want: "1h15m0s"},
+		{expr: `duration("1h") - duration("2h")`, want: "-1h0m0s"},
+		{expr: `-duration("1s")`, want: "-1s"},
+		{expr: `duration("30s") * 2`, want: "1m0s"},
+		{expr: `1.5 * duration("1m")`, want: "1m30s"},
+		{expr: `duration("1m") / 4`, want: "15s"},
+		{expr: `duration("1m") // 4`, want: "15s"},
+		{expr: `duration("1m") / duration("20s")`, want: "3"},
+		{expr: `duration("1m30s").seconds`, want: "90"},
+		{expr: `duration("1s").milliseconds`, want: "1000"},
+		{expr: `duration("60s") == duration("1m")`, want: "True"},
+		{expr: `duration("59s") < duration("1m")`, want: "True"},
+		{expr: `str(duration("2m"))`, want: `"2m0s"`},
+		{expr: `{duration("1m"): 1}[duration("60s")]`, want: "1"},
+		{expr: `duration("1m") / 0`, wantErr: true},
+		{expr: `duration("1m") + 1`, wantErr: true},
+		{expr: `duration("5 minutes")`, wantErr: true},
+		{expr: `duration(5)`, wantErr: true},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			v, _, err := util.Eval("duration", tc.expr, nil, pkgs)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if got := v.String(); got != tc.want {
+				t.Errorf("Unexpected value.\nWant: %s\nGot:  %s", tc.want, got)
+			}
+		})
+	}
+}
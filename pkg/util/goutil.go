@@ -16,6 +16,8 @@ package util
 
 import (
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
 )
 
@@ -35,3 +37,62 @@ func ParseCommaSeparatedParams(params string) (map[string]string, error) {
 	}
 	return parsed, nil
 }
+
+// ReadParamFiles replaces values of params in the form of "@path" with
+// contents of the file at path. Paths with a double slash prefix are
+// relative to baseDir, other relative paths to the working directory. A
+// value starting with "@@" is kept as is with the first "@" removed.
+func ReadParamFiles(params map[string]string, baseDir string) error {
+	for k, v := range params {
+		if !strings.HasPrefix(v, "@") {
+			continue
+		}
+		if strings.HasPrefix(v, "@@") {
+			params[k] = v[1:]
+			continue
+		}
+
+		path := v[1:]
+		if strings.HasPrefix(path, "//") {
+			path = filepath.Join(baseDir, strings.TrimPrefix(path, "//"))
+		}
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read value of `%s': %v", k, err)
+		}
+		params[k] = string(bs)
+	}
+	return nil
+}
+
+// Backends identified by distinct User-Agent strings.
+const (
+	GKEBackend      = "gke"
+	KubeBackend     = "kube"
+	VaultBackend    = "vault"
+	RegistryBackend = "registry"
+)
+
+// UserAgent builds User-Agent strings that identify Isopod distinctly to
+// each of the backends it talks to.
+type UserAgent struct {
+	// Product is the product token, e.g "Isopod/v1.0.0".
+	Product string
+	// Command is the Isopod command being run, e.g "install". Optional.
+	Command string
+}
+
+// For returns the User-Agent string for backend, e.g
+// "Isopod/v1.0.0 (vault; install)".
+func (ua UserAgent) For(backend string) string {
+	var comments []string
+	for _, c := range []string{backend, ua.Command} {
+		if c != "" {
+			comments = append(comments, c)
+		}
+	}
+	if len(comments) == 0 {
+		return ua.Product
+	}
+	return fmt.Sprintf("%s (%s)", ua.Product, strings.Join(comments, "; "))
+}
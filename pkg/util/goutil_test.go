@@ -16,6 +16,9 @@ package util
 
 import (
 	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -59,3 +62,96 @@ func TestParseCommaSeparatedParams(t *testing.T) {
 		})
 	}
 }
+
+func TestUserAgent(t *testing.T) {
+	for _, tc := range []struct {
+		name, backend string
+		ua            UserAgent
+		expected      string
+	}{
+		{
+			name:     "product only",
+			ua:       UserAgent{Product: "Isopod/v1"},
+			expected: "Isopod/v1",
+		},
+		{
+			name:     "no command",
+			backend:  VaultBackend,
+			ua:       UserAgent{Product: "Isopod/v1"},
+			expected: "Isopod/v1 (vault)",
+		},
+		{
+			name:     "backend and command",
+			backend:  GKEBackend,
+			ua:       UserAgent{Product: "Isopod/v1", Command: "install"},
+			expected: "Isopod/v1 (gke; install)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.ua.For(tc.backend); got != tc.expected {
+				t.Errorf("Expect\n%v\nGot\n%v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestReadParamFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "params")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pem := "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.pem"), []byte(pem), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		params   map[string]string
+		expected map[string]string
+		wantErr  bool
+	}{
+		{
+			name:     "plain values",
+			params:   map[string]string{"foo": "bar"},
+			expected: map[string]string{"foo": "bar"},
+		},
+		{
+			name:     "absolute path",
+			params:   map[string]string{"ca": "@" + filepath.Join(dir, "ca.pem"), "foo": "bar"},
+			expected: map[string]string{"ca": pem, "foo": "bar"},
+		},
+		{
+			name:     "double slash path",
+			params:   map[string]string{"ca": "@//ca.pem"},
+			expected: map[string]string{"ca": pem},
+		},
+		{
+			name:     "escaped",
+			params:   map[string]string{"handle": "@@isopod"},
+			expected: map[string]string{"handle": "@isopod"},
+		},
+		{
+			name:    "missing file",
+			params:  map[string]string{"ca": "@//missing.pem"},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ReadParamFiles(tc.params, dir)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.params, tc.expected) {
+				t.Errorf("Expect\n%v\nGot\n%v", tc.expected, tc.params)
+			}
+		})
+	}
+}
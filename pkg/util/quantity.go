@@ -0,0 +1,213 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+	"gopkg.in/inf.v0"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Quantity is a Starlark value of a Kubernetes resource quantity (e.g
+// "500m" CPU or "1Gi" of memory). Quantities can be compared, added and
+// subtracted, and scaled by numbers. str() of a quantity is its canonical
+// Kubernetes representation.
+type Quantity struct {
+	q resource.Quantity
+}
+
+var (
+	_ starlark.Comparable = (*Quantity)(nil)
+	_ starlark.HasBinary  = (*Quantity)(nil)
+	_ starlark.HasUnary   = (*Quantity)(nil)
+	_ starlark.HasAttrs   = (*Quantity)(nil)
+)
+
+// NewQuantity returns a Starlark value of q.
+func NewQuantity(q resource.Quantity) *Quantity {
+	return &Quantity{q: q}
+}
+
+// Quantity returns underlying Kubernetes resource quantity.
+func (q *Quantity) Quantity() resource.Quantity { return q.q.DeepCopy() }
+
+// quantityFn is a built-in that parses a Kubernetes resource quantity string
+// (e.g "250m" or "2Gi").
+// Usage:
+//
+//	mem = quantity("512Mi") * 3
+//	print(mem)                                 # "1536Mi"
+//	print(quantity("1") > quantity("500m"))    # True
+func quantityFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var v starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &v); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+
+	switch v := v.(type) {
+	case *Quantity:
+		return v, nil
+	case starlark.String:
+		q, err := resource.ParseQuantity(string(v))
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: invalid quantity `%s' (must be e.g \"250m\" or \"2Gi\")", b.Name(), string(v))
+		}
+		return NewQuantity(q), nil
+	case starlark.Int, starlark.Float:
+		f, _ := asFloat(v)
+		q, err := scaleQuantity(resource.MustParse("1"), f, false)
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+		}
+		return q, nil
+	default:
+		return nil, fmt.Errorf("<%v>: expected string or number, got %s", b.Name(), v.Type())
+	}
+}
+
+// String implements starlark.Value.String.
+func (q *Quantity) String() string { return q.q.String() }
+
+// Type implements starlark.Value.Type.
+func (q *Quantity) Type() string { return "quantity" }
+
+// Freeze implements starlark.Value.Freeze. Quantities are immutable.
+func (q *Quantity) Freeze() {}
+
+// Truth implements starlark.Value.Truth. Zero quantity is false.
+func (q *Quantity) Truth() starlark.Bool { return starlark.Bool(!q.q.IsZero()) }
+
+// Hash implements starlark.Value.Hash. Equal quantities (e.g "1Ki" and
+// "1024") hash the same.
+func (q *Quantity) Hash() (uint32, error) {
+	return starlark.String(q.q.AsDec().String()).Hash()
+}
+
+// CompareSameType implements starlark.Comparable.
+func (q *Quantity) CompareSameType(op syntax.Token, y starlark.Value, depth int) (bool, error) {
+	yq := y.(*Quantity).q
+	cmp := q.q.Cmp(yq)
+	switch op {
+	case syntax.EQL:
+		return cmp == 0, nil
+	case syntax.NEQ:
+		return cmp != 0, nil
+	case syntax.LE:
+		return cmp <= 0, nil
+	case syntax.LT:
+		return cmp < 0, nil
+	case syntax.GE:
+		return cmp >= 0, nil
+	case syntax.GT:
+		return cmp > 0, nil
+	}
+	return false, fmt.Errorf("%s %s %s not implemented", q.Type(), op, y.Type())
+}
+
+// Attr implements starlark.HasAttrs.Attr.
+func (q *Quantity) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "value":
+		return starlark.MakeInt64(q.q.Value()), nil
+	case "milli_value":
+		return starlark.MakeInt64(q.q.MilliValue()), nil
+	}
+	return nil, nil
+}
+
+// AttrNames implements starlark.HasAttrs.AttrNames.
+func (q *Quantity) AttrNames() []string { return []string{"milli_value", "value"} }
+
+// Unary implements starlark.HasUnary.
+func (q *Quantity) Unary(op syntax.Token) (starlark.Value, error) {
+	switch op {
+	case syntax.MINUS:
+		r := q.q.DeepCopy()
+		r.Neg()
+		return NewQuantity(r), nil
+	case syntax.PLUS:
+		return q, nil
+	}
+	return nil, nil
+}
+
+// Binary implements starlark.HasBinary. Supports quantity +/- quantity,
+// quantity * number, number * quantity and quantity / (or //) number.
+func (q *Quantity) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	if yq, ok := y.(*Quantity); ok {
+		x, y := q.q.DeepCopy(), yq.q
+		if side == starlark.Right {
+			x, y = y.DeepCopy(), q.q
+		}
+		switch op {
+		case syntax.PLUS:
+			x.Add(y)
+			return NewQuantity(x), nil
+		case syntax.MINUS:
+			x.Sub(y)
+			return NewQuantity(x), nil
+		}
+		return nil, nil
+	}
+
+	f, ok := asFloat(y)
+	if !ok {
+		return nil, nil
+	}
+	switch {
+	case op == syntax.STAR:
+		return scaleQuantity(q.q, f, false)
+	case (op == syntax.SLASH || op == syntax.SLASHSLASH) && side == starlark.Left:
+		if f == 0 {
+			return nil, fmt.Errorf("quantity division by zero")
+		}
+		return scaleQuantity(q.q, f, true)
+	}
+	return nil, nil
+}
+
+// quantityScale is the precision of scaled quantities (Kubernetes doesn't
+// allow quantities smaller than 1m).
+const quantityScale = inf.Scale(3)
+
+// scaleQuantity returns q multiplied (or divided if div is set) by f keeping
+// the format of q. The result is rounded up to the smallest unit.
+func scaleQuantity(q resource.Quantity, f float64, div bool) (*Quantity, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("can not scale quantity by %v", f)
+	}
+	fd, ok := new(inf.Dec).SetString(strconv.FormatFloat(f, 'f', -1, 64))
+	if !ok {
+		return nil, fmt.Errorf("can not scale quantity by %v", f)
+	}
+
+	d := new(inf.Dec)
+	if div {
+		d.QuoRound(q.AsDec(), fd, quantityScale, inf.RoundUp)
+	} else {
+		d.Round(d.Mul(q.AsDec(), fd), quantityScale, inf.RoundUp)
+	}
+	r, err := resource.ParseQuantity(d.String())
+	if err != nil {
+		return nil, err
+	}
+	r.Format = q.Format
+	return NewQuantity(r), nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestQuantity(t *testing.T) {
+	resolve.AllowFloat = true
+	pkgs := starlark.StringDict{"quantity": starlark.NewBuiltin("quantity", quantityFn)}
+
+	for _, tc := range []struct {
+		expr    string
+		want    string
+		wantErr bool
+	}{
+		{expr: `quantity("250m")`, want: "250m"},
+		{expr: `quantity("1024Mi")`, want: "1Gi"},
+		{expr: `quantity(2)`, want: "2"},
+		{expr: `quantity(0.5)`, want: "500m"},
+		{expr: `quantity("1") + quantity("500m")`, want: "1500m"},
+		{expr: `quantity("1Gi") - quantity("512Mi")`, want: "512Mi"},
+		{expr: `-quantity("1")`, want: "-1"},
+		{expr: `quantity("512Mi") * 3`, want: "1536Mi"},
+		{expr: `1.5 * quantity("2Gi")`, want: "3Gi"},
+		{expr: `quantity("1") / 3`, want: "334m"},
+		{expr: `quantity("1Gi") / 2`, want: "512Mi"},
+		{expr: `quantity("2Gi").value`, want: "2147483648"},
+		{expr: `quantity("1.5").milli_value`, want: "1500"},
+		{expr: `quantity("1Ki") == quantity("1024")`, want: "True"},
+		{expr: `quantity("500m") < quantity("1")`, want: "True"},
+		{expr: `str(quantity("100M"))`, want: `"100M"`},
+		{expr: `quantity("1") / 0`, wantErr: true},
+		{expr: `quantity("1") + 1`, wantErr: true},
+		{expr: `quantity("1 GB")`, wantErr: true},
+		{expr: `quantity([])`, wantErr: true},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			v, _, err := util.Eval("quantity", tc.expr, nil, pkgs)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if got := v.String(); got != tc.want {
+				t.Errorf("Unexpected value.\nWant: %s\nGot:  %s", tc.want, got)
+			}
+		})
+	}
+}
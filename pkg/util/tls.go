@@ -0,0 +1,133 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// DefaultTLSMinVersion is the minimum TLS version of TLSPolicy by default.
+const DefaultTLSMinVersion = "1.2"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSPolicy constrains TLS of the clients of Kubernetes and cloud APIs (e.g
+// for FIPS compliance).
+type TLSPolicy struct {
+	// MinVersion is the minimum TLS version negotiated.
+	MinVersion uint16
+	// CipherSuites are the TLS 1.0-1.2 cipher suites allowed (Go's secure
+	// defaults if empty). TLS 1.3 cipher suites are not configurable.
+	CipherSuites []uint16
+}
+
+// ParseTLSPolicy parses minimum TLS version (e.g "1.2") and comma separated
+// list of cipher suites (by their Go names, e.g
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"). Insecure cipher suites and
+// suites that can't be negotiated with minVersion are rejected.
+func ParseTLSPolicy(minVersion, cipherSuites string) (*TLSPolicy, error) {
+	v, ok := tlsVersions[minVersion]
+	if !ok {
+		var vs []string
+		for k := range tlsVersions {
+			vs = append(vs, k)
+		}
+		sort.Strings(vs)
+		return nil, fmt.Errorf("unknown TLS version `%s' (expected one of %s)", minVersion, strings.Join(vs, ", "))
+	}
+	p := &TLSPolicy{MinVersion: v}
+	if cipherSuites == "" {
+		return p, nil
+	}
+	if v == tls.VersionTLS13 {
+		return nil, fmt.Errorf("cipher suites can't be combined with minimum TLS version %s (TLS 1.3 cipher suites are not configurable)", minVersion)
+	}
+
+	suites := map[string]*tls.CipherSuite{}
+	for _, s := range tls.CipherSuites() {
+		suites[s.Name] = s
+	}
+	insecure := map[string]bool{}
+	for _, s := range tls.InsecureCipherSuites() {
+		insecure[s.Name] = true
+	}
+	for _, name := range strings.Split(cipherSuites, ",") {
+		name = strings.TrimSpace(name)
+		if insecure[name] {
+			return nil, fmt.Errorf("cipher suite `%s' is insecure", name)
+		}
+		s, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite `%s'", name)
+		}
+		var supported, tls12 bool
+		for _, sv := range s.SupportedVersions {
+			if sv >= v {
+				supported = true
+			}
+			if sv <= tls.VersionTLS12 {
+				tls12 = true
+			}
+		}
+		if !tls12 {
+			return nil, fmt.Errorf("cipher suite `%s' is a TLS 1.3 suite (these are not configurable)", name)
+		}
+		if !supported {
+			return nil, fmt.Errorf("cipher suite `%s' can't be used with minimum TLS version %s", name, minVersion)
+		}
+		p.CipherSuites = append(p.CipherSuites, s.ID)
+	}
+	return p, nil
+}
+
+// Apply constrains c (if p is set).
+func (p *TLSPolicy) Apply(c *tls.Config) {
+	if p == nil {
+		return
+	}
+	c.MinVersion = p.MinVersion
+	c.CipherSuites = p.CipherSuites
+}
+
+// WrapTransport returns a copy of rt constrained by p if it is an
+// *http.Transport (rt as-is otherwise or if p is not set). Suitable for
+// rest.Config.WrapTransport as the innermost wrapper.
+func (p *TLSPolicy) WrapTransport(rt http.RoundTripper) http.RoundTripper {
+	t, ok := rt.(*http.Transport)
+	if p == nil || !ok {
+		return rt
+	}
+	t = t.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	p.Apply(t.TLSClientConfig)
+	return t
+}
+
+// Transport returns a copy of http.DefaultTransport constrained by p
+// (http.DefaultTransport itself if p is not set).
+func (p *TLSPolicy) Transport() *http.Transport {
+	return p.WrapTransport(http.DefaultTransport).(*http.Transport)
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseTLSPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name, minVersion, cipherSuites string
+		want                           *TLSPolicy
+		wantErr                        string
+	}{
+		{
+			name:       "Default",
+			minVersion: DefaultTLSMinVersion,
+			want:       &TLSPolicy{MinVersion: tls.VersionTLS12},
+		},
+		{
+			name:         "Cipher suites",
+			minVersion:   "1.2",
+			cipherSuites: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			want: &TLSPolicy{
+				MinVersion:   tls.VersionTLS12,
+				CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+			},
+		},
+		{
+			name:       "Unknown version",
+			minVersion: "1.4",
+			wantErr:    "unknown TLS version `1.4' (expected one of 1.0, 1.1, 1.2, 1.3)",
+		},
+		{
+			name:         "Unknown cipher suite",
+			minVersion:   "1.2",
+			cipherSuites: "TLS_FOO",
+			wantErr:      "unknown cipher suite `TLS_FOO'",
+		},
+		{
+			name:         "Insecure cipher suite",
+			minVersion:   "1.2",
+			cipherSuites: "TLS_RSA_WITH_RC4_128_SHA",
+			wantErr:      "cipher suite `TLS_RSA_WITH_RC4_128_SHA' is insecure",
+		},
+		{
+			name:         "Cipher suites with TLS 1.3",
+			minVersion:   "1.3",
+			cipherSuites: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			wantErr:      "cipher suites can't be combined with minimum TLS version 1.3 (TLS 1.3 cipher suites are not configurable)",
+		},
+		{
+			name:         "TLS 1.3 cipher suite",
+			minVersion:   "1.2",
+			cipherSuites: "TLS_AES_128_GCM_SHA256",
+			wantErr:      "cipher suite `TLS_AES_128_GCM_SHA256' is a TLS 1.3 suite (these are not configurable)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseTLSPolicy(tc.minVersion, tc.cipherSuites)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("Unexpected policy (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestTLSPolicyWrapTransport(t *testing.T) {
+	p := &TLSPolicy{MinVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}}
+	base := &http.Transport{TLSClientConfig: &tls.Config{ServerName: "kube"}}
+
+	got, ok := p.WrapTransport(base).(*http.Transport)
+	if !ok || got == base {
+		t.Fatalf("Expected a copy of the base transport, got: %v", got)
+	}
+	if c := got.TLSClientConfig; c.MinVersion != tls.VersionTLS12 || len(c.CipherSuites) != 1 || c.ServerName != "kube" {
+		t.Errorf("Unexpected TLS config: %+v", c)
+	}
+	if base.TLSClientConfig.MinVersion != 0 {
+		t.Error("Expected base transport to be left untouched")
+	}
+
+	var nilPolicy *TLSPolicy
+	if rt := nilPolicy.WrapTransport(base); rt != base {
+		t.Error("Expected unset policy to keep transport as-is")
+	}
+}
@@ -41,12 +41,17 @@ var (
 //   * uuid - UUID generate operations (RFC 4122).
 //   * http - HTTP calls.
 //   * struct - Starlark struct with to_json() support.
+//   * duration - parses Go duration strings into comparable, scalable values.
+//   * quantity - parses Kubernetes resource quantities into comparable,
+//     scalable values.
 func Predeclared() starlark.StringDict {
 	return starlark.StringDict{
-		"base64": NewBase64Module(),
-		"uuid":   NewUUIDModule(),
-		"http":   NewHTTPModule(),
-		"struct": starlark.NewBuiltin("struct", StructFn),
+		"base64":   NewBase64Module(),
+		"uuid":     NewUUIDModule(),
+		"http":     NewHTTPModule(),
+		"struct":   starlark.NewBuiltin("struct", StructFn),
+		"duration": starlark.NewBuiltin("duration", durationFn),
+		"quantity": starlark.NewBuiltin("quantity", quantityFn),
 	}
 }
 
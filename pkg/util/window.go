@@ -0,0 +1,147 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a recurring time window, e.g "Mon-Fri 09:00-17:00
+// America/Los_Angeles".
+type Window struct {
+	spec string
+	// days the window opens on. All days if empty.
+	days map[time.Weekday]bool
+	// start and end are offsets from midnight. Window spans midnight if end
+	// is not after start.
+	start, end time.Duration
+	loc        *time.Location
+}
+
+// ParseWindow parses window in the "[DAYS] HH:MM-HH:MM [TIMEZONE]" format.
+// DAYS is a comma-separated list of days (e.g "Mon,Wed") or day ranges
+// (e.g "Mon-Fri"). TIMEZONE is an IANA time zone name and defaults to UTC.
+// If the end time is not after the start time the window spans midnight and
+// DAYS refer to the day the window opens.
+func ParseWindow(spec string) (*Window, error) {
+	w := &Window{spec: spec, loc: time.UTC}
+
+	fields := strings.Fields(spec)
+	hours := -1
+	for i, f := range fields {
+		if strings.Contains(f, ":") {
+			hours = i
+			break
+		}
+	}
+	if hours == -1 || hours > 1 || len(fields) > hours+2 {
+		return nil, fmt.Errorf("invalid window `%s': must be in `[DAYS] HH:MM-HH:MM [TIMEZONE]' format", spec)
+	}
+
+	if hours == 1 {
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid window `%s': %v", spec, err)
+		}
+		w.days = days
+	}
+
+	ts := strings.Split(fields[hours], "-")
+	if len(ts) != 2 {
+		return nil, fmt.Errorf("invalid window `%s': expected HH:MM-HH:MM time range, got: %s", spec, fields[hours])
+	}
+	var err error
+	if w.start, err = parseClock(ts[0]); err != nil {
+		return nil, fmt.Errorf("invalid window `%s': %v", spec, err)
+	}
+	if w.end, err = parseClock(ts[1]); err != nil {
+		return nil, fmt.Errorf("invalid window `%s': %v", spec, err)
+	}
+
+	if len(fields) > hours+1 {
+		if w.loc, err = time.LoadLocation(fields[hours+1]); err != nil {
+			return nil, fmt.Errorf("invalid window `%s': %v", spec, err)
+		}
+	}
+	return w, nil
+}
+
+func parseDays(s string) (map[time.Weekday]bool, error) {
+	days := map[time.Weekday]bool{}
+	for _, r := range strings.Split(s, ",") {
+		ds := strings.Split(r, "-")
+		if len(ds) > 2 {
+			return nil, fmt.Errorf("invalid day range: %s", r)
+		}
+		var bounds []time.Weekday
+		for _, d := range ds {
+			wd, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return nil, fmt.Errorf("unknown day `%s' (expected one of Mon, Tue, Wed, Thu, Fri, Sat, Sun)", d)
+			}
+			bounds = append(bounds, wd)
+		}
+		first, last := bounds[0], bounds[len(bounds)-1]
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time `%s' (expected HH:MM)", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains returns true if t falls within w.
+func (w *Window) Contains(t time.Time) bool {
+	t = t.In(w.loc)
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+
+	if w.start < w.end {
+		return w.opensOn(t.Weekday()) && offset >= w.start && offset < w.end
+	}
+	// Window spans midnight: either opened today or yesterday.
+	if offset >= w.start && w.opensOn(t.Weekday()) {
+		return true
+	}
+	return offset < w.end && w.opensOn((t.Weekday()+6)%7)
+}
+
+func (w *Window) opensOn(d time.Weekday) bool {
+	return len(w.days) == 0 || w.days[d]
+}
+
+// String returns the window spec.
+func (w *Window) String() string { return w.spec }
@@ -0,0 +1,112 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	// 2019-09-02 is a Monday.
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2019, time.September, 2+day, hour, min, 0, 0, time.UTC)
+	}
+	pst := time.FixedZone("PST", -8*60*60)
+
+	for _, tc := range []struct {
+		name    string
+		spec    string
+		in, out []time.Time
+		wantErr string
+	}{
+		{
+			name: "Every day",
+			spec: "09:00-17:00",
+			in:   []time.Time{at(0, 9, 0), at(5, 16, 59)},
+			out:  []time.Time{at(0, 8, 59), at(0, 17, 0)},
+		},
+		{
+			name: "Weekdays",
+			spec: "Mon-Fri 09:00-17:00",
+			in:   []time.Time{at(0, 12, 0), at(4, 12, 0)},
+			out:  []time.Time{at(5, 12, 0), at(6, 12, 0)},
+		},
+		{
+			name: "Listed days",
+			spec: "mon,Wed,Fri-Sat 09:00-17:00",
+			in:   []time.Time{at(0, 12, 0), at(2, 12, 0), at(4, 12, 0), at(5, 12, 0)},
+			out:  []time.Time{at(1, 12, 0), at(3, 12, 0), at(6, 12, 0)},
+		},
+		{
+			name: "Spans midnight",
+			spec: "Fri 22:00-02:00",
+			in:   []time.Time{at(4, 22, 0), at(5, 1, 59)},
+			out:  []time.Time{at(4, 21, 59), at(5, 2, 0), at(5, 22, 0), at(4, 1, 0)},
+		},
+		{
+			name: "Time zone",
+			spec: "Mon-Fri 09:00-17:00 America/Los_Angeles",
+			// 09:00 PDT is 16:00 UTC.
+			in:  []time.Time{at(0, 16, 0), at(0, 23, 59), at(1, 20, 0).In(pst)},
+			out: []time.Time{at(0, 15, 59), at(1, 0, 0)},
+		},
+		{
+			name:    "Invalid format",
+			spec:    "Mon-Fri",
+			wantErr: "invalid window `Mon-Fri': must be in `[DAYS] HH:MM-HH:MM [TIMEZONE]' format",
+		},
+		{
+			name:    "Invalid day",
+			spec:    "Mon-Fry 09:00-17:00",
+			wantErr: "invalid window `Mon-Fry 09:00-17:00': unknown day `Fry' (expected one of Mon, Tue, Wed, Thu, Fri, Sat, Sun)",
+		},
+		{
+			name:    "Invalid time",
+			spec:    "09:00-25:00",
+			wantErr: "invalid window `09:00-25:00': invalid time `25:00' (expected HH:MM)",
+		},
+		{
+			name:    "Invalid time zone",
+			spec:    "09:00-17:00 Mars/Olympus",
+			wantErr: "invalid window `09:00-17:00 Mars/Olympus': unknown time zone Mars/Olympus",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w, err := ParseWindow(tc.spec)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if err != nil {
+				return
+			}
+
+			for _, in := range tc.in {
+				if !w.Contains(in) {
+					t.Errorf("Expected %v to be within `%v'", in, w)
+				}
+			}
+			for _, out := range tc.out {
+				if w.Contains(out) {
+					t.Errorf("Expected %v to be outside of `%v'", out, w)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/golang/glog"
+)
+
+// LeaseRevoker is implemented by the vault package to track leases of dynamic
+// secrets (e.g database credentials) read during a run.
+type LeaseRevoker interface {
+	// Leases returns IDs of all leases opened so far and not yet revoked (in
+	// the order they were opened).
+	Leases() []string
+	// RevokeLeases revokes all leases returned by Leases.
+	RevokeLeases(ctx context.Context) error
+}
+
+func (p *vaultPackage) addLease(id string) {
+	p.leasesMu.Lock()
+	defer p.leasesMu.Unlock()
+	p.leases = append(p.leases, id)
+}
+
+// Leases implements LeaseRevoker.
+func (p *vaultPackage) Leases() []string {
+	p.leasesMu.Lock()
+	defer p.leasesMu.Unlock()
+	return append([]string(nil), p.leases...)
+}
+
+// RevokeLeases implements LeaseRevoker. Leases that failed to be revoked are
+// kept (so that revoking can be retried).
+func (p *vaultPackage) RevokeLeases(ctx context.Context) error {
+	p.leasesMu.Lock()
+	defer p.leasesMu.Unlock()
+
+	var failed []string
+	var errs []string
+	for _, id := range p.leases {
+		if err := p.revokeLease(ctx, id); err != nil {
+			failed = append(failed, id)
+			errs = append(errs, fmt.Sprintf("`%s': %v", id, err))
+			continue
+		}
+		log.Infof("Revoked Vault lease `%s'", id)
+	}
+	p.leases = failed
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to revoke leases: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (p *vaultPackage) revokeLease(ctx context.Context, id string) error {
+	r := p.client.NewRequest("PUT", "/v1/sys/leases/revoke")
+	if err := r.SetJSONBody(map[string]interface{}{"lease_id": id}); err != nil {
+		return err
+	}
+
+	resp, err := p.client.RawRequestWithContext(ctx, r)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if err := resp.Error(); err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	return nil
+}
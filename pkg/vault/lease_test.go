@@ -0,0 +1,121 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	util "github.com/cruise-automation/isopod/pkg/testing"
+)
+
+func TestLeases(t *testing.T) {
+	for _, tc := range []struct {
+		desc        string
+		expr        string
+		failRevoke  map[string]bool
+		wantLeases  []string
+		wantRevoked []string
+		wantErr     string
+		wantKept    []string
+	}{
+		{
+			desc:        "Dynamic secrets",
+			expr:        "[vault.read('database/creds/ro'), vault.read('database/creds/rw'), vault.read('secret/static')]",
+			wantLeases:  []string{"database/creds/ro/1", "database/creds/rw/2"},
+			wantRevoked: []string{"database/creds/ro/1", "database/creds/rw/2"},
+		},
+		{
+			desc:        "Revoke failure",
+			expr:        "[vault.read('database/creds/ro'), vault.read('database/creds/rw')]",
+			failRevoke:  map[string]bool{"database/creds/ro/1": true},
+			wantLeases:  []string{"database/creds/ro/1", "database/creds/rw/2"},
+			wantRevoked: []string{"database/creds/rw/2"},
+			wantErr:     "failed to revoke leases: `database/creds/ro/1': request failed:",
+			wantKept:    []string{"database/creds/ro/1"},
+		},
+		{
+			desc: "Static secrets",
+			expr: "vault.read('secret/static')",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			var n int
+			var revoked []string
+			ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/database/creds/"):
+					n++
+					fmt.Fprintf(w, `{"lease_id": "%s/%d", "lease_duration": 3600, "data": {"username": "u%d"}}`, strings.TrimPrefix(r.URL.Path, "/v1/"), n, n)
+				case r.Method == http.MethodGet:
+					fmt.Fprint(w, `{"data": {"foo": "bar"}}`)
+				case r.Method == http.MethodPut && r.URL.Path == "/v1/sys/leases/revoke":
+					var body struct {
+						LeaseID string `json:"lease_id"`
+					}
+					if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+					if tc.failRevoke[body.LeaseID] {
+						http.Error(w, "permission denied", http.StatusForbidden)
+						return
+					}
+					revoked = append(revoked, body.LeaseID)
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					http.Error(w, "unexpected request", http.StatusBadRequest)
+					t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+				}
+			}))
+			defer ts.Close()
+
+			tv, err := NewFakeWithServer(ts, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := util.Eval(t.Name(), tc.expr, nil, starlark.StringDict{"vault": tv}); err != nil {
+				t.Fatal(err)
+			}
+
+			lr := tv.(LeaseRevoker)
+			if d := cmp.Diff(tc.wantLeases, lr.Leases()); d != "" {
+				t.Errorf("Unexpected leases (-want +got):\n%s", d)
+			}
+
+			gotErr := ""
+			if err := lr.RevokeLeases(context.Background()); err != nil {
+				gotErr = err.Error()
+			}
+			if !strings.HasPrefix(gotErr, tc.wantErr) || (tc.wantErr == "" && gotErr != "") {
+				t.Errorf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+			if d := cmp.Diff(tc.wantRevoked, revoked); d != "" {
+				t.Errorf("Unexpected revoked leases (-want +got):\n%s", d)
+			}
+			if d := cmp.Diff(tc.wantKept, lr.Leases()); d != "" {
+				t.Errorf("Unexpected leases after revoke (-want +got):\n%s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+	vault "github.com/hashicorp/vault/api"
+)
+
+// Capabilities needed by built-ins (see
+// https://www.vaultproject.io/docs/concepts/policies.html#capabilities).
+const (
+	capRead   = "read"
+	capCreate = "create"
+	capUpdate = "update"
+)
+
+// MissingCapability is a capability on a Vault path that an addon needs but
+// the token lacks.
+type MissingCapability struct {
+	Addon string
+	Path  string
+	// Capability is what the addon needs, e.g `read' (`create' or `update'
+	// for writes).
+	Capability string
+}
+
+func (m MissingCapability) String() string {
+	return fmt.Sprintf("addon `%s': %s `%s'", m.Addon, m.Capability, m.Path)
+}
+
+// Preflight records capabilities missing on Vault paths referenced by addons
+// evaluated with WithPreflight.
+type Preflight struct {
+	mu      sync.Mutex
+	missing []MissingCapability
+}
+
+// Missing returns capabilities missing so far, ordered by addon and path.
+func (pf *Preflight) Missing() []MissingCapability {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	out := append([]MissingCapability(nil), pf.missing...)
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Addon != out[j].Addon {
+			return out[i].Addon < out[j].Addon
+		}
+		return out[i].Path < out[j].Path
+	})
+	return out
+}
+
+func (pf *Preflight) add(m MissingCapability) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	for _, o := range pf.missing {
+		if o == m {
+			return
+		}
+	}
+	pf.missing = append(pf.missing, m)
+}
+
+type preflightKey struct{}
+
+// preflightRun is the Preflight of the addon being evaluated.
+type preflightRun struct {
+	pf        *Preflight
+	addonName string
+}
+
+// WithPreflight returns a copy of ctx that makes built-ins (and ReadSecret)
+// check capabilities of the token on each path they are called with by
+// addonName (with sys/capabilities-self) and record those missing in pf.
+// Reads of paths that can't be read fail (the rest of the addon can't be
+// evaluated without their data).
+func WithPreflight(ctx context.Context, pf *Preflight, addonName string) context.Context {
+	return context.WithValue(ctx, preflightKey{}, preflightRun{pf: pf, addonName: addonName})
+}
+
+// checkCapability records in the Preflight of ctx (if any) that the token has
+// none of want on path. Returns false if so.
+func (p *vaultPackage) checkCapability(ctx context.Context, path string, want ...string) (bool, error) {
+	run, ok := ctx.Value(preflightKey{}).(preflightRun)
+	if !ok {
+		return true, nil
+	}
+
+	caps, err := p.capabilities(ctx, path)
+	if err != nil {
+		return false, fmt.Errorf("failed to check capabilities on `%s': %v", path, err)
+	}
+	if hasCapability(caps, want...) {
+		return true, nil
+	}
+	log.Warningf("Vault token lacks %s capability on `%s' (needed by `%s' addon), has: %v", strings.Join(want, " or "), path, run.addonName, caps)
+	run.pf.add(MissingCapability{Addon: run.addonName, Path: path, Capability: strings.Join(want, " or ")})
+	return false, nil
+}
+
+// hasCapability returns true if caps include root or any of want (and not
+// deny).
+func hasCapability(caps []string, want ...string) bool {
+	for _, c := range caps {
+		if c == "deny" {
+			return false
+		}
+	}
+	for _, c := range caps {
+		if c == "root" {
+			return true
+		}
+		for _, w := range want {
+			if c == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// capabilities returns capabilities of the token on path (cached).
+func (p *vaultPackage) capabilities(ctx context.Context, path string) ([]string, error) {
+	p.capsMu.Lock()
+	defer p.capsMu.Unlock()
+	if caps, ok := p.caps[path]; ok {
+		return caps, nil
+	}
+
+	r := p.client.NewRequest("POST", "/v1/sys/capabilities-self")
+	if err := r.SetJSONBody(map[string]interface{}{"paths": []string{path}}); err != nil {
+		return nil, err
+	}
+	resp, err := p.client.RawRequestWithContext(ctx, r)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	s, err := vault.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response: %v", err)
+	}
+	if s == nil || s.Data == nil {
+		return nil, fmt.Errorf("empty response")
+	}
+
+	// Newer Vault versions key capabilities by path, older ones only return
+	// them as `capabilities'.
+	v, ok := s.Data[path]
+	if !ok {
+		v = s.Data["capabilities"]
+	}
+	vs, _ := v.([]interface{})
+	caps := make([]string, 0, len(vs))
+	for _, c := range vs {
+		caps = append(caps, fmt.Sprint(c))
+	}
+
+	if p.caps == nil {
+		p.caps = map[string][]string{}
+	}
+	p.caps[path] = caps
+	return caps, nil
+}
+
+// preflightRead fails if the token can't read path in preflight.
+func (p *vaultPackage) preflightRead(ctx context.Context, path string) error {
+	ok, err := p.checkCapability(ctx, path, capRead)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("preflight: token lacks read capability on `%s'", path)
+	}
+	return nil
+}
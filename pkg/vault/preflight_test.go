@@ -0,0 +1,133 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.starlark.net/starlark"
+
+	"github.com/cruise-automation/isopod/pkg/addon"
+)
+
+func TestPreflight(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		expr string
+		// caps are capabilities of the token by path.
+		caps map[string][]string
+
+		wantMissing []string
+		wantErr     string
+	}{
+		{
+			desc: "All capabilities",
+			expr: "[vault.read('secret/a'), vault.exist('secret/b'), vault.write('secret/c', a='1')]",
+			caps: map[string][]string{
+				"secret/a": {"read"},
+				"secret/b": {"read", "list"},
+				"secret/c": {"update"},
+			},
+		},
+		{
+			desc: "Root token",
+			expr: "[vault.read('secret/a'), vault.write('secret/c', a='1')]",
+			caps: map[string][]string{"secret/a": {"root"}, "secret/c": {"root"}},
+		},
+		{
+			desc:        "Read denied",
+			expr:        "vault.read('secret/a')",
+			caps:        map[string][]string{"secret/a": {"read", "deny"}},
+			wantMissing: []string{"addon `foo': read `secret/a'"},
+			wantErr:     "<vault.read>: preflight: token lacks read capability on `secret/a'",
+		},
+		{
+			desc:        "Raw read missing",
+			expr:        "vault.read_raw('secret/a')",
+			caps:        map[string][]string{"secret/a": {"list"}},
+			wantMissing: []string{"addon `foo': read `secret/a'"},
+			wantErr:     "<vault.read_raw>: preflight: token lacks read capability on `secret/a'",
+		},
+		{
+			desc:        "Write missing",
+			expr:        "[vault.write('secret/c', a='1'), vault.write('secret/d', a='1'), vault.read('secret/a')]",
+			caps:        map[string][]string{"secret/a": {"read"}, "secret/c": {"read"}},
+			wantMissing: []string{"addon `foo': create or update `secret/c'", "addon `foo': create or update `secret/d'"},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			var writes int
+			ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Path == "/v1/sys/capabilities-self":
+					var body struct {
+						Paths []string `json:"paths"`
+					}
+					if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Paths) != 1 {
+						http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+						return
+					}
+					caps := tc.caps[body.Paths[0]]
+					if caps == nil {
+						caps = []string{}
+					}
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"data": map[string]interface{}{body.Paths[0]: caps},
+					})
+				case r.Method == http.MethodGet:
+					fmt.Fprint(w, `{"data": {"foo": "bar"}}`)
+				default:
+					writes++
+				}
+			}))
+			defer ts.Close()
+
+			tv, err := NewFakeWithServer(ts, false /* dryRun */)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pf := &Preflight{}
+			th := &starlark.Thread{}
+			th.SetLocal(addon.GoCtxKey, WithPreflight(addon.WithSilentDryRun(context.Background()), pf, "foo"))
+			_, err = starlark.Eval(th, t.Name(), tc.expr, starlark.StringDict{"vault": tv})
+
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if tc.wantErr != gotErr {
+				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
+			}
+
+			var gotMissing []string
+			for _, m := range pf.Missing() {
+				gotMissing = append(gotMissing, m.String())
+			}
+			if d := cmp.Diff(tc.wantMissing, gotMissing); d != "" {
+				t.Errorf("Unexpected missing capabilities (-want +got):\n%s", d)
+			}
+			if writes != 0 {
+				t.Errorf("Got %d writes in preflight, want none", writes)
+			}
+		})
+	}
+}
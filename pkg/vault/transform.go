@@ -0,0 +1,171 @@
+// Copyright 2019 GM Cruise LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// transforms are the named transforms vault.read can apply to secret values.
+var transforms = map[string]func(string) (string, error){
+	"base64_decode": base64Decode,
+	"base64_encode": func(s string) (string, error) { return base64.StdEncoding.EncodeToString([]byte(s)), nil },
+	"pem_decode":    pemDecode,
+	"url_encode":    func(s string) (string, error) { return url.QueryEscape(s), nil },
+	"trim_space":    func(s string) (string, error) { return strings.TrimSpace(s), nil },
+}
+
+// base64Decode decodes standard base64 encoded s (ignoring whitespace).
+func base64Decode(s string) (string, error) {
+	bs, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
+
+// pemDecode returns PEM encoded data of s which is either PEM already or
+// base64 encoded PEM.
+func pemDecode(s string) (string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(s), "-----BEGIN") {
+		var err error
+		if s, err = base64Decode(s); err != nil {
+			return "", err
+		}
+	}
+	if b, _ := pem.Decode([]byte(s)); b == nil {
+		return "", fmt.Errorf("no PEM block found")
+	}
+	return s, nil
+}
+
+// transform is a single step of transforming of a secret value.
+type transform struct {
+	name string
+	fn   func(t *starlark.Thread, s string) (string, error)
+}
+
+// transformSpec maps secret data keys to transforms applied in order.
+type transformSpec map[string][]transform
+
+// parseTransformSpec parses vault.read transform argument: a dict mapping
+// data keys to name of a transform, a callable taking and returning string or
+// a list of those.
+func parseTransformSpec(d *starlark.Dict) (transformSpec, error) {
+	spec := transformSpec{}
+	if d == nil {
+		return spec, nil
+	}
+	for _, item := range d.Items() {
+		k, ok := item[0].(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("transform key must be a string (got a %s)", item[0].Type())
+		}
+		steps := []starlark.Value{item[1]}
+		if l, ok := item[1].(*starlark.List); ok {
+			steps = nil
+			for i := 0; i < l.Len(); i++ {
+				steps = append(steps, l.Index(i))
+			}
+		}
+		for _, step := range steps {
+			tr, err := parseTransform(step)
+			if err != nil {
+				return nil, fmt.Errorf("invalid transform of key `%s': %v", string(k), err)
+			}
+			spec[string(k)] = append(spec[string(k)], tr)
+		}
+	}
+	return spec, nil
+}
+
+func parseTransform(v starlark.Value) (transform, error) {
+	switch v := v.(type) {
+	case starlark.String:
+		fn, ok := transforms[string(v)]
+		if !ok {
+			var names []string
+			for n := range transforms {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return transform{}, fmt.Errorf("unknown transform `%s' (expected one of %s or a callable)", string(v), strings.Join(names, ", "))
+		}
+		return transform{
+			name: string(v),
+			fn:   func(_ *starlark.Thread, s string) (string, error) { return fn(s) },
+		}, nil
+	case starlark.Callable:
+		return transform{
+			name: v.Name(),
+			fn: func(t *starlark.Thread, s string) (string, error) {
+				res, err := starlark.Call(t, v, starlark.Tuple{starlark.String(s)}, nil)
+				if err != nil {
+					return "", err
+				}
+				out, ok := res.(starlark.String)
+				if !ok {
+					return "", fmt.Errorf("must return a string (got a %s)", res.Type())
+				}
+				return string(out), nil
+			},
+		}, nil
+	}
+	return transform{}, fmt.Errorf("must be a transform name or a callable (got a %s)", v.Type())
+}
+
+// apply transforms values of data read from path in place. Values of KV v2
+// secrets are nested under "data" key.
+func (spec transformSpec) apply(t *starlark.Thread, path string, data map[string]interface{}) error {
+	if len(spec) == 0 {
+		return nil
+	}
+	if _, ok := data["metadata"].(map[string]interface{}); ok {
+		if d, ok := data["data"].(map[string]interface{}); ok {
+			data = d
+		}
+	}
+
+	var keys []string
+	for k := range spec {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, ok := data[k]
+		if !ok {
+			return fmt.Errorf("key `%s' to transform not found in `%s'", k, path)
+		}
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("key `%s' to transform in `%s' is not a string (got a %T)", k, path, v)
+		}
+		for _, tr := range spec[k] {
+			var err error
+			if s, err = tr.fn(t, s); err != nil {
+				return fmt.Errorf("transform `%s' of key `%s' in `%s' failed: %v", tr.name, k, path, err)
+			}
+		}
+		data[k] = s
+	}
+	return nil
+}
@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
 
 	log "github.com/golang/glog"
 	vault "github.com/hashicorp/vault/api"
@@ -36,65 +37,240 @@ type vaultPackage struct {
 	*isopod.Module
 	client *vault.Client
 	dryRun bool
+
+	// IDs of leases of dynamic secrets read so far.
+	leasesMu sync.Mutex
+	leases   []string
+
+	// caps caches capabilities of the token by path (see WithPreflight).
+	capsMu sync.Mutex
+	caps   map[string][]string
+
+	// concurrency is the max number of secrets vault.read_all reads at
+	// once.
+	concurrency int
+}
+
+// defaultConcurrency is the max number of secrets read at once by
+// vault.read_all unless set with WithConcurrency.
+const defaultConcurrency = 8
+
+// Option is an option of the vault package.
+type Option func(*vaultPackage)
+
+// WithConcurrency returns an Option that makes vault.read_all read up to n
+// secrets at once (one at a time if n is not positive).
+func WithConcurrency(n int) Option {
+	return func(p *vaultPackage) {
+		p.concurrency = n
+	}
+}
+
+// SecretReader reads secret data from Vault. Used by other packages (e.g
+// helm) to resolve references to Vault secrets.
+type SecretReader interface {
+	ReadSecret(ctx context.Context, path string) (map[string]interface{}, error)
 }
 
 // New returns a new skaylark.HasAttrs object for vault package.
-func New(c *vault.Client, dryRun bool) *isopod.Module {
+func New(c *vault.Client, dryRun bool, opts ...Option) starlark.HasAttrs {
 	v := &vaultPackage{
-		client: c,
-		dryRun: dryRun,
+		client:      c,
+		dryRun:      dryRun,
+		concurrency: defaultConcurrency,
+	}
+	for _, o := range opts {
+		o(v)
 	}
 	v.Module = &isopod.Module{
 		Name: "vault",
 		Attrs: starlark.StringDict{
 			"read":     starlark.NewBuiltin("vault.read", v.vaultReadFn),
+			"read_all": starlark.NewBuiltin("vault.read_all", v.vaultReadAllFn),
 			"read_raw": starlark.NewBuiltin("vault.read_raw", v.vaultReadRawFn),
 			"write":    starlark.NewBuiltin("vault.write", v.vaultWriteFn),
 			"exist":    starlark.NewBuiltin("vault.exist", v.vaultExistFn),
 		},
 	}
-	return v.Module
+	return v
 }
 
 // vaultReadFn is a starlark built-in function that reads a secret value from
 // vault.
 // Returns a (potentially nested) dict of secret data by the specified Vault
 // path.
+// Values of keys of the optional transform dict are transformed before they
+// are returned (see parseTransformSpec).
 // Usage:
 //   values = vault.read(path)
 //   print(values['foo'])
+//   values = vault.read(path, transform={'tls.crt': 'pem_decode'})
 func (p *vaultPackage) vaultReadFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var path string
-	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &path); err != nil {
+	var transform *starlark.Dict
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "path", &path, "transform?", &transform); err != nil {
 		return nil, fmt.Errorf("<%v>: failed to parse args: %v", b.Name(), err)
 	}
-
-	r := p.client.NewRequest("GET", "/v1/"+path)
+	spec, err := parseTransformSpec(transform)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
 
 	ctx := t.Local(addon.GoCtxKey).(context.Context)
-	resp, err := p.client.RawRequestWithContext(ctx, r)
-	if err != nil {
-		return nil, fmt.Errorf("<%v>: request failed: %v", b.Name(), err)
+	if err := p.preflightRead(ctx, path); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
 	}
-	if err := resp.Error(); err != nil {
-		return nil, fmt.Errorf("<%v>: request failed: %v", b.Name(), err)
+	s, err := p.readSecret(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
 	}
 
-	s, err := vault.ParseSecret(resp.Body)
+	v, err := secretValue(t, path, s, spec)
 	if err != nil {
-		return nil, fmt.Errorf("<%v>: failed to parse secret data: %v", b.Name(), err)
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
 	}
-	if s == nil { // vault client is dumb.
+	return v, nil
+}
+
+// secretValue records version of secret s read from path with the addon
+// run of t and returns its data (None if s is nil) transformed by spec.
+func secretValue(t *starlark.Thread, path string, s *vault.Secret, spec transformSpec) (starlark.Value, error) {
+	if s == nil {
 		return starlark.None, nil
 	}
 
+	if vs, ok := t.Local(addon.SecretVersionsKey).(addon.SecretVersions); ok {
+		vs[path] = secretVersion(s)
+	}
+	if err := spec.apply(t, path, s.Data); err != nil {
+		return nil, err
+	}
+
 	v, err := util.ValueFromNestedMap(s.Data)
 	if err != nil {
-		return nil, fmt.Errorf("<%v>: failed to parse data: %v", b.Name(), err)
+		return nil, fmt.Errorf("failed to parse data: %v", err)
 	}
 	return v, nil
 }
 
+// vaultReadAllFn is a starlark built-in function that reads secrets from
+// vault like vault.read but reads up to p.concurrency paths at once.
+// Returns a list of (potentially nested) dicts of secret data in the order
+// of paths (None for paths that don't exist). The optional transform dict
+// applies to every secret. Fails with the error of the first path (in order
+// of paths) that failed to be read, once all reads are done.
+// Usage:
+//   db, tls = vault.read_all(["secret/infra/db", "secret/infra/tls"])
+func (p *vaultPackage) vaultReadAllFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pathsV starlark.Iterable
+	var transform *starlark.Dict
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "paths", &pathsV, "transform?", &transform); err != nil {
+		return nil, fmt.Errorf("<%v>: failed to parse args: %v", b.Name(), err)
+	}
+	var paths []string
+	it := pathsV.Iterate()
+	defer it.Done()
+	var x starlark.Value
+	for it.Next(&x) {
+		path, ok := starlark.AsString(x)
+		if !ok {
+			return nil, fmt.Errorf("<%v>: path must be a string, got: %s", b.Name(), x.Type())
+		}
+		paths = append(paths, path)
+	}
+	spec, err := parseTransformSpec(transform)
+	if err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	ss, errs := make([]*vault.Secret, len(paths)), make([]error, len(paths))
+	n := p.concurrency
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, path string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if errs[i] = p.preflightRead(ctx, path); errs[i] != nil {
+				return
+			}
+			ss[i], errs[i] = p.readSecret(ctx, path)
+		}(i, path)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("<%v>: `%s': %v", b.Name(), paths[i], err)
+		}
+	}
+
+	vs := make([]starlark.Value, len(paths))
+	for i, path := range paths {
+		if vs[i], err = secretValue(t, path, ss[i], spec); err != nil {
+			return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+		}
+	}
+	return starlark.NewList(vs), nil
+}
+
+// ReadSecret implements SecretReader.ReadSecret. Returns nil data if secret
+// at path does not exist.
+func (p *vaultPackage) ReadSecret(ctx context.Context, path string) (map[string]interface{}, error) {
+	if err := p.preflightRead(ctx, path); err != nil {
+		return nil, err
+	}
+	s, err := p.readSecret(ctx, path)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	if vs := addon.SecretVersionsFrom(ctx); vs != nil {
+		vs[path] = secretVersion(s)
+	}
+	return s.Data, nil
+}
+
+// secretVersion returns version of s as reported by KV v2 secrets engine
+// (.data.metadata.version). Returns empty string for unversioned (e.g KV v1)
+// and dynamic secrets, which may differ on every read.
+func secretVersion(s *vault.Secret) string {
+	if md, ok := s.Data["metadata"].(map[string]interface{}); ok {
+		if v, ok := md["version"]; ok && v != nil {
+			return fmt.Sprint(v)
+		}
+	}
+	return ""
+}
+
+// readSecret reads secret at path. Returns nil if it does not exist.
+func (p *vaultPackage) readSecret(ctx context.Context, path string) (*vault.Secret, error) {
+	r := p.client.NewRequest("GET", "/v1/"+path)
+
+	resp, err := p.client.RawRequestWithContext(ctx, r)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+	if err := resp.Error(); err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+
+	s, err := vault.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse secret data: %v", err)
+	}
+	if s != nil && s.LeaseID != "" {
+		p.addLease(s.LeaseID)
+	}
+	return s, nil
+}
+
 // vaultReadRawFn is a starlark built-in function that reads a raw JSON value
 // from vault endpoint.
 // Returns a (potentially nested) dict of raw JSON data read by the specified
@@ -107,6 +283,9 @@ func (p *vaultPackage) vaultReadRawFn(t *starlark.Thread, b *starlark.Builtin, a
 	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &path); err != nil {
 		return nil, fmt.Errorf("<%v>: failed to parse args: %v", b.Name(), err)
 	}
+	if err := p.preflightRead(t.Local(addon.GoCtxKey).(context.Context), path); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
 
 	r := p.client.NewRequest("GET", "/v1/"+path)
 
@@ -159,12 +338,16 @@ func (p *vaultPackage) vaultWriteFn(t *starlark.Thread, b *starlark.Builtin, arg
 		return nil, fmt.Errorf("failed to set request body to %v: %v", data, err)
 	}
 
-	if p.dryRun {
+	ctx := t.Local(addon.GoCtxKey).(context.Context)
+	// Writes are only previewed in preflight (see WithPreflight).
+	if _, err := p.checkCapability(ctx, path, capCreate, capUpdate); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
+	if p.dryRun || addon.IsDryRun(ctx) {
 		log.V(1).Infof("<%v>: dry run: %v", b.Name(), r)
 		return starlark.None, nil
 	}
 
-	ctx := t.Local(addon.GoCtxKey).(context.Context)
 	resp, err := p.client.RawRequestWithContext(ctx, r)
 	if err != nil {
 		return nil, fmt.Errorf("<%v>: request failed: %v", b.Name(), err)
@@ -191,6 +374,9 @@ func (p *vaultPackage) vaultExistFn(t *starlark.Thread, b *starlark.Builtin, arg
 	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &path); err != nil {
 		return nil, fmt.Errorf("<%v>: failed to parse args: %v", b.Name(), err)
 	}
+	if err := p.preflightRead(t.Local(addon.GoCtxKey).(context.Context), path); err != nil {
+		return nil, fmt.Errorf("<%v>: %v", b.Name(), err)
+	}
 	r := p.client.NewRequest("GET", "/v1/"+path)
 
 	ctx := t.Local(addon.GoCtxKey).(context.Context)
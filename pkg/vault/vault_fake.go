@@ -23,8 +23,6 @@ import (
 
 	vault "github.com/hashicorp/vault/api"
 	"go.starlark.net/starlark"
-
-	isopod "github.com/cruise-automation/isopod/pkg"
 )
 
 type fakeVault struct {
@@ -80,7 +78,7 @@ func NewFake() (m starlark.HasAttrs, closeFn func(), err error) {
 
 // NewFakeWithServer returns a new fake vault module that uses s as its HTTP
 // server.
-func NewFakeWithServer(s *httptest.Server, dryRun bool) (*isopod.Module, error) {
+func NewFakeWithServer(s *httptest.Server, dryRun bool) (starlark.HasAttrs, error) {
 	c, err := vault.NewClient(&vault.Config{
 		Address:    s.URL,
 		HttpClient: s.Client(),
@@ -15,15 +15,23 @@
 package vault
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	vault "github.com/hashicorp/vault/api"
 	"go.starlark.net/starlark"
 
+	"github.com/cruise-automation/isopod/pkg/addon"
 	util "github.com/cruise-automation/isopod/pkg/testing"
 )
 
@@ -78,6 +86,17 @@ func fakeServer(t *testing.T, wantValues map[string]string, rawData string) *htt
 	}))
 }
 
+const testPEM = "-----BEGIN CERTIFICATE-----\nYWJj\n-----END CERTIFICATE-----\n"
+
+// dsn assembles a connection string from a password.
+var dsn = starlark.NewBuiltin("dsn", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var password string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &password); err != nil {
+		return nil, err
+	}
+	return starlark.String("postgres://app:" + password + "@db/app"), nil
+})
+
 func TestVault(t *testing.T) {
 
 	for _, tc := range []struct {
@@ -96,6 +115,47 @@ func TestVault(t *testing.T) {
 			rawData:    `{"data": {"a": "b", "c": 1, "d": false, "e": [1, 2, 3], "f": null}}`,
 			wantResult: `map["a":"b" "c":1 "d":False "e":[1, 2, 3] "f":None]`,
 		},
+		{
+			desc:       "Read transformed secret",
+			expr:       "vault.read('foo/bar', transform={'cert': ['pem_decode', 'trim_space'], 'password': ['url_encode', dsn]})",
+			rawData:    `{"data": {"cert": "` + base64.StdEncoding.EncodeToString([]byte(testPEM)) + `", "password": "p@ss word"}}`,
+			wantResult: `map["cert":"-----BEGIN CERTIFICATE-----\nYWJj\n-----END CERTIFICATE-----" "password":"postgres://app:p%40ss+word@db/app"]`,
+		},
+		{
+			desc:       "Read transformed KV v2 secret",
+			expr:       "vault.read('foo/bar', transform={'a': 'base64_decode'})",
+			rawData:    `{"data": {"data": {"a": "Yg=="}, "metadata": {"version": 3}}}`,
+			wantResult: `map["data":map["a":"b"] "metadata":map["version":3]]`,
+		},
+		{
+			desc:    "Unknown transform",
+			expr:    "vault.read('foo/bar', transform={'a': 'rot13'})",
+			rawData: `{"data": {"a": "b"}}`,
+			wantErr: "<vault.read>: invalid transform of key `a': unknown transform `rot13' (expected one of base64_decode, base64_encode, pem_decode, trim_space, url_encode or a callable)",
+		},
+		{
+			desc:    "Failing transform",
+			expr:    "vault.read('foo/bar', transform={'a': 'pem_decode'})",
+			rawData: `{"data": {"a": "Yg=="}}`,
+			wantErr: "<vault.read>: transform `pem_decode' of key `a' in `foo/bar' failed: no PEM block found",
+		},
+		{
+			desc:    "Missing transformed key",
+			expr:    "vault.read('foo/bar', transform={'x': 'trim_space'})",
+			rawData: `{"data": {"a": "b"}}`,
+			wantErr: "<vault.read>: key `x' to transform not found in `foo/bar'",
+		},
+		{
+			desc:       "Read all secrets",
+			expr:       "vault.read_all(['foo/bar', 'foo/bar'], transform={'a': 'base64_decode'})",
+			rawData:    `{"data": {"a": "Yg=="}}`,
+			wantResult: `[map["a":"b"], map["a":"b"]]`,
+		},
+		{
+			desc:    "Read all with non-string path",
+			expr:    "vault.read_all(['foo/bar', 1])",
+			wantErr: "<vault.read_all>: path must be a string, got: int",
+		},
 		{
 			desc:       "Read raw data from `foo/bar'",
 			expr:       "vault.read_raw('foo/bar')",
@@ -130,7 +190,7 @@ func TestVault(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			pkgs := starlark.StringDict{"vault": tv}
+			pkgs := starlark.StringDict{"vault": tv, "dsn": dsn}
 			v, _, err := util.Eval(t.Name(), tc.expr, nil, pkgs)
 
 			gotErr := ""
@@ -140,6 +200,9 @@ func TestVault(t *testing.T) {
 			if tc.wantErr != gotErr {
 				t.Fatalf("Unexpected error.\nWant: %s\nGot: %s", tc.wantErr, gotErr)
 			}
+			if err != nil {
+				return
+			}
 
 			if tc.wantResult != v.String() {
 				t.Fatalf("Unexpected expression result.\nWant: %s\nGot: %s", tc.wantResult, v.String())
@@ -148,3 +211,113 @@ func TestVault(t *testing.T) {
 		})
 	}
 }
+
+func TestSecretVersion(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		secret *vault.Secret
+		want   string
+	}{
+		{
+			desc: "KV v2 secret",
+			secret: &vault.Secret{Data: map[string]interface{}{
+				"data":     map[string]interface{}{"a": "b"},
+				"metadata": map[string]interface{}{"version": json.Number("3")},
+			}},
+			want: "3",
+		},
+		{
+			desc:   "Unversioned secret",
+			secret: &vault.Secret{Data: map[string]interface{}{"a": "b"}},
+			want:   "",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := secretVersion(tc.secret); got != tc.want {
+				t.Errorf("Unexpected version.\nWant: %s\nGot: %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestReadSecretVersions(t *testing.T) {
+	ts := fakeServer(t, nil, `{"data": {"data": {"a": "b"}, "metadata": {"version": 3}}}`)
+	defer ts.Close()
+	tv, err := NewFakeWithServer(ts, false /* dryRun */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr := tv.(SecretReader)
+
+	if _, err := sr.ReadSecret(context.Background(), "foo/bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	vs := addon.SecretVersions{}
+	if _, err := sr.ReadSecret(addon.WithSecretVersions(context.Background(), vs), "foo/bar"); err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(addon.SecretVersions{"foo/bar": "3"}, vs); d != "" {
+		t.Errorf("Unexpected secret versions (-want, +got):\n%s", d)
+	}
+}
+
+func TestReadAllConcurrency(t *testing.T) {
+	const concurrency = 3
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		// Hold the request until the pool is full (or for long enough that
+		// it would have been) so that the max number in flight is reached.
+		for i := 0; i < 100; i++ {
+			mu.Lock()
+			full := maxInFlight >= concurrency
+			mu.Unlock()
+			if full {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+
+		if r.URL.Path == "/v1/secret/denied" {
+			http.Error(w, `{"errors": ["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `{"data": {"path": %q}}`, strings.TrimPrefix(r.URL.Path, "/v1/"))
+	}))
+	defer ts.Close()
+
+	c, err := vault.NewClient(&vault.Config{Address: ts.URL, HttpClient: ts.Client()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs := starlark.StringDict{"vault": New(c, false /* dryRun */, WithConcurrency(concurrency))}
+
+	v, _, err := util.Eval(t.Name(), "vault.read_all(['secret/a', 'secret/b', 'secret/c', 'secret/d', 'secret/e'])", nil, pkgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[map["path":"secret/a"], map["path":"secret/b"], map["path":"secret/c"], map["path":"secret/d"], map["path":"secret/e"]]`
+	if got := v.String(); got != want {
+		t.Errorf("Unexpected result.\nWant: %s\nGot: %s", want, got)
+	}
+	if maxInFlight != concurrency {
+		t.Errorf("Unexpected max number of reads in flight, want %d got %d", concurrency, maxInFlight)
+	}
+
+	_, _, err = util.Eval(t.Name(), "vault.read_all(['secret/a', 'secret/denied', 'secret/b'])", nil, pkgs)
+	if err == nil || !strings.HasPrefix(err.Error(), "<vault.read_all>: `secret/denied': request failed") {
+		t.Errorf("Expected failure of denied path, got: %v", err)
+	}
+}